@@ -13,17 +13,20 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	orderedmap "github.com/wk8/go-ordered-map/v2"
 
 	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
 	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/server"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/transport"
 )
 
 var (
@@ -32,6 +35,13 @@ var (
 	address = flag.String("address", "0.0.0.0:43210", "The IP address and port to use for listening for client connections")
 	labels  = flag.String("labels", "", "Comma separated list of key=value pairs")
 	taints  = flag.String("taints", "", "Comma separated list of key=value pairs")
+
+	cpuFallbackSessions = flag.Int("cpu-fallback-sessions", 0, "The number of concurrent sessions to accept using CPU rendering (llvmpipe) when the GPUs are unavailable, 0 disables")
+	cpuFallbackIcd      = flag.String("cpu-fallback-icd", "/usr/share/vulkan/icd.d/lvp_icd.x86_64.json", "Path to the Vulkan ICD used by CPU fallback sessions")
+
+	maxSessionsPerGpu = flag.Int("max-sessions-per-gpu", 0, "The maximum number of concurrent sessions placed on each GPU regardless of the VRAM available, 0 is unlimited")
+
+	sessionToken = flag.String("session-token", "", "Pre-shared token clients must present to request sessions directly from the agent, e.g. juicify --agent")
 )
 
 type Reference[T any] struct {
@@ -69,6 +79,7 @@ type Agent struct {
 	JuicePath string
 
 	Gpus               *gpu.GpuSet
+	GpuBackend         cmdgpu.Backend
 	GpuMetricsProvider *cmdgpu.MetricsProvider
 
 	Server *server.Server
@@ -76,9 +87,45 @@ type Agent struct {
 	labels map[string]string
 	taints map[string]string
 
+	cpuFallbackCapacity int
+
+	// Renderers started ahead of sessions, nil when --warm-renderers-per-gpu is 0
+	warm *warmPool
+
+	// Nil when checking for leaked VRAM is disabled, see --vram-leak-delay
+	leaks *vramLeaks
+
+	// Nil when checking the health of GPUs is disabled, see --gpu-health-interval
+	health *gpuHealth
+
+	// Nil when enforcing fairness between the sessions sharing a GPU is disabled, see
+	// --gpu-fairness-interval
+	fairness *gpuFairness
+
+	// Whether the controller drains the agent and whether its last session has since finished,
+	// only read and written by the controller update loop
+	draining bool
+	drained  bool
+
 	sessionsMutex sync.Mutex
 	sessions      *orderedmap.OrderedMap[string, *Reference[session.Session]]
 
+	networkConsumers []NetworkMetricsConsumerFn
+	frameConsumers   []FrameMetricsConsumerFn
+
+	fairnessConsumers []FairnessMetricsConsumerFn
+
+	// Accepts client connections over QUIC, nil when disabled, see --quic-address
+	quic *transport.Listener
+
+	// Whether the agent runs without root and the features it forgoes, see restapi.Capability*
+	rootless bool
+	forgone  []string
+
+	// The results of the checks run on startup reported to the controller, nil when --self-test is
+	// disabled
+	selfTest *restapi.SelfTest
+
 	controllerData
 }
 
@@ -99,6 +146,20 @@ func NewAgent(tlsConfig *tls.Config) (*Agent, error) {
 		labels:    map[string]string{},
 		taints:    map[string]string{},
 		sessions:  orderedmap.New[string, *Reference[session.Session]](),
+
+		cpuFallbackCapacity: *cpuFallbackSessions,
+	}
+
+	// Replaced by the id the controller registers the agent with
+	logger.SetField(logger.FieldAgentId, agent.Id)
+
+	agent.quic, err = newQuicListener(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if agent.quic != nil {
+		server.AddListener(agent.quic)
 	}
 
 	if *labels != "" {
@@ -151,17 +212,72 @@ func NewAgent(tlsConfig *tls.Config) (*Agent, error) {
 
 	rendererWinPath := filepath.Join(agent.JuicePath, "Renderer_Win")
 
-	agent.Gpus, err = cmdgpu.DetectGpus(rendererWinPath)
+	agent.GpuBackend, err = cmdgpu.SelectBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	agent.Gpus, err = cmdgpu.DetectGpus(agent.GpuBackend, rendererWinPath)
 	if err != nil {
 		return nil, err
 	}
 
+	if *maxSessionsPerGpu < 0 {
+		return nil, errors.New("Agent.NewAgent: --max-sessions-per-gpu must not be negative")
+	}
+
+	agent.Gpus.LimitSessionsPerGpu(*maxSessionsPerGpu)
+
+	capabilities := agent.GpuBackend.Capabilities()
+	if len(capabilities) == 0 {
+		capabilities = []string{"detection only"}
+	}
+	logger.Infof("GPU backend: %s (%s)", agent.GpuBackend.Name(), strings.Join(capabilities, ", "))
+
 	logger.Info("GPUs")
 	for _, gpu := range agent.Gpus.GetGpus() {
 		logger.Infof("  %d @ %s: %s %dMB", gpu.Index, gpu.PciBus, gpu.Name, gpu.Vram/(1024*1024))
 	}
 
-	agent.GpuMetricsProvider = cmdgpu.NewMetricsProvider(agent.Gpus, rendererWinPath)
+	if *maxSessionsPerGpu > 0 {
+		logger.Infof("Sessions per GPU: %d", *maxSessionsPerGpu)
+	}
+
+	err = shareGpus(agent.Gpus)
+	if err != nil {
+		return nil, err
+	}
+
+	if agent.cpuFallbackCapacity > 0 {
+		logger.Infof("CPU fallback: %d sessions using %s", agent.cpuFallbackCapacity, *cpuFallbackIcd)
+	}
+
+	agent.GpuMetricsProvider = cmdgpu.NewMetricsProvider(agent.GpuBackend, agent.Gpus, rendererWinPath)
+
+	// Before any renderer is started, including those of the warm pool
+	agent.leaks = newVramLeaks(agent.GpuBackend, agent.Gpus)
+
+	agent.fairness = newGpuFairness(agent.GpuBackend)
+
+	agent.health, err = newGpuHealth(agent.GpuBackend, agent.Gpus)
+	if err != nil {
+		return nil, err
+	}
+
+	err = agent.initializePrivileged()
+	if err != nil {
+		return nil, err
+	}
+
+	pciBuses := []string{}
+	for _, gpu := range agent.Gpus.GetGpus() {
+		pciBuses = append(pciBuses, gpu.PciBus)
+	}
+
+	agent.warm, err = newWarmPool(agent.JuicePath, pciBuses)
+	if err != nil {
+		return nil, err
+	}
 
 	agent.initializeEndpoints()
 
@@ -175,6 +291,20 @@ func (agent *Agent) getSessionsCount() int {
 	return agent.sessions.Len()
 }
 
+func (agent *Agent) getCpuFallbackSessionsCount() int {
+	agent.sessionsMutex.Lock()
+	defer agent.sessionsMutex.Unlock()
+
+	count := 0
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		if pair.Value.Object.CpuFallback() {
+			count++
+		}
+	}
+
+	return count
+}
+
 func (agent *Agent) getSession(id string) (*Reference[session.Session], error) {
 	agent.sessionsMutex.Lock()
 	defer agent.sessionsMutex.Unlock()
@@ -187,16 +317,16 @@ func (agent *Agent) getSession(id string) (*Reference[session.Session], error) {
 		}
 	}
 
-	return nil, fmt.Errorf("no session found with id %s", id)
+	return nil, pkgerrors.Errorf(pkgerrors.ErrNotFound, "no session found with id %s", id)
 }
 
 func (agent *Agent) addSession(session *session.Session) *Reference[session.Session] {
-	logger.Tracef("Starting Session %s", session.Id())
+	logger.WithSession(session.Id()).Tracef("Starting Session %s", session.Id())
 
 	reference := NewReference(session, func() {
 		err := session.Close()
 		if err != nil {
-			logger.Errorf("session %s experienced a failure during closing, %v", session.Id(), err)
+			logger.WithSession(session.Id()).Errorf("session %s experienced a failure during closing, %v", session.Id(), err)
 		}
 
 		agent.sessionsMutex.Lock()
@@ -213,20 +343,94 @@ func (agent *Agent) addSession(session *session.Session) *Reference[session.Sess
 	return reference
 }
 
+// Returns the pool the agent's sessions are placed from, see restapi.PoolLabel
+func (agent *Agent) Pool() string {
+	pool := agent.labels[restapi.PoolLabel]
+	if pool == "" {
+		return restapi.DefaultPool
+	}
+
+	return pool
+}
+
 func (agent *Agent) Run(group task.Group) error {
-	group.Go("Agent GpuMetricsProvider", agent.GpuMetricsProvider)
+	if cmdgpu.HasCapability(agent.GpuBackend, restapi.CapabilityGpuMetrics) {
+		group.Go("Agent GpuMetricsProvider", agent.GpuMetricsProvider)
+	}
 	group.Go("Agent Server", agent.Server)
+	group.GoFn("Agent NetworkMetrics", agent.runNetworkMetrics)
+	if agent.warm != nil {
+		group.GoFn("Agent WarmRenderers", agent.warm.run)
+	}
+	if agent.leaks != nil {
+		group.GoFn("Agent VramLeaks", agent.runVramLeaks)
+	}
+	if agent.fairness != nil {
+		group.GoFn("Agent GpuFairness", agent.runGpuFairness)
+	}
+	if agent.health != nil {
+		group.GoFn("Agent GpuHealth", agent.runGpuHealth)
+	}
+	if *idleCheckInterval > 0 {
+		group.GoFn("Agent IdleSessions", agent.runIdleSessions)
+	}
 	return nil
 }
 
-func (agent *Agent) runSession(group task.Group, id string, juicePath string, version string, gpus *gpu.SelectedGpuSet) error {
-	reference := agent.addSession(session.New(id, juicePath, version, gpus, agent))
+func (agent *Agent) runSession(group task.Group, id string, juicePath string, version string, tenant string, dataChannel *restapi.DataChannelPolicy, idleTimeout time.Duration, metricsPort int, record bool, gpus *gpu.SelectedGpuSet, cpuFallback bool) error {
+	newSession := session.New(id, juicePath, version, gpus, agent)
+	newSession.SetTenant(tenant)
+	if dataChannel != nil {
+		newSession.SetDataChannelPolicy(*dataChannel)
+	}
+	newSession.SetIdleTimeout(idleTimeout)
+	newSession.SetMetricsPort(metricsPort)
+	if cpuFallback {
+		newSession.UseCpuFallback(*cpuFallbackIcd)
+	}
+
+	reference := agent.addSession(newSession)
+
+	var err error
+	if record {
+		err = agent.startRecording(group.Ctx(), newSession)
+	}
+
+	if err == nil {
+		err = agent.runHook(group.Ctx(), preSessionHookName, *preSessionHook, newSession, gpus)
+	}
+	if err != nil {
+		newSession.Fail()
+	} else {
+		// Warm renderers are started from the agent's own Renderer_Win on a single GPU
+		if !cpuFallback && gpus.Count() == 1 && juicePath == agent.JuicePath {
+			renderer := agent.warm.take(gpus.GetPciBusString())
+			if renderer != nil {
+				logger.WithSession(id).Debugf("session %s started on warm renderer %s", id, renderer.Id())
+				newSession.UseRenderer(renderer)
+			}
+		}
+
+		err = reference.Object.Start(group)
+	}
 
-	err := reference.Object.Start(group)
 	if err == nil {
 		group.GoFn("Agent runSession", func(group task.Group) error {
 			err := reference.Object.Wait()
+
+			hookErr := agent.runHook(group.Ctx(), postSessionHookName, *postSessionHook, newSession, gpus)
+			if hookErr != nil {
+				logger.Warning(hookErr)
+			}
+
+			// Read before the session is closed with its last reference
+			apiSession := newSession.Session()
+			rendererPid := newSession.RendererPid()
+			agent.setLogExcerpt(id, newSession.LogExcerpt(*sessionLogExcerptSize))
+
 			reference.Release()
+
+			agent.checkVramReleased(group, apiSession, rendererPid)
 			return err
 		})
 	} else {
@@ -237,20 +441,49 @@ func (agent *Agent) runSession(group task.Group, id string, juicePath string, ve
 }
 
 func (agent *Agent) requestSession(group task.Group, sessionRequirements restapi.SessionRequirements) (string, error) {
+	id := uuid.NewString()
+
+	unsupported := agent.unsupportedCapability(sessionRequirements.RequireCapabilities)
+	if unsupported != "" {
+		return "", pkgerrors.Errorf(pkgerrors.ErrUnavailable, "Agent.startSession: the agent does not support %s", unsupported)
+	}
+
+	// The keys of recordings are escrowed by the controller
+	if sessionRequirements.Record {
+		return "", pkgerrors.New(pkgerrors.ErrUnavailable, "Agent.startSession: recorded sessions must be requested from the controller")
+	}
+
+	// Only the controller holds capacity for reservations
+	if sessionRequirements.Reservation != nil {
+		return "", pkgerrors.New(pkgerrors.ErrUnavailable, "Agent.startSession: reserved sessions must be requested from the controller")
+	}
+
 	selectedGpus, err := agent.Gpus.Find(sessionRequirements.Gpus)
 	if err != nil {
-		return "", fmt.Errorf("Agent.startSession: unable to find a matching set of GPUs")
+		if sessionRequirements.AllowCpuFallback && agent.cpuFallbackCapacity > 0 {
+			if agent.getCpuFallbackSessionsCount() < agent.cpuFallbackCapacity {
+				return id, agent.runSession(group, id, agent.JuicePath, sessionRequirements.Version, sessionRequirements.Tenant, nil, idleTimeoutOf(sessionRequirements.IdleTimeoutSeconds), sessionRequirements.MetricsPort, false, &gpu.SelectedGpuSet{}, true)
+			}
+
+			return "", pkgerrors.Errorf(pkgerrors.ErrQuotaExceeded, "Agent.startSession: unable to find a matching set of GPUs and all %d CPU rendering fallback sessions are in use", agent.cpuFallbackCapacity)
+		}
+
+		return "", pkgerrors.New(pkgerrors.ErrUnavailable, "Agent.startSession: unable to find a matching set of GPUs")
 	}
 
-	id := uuid.NewString()
-	return id, agent.runSession(group, id, agent.JuicePath, sessionRequirements.Version, selectedGpus)
+	return id, agent.runSession(group, id, agent.JuicePath, sessionRequirements.Version, sessionRequirements.Tenant, nil, idleTimeoutOf(sessionRequirements.IdleTimeoutSeconds), sessionRequirements.MetricsPort, false, selectedGpus, false)
 }
 
 func (agent *Agent) registerSession(group task.Group, apiSession restapi.Session) error {
+	if apiSession.CpuFallback {
+		return agent.runSession(group, apiSession.Id, agent.JuicePath, apiSession.Version, apiSession.Tenant, apiSession.DataChannel, idleTimeoutOf(apiSession.IdleTimeoutSeconds), apiSession.MetricsPort, apiSession.Record, &gpu.SelectedGpuSet{}, true)
+	}
+
 	selectedGpus, err := agent.Gpus.Select(apiSession.Gpus)
 	if err != nil {
-		return fmt.Errorf("Agent.registerSession: unable to select a matching set of GPUs")
+		// The controller assigned GPUs the agent does not have available
+		return pkgerrors.New(pkgerrors.ErrConflict, "Agent.registerSession: unable to select a matching set of GPUs")
 	}
 
-	return agent.runSession(group, apiSession.Id, agent.JuicePath, apiSession.Version, selectedGpus)
+	return agent.runSession(group, apiSession.Id, agent.JuicePath, apiSession.Version, apiSession.Tenant, apiSession.DataChannel, idleTimeoutOf(apiSession.IdleTimeoutSeconds), apiSession.MetricsPort, apiSession.Record, selectedGpus, false)
 }
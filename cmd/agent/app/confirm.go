@@ -0,0 +1,71 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Returns an error describing why the agent cannot take the session now. The controller places
+// sessions by the state the agent last reported, which may have drifted since, such as GPUs found
+// with leaked VRAM or sessions the agent has yet to report.
+func (agent *Agent) canTakeSession(id string, confirmation restapi.AssignmentConfirmation) error {
+	agent.sessionsMutex.Lock()
+	_, running := agent.sessions.Get(id)
+	agent.sessionsMutex.Unlock()
+
+	// Already taken, the controller is retrying an assignment it did not see through
+	if running {
+		return nil
+	}
+
+	if confirmation.CpuFallback {
+		if agent.getCpuFallbackSessionsCount() >= agent.cpuFallbackCapacity {
+			return fmt.Errorf("all %d CPU rendering fallback sessions are in use", agent.cpuFallbackCapacity)
+		}
+
+		return nil
+	}
+
+	return agent.Gpus.CanSelect(confirmation.Gpus)
+}
+
+// Answers whether the agent can take the session on the GPUs the controller chose for it, without
+// reserving them. The controller assigns the session only once the agent accepts.
+func (agent *Agent) confirmSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/confirm/session/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			confirmation, err := pkgnet.ReadRequestBody[restapi.AssignmentConfirmation](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			confirmed := restapi.AssignmentConfirmed{
+				Accepted: true,
+			}
+
+			err = agent.canTakeSession(mux.Vars(r)["id"], confirmation)
+			if err != nil {
+				confirmed.Accepted = false
+				confirmed.Reason = err.Error()
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, confirmed)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -4,15 +4,20 @@
 package app
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
@@ -22,39 +27,205 @@ var (
 	controllerAddress    = flag.String("controller", "", "The IP address and port of the controller")
 	disableControllerTls = flag.Bool("controller-disable-tls", true, "")
 
-	expose = flag.String("expose", "", "The IP address and port to expose through the controller for clients to see. The value is not checked for correctness.")
+	controllerBootstrapToken = flag.String("controller-bootstrap-token", "", "Token used to request a certificate from the controller's certificate authority")
+	joinToken                = flag.String("join-token", "", "Token used to adopt the identity of an agent pre-registered with the controller")
+	controllerToken          = flag.String("controller-token", "", "Bearer token presented to the controller, required when its authorization policy restricts the agent endpoints to tokens")
+
+	controllerCaFile   = flag.String("controller-ca-file", "", "Certificates of the authorities the controller's certificate is verified against, the system's when not set")
+	controllerCertFile = flag.String("controller-cert-file", "", "Client certificate presented to the controller, such as one issued to the agent by an organization's PKI trusted through the controller's --client-ca-file. Requires --controller-key-file")
+	controllerKeyFile  = flag.String("controller-key-file", "", "Private key of --controller-cert-file")
+
+	sessionLogExcerptSize = flag.Int("session-log-excerpt-size", 4096, "Bytes at the end of a closed session's renderer log reported to the controller, 0 disables")
+
+	preemptionGrace = flag.Duration("preemption-grace", 10*time.Second, "How long the renderer of a session the controller preempts is given to exit once asked to before it is killed, see the controller's --priority-preemption. 0 kills it immediately, as are renderers that cannot be asked to exit, such as on Windows")
+
+	expose = flag.String("expose", "", "The IP address and port to expose through the controller for clients to see. The value is not checked for correctness. When the IP address is omitted, e.g. :43210, the controller uses the address the agent connects from.")
 )
 
 type sessionUpdate struct {
-	Id    string
-	State string
+	Id         string
+	State      string
+	ExitStatus string
 }
 
 type controllerData struct {
 	api restapi.Client
 
-	sessionUpdates chan sessionUpdate
+	sessionUpdates *pendingSessionUpdates
+	events         chan restapi.Event
 
 	gpuMetricsMutex sync.Mutex
 	gpuMetrics      []restapi.GpuMetrics
+
+	networkMetricsMutex sync.Mutex
+	networkMetrics      map[string]restapi.NetworkMetrics
+
+	// Sent with the updates closing the sessions, by session id
+	logExcerptsMutex sync.Mutex
+	logExcerpts      map[string]string
+
+	certificateMutex    sync.Mutex
+	certificate         *tls.Certificate
+	certificateIssued   time.Time
+	certificateNotAfter time.Time
+
+	stale staleSessions
+
+	// Events the controller has not received, kept across the updates that fail while the agent
+	// cannot reach it. Only used by the controller update task
+	unsentEvents []restapi.Event
+
+	// Assigned by the controller at registration, zero for controllers that do not assign one
+	heartbeat restapi.HeartbeatSchedule
+}
+
+// Interval between updates when the controller does not assign a heartbeat schedule
+const defaultHeartbeatInterval = 5 * time.Second
+
+// Returns the delay until the next update, at the offset within the interval assigned by the controller
+func (agent *Agent) nextHeartbeat(now time.Time) time.Duration {
+	interval := agent.heartbeat.Interval
+	if interval <= 0 {
+		return defaultHeartbeatInterval
+	}
+
+	phase := time.Duration(now.UnixNano() % int64(interval))
+	delay := agent.heartbeat.Offset - phase
+	if delay <= 0 {
+		delay += interval
+	}
+
+	return delay
+}
+
+func (agent *Agent) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	agent.certificateMutex.Lock()
+	defer agent.certificateMutex.Unlock()
+
+	if agent.certificate == nil {
+		return &tls.Certificate{}, nil
+	}
+
+	return agent.certificate, nil
+}
+
+func (agent *Agent) requestCertificate(ctx context.Context, tlsConfig *tls.Config) error {
+	host, _, err := net.SplitHostPort(*expose)
+	if err != nil {
+		return err
+	}
+
+	csr, key, err := crypto.GenerateCsr(agent.Hostname, agent.Hostname, host)
+	if err != nil {
+		return err
+	}
+
+	issued, err := agent.api.RequestAgentCertificateWithContext(ctx, restapi.CertificateRequest{
+		Token: *controllerBootstrapToken,
+		Csr:   string(csr),
+	})
+	if err != nil {
+		return fmt.Errorf("Agent.requestCertificate: failed with %s", err)
+	}
+
+	certificate, err := tls.X509KeyPair([]byte(issued.Certificate), key)
+	if err != nil {
+		return err
+	}
+
+	agent.certificateMutex.Lock()
+	defer agent.certificateMutex.Unlock()
+
+	agent.certificate = &certificate
+	agent.certificateIssued = time.Now()
+	agent.certificateNotAfter = issued.NotAfter
+
+	if !*disableControllerTls && tlsConfig.RootCAs == nil {
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM([]byte(issued.CaCertificate)) {
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	logger.Infof("Issued certificate by controller, expires %s", issued.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (agent *Agent) certificateNeedsRenewal() bool {
+	agent.certificateMutex.Lock()
+	defer agent.certificateMutex.Unlock()
+
+	// Certificates loaded from --controller-cert-file are not issued by the controller
+	if agent.certificate == nil || agent.certificateIssued.IsZero() {
+		return false
+	}
+
+	// Renew once half of the certificate's lifetime has elapsed
+	halfLife := agent.certificateNotAfter.Sub(agent.certificateIssued) / 2
+	return time.Now().After(agent.certificateIssued.Add(halfLife))
+}
+
+// Configures the certificates used to connect to the controller from --controller-ca-file,
+// --controller-cert-file, and --controller-key-file
+func (agent *Agent) loadControllerCertificates(tlsConfig *tls.Config) error {
+	if (*controllerCertFile == "") != (*controllerKeyFile == "") {
+		return errors.New("--controller-cert-file and --controller-key-file must be set together")
+	}
+
+	if *controllerCertFile != "" && *controllerBootstrapToken != "" {
+		return errors.New("--controller-cert-file and --controller-bootstrap-token are mutually exclusive")
+	}
+
+	if *controllerCaFile != "" {
+		pool, err := crypto.AppendCertsFromFile(nil, *controllerCaFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if *controllerCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(*controllerCertFile, *controllerKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the certificate %s, %v", *controllerCertFile, err)
+		}
+
+		agent.certificateMutex.Lock()
+		defer agent.certificateMutex.Unlock()
+
+		agent.certificate = &certificate
+	}
+
+	return nil
 }
 
 func (agent *Agent) ConnectToController(group task.Group) error {
 	if *controllerAddress != "" {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify:   *disableControllerTls,
+			GetClientCertificate: agent.getClientCertificate,
+		}
+
+		err := agent.loadControllerCertificates(tlsConfig)
+		if err != nil {
+			return err
+		}
+
 		agent.api = restapi.Client{
 			Client: &http.Client{
 				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						InsecureSkipVerify: *disableControllerTls,
-					},
+					TLSClientConfig: tlsConfig,
 				},
 			},
 			Scheme:  "https",
 			Address: *controllerAddress,
+			Token:   *controllerToken,
 		}
 
-		// Default queue depth of 32 to limit the amount of potential blocking between updates
-		agent.sessionUpdates = make(chan sessionUpdate, 32)
+		agent.sessionUpdates = newPendingSessionUpdates(*maxPendingSessionUpdates)
+		agent.events = make(chan restapi.Event, 32)
+		agent.logExcerpts = map[string]string{}
 
 		if *disableControllerTls {
 			agent.api.Scheme = "http"
@@ -64,21 +235,50 @@ func (agent *Agent) ConnectToController(group task.Group) error {
 			return errors.New("--expose must be set when connecting to a controller")
 		}
 
-		id, err := agent.api.RegisterAgentWithContext(group.Ctx(), restapi.Agent{
-			Id:       agent.Id,
-			State:    restapi.AgentActive,
-			Hostname: agent.Hostname,
-			Address:  *expose,
-			Version:  build.Version,
-			Gpus:     agent.Gpus.GetGpus(),
-			Labels:   agent.labels,
-			Taints:   agent.taints,
-		})
+		err = validateStaleSessionAction()
 		if err != nil {
-			return fmt.Errorf("Agent.ConnectToController: failed to register with Controller at %s with %s", *controllerAddress, err)
+			return err
 		}
+		agent.stale = newStaleSessions()
 
-		agent.Id = id
+		err = validateControllerReconnect()
+		if err != nil {
+			return err
+		}
+
+		// The agent may start before the controller, keep trying to reach it. An agent the controller
+		// refused for failing its self-test runs it again before trying again, the host may since
+		// have been fixed
+		selfTested := false
+		reconnect := controllerReconnect{}
+		err = reconnect.retry(group.Ctx(), func() error {
+			err := agent.api.NegotiateVersionWithContext(group.Ctx())
+			if err != nil {
+				return err
+			}
+
+			if !selfTested {
+				agent.selfTest = agent.runSelfTest(group.Ctx())
+				selfTested = true
+			}
+
+			if *controllerBootstrapToken != "" {
+				err := agent.requestCertificate(group.Ctx(), tlsConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = agent.registerWithController(group.Ctx())
+			if errors.Is(err, pkgerrors.ErrForbidden) {
+				selfTested = false
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
 
 		// When connected to the controller, the agent must not allow requests
 		agent.Server.SetCreateEndpoint(RequestSessionName, nil)
@@ -93,92 +293,303 @@ func (agent *Agent) ConnectToController(group task.Group) error {
 			}
 		})
 
+		agent.AddNetworkMetricsConsumer(func(metrics map[string]restapi.NetworkMetrics) {
+			agent.networkMetricsMutex.Lock()
+			defer agent.networkMetricsMutex.Unlock()
+
+			agent.networkMetrics = metrics
+		})
+
 		group.GoFn("Controller Update", func(group task.Group) error {
-			ticker := time.NewTicker(5 * time.Second)
-			defer ticker.Stop()
+			timer := time.NewTimer(agent.nextHeartbeat(time.Now()))
+			defer timer.Stop()
 
 			for {
 				select {
 				case <-group.Ctx().Done():
+					// Sessions still pending are sent with the last update rather than lost
+					sessionsUpdates := agent.sessionUpdates.take()
+					agent.attachLogExcerpts(sessionsUpdates)
+
 					return agent.api.UpdateAgent(restapi.AgentUpdate{
-						Id:    agent.Id,
-						State: restapi.AgentClosed,
+						Id:       agent.Id,
+						State:    restapi.AgentClosed,
+						Sessions: sessionsUpdates,
+						Events:   append(agent.unsentEvents, agent.pendingEvents()...),
 					})
 
-				case <-ticker.C:
-					// Update our state from what is on the controller
-					controllerAgent, err := agent.api.GetAgentWithContext(group.Ctx(), agent.Id)
+				case <-timer.C:
+					err := agent.updateController(group, tlsConfig)
 					if err != nil {
-						return err
+						delay, err_ := reconnect.failed(err)
+						if err_ != nil {
+							return err_
+						}
+
+						logger.Warningf("unable to update Controller at %s, retrying in %s, %v", *controllerAddress, delay.Round(time.Millisecond), err)
+						timer.Reset(delay)
+						continue
 					}
 
-					for _, session := range controllerAgent.Sessions {
-						reference, err_ := agent.getSession(session.Id)
+					disconnectedFor := reconnect.succeeded()
+					if disconnectedFor > 0 {
+						agent.ReportEvent(restapi.Event{
+							Type:    restapi.EventAgentReconnected,
+							Message: fmt.Sprintf("reconnected to Controller at %s after %d attempts over %s", *controllerAddress, reconnect.attempts+1, disconnectedFor.Round(time.Second)),
+							Data: map[string]string{
+								"attempts":        fmt.Sprint(reconnect.attempts + 1),
+								"disconnectedFor": disconnectedFor.Round(time.Second).String(),
+							},
+						})
+					}
 
-						switch session.State {
-						case restapi.SessionAssigned:
-							if reference == nil {
-								err = errors.Join(err, agent.registerSession(group, session))
-							}
+					timer.Reset(agent.nextHeartbeat(time.Now()))
+				}
+			}
+		})
+	} else {
+		// Without a controller the results are only logged
+		agent.selfTest = agent.runSelfTest(group.Ctx())
+	}
 
-						case restapi.SessionCanceling:
-							if reference != nil {
-								err = errors.Join(err, err_, reference.Object.Cancel())
-							}
-						}
+	return nil
+}
 
-						if reference != nil {
-							reference.Release()
-						}
-					}
+// Updates the agent's state from the controller and sends the controller the updates of the
+// sessions and the events since the last update it received
+func (agent *Agent) updateController(group task.Group, tlsConfig *tls.Config) error {
+	// Queued events are taken even when the controller cannot be reached so none are dropped from a
+	// full queue
+	agent.unsentEvents = append(agent.unsentEvents, agent.pendingEvents()...)
 
-					// Update the controller with our current state
-					// Multiple updates can occur within one cycle so create a map to get the latest updates
-					sessionsUpdates := map[string]restapi.SessionUpdate{}
+	if agent.certificateNeedsRenewal() {
+		err := agent.requestCertificate(group.Ctx(), tlsConfig)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
 
-				CopySessions:
-					for {
-						select {
-						case update := <-agent.sessionUpdates:
-							sessionsUpdates[update.Id] = restapi.SessionUpdate{
-								State: update.State,
-							}
+	// Update our state from what is on the controller
+	controllerAgent, reconcile, err := agent.api.GetAgentWithReconcileWithContext(group.Ctx(), agent.Id)
+	if errors.Is(err, pkgerrors.ErrNotFound) {
+		// The controller lost its state or removed the agent as missing, register again and
+		// leave the sessions it no longer knows about to reconcileSessions
+		err = agent.registerWithController(group.Ctx())
+		if err != nil {
+			return err
+		}
 
-						default:
-							break CopySessions
-						}
-					}
+		agent.ReportEvent(restapi.Event{
+			Type:    restapi.EventAgentReregistered,
+			Message: fmt.Sprintf("registered again with Controller at %s, which no longer knew about the agent", *controllerAddress),
+		})
 
-					err = errors.Join(err, agent.api.UpdateAgentWithContext(group.Ctx(), restapi.AgentUpdate{
-						Id:       agent.Id,
-						Sessions: sessionsUpdates,
-						Gpus:     agent.getGpuMetrics(),
-					}))
+		controllerAgent, reconcile, err = agent.api.GetAgentWithReconcileWithContext(group.Ctx(), agent.Id)
+	}
+	if err != nil {
+		return err
+	}
+
+	if reconcile {
+		// The controller corrects its records to the sessions the agent runs, read them again
+		err = agent.reconcileWithController(group.Ctx())
+		if err == nil {
+			controllerAgent, err = agent.api.GetAgentWithContext(group.Ctx(), agent.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, session := range controllerAgent.Sessions {
+		reference, err_ := agent.getSession(session.Id)
+
+		switch session.State {
+		case restapi.SessionAssigned:
+			if reference == nil {
+				// Registration runs the pre-session hook which may take a while
+				assigned := session
+				group.GoFn("Agent registerSession", func(group task.Group) error {
+					err := agent.registerSession(group, assigned)
 					if err != nil {
-						return err
+						logger.Error(err)
 					}
-				}
+					return nil
+				})
 			}
-		})
+
+		case restapi.SessionCanceling:
+			if reference != nil && session.Preempted {
+				err = errors.Join(err, err_, reference.Object.Preempt(*preemptionGrace))
+			} else if reference != nil {
+				err = errors.Join(err, err_, reference.Object.Cancel())
+			}
+		}
+
+		if reference != nil {
+			reference.Release()
+		}
+	}
+
+	err = errors.Join(err, agent.reconcileSessions(controllerAgent.Sessions))
+
+	agent.updateDraining(group, controllerAgent.Draining)
+
+	// Include the latest network metrics of every session, updates without a state leave it unchanged
+	sessionsUpdates := agent.sessionUpdates.take()
+	for id, metrics := range agent.getNetworkMetrics() {
+		metrics := metrics
+		update := sessionsUpdates[id]
+		update.Network = &metrics
+		sessionsUpdates[id] = update
+	}
+
+	agent.attachLogExcerpts(sessionsUpdates)
+
+	err_ := agent.api.UpdateAgentWithContext(group.Ctx(), restapi.AgentUpdate{
+		Id:       agent.Id,
+		Sessions: sessionsUpdates,
+		Gpus:     agent.getGpuMetrics(),
+		Events:   agent.unsentEvents,
+	})
+	if err_ == nil {
+		agent.sessionUpdates.acknowledge(sessionsUpdates)
+		agent.unsentEvents = nil
+	}
+
+	return errors.Join(err, err_)
+}
+
+func (agent *Agent) registerWithController(ctx context.Context) error {
+	id, heartbeat, err := agent.api.RegisterAgentWithScheduleWithContext(ctx, restapi.Agent{
+		Id:       agent.Id,
+		State:    restapi.AgentActive,
+		Hostname: agent.Hostname,
+		Address:  *expose,
+		Version:  build.Version,
+		Gpus:     agent.Gpus.GetGpus(),
+		Labels:   agent.labels,
+		Taints:   agent.taints,
+
+		CpuFallbackCapacity: agent.cpuFallbackCapacity,
+		MaxSessionsPerGpu:   *maxSessionsPerGpu,
+		Capabilities:        agent.capabilities(),
+		Rootless:            agent.rootless,
+		JoinToken:           *joinToken,
+		SelfTest:            agent.selfTest,
+	})
+	if errors.Is(err, pkgerrors.ErrUnauthorized) {
+		return fmt.Errorf("Agent.ConnectToController: Controller at %s rejected --join-token with %w", *controllerAddress, err)
+	} else if errors.Is(err, pkgerrors.ErrForbidden) {
+		return fmt.Errorf("Agent.ConnectToController: Controller at %s refused the agent, see --self-test, with %w", *controllerAddress, err)
+	} else if err != nil {
+		return fmt.Errorf("Agent.ConnectToController: failed to register with Controller at %s with %s", *controllerAddress, err)
+	}
+
+	agent.Id = id
+	logger.SetField(logger.FieldAgentId, id)
+
+	agent.heartbeat = heartbeat
+	if heartbeat.Interval > 0 {
+		logger.Debugf("updating Controller every %s at offset %s", heartbeat.Interval, heartbeat.Offset)
 	}
 
 	return nil
 }
 
-func (agent *Agent) SessionStateChanged(id string, state string) {
+func (agent *Agent) SessionStateChanged(id string, state string, exitStatus string) {
 	if agent.sessionUpdates != nil {
-		logger.Tracef("session %s changed state to %s", id, state)
-		agent.sessionUpdates <- sessionUpdate{
-			Id:    id,
-			State: state,
+		logger.WithSession(id).Tracef("session %s changed state to %s", id, state)
+		agent.sessionUpdates.add(sessionUpdate{
+			Id:         id,
+			State:      state,
+			ExitStatus: exitStatus,
+		})
+	}
+}
+
+// Holds the end of the closed session's renderer log until the update reporting it closed
+func (agent *Agent) setLogExcerpt(id string, excerpt string) {
+	if agent.sessionUpdates == nil || excerpt == "" {
+		return
+	}
+
+	agent.logExcerptsMutex.Lock()
+	defer agent.logExcerptsMutex.Unlock()
+
+	agent.logExcerpts[id] = excerpt
+}
+
+func (agent *Agent) attachLogExcerpts(updates map[string]restapi.SessionUpdate) {
+	agent.logExcerptsMutex.Lock()
+	defer agent.logExcerptsMutex.Unlock()
+
+	for id, update := range updates {
+		excerpt, found := agent.logExcerpts[id]
+		if found && update.State == restapi.SessionClosed {
+			update.LogExcerpt = excerpt
+			updates[id] = update
+			delete(agent.logExcerpts, id)
 		}
 	}
 }
 
+// Reports the event to the controller with the next update, events are only logged when not connected to a controller
+func (agent *Agent) ReportEvent(event restapi.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.AgentId = agent.Id
+
+	logger.Infof("event %s: %s", event.Type, event.Message)
+
+	if agent.events != nil {
+		select {
+		case agent.events <- event:
+		default:
+			logger.Warningf("event %s dropped, too many pending events", event.Type)
+		}
+	}
+}
+
+// Returns the events reported since the last update
+func (agent *Agent) pendingEvents() []restapi.Event {
+	events := []restapi.Event{}
+	for {
+		select {
+		case event := <-agent.events:
+			events = append(events, event)
+
+		default:
+			return events
+		}
+	}
+}
+
+func (agent *Agent) getNetworkMetrics() map[string]restapi.NetworkMetrics {
+	agent.networkMetricsMutex.Lock()
+	defer agent.networkMetricsMutex.Unlock()
+
+	return agent.networkMetrics
+}
+
 func (agent *Agent) getGpuMetrics() []restapi.GpuMetrics {
 	agent.gpuMetricsMutex.Lock()
 	defer agent.gpuMetricsMutex.Unlock()
 
 	// Make a copy
-	return append(make([]restapi.GpuMetrics, 0, len(agent.gpuMetrics)), agent.gpuMetrics...)
+	metrics := append(make([]restapi.GpuMetrics, 0, len(agent.gpuMetrics)), agent.gpuMetrics...)
+	for index, leaked := range agent.Gpus.VramLeaked() {
+		if index < len(metrics) {
+			metrics[index].VramLeaked = leaked
+		}
+	}
+
+	for index, unhealthy := range agent.Gpus.Unhealthy() {
+		if index < len(metrics) {
+			metrics[index].Unhealthy = unhealthy
+		}
+	}
+
+	return metrics
 }
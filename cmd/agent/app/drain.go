@@ -0,0 +1,47 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	exitWhenDrained = flag.Bool("exit-when-drained", false, "Exit once the controller drains the agent and its last session finishes")
+)
+
+// Follows the draining of the agent by the controller, which places no new sessions on a draining
+// agent, and reports when its last session finished
+func (agent *Agent) updateDraining(group task.Group, draining bool) {
+	if draining != agent.draining {
+		agent.draining = draining
+		agent.drained = false
+
+		if draining {
+			logger.Infof("the controller is draining the agent, no new sessions are placed on it while its %d sessions finish", agent.getSessionsCount())
+		} else {
+			logger.Info("the controller is no longer draining the agent")
+		}
+	}
+
+	if !agent.draining || agent.drained || agent.getSessionsCount() > 0 {
+		return
+	}
+
+	agent.drained = true
+
+	agent.ReportEvent(restapi.Event{
+		Type:    restapi.EventAgentDrained,
+		Message: "the agent is drained, no sessions run on it",
+	})
+
+	if *exitWhenDrained {
+		logger.Info("exiting, the agent is drained")
+		group.Cancel()
+	}
+}
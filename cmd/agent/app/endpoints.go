@@ -5,15 +5,20 @@ package app
 
 import (
 	"bufio"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/Juice-Labs/Juice-Labs/cmd/agent/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
 	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
@@ -25,26 +30,131 @@ const (
 	RequestSessionName = "RequestSession"
 )
 
+var (
+	errInvalidSessionToken = pkgerrors.New(pkgerrors.ErrUnauthorized, "invalid session token")
+)
+
 func (agent *Agent) initializeEndpoints() {
 	agent.Server.AddCreateEndpoint(agent.getStatusEp)
 	agent.Server.SetCreateEndpoint(RequestSessionName, agent.requestSessionEp)
 	agent.Server.AddCreateEndpoint(agent.getSessionEp)
 	agent.Server.AddCreateEndpoint(agent.connectSessionEp)
+	agent.Server.AddCreateEndpoint(agent.releaseSessionEp)
+	agent.Server.AddCreateEndpoint(agent.updateSessionFramesEp)
+	agent.Server.AddCreateEndpoint(agent.probeSessionEp)
+	agent.Server.AddCreateEndpoint(agent.negotiateSessionStreamEp)
+	agent.Server.AddCreateEndpoint(agent.getSessionFilesEp)
+	agent.Server.AddCreateEndpoint(agent.putSessionFileEp)
+	agent.Server.AddCreateEndpoint(agent.getSessionFileEp)
+	agent.Server.AddCreateEndpoint(agent.execSessionEp)
+	agent.Server.AddCreateEndpoint(agent.getSessionRecordingEp)
+	agent.Server.AddCreateEndpoint(agent.confirmSessionEp)
+	agent.Server.AddCreateEndpoint(agent.profilingEp)
 
 	prometheus.InitializeEndpoints(agent.Server)
 }
 
+func (agent *Agent) capabilities() []string {
+	capabilities := []string{}
+	if *controllerAddress == "" {
+		capabilities = append(capabilities, restapi.CapabilityDirectSessions)
+
+		if *sessionToken != "" {
+			capabilities = append(capabilities, restapi.CapabilitySessionToken)
+		}
+	}
+
+	if agent.cpuFallbackCapacity > 0 {
+		capabilities = append(capabilities, restapi.CapabilityCpuFallback)
+	}
+
+	if *sessionFilesMaxSize > 0 {
+		capabilities = append(capabilities, restapi.CapabilitySessionFiles)
+	}
+
+	if *execToken != "" {
+		capabilities = append(capabilities, restapi.CapabilitySessionExec)
+	}
+
+	if *controllerAddress != "" {
+		capabilities = append(capabilities, restapi.CapabilityConfirmAssignments)
+	}
+
+	if recordingEnabled() {
+		capabilities = append(capabilities, restapi.CapabilitySessionRecording)
+	}
+
+	if *profilingToken != "" {
+		capabilities = append(capabilities, restapi.CapabilityProfiling)
+	}
+
+	if agent.quic != nil {
+		capabilities = append(capabilities, restapi.CapabilityQuic)
+	}
+
+	capabilities = append(capabilities, restapi.CapabilityStreamNegotiation)
+
+	if agent.fairness != nil {
+		capabilities = append(capabilities, restapi.CapabilityGpuFairness)
+	}
+
+	if session.NetworkAccountingEnabled() {
+		capabilities = append(capabilities, restapi.CapabilityNetworkAccounting)
+	}
+
+	for _, capability := range agent.GpuBackend.Capabilities() {
+		if !agent.forgoes(capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	return capabilities
+}
+
+// Returns the first of the features required the agent does not support, empty when it supports
+// all of them
+func (agent *Agent) unsupportedCapability(required []string) string {
+	capabilities := agent.capabilities()
+	for _, capability := range required {
+		supported := false
+		for _, present := range capabilities {
+			if present == capability {
+				supported = true
+				break
+			}
+		}
+
+		if !supported {
+			return capability
+		}
+	}
+
+	return ""
+}
+
+func validSessionToken(r *http.Request) bool {
+	if *sessionToken == "" {
+		return true
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(*sessionToken)) == 1
+}
+
 func (agent *Agent) getStatusEp(group task.Group, router *mux.Router) error {
 	router.Methods("GET").Path("/v1/status").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			err := pkgnet.Respond(w, http.StatusOK, restapi.Status{
-				State:    "Active",
-				Version:  build.Version,
-				Hostname: agent.Hostname,
+				State:        "Active",
+				Version:      build.Version,
+				Hostname:     agent.Hostname,
+				Capabilities: agent.capabilities(),
+				GpuBackend:   agent.GpuBackend.Name(),
+				QuicPort:     agent.quicPort(),
 			})
 
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 			}
 		})
@@ -54,16 +164,24 @@ func (agent *Agent) getStatusEp(group task.Group, router *mux.Router) error {
 func (agent *Agent) requestSessionEp(group task.Group, router *mux.Router) error {
 	router.Methods("POST").Path("/v1/request/session").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			if !validSessionToken(r) {
+				err := pkgnet.RespondWithError(w, errInvalidSessionToken)
+				if err != nil {
+					logger.Error(err)
+				}
+				return
+			}
+
 			sessionRequirements, err := pkgnet.ReadRequestBody[restapi.SessionRequirements](r)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
 
 			id, err := agent.requestSession(group, sessionRequirements)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -83,7 +201,7 @@ func (agent *Agent) getSessionEp(group task.Group, router *mux.Router) error {
 
 			reference, err := agent.getSession(id)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -104,7 +222,7 @@ func (agent *Agent) connectSessionEp(group task.Group, router *mux.Router) error
 
 			reference, err := agent.getSession(id)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -124,7 +242,7 @@ func (agent *Agent) connectSessionEp(group task.Group, router *mux.Router) error
 			}
 
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -136,3 +254,89 @@ func (agent *Agent) connectSessionEp(group task.Group, router *mux.Router) error
 		})
 	return nil
 }
+
+// Sessions requested directly from the agent are released by their client, sessions
+// assigned by a controller are released through the controller
+func (agent *Agent) releaseSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/release/session/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !validSessionToken(r) {
+				err := pkgnet.RespondWithError(w, errInvalidSessionToken)
+				if err != nil {
+					logger.Error(err)
+				}
+				return
+			}
+
+			id := mux.Vars(r)["id"]
+
+			release, err := pkgnet.ReadRequestBody[restapi.SessionRelease](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			reference, err := agent.getSession(id)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer reference.Release()
+
+			logger.WithSession(id).Infof("session %s released by its client after %s, exit status %s (%d)",
+				id, release.EndedAt.Sub(release.StartedAt).Round(time.Millisecond), release.ExitStatus, release.ExitCode)
+
+			if !reference.Object.Session().Persistent {
+				err = reference.Object.Cancel()
+				if err != nil {
+					err = errors.Join(err, pkgnet.RespondWithError(w, err))
+					logger.Error(err)
+					return
+				}
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
+
+// Frame metrics of sessions assigned by a controller are reported to the controller
+func (agent *Agent) updateSessionFramesEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/session/{id}/frames").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !validSessionToken(r) {
+				err := pkgnet.RespondWithError(w, errInvalidSessionToken)
+				if err != nil {
+					logger.Error(err)
+				}
+				return
+			}
+
+			id := mux.Vars(r)["id"]
+
+			frames, err := pkgnet.ReadRequestBody[restapi.FrameMetrics](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			reference, err := agent.getSession(id)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer reference.Release()
+
+			reference.Object.SetFrames(frames)
+			for _, consumer := range agent.frameConsumers {
+				consumer(id, reference.Object.Tenant(), frames)
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	execToken   = flag.String("exec-token", "", "Bearer token the controller presents to run diagnostic commands in sessions for the users its authorization policy allows, the controller's --agent-exec-token. Running commands is disabled when not set")
+	execTimeout = flag.Duration("exec-timeout", 5*time.Minute, "Diagnostic commands run in sessions are killed after this duration")
+
+	execCommands = []string{"nvidia-smi", "env", "strace"}
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &execCommands}, "exec-commands", "A comma-separated list of the commands that may be run in sessions, found in the agent's PATH")
+}
+
+var (
+	errExecDisabled     = pkgerrors.New(pkgerrors.ErrForbidden, "running commands in sessions is disabled, see --exec-token")
+	errInvalidExecToken = pkgerrors.New(pkgerrors.ErrUnauthorized, "invalid exec token")
+)
+
+func validExecToken(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(*execToken)) == 1
+}
+
+// Returns the path of the command, which must be one of --exec-commands
+func execCommandPath(command string) (string, error) {
+	for _, allowed := range execCommands {
+		if command == allowed {
+			path, err := exec.LookPath(command)
+			if err != nil {
+				return "", pkgerrors.Errorf(pkgerrors.ErrNotFound, "command %s is not installed on the agent", command)
+			}
+
+			return path, nil
+		}
+	}
+
+	return "", pkgerrors.Errorf(pkgerrors.ErrForbidden, "command %s is not allowed, see --exec-commands", command)
+}
+
+// Sends the output of the command to the client as soon as it is written
+type flushWriter struct {
+	mutex      sync.Mutex
+	w          io.Writer
+	controller *http.ResponseController
+}
+
+func (writer *flushWriter) Write(data []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	written, err := writer.w.Write(data)
+	if err == nil {
+		err = writer.controller.Flush()
+	}
+
+	return written, err
+}
+
+func (agent *Agent) execSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/session/{id}/exec").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := errExecDisabled
+			if *execToken != "" {
+				err = nil
+				if !validExecToken(r) {
+					err = errInvalidExecToken
+				}
+			}
+
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			request, err := pkgnet.ReadRequestBody[restapi.SessionExec](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			path, err := execCommandPath(request.Command)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			reference, err := agent.getSession(mux.Vars(r)["id"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer reference.Release()
+
+			// Killed when the client disconnects
+			ctx, cancel := context.WithTimeout(r.Context(), *execTimeout)
+			defer cancel()
+
+			cmd, err := reference.Object.Command(ctx, path, request.Args)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			output := &flushWriter{
+				w:          w,
+				controller: http.NewResponseController(w),
+			}
+			cmd.Stdout = output
+			cmd.Stderr = output
+
+			logger.WithSession(reference.Object.Id()).Infof("session %s: running %s", reference.Object.Id(), strings.Join(cmd.Args, " "))
+
+			err = cmd.Start()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Trailer", restapi.ExecExitCodeTrailer)
+			w.WriteHeader(http.StatusOK)
+
+			err = cmd.Wait()
+			if ctx.Err() == context.DeadlineExceeded {
+				fmt.Fprintf(output, "\n%s killed after --exec-timeout %s\n", request.Command, *execTimeout)
+			}
+
+			var exitErr *exec.ExitError
+			if err != nil && !errors.As(err, &exitErr) {
+				logger.WithSession(reference.Object.Id()).Errorf("session %s: %s failed, %v", reference.Object.Id(), request.Command, err)
+			}
+
+			w.Header().Set(restapi.ExecExitCodeTrailer, strconv.Itoa(cmd.ProcessState.ExitCode()))
+		})
+	return nil
+}
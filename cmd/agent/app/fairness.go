@@ -0,0 +1,292 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	gpuFairnessInterval    = flag.Duration("gpu-fairness-interval", 0, "Interval between samples of each GPU's utilization by the sessions sharing it. Sessions using more than their share of a busy GPU are throttled by suspending their renderer for part of the time. Requires a GPU backend reading utilization by process, 0 disables")
+	gpuFairnessTolerance   = flag.Float64("gpu-fairness-tolerance", 0.25, "Fraction beyond its fair share of a GPU a session may use before it is throttled")
+	gpuFairnessBusy        = flag.Float64("gpu-fairness-busy", 80, "Percent of a GPU the sessions sharing it must use together before any is throttled")
+	gpuFairnessMaxThrottle = flag.Float64("gpu-fairness-max-throttle", 0.5, "Largest fraction of the time a session's renderer is suspended")
+)
+
+const (
+	// Sessions using less of a GPU are idle, leaving their share to the others
+	fairnessIdleUtilization = 5.0
+
+	// Throttles are raised by a step each sample a session uses more than its share and halved
+	// each sample it does not, removed once below fairnessMinThrottle
+	fairnessThrottleStep = 0.1
+	fairnessMinThrottle  = 0.05
+
+	// Throttled renderers are suspended for their throttle of each slice, short enough that frames
+	// are delayed rather than dropped
+	fairnessSlice = 100 * time.Millisecond
+)
+
+type FairnessMetricsConsumerFn = func(map[string]restapi.GpuFairness)
+
+func (agent *Agent) AddFairnessMetricsConsumer(consumer FairnessMetricsConsumerFn) {
+	agent.fairnessConsumers = append(agent.fairnessConsumers, consumer)
+}
+
+// Shares each GPU fairly between the sessions on it, see --gpu-fairness-interval
+type gpuFairness struct {
+	mutex sync.Mutex
+
+	// When each GPU was last sampled by PCI bus, utilization is read since then
+	sampledAt map[string]time.Time
+
+	// By session id, forgotten once the session closes
+	sessions map[string]*restapi.GpuFairness
+}
+
+// Returns nil when enforcing fairness is disabled or the GPU backend cannot support it
+func newGpuFairness(backend cmdgpu.Backend) *gpuFairness {
+	if *gpuFairnessInterval <= 0 {
+		return nil
+	}
+
+	if !cmdgpu.HasCapability(backend, restapi.CapabilityProcessUtilization) {
+		logger.Infof("GPU fairness is disabled, the %s GPU backend does not read utilization by process", backend.Name())
+		return nil
+	}
+
+	return &gpuFairness{
+		sampledAt: map[string]time.Time{},
+		sessions:  map[string]*restapi.GpuFairness{},
+	}
+}
+
+// A session's use of one of its GPUs
+type gpuShare struct {
+	id          string
+	pid         int
+	utilization float64
+}
+
+// Samples the utilization of each GPU by its sessions and adjusts their throttles. Sessions
+// spanning several GPUs are held to their smallest share of them.
+func (agent *Agent) sampleGpuFairness() map[string]restapi.GpuFairness {
+	shares := map[int][]*gpuShare{}
+
+	agent.sessionsMutex.Lock()
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		object := pair.Value.Object
+		pid := object.RendererPid()
+		if object.CpuFallback() || pid == 0 {
+			continue
+		}
+
+		for _, sessionGpu := range object.Session().Gpus {
+			shares[sessionGpu.Index] = append(shares[sessionGpu.Index], &gpuShare{
+				id:  pair.Key,
+				pid: pid,
+			})
+		}
+	}
+	agent.sessionsMutex.Unlock()
+
+	fairness := agent.fairness
+	fairness.mutex.Lock()
+	defer fairness.mutex.Unlock()
+
+	current := map[string]*restapi.GpuFairness{}
+	overShare := map[string]bool{}
+
+	now := time.Now()
+	for _, apiGpu := range agent.Gpus.GetGpus() {
+		onGpu := shares[apiGpu.Index]
+		if len(onGpu) == 0 {
+			delete(fairness.sampledAt, apiGpu.PciBus)
+			continue
+		}
+
+		for _, share := range onGpu {
+			if _, present := current[share.id]; !present {
+				current[share.id] = &restapi.GpuFairness{
+					FairShare: 100,
+				}
+			}
+		}
+
+		since, present := fairness.sampledAt[apiGpu.PciBus]
+		fairness.sampledAt[apiGpu.PciBus] = now
+		if !present {
+			continue
+		}
+
+		processes, err := agent.GpuBackend.QueryProcessUtilization(apiGpu.PciBus, since)
+		if err != nil {
+			logger.Warningf("unable to read the utilization of GPU %d @ %s by process, %v", apiGpu.Index, apiGpu.PciBus, err)
+			continue
+		}
+
+		utilization := map[int]float64{}
+		for _, process := range processes {
+			utilization[process.Pid] = process.SmUtilization
+		}
+
+		total := 0.0
+		active := 0
+		for _, share := range onGpu {
+			share.utilization = utilization[share.pid]
+			total += share.utilization
+			if share.utilization >= fairnessIdleUtilization {
+				active++
+			}
+		}
+
+		fairShare := 100.0
+		if active > 0 {
+			fairShare /= float64(active)
+		}
+
+		// An idle GPU throttles no one, the sessions may use what the others leave
+		busy := active > 1 && total >= *gpuFairnessBusy
+		for _, share := range onGpu {
+			state := current[share.id]
+			state.SmUtilization = math.Max(state.SmUtilization, share.utilization)
+			state.FairShare = math.Min(state.FairShare, fairShare)
+
+			if busy && share.utilization > fairShare*(1+*gpuFairnessTolerance) {
+				overShare[share.id] = true
+			}
+		}
+	}
+
+	metrics := map[string]restapi.GpuFairness{}
+	for id, state := range current {
+		previous, present := fairness.sessions[id]
+		if present {
+			state.Throttle = previous.Throttle
+			state.ThrottledSeconds = previous.ThrottledSeconds
+		}
+
+		if overShare[id] {
+			state.Throttle = math.Min(state.Throttle+fairnessThrottleStep, *gpuFairnessMaxThrottle)
+		} else {
+			state.Throttle /= 2
+			if state.Throttle < fairnessMinThrottle {
+				state.Throttle = 0
+			}
+		}
+
+		metrics[id] = *state
+	}
+
+	fairness.sessions = current
+
+	return metrics
+}
+
+// A session suspended for part of a slice
+type throttledSession struct {
+	session  *session.Session
+	throttle float64
+}
+
+// Suspends the renderers of the throttled sessions for their throttle of a slice, returning once
+// every one is resumed
+func (agent *Agent) throttleSlice(group task.Group) {
+	fairness := agent.fairness
+
+	fairness.mutex.Lock()
+	throttles := map[string]float64{}
+	for id, state := range fairness.sessions {
+		if state.Throttle > 0 {
+			throttles[id] = state.Throttle
+		}
+	}
+	fairness.mutex.Unlock()
+
+	if len(throttles) == 0 {
+		return
+	}
+
+	throttled := make([]throttledSession, 0, len(throttles))
+	agent.sessionsMutex.Lock()
+	for id, throttle := range throttles {
+		reference, found := agent.sessions.Get(id)
+		if found {
+			throttled = append(throttled, throttledSession{
+				session:  reference.Object,
+				throttle: throttle,
+			})
+		}
+	}
+	agent.sessionsMutex.Unlock()
+
+	// Resumed in turn, the least throttled first
+	sort.Slice(throttled, func(i, j int) bool {
+		return throttled[i].throttle < throttled[j].throttle
+	})
+
+	suspendedAt := time.Now()
+	for _, object := range throttled {
+		err := object.session.SuspendRenderer(true)
+		if err != nil {
+			logger.WithSession(object.session.Id()).Warningf("unable to suspend the renderer of session %s, %v", object.session.Id(), err)
+		}
+	}
+
+	for _, object := range throttled {
+		resumeAt := suspendedAt.Add(time.Duration(object.throttle * float64(fairnessSlice)))
+
+		// Renderers are always resumed, even when the agent is stopping
+		select {
+		case <-group.Ctx().Done():
+		case <-time.After(time.Until(resumeAt)):
+		}
+
+		err := object.session.SuspendRenderer(false)
+		if err != nil {
+			logger.WithSession(object.session.Id()).Warningf("unable to resume the renderer of session %s, %v", object.session.Id(), err)
+		}
+
+		fairness.mutex.Lock()
+		state, present := fairness.sessions[object.session.Id()]
+		if present {
+			state.ThrottledSeconds += time.Since(suspendedAt).Seconds()
+		}
+		fairness.mutex.Unlock()
+	}
+}
+
+func (agent *Agent) runGpuFairness(group task.Group) error {
+	sampler := time.NewTicker(*gpuFairnessInterval)
+	defer sampler.Stop()
+
+	slicer := time.NewTicker(fairnessSlice)
+	defer slicer.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-sampler.C:
+			metrics := agent.sampleGpuFairness()
+			for _, consumer := range agent.fairnessConsumers {
+				consumer(metrics)
+			}
+
+		case <-slicer.C:
+			agent.throttleSlice(group)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Returns the active sessions whose workloads serve Prometheus metrics, see
+// restapi.SessionRequirements.MetricsPort
+func (agent *Agent) SessionMetricsTargets() []restapi.Session {
+	agent.sessionsMutex.Lock()
+	defer agent.sessionsMutex.Unlock()
+
+	sessions := []restapi.Session{}
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		if pair.Value.Object.MetricsPort() == 0 {
+			continue
+		}
+
+		session := pair.Value.Object.Session()
+		if session.State == restapi.SessionClosed {
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
@@ -0,0 +1,117 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	sessionFileMaxSize  = flag.Int64("session-file-max-size", 32*1024*1024, "The largest file in bytes clients may push to a session's scratch directory")
+	sessionFilesMaxSize = flag.Int64("session-files-max-size", 128*1024*1024, "The bytes each session's scratch directory may hold in total, including files left for the client to pull. 0 disables pushing and pulling files")
+)
+
+var (
+	errSessionFilesDisabled = pkgerrors.New(pkgerrors.ErrForbidden, "session files are disabled, see --session-files-max-size")
+)
+
+// Wraps the handlers of the session file endpoints, which check the session token like the other
+// endpoints used by clients
+func (agent *Agent) sessionFilesHandler(handler func(w http.ResponseWriter, r *http.Request, reference *Reference[session.Session])) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := errSessionFilesDisabled
+		if *sessionFilesMaxSize > 0 {
+			err = nil
+			if !validSessionToken(r) {
+				err = errInvalidSessionToken
+			}
+		}
+
+		var reference *Reference[session.Session]
+		if err == nil {
+			reference, err = agent.getSession(mux.Vars(r)["id"])
+		}
+
+		if err != nil {
+			err = errors.Join(err, pkgnet.RespondWithError(w, err))
+			logger.Error(err)
+			return
+		}
+		defer reference.Release()
+
+		handler(w, r, reference)
+	}
+}
+
+func (agent *Agent) getSessionFilesEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/session/{id}/files").HandlerFunc(agent.sessionFilesHandler(
+		func(w http.ResponseWriter, r *http.Request, reference *Reference[session.Session]) {
+			files, err := reference.Object.Files()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, files)
+			if err != nil {
+				logger.Error(err)
+			}
+		}))
+	return nil
+}
+
+func (agent *Agent) putSessionFileEp(group task.Group, router *mux.Router) error {
+	router.Methods("PUT").Path("/v1/session/{id}/files/{name}").HandlerFunc(agent.sessionFilesHandler(
+		func(w http.ResponseWriter, r *http.Request, reference *Reference[session.Session]) {
+			file, err := reference.Object.PutFile(mux.Vars(r)["name"], r.Body, *sessionFileMaxSize, *sessionFilesMaxSize)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			logger.WithSession(reference.Object.Id()).Debugf("session %s received file %s, %d bytes", reference.Object.Id(), file.Name, file.Size)
+
+			err = pkgnet.Respond(w, http.StatusOK, file)
+			if err != nil {
+				logger.Error(err)
+			}
+		}))
+	return nil
+}
+
+func (agent *Agent) getSessionFileEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/session/{id}/files/{name}").HandlerFunc(agent.sessionFilesHandler(
+		func(w http.ResponseWriter, r *http.Request, reference *Reference[session.Session]) {
+			file, err := reference.Object.OpenFile(mux.Vars(r)["name"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer file.Close()
+
+			info, err := file.Stat()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+		}))
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	gpuHealthInterval = flag.Duration("gpu-health-interval", 30*time.Second, "Interval between checks of the GPUs' health, the Xid errors the driver logged, uncorrected ECC errors, memory pending retirement, and hardware slowdowns. Unhealthy GPUs take no sessions and the controller places none on the agent until they recover, 0 disables")
+	gpuThrottleGrace  = flag.Duration("gpu-throttle-grace", 5*time.Minute, "How long hardware slowdowns may throttle a GPU before it is unhealthy, 0 never makes throttled GPUs unhealthy")
+
+	// Xids of the NVIDIA driver pointing at the GPU rather than at the application using it, see
+	// https://docs.nvidia.com/deploy/xid-errors
+	gpuUnhealthyXids = []string{"48", "62", "63", "64", "74", "79", "92", "94", "95", "119", "120"}
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &gpuUnhealthyXids}, "gpu-unhealthy-xids", "A comma-separated list of the Xid errors that make a GPU unhealthy until the agent restarts, which requires reading /dev/kmsg")
+}
+
+// Checks the health of the GPUs, see --gpu-health-interval. Only used by the health check task.
+type gpuHealth struct {
+	// Nil when the kernel log cannot be read
+	xids          *cmdgpu.XidScanner
+	unhealthyXids map[int]struct{}
+
+	// Whether the backend reads the health of GPUs
+	backend bool
+
+	// Why each GPU is unhealthy from the Xid errors logged for it, kept until the agent restarts
+	xidProblems []string
+	// When each GPU started being throttled by hardware slowdowns, zero when it is not
+	throttledSince []time.Time
+}
+
+// Returns nil when checking the health of GPUs is disabled or neither the backend nor the kernel
+// log can be read
+func newGpuHealth(backend cmdgpu.Backend, gpus *gpu.GpuSet) (*gpuHealth, error) {
+	if *gpuHealthInterval <= 0 {
+		return nil, nil
+	}
+
+	health := &gpuHealth{
+		unhealthyXids:  map[int]struct{}{},
+		backend:        cmdgpu.HasCapability(backend, restapi.CapabilityGpuHealth),
+		xidProblems:    make([]string, gpus.Count()),
+		throttledSince: make([]time.Time, gpus.Count()),
+	}
+
+	for _, xid := range gpuUnhealthyXids {
+		xid = strings.TrimSpace(xid)
+		if xid == "" {
+			continue
+		}
+
+		code, err := strconv.Atoi(xid)
+		if err != nil {
+			return nil, fmt.Errorf("--gpu-unhealthy-xids: %s is not an Xid", xid)
+		}
+
+		health.unhealthyXids[code] = struct{}{}
+	}
+
+	if len(health.unhealthyXids) > 0 {
+		xids, err := cmdgpu.NewXidScanner()
+		if err != nil && !errors.Is(err, cmdgpu.ErrUnsupported) {
+			logger.Infof("checking GPUs for Xid errors is disabled, %v", err)
+		}
+
+		health.xids = xids
+	}
+
+	if !health.backend && health.xids == nil {
+		logger.Infof("checking the health of GPUs is disabled, the %s GPU backend does not read it", backend.Name())
+		return nil, nil
+	}
+
+	return health, nil
+}
+
+// Returns the problems found with the GPU, along with the hardware slowdowns throttling it
+func (agent *Agent) checkGpuHealth(index int, apiGpu restapi.Gpu, now time.Time) ([]string, []string) {
+	problems := []string{}
+	if agent.health.xidProblems[index] != "" {
+		problems = append(problems, agent.health.xidProblems[index])
+	}
+
+	if !agent.health.backend {
+		return problems, nil
+	}
+
+	health, err := cmdgpu.QueryHealth(agent.GpuBackend, apiGpu.PciBus)
+	if err != nil {
+		logger.Warningf("unable to check the health of GPU %d @ %s, %v", index, apiGpu.PciBus, err)
+		return problems, nil
+	}
+
+	problems = append(problems, health.Problems...)
+
+	if len(health.Throttled) == 0 {
+		agent.health.throttledSince[index] = time.Time{}
+	} else if agent.health.throttledSince[index].IsZero() {
+		agent.health.throttledSince[index] = now
+	} else if throttledFor := now.Sub(agent.health.throttledSince[index]); *gpuThrottleGrace > 0 && throttledFor >= *gpuThrottleGrace {
+		problems = append(problems, fmt.Sprintf("throttled by %s for %s", strings.Join(health.Throttled, " and "), throttledFor.Round(time.Second)))
+	}
+
+	return problems, health.Throttled
+}
+
+// Records the Xid errors logged since the last check against the GPUs they were logged for
+func (agent *Agent) scanXids(gpus []restapi.Gpu) {
+	xids, err := agent.health.xids.Scan()
+	if err != nil {
+		logger.Warning(err)
+	}
+
+	for _, xid := range xids {
+		if _, unhealthy := agent.health.unhealthyXids[xid.Code]; !unhealthy {
+			logger.Debugf("Xid %d on GPU %s, %s", xid.Code, xid.PciBus, xid.Message)
+			continue
+		}
+
+		// Xids name the GPU without its function
+		address := gpu.NewPCIAddressFromString(xid.PciBus + ".0")
+		for index, apiGpu := range gpus {
+			gpuAddress := gpu.NewPCIAddressFromString(apiGpu.PciBus)
+			if gpuAddress.Domain == address.Domain && gpuAddress.Bus == address.Bus && gpuAddress.Device == address.Device {
+				agent.health.xidProblems[index] = fmt.Sprintf("Xid %d, %s", xid.Code, xid.Message)
+			}
+		}
+	}
+}
+
+// Checks the health of the GPUs every --gpu-health-interval, marking the unhealthy GPUs so no
+// sessions are placed on them and reporting when they become unhealthy and when they recover
+func (agent *Agent) runGpuHealth(group task.Group) error {
+	if agent.health.xids != nil {
+		defer agent.health.xids.Close()
+	}
+
+	ticker := time.NewTicker(*gpuHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case now := <-ticker.C:
+			gpus := agent.Gpus.GetGpus()
+			if agent.health.xids != nil {
+				agent.scanXids(gpus)
+			}
+
+			unhealthy := agent.Gpus.Unhealthy()
+			for index, apiGpu := range gpus {
+				problems, throttled := agent.checkGpuHealth(index, apiGpu, now)
+				if len(throttled) > 0 {
+					logger.Debugf("GPU %d @ %s is throttled by %s", index, apiGpu.PciBus, strings.Join(throttled, " and "))
+				}
+
+				reason := strings.Join(problems, "; ")
+				if reason == unhealthy[index] {
+					continue
+				}
+
+				agent.Gpus.SetUnhealthy(index, reason)
+
+				data := map[string]string{
+					"gpu":    strconv.Itoa(index),
+					"pciBus": apiGpu.PciBus,
+				}
+
+				if reason == "" {
+					agent.ReportEvent(restapi.Event{
+						Type:    restapi.EventGpuRecovered,
+						Message: fmt.Sprintf("GPU %d @ %s is healthy again", index, apiGpu.PciBus),
+						Data:    data,
+					})
+				} else if unhealthy[index] == "" {
+					data["reason"] = reason
+					agent.ReportEvent(restapi.Event{
+						Type:    restapi.EventGpuUnhealthy,
+						Message: fmt.Sprintf("GPU %d @ %s is unhealthy, %s", index, apiGpu.PciBus, reason),
+						Data:    data,
+					})
+				}
+			}
+		}
+	}
+}
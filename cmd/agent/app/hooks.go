@@ -0,0 +1,100 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	preSessionHook  = flag.String("pre-session-hook", "", "Script run before a session starts, the session fails to start if it fails")
+	postSessionHook = flag.String("post-session-hook", "", "Script run after a session ends")
+	hookTimeout     = flag.Duration("session-hook-timeout", 5*time.Minute, "Maximum duration of a session hook before it is killed")
+)
+
+const (
+	preSessionHookName  = "pre-session"
+	postSessionHookName = "post-session"
+
+	// Maximum amount of hook output included in events
+	hookOutputLimit = 4096
+)
+
+func hookEnvironment(session restapi.Session, gpus *gpu.SelectedGpuSet) []string {
+	env := append(os.Environ(),
+		fmt.Sprintf("JUICE_SESSION_ID=%s", session.Id),
+		fmt.Sprintf("JUICE_SESSION_VERSION=%s", session.Version),
+		fmt.Sprintf("JUICE_SESSION_EXIT_STATUS=%s", session.ExitStatus),
+		fmt.Sprintf("JUICE_SESSION_CPU_FALLBACK=%t", session.CpuFallback),
+		fmt.Sprintf("JUICE_SESSION_PCIBUS=%s", gpus.GetPciBusString()),
+	)
+
+	// Workloads started by the pre-session hook serve their metrics on the port, see
+	// restapi.SessionRequirements.MetricsPort
+	if session.MetricsPort != 0 {
+		env = append(env, fmt.Sprintf("JUICE_SESSION_METRICS_PORT=%d", session.MetricsPort))
+	}
+
+	return env
+}
+
+func (agent *Agent) runHook(ctx context.Context, name string, path string, session *session.Session, gpus *gpu.SelectedGpuSet) error {
+	if path == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *hookTimeout)
+	defer cancel()
+
+	apiSession := session.Session()
+
+	var output bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = hookEnvironment(apiSession, gpus)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := cmd.Run()
+	if err == nil {
+		logger.Debugf("%s hook for session %s completed in %s", name, apiSession.Id, time.Since(start))
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", *hookTimeout)
+	}
+
+	err = fmt.Errorf("Agent.runHook: %s hook for session %s failed with %s", name, apiSession.Id, err)
+
+	text := strings.TrimSpace(output.String())
+	if len(text) > hookOutputLimit {
+		text = text[len(text)-hookOutputLimit:]
+	}
+
+	agent.ReportEvent(restapi.Event{
+		Type:      restapi.EventSessionHookFailed,
+		Message:   err.Error(),
+		SessionId: apiSession.Id,
+		Data: map[string]string{
+			"hook":   name,
+			"output": text,
+		},
+	})
+
+	return err
+}
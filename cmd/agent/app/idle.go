@@ -0,0 +1,139 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	defaultIdleTimeout = flag.Duration("default-idle-timeout", 0, "Closes the sessions whose client has neither used the GPU nor sent or received data for this long when their requirements set no idle timeout, returning their GPUs to the pool. 0 never closes them")
+	idleCheckInterval  = flag.Duration("idle-check-interval", 10*time.Second, "Interval between checks for idle sessions")
+)
+
+// Sessions whose renderer used less of a GPU are not doing work for their client
+const idleGpuUtilization = 1.0
+
+// Returns the idle timeout of a session from its requirements, see --default-idle-timeout
+func idleTimeoutOf(seconds int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return *defaultIdleTimeout
+}
+
+// Marks the sessions whose renderer did work on their GPUs since the last check active
+func (agent *Agent) markGpuActivity(sessions map[int][]*session.Session, since time.Time) {
+	for _, apiGpu := range agent.Gpus.GetGpus() {
+		onGpu := sessions[apiGpu.Index]
+		if len(onGpu) == 0 {
+			continue
+		}
+
+		processes, err := agent.GpuBackend.QueryProcessUtilization(apiGpu.PciBus, since)
+		if err != nil {
+			logger.Warningf("unable to read the utilization of GPU %d @ %s by process, %v", apiGpu.Index, apiGpu.PciBus, err)
+			continue
+		}
+
+		active := map[int]bool{}
+		for _, process := range processes {
+			if process.SmUtilization >= idleGpuUtilization {
+				active[process.Pid] = true
+			}
+		}
+
+		for _, object := range onGpu {
+			if active[object.RendererPid()] {
+				object.MarkActive()
+			}
+		}
+	}
+}
+
+// Closes the sessions idle for their idle timeout
+func (agent *Agent) reclaimIdleSessions(since time.Time) {
+	sessions := []*session.Session{}
+	byGpu := map[int][]*session.Session{}
+
+	agent.sessionsMutex.Lock()
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		object := pair.Value.Object
+		if object.IdleTimeout() <= 0 {
+			continue
+		}
+
+		sessions = append(sessions, object)
+		if !object.CpuFallback() && object.RendererPid() != 0 {
+			for _, sessionGpu := range object.Session().Gpus {
+				byGpu[sessionGpu.Index] = append(byGpu[sessionGpu.Index], object)
+			}
+		}
+	}
+	agent.sessionsMutex.Unlock()
+
+	if len(sessions) == 0 {
+		return
+	}
+
+	if cmdgpu.HasCapability(agent.GpuBackend, restapi.CapabilityProcessUtilization) {
+		agent.markGpuActivity(byGpu, since)
+	}
+
+	for _, object := range sessions {
+		idleFor := object.IdleFor()
+		timeout := object.IdleTimeout()
+		if idleFor < timeout {
+			continue
+		}
+
+		err := object.Reclaim()
+		if err != nil {
+			logger.WithSession(object.Id()).Warningf("unable to close idle session %s, %v", object.Id(), err)
+			continue
+		}
+
+		agent.ReportEvent(restapi.Event{
+			Type:      restapi.EventSessionIdleReclaimed,
+			Message:   fmt.Sprintf("session %s closed, its client was inactive for %s", object.Id(), idleFor.Round(time.Second)),
+			SessionId: object.Id(),
+			Data: map[string]string{
+				"idleSeconds":        strconv.Itoa(int(idleFor.Seconds())),
+				"idleTimeoutSeconds": strconv.Itoa(int(timeout.Seconds())),
+			},
+		})
+	}
+}
+
+func (agent *Agent) runIdleSessions(group task.Group) error {
+	if *networkMetricsInterval <= 0 && !cmdgpu.HasCapability(agent.GpuBackend, restapi.CapabilityProcessUtilization) {
+		logger.Warningf("idle sessions are not closed, --network-metrics-interval is 0 and the %s GPU backend does not read utilization by process", agent.GpuBackend.Name())
+		return nil
+	}
+
+	ticker := time.NewTicker(*idleCheckInterval)
+	defer ticker.Stop()
+
+	since := time.Now()
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case now := <-ticker.C:
+			agent.reclaimIdleSessions(since)
+			since = now
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	vramLeakDelay     = flag.Duration("vram-leak-delay", 10*time.Second, "How long after a session closes the GPUs it used are checked for VRAM it did not release, 0 disables checking for leaked VRAM")
+	vramLeakThreshold = flag.Uint64("vram-leak-threshold-mb", 256, "VRAM in MB still in use after a session closes, held by processes that are not sessions' renderers or beyond what an idle GPU used when the agent started, reported as leaked")
+	vramLeakReset     = flag.Bool("vram-leak-reset", false, "Reset GPUs found with leaked VRAM when no sessions run on them, supported by the nvml GPU backend when the agent runs as root")
+)
+
+// Interval between checks whether leaked VRAM was released
+const vramLeakInterval = time.Minute
+
+// Checks that sessions release the VRAM they used once they close. Leaked VRAM silently shrinks the
+// capacity of a GPU below what the agent and the controller account for, so the agent places no
+// sessions on a GPU with leaked VRAM until it is released.
+type vramLeaks struct {
+	// Serializes the checks of closing sessions and of the flagged GPUs
+	mutex sync.Mutex
+
+	// The VRAM used on each GPU when the agent started, before any renderer
+	baseline []cmdgpu.VramUsage
+	// Processes using the GPUs when the agent started, such as display servers
+	baselinePids map[int]struct{}
+}
+
+// Returns nil when checking is disabled or VRAM usage cannot be read
+func newVramLeaks(backend cmdgpu.Backend, gpus *gpu.GpuSet) *vramLeaks {
+	if *vramLeakDelay == 0 {
+		return nil
+	}
+
+	if !cmdgpu.HasCapability(backend, restapi.CapabilityVramUsage) {
+		logger.Infof("checking for leaked VRAM is disabled, the %s GPU backend does not read VRAM usage", backend.Name())
+		return nil
+	}
+
+	if *vramLeakReset && !cmdgpu.HasCapability(backend, restapi.CapabilityGpuReset) {
+		logger.Warningf("--vram-leak-reset: the %s GPU backend does not reset GPUs", backend.Name())
+	}
+
+	leaks := &vramLeaks{
+		baselinePids: map[int]struct{}{},
+	}
+
+	for _, gpu := range gpus.GetGpus() {
+		usage, err := backend.QueryVramUsage(gpu.PciBus)
+		if err != nil {
+			logger.Warningf("checking for leaked VRAM is disabled, %v", err)
+			return nil
+		}
+
+		leaks.baseline = append(leaks.baseline, usage)
+		for _, process := range usage.Processes {
+			leaks.baselinePids[process.Pid] = struct{}{}
+		}
+	}
+
+	return leaks
+}
+
+// Returns the process ids of the renderers of the agent's sessions and of its warm renderers
+func (agent *Agent) rendererPids() map[int]struct{} {
+	pids := map[int]struct{}{}
+	for _, pid := range agent.warm.pids() {
+		pids[pid] = struct{}{}
+	}
+
+	agent.sessionsMutex.Lock()
+	defer agent.sessionsMutex.Unlock()
+
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		if pid := pair.Value.Object.RendererPid(); pid != 0 {
+			pids[pid] = struct{}{}
+		}
+	}
+
+	return pids
+}
+
+// Waits for the closed session's processes to exit and checks its GPUs for leaked VRAM
+func (agent *Agent) checkVramReleased(group task.Group, session restapi.Session, rendererPid int) {
+	if agent.leaks == nil || session.CpuFallback {
+		return
+	}
+
+	group.GoFn("Agent checkVramReleased", func(group task.Group) error {
+		timer := time.NewTimer(*vramLeakDelay)
+		defer timer.Stop()
+
+		select {
+		case <-group.Ctx().Done():
+			return nil
+		case <-timer.C:
+		}
+
+		for _, gpu := range session.Gpus {
+			agent.checkVramLeak(group, gpu.Index, session.Id, rendererPid)
+		}
+
+		return nil
+	})
+}
+
+// Flags the GPU when it has leaked VRAM and reports it, or clears the flag once the VRAM is released.
+// sessionId and rendererPid are those of the session that closed on the GPU, empty when rechecking.
+func (agent *Agent) checkVramLeak(group task.Group, index int, sessionId string, rendererPid int) {
+	agent.leaks.mutex.Lock()
+	defer agent.leaks.mutex.Unlock()
+
+	apiGpu := agent.Gpus.GetGpus()[index]
+	flagged := agent.Gpus.VramLeaked()[index] > 0
+
+	usage, err := agent.GpuBackend.QueryVramUsage(apiGpu.PciBus)
+	if err != nil {
+		logger.Warningf("unable to check GPU %d @ %s for leaked VRAM, %v", index, apiGpu.PciBus, err)
+		return
+	}
+
+	renderers := agent.rendererPids()
+	delete(renderers, rendererPid)
+
+	// Processes other than renderers of running sessions, including the closed session's renderer
+	// should it still be running, hold VRAM the agent does not account for
+	var leaked, renderersUsed uint64
+	processes := []string{}
+	for _, process := range usage.Processes {
+		if _, found := renderers[process.Pid]; found {
+			renderersUsed += process.VramUsed
+			continue
+		}
+
+		if _, found := agent.leaks.baselinePids[process.Pid]; found && process.Pid != rendererPid {
+			continue
+		}
+
+		leaked += process.VramUsed
+		processes = append(processes, process.String())
+	}
+
+	// Once no sessions run on the GPU, it should use what it used when the agent started, memory the
+	// driver failed to free is not attributed to any process
+	if agent.Gpus.Sessions()[index] == 0 {
+		expected := agent.leaks.baseline[index].Used + renderersUsed
+		if usage.Used > expected && usage.Used-expected > leaked {
+			leaked = usage.Used - expected
+		}
+	}
+
+	if leaked < *vramLeakThreshold*1024*1024 {
+		if flagged {
+			agent.Gpus.SetVramLeaked(index, 0)
+
+			agent.ReportEvent(restapi.Event{
+				Type:    restapi.EventGpuVramReleased,
+				Message: fmt.Sprintf("leaked VRAM on GPU %d @ %s was released", index, apiGpu.PciBus),
+				Data: map[string]string{
+					"gpu":    strconv.Itoa(index),
+					"pciBus": apiGpu.PciBus,
+				},
+			})
+		}
+
+		return
+	}
+
+	agent.Gpus.SetVramLeaked(index, leaked)
+
+	// Only reported when first found, the flagged GPUs are rechecked until the VRAM is released
+	if flagged {
+		return
+	}
+
+	message := fmt.Sprintf("%dMB of VRAM leaked on GPU %d @ %s", leaked/(1024*1024), index, apiGpu.PciBus)
+	if len(processes) > 0 {
+		message = fmt.Sprintf("%s, held by %s", message, strings.Join(processes, ", "))
+	}
+
+	reset := ""
+	if *vramLeakReset {
+		if !cmdgpu.HasCapability(agent.GpuBackend, restapi.CapabilityGpuReset) {
+			reset = fmt.Sprintf("skipped, the %s GPU backend does not reset GPUs", agent.GpuBackend.Name())
+		} else if agent.forgoes(restapi.CapabilityGpuReset) {
+			reset = "skipped, the agent runs rootless"
+		} else if agent.Gpus.Sessions()[index] > 0 {
+			reset = "skipped, sessions run on the GPU"
+		} else if err := agent.GpuBackend.ResetGpu(group.Ctx(), apiGpu.PciBus); err != nil {
+			reset = fmt.Sprintf("failed, %v", err)
+		} else {
+			reset = "succeeded"
+		}
+
+		message = fmt.Sprintf("%s, reset %s", message, reset)
+	}
+
+	agent.ReportEvent(restapi.Event{
+		Type:      restapi.EventGpuVramLeaked,
+		Message:   message,
+		SessionId: sessionId,
+		Data: map[string]string{
+			"gpu":        strconv.Itoa(index),
+			"pciBus":     apiGpu.PciBus,
+			"vramLeaked": strconv.FormatUint(leaked, 10),
+			"processes":  strings.Join(processes, ","),
+			"reset":      reset,
+		},
+	})
+}
+
+// Rechecks the GPUs with leaked VRAM until it is released
+func (agent *Agent) runVramLeaks(group task.Group) error {
+	ticker := time.NewTicker(vramLeakInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			for index, leaked := range agent.Gpus.VramLeaked() {
+				if leaked > 0 {
+					agent.checkVramLeak(group, index, "", 0)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	networkMetricsInterval = flag.Duration("network-metrics-interval", time.Second, "Interval between samples of the sessions' client connections, 0 disables")
+	networkMetricsWindow   = flag.Duration("network-metrics-window", 30*time.Second, "Duration of the rolling summary of the sessions' client connections")
+)
+
+// Receives the network metrics of the active sessions, keyed by session id
+type NetworkMetricsConsumerFn = func(map[string]restapi.NetworkMetrics)
+
+func (agent *Agent) AddNetworkMetricsConsumer(consumer NetworkMetricsConsumerFn) {
+	agent.networkConsumers = append(agent.networkConsumers, consumer)
+}
+
+// Receives the frame metrics reported by the client of a session with the session's tenant
+type FrameMetricsConsumerFn = func(sessionId string, tenant string, frames restapi.FrameMetrics)
+
+func (agent *Agent) AddFrameMetricsConsumer(consumer FrameMetricsConsumerFn) {
+	agent.frameConsumers = append(agent.frameConsumers, consumer)
+}
+
+// Returns the tenant of the session, empty when the session has no tenant or has closed
+func (agent *Agent) SessionTenant(id string) string {
+	agent.sessionsMutex.Lock()
+	defer agent.sessionsMutex.Unlock()
+
+	reference, found := agent.sessions.Get(id)
+	if !found {
+		return ""
+	}
+
+	return reference.Object.Tenant()
+}
+
+func (agent *Agent) sampleNetwork() map[string]restapi.NetworkMetrics {
+	agent.sessionsMutex.Lock()
+	defer agent.sessionsMutex.Unlock()
+
+	metrics := map[string]restapi.NetworkMetrics{}
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		pair.Value.Object.SampleNetwork(*networkMetricsWindow)
+
+		summary := pair.Value.Object.NetworkMetrics()
+		if summary != nil {
+			metrics[pair.Key] = *summary
+		}
+	}
+
+	return metrics
+}
+
+func (agent *Agent) runNetworkMetrics(group task.Group) error {
+	// Sampled without consumers too, the samples tell idle sessions apart
+	if *networkMetricsInterval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(*networkMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			metrics := agent.sampleNetwork()
+			for _, consumer := range agent.networkConsumers {
+				consumer(metrics)
+			}
+		}
+	}
+}
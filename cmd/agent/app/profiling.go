@@ -0,0 +1,50 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/server"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	profilingToken = flag.String("profiling-token", "", "Bearer token operators present to capture the agent's runtime profiles from /debug/pprof/, see juicectl profile. Profiling is disabled when not set")
+)
+
+var errInvalidProfilingToken = pkgerrors.New(pkgerrors.ErrUnauthorized, "invalid profiling token")
+
+// Rejects requests without --profiling-token
+func requireProfilingToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if found && subtle.ConstantTimeCompare([]byte(token), []byte(*profilingToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := errors.Join(errInvalidProfilingToken, pkgnet.RespondWithError(w, errInvalidProfilingToken))
+		logger.Error(err)
+	})
+}
+
+func (agent *Agent) profilingEp(group task.Group, router *mux.Router) error {
+	if *profilingToken == "" {
+		return nil
+	}
+
+	subrouter := router.NewRoute().Subrouter()
+	subrouter.Use(requireProfilingToken)
+	return server.ProfilingEp(group, subrouter)
+}
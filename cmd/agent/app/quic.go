@@ -0,0 +1,62 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/transport"
+)
+
+var (
+	quicAddress       = flag.String("quic-address", "", "Experimental. The IP address and UDP port to also accept client connections on over QUIC, which resume when the client's network changes, such as from Wi-Fi to wired. Clients connect over TCP to --address when unset")
+	quicResumeTimeout = flag.Duration("quic-resume-timeout", 30*time.Second, "How long client connections over QUIC wait for their client to resume them after its network changes before they are closed")
+)
+
+// Returns nil when QUIC is disabled. Without TLS, QUIC connections are secured with a self-signed
+// certificate, which only clients skipping verification accept.
+func newQuicListener(tlsConfig *tls.Config) (*transport.Listener, error) {
+	if *quicAddress == "" {
+		return nil, nil
+	}
+
+	if tlsConfig == nil {
+		certificate, err := crypto.GenerateCertificate()
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+		}
+	}
+
+	listener, err := transport.Listen(*quicAddress, tlsConfig, *quicResumeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Agent.NewAgent: unable to listen on --quic-address %s, %v", *quicAddress, err)
+	}
+
+	logger.Infof("QUIC (experimental): accepting client connections on %s", listener.Addr())
+	return listener, nil
+}
+
+// Returns the UDP port client connections over QUIC are accepted on, 0 when they are not
+func (agent *Agent) quicPort() int {
+	if agent.quic == nil {
+		return 0
+	}
+
+	address, ok := agent.quic.Addr().(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+
+	return address.Port
+}
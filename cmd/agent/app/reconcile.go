@@ -0,0 +1,190 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+const (
+	staleSessionKill  = "kill"
+	staleSessionAdopt = "adopt"
+)
+
+var (
+	staleSessionGrace  = flag.Duration("stale-session-grace", time.Minute, "How long a session may run without the controller knowing about it before --stale-session-action is taken, 0 disables")
+	staleSessionAction = flag.String("stale-session-action", staleSessionKill, "What to do with sessions the controller no longer knows about, kill or adopt. Adopted sessions run until they exit and keep their GPUs, which the controller may assign again")
+)
+
+// Sessions the controller no longer knows about, tracked across updates by the controller update task
+type staleSessions struct {
+	// When each session was first missing from the controller's view of the agent
+	missingSince map[string]time.Time
+	adopted      map[string]struct{}
+}
+
+func newStaleSessions() staleSessions {
+	return staleSessions{
+		missingSince: map[string]time.Time{},
+		adopted:      map[string]struct{}{},
+	}
+}
+
+func validateStaleSessionAction() error {
+	if *staleSessionAction != staleSessionKill && *staleSessionAction != staleSessionAdopt {
+		return fmt.Errorf("--stale-session-action must be %s or %s, not %s", staleSessionKill, staleSessionAdopt, *staleSessionAction)
+	}
+
+	return nil
+}
+
+func (agent *Agent) getSessionIds() []string {
+	agent.sessionsMutex.Lock()
+	defer agent.sessionsMutex.Unlock()
+
+	ids := make([]string, 0, agent.sessions.Len())
+	for pair := agent.sessions.Oldest(); pair != nil; pair = pair.Next() {
+		ids = append(ids, pair.Key)
+	}
+
+	return ids
+}
+
+// Reports the sessions the agent runs to the controller, which corrects its records of the agent
+// to them, such as after the controller restarted
+func (agent *Agent) reconcileWithController(ctx context.Context) error {
+	sessions := []restapi.Session{}
+	for _, id := range agent.getSessionIds() {
+		reference, err := agent.getSession(id)
+		if err != nil {
+			// Exited in the meantime
+			continue
+		}
+
+		sessions = append(sessions, reference.Object.Session())
+		reference.Release()
+	}
+
+	result, err := agent.api.ReconcileAgentWithContext(ctx, agent.Id, restapi.AgentReconciliation{
+		Sessions: sessions,
+	})
+	if err != nil {
+		return fmt.Errorf("Agent.reconcileWithController: failed to report %d sessions to Controller with %s", len(sessions), err)
+	}
+
+	logger.Infof("reported %d sessions to Controller, adopted %d, corrected %d, and closed %d",
+		len(sessions), len(result.Adopted), len(result.Corrected), len(result.Closed))
+
+	if len(result.Conflicting) > 0 {
+		logger.Warningf("sessions %s run on this agent but Controller placed them on another agent", strings.Join(result.Conflicting, ", "))
+	}
+
+	return nil
+}
+
+// Takes --stale-session-action on the sessions the agent runs that have been missing from the
+// controller's view of the agent for --stale-session-grace, such as after the controller lost
+// its state. Sessions briefly missing while they start or close are left alone by the grace.
+func (agent *Agent) reconcileSessions(controllerSessions []restapi.Session) error {
+	if *staleSessionGrace <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	known := map[string]struct{}{}
+	for _, session := range controllerSessions {
+		known[session.Id] = struct{}{}
+	}
+
+	running := map[string]struct{}{}
+
+	var err error
+	for _, id := range agent.getSessionIds() {
+		running[id] = struct{}{}
+
+		if _, found := known[id]; found {
+			if _, stale := agent.stale.missingSince[id]; stale {
+				logger.WithSession(id).Infof("session %s is known to the controller again", id)
+				delete(agent.stale.missingSince, id)
+			}
+			delete(agent.stale.adopted, id)
+			continue
+		}
+
+		if _, adopted := agent.stale.adopted[id]; adopted {
+			continue
+		}
+
+		missingSince, stale := agent.stale.missingSince[id]
+		if !stale {
+			logger.WithSession(id).Debugf("session %s is not known to the controller", id)
+			agent.stale.missingSince[id] = now
+			continue
+		}
+
+		missingFor := now.Sub(missingSince)
+		if missingFor < *staleSessionGrace {
+			continue
+		}
+
+		delete(agent.stale.missingSince, id)
+
+		event := restapi.Event{
+			SessionId: id,
+			Data: map[string]string{
+				"missingFor": missingFor.Round(time.Second).String(),
+			},
+		}
+
+		switch *staleSessionAction {
+		case staleSessionKill:
+			reference, err_ := agent.getSession(id)
+			if err_ != nil {
+				// Exited in the meantime
+				continue
+			}
+
+			err_ = reference.Object.Cancel()
+			reference.Release()
+			if err_ != nil {
+				err = errors.Join(err, fmt.Errorf("Agent.reconcileSessions: unable to kill stale session %s with %s", id, err_))
+				continue
+			}
+
+			event.Type = restapi.EventSessionStaleKilled
+			event.Message = fmt.Sprintf("killed session %s, not known to the controller for %s", id, event.Data["missingFor"])
+
+		case staleSessionAdopt:
+			agent.stale.adopted[id] = struct{}{}
+
+			event.Type = restapi.EventSessionStaleAdopted
+			event.Message = fmt.Sprintf("adopted session %s, not known to the controller for %s", id, event.Data["missingFor"])
+		}
+
+		agent.ReportEvent(event)
+	}
+
+	// Forget the sessions that have since exited
+	for id := range agent.stale.missingSince {
+		if _, found := running[id]; !found {
+			delete(agent.stale.missingSince, id)
+		}
+	}
+	for id := range agent.stale.adopted {
+		if _, found := running[id]; !found {
+			delete(agent.stale.adopted, id)
+		}
+	}
+
+	return err
+}
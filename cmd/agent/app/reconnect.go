@@ -0,0 +1,126 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"time"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+var (
+	controllerReconnectBackoff    = flag.Duration("controller-reconnect-backoff", time.Second, "Delay before reconnecting to the controller after losing it, doubled after each failed attempt up to --controller-reconnect-max-backoff. Each delay is jittered so agents losing the same controller do not reconnect at once")
+	controllerReconnectMaxBackoff = flag.Duration("controller-reconnect-max-backoff", time.Minute, "Longest delay between attempts to reconnect to the controller")
+	controllerReconnectTimeout    = flag.Duration("controller-reconnect-timeout", 0, "How long the agent tries to reconnect to the controller before exiting, 0 retries until the agent is stopped. Sessions keep running while the agent is disconnected")
+)
+
+func validateControllerReconnect() error {
+	if *controllerReconnectBackoff <= 0 {
+		return errors.New("--controller-reconnect-backoff must be positive")
+	}
+
+	if *controllerReconnectMaxBackoff < *controllerReconnectBackoff {
+		return errors.New("--controller-reconnect-max-backoff must be at least --controller-reconnect-backoff")
+	}
+
+	if *controllerReconnectTimeout < 0 {
+		return errors.New("--controller-reconnect-timeout must not be negative")
+	}
+
+	return nil
+}
+
+// Returns whether retrying cannot succeed without changing the agent's configuration, such as a
+// rejected --join-token or --controller-token
+func isFatalControllerError(err error) bool {
+	return errors.Is(err, pkgerrors.ErrUnauthorized) || errors.Is(err, pkgerrors.ErrForbidden)
+}
+
+// Tracks the attempts to reach the controller since the agent lost it, used by the controller
+// update task
+type controllerReconnect struct {
+	// Zero while connected
+	disconnectedAt time.Time
+	attempts       int
+	backoff        time.Duration
+}
+
+// Records a failed attempt to reach the controller, returning the delay before the next one or
+// err when the agent must stop trying
+func (reconnect *controllerReconnect) failed(err error) (time.Duration, error) {
+	if isFatalControllerError(err) {
+		return 0, err
+	}
+
+	now := time.Now()
+	if reconnect.disconnectedAt.IsZero() {
+		reconnect.disconnectedAt = now
+		reconnect.attempts = 0
+		reconnect.backoff = *controllerReconnectBackoff
+	} else if *controllerReconnectTimeout > 0 && now.Sub(reconnect.disconnectedAt) >= *controllerReconnectTimeout {
+		return 0, fmt.Errorf("Agent.ConnectToController: unable to reach Controller at %s for %s, %w", *controllerAddress, *controllerReconnectTimeout, err)
+	}
+
+	reconnect.attempts++
+
+	// Between half and all of the backoff
+	delay := reconnect.backoff/2 + time.Duration(rand.Int63n(int64(reconnect.backoff/2)+1))
+
+	reconnect.backoff *= 2
+	if reconnect.backoff > *controllerReconnectMaxBackoff {
+		reconnect.backoff = *controllerReconnectMaxBackoff
+	}
+
+	return delay, nil
+}
+
+// Records a successful attempt to reach the controller, returning how long the agent was
+// disconnected, 0 when it was not
+func (reconnect *controllerReconnect) succeeded() time.Duration {
+	if reconnect.disconnectedAt.IsZero() {
+		return 0
+	}
+
+	disconnectedFor := time.Since(reconnect.disconnectedAt)
+	reconnect.disconnectedAt = time.Time{}
+	return disconnectedFor
+}
+
+// Calls connect until it succeeds, waiting a jittered exponential backoff between attempts
+func (reconnect *controllerReconnect) retry(ctx context.Context, connect func() error) error {
+	for {
+		err := connect()
+		if err == nil {
+			disconnectedFor := reconnect.succeeded()
+			if disconnectedFor > 0 {
+				logger.Infof("connected to Controller at %s after %d attempts over %s", *controllerAddress, reconnect.attempts+1, disconnectedFor.Round(time.Second))
+			}
+
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return err
+		}
+
+		delay, err_ := reconnect.failed(err)
+		if err_ != nil {
+			return err_
+		}
+
+		logger.Warningf("unable to connect to Controller at %s, retrying in %s, %v", *controllerAddress, delay.Round(time.Millisecond), err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
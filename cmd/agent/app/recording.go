@@ -0,0 +1,144 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	recordingDir         = flag.String("recording-dir", "", "Directory the sessions requiring it are recorded to, encrypted with keys only the controller can decrypt. Recording requires --controller and --recording-token and is disabled when not set")
+	recordingToken       = flag.String("recording-token", "", "Bearer token the controller presents to retrieve recordings for the users its authorization policy allows, the controller's --agent-recording-token")
+	recordingMaxSize     = flag.Int64("recording-max-size", 4*1024*1024*1024, "The bytes each session's recording may hold, the session goes on unrecorded once reached. 0 is unlimited")
+	recordingMaxDuration = flag.Duration("recording-max-duration", 8*time.Hour, "How long each session is recorded for, the session goes on unrecorded after. 0 is unlimited")
+)
+
+var (
+	errRecordingDisabled     = pkgerrors.New(pkgerrors.ErrForbidden, "recording sessions is disabled, see --recording-dir and --recording-token")
+	errInvalidRecordingToken = pkgerrors.New(pkgerrors.ErrUnauthorized, "invalid recording token")
+)
+
+func recordingEnabled() bool {
+	return *controllerAddress != "" && *recordingDir != "" && *recordingToken != ""
+}
+
+func validRecordingToken(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(*recordingToken)) == 1
+}
+
+func recordingPath(id string) string {
+	return filepath.Join(*recordingDir, id+".jrec")
+}
+
+// Records the session with a key requested from the controller, the session must not start
+// unrecorded when this fails
+func (agent *Agent) startRecording(ctx context.Context, newSession *session.Session) error {
+	id := newSession.Id()
+
+	if !recordingEnabled() {
+		return pkgerrors.Errorf(pkgerrors.ErrUnavailable, "session %s requires recording, %v", id, errRecordingDisabled)
+	}
+
+	key, err := agent.api.RequestSessionRecordingKeyWithContext(ctx, agent.Id, id)
+	if err != nil {
+		return fmt.Errorf("unable to request the recording key of session %s, %v", id, err)
+	}
+
+	err = os.MkdirAll(*recordingDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	recorder, err := session.NewRecorder(id, recordingPath(id), key, *recordingMaxSize, *recordingMaxDuration, func(reason string, size int64) {
+		agent.ReportEvent(restapi.Event{
+			Type:      restapi.EventSessionRecordingEnded,
+			Message:   fmt.Sprintf("recording of session %s ended, %s", id, reason),
+			SessionId: id,
+			Data: map[string]string{
+				"reason": reason,
+				"size":   strconv.FormatInt(size, 10),
+			},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to record session %s, %v", id, err)
+	}
+
+	newSession.SetRecorder(recorder)
+	return nil
+}
+
+// Serves the encrypted recording of a session, which may have closed, to the controller
+func (agent *Agent) getSessionRecordingEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/session/{id}/recording").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := errRecordingDisabled
+			if recordingEnabled() {
+				err = nil
+				if !validRecordingToken(r) {
+					err = errInvalidRecordingToken
+				}
+			}
+
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			id := mux.Vars(r)["id"]
+
+			// Only session ids name recordings, never paths
+			_, err = uuid.Parse(id)
+			if err != nil {
+				err = fmt.Errorf("/v1/session/%s/recording: invalid session id", id)
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			file, err := os.Open(recordingPath(id))
+			if err != nil {
+				if os.IsNotExist(err) {
+					err = pkgerrors.Errorf(pkgerrors.ErrNotFound, "session %s has no recording on the agent", id)
+				}
+
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer file.Close()
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(http.StatusOK)
+
+			_, err = io.Copy(w, file)
+			if err != nil {
+				logger.Errorf("/v1/session/%s/recording: %v", id, err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Running sessions, reading GPU metrics and VRAM usage, and fairness throttling only touch the
+// agent's own renderers and need no privileges. Without root the agent forgoes:
+//
+//   - GPU resets, --vram-leak-reset still reports leaked VRAM but leaves the GPUs to operators
+//   - eBPF network accounting, unless the agent is granted CAP_BPF and a delegated cgroup v2
+//     subtree, see --ebpf-network-accounting and --ebpf-cgroup-root
+//   - Xid errors from the kernel log, unless /dev/kmsg is readable, see --gpu-unhealthy-xids
+//
+// The capabilities the agent registers with omit the features it forgoes, so sessions requiring
+// them through restapi.SessionRequirements.RequireCapabilities are placed elsewhere.
+
+var (
+	rootless = flag.Bool("rootless", false, "Runs the agent without the features that need root, GPU resets and, when the agent cannot load its programs, eBPF network accounting. Set automatically when the agent is not run as root. The controller is told which features the agent forgoes")
+)
+
+// Returns whether the agent runs without root, see --rootless
+func isRootless() bool {
+	// Geteuid is -1 on Windows, where the agent runs as a service with the privileges it needs
+	euid := os.Geteuid()
+	return *rootless || (euid != 0 && euid != -1)
+}
+
+// Initializes the features needing privileges, those the agent forgoes running without root are
+// recorded rather than failing it
+func (agent *Agent) initializePrivileged() error {
+	agent.rootless = isRootless()
+
+	err := session.InitializeNetworkAccounting()
+	if err != nil {
+		if !agent.rootless {
+			return err
+		}
+
+		logger.Warningf("eBPF network accounting is disabled running rootless, %v", err)
+		agent.forgone = append(agent.forgone, restapi.CapabilityNetworkAccounting)
+	}
+
+	if !agent.rootless {
+		return nil
+	}
+
+	if cmdgpu.HasCapability(agent.GpuBackend, restapi.CapabilityGpuReset) {
+		agent.forgone = append(agent.forgone, restapi.CapabilityGpuReset)
+
+		if *vramLeakReset {
+			logger.Warning("--vram-leak-reset: GPUs are not reset running rootless")
+		}
+	}
+
+	if len(agent.forgone) == 0 {
+		logger.Infof("Rootless: running as uid %d", os.Geteuid())
+	} else {
+		logger.Infof("Rootless: running as uid %d without %s", os.Geteuid(), strings.Join(agent.forgone, ", "))
+	}
+
+	return nil
+}
+
+// Returns whether the agent forgoes the feature running without root, see restapi.Capability*
+func (agent *Agent) forgoes(capability string) bool {
+	for _, forgone := range agent.forgone {
+		if forgone == capability {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,230 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	cmdgpu "github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	selfTest     = flag.Bool("self-test", true, "Checks on startup that the renderer and its libraries are installed, the GPU driver answers, the renderer creates a Vulkan instance, and the controller is reachable with a clock agreeing with the agent's. The results are reported to the controller when registering, which may refuse or cordon agents failing critical checks")
+	maxClockSkew = flag.Duration("max-clock-skew", 30*time.Second, "How far the agent's clock may be from the controller's before the self-test's clock check fails, see --self-test")
+)
+
+// How long the self-test waits on the renderer and the controller
+const selfTestTimeout = 30 * time.Second
+
+// Returns the directories the Vulkan loader is searched for in and its file name
+func vulkanLoader(juicePath string) ([]string, string) {
+	directories := []string{juicePath}
+
+	switch runtime.GOOS {
+	case "windows":
+		return append(directories, filepath.Join(os.Getenv("SystemRoot"), "System32")), "vulkan-1.dll"
+
+	case "darwin":
+		return append(directories, "/usr/local/lib", "/opt/homebrew/lib"), "libvulkan.1.dylib"
+
+	default:
+		for _, directory := range filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")) {
+			if directory != "" {
+				directories = append(directories, directory)
+			}
+		}
+
+		return append(directories, "/usr/lib/x86_64-linux-gnu", "/usr/lib/aarch64-linux-gnu", "/usr/lib64", "/usr/lib", "/lib/x86_64-linux-gnu", "/lib64", "/lib", "/usr/local/lib"), "libvulkan.so.1"
+	}
+}
+
+func rendererPath(juicePath string) string {
+	path := filepath.Join(juicePath, "Renderer_Win")
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+
+	return path
+}
+
+func checkLibraries(juicePath string) restapi.SelfTestCheck {
+	check := restapi.SelfTestCheck{Name: restapi.SelfTestLibraries}
+
+	renderer := rendererPath(juicePath)
+	info, err := os.Stat(renderer)
+	if err != nil {
+		check.Message = fmt.Sprintf("the renderer %s is not installed, %v", renderer, err)
+		return check
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		check.Message = fmt.Sprintf("the renderer %s is not executable", renderer)
+		return check
+	}
+
+	directories, loader := vulkanLoader(juicePath)
+	for _, directory := range directories {
+		path := filepath.Join(directory, loader)
+		_, err := os.Stat(path)
+		if err == nil {
+			check.Passed = true
+			check.Message = fmt.Sprintf("found %s and %s", renderer, path)
+			return check
+		}
+	}
+
+	check.Message = fmt.Sprintf("the Vulkan loader %s is not installed in %s", loader, strings.Join(directories, ", "))
+	return check
+}
+
+func (agent *Agent) checkGpuDriver() restapi.SelfTestCheck {
+	check := restapi.SelfTestCheck{Name: restapi.SelfTestGpuDriver}
+
+	backend := agent.GpuBackend.Name()
+
+	err := agent.GpuBackend.Available()
+	if err != nil {
+		check.Message = fmt.Sprintf("the %s GPU backend is unavailable, %v", backend, err)
+		return check
+	}
+
+	if agent.Gpus.Count() == 0 {
+		check.Message = fmt.Sprintf("the %s GPU backend found no GPUs", backend)
+		return check
+	}
+
+	for _, apiGpu := range agent.Gpus.GetGpus() {
+		_, err := agent.GpuBackend.QueryVramUsage(apiGpu.PciBus)
+		if err != nil && !errors.Is(err, cmdgpu.ErrUnsupported) {
+			check.Message = fmt.Sprintf("the %s GPU backend is unable to query GPU %d @ %s, %v", backend, apiGpu.Index, apiGpu.PciBus, err)
+			return check
+		}
+	}
+
+	check.Passed = true
+	check.Message = fmt.Sprintf("the %s GPU backend reads %d GPUs", backend, agent.Gpus.Count())
+	return check
+}
+
+func checkVulkan(ctx context.Context, juicePath string) restapi.SelfTestCheck {
+	check := restapi.SelfTestCheck{Name: restapi.SelfTestVulkan}
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	// Listing the GPUs creates a Vulkan instance and enumerates its physical devices
+	output, err := exec.CommandContext(ctx, filepath.Join(juicePath, "Renderer_Win"), "--log_group", "Fatal", "--dump_gpus", "0").Output()
+	if err != nil {
+		check.Message = fmt.Sprintf("the renderer was unable to create a Vulkan instance, %v", err)
+		return check
+	}
+
+	gpus, err := gpu.NewGpuSetFromJson(output)
+	if err != nil {
+		check.Message = fmt.Sprintf("unable to read the GPUs the renderer enumerated, %v", err)
+		return check
+	}
+
+	if gpus.Count() == 0 {
+		check.Message = "the renderer created a Vulkan instance without GPUs"
+		return check
+	}
+
+	check.Passed = true
+	check.Message = fmt.Sprintf("the renderer enumerated %d GPUs through Vulkan", gpus.Count())
+	return check
+}
+
+func checkControllerReachable(ctx context.Context) restapi.SelfTestCheck {
+	check := restapi.SelfTestCheck{Name: restapi.SelfTestController}
+
+	dialer := net.Dialer{Timeout: selfTestTimeout}
+
+	startedAt := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", *controllerAddress)
+	if err != nil {
+		check.Message = fmt.Sprintf("unable to reach the controller at %s, %v", *controllerAddress, err)
+		return check
+	}
+	conn.Close()
+
+	check.Passed = true
+	check.Message = fmt.Sprintf("reached the controller at %s in %s", *controllerAddress, time.Since(startedAt).Round(time.Millisecond))
+	return check
+}
+
+func (agent *Agent) checkClockSkew(ctx context.Context) restapi.SelfTestCheck {
+	check := restapi.SelfTestCheck{Name: restapi.SelfTestClockSkew}
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	sentAt := time.Now()
+	status, err := agent.api.StatusWithContext(ctx)
+	if err != nil {
+		check.Message = fmt.Sprintf("unable to read the controller's clock, %v", err)
+		return check
+	}
+	receivedAt := time.Now()
+
+	if status.Time.IsZero() {
+		check.Passed = true
+		check.Message = "the controller does not report its clock"
+		return check
+	}
+
+	// The controller read its clock about halfway through the request
+	skew := status.Time.Sub(sentAt.Add(receivedAt.Sub(sentAt) / 2))
+	if skew < 0 {
+		skew = -skew
+	}
+
+	check.Passed = skew <= *maxClockSkew
+	check.Message = fmt.Sprintf("the agent's clock is %s from the controller's, at most %s is allowed", skew.Round(time.Millisecond), *maxClockSkew)
+	return check
+}
+
+// Runs the checks of the self-test and logs their results, nil when --self-test is disabled.
+// The controller's checks are only run when connecting to a controller.
+func (agent *Agent) runSelfTest(ctx context.Context) *restapi.SelfTest {
+	if !*selfTest {
+		return nil
+	}
+
+	result := &restapi.SelfTest{
+		RanAt: time.Now().UTC(),
+		Checks: []restapi.SelfTestCheck{
+			checkLibraries(agent.JuicePath),
+			agent.checkGpuDriver(),
+			checkVulkan(ctx, agent.JuicePath),
+		},
+	}
+
+	if *controllerAddress != "" {
+		result.Checks = append(result.Checks, checkControllerReachable(ctx), agent.checkClockSkew(ctx))
+	}
+
+	for _, check := range result.Checks {
+		if check.Passed {
+			logger.Infof("self-test %s passed, %s", check.Name, check.Message)
+		} else {
+			logger.Warningf("self-test %s failed, %s", check.Name, check.Message)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,115 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+var (
+	gpuSharing = flag.String("gpu-sharing", "", "Comma separated list of gpu=sessions[:vram] entries splitting each GPU into fractions shared by up to sessions sessions, each allocated at most vram MiB, the GPU's VRAM divided by sessions when omitted. Sessions without a VRAM requirement are allocated the whole fraction. gpu is the GPU's index or * for every GPU")
+)
+
+type gpuFraction struct {
+	maxSessions int
+	// In bytes, 0 divides the GPU's VRAM between the sessions
+	sessionVram uint64
+}
+
+func parseGpuShare(entry string) (string, gpuFraction, error) {
+	keyValue := strings.Split(entry, "=")
+	if len(keyValue) != 2 {
+		return "", gpuFraction{}, fmt.Errorf("entry '%s' must be in the format gpu=sessions[:vram]", entry)
+	}
+
+	sessions, vram, hasVram := strings.Cut(strings.TrimSpace(keyValue[1]), ":")
+
+	share := gpuFraction{}
+
+	var err error
+	share.maxSessions, err = strconv.Atoi(sessions)
+	if err != nil || share.maxSessions < 1 {
+		return "", gpuFraction{}, fmt.Errorf("entry '%s' must share the GPU between 1 or more sessions", entry)
+	}
+
+	if hasVram {
+		mib, err := strconv.ParseUint(vram, 10, 64)
+		if err != nil || mib == 0 {
+			return "", gpuFraction{}, fmt.Errorf("entry '%s' must allocate each session 1 MiB of VRAM or more", entry)
+		}
+
+		share.sessionVram = mib * 1024 * 1024
+	}
+
+	return strings.TrimSpace(keyValue[0]), share, nil
+}
+
+// Splits the GPUs into the fractions set by --gpu-sharing, entries of a GPU's index take
+// precedence over *
+func shareGpus(gpus *gpu.GpuSet) error {
+	if *gpuSharing == "" {
+		return nil
+	}
+
+	shares := map[int]gpuFraction{}
+	var all *gpuFraction
+
+	var err error
+	for _, entry := range strings.Split(*gpuSharing, ",") {
+		key, share, err_ := parseGpuShare(entry)
+		if err_ != nil {
+			err = errors.Join(err, err_)
+			continue
+		}
+
+		if key == "*" {
+			all = &share
+			continue
+		}
+
+		index, err_ := strconv.Atoi(key)
+		if err_ != nil || index < 0 || index >= gpus.Count() {
+			err = errors.Join(err, fmt.Errorf("entry '%s' must name a GPU index from 0 to %d or *", entry, gpus.Count()-1))
+			continue
+		}
+
+		shares[index] = share
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to parse --gpu-sharing with %s", err)
+	}
+
+	for index, apiGpu := range gpus.GetGpus() {
+		share, found := shares[index]
+		if !found {
+			if all == nil {
+				continue
+			}
+
+			share = *all
+		}
+
+		sessionVram := share.sessionVram
+		if sessionVram == 0 {
+			sessionVram = apiGpu.Vram / uint64(share.maxSessions)
+		}
+
+		if sessionVram > apiGpu.Vram {
+			return fmt.Errorf("--gpu-sharing allocates sessions %d MiB of GPU %d, which has %d MiB of VRAM", sessionVram/(1024*1024), index, apiGpu.Vram/(1024*1024))
+		}
+
+		gpus.Share(index, share.maxSessions, sessionVram)
+		logger.Infof("GPU %d shared by up to %d sessions of at most %dMB", index, share.maxSessions, sessionVram/(1024*1024))
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const (
+	// Largest probe clients may read to measure their bandwidth to the agent
+	maxProbeSize = 64 * 1024 * 1024
+
+	// Links at least this fast stream uncompressed, compressing costs the renderer more than it
+	// saves on the wire
+	streamUncompressedMbps = 1000
+	streamFastMbps         = 200
+	streamBalancedMbps     = 50
+
+	// Links slower than these, or with round trips longer than streamLimitedRttMs, have the frame
+	// rate limited too as frames beyond it only queue behind the ones in flight
+	streamLimitedMbps     = 20
+	streamConstrainedMbps = 5
+	streamLimitedRttMs    = 100
+)
+
+// Returns how the client streams the session from the bandwidth and round trip time it measured,
+// keeping the parameters it overrides
+func negotiateStream(negotiation restapi.StreamNegotiation) restapi.StreamParameters {
+	estimate := negotiation.Estimate
+
+	stream := restapi.StreamParameters{}
+	switch {
+	case estimate.BandwidthMbps >= streamUncompressedMbps:
+		stream.Compression = restapi.StreamCompressionNone
+	case estimate.BandwidthMbps >= streamFastMbps:
+		stream.Compression = restapi.StreamCompressionFast
+	case estimate.BandwidthMbps >= streamBalancedMbps:
+		stream.Compression = restapi.StreamCompressionBalanced
+	default:
+		stream.Compression = restapi.StreamCompressionSmall
+	}
+
+	switch {
+	case estimate.BandwidthMbps < streamConstrainedMbps:
+		stream.FrameRateLimit = 15
+	case estimate.BandwidthMbps < streamLimitedMbps || estimate.RttMs > streamLimitedRttMs:
+		stream.FrameRateLimit = 30
+	}
+
+	if negotiation.Overrides.Compression != "" {
+		stream.Compression = negotiation.Overrides.Compression
+	}
+
+	if negotiation.Overrides.FrameRateLimit > 0 {
+		stream.FrameRateLimit = negotiation.Overrides.FrameRateLimit
+	}
+
+	return stream
+}
+
+func validateStreamNegotiation(negotiation restapi.StreamNegotiation) error {
+	switch negotiation.Overrides.Compression {
+	case "", restapi.StreamCompressionNone, restapi.StreamCompressionFast, restapi.StreamCompressionBalanced, restapi.StreamCompressionSmall:
+	default:
+		return fmt.Errorf("unknown compression %s", negotiation.Overrides.Compression)
+	}
+
+	if negotiation.Overrides.FrameRateLimit < 0 || negotiation.Estimate.BandwidthMbps < 0 || negotiation.Estimate.RttMs < 0 {
+		return errors.New("expected an estimate and a frame rate limit of at least 0")
+	}
+
+	return nil
+}
+
+// Serves the bytes clients read to measure their bandwidth to the agent, over the same connection
+// as their sessions' traffic
+func (agent *Agent) probeSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/session/{id}/probe").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !validSessionToken(r) {
+				err := pkgnet.RespondWithError(w, errInvalidSessionToken)
+				if err != nil {
+					logger.Error(err)
+				}
+				return
+			}
+
+			id := mux.Vars(r)["id"]
+
+			size, err := strconv.Atoi(r.URL.Query().Get("size"))
+			if err != nil || size <= 0 || size > maxProbeSize {
+				err = fmt.Errorf("/v1/session/%s/probe: expected a size between 1 and %d", id, maxProbeSize)
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			reference, err := agent.getSession(id)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer reference.Release()
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			w.WriteHeader(http.StatusOK)
+
+			chunk := make([]byte, 64*1024)
+			for size > 0 {
+				if size < len(chunk) {
+					chunk = chunk[:size]
+				}
+
+				written, err := w.Write(chunk)
+				if err != nil {
+					logger.WithSession(id).Debugf("/v1/session/%s/probe: %v", id, err)
+					return
+				}
+
+				size -= written
+			}
+		})
+	return nil
+}
+
+func (agent *Agent) negotiateSessionStreamEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/session/{id}/stream").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !validSessionToken(r) {
+				err := pkgnet.RespondWithError(w, errInvalidSessionToken)
+				if err != nil {
+					logger.Error(err)
+				}
+				return
+			}
+
+			id := mux.Vars(r)["id"]
+
+			negotiation, err := pkgnet.ReadRequestBody[restapi.StreamNegotiation](r)
+			if err == nil {
+				err = validateStreamNegotiation(negotiation)
+			}
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			reference, err := agent.getSession(id)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+			defer reference.Release()
+
+			stream := negotiateStream(negotiation)
+			reference.Object.SetStream(stream)
+
+			logger.WithSession(id).Infof("session %s streams with %s compression and a frame rate limit of %d, the client estimates %.1f Mbps and %.1f ms round trips",
+				id, stream.Compression, stream.FrameRateLimit, negotiation.Estimate.BandwidthMbps, negotiation.Estimate.RttMs)
+
+			err = pkgnet.Respond(w, http.StatusOK, stream)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
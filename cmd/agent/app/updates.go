@@ -0,0 +1,136 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	maxPendingSessionUpdates = flag.Int("max-pending-session-updates", 1024, "Maximum number of sessions with state changes the controller has not received. Changes of a session are coalesced into its latest state; beyond the limit changes are dropped, closing sessions last, and left to reconciliation with the controller")
+)
+
+// Counts of the session state changes not sent to the controller as they happened
+type SessionUpdateStats struct {
+	// Changes replaced by a later change of the same session before the controller received them
+	Coalesced uint64
+	// Changes discarded because too many sessions had changes pending
+	Dropped uint64
+	// Sessions with changes the controller has not received
+	Pending int
+}
+
+// Holds the latest state change of each session until the controller acknowledges it, so sessions
+// changing state never wait on the controller and the memory held while it is unreachable is bounded
+// by the number of sessions
+type pendingSessionUpdates struct {
+	mutex   sync.Mutex
+	updates map[string]sessionUpdate
+	limit   int
+
+	coalesced uint64
+	dropped   uint64
+}
+
+func newPendingSessionUpdates(limit int) *pendingSessionUpdates {
+	return &pendingSessionUpdates{
+		updates: map[string]sessionUpdate{},
+		limit:   limit,
+	}
+}
+
+func (pending *pendingSessionUpdates) add(update sessionUpdate) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	previous, found := pending.updates[update.Id]
+	if found {
+		pending.coalesced++
+
+		// Changes arrive in order, but a closed session never changes state again
+		if previous.State != restapi.SessionClosed {
+			pending.updates[update.Id] = update
+		}
+		return
+	}
+
+	if pending.limit > 0 && len(pending.updates) >= pending.limit {
+		// Closing a session releases its resources on the controller, make room by dropping the
+		// change of a session that is still running
+		evicted := false
+		if update.State == restapi.SessionClosed {
+			for id, queued := range pending.updates {
+				if queued.State != restapi.SessionClosed {
+					logger.WithSession(id).Warningf("session %s update to %s dropped, too many pending session updates", id, queued.State)
+					delete(pending.updates, id)
+					evicted = true
+					break
+				}
+			}
+		}
+
+		pending.dropped++
+		if !evicted {
+			logger.WithSession(update.Id).Warningf("session %s update to %s dropped, too many pending session updates", update.Id, update.State)
+			return
+		}
+	}
+
+	pending.updates[update.Id] = update
+}
+
+// Returns the pending updates to send to the controller, they remain pending until acknowledged
+func (pending *pendingSessionUpdates) take() map[string]restapi.SessionUpdate {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	updates := make(map[string]restapi.SessionUpdate, len(pending.updates))
+	for id, update := range pending.updates {
+		updates[id] = restapi.SessionUpdate{
+			State:      update.State,
+			ExitStatus: update.ExitStatus,
+		}
+	}
+
+	return updates
+}
+
+// Removes the updates the controller received, leaving those of sessions that changed state again
+// since they were taken
+func (pending *pendingSessionUpdates) acknowledge(sent map[string]restapi.SessionUpdate) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	for id, update := range sent {
+		queued, found := pending.updates[id]
+		if found && queued.State == update.State && queued.ExitStatus == update.ExitStatus {
+			delete(pending.updates, id)
+		}
+	}
+}
+
+func (pending *pendingSessionUpdates) stats() SessionUpdateStats {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	return SessionUpdateStats{
+		Coalesced: pending.coalesced,
+		Dropped:   pending.dropped,
+		Pending:   len(pending.updates),
+	}
+}
+
+// Returns the counts of the session state changes not sent to the controller as they happened,
+// zero when not connected to a controller
+func (agent *Agent) SessionUpdateStats() SessionUpdateStats {
+	if agent.sessionUpdates == nil {
+		return SessionUpdateStats{}
+	}
+
+	return agent.sessionUpdates.stats()
+}
@@ -0,0 +1,175 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/session"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	warmRenderersPerGpu = flag.Int("warm-renderers-per-gpu", 0, "The number of Renderer_Win processes kept started and initialized on each GPU ahead of sessions, sessions on a single GPU are handed one and start without waiting for the renderer to initialize. Idle renderers hold their driver contexts and libraries, 0 disables")
+)
+
+// Interval between checks that the pool is full, renderers that failed to start are retried then
+const warmPoolInterval = 10 * time.Second
+
+// Renderers started ahead of their sessions, by the PCI bus of the GPU they render on
+type warmPool struct {
+	juicePath string
+	size      int
+	pciBuses  []string
+
+	mutex sync.Mutex
+	idle  map[string][]*session.Renderer
+
+	refill chan struct{}
+}
+
+// Returns nil when --warm-renderers-per-gpu is 0
+func newWarmPool(juicePath string, pciBuses []string) (*warmPool, error) {
+	if *warmRenderersPerGpu < 0 {
+		return nil, errors.New("--warm-renderers-per-gpu must not be negative")
+	}
+
+	if *warmRenderersPerGpu == 0 {
+		return nil, nil
+	}
+
+	return &warmPool{
+		juicePath: juicePath,
+		size:      *warmRenderersPerGpu,
+		pciBuses:  pciBuses,
+		idle:      map[string][]*session.Renderer{},
+		refill:    make(chan struct{}, 1),
+	}, nil
+}
+
+func (pool *warmPool) run(group task.Group) error {
+	ticker := time.NewTicker(warmPoolInterval)
+	defer ticker.Stop()
+
+	for {
+		pool.fill(group)
+
+		select {
+		case <-group.Ctx().Done():
+			pool.drain()
+			return nil
+
+		case <-ticker.C:
+		case <-pool.refill:
+		}
+	}
+}
+
+// Starts renderers until each GPU has --warm-renderers-per-gpu idle, replacing those that exited
+func (pool *warmPool) fill(group task.Group) {
+	for _, pciBus := range pool.pciBuses {
+		pool.mutex.Lock()
+		idle := pool.prune(pciBus)
+		pool.mutex.Unlock()
+
+		for ; idle < pool.size; idle++ {
+			if group.Ctx().Err() != nil {
+				return
+			}
+
+			renderer, err := session.StartRenderer(group.Ctx(), pool.juicePath, uuid.NewString(), pciBus, "")
+			if err != nil {
+				logger.Warningf("unable to start a warm renderer on GPU %s, %v", pciBus, err)
+				break
+			}
+
+			logger.Debugf("started warm renderer %s on GPU %s", renderer.Id(), pciBus)
+
+			pool.mutex.Lock()
+			pool.idle[pciBus] = append(pool.idle[pciBus], renderer)
+			pool.mutex.Unlock()
+		}
+	}
+}
+
+// Removes the idle renderers on the GPU that exited, returning the number left. The mutex must be held.
+func (pool *warmPool) prune(pciBus string) int {
+	running := pool.idle[pciBus][:0]
+	for _, renderer := range pool.idle[pciBus] {
+		if renderer.Exited() {
+			logger.Warningf("warm renderer %s on GPU %s exited while idle, %v", renderer.Id(), pciBus, renderer.Wait())
+			renderer.Close()
+		} else {
+			running = append(running, renderer)
+		}
+	}
+
+	pool.idle[pciBus] = running
+	return len(running)
+}
+
+// Returns an idle renderer on the GPU, nil when there is none. Safe to call on nil.
+func (pool *warmPool) take(pciBus string) *session.Renderer {
+	if pool == nil {
+		return nil
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.prune(pciBus) == 0 {
+		return nil
+	}
+
+	renderer := pool.idle[pciBus][0]
+	pool.idle[pciBus] = pool.idle[pciBus][1:]
+
+	select {
+	case pool.refill <- struct{}{}:
+	default:
+	}
+
+	return renderer
+}
+
+// Returns the process ids of the idle renderers. Safe to call on nil.
+func (pool *warmPool) pids() []int {
+	if pool == nil {
+		return nil
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pids := []int{}
+	for _, renderers := range pool.idle {
+		for _, renderer := range renderers {
+			pids = append(pids, renderer.Pid())
+		}
+	}
+
+	return pids
+}
+
+// Stops the idle renderers
+func (pool *warmPool) drain() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for pciBus, renderers := range pool.idle {
+		for _, renderer := range renderers {
+			renderer.Cancel()
+			renderer.Wait()
+			renderer.Close()
+		}
+
+		delete(pool.idle, pciBus)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package gpu
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+)
+
+var (
+	gpuBackend = flag.String("gpu-backend", "auto", "Backend detecting the GPUs and reading their VRAM usage, one of auto, nvml, dxgi, rocm, renderer, metal, or fake. auto selects the first available of nvml, dxgi, rocm, renderer, and metal built for the platform")
+)
+
+// Returned by backends for the features they do not support
+var ErrUnsupported = errors.New("not supported by the GPU backend")
+
+// Detects the GPUs of the host and queries their state. Backends are built for the platforms they
+// support, see registerBackend.
+type Backend interface {
+	Name() string
+
+	// Returns why the backend cannot be used on this host, nil when it can
+	Available() error
+
+	// The optional features supported, see restapi.Capability*
+	Capabilities() []string
+
+	// Returns every GPU of the host
+	DetectGpus(rendererWinPath string) (*gpu.GpuSet, error)
+
+	// Returns the VRAM used on the GPU on the PCI bus and the processes using it, ErrUnsupported
+	// when the backend cannot read it
+	QueryVramUsage(pciBus string) (VramUsage, error)
+
+	// Returns the SM utilization of each process using the GPU on the PCI bus since the time given,
+	// processes without samples in the period are left out, ErrUnsupported when the backend cannot
+	// read it
+	QueryProcessUtilization(pciBus string, since time.Time) ([]ProcessUtilization, error)
+
+	// Resets the GPU on the PCI bus, which fails while processes use the GPU, ErrUnsupported when
+	// the backend cannot reset GPUs
+	ResetGpu(ctx context.Context, pciBus string) error
+}
+
+// The order auto selects backends in, fake is only used when requested
+var autoBackends = []string{"nvml", "dxgi", "rocm", "renderer", "metal"}
+
+var backends = map[string]Backend{}
+
+// Called by the init functions of the backends built for the platform
+func registerBackend(backend Backend) {
+	backends[backend.Name()] = backend
+}
+
+func registeredBackends() []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Returns the backend selected by --gpu-backend
+func SelectBackend() (Backend, error) {
+	if *gpuBackend != "auto" {
+		backend, found := backends[*gpuBackend]
+		if !found {
+			return nil, fmt.Errorf("--gpu-backend: %s is not supported on %s/%s, expected one of %s",
+				*gpuBackend, runtime.GOOS, runtime.GOARCH, strings.Join(registeredBackends(), ", "))
+		}
+
+		err := backend.Available()
+		if err != nil {
+			return nil, fmt.Errorf("--gpu-backend: %s is unavailable, %v", backend.Name(), err)
+		}
+
+		return backend, nil
+	}
+
+	var err error
+	for _, name := range autoBackends {
+		backend, found := backends[name]
+		if !found {
+			continue
+		}
+
+		err_ := backend.Available()
+		if err_ == nil {
+			return backend, nil
+		}
+
+		err = errors.Join(err, fmt.Errorf("%s: %v", name, err_))
+	}
+
+	return nil, fmt.Errorf("--gpu-backend: no GPU backend is available on %s/%s, %v", runtime.GOOS, runtime.GOARCH, err)
+}
+
+// Returns whether the backend supports the feature, see restapi.Capability*
+func HasCapability(backend Backend, capability string) bool {
+	for _, supported := range backend.Capabilities() {
+		if supported == capability {
+			return true
+		}
+	}
+
+	return false
+}
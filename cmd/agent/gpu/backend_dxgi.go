@@ -0,0 +1,353 @@
+//go:build windows
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	moddxgi  = windows.NewLazySystemDLL("dxgi.dll")
+	modgdi32 = windows.NewLazySystemDLL("gdi32.dll")
+
+	procCreateDXGIFactory1        = moddxgi.NewProc("CreateDXGIFactory1")
+	procD3DKMTOpenAdapterFromLuid = modgdi32.NewProc("D3DKMTOpenAdapterFromLuid")
+	procD3DKMTQueryAdapterInfo    = modgdi32.NewProc("D3DKMTQueryAdapterInfo")
+	procD3DKMTCloseAdapter        = modgdi32.NewProc("D3DKMTCloseAdapter")
+
+	iidIDXGIFactory1 = windows.GUID{Data1: 0x770aae78, Data2: 0xf26f, Data3: 0x4dba, Data4: [8]byte{0xa8, 0x29, 0x25, 0x3c, 0x83, 0xd1, 0xb3, 0x87}}
+	iidIDXGIAdapter3 = windows.GUID{Data1: 0x645967a4, Data2: 0x1392, Data3: 0x4310, Data4: [8]byte{0xa7, 0x98, 0x80, 0x53, 0xce, 0x3e, 0x93, 0xfd}}
+
+	dxgiOnce     sync.Once
+	dxgiErr      error
+	dxgiAdapters map[pciSlot]*dxgiAdapter
+)
+
+const (
+	dxgiErrorNotFound       = 0x887a0002
+	dxgiAdapterFlagSoftware = 2
+	// DXGI_MEMORY_SEGMENT_GROUP_LOCAL, the adapter's dedicated VRAM
+	dxgiMemorySegmentGroupLocal = 0
+	// KMTQAITYPE_ADAPTERADDRESS
+	kmtqaiTypeAdapterAddress = 6
+
+	// Indexes of the methods in the vtables of the DXGI interfaces
+	comQueryInterface           = 0
+	comRelease                  = 2
+	dxgiFactory1EnumAdapters1   = 12
+	dxgiAdapter1GetDesc1        = 10
+	dxgiAdapter3QueryMemoryInfo = 14
+)
+
+// Reads the VRAM usage of the GPUs of Windows hosts with DXGI, and the utilization, clocks, and
+// temperature of NVIDIA GPUs with NVAPI, rather than with Renderer_Win. Neither reads the power
+// drawn or the fans, --gpu-backend renderer still reports them. Processes are not attributed the
+// VRAM they use and GPUs are not reset.
+type dxgiBackend struct {
+	rendererBackend
+}
+
+func init() {
+	registerBackend(dxgiBackend{})
+}
+
+// A COM object, the vtable's length only bounds the methods called
+type comObject struct {
+	vtable *[32]uintptr
+}
+
+func (object *comObject) call(method int, args ...uintptr) uint32 {
+	hr, _, _ := syscall.SyscallN(object.vtable[method], append([]uintptr{uintptr(unsafe.Pointer(object))}, args...)...)
+	return uint32(hr)
+}
+
+func (object *comObject) release() {
+	object.call(comRelease)
+}
+
+func hresultFailed(hr uint32) bool {
+	return int32(hr) < 0
+}
+
+type luid struct {
+	LowPart  uint32
+	HighPart int32
+}
+
+// DXGI_ADAPTER_DESC1
+type dxgiAdapterDesc1 struct {
+	Description           [128]uint16
+	VendorId              uint32
+	DeviceId              uint32
+	SubSysId              uint32
+	Revision              uint32
+	DedicatedVideoMemory  uintptr
+	DedicatedSystemMemory uintptr
+	SharedSystemMemory    uintptr
+	AdapterLuid           luid
+	Flags                 uint32
+}
+
+// DXGI_QUERY_VIDEO_MEMORY_INFO
+type dxgiQueryVideoMemoryInfo struct {
+	Budget                  uint64
+	CurrentUsage            uint64
+	AvailableForReservation uint64
+	CurrentReservation      uint64
+}
+
+// D3DKMT_OPENADAPTERFROMLUID
+type d3dkmtOpenAdapterFromLuid struct {
+	AdapterLuid luid
+	HAdapter    uint32
+}
+
+// D3DKMT_QUERYADAPTERINFO
+type d3dkmtQueryAdapterInfo struct {
+	HAdapter              uint32
+	Type                  uint32
+	PrivateDriverData     unsafe.Pointer
+	PrivateDriverDataSize uint32
+}
+
+// D3DKMT_ADAPTERADDRESS
+type d3dkmtAdapterAddress struct {
+	BusNumber      uint32
+	DeviceNumber   uint32
+	FunctionNumber uint32
+}
+
+// Adapters are matched to GPUs by their PCI bus without its domain, which neither DXGI nor NVAPI
+// report
+type pciSlot struct {
+	bus      int32
+	device   int32
+	function int32
+}
+
+func newPciSlot(pciBus string) pciSlot {
+	address := gpu.NewPCIAddressFromString(pciBus)
+	return pciSlot{
+		bus:      address.Bus,
+		device:   address.Device,
+		function: address.Function,
+	}
+}
+
+type dxgiAdapter struct {
+	// Nil before Windows 10, which introduced IDXGIAdapter3
+	adapter3  *comObject
+	dedicated uint64
+
+	// Zero when the GPU is not an NVIDIA GPU or NVAPI is not installed
+	nvapiGpu uintptr
+}
+
+// Enumerates the adapters once, they are kept for the lifetime of the agent
+func initializeDxgi() error {
+	dxgiOnce.Do(func() {
+		dxgiAdapters, dxgiErr = enumerateDxgiAdapters()
+		if dxgiErr != nil {
+			return
+		}
+
+		err := attachNvapiGpus(dxgiAdapters)
+		if err != nil {
+			logger.Debugf("the utilization, clocks, and temperature of GPUs are not read, %v", err)
+		}
+	})
+
+	return dxgiErr
+}
+
+func enumerateDxgiAdapters() (map[pciSlot]*dxgiAdapter, error) {
+	err := procCreateDXGIFactory1.Find()
+	if err != nil {
+		return nil, errors.New("DXGI is not available")
+	}
+
+	var factory *comObject
+	hr, _, _ := procCreateDXGIFactory1.Call(uintptr(unsafe.Pointer(&iidIDXGIFactory1)), uintptr(unsafe.Pointer(&factory)))
+	if hresultFailed(uint32(hr)) {
+		return nil, fmt.Errorf("CreateDXGIFactory1 failed with 0x%08x", uint32(hr))
+	}
+	defer factory.release()
+
+	adapters := map[pciSlot]*dxgiAdapter{}
+	for index := 0; ; index++ {
+		var adapter *comObject
+		hr := factory.call(dxgiFactory1EnumAdapters1, uintptr(index), uintptr(unsafe.Pointer(&adapter)))
+		if hr == dxgiErrorNotFound {
+			break
+		} else if hresultFailed(hr) {
+			return nil, fmt.Errorf("IDXGIFactory1::EnumAdapters1 failed with 0x%08x", hr)
+		}
+
+		var desc dxgiAdapterDesc1
+		hr = adapter.call(dxgiAdapter1GetDesc1, uintptr(unsafe.Pointer(&desc)))
+		if hresultFailed(hr) || desc.Flags&dxgiAdapterFlagSoftware != 0 {
+			adapter.release()
+			continue
+		}
+
+		slot, err := adapterSlot(desc.AdapterLuid)
+		if err != nil {
+			logger.Debugf("skipping adapter %s, %v", windows.UTF16ToString(desc.Description[:]), err)
+			adapter.release()
+			continue
+		}
+
+		var adapter3 *comObject
+		hr = adapter.call(comQueryInterface, uintptr(unsafe.Pointer(&iidIDXGIAdapter3)), uintptr(unsafe.Pointer(&adapter3)))
+		if hresultFailed(hr) {
+			adapter3 = nil
+		}
+		adapter.release()
+
+		adapters[slot] = &dxgiAdapter{
+			adapter3:  adapter3,
+			dedicated: uint64(desc.DedicatedVideoMemory),
+		}
+	}
+
+	if len(adapters) == 0 {
+		return nil, errors.New("DXGI reports no hardware adapter")
+	}
+
+	return adapters, nil
+}
+
+// Returns the PCI bus of the adapter from the kernel mode driver
+func adapterSlot(adapterLuid luid) (pciSlot, error) {
+	open := d3dkmtOpenAdapterFromLuid{
+		AdapterLuid: adapterLuid,
+	}
+
+	status, _, _ := procD3DKMTOpenAdapterFromLuid.Call(uintptr(unsafe.Pointer(&open)))
+	if status != 0 {
+		return pciSlot{}, fmt.Errorf("D3DKMTOpenAdapterFromLuid failed with 0x%08x", uint32(status))
+	}
+	defer procD3DKMTCloseAdapter.Call(uintptr(unsafe.Pointer(&open.HAdapter)))
+
+	var address d3dkmtAdapterAddress
+	query := d3dkmtQueryAdapterInfo{
+		HAdapter:              open.HAdapter,
+		Type:                  kmtqaiTypeAdapterAddress,
+		PrivateDriverData:     unsafe.Pointer(&address),
+		PrivateDriverDataSize: uint32(unsafe.Sizeof(address)),
+	}
+
+	status, _, _ = procD3DKMTQueryAdapterInfo.Call(uintptr(unsafe.Pointer(&query)))
+	if status != 0 {
+		return pciSlot{}, fmt.Errorf("D3DKMTQueryAdapterInfo failed with 0x%08x", uint32(status))
+	}
+
+	return pciSlot{
+		bus:      int32(address.BusNumber),
+		device:   int32(address.DeviceNumber),
+		function: int32(address.FunctionNumber),
+	}, nil
+}
+
+func findDxgiAdapter(pciBus string) (*dxgiAdapter, error) {
+	err := initializeDxgi()
+	if err != nil {
+		return nil, err
+	}
+
+	adapter, found := dxgiAdapters[newPciSlot(pciBus)]
+	if !found {
+		return nil, fmt.Errorf("unable to find GPU %s with DXGI", pciBus)
+	}
+
+	return adapter, nil
+}
+
+// Returns the VRAM used on the adapter by every process. NVAPI reads it for NVIDIA GPUs, DXGI only
+// reports the budget the OS leaves the agent, so the VRAM outside it is taken as used.
+func (adapter *dxgiAdapter) vramUsed(pciBus string) (uint64, error) {
+	if adapter.nvapiGpu != 0 {
+		return nvapiVramUsed(adapter.nvapiGpu)
+	}
+
+	if adapter.adapter3 == nil {
+		return 0, fmt.Errorf("reading the VRAM used on GPU %s needs Windows 10", pciBus)
+	}
+
+	var info dxgiQueryVideoMemoryInfo
+	hr := adapter.adapter3.call(dxgiAdapter3QueryMemoryInfo, 0, dxgiMemorySegmentGroupLocal, uintptr(unsafe.Pointer(&info)))
+	if hresultFailed(hr) {
+		return 0, fmt.Errorf("IDXGIAdapter3::QueryVideoMemoryInfo failed for GPU %s with 0x%08x", pciBus, hr)
+	}
+
+	if info.Budget >= adapter.dedicated {
+		return 0, nil
+	}
+
+	return adapter.dedicated - info.Budget, nil
+}
+
+func (dxgiBackend) Name() string {
+	return "dxgi"
+}
+
+func (dxgiBackend) Available() error {
+	return initializeDxgi()
+}
+
+func (dxgiBackend) Capabilities() []string {
+	return []string{restapi.CapabilityGpuMetrics, restapi.CapabilityVramUsage}
+}
+
+// Reads the VRAM used with DXGI or NVAPI, and the rest of the metrics of NVIDIA GPUs with NVAPI
+func (dxgiBackend) QueryGpuMetrics(pciBus string) (restapi.GpuMetrics, error) {
+	adapter, err := findDxgiAdapter(pciBus)
+	if err != nil {
+		return restapi.GpuMetrics{}, err
+	}
+
+	metrics := restapi.GpuMetrics{}
+	if adapter.nvapiGpu != 0 {
+		metrics, err = nvapiMetrics(adapter.nvapiGpu)
+		if err != nil {
+			return restapi.GpuMetrics{}, fmt.Errorf("unable to read the metrics of GPU %s with NVAPI, %v", pciBus, err)
+		}
+	}
+
+	metrics.VramUsed, err = adapter.vramUsed(pciBus)
+	if err != nil {
+		return restapi.GpuMetrics{}, err
+	}
+
+	return metrics, nil
+}
+
+func (dxgiBackend) QueryVramUsage(pciBus string) (VramUsage, error) {
+	adapter, err := findDxgiAdapter(pciBus)
+	if err != nil {
+		return VramUsage{}, err
+	}
+
+	used, err := adapter.vramUsed(pciBus)
+	if err != nil {
+		return VramUsage{}, err
+	}
+
+	return VramUsage{
+		Used: used,
+	}, nil
+}
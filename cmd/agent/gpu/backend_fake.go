@@ -0,0 +1,64 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package gpu
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+)
+
+var (
+	fakeGpusFile = flag.String("fake-gpus-file", "", "JSON file listing the GPUs reported by --gpu-backend fake, in the format of Renderer_Win --dump_gpus")
+)
+
+// Reports the GPUs listed by --fake-gpus-file, for developing and testing on hosts without GPUs or
+// on platforms Renderer_Win does not support. Sessions still require a Renderer_Win.
+type fakeBackend struct{}
+
+func init() {
+	registerBackend(fakeBackend{})
+}
+
+func (fakeBackend) Name() string {
+	return "fake"
+}
+
+func (fakeBackend) Available() error {
+	if *fakeGpusFile == "" {
+		return errors.New("--fake-gpus-file is not set")
+	}
+
+	return nil
+}
+
+func (fakeBackend) Capabilities() []string {
+	return []string{}
+}
+
+func (fakeBackend) DetectGpus(rendererWinPath string) (*gpu.GpuSet, error) {
+	data, err := os.ReadFile(*fakeGpusFile)
+	if err != nil {
+		return nil, fmt.Errorf("DetectGpus: unable to read --fake-gpus-file, %v", err)
+	}
+
+	return gpu.NewGpuSetFromJson(data)
+}
+
+func (fakeBackend) QueryVramUsage(pciBus string) (VramUsage, error) {
+	return VramUsage{}, fmt.Errorf("reading the VRAM usage of GPU %s is %w", pciBus, ErrUnsupported)
+}
+
+func (fakeBackend) QueryProcessUtilization(pciBus string, since time.Time) ([]ProcessUtilization, error) {
+	return nil, fmt.Errorf("reading the utilization of GPU %s by process is %w", pciBus, ErrUnsupported)
+}
+
+func (fakeBackend) ResetGpu(ctx context.Context, pciBus string) error {
+	return fmt.Errorf("resetting GPU %s is %w", pciBus, ErrUnsupported)
+}
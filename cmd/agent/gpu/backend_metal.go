@@ -0,0 +1,52 @@
+//go:build darwin
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+)
+
+// Placeholder for the GPUs of macOS hosts, which Renderer_Win does not yet support. It is never
+// available so the agent explains why it cannot run rather than failing to start Renderer_Win.
+type metalBackend struct{}
+
+func init() {
+	registerBackend(metalBackend{})
+}
+
+func (metalBackend) Name() string {
+	return "metal"
+}
+
+func (metalBackend) Available() error {
+	return errors.New("sharing Metal GPUs is not supported yet, --gpu-backend fake reports GPUs for development")
+}
+
+func (metalBackend) Capabilities() []string {
+	return []string{}
+}
+
+func (metalBackend) DetectGpus(rendererWinPath string) (*gpu.GpuSet, error) {
+	return nil, fmt.Errorf("DetectGpus: detecting Metal GPUs is %w", ErrUnsupported)
+}
+
+func (metalBackend) QueryVramUsage(pciBus string) (VramUsage, error) {
+	return VramUsage{}, fmt.Errorf("reading the VRAM usage of GPU %s is %w", pciBus, ErrUnsupported)
+}
+
+func (metalBackend) QueryProcessUtilization(pciBus string, since time.Time) ([]ProcessUtilization, error) {
+	return nil, fmt.Errorf("reading the utilization of GPU %s by process is %w", pciBus, ErrUnsupported)
+}
+
+func (metalBackend) ResetGpu(ctx context.Context, pciBus string) error {
+	return fmt.Errorf("resetting GPU %s is %w", pciBus, ErrUnsupported)
+}
@@ -0,0 +1,233 @@
+//go:build linux && cgo
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	nvmlOnce sync.Once
+	nvmlErr  error
+)
+
+// Reads the VRAM usage of NVIDIA GPUs with NVML, which requires cgo, and resets them with nvidia-smi
+type nvmlBackend struct {
+	rendererBackend
+}
+
+func init() {
+	registerBackend(nvmlBackend{})
+}
+
+// Loads NVML once, it stays loaded for the lifetime of the agent
+func initializeNvml() error {
+	nvmlOnce.Do(func() {
+		result := nvml.Init()
+		if result == nvml.ERROR_LIBRARY_NOT_FOUND {
+			nvmlErr = errors.New("NVML is not installed")
+		} else if result != nvml.SUCCESS {
+			nvmlErr = fmt.Errorf("unable to initialize NVML, %s", nvml.ErrorString(result))
+		}
+	})
+
+	return nvmlErr
+}
+
+func (nvmlBackend) Name() string {
+	return "nvml"
+}
+
+func (nvmlBackend) Available() error {
+	return initializeNvml()
+}
+
+func (nvmlBackend) Capabilities() []string {
+	return []string{restapi.CapabilityGpuMetrics, restapi.CapabilityVramUsage, restapi.CapabilityGpuReset, restapi.CapabilityProcessUtilization, restapi.CapabilityGpuHealth}
+}
+
+// Reads the VRAM used and the processes using it from NVML
+func (nvmlBackend) QueryVramUsage(pciBus string) (VramUsage, error) {
+	err := initializeNvml()
+	if err != nil {
+		return VramUsage{}, err
+	}
+
+	address := gpu.NewPCIAddressFromString(pciBus)
+	device, result := nvml.DeviceGetHandleByPciBusId(fmt.Sprintf("%08x:%02x:%02x.%x", address.Domain, address.Bus, address.Device, address.Function))
+	if result != nvml.SUCCESS {
+		return VramUsage{}, fmt.Errorf("unable to find GPU %s with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	memory, result := device.GetMemoryInfo()
+	if result != nvml.SUCCESS {
+		return VramUsage{}, fmt.Errorf("unable to read the memory of GPU %s with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	usage := VramUsage{
+		Used: memory.Used,
+	}
+
+	compute, result := device.GetComputeRunningProcesses()
+	if result != nvml.SUCCESS {
+		return VramUsage{}, fmt.Errorf("unable to list the processes on GPU %s with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	graphics, result := device.GetGraphicsRunningProcesses()
+	if result != nvml.SUCCESS {
+		return VramUsage{}, fmt.Errorf("unable to list the processes on GPU %s with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	// Processes using the GPU for both compute and graphics are listed twice
+	seen := map[uint32]struct{}{}
+	for _, info := range append(compute, graphics...) {
+		if _, found := seen[info.Pid]; found {
+			continue
+		}
+		seen[info.Pid] = struct{}{}
+
+		process := VramProcess{
+			Pid: int(info.Pid),
+		}
+
+		if info.UsedGpuMemory != ^uint64(0) {
+			process.VramUsed = info.UsedGpuMemory
+		}
+
+		name, result := nvml.SystemGetProcessName(int(info.Pid))
+		if result == nvml.SUCCESS {
+			process.Name = name
+		}
+
+		usage.Processes = append(usage.Processes, process)
+	}
+
+	return usage, nil
+}
+
+// Reads the SM utilization of the processes from NVML's samples, averaging the samples of each
+// process in the period
+func (nvmlBackend) QueryProcessUtilization(pciBus string, since time.Time) ([]ProcessUtilization, error) {
+	err := initializeNvml()
+	if err != nil {
+		return nil, err
+	}
+
+	address := gpu.NewPCIAddressFromString(pciBus)
+	device, result := nvml.DeviceGetHandleByPciBusId(fmt.Sprintf("%08x:%02x:%02x.%x", address.Domain, address.Bus, address.Device, address.Function))
+	if result != nvml.SUCCESS {
+		return nil, fmt.Errorf("unable to find GPU %s with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	// Samples are timestamped in microseconds since the epoch
+	samples, result := device.GetProcessUtilization(uint64(since.UnixMicro()))
+	if result == nvml.ERROR_NOT_FOUND {
+		return []ProcessUtilization{}, nil
+	} else if result != nvml.SUCCESS {
+		return nil, fmt.Errorf("unable to read the utilization of GPU %s by process with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	totals := map[int]float64{}
+	counts := map[int]int{}
+	for _, sample := range samples {
+		totals[int(sample.Pid)] += float64(sample.SmUtil)
+		counts[int(sample.Pid)]++
+	}
+
+	utilization := make([]ProcessUtilization, 0, len(totals))
+	for pid, total := range totals {
+		utilization = append(utilization, ProcessUtilization{
+			Pid:           pid,
+			SmUtilization: total / float64(counts[pid]),
+		})
+	}
+
+	return utilization, nil
+}
+
+// The clock throttle reasons of hardware slowdowns, which the application and the agent cannot cause
+var nvmlSlowdowns = []struct {
+	reason uint64
+	name   string
+}{
+	{nvml.ClocksThrottleReasonHwSlowdown, "hardware slowdown"},
+	{nvml.ClocksThrottleReasonHwThermalSlowdown, "hardware thermal slowdown"},
+	{nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, "power brake slowdown"},
+}
+
+// Reads the uncorrected ECC errors, the retired or remapped memory, and the hardware slowdowns of
+// the GPU from NVML. Counters the GPU does not support are skipped.
+func (nvmlBackend) QueryHealth(pciBus string) (Health, error) {
+	err := initializeNvml()
+	if err != nil {
+		return Health{}, err
+	}
+
+	address := gpu.NewPCIAddressFromString(pciBus)
+	device, result := nvml.DeviceGetHandleByPciBusId(fmt.Sprintf("%08x:%02x:%02x.%x", address.Domain, address.Bus, address.Device, address.Function))
+	if result == nvml.ERROR_GPU_IS_LOST {
+		return Health{
+			Problems: []string{"the GPU has fallen off the bus"},
+		}, nil
+	} else if result != nvml.SUCCESS {
+		return Health{}, fmt.Errorf("unable to find GPU %s with NVML, %s", pciBus, nvml.ErrorString(result))
+	}
+
+	health := Health{}
+
+	uncorrected, result := device.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.VOLATILE_ECC)
+	if result == nvml.SUCCESS && uncorrected > 0 {
+		health.Problems = append(health.Problems, fmt.Sprintf("%d uncorrected ECC errors since the driver loaded", uncorrected))
+	}
+
+	_, _, remapPending, remapFailed, result := device.GetRemappedRows()
+	if result == nvml.SUCCESS {
+		if remapFailed {
+			health.Problems = append(health.Problems, "remapping a row of memory failed")
+		} else if remapPending {
+			health.Problems = append(health.Problems, "rows of memory are pending remapping, the GPU must be reset")
+		}
+	} else {
+		// GPUs predating row remapping retire pages instead
+		pending, result := device.GetRetiredPagesPendingStatus()
+		if result == nvml.SUCCESS && pending == nvml.FEATURE_ENABLED {
+			health.Problems = append(health.Problems, "pages of memory are pending retirement, the GPU must be reset")
+		}
+	}
+
+	reasons, result := device.GetCurrentClocksThrottleReasons()
+	if result == nvml.SUCCESS {
+		for _, slowdown := range nvmlSlowdowns {
+			if reasons&slowdown.reason != 0 {
+				health.Throttled = append(health.Throttled, slowdown.name)
+			}
+		}
+	}
+
+	return health, nil
+}
+
+// Resets the GPU with nvidia-smi
+func (nvmlBackend) ResetGpu(ctx context.Context, pciBus string) error {
+	output, err := exec.CommandContext(ctx, "nvidia-smi", "--gpu-reset", "-i", pciBus).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nvidia-smi --gpu-reset failed with %s, %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build !darwin
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Detects the GPUs with Renderer_Win, which also reports their metrics, without reading their VRAM
+// usage. The vendor backends extend it.
+type rendererBackend struct{}
+
+func init() {
+	registerBackend(rendererBackend{})
+}
+
+func (rendererBackend) Name() string {
+	return "renderer"
+}
+
+func (rendererBackend) Available() error {
+	return nil
+}
+
+func (rendererBackend) Capabilities() []string {
+	return []string{restapi.CapabilityGpuMetrics}
+}
+
+func (rendererBackend) DetectGpus(rendererWinPath string) (*gpu.GpuSet, error) {
+	return detectRendererGpus(rendererWinPath)
+}
+
+func (rendererBackend) QueryVramUsage(pciBus string) (VramUsage, error) {
+	return VramUsage{}, fmt.Errorf("reading the VRAM usage of GPU %s is %w", pciBus, ErrUnsupported)
+}
+
+func (rendererBackend) QueryProcessUtilization(pciBus string, since time.Time) ([]ProcessUtilization, error) {
+	return nil, fmt.Errorf("reading the utilization of GPU %s by process is %w", pciBus, ErrUnsupported)
+}
+
+func (rendererBackend) ResetGpu(ctx context.Context, pciBus string) error {
+	return fmt.Errorf("resetting GPU %s is %w", pciBus, ErrUnsupported)
+}
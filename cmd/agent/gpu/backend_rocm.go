@@ -0,0 +1,317 @@
+//go:build linux
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Detects AMD GPUs and reads their metrics and VRAM usage from the amdgpu driver's sysfs and DRM
+// fdinfo files, the files ROCm SMI reads, which needs neither cgo nor ROCm libraries. GPUs are not
+// reset.
+type rocmBackend struct {
+	rendererBackend
+}
+
+func init() {
+	registerBackend(rocmBackend{})
+}
+
+func (rocmBackend) Name() string {
+	return "rocm"
+}
+
+func (rocmBackend) Available() error {
+	_, err := os.Stat("/sys/module/amdgpu")
+	if err != nil {
+		return errors.New("the amdgpu driver is not loaded")
+	}
+
+	return nil
+}
+
+func (rocmBackend) Capabilities() []string {
+	return []string{restapi.CapabilityGpuMetrics, restapi.CapabilityVramUsage}
+}
+
+// The devices bound to the amdgpu driver are listed by PCI bus
+const amdgpuDevices = "/sys/bus/pci/drivers/amdgpu"
+
+// Returns the contents of a sysfs file of the device, trimmed
+func readDeviceFile(device string, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/bus/pci/devices", device, name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Returns a sysfs file of the device holding a number, 0 when the device does not report it
+func readDeviceUint(device string, name string) uint64 {
+	data, err := readDeviceFile(device, name)
+	if err != nil {
+		return 0
+	}
+
+	// The PCI ids are written in hex with a 0x prefix
+	value, err := strconv.ParseUint(data, 0, 64)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// Returns a file of the device's hardware monitor holding a number, 0 when the device does not
+// report it
+func readHwmonUint(device string, name string) uint64 {
+	paths, _ := filepath.Glob(filepath.Join("/sys/bus/pci/devices", device, "hwmon", "hwmon*", name))
+	if len(paths) == 0 {
+		return 0
+	}
+
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		return 0
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// Returns the current clock in MHz from a DPM table of the device, where the current level is
+// marked with a * as in "1: 1000Mhz *"
+func readDeviceClock(device string, name string) uint32 {
+	data, err := readDeviceFile(device, name)
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		if !strings.HasSuffix(line, "*") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0
+		}
+
+		clock, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(fields[1]), "mhz"), 10, 32)
+		if err != nil {
+			return 0
+		}
+
+		return uint32(clock)
+	}
+
+	return 0
+}
+
+// Returns every GPU bound to the amdgpu driver ordered by PCI bus, without Renderer_Win
+func (rocmBackend) DetectGpus(rendererWinPath string) (*gpu.GpuSet, error) {
+	entries, err := os.ReadDir(amdgpuDevices)
+	if err != nil {
+		return nil, fmt.Errorf("DetectGpus: unable to list the amdgpu devices, %v", err)
+	}
+
+	devices := []string{}
+	for _, entry := range entries {
+		address := gpu.NewPCIAddressFromString(entry.Name())
+		if address.Domain >= 0 {
+			devices = append(devices, entry.Name())
+		}
+	}
+	sort.Strings(devices)
+
+	driver, err := os.ReadFile("/sys/module/amdgpu/version")
+	if err != nil {
+		// The amdgpu driver built into the kernel has no version of its own
+		driver, _ = os.ReadFile("/proc/sys/kernel/osrelease")
+	}
+
+	apiGpus := []restapi.Gpu{}
+	for _, device := range devices {
+		vram := readDeviceUint(device, "mem_info_vram_total")
+		if vram == 0 {
+			// Not a GPU Juice can render on, such as a display controller without VRAM
+			continue
+		}
+
+		deviceId := uint32(readDeviceUint(device, "device"))
+
+		// Set by the FRU of Instinct GPUs, other GPUs are named by their device id
+		name, err := readDeviceFile(device, "product_name")
+		if err != nil || name == "" {
+			name = fmt.Sprintf("AMD GPU 0x%04x", deviceId)
+		}
+
+		uuid, _ := readDeviceFile(device, "unique_id")
+
+		apiGpus = append(apiGpus, restapi.Gpu{
+			Index:       len(apiGpus),
+			Uuid:        uuid,
+			Name:        name,
+			Vendor:      "AMD",
+			Model:       name,
+			VendorId:    uint32(readDeviceUint(device, "vendor")),
+			DeviceId:    deviceId,
+			SubDeviceId: uint32(readDeviceUint(device, "subsystem_device")),
+			Driver:      strings.TrimSpace(string(driver)),
+			Vram:        vram,
+			PciBus:      device,
+		})
+	}
+
+	if len(apiGpus) == 0 {
+		return nil, errors.New("DetectGpus: no GPU is bound to the amdgpu driver")
+	}
+
+	return gpu.NewGpuSet(apiGpus), nil
+}
+
+// Reads the metrics of the GPU as ROCm SMI reports them
+func (rocmBackend) QueryGpuMetrics(pciBus string) (restapi.GpuMetrics, error) {
+	device := sysfsPciBus(pciBus)
+
+	utilization, err := readDeviceFile(device, "gpu_busy_percent")
+	if err != nil {
+		return restapi.GpuMetrics{}, fmt.Errorf("unable to read the metrics of GPU %s, %v", pciBus, err)
+	}
+
+	utilizationGpu, _ := strconv.ParseUint(utilization, 10, 32)
+
+	// Newer GPUs report the power drawn as power1_input rather than power1_average
+	power := readHwmonUint(device, "power1_average")
+	if power == 0 {
+		power = readHwmonUint(device, "power1_input")
+	}
+
+	var fanSpeed uint32
+	if fanMax := readHwmonUint(device, "pwm1_max"); fanMax > 0 {
+		fanSpeed = uint32(readHwmonUint(device, "pwm1") * 100 / fanMax)
+	}
+
+	// The hardware monitor reports millidegrees and microwatts
+	return restapi.GpuMetrics{
+		ClockCore:       readDeviceClock(device, "pp_dpm_sclk"),
+		ClockMemory:     readDeviceClock(device, "pp_dpm_mclk"),
+		UtilizationGpu:  uint32(utilizationGpu),
+		UtilizationVram: uint32(readDeviceUint(device, "mem_busy_percent")),
+		TemperatureGpu:  uint32(readHwmonUint(device, "temp1_input") / 1000),
+		VramUsed:        readDeviceUint(device, "mem_info_vram_used"),
+		PowerDraw:       uint32(power / 1000000),
+		PowerLimit:      uint32(readHwmonUint(device, "power1_cap") / 1000000),
+		FanSpeed:        fanSpeed,
+	}, nil
+}
+
+// Returns the PCI bus formatted as sysfs and DRM fdinfo list devices
+func sysfsPciBus(pciBus string) string {
+	address := gpu.NewPCIAddressFromString(pciBus)
+	return fmt.Sprintf("%04x:%02x:%02x.%x", address.Domain, address.Bus, address.Device, address.Function)
+}
+
+func (rocmBackend) QueryVramUsage(pciBus string) (VramUsage, error) {
+	device := sysfsPciBus(pciBus)
+
+	data, err := os.ReadFile(filepath.Join("/sys/bus/pci/devices", device, "mem_info_vram_used"))
+	if err != nil {
+		return VramUsage{}, fmt.Errorf("unable to read the VRAM used on GPU %s, %v", pciBus, err)
+	}
+
+	used, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return VramUsage{}, fmt.Errorf("unable to read the VRAM used on GPU %s, %v", pciBus, err)
+	}
+
+	return VramUsage{
+		Used:      used,
+		Processes: drmProcesses(device),
+	}, nil
+}
+
+// Returns the processes holding VRAM on the device as listed by the fdinfo of their open DRM files.
+// Processes of other users are only listed when the agent runs as root.
+func drmProcesses(device string) []VramProcess {
+	fdinfos, _ := filepath.Glob("/proc/[0-9]*/fdinfo/*")
+
+	processes := map[int]*VramProcess{}
+	// A DRM client opened through several files is listed by each
+	clients := map[string]struct{}{}
+	for _, path := range fdinfos {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		fields := map[string]string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, found := strings.Cut(line, ":")
+			if found {
+				fields[key] = strings.TrimSpace(value)
+			}
+		}
+
+		if fields["drm-pdev"] != device {
+			continue
+		}
+
+		client := fields["drm-client-id"]
+		if _, found := clients[client]; found {
+			continue
+		}
+		clients[client] = struct{}{}
+
+		pid, err := strconv.Atoi(strings.Split(path, "/")[2])
+		if err != nil {
+			continue
+		}
+
+		process, found := processes[pid]
+		if !found {
+			process = &VramProcess{
+				Pid: pid,
+			}
+
+			comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+			if err == nil {
+				process.Name = strings.TrimSpace(string(comm))
+			}
+
+			processes[pid] = process
+		}
+
+		// Reported as "<value> KiB"
+		value, _, _ := strings.Cut(fields["drm-memory-vram"], " ")
+		vram, err := strconv.ParseUint(value, 10, 64)
+		if err == nil {
+			process.VramUsed += vram * 1024
+		}
+	}
+
+	result := []VramProcess{}
+	for _, process := range processes {
+		result = append(result, *process)
+	}
+
+	return result
+}
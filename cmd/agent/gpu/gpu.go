@@ -4,13 +4,137 @@
 package gpu
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os/exec"
+	"strconv"
+	"strings"
 
 	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 )
 
-func DetectGpus(rendererWinPath string) (*gpu.GpuSet, error) {
+var (
+	gpuInclude = flag.String("gpu-include", "", "Comma separated indices or UUIDs of the GPUs exported to Juice, every GPU when not set")
+	gpuExclude = flag.String("gpu-exclude", "", "Comma separated indices or UUIDs of the GPUs kept for local use and not exported to Juice")
+)
+
+// GPUs selected by index or UUID as listed by --gpu-include and --gpu-exclude
+type gpuSelector struct {
+	flag    string
+	indices map[int]struct{}
+	uuids   map[string]struct{}
+}
+
+func newGpuSelector(name string, value string) gpuSelector {
+	selector := gpuSelector{
+		flag:    name,
+		indices: map[int]struct{}{},
+		uuids:   map[string]struct{}{},
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		index, err := strconv.Atoi(entry)
+		if err == nil {
+			selector.indices[index] = struct{}{}
+		} else {
+			selector.uuids[strings.ToLower(entry)] = struct{}{}
+		}
+	}
+
+	return selector
+}
+
+func (selector gpuSelector) empty() bool {
+	return len(selector.indices) == 0 && len(selector.uuids) == 0
+}
+
+func (selector gpuSelector) matches(gpu restapi.Gpu) bool {
+	_, index := selector.indices[gpu.Index]
+	_, uuid := selector.uuids[strings.ToLower(gpu.Uuid)]
+	return index || uuid
+}
+
+// Returns an error naming the entries matching none of the GPUs, likely typos
+func (selector gpuSelector) validate(gpus []restapi.Gpu) error {
+	unmatched := []string{}
+	for index := range selector.indices {
+		found := false
+		for _, gpu := range gpus {
+			found = found || gpu.Index == index
+		}
+		if !found {
+			unmatched = append(unmatched, strconv.Itoa(index))
+		}
+	}
+
+	for uuid := range selector.uuids {
+		found := false
+		for _, gpu := range gpus {
+			found = found || strings.ToLower(gpu.Uuid) == uuid
+		}
+		if !found {
+			unmatched = append(unmatched, uuid)
+		}
+	}
+
+	if len(unmatched) > 0 {
+		return fmt.Errorf("--%s: no GPU has the index or UUID %s", selector.flag, strings.Join(unmatched, ", "))
+	}
+
+	return nil
+}
+
+// Returns the GPUs exported to Juice by --gpu-include and --gpu-exclude, renumbered so sessions,
+// registration, and metrics only ever see the exported GPUs
+func filterGpus(gpus *gpu.GpuSet) (*gpu.GpuSet, error) {
+	include := newGpuSelector("gpu-include", *gpuInclude)
+	exclude := newGpuSelector("gpu-exclude", *gpuExclude)
+	if include.empty() && exclude.empty() {
+		return gpus, nil
+	}
+
+	detected := gpus.GetGpus()
+	err := errors.Join(include.validate(detected), exclude.validate(detected))
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := gpus.Filter(func(gpu restapi.Gpu) bool {
+		exported := (include.empty() || include.matches(gpu)) && !exclude.matches(gpu)
+		if !exported {
+			logger.Infof("GPU %d @ %s (%s) is not exported", gpu.Index, gpu.PciBus, gpu.Uuid)
+		}
+
+		return exported
+	})
+
+	if filtered.Count() == 0 {
+		return nil, errors.New("DetectGpus: --gpu-include and --gpu-exclude leave no GPUs to export")
+	}
+
+	return filtered, nil
+}
+
+// Returns the GPUs exported to Juice, detected by the backend
+func DetectGpus(backend Backend, rendererWinPath string) (*gpu.GpuSet, error) {
+	gpus, err := backend.DetectGpus(rendererWinPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterGpus(gpus)
+}
+
+// Returns every GPU listed by Renderer_Win
+func detectRendererGpus(rendererWinPath string) (*gpu.GpuSet, error) {
 	cmd := exec.Command(rendererWinPath,
 		"--log_group", "Fatal",
 		"--dump_gpus", "0")
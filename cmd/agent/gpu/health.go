@@ -0,0 +1,39 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package gpu
+
+import (
+	"fmt"
+)
+
+// The state of a GPU read by a backend's health checks
+type Health struct {
+	// Why the GPU cannot be trusted with sessions, empty when it is healthy
+	Problems []string
+	// The hardware slowdowns throttling the GPU's clocks, which make it unhealthy once they persist
+	Throttled []string
+}
+
+// Implemented by the backends reading the health of GPUs, see restapi.CapabilityGpuHealth
+type healthBackend interface {
+	QueryHealth(pciBus string) (Health, error)
+}
+
+// Returns the health of the GPU on the PCI bus, ErrUnsupported when the backend cannot read it
+func QueryHealth(backend Backend, pciBus string) (Health, error) {
+	health, ok := backend.(healthBackend)
+	if !ok {
+		return Health{}, fmt.Errorf("reading the health of GPU %s is %w", pciBus, ErrUnsupported)
+	}
+
+	return health.QueryHealth(pciBus)
+}
+
+// An Xid error the NVIDIA driver logged for a GPU
+type Xid struct {
+	// The PCI bus of the GPU, without its function
+	PciBus  string
+	Code    int
+	Message string
+}
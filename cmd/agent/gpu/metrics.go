@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"os/exec"
+	"time"
 
 	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
@@ -23,15 +24,26 @@ var (
 
 type MetricsConsumerFn = func([]restapi.Gpu)
 
+// Implemented by the backends reading the metrics of GPUs themselves, the metrics of the GPUs of
+// other backends are read by Renderer_Win
+type metricsBackend interface {
+	QueryGpuMetrics(pciBus string) (restapi.GpuMetrics, error)
+}
+
 type MetricsProvider struct {
 	consumers []MetricsConsumerFn
 
+	backend Backend
+	gpus    []restapi.Gpu
+
 	pcibus          string
 	rendererWinPath string
 }
 
-func NewMetricsProvider(gpus *gpu.GpuSet, rendererWinPath string) *MetricsProvider {
+func NewMetricsProvider(backend Backend, gpus *gpu.GpuSet, rendererWinPath string) *MetricsProvider {
 	return &MetricsProvider{
+		backend:         backend,
+		gpus:            gpus.GetGpus(),
 		pcibus:          gpus.GetPciBusString(),
 		rendererWinPath: rendererWinPath,
 	}
@@ -41,38 +53,71 @@ func (provider *MetricsProvider) AddConsumer(consumer MetricsConsumerFn) {
 	provider.consumers = append(provider.consumers, consumer)
 }
 
-func (provider *MetricsProvider) Run(group task.Group) error {
-	if !*disableGpuMetrics && len(provider.consumers) > 0 {
-		cmd := exec.CommandContext(group.Ctx(), provider.rendererWinPath,
-			"--log_group", "Fatal",
-			"--dump_gpus", fmt.Sprint(*gpuMetricsInterval),
-			"--pcibus", provider.pcibus)
-
-		stdoutReader, err := cmd.StdoutPipe()
-		if err != nil {
-			return err
-		}
+// Reads the metrics of each GPU from the backend every --gpu-metrics-interval-ms
+func (provider *MetricsProvider) runBackend(group task.Group, backend metricsBackend) error {
+	ticker := time.NewTicker(time.Duration(*gpuMetricsInterval) * time.Millisecond)
+	defer ticker.Stop()
 
-		err = cmd.Start()
-		if err != nil {
-			return err
-		}
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
 
-		scanner := bufio.NewScanner(stdoutReader)
-		for scanner.Scan() {
-			var metrics []restapi.Gpu
-			err := json.Unmarshal(scanner.Bytes(), &metrics)
-			if err == nil {
-				for _, consumer := range provider.consumers {
-					consumer(metrics)
+		case <-ticker.C:
+			metrics := make([]restapi.Gpu, len(provider.gpus))
+			for index, apiGpu := range provider.gpus {
+				metrics[index] = apiGpu
+
+				var err error
+				metrics[index].Metrics, err = backend.QueryGpuMetrics(apiGpu.PciBus)
+				if err != nil {
+					logger.Debug(err)
 				}
-			} else {
-				logger.Warning(err)
+			}
+
+			for _, consumer := range provider.consumers {
+				consumer(metrics)
 			}
 		}
+	}
+}
 
-		return cmd.Wait()
+func (provider *MetricsProvider) Run(group task.Group) error {
+	if *disableGpuMetrics || len(provider.consumers) == 0 {
+		return nil
+	}
+
+	if backend, ok := provider.backend.(metricsBackend); ok {
+		return provider.runBackend(group, backend)
+	}
+
+	cmd := exec.CommandContext(group.Ctx(), provider.rendererWinPath,
+		"--log_group", "Fatal",
+		"--dump_gpus", fmt.Sprint(*gpuMetricsInterval),
+		"--pcibus", provider.pcibus)
+
+	stdoutReader, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdoutReader)
+	for scanner.Scan() {
+		var metrics []restapi.Gpu
+		err := json.Unmarshal(scanner.Bytes(), &metrics)
+		if err == nil {
+			for _, consumer := range provider.consumers {
+				consumer(metrics)
+			}
+		} else {
+			logger.Warning(err)
+		}
 	}
 
-	return nil
+	return cmd.Wait()
 }
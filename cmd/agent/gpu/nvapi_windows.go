@@ -0,0 +1,210 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// NVAPI exports only nvapi_QueryInterface, which returns its functions by id
+var (
+	modnvapi = windows.NewLazySystemDLL(nvapiDll())
+
+	procNvapiQueryInterface = modnvapi.NewProc("nvapi_QueryInterface")
+)
+
+const (
+	nvapiIdInitialize                = 0x0150e828
+	nvapiIdEnumPhysicalGPUs          = 0xe5ac921f
+	nvapiIdGpuGetBusId               = 0x1be0b8e5
+	nvapiIdGpuGetBusSlotId           = 0x2a0a350f
+	nvapiIdGpuGetDynamicPstatesInfo  = 0x60ded2ed
+	nvapiIdGpuGetThermalSettings     = 0xe3640a56
+	nvapiIdGpuGetMemoryInfo          = 0x07f9b368
+	nvapiIdGpuGetAllClockFrequencies = 0xdcb616c3
+
+	nvapiMaxPhysicalGpus = 64
+	// NVAPI_THERMAL_TARGET_ALL
+	nvapiThermalTargetAll = 15
+	// NVAPI_THERMAL_TARGET_GPU
+	nvapiThermalTargetGpu = 1
+
+	// The utilization domains of NV_GPU_DYNAMIC_PSTATES_INFO_EX
+	nvapiUtilizationGpu = 0
+	nvapiUtilizationFb  = 1
+
+	// The clock domains of NV_GPU_CLOCK_FREQUENCIES
+	nvapiClockGraphics = 0
+	nvapiClockMemory   = 4
+)
+
+func nvapiDll() string {
+	if runtime.GOARCH == "386" {
+		return "nvapi.dll"
+	}
+
+	return "nvapi64.dll"
+}
+
+// Versions of NVAPI structures hold their size and revision
+func nvapiVersion(size uintptr, revision uint32) uint32 {
+	return uint32(size) | revision<<16
+}
+
+// NV_GPU_DYNAMIC_PSTATES_INFO_EX
+type nvapiDynamicPstatesInfo struct {
+	Version     uint32
+	Flags       uint32
+	Utilization [8]struct {
+		IsPresent  uint32
+		Percentage uint32
+	}
+}
+
+// NV_GPU_THERMAL_SETTINGS_V2
+type nvapiThermalSettings struct {
+	Version uint32
+	Count   uint32
+	Sensor  [3]struct {
+		Controller     int32
+		DefaultMinTemp int32
+		DefaultMaxTemp int32
+		CurrentTemp    int32
+		Target         int32
+	}
+}
+
+// NV_GPU_CLOCK_FREQUENCIES_V2 in kHz, ClockType 0 reads the current clocks
+type nvapiClockFrequencies struct {
+	Version   uint32
+	ClockType uint32
+	Domain    [32]struct {
+		IsPresent uint32
+		Frequency uint32
+	}
+}
+
+// NV_DISPLAY_DRIVER_MEMORY_INFO_V2, in KiB
+type nvapiMemoryInfo struct {
+	Version                          uint32
+	DedicatedVideoMemory             uint32
+	AvailableDedicatedVideoMemory    uint32
+	SystemVideoMemory                uint32
+	SharedSystemMemory               uint32
+	CurAvailableDedicatedVideoMemory uint32
+}
+
+// Calls the NVAPI function with the id, NVAPI_OK is 0
+func nvapiCall(id uint32, args ...uintptr) error {
+	function, _, _ := procNvapiQueryInterface.Call(uintptr(id))
+	if function == 0 {
+		return fmt.Errorf("NVAPI does not provide function 0x%08x", id)
+	}
+
+	status, _, _ := syscall.SyscallN(function, args...)
+	if int32(status) != 0 {
+		return fmt.Errorf("NVAPI function 0x%08x failed with %d", id, int32(status))
+	}
+
+	return nil
+}
+
+// Matches the NVIDIA GPUs to the DXGI adapters by their PCI bus, NVIDIA GPUs are function 0
+func attachNvapiGpus(adapters map[pciSlot]*dxgiAdapter) error {
+	err := procNvapiQueryInterface.Find()
+	if err != nil {
+		return errors.New("NVAPI is not installed")
+	}
+
+	err = nvapiCall(nvapiIdInitialize)
+	if err != nil {
+		return err
+	}
+
+	var handles [nvapiMaxPhysicalGpus]uintptr
+	var count uint32
+	err = nvapiCall(nvapiIdEnumPhysicalGPUs, uintptr(unsafe.Pointer(&handles[0])), uintptr(unsafe.Pointer(&count)))
+	if err != nil {
+		return err
+	}
+
+	for _, handle := range handles[:count] {
+		var bus, slot uint32
+		err = errors.Join(
+			nvapiCall(nvapiIdGpuGetBusId, handle, uintptr(unsafe.Pointer(&bus))),
+			nvapiCall(nvapiIdGpuGetBusSlotId, handle, uintptr(unsafe.Pointer(&slot))))
+		if err != nil {
+			return err
+		}
+
+		adapter, found := adapters[pciSlot{bus: int32(bus), device: int32(slot)}]
+		if found {
+			adapter.nvapiGpu = handle
+		}
+	}
+
+	return nil
+}
+
+// Reads the utilization of the GPU and its memory, its clocks, and its temperature
+func nvapiMetrics(handle uintptr) (restapi.GpuMetrics, error) {
+	pstates := nvapiDynamicPstatesInfo{}
+	pstates.Version = nvapiVersion(unsafe.Sizeof(pstates), 1)
+	err := nvapiCall(nvapiIdGpuGetDynamicPstatesInfo, handle, uintptr(unsafe.Pointer(&pstates)))
+	if err != nil {
+		return restapi.GpuMetrics{}, err
+	}
+
+	metrics := restapi.GpuMetrics{
+		UtilizationGpu:  pstates.Utilization[nvapiUtilizationGpu].Percentage,
+		UtilizationVram: pstates.Utilization[nvapiUtilizationFb].Percentage,
+	}
+
+	clocks := nvapiClockFrequencies{}
+	clocks.Version = nvapiVersion(unsafe.Sizeof(clocks), 2)
+	err = nvapiCall(nvapiIdGpuGetAllClockFrequencies, handle, uintptr(unsafe.Pointer(&clocks)))
+	if err == nil {
+		metrics.ClockCore = clocks.Domain[nvapiClockGraphics].Frequency / 1000
+		metrics.ClockMemory = clocks.Domain[nvapiClockMemory].Frequency / 1000
+	}
+
+	thermal := nvapiThermalSettings{}
+	thermal.Version = nvapiVersion(unsafe.Sizeof(thermal), 2)
+	err = nvapiCall(nvapiIdGpuGetThermalSettings, handle, nvapiThermalTargetAll, uintptr(unsafe.Pointer(&thermal)))
+	if err == nil {
+		for index, sensor := range thermal.Sensor {
+			if uint32(index) < thermal.Count && sensor.Target == nvapiThermalTargetGpu && sensor.CurrentTemp > 0 {
+				metrics.TemperatureGpu = uint32(sensor.CurrentTemp)
+				break
+			}
+		}
+	}
+
+	return metrics, nil
+}
+
+// Reads the VRAM used on the GPU by every process
+func nvapiVramUsed(handle uintptr) (uint64, error) {
+	memory := nvapiMemoryInfo{}
+	memory.Version = nvapiVersion(unsafe.Sizeof(memory), 2)
+	err := nvapiCall(nvapiIdGpuGetMemoryInfo, handle, uintptr(unsafe.Pointer(&memory)))
+	if err != nil {
+		return 0, err
+	}
+
+	if memory.CurAvailableDedicatedVideoMemory > memory.DedicatedVideoMemory {
+		return 0, nil
+	}
+
+	return uint64(memory.DedicatedVideoMemory-memory.CurAvailableDedicatedVideoMemory) * 1024, nil
+}
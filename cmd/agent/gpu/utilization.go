@@ -0,0 +1,11 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package gpu
+
+// The share of a GPU's streaming multiprocessors a process used over a period
+type ProcessUtilization struct {
+	Pid int
+	// Percent of the period the process had kernels running on the GPU
+	SmUtilization float64
+}
@@ -0,0 +1,27 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package gpu
+
+import (
+	"fmt"
+)
+
+// A process holding VRAM on a GPU
+type VramProcess struct {
+	Pid  int
+	Name string
+	// Bytes of VRAM used by the process, 0 when the driver does not report it
+	VramUsed uint64
+}
+
+func (process VramProcess) String() string {
+	return fmt.Sprintf("%d:%s:%d", process.Pid, process.Name, process.VramUsed)
+}
+
+// The VRAM used on a GPU and the processes using it
+type VramUsage struct {
+	Used uint64
+	// Empty when the backend cannot attribute VRAM to processes
+	Processes []VramProcess
+}
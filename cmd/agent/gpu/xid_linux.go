@@ -0,0 +1,83 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package gpu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Matches the Xid errors logged by the NVIDIA driver, such as
+// NVRM: Xid (PCI:0000:3b:00): 79, pid=1234, GPU has fallen off the bus.
+var xidRegex = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F]+:[0-9a-fA-F]+:[0-9a-fA-F]+)\): (\d+),?\s*(.*)`)
+
+// Reads the Xid errors logged to the kernel's log buffer since it was created, which requires
+// reading /dev/kmsg
+type XidScanner struct {
+	fd int
+}
+
+func NewXidScanner() (*XidScanner, error) {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the kernel log for Xid errors, %v", err)
+	}
+
+	// Errors logged before the agent started were seen by the agents before it
+	_, err = syscall.Seek(fd, 0, io.SeekEnd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unable to read the kernel log for Xid errors, %v", err)
+	}
+
+	return &XidScanner{
+		fd: fd,
+	}, nil
+}
+
+// Returns the Xid errors logged since the last scan
+func (scanner *XidScanner) Scan() ([]Xid, error) {
+	xids := []Xid{}
+
+	// Each read returns one record
+	buffer := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(scanner.fd, buffer)
+		if errors.Is(err, syscall.EAGAIN) {
+			return xids, nil
+		} else if errors.Is(err, syscall.EPIPE) {
+			// Records were overwritten before they were read
+			continue
+		} else if err != nil {
+			return xids, fmt.Errorf("unable to read the kernel log for Xid errors, %v", err)
+		}
+
+		// Records are prefixed by their priority, sequence number, and timestamp
+		record := string(buffer[:n])
+		if _, message, found := strings.Cut(record, ";"); found {
+			record = message
+		}
+
+		matches := xidRegex.FindStringSubmatch(record)
+		if matches == nil {
+			continue
+		}
+
+		code, _ := strconv.Atoi(matches[2])
+		xids = append(xids, Xid{
+			PciBus:  matches[1],
+			Code:    code,
+			Message: strings.TrimSpace(matches[3]),
+		})
+	}
+}
+
+func (scanner *XidScanner) Close() {
+	syscall.Close(scanner.fd)
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package gpu
+
+import (
+	"fmt"
+)
+
+// Xid errors are only read from the kernel log of Linux hosts
+type XidScanner struct{}
+
+func NewXidScanner() (*XidScanner, error) {
+	return nil, fmt.Errorf("reading Xid errors is %w", ErrUnsupported)
+}
+
+func (scanner *XidScanner) Scan() ([]Xid, error) {
+	return []Xid{}, nil
+}
+
+func (scanner *XidScanner) Close() {
+}
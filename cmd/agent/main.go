@@ -9,6 +9,7 @@ import (
 	"flag"
 
 	"github.com/Juice-Labs/Juice-Labs/cmd/agent/app"
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/otlp"
 	"github.com/Juice-Labs/Juice-Labs/cmd/agent/playnite"
 	"github.com/Juice-Labs/Juice-Labs/cmd/agent/prometheus"
 	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
@@ -59,6 +60,24 @@ func main() {
 				agent.GpuMetricsProvider.AddConsumer(consumer)
 				agent.GpuMetricsProvider.AddConsumer(prometheus.NewGpuMetricsConsumer())
 
+				otlpConsumer, err_ := otlp.NewGpuMetricsConsumer(group, agent)
+				if err_ != nil {
+					return err_
+				}
+
+				if otlpConsumer != nil {
+					agent.GpuMetricsProvider.AddConsumer(otlpConsumer)
+				}
+
+				agent.AddNetworkMetricsConsumer(prometheus.NewNetworkMetricsConsumer(agent.SessionTenant))
+				agent.AddFrameMetricsConsumer(prometheus.NewFrameMetricsConsumer())
+				agent.AddFairnessMetricsConsumer(prometheus.NewFairnessMetricsConsumer(agent.SessionTenant))
+				prometheus.RegisterSessionUpdateMetrics(func() (uint64, uint64, int) {
+					stats := agent.SessionUpdateStats()
+					return stats.Coalesced, stats.Dropped, stats.Pending
+				})
+				prometheus.RegisterSessionMetricsFederation(agent.SessionMetricsTargets)
+
 				err = agent.ConnectToController(group)
 				if err == nil {
 					group.Go("Agent", agent)
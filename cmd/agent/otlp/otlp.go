@@ -0,0 +1,357 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package otlp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/app"
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/gpu"
+	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+const (
+	scopeName = "github.com/Juice-Labs/Juice-Labs/cmd/agent/otlp"
+
+	// Bounds each attempt to export a batch
+	exportTimeout = 10 * time.Second
+	// Bounds the export of the metrics still pending when the agent stops
+	shutdownTimeout = 5 * time.Second
+
+	initialRetryBackoff = time.Second
+	maxRetryBackoff     = 10 * time.Second
+)
+
+var (
+	otlpEndpoint       = flag.String("otlp-endpoint", "", "The host and port of the OpenTelemetry collector the GPU metrics are exported to over OTLP/gRPC, disabled when not set")
+	otlpInsecure       = flag.Bool("otlp-insecure", false, "Export to the collector over a plaintext connection rather than TLS")
+	otlpCaFile         = flag.String("otlp-ca-file", "", "Certificates of the authorities the collector's certificate is verified against, the system's when not set")
+	otlpExportInterval = flag.Duration("otlp-export-interval", 15*time.Second, "How often the GPU metrics sampled since the last export are sent to the collector")
+	otlpBatchSize      = flag.Int("otlp-batch-size", 100, "The number of samples of the GPUs' metrics, read every --gpu-metrics-interval-ms, sent in each export request")
+	otlpMaxQueue       = flag.Int("otlp-max-queue", 3600, "The number of samples kept while the collector cannot be reached, the oldest are dropped beyond it")
+	otlpRetryTimeout   = flag.Duration("otlp-retry-timeout", time.Minute, "How long an export is retried when the collector is unavailable before its samples wait for the next export")
+
+	otlpHeaders = []string{}
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &otlpHeaders}, "otlp-headers", "A comma-separated list of key=value headers sent with every export, such as the collector's credentials")
+}
+
+// The gauges exported for each GPU, named as their Prometheus counterparts so dashboards carry
+// over once the collector translates them
+var gpuGauges = []struct {
+	name        string
+	description string
+	unit        string
+	value       func(restapi.Gpu) float64
+}{
+	{"juice.agent.clock_core", "The GPU's core clock", "MHz", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.ClockCore) }},
+	{"juice.agent.clock_memory", "The GPU's memory clock", "MHz", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.ClockMemory) }},
+	{"juice.agent.utilization_gpu", "The share of time the GPU was busy", "%", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.UtilizationGpu) }},
+	{"juice.agent.utilization_memory", "The share of time the GPU's memory was read or written", "%", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.UtilizationVram) }},
+	{"juice.agent.temperature_gpu", "The GPU's temperature", "Cel", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.TemperatureGpu) }},
+	{"juice.agent.memory_used", "The GPU's VRAM in use", "By", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.VramUsed) }},
+	{"juice.agent.memory_total", "The GPU's VRAM", "By", func(gpu restapi.Gpu) float64 { return float64(gpu.Vram) }},
+	{"juice.agent.power_draw", "The GPU's power draw", "mW", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.PowerDraw) }},
+	{"juice.agent.power_limit", "The GPU's power limit", "mW", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.PowerLimit) }},
+	{"juice.agent.fan_speed", "The GPU's fan speed", "%", func(gpu restapi.Gpu) float64 { return float64(gpu.Metrics.FanSpeed) }},
+}
+
+// The metrics of the agent's GPUs read at a time
+type sample struct {
+	time time.Time
+	gpus []restapi.Gpu
+}
+
+type exporter struct {
+	agent   *app.Agent
+	conn    *grpc.ClientConn
+	client  colmetricspb.MetricsServiceClient
+	headers metadata.MD
+
+	mutex   sync.Mutex
+	pending []sample
+	dropped int
+}
+
+// Returns a consumer batching the GPU metrics and exporting them to the collector at
+// --otlp-endpoint every --otlp-export-interval, nil when --otlp-endpoint is not set. Samples the
+// collector does not accept are retried with the next export, up to --otlp-max-queue of them.
+func NewGpuMetricsConsumer(group task.Group, agent *app.Agent) (gpu.MetricsConsumerFn, error) {
+	if *otlpEndpoint == "" {
+		return nil, nil
+	}
+
+	if *otlpExportInterval <= 0 || *otlpBatchSize <= 0 || *otlpMaxQueue <= 0 {
+		return nil, errors.New("otlp: --otlp-export-interval, --otlp-batch-size, and --otlp-max-queue must be positive")
+	}
+
+	headers := metadata.MD{}
+	for _, header := range otlpHeaders {
+		key, value, found := strings.Cut(header, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("otlp: --otlp-headers: %s must be of the form key=value", header)
+		}
+
+		headers.Append(strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value))
+	}
+
+	transportCredentials := insecure.NewCredentials()
+	if !*otlpInsecure {
+		tlsConfig := &tls.Config{}
+		if *otlpCaFile != "" {
+			pool, err := crypto.AppendCertsFromFile(nil, *otlpCaFile)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.RootCAs = pool
+		}
+
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	}
+
+	// Connects in the background, exports wait for the connection
+	conn, err := grpc.Dial(*otlpEndpoint, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return nil, fmt.Errorf("otlp: unable to connect to %s, %v", *otlpEndpoint, err)
+	}
+
+	exporter := &exporter{
+		agent:   agent,
+		conn:    conn,
+		client:  colmetricspb.NewMetricsServiceClient(conn),
+		headers: headers,
+	}
+
+	group.GoFn("Agent OTLP exporter", exporter.run)
+
+	return exporter.consume, nil
+}
+
+func (exporter *exporter) consume(metrics []restapi.Gpu) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.pending = append(exporter.pending, sample{
+		time: time.Now(),
+		gpus: metrics,
+	})
+
+	if overflow := len(exporter.pending) - *otlpMaxQueue; overflow > 0 {
+		exporter.pending = exporter.pending[overflow:]
+		exporter.dropped += overflow
+	}
+}
+
+func (exporter *exporter) run(group task.Group) error {
+	defer exporter.conn.Close()
+
+	ticker := time.NewTicker(*otlpExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			exporter.flush(ctx)
+			return nil
+
+		case <-ticker.C:
+			exporter.flush(group.Ctx())
+		}
+	}
+}
+
+// Exports the pending samples in batches of --otlp-batch-size, keeping those not exported for
+// the next flush
+func (exporter *exporter) flush(ctx context.Context) {
+	exporter.mutex.Lock()
+	pending := exporter.pending
+	dropped := exporter.dropped
+	exporter.pending = nil
+	exporter.dropped = 0
+	exporter.mutex.Unlock()
+
+	if dropped > 0 {
+		logger.Warningf("otlp: dropped %d samples of the GPU metrics while %s could not be reached, see --otlp-max-queue", dropped, *otlpEndpoint)
+	}
+
+	for len(pending) > 0 {
+		batch := pending
+		if len(batch) > *otlpBatchSize {
+			batch = batch[:*otlpBatchSize]
+		}
+
+		err := exporter.export(ctx, batch)
+		if err != nil {
+			// Exports interrupted by the agent stopping are retried as it does
+			if ctx.Err() == nil {
+				logger.Warningf("otlp: unable to export the GPU metrics to %s, %v", *otlpEndpoint, err)
+			}
+
+			exporter.requeue(pending)
+			return
+		}
+
+		pending = pending[len(batch):]
+	}
+}
+
+// Returns the samples not exported to the front of the queue, ahead of those read since
+func (exporter *exporter) requeue(samples []sample) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.pending = append(samples, exporter.pending...)
+	if overflow := len(exporter.pending) - *otlpMaxQueue; overflow > 0 {
+		exporter.pending = exporter.pending[overflow:]
+		exporter.dropped += overflow
+	}
+}
+
+// Returns whether the collector may accept the request when retried, see the OTLP
+// specification's failures
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss, codes.ResourceExhausted:
+		return true
+	}
+
+	return false
+}
+
+// Sends the batch to the collector, retrying with backoff for up to --otlp-retry-timeout while
+// the collector is unavailable
+func (exporter *exporter) export(ctx context.Context, batch []sample) error {
+	request := exporter.encode(batch)
+
+	deadline := time.Now().Add(*otlpRetryTimeout)
+	backoff := initialRetryBackoff
+	for {
+		callCtx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, exporter.headers), exportTimeout)
+
+		response, err := exporter.client.Export(callCtx, request)
+		cancel()
+		if err == nil {
+			if partial := response.GetPartialSuccess(); partial.GetRejectedDataPoints() > 0 {
+				logger.Warningf("otlp: %s rejected %d data points of the GPU metrics, %s", *otlpEndpoint, partial.GetRejectedDataPoints(), partial.GetErrorMessage())
+			}
+
+			return nil
+		}
+
+		if !retryable(err) || ctx.Err() != nil || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		logger.Debugf("otlp: retrying the export to %s in %s, %v", *otlpEndpoint, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func stringAttribute(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func intAttribute(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}},
+	}
+}
+
+// Returns the batch as an export request, a gauge per metric with a point per GPU and sample
+func (exporter *exporter) encode(batch []sample) *colmetricspb.ExportMetricsServiceRequest {
+	// Read at each export, the agent's id changes when it registers with the controller
+	resource := &resourcepb.Resource{
+		Attributes: []*commonpb.KeyValue{
+			stringAttribute("service.name", "juice-agent"),
+			stringAttribute("service.version", build.Version),
+			stringAttribute("host.name", exporter.agent.Hostname),
+			stringAttribute("juice.agent.id", exporter.agent.Id),
+			stringAttribute("juice.pool", exporter.agent.Pool()),
+		},
+	}
+
+	metrics := make([]*metricspb.Metric, 0, len(gpuGauges))
+	for _, definition := range gpuGauges {
+		gauge := &metricspb.Gauge{}
+		for _, sample := range batch {
+			for _, gpu := range sample.gpus {
+				gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+					Attributes: []*commonpb.KeyValue{
+						intAttribute("gpu.index", int64(gpu.Index)),
+						stringAttribute("gpu.name", gpu.Name),
+					},
+					TimeUnixNano: uint64(sample.time.UnixNano()),
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: definition.value(gpu)},
+				})
+			}
+		}
+
+		metrics = append(metrics, &metricspb.Metric{
+			Name:        definition.name,
+			Description: definition.description,
+			Unit:        definition.unit,
+			Data:        &metricspb.Metric_Gauge{Gauge: gauge},
+		})
+	}
+
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{
+			{
+				Resource: resource,
+				ScopeMetrics: []*metricspb.ScopeMetrics{
+					{
+						Scope: &commonpb.InstrumentationScope{
+							Name:    scopeName,
+							Version: build.Version,
+						},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package otlp
+
+import (
+	"context"
+	"flag"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/agent/app"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// A collector refusing the first export as unavailable and recording those it accepts
+type collector struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mutex    sync.Mutex
+	refused  bool
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	headers  []metadata.MD
+	received chan struct{}
+}
+
+func (collector *collector) Export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	if !collector.refused {
+		collector.refused = true
+		return nil, status.Error(codes.Unavailable, "starting")
+	}
+
+	headers, _ := metadata.FromIncomingContext(ctx)
+	collector.requests = append(collector.requests, request)
+	collector.headers = append(collector.headers, headers)
+	collector.received <- struct{}{}
+
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestExportRetriedUntilAccepted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := &collector{
+		received: make(chan struct{}, 16),
+	}
+
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, collector)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	for name, value := range map[string]string{
+		"otlp-endpoint":        listener.Addr().String(),
+		"otlp-insecure":        "true",
+		"otlp-export-interval": "10ms",
+		"otlp-headers":         "Authorization=Bearer token",
+	} {
+		err = flag.Set(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	group := task.NewTaskManager(context.Background())
+	defer func() {
+		group.Cancel()
+		group.Wait()
+	}()
+
+	consume, err := NewGpuMetricsConsumer(group, &app.Agent{Id: "agent", Hostname: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gpu := restapi.Gpu{Index: 1, Name: "A100", Vram: 80}
+	gpu.Metrics.FanSpeed = 42
+	consume([]restapi.Gpu{gpu})
+
+	select {
+	case <-collector.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the export refused as unavailable to be retried")
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	if authorization := collector.headers[0].Get("authorization"); len(authorization) != 1 || authorization[0] != "Bearer token" {
+		t.Errorf("expected the export to carry --otlp-headers, instead received %v", authorization)
+	}
+
+	resourceMetrics := collector.requests[0].GetResourceMetrics()
+	if len(resourceMetrics) != 1 || len(resourceMetrics[0].GetScopeMetrics()) != 1 {
+		t.Fatalf("expected a single resource and scope, instead received %v", collector.requests[0])
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range resourceMetrics[0].GetResource().GetAttributes() {
+		attributes[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+	if attributes["host.name"] != "host" || attributes["juice.agent.id"] != "agent" || attributes["juice.pool"] != restapi.DefaultPool {
+		t.Errorf("expected the resource to identify the agent, instead received %v", attributes)
+	}
+
+	metrics := resourceMetrics[0].GetScopeMetrics()[0].GetMetrics()
+	if len(metrics) != len(gpuGauges) {
+		t.Fatalf("expected %d gauges, instead received %d", len(gpuGauges), len(metrics))
+	}
+
+	for _, metric := range metrics {
+		if metric.GetName() != "juice.agent.fan_speed" {
+			continue
+		}
+
+		points := metric.GetGauge().GetDataPoints()
+		if len(points) != 1 {
+			t.Fatalf("expected a point of the GPU, instead received %d", len(points))
+		}
+
+		if points[0].GetAsDouble() != 42 {
+			t.Errorf("expected the GPU's fan speed, 42, instead received %f", points[0].GetAsDouble())
+		}
+
+		for _, attribute := range points[0].GetAttributes() {
+			if attribute.GetKey() == "gpu.index" && attribute.GetValue().GetIntValue() != 1 {
+				t.Errorf("expected the point of GPU 1, instead received %d", attribute.GetValue().GetIntValue())
+			}
+		}
+
+		return
+	}
+
+	t.Error("expected the GPU's fan speed to be exported")
+}
@@ -0,0 +1,62 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Label value of the series aggregating the values beyond a labelLimiter's limit
+const otherLabelValue = "other"
+
+// Bounds the number of distinct values of a label. Values are admitted as their own label
+// value up to max, values beyond it are hashed into a fixed number of buckets or, without
+// buckets, aggregated into otherLabelValue. Admitted values keep their label until forgotten.
+type labelLimiter struct {
+	max     int
+	buckets int
+
+	admitted map[string]struct{}
+}
+
+func newLabelLimiter(max int, buckets int) *labelLimiter {
+	return &labelLimiter{
+		max:      max,
+		buckets:  buckets,
+		admitted: map[string]struct{}{},
+	}
+}
+
+func (limiter *labelLimiter) label(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	if _, present := limiter.admitted[value]; present {
+		return value
+	}
+
+	if len(limiter.admitted) < limiter.max {
+		limiter.admitted[value] = struct{}{}
+		return value
+	}
+
+	if limiter.buckets > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(value))
+		return fmt.Sprintf("bucket-%d", hash.Sum32()%uint32(limiter.buckets))
+	}
+
+	return otherLabelValue
+}
+
+// Forgets the admitted values not in present, freeing their slots for new values
+func (limiter *labelLimiter) retain(present map[string]struct{}) {
+	for value := range limiter.admitted {
+		if _, found := present[value]; !found {
+			delete(limiter.admitted, value)
+		}
+	}
+}
@@ -4,6 +4,7 @@
 package prometheus
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/gorilla/mux"
@@ -17,8 +18,12 @@ func InitializeEndpoints(server *server.Server) {
 }
 
 func getMetrics(group task.Group, router *mux.Router) error {
+	// OpenMetrics is required to expose exemplars
 	router.Methods("GET").Path("/v1/prometheus/metrics").Handler(
-		promhttp.Handler())
+		promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+				EnableOpenMetrics: true,
+			})))
 
 	return nil
 }
@@ -0,0 +1,147 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+type fairnessCollector struct {
+	sync.Mutex
+
+	SmUtilization    *prometheus.GaugeVec
+	FairShare        *prometheus.GaugeVec
+	Throttle         *prometheus.GaugeVec
+	ThrottledSeconds *prometheus.GaugeVec
+}
+
+func newFairnessCollector() *fairnessCollector {
+	labels := []string{"session", "tenant"}
+
+	return &fairnessCollector{
+		SmUtilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_sm_utilization_percent",
+			},
+			labels,
+		),
+		FairShare: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_sm_fair_share_percent",
+			},
+			labels,
+		),
+		Throttle: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_throttle",
+			},
+			labels,
+		),
+		ThrottledSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_throttled_seconds",
+			},
+			labels,
+		),
+	}
+}
+
+func (c *fairnessCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.SmUtilization.Describe(ch)
+	c.FairShare.Describe(ch)
+	c.Throttle.Describe(ch)
+	c.ThrottledSeconds.Describe(ch)
+}
+
+func (c *fairnessCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.SmUtilization.Collect(ch)
+	c.FairShare.Collect(ch)
+	c.Throttle.Collect(ch)
+	c.ThrottledSeconds.Collect(ch)
+}
+
+// Sessions sharing a series report the busiest and most throttled session, and their total time throttled
+func accumulateFairness(total *restapi.GpuFairness, fairness restapi.GpuFairness) {
+	total.SmUtilization = math.Max(total.SmUtilization, fairness.SmUtilization)
+	total.FairShare = math.Min(total.FairShare, fairness.FairShare)
+	total.Throttle = math.Max(total.Throttle, fairness.Throttle)
+	total.ThrottledSeconds += fairness.ThrottledSeconds
+}
+
+// Records how the sessions share their GPUs, labeled by session and tenant as the network metrics
+// are and bounded by the same options
+func NewFairnessMetricsConsumer(tenantOf func(sessionId string) string) func(map[string]restapi.GpuFairness) {
+	collector := newFairnessCollector()
+	prometheus.MustRegister(collector)
+
+	sessionLimiter := newLabelLimiter(*maxSessionLabels, *sessionBuckets)
+	tenantLimiter := newLabelLimiter(*maxTenantLabels, 0)
+
+	return func(metrics map[string]restapi.GpuFairness) {
+		collector.Lock()
+		defer collector.Unlock()
+
+		// Admit new sessions in a stable order
+		ids := make([]string, 0, len(metrics))
+		tenants := map[string]string{}
+		presentSessions := map[string]struct{}{}
+		presentTenants := map[string]struct{}{}
+		for id := range metrics {
+			ids = append(ids, id)
+			tenants[id] = tenantOf(id)
+			presentSessions[id] = struct{}{}
+			presentTenants[tenants[id]] = struct{}{}
+		}
+		sort.Strings(ids)
+
+		sessionLimiter.retain(presentSessions)
+		tenantLimiter.retain(presentTenants)
+
+		series := map[sessionSeries]*restapi.GpuFairness{}
+		for _, id := range ids {
+			key := sessionSeries{
+				session: sessionLimiter.label(id),
+				tenant:  tenantLimiter.label(tenants[id]),
+			}
+
+			total, present := series[key]
+			if !present {
+				total = &restapi.GpuFairness{
+					FairShare: 100,
+				}
+				series[key] = total
+			}
+			accumulateFairness(total, metrics[id])
+		}
+
+		collector.SmUtilization.Reset()
+		collector.FairShare.Reset()
+		collector.Throttle.Reset()
+		collector.ThrottledSeconds.Reset()
+
+		for key, fairness := range series {
+			collector.SmUtilization.WithLabelValues(key.session, key.tenant).Set(fairness.SmUtilization)
+			collector.FairShare.WithLabelValues(key.session, key.tenant).Set(fairness.FairShare)
+			collector.Throttle.WithLabelValues(key.session, key.tenant).Set(fairness.Throttle)
+			collector.ThrottledSeconds.WithLabelValues(key.session, key.tenant).Set(fairness.ThrottledSeconds)
+		}
+	}
+}
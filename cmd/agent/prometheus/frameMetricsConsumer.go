@@ -0,0 +1,92 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+type frameCollector struct {
+	sync.Mutex
+
+	// Labeled by tenant only, each report is one sample carrying the id of its session as an exemplar
+	FrameIntervalP95 *prometheus.HistogramVec
+	InputLatencyP95  *prometheus.HistogramVec
+}
+
+func newFrameCollector() *frameCollector {
+	return &frameCollector{
+		FrameIntervalP95: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_frame_interval_p95_seconds",
+				Buckets:   prometheus.ExponentialBuckets(0.004, 1.5, 12),
+			},
+			[]string{"tenant"},
+		),
+		InputLatencyP95: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_input_latency_p95_seconds",
+				Buckets:   prometheus.ExponentialBuckets(0.004, 1.5, 12),
+			},
+			[]string{"tenant"},
+		),
+	}
+}
+
+func (c *frameCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.FrameIntervalP95.Describe(ch)
+	c.InputLatencyP95.Describe(ch)
+}
+
+func (c *frameCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.FrameIntervalP95.Collect(ch)
+	c.InputLatencyP95.Collect(ch)
+}
+
+func observe(observer prometheus.Observer, value float64, sessionId string) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"session": sessionId})
+	} else {
+		observer.Observe(value)
+	}
+}
+
+func seconds(milliseconds float64) float64 {
+	return milliseconds / 1000
+}
+
+// Records the frame metrics reported by the clients of the sessions, labeled by tenant and
+// bounded by --prometheus-max-tenants
+func NewFrameMetricsConsumer() func(sessionId string, tenant string, frames restapi.FrameMetrics) {
+	collector := newFrameCollector()
+	prometheus.MustRegister(collector)
+
+	tenantLimiter := newLabelLimiter(*maxTenantLabels, 0)
+
+	return func(sessionId string, tenant string, frames restapi.FrameMetrics) {
+		collector.Lock()
+		defer collector.Unlock()
+
+		tenant = tenantLimiter.label(tenant)
+
+		if frames.Frames > 0 {
+			observe(collector.FrameIntervalP95.WithLabelValues(tenant), seconds(frames.FrameIntervalP95), sessionId)
+		}
+
+		if frames.InputLatencyP95 > 0 {
+			observe(collector.InputLatencyP95.WithLabelValues(tenant), seconds(frames.InputLatencyP95), sessionId)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	maxSessionLabels = flag.Int("prometheus-max-sessions", 50, "Maximum number of sessions labeled by id in the session metrics, 0 aggregates every session")
+	sessionBuckets   = flag.Int("prometheus-session-buckets", 16, "Number of hash buckets the sessions beyond --prometheus-max-sessions are aggregated into, 0 aggregates them into a single series")
+	maxTenantLabels  = flag.Int("prometheus-max-tenants", 20, "Maximum number of tenants labeled by name in the session metrics, tenants beyond the limit are aggregated")
+)
+
+type networkCollector struct {
+	sync.Mutex
+
+	SendRate    *prometheus.GaugeVec
+	ReceiveRate *prometheus.GaugeVec
+	Rtt         *prometheus.GaugeVec
+	RttMax      *prometheus.GaugeVec
+	Retransmits *prometheus.GaugeVec
+
+	// Only reported by agents with eBPF network accounting
+	SendPacketRate    *prometheus.GaugeVec
+	ReceivePacketRate *prometheus.GaugeVec
+
+	// Labeled by tenant only, so they remain useful when the sessions are aggregated
+	Sessions     *prometheus.GaugeVec
+	RttHistogram *prometheus.HistogramVec
+
+	// Labeled by the transport of the sessions' client connections, to compare their performance
+	TransportSessions     *prometheus.GaugeVec
+	TransportSendRate     *prometheus.GaugeVec
+	TransportReceiveRate  *prometheus.GaugeVec
+	TransportRetransmits  *prometheus.GaugeVec
+	TransportResumes      *prometheus.GaugeVec
+	TransportRttHistogram *prometheus.HistogramVec
+}
+
+func newNetworkCollector() *networkCollector {
+	labels := []string{"session", "tenant"}
+	transportLabels := []string{"transport"}
+
+	return &networkCollector{
+		TransportSessions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "transport_sessions",
+			},
+			transportLabels,
+		),
+		TransportSendRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "transport_send_bytes_per_second",
+			},
+			transportLabels,
+		),
+		TransportReceiveRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "transport_receive_bytes_per_second",
+			},
+			transportLabels,
+		),
+		// Packets lost over QUIC
+		TransportRetransmits: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "transport_retransmits",
+			},
+			transportLabels,
+		),
+		TransportResumes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "transport_resumes",
+			},
+			transportLabels,
+		),
+		TransportRttHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "transport_rtt_seconds",
+				Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+			},
+			transportLabels,
+		),
+		Sessions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "sessions",
+			},
+			[]string{"tenant"},
+		),
+		// Each sample carries the id of its session as an exemplar
+		RttHistogram: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_rtt_seconds",
+				Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+			},
+			[]string{"tenant"},
+		),
+		SendRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_send_bytes_per_second",
+			},
+			labels,
+		),
+		ReceiveRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_receive_bytes_per_second",
+			},
+			labels,
+		),
+		Rtt: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_rtt_microseconds",
+			},
+			labels,
+		),
+		RttMax: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_rtt_max_microseconds",
+			},
+			labels,
+		),
+		Retransmits: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_retransmits",
+			},
+			labels,
+		),
+		SendPacketRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_send_packets_per_second",
+			},
+			labels,
+		),
+		ReceivePacketRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_receive_packets_per_second",
+			},
+			labels,
+		),
+	}
+}
+
+func (c *networkCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.SendRate.Describe(ch)
+	c.ReceiveRate.Describe(ch)
+	c.Rtt.Describe(ch)
+	c.RttMax.Describe(ch)
+	c.Retransmits.Describe(ch)
+	c.SendPacketRate.Describe(ch)
+	c.ReceivePacketRate.Describe(ch)
+	c.Sessions.Describe(ch)
+	c.RttHistogram.Describe(ch)
+	c.TransportSessions.Describe(ch)
+	c.TransportSendRate.Describe(ch)
+	c.TransportReceiveRate.Describe(ch)
+	c.TransportRetransmits.Describe(ch)
+	c.TransportResumes.Describe(ch)
+	c.TransportRttHistogram.Describe(ch)
+}
+
+func (c *networkCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.SendRate.Collect(ch)
+	c.ReceiveRate.Collect(ch)
+	c.Rtt.Collect(ch)
+	c.RttMax.Collect(ch)
+	c.Retransmits.Collect(ch)
+	c.SendPacketRate.Collect(ch)
+	c.ReceivePacketRate.Collect(ch)
+	c.Sessions.Collect(ch)
+	c.RttHistogram.Collect(ch)
+	c.TransportSessions.Collect(ch)
+	c.TransportSendRate.Collect(ch)
+	c.TransportReceiveRate.Collect(ch)
+	c.TransportRetransmits.Collect(ch)
+	c.TransportResumes.Collect(ch)
+	c.TransportRttHistogram.Collect(ch)
+}
+
+type sessionSeries struct {
+	session string
+	tenant  string
+}
+
+// Sessions sharing a series are summed, except for the round trip times which report the worst session
+func accumulate(total *restapi.NetworkMetrics, network restapi.NetworkMetrics) {
+	total.SendRate += network.SendRate
+	total.ReceiveRate += network.ReceiveRate
+	total.Retransmits += network.Retransmits
+	total.SendPacketRate += network.SendPacketRate
+	total.ReceivePacketRate += network.ReceivePacketRate
+
+	if network.Rtt > total.Rtt {
+		total.Rtt = network.Rtt
+	}
+	if network.RttMax > total.RttMax {
+		total.RttMax = network.RttMax
+	}
+
+	total.Resumes += network.Resumes
+}
+
+// Labels the session metrics by session and tenant, bounding the number of series with
+// --prometheus-max-sessions, --prometheus-session-buckets, and --prometheus-max-tenants
+func NewNetworkMetricsConsumer(tenantOf func(sessionId string) string) func(map[string]restapi.NetworkMetrics) {
+	collector := newNetworkCollector()
+	prometheus.MustRegister(collector)
+
+	sessionLimiter := newLabelLimiter(*maxSessionLabels, *sessionBuckets)
+	tenantLimiter := newLabelLimiter(*maxTenantLabels, 0)
+
+	return func(metrics map[string]restapi.NetworkMetrics) {
+		collector.Lock()
+		defer collector.Unlock()
+
+		// Admit new sessions in a stable order
+		ids := make([]string, 0, len(metrics))
+		tenants := map[string]string{}
+		presentSessions := map[string]struct{}{}
+		presentTenants := map[string]struct{}{}
+		for id := range metrics {
+			ids = append(ids, id)
+			tenants[id] = tenantOf(id)
+			presentSessions[id] = struct{}{}
+			presentTenants[tenants[id]] = struct{}{}
+		}
+		sort.Strings(ids)
+
+		// Sessions that have closed are no longer reported and free their labels
+		sessionLimiter.retain(presentSessions)
+		tenantLimiter.retain(presentTenants)
+
+		series := map[sessionSeries]*restapi.NetworkMetrics{}
+		sessions := map[string]int{}
+		transports := map[string]*restapi.NetworkMetrics{}
+		transportSessions := map[string]int{}
+		for _, id := range ids {
+			network := metrics[id]
+			tenant := tenantLimiter.label(tenants[id])
+
+			key := sessionSeries{
+				session: sessionLimiter.label(id),
+				tenant:  tenant,
+			}
+
+			total, present := series[key]
+			if !present {
+				total = &restapi.NetworkMetrics{}
+				series[key] = total
+			}
+			accumulate(total, network)
+
+			sessions[tenant]++
+
+			rtt := (time.Duration(network.Rtt) * time.Microsecond).Seconds()
+			observer := collector.RttHistogram.WithLabelValues(tenant)
+			if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+				exemplarObserver.ObserveWithExemplar(rtt, prometheus.Labels{"session": id})
+			} else {
+				observer.Observe(rtt)
+			}
+
+			// Sessions no client has connected to yet have no transport
+			if network.Transport != "" {
+				transport, present := transports[network.Transport]
+				if !present {
+					transport = &restapi.NetworkMetrics{}
+					transports[network.Transport] = transport
+				}
+				accumulate(transport, network)
+
+				transportSessions[network.Transport]++
+				collector.TransportRttHistogram.WithLabelValues(network.Transport).Observe(rtt)
+			}
+		}
+
+		collector.SendRate.Reset()
+		collector.ReceiveRate.Reset()
+		collector.Rtt.Reset()
+		collector.RttMax.Reset()
+		collector.Retransmits.Reset()
+		collector.SendPacketRate.Reset()
+		collector.ReceivePacketRate.Reset()
+		collector.Sessions.Reset()
+		collector.TransportSessions.Reset()
+		collector.TransportSendRate.Reset()
+		collector.TransportReceiveRate.Reset()
+		collector.TransportRetransmits.Reset()
+		collector.TransportResumes.Reset()
+
+		for key, network := range series {
+			collector.SendRate.WithLabelValues(key.session, key.tenant).Set(float64(network.SendRate))
+			collector.ReceiveRate.WithLabelValues(key.session, key.tenant).Set(float64(network.ReceiveRate))
+			collector.Rtt.WithLabelValues(key.session, key.tenant).Set(float64(network.Rtt))
+			collector.RttMax.WithLabelValues(key.session, key.tenant).Set(float64(network.RttMax))
+			collector.Retransmits.WithLabelValues(key.session, key.tenant).Set(float64(network.Retransmits))
+
+			if network.SendPacketRate > 0 || network.ReceivePacketRate > 0 {
+				collector.SendPacketRate.WithLabelValues(key.session, key.tenant).Set(float64(network.SendPacketRate))
+				collector.ReceivePacketRate.WithLabelValues(key.session, key.tenant).Set(float64(network.ReceivePacketRate))
+			}
+		}
+
+		for tenant, count := range sessions {
+			collector.Sessions.WithLabelValues(tenant).Set(float64(count))
+		}
+
+		for name, transport := range transports {
+			collector.TransportSessions.WithLabelValues(name).Set(float64(transportSessions[name]))
+			collector.TransportSendRate.WithLabelValues(name).Set(float64(transport.SendRate))
+			collector.TransportReceiveRate.WithLabelValues(name).Set(float64(transport.ReceiveRate))
+			collector.TransportRetransmits.WithLabelValues(name).Set(float64(transport.Retransmits))
+			collector.TransportResumes.WithLabelValues(name).Set(float64(transport.Resumes))
+		}
+	}
+}
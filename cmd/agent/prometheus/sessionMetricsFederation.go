@@ -0,0 +1,291 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	sessionMetricsPath      = flag.String("session-metrics-path", "/metrics", "Path the agent scrapes on the metrics port of the sessions' workloads, see the sessions' metricsPort requirement")
+	sessionMetricsTimeout   = flag.Duration("session-metrics-timeout", 2*time.Second, "Maximum duration of a scrape of a session's workload, sessions not answering in time are left out of the agent's metrics")
+	sessionMetricsMaxSeries = flag.Int("session-metrics-max-series", 1000, "Maximum number of series exported from the workload of each session, series beyond the limit are dropped")
+)
+
+// Labels added to the series of the sessions' workloads, the same as those of the agent's own
+// session and GPU metrics so they can be joined. Labels of the workload's series with the same
+// names are renamed with exportedLabelPrefix, as Prometheus does when federating.
+var sessionMetricsLabels = []string{"session", "tenant", "index"}
+
+const exportedLabelPrefix = "exported_"
+
+// Scrapes the workloads of the sessions as the agent's metrics are gathered and exports their
+// series as the agent's own
+type sessionMetricsCollector struct {
+	targets func() []restapi.Session
+	client  *http.Client
+
+	scrapeErrors  prometheus.Counter
+	seriesDropped prometheus.Counter
+}
+
+type sessionScrape struct {
+	session  restapi.Session
+	families map[string]*dto.MetricFamily
+}
+
+// Describes nothing, the series are only known once the workloads are scraped
+func (c *sessionMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *sessionMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	targets := c.targets()
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Id < targets[j].Id
+	})
+
+	scrapes := make([]sessionScrape, len(targets))
+
+	var wg sync.WaitGroup
+	for index, target := range targets {
+		scrapes[index].session = target
+
+		wg.Add(1)
+		go func(scrape *sessionScrape) {
+			defer wg.Done()
+
+			families, err := c.scrape(scrape.session.MetricsPort)
+			if err != nil {
+				c.scrapeErrors.Inc()
+				logger.WithSession(scrape.session.Id).Debugf("unable to scrape the metrics of session %s, %v", scrape.session.Id, err)
+				return
+			}
+
+			scrape.families = families
+		}(&scrapes[index])
+	}
+	wg.Wait()
+
+	// Series of a name must have the same type, help, and labels whichever session exports them
+	descs := map[string]*sessionMetricsDesc{}
+	for _, scrape := range scrapes {
+		c.collectSession(ch, scrape, descs)
+	}
+}
+
+func (c *sessionMetricsCollector) scrape(port int) (map[string]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *sessionMetricsTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", port, *sessionMetricsPath)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", string(expfmt.FmtText))
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(response.Body)
+}
+
+type sessionMetricsDesc struct {
+	desc       *prometheus.Desc
+	metricType dto.MetricType
+	// The workload's label names, followed by sessionMetricsLabels
+	labels []string
+	// Label values already exported, the registry rejects duplicate series
+	exported map[string]struct{}
+}
+
+// Returns the label names of the workload's series, sorted and renamed away from
+// sessionMetricsLabels
+func workloadLabels(metric *dto.Metric) ([]string, map[string]string) {
+	names := make([]string, 0, len(metric.GetLabel()))
+	values := map[string]string{}
+	for _, pair := range metric.GetLabel() {
+		name := pair.GetName()
+		for _, label := range sessionMetricsLabels {
+			if name == label {
+				name = exportedLabelPrefix + name
+				break
+			}
+		}
+
+		names = append(names, name)
+		values[name] = pair.GetValue()
+	}
+	sort.Strings(names)
+
+	return names, values
+}
+
+func sameLabels(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *sessionMetricsCollector) collectSession(ch chan<- prometheus.Metric, scrape sessionScrape, descs map[string]*sessionMetricsDesc) {
+	gpus := make([]string, len(scrape.session.Gpus))
+	for index, gpu := range scrape.session.Gpus {
+		gpus[index] = strconv.Itoa(gpu.Index)
+	}
+	sessionValues := []string{scrape.session.Id, scrape.session.Tenant, strings.Join(gpus, ",")}
+
+	names := make([]string, 0, len(scrape.families))
+	for name := range scrape.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	series := 0
+	for _, name := range names {
+		family := scrape.families[name]
+
+		for _, metric := range family.GetMetric() {
+			// The agent's own metrics are not replaced by those of a workload
+			if strings.HasPrefix(name, namespace+"_") || series >= *sessionMetricsMaxSeries {
+				c.seriesDropped.Inc()
+				continue
+			}
+
+			labels, values := workloadLabels(metric)
+
+			desc, found := descs[name]
+			if !found {
+				desc = &sessionMetricsDesc{
+					desc:       prometheus.NewDesc(name, family.GetHelp(), append(append([]string{}, labels...), sessionMetricsLabels...), nil),
+					metricType: family.GetType(),
+					labels:     labels,
+					exported:   map[string]struct{}{},
+				}
+				descs[name] = desc
+			} else if desc.metricType != family.GetType() || !sameLabels(desc.labels, labels) {
+				c.seriesDropped.Inc()
+				continue
+			}
+
+			labelValues := make([]string, 0, len(labels)+len(sessionMetricsLabels))
+			for _, label := range labels {
+				labelValues = append(labelValues, values[label])
+			}
+			labelValues = append(labelValues, sessionValues...)
+
+			key := strings.Join(labelValues, "\xff")
+			if _, present := desc.exported[key]; present {
+				c.seriesDropped.Inc()
+				continue
+			}
+
+			exported, err := constMetric(desc.desc, family.GetType(), metric, labelValues)
+			if err != nil {
+				c.seriesDropped.Inc()
+				logger.WithSession(scrape.session.Id).Debugf("unable to export series %s of session %s, %v", name, scrape.session.Id, err)
+				continue
+			}
+
+			desc.exported[key] = struct{}{}
+			series++
+			ch <- exported
+		}
+	}
+}
+
+func constMetric(desc *prometheus.Desc, metricType dto.MetricType, metric *dto.Metric, labelValues []string) (prometheus.Metric, error) {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, metric.GetCounter().GetValue(), labelValues...)
+
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, metric.GetGauge().GetValue(), labelValues...)
+
+	case dto.MetricType_UNTYPED:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, metric.GetUntyped().GetValue(), labelValues...)
+
+	case dto.MetricType_SUMMARY:
+		summary := metric.GetSummary()
+
+		quantiles := map[float64]float64{}
+		for _, quantile := range summary.GetQuantile() {
+			quantiles[quantile.GetQuantile()] = quantile.GetValue()
+		}
+
+		return prometheus.NewConstSummary(desc, summary.GetSampleCount(), summary.GetSampleSum(), quantiles, labelValues...)
+
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+
+		// The +Inf bucket is the sample count
+		buckets := map[float64]uint64{}
+		for _, bucket := range histogram.GetBucket() {
+			if !math.IsInf(bucket.GetUpperBound(), 1) {
+				buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+			}
+		}
+
+		return prometheus.NewConstHistogram(desc, histogram.GetSampleCount(), histogram.GetSampleSum(), buckets, labelValues...)
+	}
+
+	return nil, fmt.Errorf("unsupported metric type %s", metricType)
+}
+
+// Exports the metrics served by the workloads of the sessions targets returns, labeled with the
+// session, its tenant, and the indexes of its GPUs
+func RegisterSessionMetricsFederation(targets func() []restapi.Session) {
+	collector := &sessionMetricsCollector{
+		targets: targets,
+		client:  &http.Client{},
+
+		scrapeErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_metrics_scrape_errors_total",
+			},
+		),
+		seriesDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_metrics_series_dropped_total",
+			},
+		),
+	}
+
+	prometheus.MustRegister(collector, collector.scrapeErrors, collector.seriesDropped)
+}
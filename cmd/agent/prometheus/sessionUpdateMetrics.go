@@ -0,0 +1,48 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Records the session state changes the agent could not send to the controller as they happened,
+// read from stats when scraped
+func RegisterSessionUpdateMetrics(stats func() (coalesced uint64, dropped uint64, pending int)) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_updates_coalesced_total",
+			},
+			func() float64 {
+				coalesced, _, _ := stats()
+				return float64(coalesced)
+			},
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_updates_dropped_total",
+			},
+			func() float64 {
+				_, dropped, _ := stats()
+				return float64(dropped)
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "session_updates_pending",
+			},
+			func() float64 {
+				_, _, pending := stats()
+				return float64(pending)
+			},
+		),
+	)
+}
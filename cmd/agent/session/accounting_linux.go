@@ -0,0 +1,323 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+var (
+	ebpfNetworkAccounting = flag.Bool("ebpf-network-accounting", false, "Counts the bytes and packets of each renderer with eBPF programs attached to a cgroup created for it, including the connections the renderer opens itself, without capturing packets. Requires cgroup v2 and CAP_BPF or root, a --rootless agent runs without it when the programs cannot be loaded")
+	ebpfCgroupRoot        = flag.String("ebpf-cgroup-root", "", "The cgroup v2 directory the renderers' cgroups are created in with --ebpf-network-accounting, defaults to the agent's own cgroup")
+)
+
+// Indexes of the counters map
+const (
+	egressCounter  = 0
+	ingressCounter = 1
+)
+
+// Value of the counters map, one per CPU
+type cgroupCounter struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+// Directory the renderers' cgroups are created in, empty when eBPF network accounting is disabled
+var cgroupRoot string
+
+// Checks that eBPF network accounting is supported when --ebpf-network-accounting is set
+func InitializeNetworkAccounting() error {
+	if !*ebpfNetworkAccounting {
+		return nil
+	}
+
+	root := *ebpfCgroupRoot
+	if root == "" {
+		mount, err := cgroup2Mount()
+		if err != nil {
+			return fmt.Errorf("unable to find the cgroup v2 mount for --ebpf-network-accounting, %w", err)
+		}
+
+		own, err := ownCgroup()
+		if err != nil {
+			return fmt.Errorf("unable to find the agent's cgroup for --ebpf-network-accounting, %w", err)
+		}
+
+		root = filepath.Join(mount, own)
+	}
+
+	var stat unix.Statfs_t
+	err := unix.Statfs(root, &stat)
+	if err != nil {
+		return err
+	}
+
+	if stat.Type != unix.CGROUP2_SUPER_MAGIC {
+		return fmt.Errorf("--ebpf-network-accounting requires cgroup v2, %s is not a cgroup v2 directory", root)
+	}
+
+	// Loading the programs checks the kernel supports them and the agent is permitted to load them
+	accounting, err := loadAccounting()
+	if err != nil {
+		return fmt.Errorf("unable to load the eBPF network accounting programs, %w", err)
+	}
+
+	err = accounting.close()
+	if err != nil {
+		return err
+	}
+
+	cgroupRoot = root
+	logger.Infof("accounting renderer network traffic with eBPF in cgroups under %s", root)
+
+	return nil
+}
+
+// Returns whether eBPF network accounting was initialized, see InitializeNetworkAccounting
+func NetworkAccountingEnabled() bool {
+	return cgroupRoot != ""
+}
+
+// Returns where the cgroup v2 hierarchy is mounted, /sys/fs/cgroup/unified on hosts with both versions
+func cgroup2Mount() (string, error) {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+
+	return "", errors.Join(scanner.Err(), errors.New("cgroup v2 is not mounted"))
+}
+
+// Returns the agent's cgroup v2 path relative to the cgroup v2 mount
+func ownCgroup() (string, error) {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path, found := strings.CutPrefix(scanner.Text(), "0::"); found {
+			return path, nil
+		}
+	}
+
+	return "", errors.Join(scanner.Err(), errors.New("the agent is not in a cgroup v2 hierarchy"))
+}
+
+// Counts the packets a renderer sends and receives with eBPF programs attached to a cgroup the
+// renderer is started in
+type cgroupAccounting struct {
+	path   string
+	cgroup *os.File
+
+	counters *ebpf.Map
+	programs []*ebpf.Program
+	links    []link.Link
+}
+
+// Adds the length of the packet and one packet to the counter, letting every packet through
+func countingInstructions(counters *ebpf.Map, counter int32) asm.Instructions {
+	return asm.Instructions{
+		// __sk_buff.len
+		asm.LoadMem(asm.R6, asm.R1, 0, asm.Word),
+
+		asm.StoreImm(asm.RFP, -4, int64(counter), asm.Word),
+		asm.LoadMapPtr(asm.R1, counters.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "allow"),
+
+		// The map is per CPU, the values are summed when read
+		asm.LoadMem(asm.R1, asm.R0, 0, asm.DWord),
+		asm.Add.Reg(asm.R1, asm.R6),
+		asm.StoreMem(asm.R0, 0, asm.R1, asm.DWord),
+		asm.LoadMem(asm.R1, asm.R0, 8, asm.DWord),
+		asm.Add.Imm(asm.R1, 1),
+		asm.StoreMem(asm.R0, 8, asm.R1, asm.DWord),
+
+		asm.Mov.Imm(asm.R0, 1).WithSymbol("allow"),
+		asm.Return(),
+	}
+}
+
+func loadAccounting() (*cgroupAccounting, error) {
+	counters, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  16,
+		MaxEntries: 2,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accounting := &cgroupAccounting{
+		counters: counters,
+	}
+
+	for _, counter := range []int32{egressCounter, ingressCounter} {
+		program, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type:         ebpf.CGroupSKB,
+			License:      "Proprietary",
+			Instructions: countingInstructions(counters, counter),
+		})
+		if err != nil {
+			return nil, errors.Join(err, accounting.close())
+		}
+
+		accounting.programs = append(accounting.programs, program)
+	}
+
+	return accounting, nil
+}
+
+// Creates the cgroup for the renderer with the accounting programs attached, returns nil when
+// --ebpf-network-accounting is not set
+func newCgroupAccounting(id string) (*cgroupAccounting, error) {
+	if cgroupRoot == "" {
+		return nil, nil
+	}
+
+	accounting, err := loadAccounting()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(cgroupRoot, fmt.Sprint("juice-renderer-", id))
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		return nil, errors.Join(err, accounting.close())
+	}
+	accounting.path = path
+
+	accounting.cgroup, err = os.Open(path)
+	if err != nil {
+		return nil, errors.Join(err, accounting.close())
+	}
+
+	for index, attach := range []ebpf.AttachType{ebpf.AttachCGroupInetEgress, ebpf.AttachCGroupInetIngress} {
+		attached, err := link.AttachCgroup(link.CgroupOptions{
+			Path:    path,
+			Attach:  attach,
+			Program: accounting.programs[index],
+		})
+		if err != nil {
+			return nil, errors.Join(err, accounting.close())
+		}
+
+		accounting.links = append(accounting.links, attached)
+	}
+
+	return accounting, nil
+}
+
+// Starts cmd in the renderer's cgroup, safe to call on nil
+func (accounting *cgroupAccounting) prepare(cmd *exec.Cmd) {
+	if accounting == nil {
+		return
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(accounting.cgroup.Fd())
+}
+
+func sumCounters(counters *ebpf.Map, counter uint32) (cgroupCounter, error) {
+	var perCpu []cgroupCounter
+	err := counters.Lookup(counter, &perCpu)
+	if err != nil {
+		return cgroupCounter{}, err
+	}
+
+	var total cgroupCounter
+	for _, value := range perCpu {
+		total.Bytes += value.Bytes
+		total.Packets += value.Packets
+	}
+
+	return total, nil
+}
+
+// Returns the renderer's traffic counted so far, safe to call on nil
+func (accounting *cgroupAccounting) read() (networkCounters, error) {
+	if accounting == nil {
+		return networkCounters{}, nil
+	}
+
+	egress, err := sumCounters(accounting.counters, egressCounter)
+	if err != nil {
+		return networkCounters{}, err
+	}
+
+	ingress, err := sumCounters(accounting.counters, ingressCounter)
+	if err != nil {
+		return networkCounters{}, err
+	}
+
+	return networkCounters{
+		bytesSent:       egress.Bytes,
+		bytesReceived:   ingress.Bytes,
+		packetsSent:     egress.Packets,
+		packetsReceived: ingress.Packets,
+	}, nil
+}
+
+// Detaches the programs and removes the cgroup, which fails while the renderer is running. Safe to call on nil.
+func (accounting *cgroupAccounting) close() error {
+	if accounting == nil {
+		return nil
+	}
+
+	var err error
+	for _, attached := range accounting.links {
+		err = errors.Join(err, attached.Close())
+	}
+
+	for _, program := range accounting.programs {
+		err = errors.Join(err, program.Close())
+	}
+
+	err = errors.Join(err, accounting.counters.Close())
+
+	if accounting.cgroup != nil {
+		err = errors.Join(err, accounting.cgroup.Close())
+	}
+
+	if accounting.path != "" {
+		err = errors.Join(err, os.Remove(accounting.path))
+	}
+
+	return err
+}
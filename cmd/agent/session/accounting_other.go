@@ -0,0 +1,37 @@
+//go:build !linux
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package session
+
+import (
+	"os/exec"
+)
+
+// eBPF network accounting is only available on Linux
+type cgroupAccounting struct{}
+
+func InitializeNetworkAccounting() error {
+	return nil
+}
+
+func NetworkAccountingEnabled() bool {
+	return false
+}
+
+func newCgroupAccounting(id string) (*cgroupAccounting, error) {
+	return nil, nil
+}
+
+func (accounting *cgroupAccounting) prepare(cmd *exec.Cmd) {
+}
+
+func (accounting *cgroupAccounting) read() (networkCounters, error) {
+	return networkCounters{}, nil
+}
+
+func (accounting *cgroupAccounting) close() error {
+	return nil
+}
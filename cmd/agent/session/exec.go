@@ -0,0 +1,59 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Returns the command running the program at path in the session's environment: the renderer's
+// environment variables and the session's scratch directory, when it has one, as its working
+// directory. restapi.ExecRendererPidPlaceholder in args is replaced by the renderer's process id.
+func (session *Session) Command(ctx context.Context, path string, args []string) (*exec.Cmd, error) {
+	session.mutex.Lock()
+	renderer := session.renderer
+	metricsPort := session.metricsPort
+	session.mutex.Unlock()
+
+	env := os.Environ()
+	pid := 0
+	if renderer != nil && !renderer.Exited() {
+		env = renderer.Environ()
+		pid = renderer.Pid()
+	}
+
+	replaced := make([]string, len(args))
+	for index, arg := range args {
+		if strings.Contains(arg, restapi.ExecRendererPidPlaceholder) {
+			if pid == 0 {
+				return nil, pkgerrors.Errorf(pkgerrors.ErrConflict, "session %s has no running renderer to replace %s with", session.id, restapi.ExecRendererPidPlaceholder)
+			}
+
+			arg = strings.ReplaceAll(arg, restapi.ExecRendererPidPlaceholder, strconv.Itoa(pid))
+		}
+
+		replaced[index] = arg
+	}
+
+	cmd := exec.CommandContext(ctx, path, replaced...)
+	cmd.Env = append(env, fmt.Sprint("JUICE_SESSION_ID=", session.id))
+	if metricsPort != 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprint("JUICE_SESSION_METRICS_PORT=", metricsPort))
+	}
+
+	cmd.Dir = session.juicePath
+	if info, err := os.Stat(session.FilesPath()); err == nil && info.IsDir() {
+		cmd.Dir = session.FilesPath()
+	}
+
+	return cmd, nil
+}
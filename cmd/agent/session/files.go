@@ -0,0 +1,280 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Directory holding the files pushed by the session's client and those left for it to pull,
+// removed when the session closes
+func (session *Session) FilesPath() string {
+	return filepath.Join(session.juicePath, "sessions", session.id)
+}
+
+// Files are kept directly in the scratch directory, names must not reach outside of it
+func validFileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) || filepath.Base(name) != name {
+		return fmt.Errorf("invalid file name '%s', file names must not contain a path", name)
+	}
+
+	return nil
+}
+
+// Restricts the files moved through the session's scratch directory, see restapi.DataChannelPolicy
+func (session *Session) SetDataChannelPolicy(policy restapi.DataChannelPolicy) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.dataChannel = policy
+}
+
+func (session *Session) dataChannelPolicy() restapi.DataChannelPolicy {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.dataChannel
+}
+
+func hasExtension(extensions []string, extension string) bool {
+	for _, candidate := range extensions {
+		candidate = strings.ToLower(candidate)
+		if !strings.HasPrefix(candidate, ".") {
+			candidate = "." + candidate
+		}
+
+		if candidate == extension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a pkgerrors.ErrForbidden error when the data channel policy refuses moving the named file in
+// the direction, see restapi.DataChannel*
+func (session *Session) allowTransfer(direction string, name string) error {
+	policy := session.dataChannelPolicy()
+
+	if policy.Disabled {
+		return pkgerrors.Errorf(pkgerrors.ErrForbidden, "the files of session %s are disabled by its tenant's policy", session.id)
+	}
+
+	if len(policy.Directions) > 0 {
+		allowed := false
+		for _, candidate := range policy.Directions {
+			allowed = allowed || candidate == direction
+		}
+
+		if !allowed {
+			return pkgerrors.Errorf(pkgerrors.ErrForbidden, "session %s does not allow files to be %sed by its tenant's policy", session.id, direction)
+		}
+	}
+
+	extension := strings.ToLower(filepath.Ext(name))
+	if hasExtension(policy.DeniedExtensions, extension) ||
+		(len(policy.AllowedExtensions) > 0 && !hasExtension(policy.AllowedExtensions, extension)) {
+		return pkgerrors.Errorf(pkgerrors.ErrForbidden, "session %s does not allow %s files by its tenant's policy", session.id, name)
+	}
+
+	return nil
+}
+
+func sessionFile(info fs.FileInfo) restapi.SessionFile {
+	return restapi.SessionFile{
+		Name:       info.Name(),
+		Size:       info.Size(),
+		ModifiedAt: info.ModTime().UTC(),
+	}
+}
+
+// Returns the files in the scratch directory ordered by name
+func (session *Session) Files() ([]restapi.SessionFile, error) {
+	if session.dataChannelPolicy().Disabled {
+		return nil, pkgerrors.Errorf(pkgerrors.ErrForbidden, "the files of session %s are disabled by its tenant's policy", session.id)
+	}
+
+	session.filesMutex.Lock()
+	defer session.filesMutex.Unlock()
+
+	return session.files()
+}
+
+func (session *Session) files() ([]restapi.SessionFile, error) {
+	entries, err := os.ReadDir(session.FilesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []restapi.SessionFile{}, nil
+		}
+
+		return nil, err
+	}
+
+	files := make([]restapi.SessionFile, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, sessionFile(info))
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	return files, nil
+}
+
+// Writes content to the named file in the scratch directory, replacing any file with the name once
+// content is fully written. Files larger than maxFileSize or the data channel policy's transfer size,
+// or pushing the directory past maxTotalSize, are rejected with pkgerrors.ErrTooLarge.
+func (session *Session) PutFile(name string, content io.Reader, maxFileSize int64, maxTotalSize int64) (restapi.SessionFile, error) {
+	err := validFileName(name)
+	if err == nil {
+		err = session.allowTransfer(restapi.DataChannelPush, name)
+	}
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+
+	if policy := session.dataChannelPolicy(); policy.MaxTransferSize > 0 && policy.MaxTransferSize < maxFileSize {
+		maxFileSize = policy.MaxTransferSize
+	}
+
+	// Uploads take as long as the client takes to send them, the files are only locked to check
+	// the space available before and after the upload and to move it into place, so uploads do not
+	// hold up one another or the session
+	session.filesMutex.Lock()
+	limit, err := session.availableSpace(name, maxFileSize, maxTotalSize)
+	session.filesMutex.Unlock()
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+
+	// Written beside the scratch directory so partial uploads are not listed
+	temp, err := os.CreateTemp(filepath.Dir(session.FilesPath()), fmt.Sprint(session.id, ".upload-*"))
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+	defer os.Remove(temp.Name())
+
+	// Read one byte past the limit to tell files at the limit from those over it
+	written, err := io.Copy(temp, io.LimitReader(content, limit+1))
+	err = errors.Join(err, temp.Close())
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+
+	session.filesMutex.Lock()
+	defer session.filesMutex.Unlock()
+
+	// The files pushed while this one was uploaded count against the directory
+	limit, err = session.availableSpace(name, maxFileSize, maxTotalSize)
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+
+	if written > limit {
+		return restapi.SessionFile{}, pkgerrors.Errorf(pkgerrors.ErrTooLarge,
+			"file %s exceeds the %d bytes available to session %s, files are limited to %d bytes and %d bytes in total", name, limit, session.id, maxFileSize, maxTotalSize)
+	}
+
+	path := filepath.Join(session.FilesPath(), name)
+	err = os.Rename(temp.Name(), path)
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return restapi.SessionFile{}, err
+	}
+
+	return sessionFile(info), nil
+}
+
+// Returns the bytes the named file may hold, creating the scratch directory for it. Must be called
+// with filesMutex held.
+func (session *Session) availableSpace(name string, maxFileSize int64, maxTotalSize int64) (int64, error) {
+	if session.filesRemoved {
+		return 0, pkgerrors.Errorf(pkgerrors.ErrNotFound, "session %s is closed", session.id)
+	}
+
+	files, err := session.files()
+	if err != nil {
+		return 0, err
+	}
+
+	// The file being replaced does not count against the directory
+	var used int64
+	for _, file := range files {
+		if file.Name != name {
+			used += file.Size
+		}
+	}
+
+	limit := maxFileSize
+	if maxTotalSize-used < limit {
+		limit = maxTotalSize - used
+	}
+
+	return limit, os.MkdirAll(session.FilesPath(), fs.ModeDir|fs.ModePerm)
+}
+
+// Opens the named file in the scratch directory for reading, the caller closes it. Files larger than
+// the data channel policy's transfer size are rejected with pkgerrors.ErrTooLarge.
+func (session *Session) OpenFile(name string) (*os.File, error) {
+	err := validFileName(name)
+	if err == nil {
+		err = session.allowTransfer(restapi.DataChannelPull, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(session.FilesPath(), name))
+	if os.IsNotExist(err) {
+		return nil, pkgerrors.Errorf(pkgerrors.ErrNotFound, "session %s has no file %s", session.Id(), name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if maxSize := session.dataChannelPolicy().MaxTransferSize; maxSize > 0 {
+		info, err := file.Stat()
+		if err == nil && info.Size() > maxSize {
+			err = pkgerrors.Errorf(pkgerrors.ErrTooLarge, "file %s exceeds the %d bytes session %s allows to be pulled by its tenant's policy", name, maxSize, session.Id())
+		}
+		if err != nil {
+			return nil, errors.Join(err, file.Close())
+		}
+	}
+
+	return file, nil
+}
+
+// Uploads in progress are rejected once written, as are files pushed afterwards
+func (session *Session) removeFiles() error {
+	session.filesMutex.Lock()
+	defer session.filesMutex.Unlock()
+
+	session.filesRemoved = true
+
+	return os.RemoveAll(session.FilesPath())
+}
@@ -0,0 +1,48 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Closes the session once its client has neither used the GPU nor sent or received data for
+// timeout, 0 never closes it. The agent reclaims idle sessions, see Reclaim.
+func (session *Session) SetIdleTimeout(timeout time.Duration) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.idleTimeout = timeout
+}
+
+func (session *Session) IdleTimeout() time.Duration {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.idleTimeout
+}
+
+// Records that the session's renderer did work on the GPU for its client. Network traffic is
+// recorded as the session's connections are sampled, see SampleNetwork.
+func (session *Session) MarkActive() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.lastActive = time.Now()
+}
+
+// Returns how long the session's client has been inactive
+func (session *Session) IdleFor() time.Duration {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return time.Since(session.lastActive)
+}
+
+// Cancels the session idle for its idle timeout, closing it with restapi.ExitStatusIdle
+func (session *Session) Reclaim() error {
+	return session.cancel(restapi.ExitStatusIdle)
+}
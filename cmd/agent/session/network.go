@@ -0,0 +1,184 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+type tcpStats struct {
+	bytesSent     uint64
+	bytesReceived uint64
+	rtt           uint32
+	retransmits   uint32
+	// Times a connection over QUIC moved to a new network path
+	resumes     uint32
+	established bool
+}
+
+// A client connection whose statistics are sampled
+type sampledConnection interface {
+	stats() (tcpStats, error)
+	close()
+}
+
+// Totals counted for the renderer by eBPF network accounting
+type networkCounters struct {
+	bytesSent       uint64
+	bytesReceived   uint64
+	packetsSent     uint64
+	packetsReceived uint64
+}
+
+type networkSample struct {
+	time time.Time
+
+	bytesSent       uint64
+	bytesReceived   uint64
+	packetsSent     uint64
+	packetsReceived uint64
+	rtt             uint32
+}
+
+// Tracks the client connections forwarded to the renderer, the agent keeps a
+// duplicate of each socket to read its statistics until the connection closes
+type networkSampler struct {
+	connections []sampledConnection
+	// Of the latest connection, see restapi.Transport*
+	transport string
+
+	// Totals of connections that have since closed
+	closedBytesSent     uint64
+	closedBytesReceived uint64
+	closedRetransmits   uint32
+	closedResumes       uint32
+
+	samples []networkSample
+	summary *restapi.NetworkMetrics
+}
+
+// The renderer's counters are added to the client connections', the forwarded connections are
+// sockets of the agent, outside of the renderer's cgroup, so are not counted twice
+func (sampler *networkSampler) sample(now time.Time, window time.Duration, counters networkCounters) {
+	if len(sampler.connections) == 0 && len(sampler.samples) == 0 && counters == (networkCounters{}) {
+		return
+	}
+
+	current := networkSample{
+		time:            now,
+		bytesSent:       sampler.closedBytesSent + counters.bytesSent,
+		bytesReceived:   sampler.closedBytesReceived + counters.bytesReceived,
+		packetsSent:     counters.packetsSent,
+		packetsReceived: counters.packetsReceived,
+	}
+	retransmits := sampler.closedRetransmits
+	resumes := sampler.closedResumes
+
+	connections := sampler.connections[:0]
+	for _, connection := range sampler.connections {
+		stats, err := connection.stats()
+		if err != nil {
+			logger.Debugf("unable to read connection statistics, %s", err)
+		}
+
+		if err != nil || !stats.established {
+			sampler.closedBytesSent += stats.bytesSent
+			sampler.closedBytesReceived += stats.bytesReceived
+			sampler.closedRetransmits += stats.retransmits
+			sampler.closedResumes += stats.resumes
+			connection.close()
+		} else {
+			connections = append(connections, connection)
+		}
+
+		current.bytesSent += stats.bytesSent
+		current.bytesReceived += stats.bytesReceived
+		retransmits += stats.retransmits
+		resumes += stats.resumes
+		if stats.rtt > current.rtt {
+			current.rtt = stats.rtt
+		}
+	}
+	sampler.connections = connections
+
+	sampler.samples = append(sampler.samples, current)
+	for len(sampler.samples) > 1 && now.Sub(sampler.samples[0].time) > window {
+		sampler.samples = sampler.samples[1:]
+	}
+
+	summary := &restapi.NetworkMetrics{
+		BytesSent:       current.bytesSent,
+		BytesReceived:   current.bytesReceived,
+		Retransmits:     retransmits,
+		PacketsSent:     current.packetsSent,
+		PacketsReceived: current.packetsReceived,
+		Transport:       sampler.transport,
+		Resumes:         resumes,
+	}
+
+	var rttTotal uint64
+	for _, sample := range sampler.samples {
+		rttTotal += uint64(sample.rtt)
+		if sample.rtt > summary.RttMax {
+			summary.RttMax = sample.rtt
+		}
+	}
+	summary.Rtt = uint32(rttTotal / uint64(len(sampler.samples)))
+
+	oldest := sampler.samples[0]
+	if elapsed := current.time.Sub(oldest.time).Seconds(); elapsed > 0 {
+		summary.SendRate = uint64(float64(current.bytesSent-oldest.bytesSent) / elapsed)
+		summary.ReceiveRate = uint64(float64(current.bytesReceived-oldest.bytesReceived) / elapsed)
+		summary.SendPacketRate = uint64(float64(current.packetsSent-oldest.packetsSent) / elapsed)
+		summary.ReceivePacketRate = uint64(float64(current.packetsReceived-oldest.packetsReceived) / elapsed)
+	}
+
+	sampler.summary = summary
+}
+
+func (sampler *networkSampler) close() {
+	for _, connection := range sampler.connections {
+		connection.close()
+	}
+
+	sampler.connections = nil
+}
+
+// Samples the statistics of the session's client connections, and the renderer's counters with
+// eBPF network accounting, summarizing the samples within window
+func (session *Session) SampleNetwork(window time.Duration) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	var counters networkCounters
+	if session.renderer != nil {
+		var err error
+		counters, err = session.renderer.accounting.read()
+		if err != nil {
+			logger.Debugf("unable to read the network counters of renderer %s, %s", session.renderer.Id(), err)
+		}
+	}
+
+	now := time.Now()
+	session.network.sample(now, window, counters)
+
+	if summary := session.network.summary; summary != nil {
+		traffic := summary.BytesSent + summary.BytesReceived
+		if traffic != session.lastTraffic {
+			session.lastTraffic = traffic
+			session.lastActive = now
+		}
+	}
+}
+
+// Returns the rolling summary of the session's client connections, nil before the first sample
+func (session *Session) NetworkMetrics() *restapi.NetworkMetrics {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.network.summary
+}
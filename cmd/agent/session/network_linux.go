@@ -0,0 +1,52 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+type connection struct {
+	file *os.File
+}
+
+func newConnection(rawConn syscall.RawConn) (*connection, error) {
+	var dupFd int
+	var dupErr error
+	err := rawConn.Control(func(fd uintptr) {
+		dupFd, dupErr = unix.Dup(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+
+	return &connection{
+		file: os.NewFile(uintptr(dupFd), "connection"),
+	}, nil
+}
+
+func (connection *connection) stats() (tcpStats, error) {
+	info, err := unix.GetsockoptTCPInfo(int(connection.file.Fd()), unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return tcpStats{}, err
+	}
+
+	return tcpStats{
+		bytesSent:     info.Bytes_acked,
+		bytesReceived: info.Bytes_received,
+		rtt:           info.Rtt,
+		retransmits:   info.Total_retrans,
+		established:   info.State == unix.BPF_TCP_ESTABLISHED,
+	}, nil
+}
+
+func (connection *connection) close() {
+	connection.file.Close()
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package session
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+type connection struct{}
+
+// Connection statistics are only collected on Linux
+func newConnection(rawConn syscall.RawConn) (*connection, error) {
+	return nil, fmt.Errorf("connection statistics are not supported on %s", runtime.GOOS)
+}
+
+func (connection *connection) stats() (tcpStats, error) {
+	return tcpStats{}, fmt.Errorf("connection statistics are not supported on %s", runtime.GOOS)
+}
+
+func (connection *connection) close() {}
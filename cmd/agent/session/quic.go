@@ -0,0 +1,70 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"net"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/transport"
+)
+
+// A client connection over QUIC, sampled from QUIC's statistics rather than those of the loopback
+// socket bridging it to the renderer
+type quicConnection struct {
+	conn *transport.Conn
+}
+
+func (connection quicConnection) stats() (tcpStats, error) {
+	stats := connection.conn.Stats()
+
+	return tcpStats{
+		bytesSent:     stats.BytesSent,
+		bytesReceived: stats.BytesReceived,
+		rtt:           uint32(stats.Rtt.Microseconds()),
+		retransmits:   uint32(stats.LostPackets),
+		resumes:       uint32(stats.Resumes),
+		established:   !stats.Finished,
+	}, nil
+}
+
+func (connection quicConnection) close() {}
+
+// Returns one end of a loopback TCP connection relayed to the client connection, as the renderer
+// only takes sockets. The traffic relayed is recorded by recorder unless it is nil.
+func bridge(conn net.Conn, recorder *Recorder) (*net.TCPConn, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	dialed, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		return nil, err
+	}
+
+	// Other local processes may connect to the listener first
+	err = listener.SetDeadline(time.Now().Add(5 * time.Second))
+	for err == nil {
+		var accepted *net.TCPConn
+		accepted, err = listener.AcceptTCP()
+		if err == nil {
+			if accepted.RemoteAddr().String() == dialed.LocalAddr().String() {
+				if recorder != nil {
+					go transport.Relay(recordedConn{conn, recorder, restapi.RecordingFromClient}, recordedConn{dialed, recorder, restapi.RecordingFromRenderer})
+				} else {
+					go transport.Relay(conn, dialed)
+				}
+				return accepted, nil
+			}
+
+			accepted.Close()
+		}
+	}
+
+	dialed.Close()
+	return nil, err
+}
@@ -0,0 +1,136 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/recording"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Records the traffic of a session's client connections, see restapi.SessionRequirements.Record.
+// Once the recording reaches its limits it ends and the session goes on unrecorded.
+type Recorder struct {
+	mutex sync.Mutex
+
+	id     string
+	file   *os.File
+	writer *recording.Writer
+
+	maxSize  int64
+	deadline time.Time
+
+	// Called once the recording ends with the reason and its size, see restapi.RecordingEnd*
+	onEnd func(reason string, size int64)
+	ended bool
+}
+
+// Creates the recording at path, which must not exist. maxSize and maxDuration of 0 are unlimited.
+func NewRecorder(id string, path string, key restapi.RecordingKey, maxSize int64, maxDuration time.Duration, onEnd func(reason string, size int64)) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := recording.NewWriter(file, key)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+
+	recorder := &Recorder{
+		id:      id,
+		file:    file,
+		writer:  writer,
+		maxSize: maxSize,
+		onEnd:   onEnd,
+	}
+
+	if maxDuration > 0 {
+		recorder.deadline = time.Now().Add(maxDuration)
+	}
+
+	return recorder, nil
+}
+
+func (recorder *Recorder) record(direction string, data []byte) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.ended {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case !recorder.deadline.IsZero() && now.After(recorder.deadline):
+		recorder.end(now, restapi.RecordingEndMaxDuration)
+
+	case recorder.maxSize > 0 && recorder.writer.Size()+recording.ChunkSize(len(data))+recording.ChunkSize(len(restapi.RecordingEndMaxSize)) > recorder.maxSize:
+		recorder.end(now, restapi.RecordingEndMaxSize)
+
+	default:
+		err := recorder.writer.Write(now, direction, data)
+		if err != nil {
+			logger.WithSession(recorder.id).Errorf("unable to record session %s, %v", recorder.id, err)
+			recorder.end(now, restapi.RecordingEndTruncated)
+		}
+	}
+}
+
+func (recorder *Recorder) end(now time.Time, reason string) {
+	recorder.ended = true
+
+	var err error
+	if reason != restapi.RecordingEndTruncated {
+		err = recorder.writer.End(now, reason)
+	}
+
+	err = errors.Join(err, recorder.file.Sync(), recorder.file.Close())
+	if err != nil {
+		logger.WithSession(recorder.id).Errorf("unable to finish the recording of session %s, %v", recorder.id, err)
+	}
+
+	recorder.onEnd(reason, recorder.writer.Size())
+}
+
+// Ends the recording unless it already ended
+func (recorder *Recorder) Close() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if !recorder.ended {
+		recorder.end(time.Now(), restapi.RecordingEndClosed)
+	}
+}
+
+// Records the data read from the connection as sent in direction
+type recordedConn struct {
+	net.Conn
+	recorder  *Recorder
+	direction string
+}
+
+func (conn recordedConn) Read(data []byte) (int, error) {
+	n, err := conn.Conn.Read(data)
+	if n > 0 {
+		conn.recorder.record(conn.direction, data[:n])
+	}
+
+	return n, err
+}
+
+// Lets transport.Relay close only the writing side of connections that support it
+func (conn recordedConn) CloseWrite() error {
+	if closer, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+
+	return conn.Conn.Close()
+}
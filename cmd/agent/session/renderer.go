@@ -0,0 +1,270 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+var (
+	mpsActiveThreadPercentage = flag.Int("mps-active-thread-percentage", 0, "Limits each renderer to this percent of a GPU's streaming multiprocessors when the GPUs are shared through CUDA MPS, such as 100 divided by --max-sessions-per-gpu, so no session can take a GPU from the others. 0 leaves renderers unlimited")
+)
+
+// A running Renderer_Win process and the pipes the agent forwards client connections through
+type Renderer struct {
+	id     string
+	pciBus string
+
+	cmd       *exec.Cmd
+	readPipe  *os.File
+	writePipe *os.File
+	logPath   string
+
+	// Nil without eBPF network accounting
+	accounting *cgroupAccounting
+
+	done chan struct{}
+
+	mutex   sync.Mutex
+	exitErr error
+	// Set once the process was asked to exit, see Terminate
+	terminating bool
+}
+
+// Starts Renderer_Win on the GPUs at pciBus, it is killed when ctx is done. The id identifies
+// the renderer in its log file name, it is the id of the session it is started for or, for
+// renderers started ahead of their session, an id of its own.
+func StartRenderer(ctx context.Context, juicePath string, id string, pciBus string, cpuFallbackIcd string) (*Renderer, error) {
+	renderer := &Renderer{
+		id:     id,
+		pciBus: pciBus,
+		done:   make(chan struct{}),
+	}
+
+	ch1Read, ch1Write, err := setupIpc()
+	if err != nil {
+		return nil, err
+	}
+	defer ch1Write.Close()
+
+	ch2Read, ch2Write, err := setupIpc()
+	if err != nil {
+		return nil, errors.Join(err, ch1Read.Close())
+	}
+	defer ch2Read.Close()
+
+	renderer.readPipe = ch1Read
+	renderer.writePipe = ch2Write
+
+	logsPath := filepath.Join(juicePath, "logs")
+	_, err = os.Stat(logsPath)
+	if err != nil && os.IsNotExist(err) {
+		err = os.MkdirAll(logsPath, fs.ModeDir|fs.ModePerm)
+		if err != nil {
+			logger.Errorf("unable to create directory %s, %s", logsPath, err.Error())
+		}
+	}
+
+	now := time.Now()
+
+	// NOTE: time.Format is really weird. The string below equates to YYYYMMDD-HHMMSS_
+	logName := fmt.Sprint(now.Format("20060102-150405_"), id, ".log")
+	renderer.logPath = filepath.Join(logsPath, logName)
+
+	renderer.cmd = exec.CommandContext(ctx,
+		filepath.Join(juicePath, "Renderer_Win"),
+		append(
+			[]string{
+				"--id", id,
+				"--log_file", renderer.logPath,
+				"--ipc_write", fmt.Sprint(ch1Write.Fd()),
+				"--ipc_read", fmt.Sprint(ch2Read.Fd()),
+				"--pcibus", pciBus,
+			},
+			flag.Args()[0:]...,
+		)...,
+	)
+
+	if cpuFallbackIcd != "" {
+		renderer.cmd.Env = append(os.Environ(),
+			fmt.Sprintf("VK_ICD_FILENAMES=%s", cpuFallbackIcd),
+			fmt.Sprintf("VK_DRIVER_FILES=%s", cpuFallbackIcd),
+		)
+	} else if *mpsActiveThreadPercentage > 0 {
+		renderer.cmd.Env = append(os.Environ(),
+			fmt.Sprintf("CUDA_MPS_ACTIVE_THREAD_PERCENTAGE=%d", *mpsActiveThreadPercentage),
+		)
+	}
+
+	inheritFiles(renderer.cmd, ch1Write, ch2Read)
+
+	renderer.accounting, err = newCgroupAccounting(id)
+	if err != nil {
+		logger.Warningf("unable to account the network traffic of renderer %s with eBPF, %s", id, err)
+	}
+	renderer.accounting.prepare(renderer.cmd)
+
+	err = renderer.cmd.Start()
+	if err != nil {
+		return nil, errors.Join(err, renderer.Close())
+	}
+
+	go func() {
+		err := renderer.cmd.Wait()
+
+		renderer.mutex.Lock()
+		renderer.exitErr = err
+		renderer.mutex.Unlock()
+
+		close(renderer.done)
+	}()
+
+	return renderer, nil
+}
+
+func (renderer *Renderer) Id() string {
+	return renderer.id
+}
+
+func (renderer *Renderer) PciBus() string {
+	return renderer.pciBus
+}
+
+func (renderer *Renderer) Pid() int {
+	return renderer.cmd.Process.Pid
+}
+
+// Returns at most the last maxBytes of the process's log, starting at a line, empty when it cannot be read
+func (renderer *Renderer) LogExcerpt(maxBytes int) string {
+	file, err := os.Open(renderer.logPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+
+	offset := info.Size() - int64(maxBytes)
+	if offset < 0 {
+		offset = 0
+	}
+
+	excerpt := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(excerpt, offset)
+	if err != nil && err != io.EOF {
+		return ""
+	}
+
+	// Drop the partial line the excerpt starts in
+	if offset > 0 {
+		if index := bytes.IndexByte(excerpt, '\n'); index >= 0 {
+			excerpt = excerpt[index+1:]
+		}
+	}
+
+	return string(excerpt)
+}
+
+// Returns the environment variables the process was started with
+func (renderer *Renderer) Environ() []string {
+	if renderer.cmd.Env == nil {
+		return os.Environ()
+	}
+
+	return append([]string{}, renderer.cmd.Env...)
+}
+
+// Returns whether the process has exited
+func (renderer *Renderer) Exited() bool {
+	select {
+	case <-renderer.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for the process to exit, returning how it exited
+func (renderer *Renderer) Wait() error {
+	<-renderer.done
+
+	renderer.mutex.Lock()
+	defer renderer.mutex.Unlock()
+
+	return renderer.exitErr
+}
+
+func (renderer *Renderer) Cancel() error {
+	if renderer.Exited() {
+		return nil
+	}
+
+	return renderer.cmd.Cancel()
+}
+
+// Asks the process to exit, killing it when it has not exited after grace. Processes that cannot
+// be asked, such as on Windows, are killed immediately. Processes already asked are left to exit.
+func (renderer *Renderer) Terminate(grace time.Duration) error {
+	if renderer.Exited() {
+		return nil
+	}
+
+	renderer.mutex.Lock()
+	terminating := renderer.terminating
+	renderer.terminating = true
+	renderer.mutex.Unlock()
+
+	if terminating {
+		return nil
+	}
+
+	if grace <= 0 || renderer.cmd.Process.Signal(syscall.SIGTERM) != nil {
+		return renderer.Cancel()
+	}
+
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+
+		select {
+		case <-renderer.done:
+		case <-timer.C:
+			logger.Warningf("renderer %s did not exit within %s, killing it", renderer.id, grace)
+
+			err := renderer.Cancel()
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Closes the agent's ends of the pipes and the renderer's network accounting, the process is
+// stopped with Cancel
+func (renderer *Renderer) Close() error {
+	return errors.Join(
+		renderer.readPipe.Close(),
+		renderer.writePipe.Close(),
+		renderer.accounting.close(),
+	)
+}
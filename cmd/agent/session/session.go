@@ -6,13 +6,8 @@ package session
 import (
 	"crypto/tls"
 	"errors"
-	"flag"
 	"fmt"
-	"io/fs"
 	"net"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"sync"
 	"time"
 
@@ -20,11 +15,12 @@ import (
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/transport"
 	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
 )
 
 type EventListener interface {
-	SessionStateChanged(id string, state string)
+	SessionStateChanged(id string, state string, exitStatus string)
 }
 
 type Session struct {
@@ -33,17 +29,45 @@ type Session struct {
 	id        string
 	juicePath string
 	version   string
+	tenant    string
 
 	state      string
 	exitStatus string
 
 	gpus *gpu.SelectedGpuSet
 
-	cmd       *exec.Cmd
-	readPipe  *os.File
-	writePipe *os.File
+	// Path to the Vulkan ICD used for CPU rendering, empty when using GPUs
+	cpuFallbackIcd string
+
+	renderer *Renderer
+	// Cleared once the renderer exits
+	running bool
+
+	network networkSampler
+	// Reported by the client of sessions requested directly from the agent
+	frames *restapi.FrameMetrics
+	// Last agreed with the client, see SetStream
+	stream *restapi.StreamParameters
 
 	eventListener EventListener
+
+	// Guards the scratch directory, see FilesPath
+	filesMutex   sync.Mutex
+	filesRemoved bool
+	// Set by the controller from the policy of the session's tenant
+	dataChannel restapi.DataChannelPolicy
+
+	// See SetIdleTimeout, the client was last active at lastActive
+	idleTimeout time.Duration
+	lastActive  time.Time
+	// Bytes sent and received by the client as of the last network sample
+	lastTraffic uint64
+
+	// See SetMetricsPort
+	metricsPort int
+
+	// Nil unless the session is recorded, see SetRecorder
+	recorder *Recorder
 }
 
 func New(id string, juicePath string, version string, gpus *gpu.SelectedGpuSet, eventListener EventListener) *Session {
@@ -55,6 +79,7 @@ func New(id string, juicePath string, version string, gpus *gpu.SelectedGpuSet,
 		exitStatus:    restapi.ExitStatusUnknown,
 		gpus:          gpus,
 		eventListener: eventListener,
+		lastActive:    time.Now(),
 	}
 }
 
@@ -65,19 +90,103 @@ func (session *Session) Id() string {
 	return session.id
 }
 
+func (session *Session) UseCpuFallback(icdPath string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.cpuFallbackIcd = icdPath
+}
+
+func (session *Session) SetTenant(tenant string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.tenant = tenant
+}
+
+func (session *Session) Tenant() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.tenant
+}
+
+func (session *Session) CpuFallback() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.cpuFallbackIcd != ""
+}
+
 func (session *Session) Session() restapi.Session {
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
 	return restapi.Session{
-		Id:         session.id,
-		State:      session.state,
-		ExitStatus: session.exitStatus,
-		Version:    session.version,
-		Gpus:       session.gpus.GetGpus(),
+		Id:          session.id,
+		State:       session.state,
+		ExitStatus:  session.exitStatus,
+		Version:     session.version,
+		Gpus:        session.gpus.GetGpus(),
+		CpuFallback: session.cpuFallbackIcd != "",
+		Tenant:      session.tenant,
+		Network:     session.network.summary,
+		Frames:      session.frames,
+		Stream:      session.stream,
+
+		IdleTimeoutSeconds: int(session.idleTimeout.Seconds()),
+		MetricsPort:        session.metricsPort,
+		Record:             session.recorder != nil,
 	}
 }
 
+// Sets the port on the loopback interface the session's workload serves Prometheus metrics on,
+// 0 when it serves none, see restapi.SessionRequirements.MetricsPort
+func (session *Session) SetMetricsPort(port int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.metricsPort = port
+}
+
+// Records the traffic of the client connections made from now on, the recording ends when the
+// session closes
+func (session *Session) SetRecorder(recorder *Recorder) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.recorder = recorder
+}
+
+func (session *Session) MetricsPort() int {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.metricsPort
+}
+
+func (session *Session) SetFrames(frames restapi.FrameMetrics) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.frames = &frames
+}
+
+func (session *Session) SetStream(stream restapi.StreamParameters) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.stream = &stream
+}
+
+// Marks the session as failed, used when the session fails before it is started
+func (session *Session) Fail() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.setExitStatus(restapi.ExitStatusFailure)
+}
+
 func (session *Session) setExitStatus(exitStatus string) {
 	if session.exitStatus == restapi.ExitStatusUnknown {
 		session.exitStatus = exitStatus
@@ -85,114 +194,151 @@ func (session *Session) setExitStatus(exitStatus string) {
 }
 
 func (session *Session) changeState(newState string) {
-	session.eventListener.SessionStateChanged(session.id, newState)
+	session.eventListener.SessionStateChanged(session.id, newState, session.exitStatus)
 	session.state = newState
 }
 
 func (session *Session) Close() error {
+	// Outside of the session's mutex, uploads in progress are waited for
+	err := session.removeFiles()
+
+	return errors.Join(err, session.close())
+}
+
+func (session *Session) close() error {
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
-	session.cmd = nil
+	session.running = false
 
-	err := errors.Join(
-		session.readPipe.Close(),
-		session.writePipe.Close(),
-	)
+	var err error
+	if session.renderer != nil {
+		err = session.renderer.Close()
+	}
 
 	session.gpus.Release()
 	session.gpus = nil
 
+	session.network.close()
+
+	if session.recorder != nil {
+		session.recorder.Close()
+	}
+
 	session.changeState(restapi.SessionClosed)
 
 	return err
 }
 
-func (session *Session) Start(group task.Group) error {
+// Returns at most the last maxBytes of the log of the session's renderer, empty before it started
+func (session *Session) LogExcerpt(maxBytes int) string {
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
-	ch1Read, ch1Write, err := setupIpc()
-	if err == nil {
-		session.readPipe = ch1Read
-		defer ch1Write.Close()
+	if session.renderer == nil || maxBytes <= 0 {
+		return ""
+	}
 
-		ch2Read, ch2Write, err_ := setupIpc()
-		err = err_
-		if err == nil {
-			session.writePipe = ch2Write
-			defer ch2Read.Close()
-
-			logsPath := filepath.Join(session.juicePath, "logs")
-			_, err_ = os.Stat(logsPath)
-			if err_ != nil && os.IsNotExist(err_) {
-				err_ = os.MkdirAll(logsPath, fs.ModeDir|fs.ModePerm)
-				if err_ != nil {
-					logger.Errorf("unable to create directory %s, %s", logsPath, err_.Error())
-				}
-			}
+	return session.renderer.LogExcerpt(maxBytes)
+}
 
-			now := time.Now()
+// Returns the process id of the session's renderer, which may have exited, 0 before it started
+func (session *Session) RendererPid() int {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
 
-			// NOTE: time.Format is really weird. The string below equates to YYYYMMDD-HHMMSS_
-			logName := fmt.Sprint(now.Format("20060102-150405_"), session.id, ".log")
+	if session.renderer == nil {
+		return 0
+	}
 
-			if err == nil {
-				session.cmd = exec.CommandContext(group.Ctx(),
-					filepath.Join(session.juicePath, "Renderer_Win"),
-					append(
-						[]string{
-							"--id", session.id,
-							"--log_file", filepath.Join(logsPath, logName),
-							"--ipc_write", fmt.Sprint(ch1Write.Fd()),
-							"--ipc_read", fmt.Sprint(ch2Read.Fd()),
-							"--pcibus", session.gpus.GetPciBusString(),
-						},
-						flag.Args()[0:]...,
-					)...,
-				)
-
-				inheritFiles(session.cmd, ch1Write, ch2Read)
-
-				err = session.cmd.Start()
-
-				session.changeState(restapi.SessionActive)
-			}
-		}
+	return session.renderer.Pid()
+}
+
+// Suspends or resumes the session's renderer, throttling a session using more than its share of
+// a GPU. Renderers that are not running are left as they are.
+func (session *Session) SuspendRenderer(suspend bool) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.renderer == nil || !session.running || session.renderer.Exited() {
+		return nil
+	}
+
+	return suspendProcess(session.renderer.Pid(), suspend)
+}
+
+// Starts the session on a renderer already started for it rather than starting one
+func (session *Session) UseRenderer(renderer *Renderer) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.renderer = renderer
+}
+
+func (session *Session) Start(group task.Group) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	var err error
+	if session.renderer == nil {
+		session.renderer, err = StartRenderer(group.Ctx(), session.juicePath, session.id, session.gpus.GetPciBusString(), session.cpuFallbackIcd)
+	} else if session.renderer.Exited() {
+		err = fmt.Errorf("renderer %s exited before the session started", session.renderer.Id())
 	}
 
 	if err != nil {
-		err = fmt.Errorf("Session: failed to start Renderer_Win with %s", err)
 		session.setExitStatus(restapi.ExitStatusFailure)
+		return fmt.Errorf("Session: failed to start Renderer_Win with %s", err)
 	}
 
-	return err
+	session.running = true
+	session.lastActive = time.Now()
+	session.changeState(restapi.SessionActive)
+
+	return nil
 }
 
 func (session *Session) Wait() error {
-	err := session.cmd.Wait()
+	err := session.renderer.Wait()
 
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("Session: session %s failed with %s", session.id, err))
+		logger.WithSession(session.id).Errorf("Session: session %s failed with %s", session.id, err)
 		session.setExitStatus(restapi.ExitStatusFailure)
 	} else {
 		session.setExitStatus(restapi.ExitStatusSuccess)
 	}
 
-	session.cmd = nil
+	session.running = false
 	return nil
 }
 
 func (session *Session) Cancel() error {
+	return session.cancel(restapi.ExitStatusCanceled)
+}
+
+// Asks the renderer to exit, killing it when it has not exited after grace, see Renderer.Terminate
+func (session *Session) Preempt(grace time.Duration) error {
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
-	if session.cmd != nil {
+	if session.running {
 		session.setExitStatus(restapi.ExitStatusCanceled)
-		return session.cmd.Cancel()
+		return session.renderer.Terminate(grace)
+	}
+
+	return nil
+}
+
+func (session *Session) cancel(exitStatus string) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.running {
+		session.setExitStatus(exitStatus)
+		return session.renderer.Cancel()
 	}
 
 	return nil
@@ -202,10 +348,37 @@ func (session *Session) Connect(c net.Conn) error {
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
 
+	session.lastActive = time.Now()
+
+	// Connections over QUIC are bridged to the renderer, which only takes sockets
+	var tracked sampledConnection
+	session.network.transport = restapi.TransportTcp
+	if quicConn, ok := c.(*transport.Conn); ok && session.running {
+		forwarded, err := bridge(quicConn, session.recorder)
+		if err != nil {
+			c.Close()
+			return err
+		}
+
+		c = forwarded
+		tracked = quicConnection{quicConn}
+		session.network.transport = restapi.TransportQuic
+	} else if session.recorder != nil && session.running {
+		// Recorded connections are relayed by the agent rather than handed to the renderer, so
+		// the agent sees their traffic
+		forwarded, err := bridge(c, session.recorder)
+		if err != nil {
+			c.Close()
+			return err
+		}
+
+		c = forwarded
+	}
+
 	defer c.Close()
 
 	var err error
-	if session.cmd != nil {
+	if session.running {
 		tcpConn := &net.TCPConn{}
 		tlsConn, err_ := utilities.Cast[*tls.Conn](c)
 		err = err_
@@ -219,17 +392,31 @@ func (session *Session) Connect(c net.Conn) error {
 			rawConn, err_ := tcpConn.SyscallConn()
 			err = err_
 			if err == nil {
+				if tracked == nil {
+					// Keep a duplicate of the socket to measure the connection once it is forwarded
+					connection, err_ := newConnection(rawConn)
+					if err_ == nil {
+						tracked = connection
+					} else {
+						logger.Debugf("Session: unable to track connection statistics, %s", err_)
+					}
+				}
+
+				if tracked != nil {
+					session.network.connections = append(session.network.connections, tracked)
+				}
+
 				err = session.forwardSocket(rawConn)
 				if err == nil {
 					// Wait for the server to indicate it has created the socket
 					data := make([]byte, 1)
-					_, err = session.readPipe.Read(data)
+					_, err = session.renderer.readPipe.Read(data)
 
 					// Close our socket handle
 					err = errors.Join(err, c.Close())
 
 					// And finally, inform the server that our side is closed
-					_, err_ := session.writePipe.Write(data)
+					_, err_ := session.renderer.writePipe.Write(data)
 					err = errors.Join(err, err_)
 				}
 			}
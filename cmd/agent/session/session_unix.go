@@ -1,6 +1,9 @@
+//go:build !windows
+
 /*
  *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
  */
+
 package session
 
 import (
@@ -37,6 +40,16 @@ func (session *Session) forwardSocket(rawConn syscall.RawConn) error {
 		return err
 	}
 
-	_, err = unix.SendmsgN(int(session.writePipe.Fd()), nil, rights, nil, 0)
+	_, err = unix.SendmsgN(int(session.renderer.writePipe.Fd()), nil, rights, nil, 0)
 	return err
 }
+
+// Stops or continues the process, see Session.SuspendRenderer
+func suspendProcess(pid int, suspend bool) error {
+	signal := syscall.SIGCONT
+	if suspend {
+		signal = syscall.SIGSTOP
+	}
+
+	return syscall.Kill(pid, signal)
+}
@@ -35,7 +35,7 @@ func (session *Session) forwardSocket(rawConn syscall.RawConn) error {
 	fd := syscall.Handle(pfd.FieldByName("Sysfd").Uint())
 
 	var protocolInfo syscall.WSAProtocolInfo
-	err := windows.WSADuplicateSocketW(fd, uint32(session.cmd.Process.Pid), &protocolInfo)
+	err := windows.WSADuplicateSocketW(fd, uint32(session.renderer.cmd.Process.Pid), &protocolInfo)
 	if err != nil {
 		return err
 	}
@@ -73,10 +73,28 @@ func (session *Session) forwardSocket(rawConn syscall.RawConn) error {
 		binary.Write(buffer, binary.LittleEndian, protocolInfo.ProtocolName[i])
 	}
 
-	_, err = session.writePipe.Write(buffer.Bytes())
+	_, err = session.renderer.writePipe.Write(buffer.Bytes())
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Access right needed to suspend and resume a process
+const processSuspendResume = 0x0800
+
+// Suspends or resumes every thread of the process, see Session.SuspendRenderer
+func suspendProcess(pid int, suspend bool) error {
+	process, err := syscall.OpenProcess(processSuspendResume, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(process)
+
+	if suspend {
+		return windows.NtSuspendProcess(process)
+	}
+
+	return windows.NtResumeProcess(process)
+}
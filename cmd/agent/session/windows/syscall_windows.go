@@ -8,3 +8,5 @@ package windows
 const socket_error = uintptr(^uint32(0))
 
 //sys	WSADuplicateSocketW(s Handle, processId uint32, protocolBuffer *WSAProtocolInfo) (err error) [failretval==socket_error] = ws2_32.WSADuplicateSocketW
+//sys	NtSuspendProcess(process Handle) (ntstatus error) = ntdll.NtSuspendProcess
+//sys	NtResumeProcess(process Handle) (ntstatus error) = ntdll.NtResumeProcess
@@ -38,11 +38,30 @@ func errnoErr(e syscall.Errno) error {
 }
 
 var (
+	modntdll  = windows.NewLazySystemDLL("ntdll.dll")
 	modws2_32 = windows.NewLazySystemDLL("ws2_32.dll")
 
+	procNtResumeProcess     = modntdll.NewProc("NtResumeProcess")
+	procNtSuspendProcess    = modntdll.NewProc("NtSuspendProcess")
 	procWSADuplicateSocketW = modws2_32.NewProc("WSADuplicateSocketW")
 )
 
+func NtResumeProcess(process syscall.Handle) (ntstatus error) {
+	r0, _, _ := syscall.Syscall(procNtResumeProcess.Addr(), 1, uintptr(process), 0, 0)
+	if r0 != 0 {
+		ntstatus = windows.NTStatus(r0)
+	}
+	return
+}
+
+func NtSuspendProcess(process syscall.Handle) (ntstatus error) {
+	r0, _, _ := syscall.Syscall(procNtSuspendProcess.Addr(), 1, uintptr(process), 0, 0)
+	if r0 != 0 {
+		ntstatus = windows.NTStatus(r0)
+	}
+	return
+}
+
 func WSADuplicateSocketW(s syscall.Handle, processId uint32, protocolBuffer *syscall.WSAProtocolInfo) (err error) {
 	r1, _, e1 := syscall.Syscall(procWSADuplicateSocketW.Addr(), 3, uintptr(s), uintptr(processId), uintptr(unsafe.Pointer(protocolBuffer)))
 	if r1 == socket_error {
@@ -0,0 +1,223 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	queueSaturationThreshold = flag.Int("queue-saturation-threshold", 50, "Publishes an event when at least this many queued sessions are left unassigned by a scheduling pass, 0 disables")
+)
+
+// Operator alerts derived from each scheduling pass, published on the event bus on transitions
+// so subscribers are told once when the condition starts and once when it ends
+type alerts struct {
+	saturated bool
+	// Pools with sessions left unassigned while none of their agents have VRAM available
+	exhaustedPools map[string]struct{}
+	// Agents left out of scheduling because they report unhealthy GPUs
+	cordonedAgents map[string]struct{}
+}
+
+func newAlerts() alerts {
+	return alerts{
+		exhaustedPools: map[string]struct{}{},
+		cordonedAgents: map[string]struct{}{},
+	}
+}
+
+// Sessions left unassigned by a scheduling pass
+type unassignedSessions struct {
+	total int
+	// Sessions by pool, along with the requirements of the first session of the pool
+	byPool       map[string]int
+	requirements map[string]restapi.SessionRequirements
+}
+
+func newUnassignedSessions() unassignedSessions {
+	return unassignedSessions{
+		byPool:       map[string]int{},
+		requirements: map[string]restapi.SessionRequirements{},
+	}
+}
+
+func (unassigned *unassignedSessions) add(session storage.QueuedSession) {
+	pool := storage.Pool(session.Requirements.MatchLabels)
+
+	unassigned.total++
+	unassigned.byPool[pool]++
+	if _, present := unassigned.requirements[pool]; !present {
+		unassigned.requirements[pool] = session.Requirements
+	}
+}
+
+func (backend *Backend) publish(event restapi.Event) {
+	if backend.bus != nil {
+		backend.bus.Publish(event)
+	}
+}
+
+func (backend *Backend) publishAssignment(sessionId string, agentId string) {
+	backend.publish(restapi.Event{
+		Type:      restapi.EventSessionStateChanged,
+		Message:   fmt.Sprintf("session %s was assigned to agent %s", sessionId, agentId),
+		AgentId:   agentId,
+		SessionId: sessionId,
+		Data: map[string]string{
+			"state":      restapi.SessionAssigned,
+			"exitStatus": "",
+		},
+	})
+}
+
+func (backend *Backend) publishAssignmentDeclined(sessionId string, agentId string, reason error) {
+	backend.publish(restapi.Event{
+		Type:      restapi.EventSessionAssignmentDeclined,
+		Message:   fmt.Sprintf("agent %s did not confirm it could take session %s, %v", agentId, sessionId, reason),
+		AgentId:   agentId,
+		SessionId: sessionId,
+		Data: map[string]string{
+			"reason": reason.Error(),
+		},
+	})
+}
+
+func (backend *Backend) publishAgentsMissing(agentIds []string) {
+	for _, agentId := range agentIds {
+		hostname := backend.cache.hostname(agentId)
+
+		backend.publish(restapi.Event{
+			Type:    restapi.EventAgentMissing,
+			Message: fmt.Sprintf("agent %s (%s) stopped updating the controller and is missing", agentId, hostname),
+			AgentId: agentId,
+			Data: map[string]string{
+				"hostname": hostname,
+			},
+		})
+	}
+}
+
+func (backend *Backend) updateAlerts(unassigned unassignedSessions) {
+	if *queueSaturationThreshold > 0 {
+		saturated := unassigned.total >= *queueSaturationThreshold
+		if saturated != backend.alerts.saturated {
+			backend.alerts.saturated = saturated
+
+			event := restapi.Event{
+				Type:    restapi.EventQueueRecovered,
+				Message: fmt.Sprintf("%d queued sessions are waiting for capacity, below the threshold of %d", unassigned.total, *queueSaturationThreshold),
+				Data: map[string]string{
+					"queued": strconv.Itoa(unassigned.total),
+				},
+			}
+			if saturated {
+				event.Type = restapi.EventQueueSaturated
+				event.Message = fmt.Sprintf("%d queued sessions are waiting for capacity, at or above the threshold of %d", unassigned.total, *queueSaturationThreshold)
+			}
+
+			backend.publish(event)
+		}
+	}
+
+	exhausted := map[string]struct{}{}
+	for pool, requirements := range unassigned.requirements {
+		if backend.cache.vramAvailable(requirements) == 0 {
+			exhausted[pool] = struct{}{}
+		}
+	}
+
+	pools := make([]string, 0, len(exhausted)+len(backend.alerts.exhaustedPools))
+	for pool := range exhausted {
+		pools = append(pools, pool)
+	}
+	for pool := range backend.alerts.exhaustedPools {
+		if _, present := exhausted[pool]; !present {
+			pools = append(pools, pool)
+		}
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		_, wasExhausted := backend.alerts.exhaustedPools[pool]
+		_, isExhausted := exhausted[pool]
+		if wasExhausted == isExhausted {
+			continue
+		}
+
+		event := restapi.Event{
+			Type:    restapi.EventPoolCapacityRecovered,
+			Message: fmt.Sprintf("pool %s has capacity available again", pool),
+			Pool:    pool,
+		}
+		if isExhausted {
+			event.Type = restapi.EventPoolCapacityExhausted
+			event.Message = fmt.Sprintf("pool %s has no VRAM available, %d sessions are waiting for capacity", pool, unassigned.byPool[pool])
+			event.Data = map[string]string{
+				"queued": strconv.Itoa(unassigned.byPool[pool]),
+			}
+		}
+
+		backend.publish(event)
+	}
+
+	backend.alerts.exhaustedPools = exhausted
+}
+
+// Publishes the agents cordoned for reporting unhealthy GPUs since the last pass and those no
+// longer cordoned, because their GPUs recovered or they left
+func (backend *Backend) updateCordonedAgents() {
+	cordoned := backend.cache.cordonedAgents()
+
+	agentIds := make([]string, 0, len(cordoned)+len(backend.alerts.cordonedAgents))
+	for agentId := range cordoned {
+		if _, present := backend.alerts.cordonedAgents[agentId]; !present {
+			agentIds = append(agentIds, agentId)
+		}
+	}
+	for agentId := range backend.alerts.cordonedAgents {
+		if _, present := cordoned[agentId]; !present {
+			agentIds = append(agentIds, agentId)
+		}
+	}
+	sort.Strings(agentIds)
+
+	for _, agentId := range agentIds {
+		agent, isCordoned := cordoned[agentId]
+		if !isCordoned {
+			delete(backend.alerts.cordonedAgents, agentId)
+
+			backend.publish(restapi.Event{
+				Type:    restapi.EventAgentUncordoned,
+				Message: fmt.Sprintf("agent %s is no longer cordoned", agentId),
+				AgentId: agentId,
+			})
+			continue
+		}
+
+		backend.alerts.cordonedAgents[agentId] = struct{}{}
+
+		gpus := []string{}
+		for _, index := range storage.UnhealthyGpus(agent) {
+			gpus = append(gpus, strconv.Itoa(index))
+		}
+
+		backend.publish(restapi.Event{
+			Type:    restapi.EventAgentCordoned,
+			Message: fmt.Sprintf("agent %s (%s) is cordoned, GPUs %s are unhealthy", agentId, agent.Hostname, strings.Join(gpus, ", ")),
+			AgentId: agentId,
+			Data: map[string]string{
+				"hostname": agent.Hostname,
+				"gpus":     strings.Join(gpus, ","),
+			},
+		})
+	}
+}
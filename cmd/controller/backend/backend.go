@@ -6,8 +6,17 @@ package backend
 import (
 	"context"
 	"errors"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/features"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/slo"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
 	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
@@ -16,17 +25,107 @@ import (
 )
 
 type Backend struct {
-	storage storage.Storage
+	storage  storage.Storage
+	bus      *events.Bus
+	tracker  *slo.Tracker
+	features *features.Set
+	cache    *agentCache
+	alerts   alerts
+
+	// Nil when agents are not asked to confirm assignments
+	confirmer *assignmentConfirmer
+	// Nil when sessions are always placed on their best placement
+	spreader *placementSpreader
+	// Nil when --tenant-quota-file is not set, see tenantQuotas
+	quotas *tenantQuotas
+	// Holds the quotas applied through the API, see restapi.ConfigQuota
+	resources *resources.Store
+	// See restapi.SessionRequirements.Class
+	classes scheduling.SessionClasses
+	// Whether sessions of lower priorities are preempted, see --priority-preemption
+	priorityPreemption bool
+
+	scheduling *scheduling.Pools
+	poolsMutex sync.Mutex
+	schedulers map[string]*poolScheduler
+	passes     sync.WaitGroup
+
+	// Held while a placement is checked against the agent and committed, see assign
+	assignMutex sync.Mutex
+
+	// The clock the storage was opened with, see clock.NewContext
+	clock           clock.Clock
+	lastClosedCheck time.Time
 }
 
-func NewBackend(storage storage.Storage) *Backend {
+func NewBackend(storage storage.Storage, bus *events.Bus, tracker *slo.Tracker, features *features.Set, pools *scheduling.Pools, resources *resources.Store) *Backend {
 	return &Backend{
-		storage: storage,
+		storage:    storage,
+		clock:      clock.Real,
+		bus:        bus,
+		tracker:    tracker,
+		features:   features,
+		cache:      newAgentCache(storage),
+		alerts:     newAlerts(),
+		confirmer:  newAssignmentConfirmer(),
+		classes:    scheduling.DefaultSessionClasses(),
+		scheduling: pools,
+		resources:  resources,
+		schedulers: map[string]*poolScheduler{},
+
+		priorityPreemption: *priorityPreemption,
 	}
 }
 
 func (backend *Backend) Run(group task.Group) error {
-	err := backend.update(group.Ctx())
+	err := validatePlacementStrategy()
+	if err != nil {
+		return err
+	}
+
+	spreader, err := newPlacementSpreader()
+	if err != nil {
+		return err
+	}
+	backend.spreader = spreader
+
+	quotas, err := loadTenantQuotas()
+	if err != nil {
+		return err
+	}
+	backend.quotas = quotas
+
+	classes, err := scheduling.LoadSessionClasses()
+	if err != nil {
+		return err
+	}
+	backend.classes = classes
+
+	stopWatching, err := backend.cache.watch()
+	if err != nil {
+		logger.Warningf("unable to watch for agent changes, reloading every agent each update, %s", err.Error())
+	} else {
+		defer stopWatching()
+	}
+
+	// Passes still running when the backend stops are canceled with the group
+	defer backend.passes.Wait()
+
+	// The stored records of the agents may be stale, such as when sessions changed while the
+	// controller was down. Agents report the sessions they run after the controller starts, the
+	// capacity they use is only assigned again once they have.
+	if *recoveryPeriod > 0 {
+		logger.Infof("waiting %s for agents to report their sessions before scheduling", *recoveryPeriod)
+
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-time.After(*recoveryPeriod):
+		}
+	}
+
+	err = backend.tick(group.Ctx())
 	if err == nil {
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
@@ -37,7 +136,7 @@ func (backend *Backend) Run(group task.Group) error {
 				return err
 
 			case <-ticker.C:
-				err = backend.update(group.Ctx())
+				err = backend.tick(group.Ctx())
 			}
 		}
 	}
@@ -45,89 +144,388 @@ func (backend *Backend) Run(group task.Group) error {
 	return err
 }
 
-func isSubset(set, subset map[string]string) bool {
-	for key, value := range subset {
-		checkValue, present := set[key]
-		if !present || value != checkValue {
-			return false
-		}
-	}
+type placement struct {
+	agent        restapi.Agent
+	selectedGpus *gpu.SelectedGpuSet
 
-	return true
+	distance      distance
+	vramRemaining uint64
+	fragmentation float64
 }
 
-func matchesLabels(set, subset map[string]string) bool {
-	return isSubset(set, subset)
-}
+// Placements on the agents closest to the client are preferred, keeping interactive
+// streaming latency low, followed by those the placement strategy prefers, see betterFit and
+// lessContended. Random placements are ordered as binpack ones and shuffled by sortPlacements.
+func (p placement) betterThan(other *placement, strategy string) bool {
+	if other == nil {
+		return true
+	}
+
+	if p.distance != other.distance {
+		return p.distance.closerThan(other.distance)
+	}
+
+	better, decided := p.betterFit(other)
+	if strategy == restapi.PlacementSpread {
+		better, decided = p.lessContended(other)
+	}
 
-func canTolerate(taints, tolerates map[string]string) bool {
-	// tolerates must be a superset of taints to be acceptable
-	return isSubset(tolerates, taints)
+	if decided {
+		return better
+	}
+
+	// Candidates come from the cache in no particular order, keep the choice stable
+	return p.agent.Id < other.agent.Id
 }
 
-func agentMatches(agent restapi.Agent, requirements restapi.SessionRequirements) (*gpu.SelectedGpuSet, error) {
-	if matchesLabels(agent.Labels, requirements.MatchLabels) && canTolerate(agent.Taints, requirements.Tolerates) {
+func (backend *Backend) agentMatches(agent restapi.Agent, requirements restapi.SessionRequirements) (*placement, error) {
+	if storage.AgentEligible(agent, requirements) && !backend.inMaintenance(agent) {
 		// Need to ensure the agent has the GPU capacity to support this session
-		gpuSet := gpu.NewGpuSet(agent.Gpus)
+		gpuSet := storage.AgentGpuSet(agent)
+		if !backend.features.Enabled(features.PerGpuSessionLimits) {
+			gpuSet.LimitSessionsPerGpu(0)
+		}
 
-		// Add the currently assigned sessions to the gpuSet
-		for _, session := range agent.Sessions {
-			gpuSet.Select(session.Gpus)
+		selectedGpus, err := gpuSet.Find(requirements.Gpus)
+		if err != nil || selectedGpus == nil {
+			return nil, err
 		}
 
-		return gpuSet.Find(requirements.Gpus)
+		return &placement{
+			agent:         agent,
+			selectedGpus:  selectedGpus,
+			distance:      localityDistance(agent.Labels, requirements.Locality),
+			vramRemaining: selectedGpus.VramRemaining(),
+			fragmentation: gpuSet.Fragmentation(),
+		}, nil
 	}
 
 	return nil, nil
 }
 
+// Starts a scheduling pass of each pool without waiting for them, pools whose previous pass is
+// still running are left to it
+func (backend *Backend) tick(ctx context.Context) error {
+	err := backend.housekeep()
+	if err != nil {
+		return err
+	}
+
+	err = backend.dispatch(ctx)
+	return errors.Join(err, backend.passErrors(), backend.publishAlerts())
+}
+
+// Runs a scheduling pass of each pool, waiting for them to complete
 func (backend *Backend) update(ctx context.Context) error {
-	err := backend.storage.SetAgentsMissingIfNotUpdatedFor(30 * time.Second)
+	err := backend.housekeep()
 	if err != nil {
 		return err
 	}
 
-	err = backend.storage.RemoveMissingAgentsIfNotUpdatedFor(5 * time.Minute)
+	err = backend.dispatch(ctx)
+	backend.passes.Wait()
+
+	return errors.Join(err, backend.passErrors(), backend.publishAlerts())
+}
+
+func (backend *Backend) housekeep() error {
+	missing, err := backend.storage.SetAgentsMissingIfNotUpdatedFor(*agentMissingTimeout)
 	if err != nil {
 		return err
 	}
 
-	sessionIterator, err := backend.storage.GetQueuedSessionsIterator()
+	backend.publishAgentsMissing(missing)
+
+	err = backend.storage.RemoveMissingAgentsIfNotUpdatedFor(*missingAgentRemoval)
 	if err != nil {
 		return err
 	}
 
-	for sessionIterator.Next() {
-		select {
-		case <-ctx.Done():
-			return nil
+	if *unclaimedSessionTtl > 0 {
+		canceled, err := backend.storage.CancelUnclaimedSessionsOlderThan(*unclaimedSessionTtl)
+		if err != nil {
+			return err
+		}
+
+		if canceled > 0 {
+			logger.Infof("canceled %d sessions not claimed within %s", canceled, *unclaimedSessionTtl)
+		}
+	}
+
+	err = backend.cache.sync()
+	if err != nil {
+		return err
+	}
+
+	return backend.cancelReservationsEnded()
+}
+
+func (backend *Backend) publishAlerts() error {
+	backend.updateAlerts(backend.unassignedSessions())
+	backend.updateCordonedAgents()
+	backend.observeQuotas()
+
+	return backend.updateSlos()
+}
+
+// Places the queued sessions of a pool, returning the sessions left unassigned and the number
+// assigned. On-demand sessions are only placed on the VRAM left once the VRAM of the pool's
+// reserved sessions not yet placed is set aside, held are those whose window has yet to start.
+func (backend *Backend) schedulePool(ctx context.Context, sessions []storage.QueuedSession, held []storage.QueuedSession) (unassignedSessions, int, error) {
+	unassigned := newUnassignedSessions()
+	assigned := 0
+
+	sortReservationsFirst(sessions)
+	vramHeld := heldVram(sessions, held)
+
+	var err error
+	for _, session := range sessions {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// On-demand sessions the held VRAM leaves no room for may still fall back to the CPU
+		reserved := session.Requirements.Reservation != nil
+		onHeldVram := !reserved && vramHeld > 0 && !backend.fitsAroundHolds(session, vramHeld)
+
+		if !backend.features.Enabled(features.LocalityScheduling) {
+			session.Requirements.Locality = nil
+		}
+
+		candidates := backend.cache.candidates(session.Requirements)
+		if onHeldVram {
+			candidates = nil
+		}
+
+		// The cached agents with the capacity to possibly satisfy the requirements
+		placements := []*placement{}
+		for _, agent := range candidates {
+			candidate, err_ := backend.agentMatches(*agent, session.Requirements)
+			if err_ != nil {
+				logger.Debugf("unable to match agent, %s", err_.Error())
+				continue
+			}
 
-		default:
-			session := sessionIterator.Value()
+			if candidate != nil {
+				placements = append(placements, candidate)
+			}
+		}
+
+		sortPlacements(placements, sessionPlacementStrategy(session.Requirements))
+		backend.spreader.spread(placements)
+
+		// The next best placement is tried when the session no longer fits on the agent or the
+		// agent declines it
+		sessionAssigned := false
+		for _, chosen := range placements {
+			assigned_, err_ := backend.assign(ctx, session, chosen)
+			err = errors.Join(err, err_)
+			sessionAssigned = assigned_
 
-			// Get an iterator of the agents matching a subset of the requirements
-			agentIterator, err_ := backend.storage.GetAvailableAgentsMatching(storage.TotalVramRequired(session.Requirements))
+			if sessionAssigned || err_ != nil {
+				break
+			}
+		}
+
+		if !sessionAssigned && session.Requirements.AllowCpuFallback {
+			assigned_, err_ := backend.assignCpuFallback(ctx, session)
 			err = errors.Join(err, err_)
-			if err_ == nil {
-				for agentIterator.Next() {
-					agent := agentIterator.Value()
-
-					selectedGpus, err_ := agentMatches(agent, session.Requirements)
-					err = err_
-					if err != nil {
-						logger.Debugf("unable to match agent, %s", err.Error())
-						continue
-					}
-
-					if selectedGpus != nil {
-						logger.Tracef("assigning %s to %s", session.Id, agent.Id)
-						err = errors.Join(err, backend.storage.AssignSession(session.Id, agent.Id, selectedGpus.GetGpus()))
-						break
-					}
-				}
+			sessionAssigned = assigned_
+		}
+
+		if !sessionAssigned && !onHeldVram {
+			err = errors.Join(err, backend.reclaimFor(session))
+		}
+
+		if sessionAssigned {
+			assigned++
+
+			if reserved {
+				vramHeld -= storage.TotalVramRequired(session.Requirements)
 			}
+		} else {
+			unassigned.add(session)
 		}
 	}
 
-	return err
+	return unassigned, assigned, err
+}
+
+// Commits the placement chosen for the session, returning whether it was assigned. Pools are
+// scheduled concurrently and sessions without a pool may be placed on any agent, so the placement
+// is made again against the agent as it is now, which another pool may have placed sessions on
+// since the placement was chosen.
+func (backend *Backend) assign(ctx context.Context, session storage.QueuedSession, chosen *placement) (bool, error) {
+	// Asked before taking the lock, the agent answering slowly must not hold up other pools
+	confirmed := chosen.selectedGpus.GetGpus()
+	err := backend.confirmer.confirm(ctx, chosen.agent, session.Id, confirmed, false)
+	if err != nil {
+		if ctx.Err() == nil {
+			backend.publishAssignmentDeclined(session.Id, chosen.agent.Id, err)
+		}
+		return false, nil
+	}
+
+	backend.assignMutex.Lock()
+	defer backend.assignMutex.Unlock()
+
+	agent, found := backend.cache.agent(chosen.agent.Id)
+	if !found {
+		return false, nil
+	}
+
+	current, err := backend.agentMatches(agent, session.Requirements)
+	if err != nil || current == nil {
+		logger.Tracef("%s no longer fits on %s, %v", session.Id, agent.Id, err)
+		return false, nil
+	}
+
+	gpus := current.selectedGpus.GetGpus()
+	if backend.confirmer != nil && !sameGpus(gpus, confirmed) {
+		logger.Tracef("%s no longer fits on the GPUs %s confirmed", session.Id, agent.Id)
+		return false, nil
+	}
+
+	allowed, borrowing := backend.checkQuota(session, gpus)
+	if !allowed {
+		return false, nil
+	}
+
+	preemptible := borrowing || (len(gpus) > 0 && backend.preemptibleClass(session.Requirements.Class))
+
+	logger.Tracef("assigning %s to %s", session.Id, agent.Id)
+	err = backend.storage.AssignSession(session.Id, agent.Id, gpus, false)
+	if err != nil {
+		return false, err
+	}
+
+	backend.cache.assigned(agent.Id, restapi.Session{
+		Id:          session.Id,
+		State:       restapi.SessionAssigned,
+		Gpus:        gpus,
+		Tenant:      session.Requirements.Tenant,
+		Class:       session.Requirements.Class,
+		Preemptible: preemptible,
+		Reservation: session.Requirements.Reservation,
+		Priority:    session.Requirements.Priority,
+	})
+	backend.observeAssignment(session)
+	backend.publishAssignment(session.Id, agent.Id)
+
+	if borrowing {
+		err = backend.borrow(session, agent.Id, gpus)
+	} else if preemptible {
+		err = backend.storage.SetSessionPreemptible(session.Id, true)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+func (backend *Backend) observeAssignment(session storage.QueuedSession) {
+	if session.RequestedAt.IsZero() {
+		return
+	}
+
+	pool := storage.Pool(session.Requirements.MatchLabels)
+	latency := backend.clock.Since(session.RequestedAt)
+
+	prometheus.ObserveSchedulingLatency(pool, session.Requirements.Class, latency)
+	if backend.tracker != nil {
+		backend.tracker.ObserveAssignment(pool, latency)
+	}
+}
+
+func (backend *Backend) updateSlos() error {
+	if backend.tracker == nil {
+		return nil
+	}
+
+	// Look back over the whole window the first time, afterwards only since the last check
+	// with some overlap, the tracker ignores sessions it has already seen
+	lookback := backend.tracker.Window()
+	if !backend.lastClosedCheck.IsZero() {
+		lookback = backend.clock.Since(backend.lastClosedCheck) + 10*time.Second
+	}
+	backend.lastClosedCheck = backend.clock.Now()
+
+	iterator, err := backend.storage.GetSessionsClosedWithin(lookback)
+	if err != nil {
+		return err
+	}
+
+	for iterator.Next() {
+		session := iterator.Value()
+		backend.tracker.ObserveSessionClosed(session.Id, storage.Pool(session.Requirements.MatchLabels), session.ExitStatus, session.ClosedAt)
+	}
+
+	backend.tracker.Update()
+	return nil
+}
+
+// Returns whether the session was assigned
+func (backend *Backend) assignCpuFallback(ctx context.Context, session storage.QueuedSession) (bool, error) {
+	// CPU fallback sessions do not consume VRAM so every active agent is a candidate,
+	// the closest to the client are preferred
+	candidates := backend.cache.cpuFallbackCandidates(session.Requirements)
+	sort.Slice(candidates, func(i, j int) bool {
+		di := localityDistance(candidates[i].Labels, session.Requirements.Locality)
+		dj := localityDistance(candidates[j].Labels, session.Requirements.Locality)
+		if di != dj {
+			return di.closerThan(dj)
+		}
+
+		return candidates[i].Id < candidates[j].Id
+	})
+
+	for _, agent := range candidates {
+		if storage.AgentEligible(agent, session.Requirements) && !backend.inMaintenance(agent) {
+			assigned, err := backend.assignCpuFallbackTo(ctx, session, agent)
+			if assigned || err != nil {
+				return assigned, err
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Commits the session to the agent's CPU rendering fallback when it still has capacity, see assign
+func (backend *Backend) assignCpuFallbackTo(ctx context.Context, session storage.QueuedSession, agent restapi.Agent) (bool, error) {
+	agentId := agent.Id
+
+	err := backend.confirmer.confirm(ctx, agent, session.Id, []restapi.SessionGpu{}, true)
+	if err != nil {
+		if ctx.Err() == nil {
+			backend.publishAssignmentDeclined(session.Id, agentId, err)
+		}
+		return false, nil
+	}
+
+	backend.assignMutex.Lock()
+	defer backend.assignMutex.Unlock()
+
+	if !backend.cache.cpuFallbackAvailable(agentId) {
+		return false, nil
+	}
+
+	logger.Tracef("assigning %s to %s using cpu fallback", session.Id, agentId)
+	err = backend.storage.AssignSession(session.Id, agentId, []restapi.SessionGpu{}, true)
+	if err != nil {
+		return false, err
+	}
+
+	backend.cache.assigned(agentId, restapi.Session{
+		Id:          session.Id,
+		State:       restapi.SessionAssigned,
+		Gpus:        []restapi.SessionGpu{},
+		CpuFallback: true,
+		Tenant:      session.Requirements.Tenant,
+	})
+	backend.observeAssignment(session)
+	backend.publishAssignment(session.Id, agentId)
+
+	return true, nil
 }
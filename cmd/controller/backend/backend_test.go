@@ -6,10 +6,22 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/features"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/memdb"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/postgres"
@@ -25,8 +37,20 @@ func openMemdb(t *testing.T) storage.Storage {
 	return db
 }
 
+const postgresConnection = "user=postgres password=password dbname=postgres sslmode=disable"
+
 func openPostgres(t *testing.T) storage.Storage {
-	db, err := postgres.OpenStorage(context.Background(), "user=postgres password=password dbname=postgres sslmode=disable")
+	migrator, err := postgres.OpenMigrator(postgresConnection)
+	if err == nil {
+		_, err = migrator.Migrate(context.Background(), postgres.LatestSchemaVersion(), false, nil)
+		err = errors.Join(err, migrator.Close())
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	db, err := postgres.OpenStorage(context.Background(), postgresConnection, nil, nil)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -182,7 +206,7 @@ func queueSession(t *testing.T, db storage.Storage, requirements restapi.Session
 
 func TestGetAvailableAgentsMatching(t *testing.T) {
 	run := func(t *testing.T, db storage.Storage) {
-		backend := NewBackend(db)
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
 
 		agentIds := []string{
 			registerAgent(t, db, defaultAgent(24*1024*1024*1024)).Id,
@@ -244,3 +268,1594 @@ func TestGetAvailableAgentsMatching(t *testing.T) {
 		run(t, db)
 	})
 }
+
+func TestCpuFallback(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		agent := defaultAgent(4 * 1024 * 1024 * 1024)
+		agent.CpuFallbackCapacity = 1
+		agentId := registerAgent(t, db, agent).Id
+
+		fallbackRequirements := defaultSessionRequirements(8 * 1024 * 1024 * 1024)
+		fallbackRequirements.AllowCpuFallback = true
+
+		sessionIds := []string{
+			queueSession(t, db, fallbackRequirements),
+			queueSession(t, db, fallbackRequirements),
+			queueSession(t, db, defaultSessionRequirements(8*1024*1024*1024)),
+		}
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		fallbackAssigned := 0
+		for _, id := range sessionIds[:2] {
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Error(err)
+			} else if session.State == restapi.SessionAssigned {
+				if !session.CpuFallback {
+					t.Error("expected session to be assigned using cpu fallback")
+				}
+
+				fallbackAssigned++
+			}
+		}
+
+		if fallbackAssigned != 1 {
+			t.Errorf("expected 1 session to be assigned using cpu fallback, found %d", fallbackAssigned)
+		}
+
+		session, err := db.GetSessionById(sessionIds[2])
+		if err != nil {
+			t.Error(err)
+		} else if session.State != restapi.SessionQueued {
+			t.Errorf("expected session without cpu fallback to remain queued, state = %s", session.State)
+		}
+
+		agent, err = db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if storage.CpuFallbackSessions(agent) != 1 {
+			t.Errorf("expected 1 cpu fallback session, found %d", storage.CpuFallbackSessions(agent))
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestMaxSessionsPerGpu(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		agent := defaultAgent(16 * 1024 * 1024 * 1024)
+		agent.MaxSessionsPerGpu = 1
+		agentId := registerAgent(t, db, agent).Id
+
+		sessionIds := []string{
+			queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024)),
+			queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024)),
+		}
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		assigned := 0
+		for _, id := range sessionIds {
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Error(err)
+			} else if session.State == restapi.SessionAssigned {
+				assigned++
+			} else if session.State != restapi.SessionQueued {
+				t.Errorf("expected session to be assigned or queued, state = %s", session.State)
+			}
+		}
+
+		if assigned != 1 {
+			t.Errorf("expected 1 session to be assigned to the GPU, found %d", assigned)
+		}
+
+		agent, err = db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if agent.MaxSessionsPerGpu != 1 {
+			t.Errorf("expected agent to keep a limit of 1 session per GPU, found %d", agent.MaxSessionsPerGpu)
+		} else if sessions := storage.WithVramAllocation(agent).Gpus[0].Sessions; sessions != 1 {
+			t.Errorf("expected 1 session on the GPU, found %d", sessions)
+		}
+
+		// With the feature off the limit is ignored and the queued session is assigned
+		featureSet, err := features.Load(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = featureSet.Set(features.PerGpuSessionLimits, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = NewBackend(db, nil, nil, featureSet, nil, nil).update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		for _, id := range sessionIds {
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Error(err)
+			} else if session.State != restapi.SessionAssigned {
+				t.Errorf("expected session to be assigned with %s disabled, state = %s", features.PerGpuSessionLimits, session.State)
+			}
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGpuSharing(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		// A 48GB GPU split into 4 fractions of 12GB
+		agent := defaultAgent(48 * 1024 * 1024 * 1024)
+		agent.Gpus[0].MaxSessions = 4
+		agent.Gpus[0].SessionVram = 12 * 1024 * 1024 * 1024
+		agentId := registerAgent(t, db, agent).Id
+
+		sessionIds := []string{
+			queueSession(t, db, defaultSessionRequirements(2*1024*1024*1024)),
+			queueSession(t, db, defaultSessionRequirements(0)),
+			queueSession(t, db, defaultSessionRequirements(16*1024*1024*1024)),
+			queueSession(t, db, defaultSessionRequirements(2*1024*1024*1024)),
+			queueSession(t, db, defaultSessionRequirements(2*1024*1024*1024)),
+			queueSession(t, db, defaultSessionRequirements(2*1024*1024*1024)),
+		}
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		allocated := []uint64{2 * 1024 * 1024 * 1024, 12 * 1024 * 1024 * 1024, 0, 2 * 1024 * 1024 * 1024, 2 * 1024 * 1024 * 1024, 0}
+		for index, id := range sessionIds {
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Error(err)
+			} else if allocated[index] == 0 && session.State != restapi.SessionQueued {
+				t.Errorf("expected session %d to stay queued, state = %s", index, session.State)
+			} else if allocated[index] != 0 && (session.State != restapi.SessionAssigned || session.Gpus[0].VramRequired != allocated[index]) {
+				t.Errorf("expected session %d to be assigned %dMB, state = %s, gpus = %v", index, allocated[index]/(1024*1024), session.State, session.Gpus)
+			}
+		}
+
+		agent, err = db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if gpu := storage.WithVramAllocation(agent).Gpus[0]; gpu.Sessions != 4 || gpu.VramAvailable != 30*1024*1024*1024 {
+			t.Errorf("expected 4 sessions on the GPU with 30GB available, found %d with %dMB", gpu.Sessions, gpu.VramAvailable/(1024*1024))
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPoolScheduling(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		// Paused through another controller sharing the storage
+		replica, err := scheduling.NewPools(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = replica.SetPaused("batch", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pools, err := scheduling.NewPools(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := NewBackend(db, nil, nil, nil, pools, nil)
+
+		for _, pool := range []string{"render", "batch"} {
+			agent := defaultAgent(16 * 1024 * 1024 * 1024)
+			agent.Labels[restapi.PoolLabel] = pool
+			registerAgent(t, db, agent)
+		}
+
+		sessionIds := map[string]string{}
+		for _, pool := range []string{"render", "batch"} {
+			requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+			requirements.MatchLabels[restapi.PoolLabel] = pool
+			sessionIds[pool] = queueSession(t, db, requirements)
+		}
+
+		checkState := func(pool string, state string) {
+			t.Helper()
+
+			session, err := db.GetSessionById(sessionIds[pool])
+			if err != nil {
+				t.Error(err)
+			} else if session.State != state {
+				t.Errorf("expected the session in pool %s to be %s, state = %s", pool, state, session.State)
+			}
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		checkState("render", restapi.SessionAssigned)
+		checkState("batch", restapi.SessionQueued)
+
+		for _, status := range pools.Status() {
+			if status.Pool == "batch" && (!status.Paused || status.Queued != 1) {
+				t.Errorf("expected pool batch to be paused with 1 session queued, found %+v", status)
+			} else if status.Pool == "render" && (status.Paused || status.LastPassAssigned != 1) {
+				t.Errorf("expected pool render to have assigned 1 session, found %+v", status)
+			}
+		}
+
+		_, err = pools.SetPaused("batch", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		checkState("batch", restapi.SessionAssigned)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestBestFitPlacement(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		largeAgentId := registerAgent(t, db, defaultAgent(24*1024*1024*1024)).Id
+		smallAgentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+
+		smallSessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+		largeSessionId := queueSession(t, db, defaultSessionRequirements(24*1024*1024*1024))
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		for agentId, sessionId := range map[string]string{smallAgentId: smallSessionId, largeAgentId: largeSessionId} {
+			agent, err := db.GetAgentById(agentId)
+			if err != nil {
+				t.Error(err)
+			} else if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+				t.Error("expected each session to be assigned to the agent with the least VRAM remaining")
+			}
+		}
+
+		agent, err := db.GetAgentById(smallAgentId)
+		if err != nil {
+			t.Error(err)
+		} else if available := storage.WithVramAllocation(agent).Gpus[0].VramAvailable; available != 4*1024*1024*1024 {
+			t.Errorf("expected 4GB of VRAM available, found %d", available)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPriorityScheduling(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		agentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+
+		batchSessionId := queueSession(t, db, defaultSessionRequirements(8*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(8 * 1024 * 1024 * 1024)
+		requirements.Priority = 10
+		interactiveSessionId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err := db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if len(agent.Sessions) != 1 || agent.Sessions[0].Id != interactiveSessionId {
+			t.Error("expected the session with the higher priority to be assigned first")
+		}
+
+		session, err := db.GetSessionById(batchSessionId)
+		if err != nil {
+			t.Error(err)
+		} else if session.State != restapi.SessionQueued {
+			t.Errorf("expected the session with the lower priority to remain queued, found %s", session.State)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestDrainingAgents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		agentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+
+		err := db.SetAgentDraining(agentId, true)
+		if err != nil {
+			t.Error(err)
+		}
+
+		sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		if err != nil {
+			t.Error(err)
+		} else if session.State != restapi.SessionQueued {
+			t.Errorf("expected no sessions to be placed on the draining agent, found %s", session.State)
+		}
+
+		err = db.SetAgentDraining(agentId, false)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err := db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if agent.Draining || len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Error("expected the session to be placed on the agent once it was resumed")
+		}
+
+		err = db.SetAgentDraining(uuid.NewString(), true)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected draining an unknown agent to return ErrNotFound, found %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestUnhealthyGpus(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		bus := events.NewBus(nil)
+		published, unsubscribe := bus.Subscribe(16)
+		defer unsubscribe()
+
+		backend := NewBackend(db, bus, nil, nil, nil, nil)
+
+		agentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+
+		err := db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agentId,
+			State: restapi.AgentActive,
+			Gpus: []restapi.GpuMetrics{
+				{Unhealthy: "Xid 79, GPU has fallen off the bus"},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		if err != nil {
+			t.Error(err)
+		} else if session.State != restapi.SessionQueued {
+			t.Errorf("expected no sessions to be placed on the agent with an unhealthy GPU, found %s", session.State)
+		}
+
+		expectEvent := func(eventType string) {
+			for {
+				select {
+				case event := <-published:
+					if event.Type != eventType {
+						continue
+					}
+
+					if event.AgentId != agentId {
+						t.Errorf("expected %s for agent %s, found %s", eventType, agentId, event.AgentId)
+					}
+				default:
+					t.Errorf("expected %s to be published", eventType)
+				}
+
+				return
+			}
+		}
+
+		expectEvent(restapi.EventAgentCordoned)
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agentId,
+			State: restapi.AgentActive,
+			Gpus: []restapi.GpuMetrics{
+				{},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err := db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Error("expected the session to be placed on the agent once its GPU recovered")
+		}
+
+		expectEvent(restapi.EventAgentUncordoned)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPatchedAgentLabels(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		agent := defaultAgent(16 * 1024 * 1024 * 1024)
+		agent.Taints = map[string]string{
+			"maintenance": "true",
+		}
+		agentId := registerAgent(t, db, agent).Id
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchLabels["gpu"] = "a100"
+		sessionId := queueSession(t, db, requirements)
+
+		update := func() {
+			t.Helper()
+
+			err := backend.update(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		update()
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		// The next pass places the session once the agent is labeled and no longer tainted
+		err = db.PatchAgentLabels(agentId, restapi.AgentLabelsPatch{
+			Labels: map[string]string{
+				"gpu": "a100",
+			},
+			RemoveTaints: []string{"maintenance"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		update()
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestRequireCapabilities(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		rootless := defaultAgent(16 * 1024 * 1024 * 1024)
+		rootless.Capabilities = []string{restapi.CapabilityGpuMetrics}
+		rootless.Rootless = true
+		registerAgent(t, db, rootless)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.RequireCapabilities = []string{restapi.CapabilityGpuFairness}
+		sessionId := queueSession(t, db, requirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		if err != nil {
+			t.Error(err)
+		} else if session.State != restapi.SessionQueued {
+			t.Errorf("expected the session to stay queued without an agent enforcing fairness, found %s", session.State)
+		}
+
+		enforcing := defaultAgent(16 * 1024 * 1024 * 1024)
+		enforcing.Capabilities = []string{restapi.CapabilityGpuMetrics, restapi.CapabilityGpuFairness}
+		agentId := registerAgent(t, db, enforcing).Id
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err := db.GetAgentById(agentId)
+		if err != nil {
+			t.Error(err)
+		} else if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Error("expected the session to be placed on the agent enforcing fairness")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestTenantQuotas(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+		backend.quotas = &tenantQuotas{
+			Tenants: map[string]restapi.TenantQuota{
+				"alice": {GuaranteedGpus: 1, BurstGpus: 2},
+				"bob":   {GuaranteedGpus: 2},
+			},
+		}
+
+		agent := defaultAgent(8 * 1024 * 1024 * 1024)
+		for index := 1; index < 3; index++ {
+			gpu := agent.Gpus[0]
+			gpu.Index = index
+			agent.Gpus = append(agent.Gpus, gpu)
+		}
+		agentId := registerAgent(t, db, agent).Id
+
+		queueTenantSession := func(tenant string) string {
+			requirements := defaultSessionRequirements(8 * 1024 * 1024 * 1024)
+			requirements.Tenant = tenant
+			return queueSession(t, db, requirements)
+		}
+
+		getSession := func(id string) restapi.Session {
+			t.Helper()
+
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return session
+		}
+
+		update := func() {
+			t.Helper()
+
+			err := backend.update(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		// Alice bursts to 2 GPUs, the second is borrowed, and the third session waits although a
+		// GPU is idle
+		alice := []string{queueTenantSession("alice"), queueTenantSession("alice"), queueTenantSession("alice")}
+		update()
+
+		preemptible := ""
+		for _, id := range alice[:2] {
+			session := getSession(id)
+			if session.State != restapi.SessionAssigned {
+				t.Errorf("expected session %s to be assigned, state = %s", id, session.State)
+			}
+			if session.Preemptible {
+				preemptible = id
+			}
+		}
+		if preemptible == "" || getSession(alice[0]).Preemptible == getSession(alice[1]).Preemptible {
+			t.Fatal("expected one of alice's sessions to be preemptible")
+		}
+		compare(t, restapi.SessionQueued, getSession(alice[2]).State, nil)
+
+		err := db.CancelSession(alice[2])
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Bob is within his guarantee, his first session takes the idle GPU and his second reclaims
+		// the GPU alice borrowed
+		bob := []string{queueTenantSession("bob"), queueTenantSession("bob")}
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(bob[0]).State, nil)
+		compare(t, false, getSession(bob[0]).Preemptible, nil)
+		compare(t, restapi.SessionQueued, getSession(bob[1]).State, nil)
+		compare(t, restapi.SessionCanceling, getSession(preemptible).State, nil)
+
+		// Nothing more is reclaimed while the agent cancels the session
+		update()
+
+		for _, id := range alice[:2] {
+			if id != preemptible {
+				compare(t, restapi.SessionAssigned, getSession(id).State, nil)
+			}
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agentId,
+			State: restapi.AgentActive,
+			Sessions: map[string]restapi.SessionUpdate{
+				preemptible: {
+					State: restapi.SessionClosed,
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(bob[1]).State, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAppliedTenantQuotas(t *testing.T) {
+	db := openMemdb(t)
+	defer db.Close()
+
+	store, err := resources.Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewBackend(db, nil, nil, nil, nil, store)
+	if backend.tenantQuotas() != nil {
+		t.Error("expected no quotas without --tenant-quota-file or quota resources")
+	}
+
+	backend.quotas = &tenantQuotas{
+		Default: &restapi.TenantQuota{GuaranteedGpus: 1},
+		Tenants: map[string]restapi.TenantQuota{
+			"alice": {GuaranteedGpus: 1, BurstGpus: 2},
+			"bob":   {GuaranteedGpus: 2},
+		},
+	}
+
+	for name, spec := range map[string]string{
+		"alice": `{"guaranteedGpus":3}`,
+		"carol": `{"guaranteedGpus":1,"burstGpus":4}`,
+	} {
+		_, err = store.Put(restapi.ConfigResource{
+			Kind: restapi.ConfigQuota,
+			Name: name,
+			Spec: json.RawMessage(spec),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The quota resources replace those of the file for their tenants
+	compare(t, &tenantQuotas{
+		Default: &restapi.TenantQuota{GuaranteedGpus: 1},
+		Tenants: map[string]restapi.TenantQuota{
+			"alice": {GuaranteedGpus: 3},
+			"bob":   {GuaranteedGpus: 2},
+			"carol": {GuaranteedGpus: 1, BurstGpus: 4},
+		},
+	}, backend.tenantQuotas(), nil)
+
+	_, err = store.Put(restapi.ConfigResource{
+		Kind: restapi.ConfigQuota,
+		Name: "dave",
+		Spec: json.RawMessage(`{"guaranteedGpus":2,"burstGpus":1}`),
+	})
+	if err == nil {
+		t.Error("expected a quota bursting below its guarantee to be rejected")
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	db := openMemdb(t)
+	defer db.Close()
+
+	store, err := resources.Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	fake := clock.NewFake(now)
+
+	backend := NewBackend(db, nil, nil, nil, nil, store)
+	backend.clock = fake
+
+	registerAgent(t, db, defaultAgent(8*1024*1024*1024))
+
+	window, err := json.Marshal(restapi.MaintenanceWindow{
+		Hostnames: []string{"Test"},
+		Start:     now.Add(-time.Minute),
+		End:       now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Put(restapi.ConfigResource{
+		Kind: restapi.ConfigMaintenanceWindow,
+		Name: "upgrade",
+		Spec: window,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := queueSession(t, db, defaultSessionRequirements(8*1024*1024*1024))
+
+	// The session waits while the window holds the only agent
+	err = backend.update(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	session, err := db.GetSessionById(id)
+	compare(t, restapi.SessionQueued, session.State, err)
+
+	fake.Advance(time.Hour)
+
+	err = backend.update(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	session, err = db.GetSessionById(id)
+	compare(t, restapi.SessionAssigned, session.State, err)
+}
+
+// Returns the address of an agent answering confirmations with confirmed
+func confirmingAgent(t *testing.T, confirmed restapi.AssignmentConfirmed) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(confirmed)
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestSessionClasses(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		agentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+
+		queueClassSession := func(class string) string {
+			requirements := defaultSessionRequirements(8 * 1024 * 1024 * 1024)
+			requirements.Class = class
+			backend.classes.Apply(&requirements)
+			return queueSession(t, db, requirements)
+		}
+
+		getSession := func(id string) restapi.Session {
+			t.Helper()
+
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return session
+		}
+
+		update := func() {
+			t.Helper()
+
+			err := backend.update(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		// Sessions of the preemptible class are preemptible without a quota
+		preemptible := queueClassSession(restapi.SessionClassPreemptible)
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(preemptible).State, nil)
+		compare(t, true, getSession(preemptible).Preemptible, nil)
+		compare(t, restapi.SessionClassPreemptible, getSession(preemptible).Class, nil)
+
+		// A batch session waits, an interactive session takes the GPU
+		batch := queueClassSession(restapi.SessionClassBatch)
+		interactive := queueClassSession(restapi.SessionClassInteractive)
+		update()
+
+		compare(t, restapi.SessionCanceling, getSession(preemptible).State, nil)
+		compare(t, restapi.SessionQueued, getSession(interactive).State, nil)
+		compare(t, restapi.SessionQueued, getSession(batch).State, nil)
+
+		err := db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agentId,
+			State: restapi.AgentActive,
+			Sessions: map[string]restapi.SessionUpdate{
+				preemptible: {
+					State: restapi.SessionClosed,
+				},
+			},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(interactive).State, nil)
+		compare(t, false, getSession(interactive).Preemptible, nil)
+		compare(t, restapi.SessionQueued, getSession(batch).State, nil)
+
+		// Queued interactive sessions are closed once they wait longer than the class allows, batch
+		// sessions wait indefinitely
+		waiting := queueClassSession(restapi.SessionClassInteractive)
+		update()
+
+		compare(t, restapi.SessionQueued, getSession(waiting).State, nil)
+
+		backend.clock = clock.NewFake(time.Now().Add(backend.classes.Get(restapi.SessionClassInteractive).MaxWait() + time.Minute))
+		update()
+
+		compare(t, restapi.SessionClosed, getSession(waiting).State, nil)
+		compare(t, restapi.ExitStatusCanceled, getSession(waiting).ExitStatus, nil)
+		compare(t, restapi.SessionQueued, getSession(batch).State, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPriorityPreemption(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+		backend.priorityPreemption = true
+
+		agentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+
+		queuePrioritySession := func(priority int) string {
+			requirements := defaultSessionRequirements(8 * 1024 * 1024 * 1024)
+			requirements.Priority = priority
+			return queueSession(t, db, requirements)
+		}
+
+		getSession := func(id string) restapi.Session {
+			t.Helper()
+
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return session
+		}
+
+		update := func() {
+			t.Helper()
+
+			err := backend.update(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		closeSession := func(id string) {
+			t.Helper()
+
+			err := db.UpdateAgent(restapi.AgentUpdate{
+				Id:    agentId,
+				State: restapi.AgentActive,
+				Sessions: map[string]restapi.SessionUpdate{
+					id: {
+						State:      restapi.SessionClosed,
+						ExitStatus: restapi.ExitStatusCanceled,
+					},
+				},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		low := queuePrioritySession(0)
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(low).State, nil)
+		compare(t, 0, getSession(low).Priority, nil)
+
+		// A session of equal priority waits
+		equal := queuePrioritySession(0)
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(low).State, nil)
+		compare(t, restapi.SessionQueued, getSession(equal).State, nil)
+
+		// A session of higher priority preempts the running session
+		high := queuePrioritySession(10)
+		update()
+
+		compare(t, restapi.SessionCanceling, getSession(low).State, nil)
+		compare(t, true, getSession(low).Preempted, nil)
+		compare(t, restapi.SessionQueued, getSession(high).State, nil)
+
+		// Once its agent closes it, the preempted session returns to the queue behind the session
+		// it was preempted for
+		closeSession(low)
+
+		compare(t, restapi.SessionQueued, getSession(low).State, nil)
+		compare(t, false, getSession(low).Preempted, nil)
+
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(high).State, nil)
+		compare(t, restapi.SessionQueued, getSession(low).State, nil)
+		compare(t, restapi.SessionQueued, getSession(equal).State, nil)
+
+		// The session of higher priority is not preempted for the sessions it preempted
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(high).State, nil)
+
+		// A preempted session canceled by its requester closes rather than returns to the queue
+		higher := queuePrioritySession(20)
+		update()
+
+		compare(t, restapi.SessionCanceling, getSession(high).State, nil)
+
+		err := db.CancelSession(high)
+		if err != nil {
+			t.Error(err)
+		}
+		closeSession(high)
+
+		compare(t, restapi.SessionClosed, getSession(high).State, nil)
+
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(higher).State, nil)
+
+		// Without --priority-preemption sessions of higher priorities wait
+		backend.priorityPreemption = false
+		highest := queuePrioritySession(30)
+		update()
+
+		compare(t, restapi.SessionAssigned, getSession(higher).State, nil)
+		compare(t, restapi.SessionQueued, getSession(highest).State, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionReservations(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		registerAgent(t, db, defaultAgent(8*1024*1024*1024))
+
+		now := time.Now()
+		queueReservedSession := func(vram uint64, startIn time.Duration, duration time.Duration) string {
+			requirements := defaultSessionRequirements(vram)
+			requirements.Reservation = &restapi.SessionReservation{
+				StartAt:         now.Add(startIn),
+				DurationSeconds: int64(duration.Seconds()),
+			}
+			return queueSession(t, db, requirements)
+		}
+
+		getSession := func(id string) restapi.Session {
+			t.Helper()
+
+			session, err := db.GetSessionById(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return session
+		}
+
+		update := func(at time.Duration) {
+			t.Helper()
+
+			backend.clock = clock.NewFake(now.Add(at))
+			err := backend.update(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		// The VRAM of a reservation starting soon is held, on-demand sessions only take what is left
+		reserved := queueReservedSession(6*1024*1024*1024, 10*time.Minute, time.Hour)
+		large := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+		small := queueSession(t, db, defaultSessionRequirements(2*1024*1024*1024))
+		update(0)
+
+		compare(t, restapi.SessionQueued, getSession(reserved).State, nil)
+		compare(t, restapi.SessionQueued, getSession(large).State, nil)
+		compare(t, restapi.SessionAssigned, getSession(small).State, nil)
+
+		// Reservations the agent has no room left for are closed once their window ends
+		missed := queueReservedSession(4*1024*1024*1024, 20*time.Minute, time.Minute)
+
+		// The reservation is placed once its window starts
+		update(11 * time.Minute)
+
+		compare(t, restapi.SessionAssigned, getSession(reserved).State, nil)
+		compare(t, restapi.SessionQueued, getSession(large).State, nil)
+		compare(t, restapi.SessionQueued, getSession(missed).State, nil)
+
+		update(30 * time.Minute)
+
+		compare(t, restapi.SessionClosed, getSession(missed).State, nil)
+		compare(t, restapi.ExitStatusCanceled, getSession(missed).ExitStatus, nil)
+
+		// And canceled once its window ends, returning its GPUs to the pool
+		update(71 * time.Minute)
+
+		compare(t, restapi.SessionCanceling, getSession(reserved).State, nil)
+		compare(t, restapi.SessionAssigned, getSession(small).State, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestConfirmAssignments(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+		backend.confirmer = &assignmentConfirmer{
+			client: &http.Client{},
+			scheme: "http",
+		}
+
+		// The best fit for the session declines it
+		declining := defaultAgent(4 * 1024 * 1024 * 1024)
+		declining.Address = confirmingAgent(t, restapi.AssignmentConfirmed{Reason: "GPU 0 has 512MB of leaked VRAM"})
+		decliningId := registerAgent(t, db, declining).Id
+
+		accepting := defaultAgent(24 * 1024 * 1024 * 1024)
+		accepting.Address = confirmingAgent(t, restapi.AssignmentConfirmed{Accepted: true})
+		acceptingId := registerAgent(t, db, accepting).Id
+
+		sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		agent, err := db.GetAgentById(acceptingId)
+		if err != nil {
+			t.Error(err)
+		} else if len(agent.Sessions) != 1 || agent.Sessions[0].Id != sessionId {
+			t.Error("expected the session to be placed on the next candidate")
+		}
+
+		agent, err = db.GetAgentById(decliningId)
+		if err != nil {
+			t.Error(err)
+		} else if len(agent.Sessions) != 0 {
+			t.Error("expected no sessions to be placed on the agent declining them")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestLocalityPlacement(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		// The best fit for the sessions is in another region
+		farAgent := defaultAgent(8 * 1024 * 1024 * 1024)
+		farAgent.Labels[restapi.RegionLabel] = "us-west"
+		farAgentId := registerAgent(t, db, farAgent).Id
+
+		regionAgent := defaultAgent(24 * 1024 * 1024 * 1024)
+		regionAgent.Labels[restapi.RegionLabel] = "us-east"
+		registerAgent(t, db, regionAgent)
+
+		zoneAgent := defaultAgent(24 * 1024 * 1024 * 1024)
+		zoneAgent.Labels[restapi.RegionLabel] = "us-east"
+		zoneAgent.Labels[restapi.ZoneLabel] = "us-east-1a"
+		zoneAgentId := registerAgent(t, db, zoneAgent).Id
+
+		zoneRequirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		zoneRequirements.Locality = &restapi.LocalityHint{
+			Region: "us-east",
+			Zone:   "us-east-1a",
+		}
+
+		rttRequirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		rttRequirements.Locality = &restapi.LocalityHint{
+			RegionRtts: map[string]float64{
+				"us-west": 80,
+				"us-east": 12,
+			},
+		}
+
+		selectorRequirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		selectorRequirements.MatchLabels[restapi.RegionLabel] = "us-west"
+		selectorRequirements.Locality = &restapi.LocalityHint{
+			Region: "us-east",
+		}
+
+		zoneSessionId := queueSession(t, db, zoneRequirements)
+
+		err := backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		rttSessionId := queueSession(t, db, rttRequirements)
+		selectorSessionId := queueSession(t, db, selectorRequirements)
+
+		err = backend.update(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Both agents in us-east are at the same distance from the measured session,
+		// it is placed on the best fit of the two
+		for sessionId, agentId := range map[string]string{zoneSessionId: zoneAgentId, rttSessionId: zoneAgentId, selectorSessionId: farAgentId} {
+			agent, err := db.GetAgentById(agentId)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+
+			found := false
+			for _, session := range agent.Sessions {
+				found = found || session.Id == sessionId
+			}
+
+			if !found {
+				t.Errorf("expected session %s to be assigned to agent %s", sessionId, agentId)
+			}
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSpreadPlacements(t *testing.T) {
+	newPlacements := func() []*placement {
+		placements := []*placement{}
+		for _, id := range []string{"a", "b", "c", "d"} {
+			placements = append(placements, &placement{agent: restapi.Agent{Id: id}})
+		}
+
+		// Farther from the client than the others
+		return append(placements, &placement{agent: restapi.Agent{Id: "far"}, distance: distance{tier: otherRegion}})
+	}
+
+	spreader := &placementSpreader{
+		random: rand.New(rand.NewSource(1)),
+		topN:   10,
+		weight: func(rank int, count int) float64 {
+			return float64(count - rank)
+		},
+	}
+
+	chosen := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		placements := newPlacements()
+		spreader.spread(placements)
+
+		seen := map[string]bool{}
+		for _, placement := range placements {
+			seen[placement.agent.Id] = true
+		}
+		if len(seen) != 5 {
+			t.Fatalf("expected every placement to be kept, found %v", seen)
+		}
+
+		if placements[4].agent.Id != "far" {
+			t.Fatal("expected the placement farther from the client to remain last")
+		}
+
+		chosen[placements[0].agent.Id]++
+	}
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if chosen[id] == 0 {
+			t.Errorf("expected %s to be chosen first at times", id)
+		}
+	}
+
+	if chosen["a"] <= chosen["d"] {
+		t.Errorf("expected the best placement to be chosen more often than the worst, %v", chosen)
+	}
+
+	// Only the best placements are spread over
+	spreader.topN = 2
+	for i := 0; i < 100; i++ {
+		placements := newPlacements()
+		spreader.spread(placements)
+
+		if placements[2].agent.Id != "c" || placements[3].agent.Id != "d" {
+			t.Fatal("expected the placements after the best 2 to keep their order")
+		}
+	}
+
+	// A nil spreader always chooses the best
+	var none *placementSpreader
+	placements := newPlacements()
+	none.spread(placements)
+	if placements[0].agent.Id != "a" {
+		t.Error("expected the best placement to remain first")
+	}
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		backend := NewBackend(db, nil, nil, nil, nil, nil)
+
+		busyAgentId := registerAgent(t, db, defaultAgent(24*1024*1024*1024)).Id
+		idleAgentId := registerAgent(t, db, defaultAgent(24*1024*1024*1024)).Id
+
+		busySessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		err := db.AssignSession(busySessionId, busyAgentId, []restapi.SessionGpu{{Index: 0, VramRequired: 4 * 1024 * 1024 * 1024}}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for strategy, expectedAgentId := range map[string]string{restapi.PlacementBinPack: busyAgentId, restapi.PlacementSpread: idleAgentId} {
+			requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+			requirements.Placement = strategy
+			sessionId := queueSession(t, db, requirements)
+
+			err = backend.update(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+
+			agent, err := db.GetAgentById(expectedAgentId)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			placed := false
+			for _, session := range agent.Sessions {
+				placed = placed || session.Id == sessionId
+			}
+			if !placed {
+				t.Errorf("expected the %s session to be placed on agent %s", strategy, expectedAgentId)
+			}
+
+			err = db.CancelSession(sessionId)
+			if err != nil {
+				t.Error(err)
+			}
+
+			err = db.UpdateAgent(restapi.AgentUpdate{
+				Id:       expectedAgentId,
+				State:    restapi.AgentActive,
+				Sessions: map[string]restapi.SessionUpdate{sessionId: {State: restapi.SessionClosed}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestRandomPlacements(t *testing.T) {
+	chosen := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		placements := []*placement{}
+		for _, id := range []string{"a", "b", "c"} {
+			placements = append(placements, &placement{agent: restapi.Agent{Id: id}})
+		}
+		placements = append(placements, &placement{agent: restapi.Agent{Id: "far"}, distance: distance{tier: otherRegion}})
+
+		sortPlacements(placements, restapi.PlacementRandom)
+
+		if placements[3].agent.Id != "far" {
+			t.Fatal("expected the placement farther from the client to remain last")
+		}
+
+		chosen[placements[0].agent.Id]++
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if chosen[id] == 0 {
+			t.Errorf("expected %s to be chosen first at times", id)
+		}
+	}
+}
+
+func TestAgentCache(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		cache := newAgentCache(db)
+		stop, err := cache.watch()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		defer stop()
+
+		pooledAgent := defaultAgent(8 * 1024 * 1024 * 1024)
+		pooledAgent.Labels[restapi.PoolLabel] = "render"
+
+		agentId := registerAgent(t, db, defaultAgent(8*1024*1024*1024)).Id
+		pooledAgentId := registerAgent(t, db, pooledAgent).Id
+
+		err = cache.sync()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if candidates := cache.candidates(defaultSessionRequirements(4 * 1024 * 1024 * 1024)); len(candidates) != 2 {
+			t.Errorf("expected 2 candidates, found %d", len(candidates))
+		}
+
+		if candidates := cache.candidates(defaultSessionRequirements(16 * 1024 * 1024 * 1024)); len(candidates) != 0 {
+			t.Errorf("expected no candidates with enough VRAM, found %d", len(candidates))
+		}
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchLabels[restapi.PoolLabel] = "render"
+		if candidates := cache.candidates(requirements); len(candidates) != 1 || candidates[0].Id != pooledAgentId {
+			t.Error("expected only the agent in the render pool")
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agentId,
+			State: restapi.AgentDisabled,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = cache.sync()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if candidates := cache.candidates(defaultSessionRequirements(4 * 1024 * 1024 * 1024)); len(candidates) != 1 || candidates[0].Id != pooledAgentId {
+			t.Error("expected the disabled agent to be removed from the cache")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func BenchmarkAgentCacheCandidates(b *testing.B) {
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10000; i++ {
+		agent := defaultAgent(uint64(rand.Intn(48)+1) * 1024 * 1024 * 1024)
+		_, err = db.RegisterAgent(agent)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	cache := newAgentCache(db)
+	err = cache.sync()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	requirements := defaultSessionRequirements(40 * 1024 * 1024 * 1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.candidates(requirements)
+	}
+}
@@ -0,0 +1,390 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	agentCacheResync = flag.Duration("agent-cache-resync", time.Minute, "Reloads every agent into the scheduler's cache at this interval in case change notifications were missed")
+)
+
+type cachedAgent struct {
+	agent restapi.Agent
+
+	vramAvailable        uint64
+	largestVramAvailable uint64
+	cpuFallbackSessions  int
+}
+
+func newCachedAgent(agent restapi.Agent) *cachedAgent {
+	cached := &cachedAgent{
+		agent:               agent,
+		cpuFallbackSessions: storage.CpuFallbackSessions(agent),
+	}
+
+	for _, vramAvailable := range storage.AgentGpuSet(agent).VramAvailable() {
+		cached.vramAvailable += vramAvailable
+		if vramAvailable > cached.largestVramAvailable {
+			cached.largestVramAvailable = vramAvailable
+		}
+	}
+
+	return cached
+}
+
+// Rejects agents that cannot possibly satisfy the requirements without building their GPU sets
+func (cached *cachedAgent) mayFit(requirements restapi.SessionRequirements, vramRequired, largestVramRequired uint64) bool {
+	return len(cached.agent.Gpus) >= len(requirements.Gpus) &&
+		cached.vramAvailable >= vramRequired &&
+		cached.largestVramAvailable >= largestVramRequired
+}
+
+// Returns whether the agent would be schedulable but for its unhealthy GPUs
+func cordoned(agent restapi.Agent) bool {
+	return agent.State == restapi.AgentActive && !agent.Draining && len(storage.UnhealthyGpus(agent)) > 0
+}
+
+// Indexed snapshot of the schedulable agents, kept up to date from the storage's agent change
+// notifications so candidates are selected without scanning the storage for every queued session
+type agentCache struct {
+	storage storage.Storage
+
+	mutex sync.Mutex
+
+	agents map[string]*cachedAgent
+	// Agents by the value of their PoolLabel label, empty when the label is not set
+	byPool map[string]map[string]*cachedAgent
+	// Agents left out because they report unhealthy GPUs, see cordoned
+	cordoned map[string]restapi.Agent
+
+	// Without notifications every sync reloads all of the agents
+	watching   bool
+	resync     bool
+	lastResync time.Time
+	dirty      map[string]struct{}
+}
+
+func newAgentCache(storage storage.Storage) *agentCache {
+	return &agentCache{
+		storage:  storage,
+		agents:   map[string]*cachedAgent{},
+		byPool:   map[string]map[string]*cachedAgent{},
+		cordoned: map[string]restapi.Agent{},
+		resync:   true,
+		dirty:    map[string]struct{}{},
+	}
+}
+
+// Starts receiving agent change notifications from the storage, returning a function to stop
+func (cache *agentCache) watch() (func(), error) {
+	stop, err := cache.storage.WatchAgents(cache.invalidate)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.watching = true
+	cache.resync = true
+
+	return func() {
+		stop()
+
+		cache.mutex.Lock()
+		defer cache.mutex.Unlock()
+
+		cache.watching = false
+	}, nil
+}
+
+func (cache *agentCache) invalidate(agentId string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if agentId == "" {
+		cache.resync = true
+	} else {
+		cache.dirty[agentId] = struct{}{}
+	}
+}
+
+// Reloads the agents invalidated since the last sync, or every agent when required
+func (cache *agentCache) sync() error {
+	cache.mutex.Lock()
+	resync := !cache.watching || cache.resync || time.Since(cache.lastResync) >= *agentCacheResync
+	dirty := cache.dirty
+	cache.resync = false
+	cache.dirty = map[string]struct{}{}
+	cache.mutex.Unlock()
+
+	if resync {
+		return cache.reload()
+	}
+
+	var err error
+	for agentId := range dirty {
+		agent, err_ := cache.storage.GetAgentById(agentId)
+		if err_ != nil && !errors.Is(err_, storage.ErrNotFound) {
+			// Try again on the next sync
+			cache.invalidate(agentId)
+			err = errors.Join(err, err_)
+			continue
+		}
+
+		cache.mutex.Lock()
+		cache.remove(agentId)
+		delete(cache.cordoned, agentId)
+		if err_ == nil && storage.Schedulable(agent) {
+			cache.add(agent)
+		} else if err_ == nil && cordoned(agent) {
+			cache.cordoned[agentId] = agent
+		}
+		cache.mutex.Unlock()
+	}
+
+	return err
+}
+
+func (cache *agentCache) reload() error {
+	now := time.Now()
+
+	iterator, err := cache.storage.GetAgents()
+	if err != nil {
+		cache.invalidate("")
+		return err
+	}
+
+	agents := []restapi.Agent{}
+	cordonedAgents := map[string]restapi.Agent{}
+	for iterator.Next() {
+		agent := iterator.Value()
+		if storage.Schedulable(agent) {
+			agents = append(agents, agent)
+		} else if cordoned(agent) {
+			cordonedAgents[agent.Id] = agent
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.agents = map[string]*cachedAgent{}
+	cache.byPool = map[string]map[string]*cachedAgent{}
+	for _, agent := range agents {
+		cache.add(agent)
+	}
+	cache.cordoned = cordonedAgents
+	cache.lastResync = now
+
+	return nil
+}
+
+// Requires the mutex to be held
+func (cache *agentCache) add(agent restapi.Agent) {
+	cached := newCachedAgent(agent)
+	cache.agents[agent.Id] = cached
+
+	pool := agent.Labels[restapi.PoolLabel]
+	if cache.byPool[pool] == nil {
+		cache.byPool[pool] = map[string]*cachedAgent{}
+	}
+	cache.byPool[pool][agent.Id] = cached
+}
+
+// Requires the mutex to be held
+func (cache *agentCache) remove(agentId string) {
+	cached, present := cache.agents[agentId]
+	if !present {
+		return
+	}
+
+	delete(cache.agents, agentId)
+
+	pool := cached.agent.Labels[restapi.PoolLabel]
+	delete(cache.byPool[pool], agentId)
+	if len(cache.byPool[pool]) == 0 {
+		delete(cache.byPool, pool)
+	}
+}
+
+// Requires the mutex to be held
+func (cache *agentCache) agentsMatchingPool(requirements restapi.SessionRequirements) map[string]*cachedAgent {
+	pool, present := requirements.MatchLabels[restapi.PoolLabel]
+	if !present {
+		return cache.agents
+	}
+
+	return cache.byPool[pool]
+}
+
+// Returns the agents with the capacity to possibly satisfy the requirements, cached agents are
+// replaced rather than modified so the agents returned must not be modified
+func (cache *agentCache) candidates(requirements restapi.SessionRequirements) []*restapi.Agent {
+	vramRequired := storage.TotalVramRequired(requirements)
+
+	var largestVramRequired uint64
+	for _, gpu := range requirements.Gpus {
+		if gpu.VramRequired > largestVramRequired {
+			largestVramRequired = gpu.VramRequired
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	pool := cache.agentsMatchingPool(requirements)
+
+	agents := make([]*restapi.Agent, 0, len(pool))
+	for _, cached := range pool {
+		if cached.mayFit(requirements, vramRequired, largestVramRequired) {
+			agents = append(agents, &cached.agent)
+		}
+	}
+
+	return agents
+}
+
+// Returns the agents with spare CPU rendering fallback capacity
+func (cache *agentCache) cpuFallbackCandidates(requirements restapi.SessionRequirements) []restapi.Agent {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	agents := []restapi.Agent{}
+	for _, cached := range cache.agentsMatchingPool(requirements) {
+		if cached.agent.CpuFallbackCapacity > cached.cpuFallbackSessions {
+			agents = append(agents, cached.agent)
+		}
+	}
+
+	return agents
+}
+
+// Applies a session assignment to the cached agent ahead of its change notification, so
+// later sessions in the same scheduling pass see the capacity it consumes
+func (cache *agentCache) assigned(agentId string, session restapi.Session) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cached, present := cache.agents[agentId]
+	if !present {
+		return
+	}
+
+	agent := cached.agent
+	sessions := make([]restapi.Session, len(agent.Sessions), len(agent.Sessions)+1)
+	copy(sessions, agent.Sessions)
+	agent.Sessions = append(sessions, session)
+
+	cache.remove(agentId)
+	cache.add(agent)
+
+	cache.dirty[agentId] = struct{}{}
+}
+
+// Applies the cancellation of a session to the cached agent ahead of its change notification,
+// see assigned
+func (cache *agentCache) canceling(agentId string, sessionId string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cached, present := cache.agents[agentId]
+	if !present {
+		return
+	}
+
+	agent := cached.agent
+	agent.Sessions = make([]restapi.Session, len(cached.agent.Sessions))
+	copy(agent.Sessions, cached.agent.Sessions)
+	for index := range agent.Sessions {
+		if agent.Sessions[index].Id == sessionId {
+			agent.Sessions[index].State = restapi.SessionCanceling
+		}
+	}
+
+	cache.remove(agentId)
+	cache.add(agent)
+
+	cache.dirty[agentId] = struct{}{}
+}
+
+// Returns every cached agent, which must not be modified
+func (cache *agentCache) all() []restapi.Agent {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	agents := make([]restapi.Agent, 0, len(cache.agents))
+	for _, cached := range cache.agents {
+		agents = append(agents, cached.agent)
+	}
+
+	return agents
+}
+
+// Returns the agents left out because they report unhealthy GPUs by id, which must not be modified
+func (cache *agentCache) cordonedAgents() map[string]restapi.Agent {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	agents := make(map[string]restapi.Agent, len(cache.cordoned))
+	for id, agent := range cache.cordoned {
+		agents[id] = agent
+	}
+
+	return agents
+}
+
+// Returns the VRAM available across the agents the requirements may be assigned to
+func (cache *agentCache) vramAvailable(requirements restapi.SessionRequirements) uint64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	var vramAvailable uint64
+	for _, cached := range cache.agentsMatchingPool(requirements) {
+		vramAvailable += cached.vramAvailable
+	}
+
+	return vramAvailable
+}
+
+// Returns the cached agent, which must not be modified
+func (cache *agentCache) agent(agentId string) (restapi.Agent, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cached, present := cache.agents[agentId]; present {
+		return cached.agent, true
+	}
+
+	return restapi.Agent{}, false
+}
+
+// Returns whether the cached agent has spare CPU rendering fallback capacity
+func (cache *agentCache) cpuFallbackAvailable(agentId string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cached, present := cache.agents[agentId]
+	return present && cached.agent.CpuFallbackCapacity > cached.cpuFallbackSessions
+}
+
+// Returns the hostname of the cached agent, empty when the agent is not cached
+func (cache *agentCache) hostname(agentId string) string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cached, present := cache.agents[agentId]; present {
+		return cached.agent.Hostname
+	}
+
+	return ""
+}
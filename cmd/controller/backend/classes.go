@@ -0,0 +1,101 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Returns whether sessions of the class yield their GPUs to the sessions of other classes
+func (backend *Backend) preemptibleClass(class string) bool {
+	return backend.classes.Get(class).Preemptible
+}
+
+// Returns whether any of the agents runs a session of a preemptible class
+func (backend *Backend) runsPreemptibleClass(agents []restapi.Agent) bool {
+	for _, agent := range agents {
+		for _, session := range agent.Sessions {
+			if backend.preemptibleClass(session.Class) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns whether the queued session has waited longer than its class allows, reserved sessions
+// wait until their window ends instead
+func (backend *Backend) waitExceeded(session storage.QueuedSession) bool {
+	if session.Requirements.Reservation != nil {
+		return false
+	}
+
+	maxWait := backend.classes.Get(session.Requirements.Class).MaxWait()
+	return maxWait > 0 && !session.RequestedAt.IsZero() && backend.clock.Since(session.RequestedAt) > maxWait
+}
+
+// Closes the queued sessions that waited longer than their class allows, their requesters find
+// them canceled rather than waiting on them indefinitely
+func (backend *Backend) closeWaitExceeded(sessions []storage.QueuedSession) error {
+	var err error
+	for _, session := range sessions {
+		err_ := backend.storage.CancelSession(session.Id)
+		if err_ != nil {
+			err = errors.Join(err, err_)
+			continue
+		}
+
+		class := session.Requirements.Class
+		waited := backend.clock.Since(session.RequestedAt)
+		maxWait := backend.classes.Get(class).MaxWait()
+
+		logger.WithSession(session.Id).Infof("closing session %s of class %s, not placed within %s", session.Id, class, maxWait)
+		prometheus.ObserveSessionWaitExceeded(class)
+		backend.publish(restapi.Event{
+			Type:      restapi.EventSessionWaitExceeded,
+			Message:   fmt.Sprintf("session %s of class %s was not placed within %s and was closed", session.Id, class, maxWait),
+			SessionId: session.Id,
+			Data: map[string]string{
+				"class":   class,
+				"waited":  waited.String(),
+				"maxWait": maxWait.String(),
+			},
+		})
+		backend.publish(restapi.Event{
+			Type:      restapi.EventSessionStateChanged,
+			Message:   fmt.Sprintf("session %s is %s", session.Id, restapi.SessionClosed),
+			SessionId: session.Id,
+			Data: map[string]string{
+				"state":      restapi.SessionClosed,
+				"exitStatus": restapi.ExitStatusCanceled,
+			},
+		})
+	}
+
+	return err
+}
+
+// Records that a session of a preemptible class was canceled for a session of another class
+func (backend *Backend) publishPreempted(victim restapi.Session, agentId string, session storage.QueuedSession) {
+	logger.WithSession(victim.Id).Infof("preempting session %s of class %s for session %s of class %s", victim.Id, victim.Class, session.Id, session.Requirements.Class)
+	prometheus.ObserveSessionPreempted(victim.Class)
+	backend.publish(restapi.Event{
+		Type:      restapi.EventSessionPreempted,
+		Message:   fmt.Sprintf("session %s of class %s was canceled to make room for session %s", victim.Id, victim.Class, session.Id),
+		AgentId:   agentId,
+		SessionId: victim.Id,
+		Data: map[string]string{
+			"class":      victim.Class,
+			"forClass":   session.Requirements.Class,
+			"forSession": session.Id,
+		},
+	})
+}
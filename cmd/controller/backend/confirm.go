@@ -0,0 +1,119 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	assignmentConfirmTimeout = flag.Duration("assignment-confirm-timeout", 0, "Before assigning a session, asks the agent chosen whether it can take the session on the GPUs chosen, offering the session to the next candidate when the agent declines or does not answer within this duration. Guards against agents whose state drifted since their last update, 0 disables")
+	assignmentConfirmTls     = flag.Bool("assignment-confirm-tls", false, "Connect to agents over TLS to confirm assignments")
+)
+
+// Asks agents to confirm they can take sessions before they are assigned, see
+// restapi.AssignmentConfirmation
+type assignmentConfirmer struct {
+	client *http.Client
+	scheme string
+}
+
+// Returns nil when --assignment-confirm-timeout is not set
+func newAssignmentConfirmer() *assignmentConfirmer {
+	if *assignmentConfirmTimeout <= 0 {
+		return nil
+	}
+
+	scheme := "http"
+	if *assignmentConfirmTls {
+		scheme = "https"
+	}
+
+	return &assignmentConfirmer{
+		client: &http.Client{
+			Timeout: *assignmentConfirmTimeout,
+		},
+		scheme: scheme,
+	}
+}
+
+// Returns an error when the agent declines the session or cannot be asked, nil when it accepts
+// or confirming is disabled. Agents predating confirmations are assumed to accept.
+func (confirmer *assignmentConfirmer) confirm(ctx context.Context, agent restapi.Agent, sessionId string, gpus []restapi.SessionGpu, cpuFallback bool) error {
+	if confirmer == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(restapi.AssignmentConfirmation{
+		Gpus:        gpus,
+		CpuFallback: cpuFallback,
+	})
+	if err != nil {
+		return err
+	}
+
+	confirmUrl := url.URL{
+		Scheme: confirmer.scheme,
+		Host:   agent.Address,
+		Path:   fmt.Sprintf("/v1/confirm/session/%s", sessionId),
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, confirmUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := confirmer.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to reach the agent, %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("the agent responded with code %d, %s", response.StatusCode, string(message))
+	}
+
+	var confirmed restapi.AssignmentConfirmed
+	err = json.NewDecoder(response.Body).Decode(&confirmed)
+	if err != nil {
+		return err
+	}
+
+	if !confirmed.Accepted {
+		return errors.New(confirmed.Reason)
+	}
+
+	return nil
+}
+
+// Returns whether the session is placed on the same GPUs of the agent
+func sameGpus(gpus []restapi.SessionGpu, other []restapi.SessionGpu) bool {
+	if len(gpus) != len(other) {
+		return false
+	}
+
+	for i := range gpus {
+		if gpus[i].Index != other[i].Index || gpus[i].VramRequired != other[i].VramRequired {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,58 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"math"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+const (
+	sameZone = iota
+	sameRegion
+	otherRegion
+)
+
+// How far an agent is from the client requesting the session. Agents in the client's zone are
+// closest, followed by those in its region, then the rest. Agents at the same tier are ordered by
+// the round trip time the client measured to their region, regions it did not measure last.
+type distance struct {
+	tier int
+	rtt  float64
+}
+
+// Every agent is at the same distance from sessions without a locality hint
+func localityDistance(labels map[string]string, hint *restapi.LocalityHint) distance {
+	if hint == nil {
+		return distance{}
+	}
+
+	region := labels[restapi.RegionLabel]
+
+	tier := otherRegion
+	if hint.Zone != "" && labels[restapi.ZoneLabel] == hint.Zone {
+		tier = sameZone
+	} else if hint.Region != "" && region == hint.Region {
+		tier = sameRegion
+	}
+
+	rtt := math.Inf(1)
+	if measured, found := hint.RegionRtts[region]; found && region != "" {
+		rtt = measured
+	}
+
+	return distance{
+		tier: tier,
+		rtt:  rtt,
+	}
+}
+
+func (d distance) closerThan(other distance) bool {
+	if d.tier != other.tier {
+		return d.tier < other.tier
+	}
+
+	return d.rtt < other.rtt
+}
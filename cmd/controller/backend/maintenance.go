@@ -0,0 +1,22 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Returns whether a maintenance window applied through the API holds the agent, no sessions are
+// assigned to it until the window closes
+func (backend *Backend) inMaintenance(agent restapi.Agent) bool {
+	now := backend.clock.Now()
+	for _, window := range resources.Specs[restapi.MaintenanceWindow](backend.resources, restapi.ConfigMaintenanceWindow) {
+		if window.Open(now) && window.Selects(agent) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,164 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+)
+
+// Each pool's queue is scheduled by its own pass, running on its own goroutine, so a pool with a
+// long queue or slow matching does not delay placements in the others
+type poolScheduler struct {
+	running bool
+
+	// Sessions left unassigned by the last pass, or left queued while the pool is paused
+	unassigned unassignedSessions
+
+	// Errors of the passes since the last update, returned by the next update
+	err error
+}
+
+// Reads the queue and starts a pass for each pool with queued sessions. Pools whose previous pass
+// is still running are skipped, their sessions are read again once the pass is complete.
+func (backend *Backend) dispatch(ctx context.Context) error {
+	// Only dispatch starts passes, the pools running now are the only ones that may be assigning
+	// sessions while the queue is read
+	running := map[string]bool{}
+
+	backend.poolsMutex.Lock()
+	for pool, scheduler := range backend.schedulers {
+		running[pool] = scheduler.running
+	}
+	backend.poolsMutex.Unlock()
+
+	iterator, err := backend.storage.GetQueuedSessionsIterator()
+	if err != nil {
+		return err
+	}
+
+	now := backend.clock.Now()
+
+	queues := map[string][]storage.QueuedSession{}
+	expired := []storage.QueuedSession{}
+	// Reserved sessions whose window has yet to start, holding the VRAM of their pool
+	held := map[string][]storage.QueuedSession{}
+	ended := []storage.QueuedSession{}
+	for iterator.Next() {
+		session := iterator.Value()
+
+		pool := storage.Pool(session.Requirements.MatchLabels)
+		if running[pool] {
+			continue
+		}
+
+		reservation := session.Requirements.Reservation
+		switch {
+		case scheduling.ReservationEnded(reservation, now):
+			ended = append(ended, session)
+
+		case !scheduling.ReservationStarted(reservation, now):
+			if scheduling.ReservationHeld(reservation, now) {
+				held[pool] = append(held[pool], session)
+			}
+
+		case backend.waitExceeded(session):
+			expired = append(expired, session)
+
+		default:
+			queues[pool] = append(queues[pool], session)
+		}
+	}
+
+	// The passes are started even when closing them fails
+	err = errors.Join(backend.closeWaitExceeded(expired), backend.closeReservationsEnded(ended))
+
+	backend.poolsMutex.Lock()
+	defer backend.poolsMutex.Unlock()
+
+	for pool, scheduler := range backend.schedulers {
+		if _, queued := queues[pool]; !queued && !scheduler.running {
+			scheduler.unassigned = newUnassignedSessions()
+			backend.scheduling.ObserveQueued(pool, 0)
+		}
+	}
+
+	for pool, sessions := range queues {
+		scheduler, present := backend.schedulers[pool]
+		if !present {
+			scheduler = &poolScheduler{}
+			backend.schedulers[pool] = scheduler
+		}
+
+		if backend.scheduling.Paused(pool) {
+			scheduler.unassigned = newUnassignedSessions()
+			for _, session := range sessions {
+				scheduler.unassigned.add(session)
+			}
+
+			backend.scheduling.ObserveQueued(pool, len(sessions))
+			continue
+		}
+
+		scheduler.running = true
+		backend.scheduling.ObservePassStarted(pool, len(sessions))
+
+		backend.passes.Add(1)
+		go func(pool string, scheduler *poolScheduler, sessions []storage.QueuedSession, held []storage.QueuedSession) {
+			defer backend.passes.Done()
+
+			startedAt := time.Now()
+			unassigned, assigned, err := backend.schedulePool(ctx, sessions, held)
+			backend.scheduling.ObservePass(pool, startedAt, assigned)
+			prometheus.ObserveSchedulingPass(pool, time.Since(startedAt))
+
+			backend.poolsMutex.Lock()
+			defer backend.poolsMutex.Unlock()
+
+			scheduler.running = false
+			scheduler.unassigned = unassigned
+			scheduler.err = errors.Join(scheduler.err, err)
+		}(pool, scheduler, sessions, held[pool])
+	}
+
+	return err
+}
+
+// Returns the errors of the passes completed since the last call
+func (backend *Backend) passErrors() error {
+	backend.poolsMutex.Lock()
+	defer backend.poolsMutex.Unlock()
+
+	var err error
+	for _, scheduler := range backend.schedulers {
+		err = errors.Join(err, scheduler.err)
+		scheduler.err = nil
+	}
+
+	return err
+}
+
+// Returns the sessions left unassigned by the last pass of every pool
+func (backend *Backend) unassignedSessions() unassignedSessions {
+	backend.poolsMutex.Lock()
+	defer backend.poolsMutex.Unlock()
+
+	unassigned := newUnassignedSessions()
+	for _, scheduler := range backend.schedulers {
+		unassigned.total += scheduler.unassigned.total
+		for pool, count := range scheduler.unassigned.byPool {
+			unassigned.byPool[pool] += count
+		}
+		for pool, requirements := range scheduler.unassigned.requirements {
+			unassigned.requirements[pool] = requirements
+		}
+	}
+
+	return unassigned
+}
@@ -0,0 +1,51 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	priorityPreemption = flag.Bool("priority-preemption", false, "Preempts the running sessions of the lowest priorities on an agent when a session of a higher priority cannot be placed, for fleets mixing interactive and batch sessions. Preempted sessions are given the agent's --preemption-grace to exit and return to the queue, see restapi.Session.Preempted")
+)
+
+// Returns whether the running session may be preempted for a queued session of the priority
+func (backend *Backend) lowerPriority(session restapi.Session, priority int) bool {
+	return backend.priorityPreemption && session.Priority < priority
+}
+
+// Returns whether any of the agents runs a session of a priority lower than the priority
+func (backend *Backend) runsLowerPriority(agents []restapi.Agent, priority int) bool {
+	for _, agent := range agents {
+		for _, session := range agent.Sessions {
+			if len(session.Gpus) > 0 && session.State != restapi.SessionCanceling && backend.lowerPriority(session, priority) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (backend *Backend) publishRequeued(victim restapi.Session, agentId string, session storage.QueuedSession) {
+	logger.WithSession(victim.Id).Infof("preempting session %s of priority %d for session %s of priority %d", victim.Id, victim.Priority, session.Id, session.Requirements.Priority)
+	backend.publish(restapi.Event{
+		Type:      restapi.EventSessionRequeued,
+		Message:   fmt.Sprintf("session %s of priority %d was preempted for session %s and returns to the queue", victim.Id, victim.Priority, session.Id),
+		AgentId:   agentId,
+		SessionId: victim.Id,
+		Data: map[string]string{
+			"priority":    strconv.Itoa(victim.Priority),
+			"forPriority": strconv.Itoa(session.Requirements.Priority),
+			"forSession":  session.Id,
+		},
+	})
+}
@@ -0,0 +1,381 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	tenantQuotaFile = flag.String("tenant-quota-file", "", "JSON file declaring, by tenant, the GPUs guaranteed to its sessions and the GPUs they may burst to by borrowing idle capacity. Sessions placed beyond the guarantee are preemptible, canceled first when a tenant within its guarantee needs the GPUs. Tenants are not limited when not set")
+)
+
+func burstGpus(quota restapi.TenantQuota) int {
+	if quota.BurstGpus == 0 {
+		return quota.GuaranteedGpus
+	}
+
+	return quota.BurstGpus
+}
+
+// GPU quotas by the tenant of the sessions, see restapi.SessionRequirements.Tenant
+type tenantQuotas struct {
+	// Applied to the tenants not listed, their sessions are not limited when not set
+	Default *restapi.TenantQuota           `json:"default,omitempty"`
+	Tenants map[string]restapi.TenantQuota `json:"tenants,omitempty"`
+}
+
+// Returns nil when --tenant-quota-file is not set
+func loadTenantQuotas() (*tenantQuotas, error) {
+	if *tenantQuotaFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(*tenantQuotaFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", *tenantQuotaFile, err)
+	}
+
+	quotas := &tenantQuotas{}
+	err = json.Unmarshal(data, quotas)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s, %v", *tenantQuotaFile, err)
+	}
+
+	if quotas.Default != nil {
+		err = resources.ValidateTenantQuota(*quotas.Default)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid default quota, %v", *tenantQuotaFile, err)
+		}
+	}
+
+	for tenant, quota := range quotas.Tenants {
+		err = resources.ValidateTenantQuota(quota)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid quota of tenant %s, %v", *tenantQuotaFile, tenant, err)
+		}
+	}
+
+	return quotas, nil
+}
+
+// Returns the quotas of --tenant-quota-file with the quota resources applied through the API
+// replacing those of their tenants, nil when neither limits any tenant
+func (backend *Backend) tenantQuotas() *tenantQuotas {
+	applied := resources.Specs[restapi.TenantQuota](backend.resources, restapi.ConfigQuota)
+	if len(applied) == 0 {
+		return backend.quotas
+	}
+
+	quotas := &tenantQuotas{
+		Tenants: map[string]restapi.TenantQuota{},
+	}
+
+	if backend.quotas != nil {
+		quotas.Default = backend.quotas.Default
+		for tenant, quota := range backend.quotas.Tenants {
+			quotas.Tenants[tenant] = quota
+		}
+	}
+
+	for tenant, quota := range applied {
+		quotas.Tenants[tenant] = quota
+	}
+
+	return quotas
+}
+
+// Returns the quota of the tenant, nil when its sessions are not limited
+func (quotas *tenantQuotas) forTenant(tenant string) *restapi.TenantQuota {
+	if quotas == nil {
+		return nil
+	}
+
+	if quota, found := quotas.Tenants[tenant]; found {
+		return &quota
+	}
+
+	return quotas.Default
+}
+
+// Returns the GPUs used by the sessions of each tenant on the agents. Sessions being canceled
+// are about to return their GPUs so are not counted.
+func gpusInUse(agents []restapi.Agent) map[string]int {
+	used := map[string]int{}
+	for _, agent := range agents {
+		for _, session := range agent.Sessions {
+			if session.State != restapi.SessionCanceling && session.State != restapi.SessionClosed {
+				used[session.Tenant] += len(session.Gpus)
+			}
+		}
+	}
+
+	return used
+}
+
+// Returns the GPUs each tenant uses beyond its guarantee
+func (quotas *tenantQuotas) borrowed(used map[string]int) map[string]int {
+	borrowed := map[string]int{}
+	for tenant, gpus := range used {
+		if quota := quotas.forTenant(tenant); quota != nil && gpus > quota.GuaranteedGpus {
+			borrowed[tenant] = gpus - quota.GuaranteedGpus
+		}
+	}
+
+	return borrowed
+}
+
+// Returns whether the session may use the GPUs given the GPUs its tenant uses on the agents,
+// and whether it borrows them, must be called with the assignMutex held. Usage is counted over
+// the schedulable agents, sessions on agents draining or missing are not counted.
+func (backend *Backend) checkQuota(session storage.QueuedSession, gpus []restapi.SessionGpu) (bool, bool) {
+	quota := backend.tenantQuotas().forTenant(session.Requirements.Tenant)
+	if quota == nil || len(gpus) == 0 {
+		return true, false
+	}
+
+	used := gpusInUse(backend.cache.all())[session.Requirements.Tenant] + len(gpus)
+	if used > burstGpus(*quota) {
+		logger.Tracef("%s would exceed the %d GPUs tenant %s may burst to", session.Id, burstGpus(*quota), session.Requirements.Tenant)
+		return false, false
+	}
+
+	return true, used > quota.GuaranteedGpus
+}
+
+// Marks the session assigned beyond its tenant's guarantee preemptible
+func (backend *Backend) borrow(session storage.QueuedSession, agentId string, gpus []restapi.SessionGpu) error {
+	err := backend.storage.SetSessionPreemptible(session.Id, true)
+	if err != nil {
+		return err
+	}
+
+	tenant := session.Requirements.Tenant
+	quota := backend.tenantQuotas().forTenant(tenant)
+	used := gpusInUse(backend.cache.all())[tenant]
+
+	prometheus.ObserveQuotaBorrowed(tenant)
+	backend.publish(restapi.Event{
+		Type:      restapi.EventQuotaBorrowed,
+		Message:   fmt.Sprintf("session %s of tenant %s borrowed %d GPUs beyond its guarantee of %d", session.Id, tenant, len(gpus), quota.GuaranteedGpus),
+		AgentId:   agentId,
+		SessionId: session.Id,
+		Data: map[string]string{
+			"tenant":         tenant,
+			"gpus":           fmt.Sprint(used),
+			"guaranteedGpus": fmt.Sprint(quota.GuaranteedGpus),
+			"burstGpus":      fmt.Sprint(burstGpus(*quota)),
+		},
+	})
+
+	return nil
+}
+
+// Returns the preemptible sessions to cancel on the agent for the requirements to fit, those of
+// preemptible classes first, then those of the lowest priorities below the requirements' with
+// --priority-preemption, and then those borrowing beyond their tenant's quota, taking no more from
+// each tenant than it borrows, false when the requirements cannot fit on the agent. Sessions
+// already being canceled are counted as freed.
+func (backend *Backend) reclaimable(agent restapi.Agent, requirements restapi.SessionRequirements, borrowed map[string]int) ([]restapi.Session, bool) {
+	if !storage.AgentEligible(agent, requirements) {
+		return nil, false
+	}
+
+	remaining := agent
+	remaining.Sessions = []restapi.Session{}
+
+	preemptible := []restapi.Session{}
+	for _, session := range agent.Sessions {
+		if session.State == restapi.SessionCanceling {
+			continue
+		}
+
+		remaining.Sessions = append(remaining.Sessions, session)
+		if len(session.Gpus) > 0 && (backend.preemptibleClass(session.Class) || backend.lowerPriority(session, requirements.Priority) || (session.Preemptible && borrowed[session.Tenant] > 0)) {
+			preemptible = append(preemptible, session)
+		}
+	}
+
+	sort.Slice(preemptible, func(i, j int) bool {
+		iClass, jClass := backend.preemptibleClass(preemptible[i].Class), backend.preemptibleClass(preemptible[j].Class)
+		if iClass != jClass {
+			return iClass
+		}
+
+		iLower, jLower := backend.lowerPriority(preemptible[i], requirements.Priority), backend.lowerPriority(preemptible[j], requirements.Priority)
+		if iLower != jLower {
+			return iLower
+		}
+
+		if iLower && preemptible[i].Priority != preemptible[j].Priority {
+			return preemptible[i].Priority < preemptible[j].Priority
+		}
+
+		return preemptible[i].Id < preemptible[j].Id
+	})
+
+	left := map[string]int{}
+	for tenant, gpus := range borrowed {
+		left[tenant] = gpus
+	}
+
+	victims := []restapi.Session{}
+	for {
+		candidate, err := backend.agentMatches(remaining, requirements)
+		if err == nil && candidate != nil {
+			return victims, true
+		}
+
+		if len(preemptible) == 0 {
+			return nil, false
+		}
+
+		victim := preemptible[0]
+		preemptible = preemptible[1:]
+		if !backend.preemptibleClass(victim.Class) && !backend.lowerPriority(victim, requirements.Priority) {
+			if left[victim.Tenant] < len(victim.Gpus) {
+				continue
+			}
+			left[victim.Tenant] -= len(victim.Gpus)
+		}
+
+		for index, session := range remaining.Sessions {
+			if session.Id == victim.Id {
+				remaining.Sessions = append(remaining.Sessions[:index:index], remaining.Sessions[index+1:]...)
+				break
+			}
+		}
+		victims = append(victims, victim)
+	}
+}
+
+// Cancels the sessions of preemptible classes, preempts the sessions of lower priorities with
+// --priority-preemption, and cancels the preemptible sessions of tenants using more than their
+// guarantee when the session's tenant is within its guarantee, to make room for a session left
+// unassigned that is not of a preemptible class, on the agent needing the fewest canceled. The
+// session is placed by a later pass once the agent closes them, ahead of the preempted sessions
+// returned to the queue by its higher priority.
+func (backend *Backend) reclaimFor(session storage.QueuedSession) error {
+	if len(session.Requirements.Gpus) == 0 || backend.preemptibleClass(session.Requirements.Class) {
+		return nil
+	}
+
+	tenant := session.Requirements.Tenant
+	quotas := backend.tenantQuotas()
+	quota := quotas.forTenant(tenant)
+
+	backend.assignMutex.Lock()
+	defer backend.assignMutex.Unlock()
+
+	agents := backend.cache.all()
+
+	borrowed := map[string]int{}
+	if quota != nil {
+		used := gpusInUse(agents)
+		if used[tenant]+len(session.Requirements.Gpus) <= quota.GuaranteedGpus {
+			borrowed = quotas.borrowed(used)
+		}
+	}
+
+	if len(borrowed) == 0 && !backend.runsPreemptibleClass(agents) && !backend.runsLowerPriority(agents, session.Requirements.Priority) {
+		return nil
+	}
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Id < agents[j].Id
+	})
+
+	var chosen *restapi.Agent
+	var victims []restapi.Session
+	for index := range agents {
+		reclaimed, fits := backend.reclaimable(agents[index], session.Requirements, borrowed)
+		if fits && (chosen == nil || len(reclaimed) < len(victims)) {
+			chosen = &agents[index]
+			victims = reclaimed
+		}
+	}
+
+	// Either no agent fits the session or the GPUs are already being returned
+	if chosen == nil || len(victims) == 0 {
+		return nil
+	}
+
+	var err error
+	for _, victim := range victims {
+		// Sessions of preemptible classes are canceled outright, those of lower priorities return
+		// to the queue
+		requeue := !backend.preemptibleClass(victim.Class) && backend.lowerPriority(victim, session.Requirements.Priority)
+
+		var err_ error
+		if requeue {
+			err_ = backend.storage.PreemptSession(victim.Id)
+		} else {
+			err_ = backend.storage.CancelSession(victim.Id)
+		}
+		if err_ != nil {
+			err = errors.Join(err, err_)
+			continue
+		}
+
+		backend.cache.canceling(chosen.Id, victim.Id)
+
+		if requeue {
+			backend.publishRequeued(victim, chosen.Id, session)
+			continue
+		}
+
+		if backend.preemptibleClass(victim.Class) {
+			backend.publishPreempted(victim, chosen.Id, session)
+			continue
+		}
+
+		logger.WithSession(victim.Id).Infof("reclaiming the GPUs session %s of tenant %s borrowed for session %s of tenant %s", victim.Id, victim.Tenant, session.Id, tenant)
+		prometheus.ObserveQuotaReclaimed(victim.Tenant)
+		backend.publish(restapi.Event{
+			Type:      restapi.EventQuotaReclaimed,
+			Message:   fmt.Sprintf("session %s of tenant %s was canceled to return the GPUs it borrowed to tenant %s", victim.Id, victim.Tenant, tenant),
+			AgentId:   chosen.Id,
+			SessionId: victim.Id,
+			Data: map[string]string{
+				"tenant":     victim.Tenant,
+				"forTenant":  tenant,
+				"forSession": session.Id,
+			},
+		})
+	}
+
+	return err
+}
+
+// Records the GPUs used and borrowed by the tenants with a quota
+func (backend *Backend) observeQuotas() {
+	quotas := backend.tenantQuotas()
+	if quotas == nil {
+		return
+	}
+
+	used := map[string]int{}
+	for tenant := range quotas.Tenants {
+		used[tenant] = 0
+	}
+
+	for tenant, gpus := range gpusInUse(backend.cache.all()) {
+		if quotas.forTenant(tenant) != nil {
+			used[tenant] = gpus
+		}
+	}
+
+	prometheus.ObserveTenantGpus(used, quotas.borrowed(used))
+}
@@ -0,0 +1,128 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Reserved sessions whose window started are placed ahead of the on-demand sessions of their pool
+func sortReservationsFirst(sessions []storage.QueuedSession) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Requirements.Reservation != nil && sessions[j].Requirements.Reservation == nil
+	})
+}
+
+// Returns the VRAM held for the reserved sessions of the pool not yet placed, those queued to be
+// placed by the pass and those whose window has yet to start
+func heldVram(sessions []storage.QueuedSession, held []storage.QueuedSession) uint64 {
+	var vram uint64
+	for _, session := range sessions {
+		if session.Requirements.Reservation != nil {
+			vram += storage.TotalVramRequired(session.Requirements)
+		}
+	}
+
+	for _, session := range held {
+		vram += storage.TotalVramRequired(session.Requirements)
+	}
+
+	return vram
+}
+
+// Returns whether the on-demand session fits in the VRAM left once the VRAM held for reserved
+// sessions is set aside
+func (backend *Backend) fitsAroundHolds(session storage.QueuedSession, held uint64) bool {
+	vramRequired := storage.TotalVramRequired(session.Requirements)
+	return vramRequired == 0 || backend.cache.vramAvailable(session.Requirements) >= held+vramRequired
+}
+
+// Closes the queued reserved sessions whose window ended before they were placed
+func (backend *Backend) closeReservationsEnded(sessions []storage.QueuedSession) error {
+	var err error
+	for _, session := range sessions {
+		err_ := backend.storage.CancelSession(session.Id)
+		if err_ != nil {
+			err = errors.Join(err, err_)
+			continue
+		}
+
+		logger.WithSession(session.Id).Infof("closing session %s, its reservation ended before it was placed", session.Id)
+		backend.publishReservationEnded(session.Id, "", *session.Requirements.Reservation, false)
+		backend.publish(restapi.Event{
+			Type:      restapi.EventSessionStateChanged,
+			Message:   fmt.Sprintf("session %s is %s", session.Id, restapi.SessionClosed),
+			SessionId: session.Id,
+			Data: map[string]string{
+				"state":      restapi.SessionClosed,
+				"exitStatus": restapi.ExitStatusCanceled,
+			},
+		})
+	}
+
+	return err
+}
+
+// Cancels the placed reserved sessions whose window ended, returning their GPUs to the pool
+func (backend *Backend) cancelReservationsEnded() error {
+	now := backend.clock.Now()
+
+	var err error
+	for _, agent := range backend.cache.all() {
+		for _, session := range agent.Sessions {
+			if session.Reservation == nil || now.Before(session.Reservation.EndAt()) {
+				continue
+			}
+
+			if session.State != restapi.SessionAssigned && session.State != restapi.SessionActive {
+				continue
+			}
+
+			err_ := backend.storage.CancelSession(session.Id)
+			if err_ != nil {
+				err = errors.Join(err, err_)
+				continue
+			}
+
+			backend.cache.canceling(agent.Id, session.Id)
+
+			logger.WithSession(session.Id).Infof("canceling session %s, its reservation ended", session.Id)
+			backend.publishReservationEnded(session.Id, agent.Id, *session.Reservation, true)
+			backend.publish(restapi.Event{
+				Type:      restapi.EventSessionStateChanged,
+				Message:   fmt.Sprintf("session %s is %s", session.Id, restapi.SessionCanceling),
+				AgentId:   agent.Id,
+				SessionId: session.Id,
+				Data: map[string]string{
+					"state":      restapi.SessionCanceling,
+					"exitStatus": "",
+				},
+			})
+		}
+	}
+
+	return err
+}
+
+func (backend *Backend) publishReservationEnded(sessionId string, agentId string, reservation restapi.SessionReservation, placed bool) {
+	backend.publish(restapi.Event{
+		Type:      restapi.EventSessionReservationEnded,
+		Message:   fmt.Sprintf("the reservation of session %s ended at %s", sessionId, reservation.EndAt().UTC().Format(time.RFC3339)),
+		AgentId:   agentId,
+		SessionId: sessionId,
+		Data: map[string]string{
+			"startAt": reservation.StartAt.UTC().Format(time.RFC3339),
+			"endAt":   reservation.EndAt().UTC().Format(time.RFC3339),
+			"placed":  strconv.FormatBool(placed),
+		},
+	})
+}
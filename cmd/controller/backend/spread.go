@@ -0,0 +1,122 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	placementTopN      = flag.Int("placement-top-n", 1, "Chooses the agent of each session at random among this many of its best placements, weighted by --placement-weighting, rather than always the best. Controllers placing sessions concurrently then rarely choose the same agent, reducing the assignments that conflict and are retried. 1 always chooses the best")
+	placementWeighting = flag.String("placement-weighting", weightingLinear, "How the best placements are weighted by their rank when --placement-top-n is greater than 1, uniform, linear for N for the best then N-1 down to 1, or exponential for half the weight of the placement ranked before")
+)
+
+const (
+	weightingUniform     = "uniform"
+	weightingLinear      = "linear"
+	weightingExponential = "exponential"
+)
+
+// Spreads the sessions over the best placements rather than placing every session on the best,
+// see --placement-top-n
+type placementSpreader struct {
+	// Pools are scheduled concurrently and rand.Rand is not safe for concurrent use
+	mutex  sync.Mutex
+	random *rand.Rand
+
+	topN int
+	// Returns the weight of the placement ranked rank, from 0, of count placements
+	weight func(rank int, count int) float64
+}
+
+// Returns nil when --placement-top-n always chooses the best placement
+func newPlacementSpreader() (*placementSpreader, error) {
+	if *placementTopN < 1 {
+		return nil, errors.New("--placement-top-n must be at least 1")
+	}
+
+	if *placementTopN == 1 {
+		return nil, nil
+	}
+
+	spreader := &placementSpreader{
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		topN:   *placementTopN,
+	}
+
+	switch *placementWeighting {
+	case weightingUniform:
+		spreader.weight = func(rank int, count int) float64 {
+			return 1
+		}
+
+	case weightingLinear:
+		spreader.weight = func(rank int, count int) float64 {
+			return float64(count - rank)
+		}
+
+	case weightingExponential:
+		spreader.weight = func(rank int, count int) float64 {
+			return math.Pow(0.5, float64(rank))
+		}
+
+	default:
+		return nil, fmt.Errorf("--placement-weighting must be %s, %s, or %s", weightingUniform, weightingLinear, weightingExponential)
+	}
+
+	return spreader, nil
+}
+
+// Reorders the best placements, sorted best first, at random by their weight. The placements after
+// them keep their order, so are still tried when the agents of the best decline the session. Only
+// placements as close to the client as the best are spread over, locality is not traded for it.
+// Safe to call on nil.
+func (spreader *placementSpreader) spread(placements []*placement) {
+	if spreader == nil || len(placements) < 2 {
+		return
+	}
+
+	count := 1
+	for count < len(placements) && count < spreader.topN && placements[count].distance.tier == placements[0].distance.tier {
+		count++
+	}
+
+	ranks := make([]int, count)
+	for index := range ranks {
+		ranks[index] = index
+	}
+
+	best := make([]*placement, count)
+	copy(best, placements[:count])
+
+	spreader.mutex.Lock()
+	defer spreader.mutex.Unlock()
+
+	// Chooses each position in turn from the placements not yet chosen
+	for position := 0; position < count; position++ {
+		total := 0.0
+		for _, rank := range ranks[position:] {
+			total += spreader.weight(rank, count)
+		}
+
+		chosen := len(ranks) - 1
+		value := spreader.random.Float64() * total
+		for index := position; index < len(ranks); index++ {
+			value -= spreader.weight(ranks[index], count)
+			if value < 0 {
+				chosen = index
+				break
+			}
+		}
+
+		ranks[position], ranks[chosen] = ranks[chosen], ranks[position]
+		placements[position] = best[ranks[position]]
+	}
+}
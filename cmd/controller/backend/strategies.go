@@ -0,0 +1,90 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	placementStrategy = flag.String("placement-strategy", restapi.PlacementBinPack, "How sessions are placed among the agents they fit on, binpack for the agent leaving the least VRAM free to consolidate sessions, spread for the agent running the fewest sessions to minimize contention, or random. Sessions may request their own through their placement requirement")
+)
+
+func validatePlacementStrategy() error {
+	if !restapi.IsPlacementStrategy(*placementStrategy) {
+		return fmt.Errorf("--placement-strategy must be %s, %s, or %s", restapi.PlacementBinPack, restapi.PlacementSpread, restapi.PlacementRandom)
+	}
+
+	return nil
+}
+
+// Returns the placement strategy of the session, the one it requested or --placement-strategy
+func sessionPlacementStrategy(requirements restapi.SessionRequirements) string {
+	if restapi.IsPlacementStrategy(requirements.Placement) {
+		return requirements.Placement
+	}
+
+	return *placementStrategy
+}
+
+// Returns whether p leaves less VRAM free on the GPUs chosen than other, and then the agent less
+// fragmented, keeping larger GPUs free for larger requests. The second value is false when they
+// fit as well.
+func (p placement) betterFit(other *placement) (bool, bool) {
+	if p.vramRemaining != other.vramRemaining {
+		return p.vramRemaining < other.vramRemaining, true
+	}
+
+	if p.fragmentation != other.fragmentation {
+		return p.fragmentation < other.fragmentation, true
+	}
+
+	return false, false
+}
+
+// Returns whether p places the session on an agent running fewer sessions than other, and then
+// leaves more VRAM free on the GPUs chosen. The second value is false when they are as
+// contended.
+func (p placement) lessContended(other *placement) (bool, bool) {
+	if len(p.agent.Sessions) != len(other.agent.Sessions) {
+		return len(p.agent.Sessions) < len(other.agent.Sessions), true
+	}
+
+	if p.vramRemaining != other.vramRemaining {
+		return p.vramRemaining > other.vramRemaining, true
+	}
+
+	return false, false
+}
+
+// Sorts the placements best first under the strategy. Random placements are shuffled among those
+// as close to the client, locality is not traded for it.
+func sortPlacements(placements []*placement, strategy string) {
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].betterThan(placements[j], strategy)
+	})
+
+	if strategy != restapi.PlacementRandom {
+		return
+	}
+
+	for start := 0; start < len(placements); {
+		end := start + 1
+		for end < len(placements) && placements[end].distance == placements[start].distance {
+			end++
+		}
+
+		tier := placements[start:end]
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+
+		start = end
+	}
+}
@@ -0,0 +1,18 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package backend
+
+import (
+	"flag"
+	"time"
+)
+
+// The timeouts the backend's housekeeping applies, measured against the storage's clock, see
+// clock.Clock
+var (
+	agentMissingTimeout = flag.Duration("agent-missing-timeout", 30*time.Second, "Marks active agents missing when they have not updated within this duration, their sessions are no longer scheduled on them")
+	missingAgentRemoval = flag.Duration("missing-agent-removal", 5*time.Minute, "Removes agents missing for this duration along with their sessions")
+	unclaimedSessionTtl = flag.Duration("unclaimed-session-ttl", 10*time.Minute, "Cancels sessions whose requester has not retrieved them within this duration, 0 disables")
+	recoveryPeriod      = flag.Duration("recovery-period", 15*time.Second, "After starting, how long the controller waits for agents to report the sessions they run before scheduling sessions or marking agents missing, 0 disables")
+)
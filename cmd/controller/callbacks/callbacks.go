@@ -0,0 +1,247 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Posts the outcome of closed sessions to the callback URLs they were requested with, so CI
+// pipelines waiting on remote GPU jobs do not poll the controller
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	callbackSecretFile = flag.String("session-callback-secret-file", "", "File holding the secret session callbacks are signed with, see restapi.SessionCallbackSignatureHeader. Sessions cannot be requested with a callback URL when not set")
+	callbackAttempts   = flag.Int("session-callback-attempts", 5, "Attempts made to send a session's callback before giving up")
+	callbackWindow     = flag.Duration("session-callback-window", 10*time.Minute, "Sessions closed longer ago are no longer sent callbacks, including callbacks left to send when the controller restarted")
+
+	callbackHosts []string
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &callbackHosts}, "session-callback-hosts", "A comma-separated list of the hosts session callbacks may be sent to, any host when not set")
+}
+
+const (
+	callbackInterval = 5 * time.Second
+	callbackTimeout  = 10 * time.Second
+)
+
+// Returns an error when sessions may not be requested with the callback URL
+func ValidateUrl(callbackUrl string) error {
+	if *callbackSecretFile == "" {
+		return pkgerrors.New(pkgerrors.ErrForbidden, "session callbacks are not enabled on the controller")
+	}
+
+	parsed, err := url.ParseRequestURI(callbackUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return pkgerrors.Errorf(pkgerrors.ErrForbidden, "callbackUrl %s is not an http or https URL", callbackUrl)
+	}
+
+	if len(callbackHosts) == 0 {
+		return nil
+	}
+
+	for _, host := range callbackHosts {
+		if strings.EqualFold(host, parsed.Hostname()) {
+			return nil
+		}
+	}
+
+	return pkgerrors.Errorf(pkgerrors.ErrForbidden, "callbackUrl host %s is not allowed by the controller", parsed.Hostname())
+}
+
+type Sender struct {
+	storage storage.Storage
+	bus     *events.Bus
+	secret  []byte
+	client  *http.Client
+
+	// Sessions whose callback was sent or given up on, by id, with when they closed
+	done map[string]time.Time
+	// Failed attempts by session id
+	attempts map[string]int
+}
+
+// Returns nil when --session-callback-secret-file is not set
+func NewSender(storage storage.Storage, bus *events.Bus) (*Sender, error) {
+	if *callbackSecretFile == "" {
+		return nil, nil
+	}
+
+	secret, err := os.ReadFile(*callbackSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", *callbackSecretFile, err)
+	}
+
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("--session-callback-secret-file: %s is empty", *callbackSecretFile)
+	}
+
+	if *callbackAttempts < 1 {
+		return nil, errors.New("--session-callback-attempts must be at least 1")
+	}
+
+	return &Sender{
+		storage: storage,
+		bus:     bus,
+		secret:  secret,
+		client: &http.Client{
+			Timeout: callbackTimeout,
+		},
+		done:     map[string]time.Time{},
+		attempts: map[string]int{},
+	}, nil
+}
+
+func (sender *Sender) Run(group task.Group) error {
+	ticker := time.NewTicker(callbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			err := sender.send(group.Ctx())
+			if err != nil {
+				logger.Warningf("unable to send session callbacks, %v", err)
+			}
+		}
+	}
+}
+
+// Sends the callbacks of the sessions closed within --session-callback-window not yet sent
+func (sender *Sender) send(ctx context.Context) error {
+	iterator, err := sender.storage.GetSessionsClosedWithin(*callbackWindow)
+	if err != nil {
+		return err
+	}
+
+	closed := []storage.ClosedSession{}
+	for iterator.Next() {
+		session := iterator.Value()
+		if _, done := sender.done[session.Id]; !done && session.Requirements.CallbackUrl != "" {
+			closed = append(closed, session)
+		}
+	}
+
+	for _, session := range closed {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		err_ := sender.sendSession(ctx, session)
+		if err_ == nil {
+			sender.done[session.Id] = session.ClosedAt
+			delete(sender.attempts, session.Id)
+			continue
+		}
+
+		sender.attempts[session.Id]++
+		attempts := sender.attempts[session.Id]
+		if attempts < *callbackAttempts {
+			logger.WithSession(session.Id).Debugf("callback of session %s failed, attempt %d of %d, %v", session.Id, attempts, *callbackAttempts, err_)
+			continue
+		}
+
+		sender.done[session.Id] = session.ClosedAt
+		delete(sender.attempts, session.Id)
+
+		host := ""
+		if parsed, err := url.Parse(session.Requirements.CallbackUrl); err == nil {
+			host = parsed.Host
+		}
+
+		sender.bus.Publish(restapi.Event{
+			Type:      restapi.EventSessionCallbackFailed,
+			Message:   fmt.Sprintf("gave up sending the callback of session %s to %s after %d attempts, %v", session.Id, host, attempts, err_),
+			SessionId: session.Id,
+			Data: map[string]string{
+				"host":     host,
+				"attempts": strconv.Itoa(attempts),
+				"error":    err_.Error(),
+			},
+		})
+	}
+
+	sender.forget()
+
+	return nil
+}
+
+// Forgets the sessions closed before the window, which are no longer read
+func (sender *Sender) forget() {
+	before := time.Now().Add(-*callbackWindow)
+	for id, closedAt := range sender.done {
+		if closedAt.Before(before) {
+			delete(sender.done, id)
+		}
+	}
+}
+
+func (sender *Sender) sendSession(ctx context.Context, closed storage.ClosedSession) error {
+	session, err := sender.storage.GetSessionById(closed.Id)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(restapi.SessionCallback{
+		SessionId:   session.Id,
+		ExitStatus:  session.ExitStatus,
+		ClosedAt:    closed.ClosedAt,
+		Tenant:      session.Tenant,
+		User:        session.User,
+		Gpus:        session.Gpus,
+		CpuFallback: session.CpuFallback,
+		Release:     session.Release,
+		Network:     session.Network,
+		Frames:      session.Frames,
+		LogExcerpt:  session.LogExcerpt,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, closed.Requirements.CallbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(restapi.SessionCallbackSignatureHeader, restapi.SignSessionCallback(sender.secret, body))
+
+	response, err := sender.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("callback responded with code %d, %s", response.StatusCode, string(message))
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The source of the current time for the controller's expiry math, such as when agents are
+// marked missing and sessions expire. The postgres storage does its expiry math in the database,
+// against the database's clock.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// The system clock
+var Real Clock = realClock{}
+
+// A clock whose time only changes when advanced or set, for tests
+type Fake struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// Returns a fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now: now,
+	}
+}
+
+func (fake *Fake) Now() time.Time {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.now
+}
+
+func (fake *Fake) Since(t time.Time) time.Duration {
+	return fake.Now().Sub(t)
+}
+
+// Moves the clock forward by duration
+func (fake *Fake) Advance(duration time.Duration) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.now = fake.now.Add(duration)
+}
+
+// Moves the clock to now
+func (fake *Fake) Set(now time.Time) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.now = now
+}
+
+type contextKey struct{}
+
+// Returns a context carrying the clock, storages opened with it read the time from the clock
+func NewContext(ctx context.Context, clock Clock) context.Context {
+	return context.WithValue(ctx, contextKey{}, clock)
+}
+
+// Returns the clock carried by ctx, Real when it carries none
+func FromContext(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(contextKey{}).(Clock); ok {
+		return clock
+	}
+
+	return Real
+}
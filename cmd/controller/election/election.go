@@ -0,0 +1,179 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Elects the controller replica running the scheduling loop among the replicas sharing their
+// storage, all of them serving the API
+package election
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	Enabled = flag.Bool("leader-election", false, "Runs the backend, scheduling sessions and applying retention, callbacks, inventory imports, and webhooks, only on the replica holding the scheduler lease among the controller replicas sharing their storage, such as postgres, while every replica serves the API, see GET /v1/leader. Pools paused and feature flags turned on or off through any replica apply to the leader within --paused-pools-refresh and --feature-refresh")
+
+	leaseDuration = flag.Duration("leader-lease-duration", 15*time.Second, "How long the scheduler lease lasts without being renewed, another replica takes over at most this long after the leader stops, see --leader-election")
+	renewInterval = flag.Duration("leader-renew-interval", 5*time.Second, "Interval between the attempts of each replica to acquire or renew the scheduler lease, at most half of --leader-lease-duration")
+	leaderId      = flag.String("leader-id", "", "Identifies the replica holding the scheduler lease, its hostname and process id when not set, see --leader-election")
+)
+
+type Elector struct {
+	storage storage.Storage
+	bus     *events.Bus
+	id      string
+
+	// Runs the tasks of the leader until the group is canceled
+	lead task.TaskFn
+}
+
+func NewElector(storage storage.Storage, bus *events.Bus, lead task.TaskFn) (*Elector, error) {
+	if *leaseDuration <= 0 || *renewInterval <= 0 {
+		return nil, errors.New("--leader-lease-duration and --leader-renew-interval must be positive")
+	}
+
+	// The leader steps down once it has not renewed the lease for all but an interval of it,
+	// before another replica may acquire it
+	if *renewInterval*2 > *leaseDuration {
+		return nil, fmt.Errorf("--leader-renew-interval %s must be at most half of --leader-lease-duration %s", *renewInterval, *leaseDuration)
+	}
+
+	id := *leaderId
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+
+		id = fmt.Sprint(hostname, "-", os.Getpid())
+	}
+
+	return &Elector{
+		storage: storage,
+		bus:     bus,
+		id:      id,
+		lead:    lead,
+	}, nil
+}
+
+func (elector *Elector) publish(eventType string, message string, data map[string]string) {
+	if elector.bus != nil {
+		elector.bus.Publish(restapi.Event{
+			Type:    eventType,
+			Message: message,
+			Data:    data,
+		})
+	} else {
+		logger.Info(message)
+	}
+}
+
+// Steps down and releases the lease as the controller stops, so another replica takes over
+// without waiting for the lease to expire
+func (elector *Elector) stop(stepDown func(reason string) error) error {
+	err := stepDown("the controller is stopping")
+
+	err_ := elector.storage.ReleaseLease(restapi.SchedulerLease, elector.id)
+	if err_ != nil {
+		logger.Warningf("unable to release the scheduler lease, another replica takes over once it expires, %v", err_)
+	}
+
+	return err
+}
+
+func (elector *Elector) Run(group task.Group) error {
+	logger.Infof("controller replica %s electing the leader", elector.id)
+
+	ticker := time.NewTicker(*renewInterval)
+	defer ticker.Stop()
+
+	var leading *task.TaskManager
+	var renewedAt time.Time
+	previous := ""
+
+	stepDown := func(reason string) error {
+		if leading == nil {
+			return nil
+		}
+
+		leading.Cancel()
+		err := leading.Wait()
+		leading = nil
+
+		elector.publish(restapi.EventControllerLeadershipLost, fmt.Sprintf("controller replica %s stopped leading, %s", elector.id, reason), map[string]string{
+			"holder": elector.id,
+			"reason": reason,
+		})
+
+		return err
+	}
+
+	for {
+		lease, err := elector.storage.AcquireLease(restapi.SchedulerLease, elector.id, *leaseDuration)
+		if err != nil {
+			logger.Warningf("unable to acquire the scheduler lease, %v", err)
+
+			if leading != nil && time.Since(renewedAt) >= *leaseDuration-*renewInterval {
+				err = stepDown("the scheduler lease could not be renewed before it expired")
+				if err != nil {
+					return err
+				}
+			}
+		} else if lease.Holder == elector.id {
+			renewedAt = time.Now()
+
+			if leading == nil {
+				leading = task.NewTaskManager(group.Ctx())
+				leading.GoFn("Leader", elector.lead)
+
+				elector.publish(restapi.EventControllerLeaderElected, fmt.Sprintf("controller replica %s is the leader and runs the scheduling loop", elector.id), map[string]string{
+					"holder":   elector.id,
+					"previous": previous,
+				})
+				previous = elector.id
+			}
+		} else {
+			if lease.Holder != previous {
+				logger.Infof("controller replica %s is the leader", lease.Holder)
+			}
+			previous = lease.Holder
+
+			err = stepDown(fmt.Sprintf("replica %s holds the scheduler lease", lease.Holder))
+			if err != nil {
+				return err
+			}
+		}
+
+		// Done once the leader's tasks fail, stopping the controller as they would without election
+		var failed <-chan struct{}
+		if leading != nil {
+			failed = leading.Ctx().Done()
+		}
+
+		select {
+		case <-group.Ctx().Done():
+			return elector.stop(stepDown)
+
+		case <-failed:
+			if group.Ctx().Err() != nil {
+				return elector.stop(stepDown)
+			}
+
+			err = leading.Wait()
+			leading = nil
+			return err
+
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+type Bus struct {
+	mutex sync.Mutex
+
+	// Event log replayed through /v1/events, nil to not persist events
+	storage storage.Storage
+
+	nextId      int
+	subscribers map[int]chan restapi.Event
+}
+
+func NewBus(storage storage.Storage) *Bus {
+	return &Bus{
+		storage:     storage,
+		subscribers: map[int]chan restapi.Event{},
+	}
+}
+
+// Persists the event, assigning its sequence, and publishes it to every subscriber. Subscribers
+// that are not keeping up drop the event, consumers outside the controller replay the events
+// they missed from the storage.
+func (bus *Bus) Publish(event restapi.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if eventType, known := restapi.LookupEventType(event.Type); known {
+		event.Version = eventType.Version
+	}
+
+	logger.Infof("event %s: %s", event.Type, event.Message)
+
+	// Held while persisting so subscribers receive events in order of sequence
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if bus.storage != nil {
+		persisted, err := bus.storage.AppendEvent(event)
+		if err != nil {
+			logger.Errorf("event %s was not persisted and cannot be replayed, %s", event.Type, err)
+		} else {
+			event = persisted
+		}
+	}
+
+	for _, subscriber := range bus.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			logger.Warningf("event %s dropped, subscriber is full", event.Type)
+		}
+	}
+}
+
+// Returns a channel receiving published events and a function to unsubscribe
+func (bus *Bus) Subscribe(buffer int) (<-chan restapi.Event, func()) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	id := bus.nextId
+	bus.nextId++
+
+	channel := make(chan restapi.Event, buffer)
+	bus.subscribers[id] = channel
+
+	return channel, func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+
+		if _, present := bus.subscribers[id]; present {
+			delete(bus.subscribers, id)
+			close(channel)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package features
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	featureGates   = flag.String("features", "", "Comma separated list of feature=true|false pairs turning the controller's feature flags on or off, see /v1/features for the flags and their defaults. Features turned on or off through /v1/feature/{name} keep that setting over this list")
+	featureRefresh = flag.Duration("feature-refresh", 5*time.Second, "Interval between reloads of the feature flags turned on or off through /v1/feature/{name} from the storage. Features turned on or off through another controller sharing the storage apply within the interval")
+)
+
+const (
+	LocalityScheduling  = "localityScheduling"
+	PerGpuSessionLimits = "perGpuSessionLimits"
+)
+
+// The controller's feature flags. New behaviors are added at alpha or beta so they can be turned
+// off if they misbehave, and once they become stable the flag and the code paths it guards are
+// removed. Behaviors being removed are marked deprecated with the date after which they may go.
+var registry = []restapi.Feature{
+	{
+		Name:        LocalityScheduling,
+		Description: "Prefer agents close to the client from the locality hint in its session requirements",
+		Stage:       restapi.FeatureBeta,
+		Default:     true,
+	},
+	{
+		Name:        PerGpuSessionLimits,
+		Description: "Limit the sessions placed on each GPU to the agent's --max-sessions-per-gpu and the controller's --pool-max-sessions-per-gpu",
+		Stage:       restapi.FeatureBeta,
+		Default:     true,
+	},
+}
+
+type Set struct {
+	storage storage.Storage
+
+	mutex sync.Mutex
+	// Defaults with --features applied
+	configured map[string]bool
+	// configured with the overrides of the storage applied
+	enabled map[string]bool
+}
+
+// Returns the feature flags with those given in --features applied, then those turned on or off
+// through the API by any controller sharing the storage
+func Load(storage storage.Storage) (*Set, error) {
+	if *featureRefresh <= 0 {
+		return nil, errors.New("--feature-refresh must be greater than 0")
+	}
+
+	set := &Set{
+		storage:    storage,
+		configured: map[string]bool{},
+		enabled:    map[string]bool{},
+	}
+
+	for _, feature := range registry {
+		set.configured[feature.Name] = feature.Default
+	}
+
+	var err error
+	if *featureGates != "" {
+		for _, pair := range strings.Split(*featureGates, ",") {
+			keyValue := strings.Split(pair, "=")
+			if len(keyValue) != 2 {
+				err = errors.Join(err, fmt.Errorf("'%s' must be in the format feature=true|false", pair))
+				continue
+			}
+
+			enabled, err_ := strconv.ParseBool(strings.TrimSpace(keyValue[1]))
+			if err_ != nil {
+				err = errors.Join(err, fmt.Errorf("'%s' must be in the format feature=true|false", pair))
+				continue
+			}
+
+			name := strings.TrimSpace(keyValue[0])
+			_, err_ = validate(name, enabled)
+			if err_ == nil {
+				set.configured[name] = enabled
+			}
+			err = errors.Join(err, err_)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --features with %s", err)
+	}
+
+	err = set.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, feature := range registry {
+		if set.Enabled(feature.Name) {
+			warnIfDeprecated(feature)
+		}
+	}
+
+	return set, nil
+}
+
+// Applies the overrides of the storage to the configured features
+func (set *Set) load() error {
+	overrides, err := set.storage.GetFeatureOverrides()
+	if err != nil {
+		return err
+	}
+
+	enabled := map[string]bool{}
+	for name, configured := range set.configured {
+		enabled[name] = configured
+	}
+
+	for _, override := range overrides {
+		// Overrides of features another version of the controller has are ignored
+		if _, err := validate(override.Name, override.Enabled); err == nil {
+			enabled[override.Name] = override.Enabled
+		}
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	for name, value := range enabled {
+		if previous, present := set.enabled[name]; present && previous != value {
+			logger.Infof("feature %s enabled: %t", name, value)
+		}
+	}
+
+	set.enabled = enabled
+	return nil
+}
+
+// Reloads the overrides every --feature-refresh, so the features turned on or off through another
+// controller apply to this one
+func (set *Set) Run(group task.Group) error {
+	ticker := time.NewTicker(*featureRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			err := set.load()
+			if err != nil {
+				logger.Warningf("unable to reload the feature flags, %v", err)
+			}
+		}
+	}
+}
+
+func warnIfDeprecated(feature restapi.Feature) {
+	if feature.Stage == restapi.FeatureDeprecated {
+		logger.Warningf("feature %s is deprecated and may be removed after %s, disable it with --features %s=false", feature.Name, feature.RemovedAfter, feature.Name)
+	}
+}
+
+func lookup(name string) (restapi.Feature, bool) {
+	for _, feature := range registry {
+		if feature.Name == name {
+			return feature, true
+		}
+	}
+
+	return restapi.Feature{}, false
+}
+
+// Returns whether the feature is enabled, features are at their defaults on a nil Set
+func (set *Set) Enabled(name string) bool {
+	if set == nil {
+		feature, _ := lookup(name)
+		return feature.Default
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	return set.enabled[name]
+}
+
+// Turns the feature on or off for every controller sharing the storage, over their --features
+func (set *Set) Set(name string, enabled bool) (restapi.Feature, error) {
+	feature, err := validate(name, enabled)
+	if err != nil {
+		return restapi.Feature{}, err
+	}
+
+	err = set.storage.SetFeatureOverride(storage.FeatureOverride{
+		Name:    name,
+		Enabled: enabled,
+	})
+	if err != nil {
+		return restapi.Feature{}, err
+	}
+
+	set.mutex.Lock()
+	if set.enabled[name] != enabled {
+		logger.Infof("feature %s enabled: %t", name, enabled)
+	}
+	set.enabled[name] = enabled
+	set.mutex.Unlock()
+
+	if enabled {
+		warnIfDeprecated(feature)
+	}
+
+	feature.Enabled = enabled
+	return feature, nil
+}
+
+func validate(name string, enabled bool) (restapi.Feature, error) {
+	feature, found := lookup(name)
+	if !found {
+		return restapi.Feature{}, fmt.Errorf("feature %s %w", name, pkgerrors.ErrNotFound)
+	}
+
+	if feature.Stage == restapi.FeatureStable && !enabled {
+		return restapi.Feature{}, fmt.Errorf("feature %s is stable and cannot be disabled", name)
+	}
+
+	return feature, nil
+}
+
+// Returns the feature flags ordered by name
+func (set *Set) List() []restapi.Feature {
+	list := make([]restapi.Feature, 0, len(registry))
+	for _, feature := range registry {
+		feature.Enabled = set.Enabled(feature.Name)
+		list = append(list, feature)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Returns whether each feature is enabled, keyed by name
+func (set *Set) Map() map[string]bool {
+	enabled := map[string]bool{}
+	for _, feature := range registry {
+		enabled[feature.Name] = set.Enabled(feature.Name)
+	}
+
+	return enabled
+}
@@ -0,0 +1,590 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const mebibyte = 1024 * 1024
+
+// Returns whether a session with the requirements could be placed on the agent as it is
+func (frontend *Frontend) fitsAgent(agent restapi.Agent, requirements restapi.SessionRequirements) bool {
+	if len(requirements.Gpus) > 0 {
+		selected, err := frontend.capacityGpuSet(agent).Find(requirements.Gpus)
+		if err == nil && selected != nil {
+			return true
+		}
+	}
+
+	return requirements.AllowCpuFallback && agent.CpuFallbackCapacity > storage.CpuFallbackSessions(agent)
+}
+
+func (frontend *Frontend) fitsAnyAgent(agents []*restapi.Agent, requirements restapi.SessionRequirements) bool {
+	for _, agent := range agents {
+		if frontend.fitsAgent(*agent, requirements) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func agentName(agent restapi.Agent) string {
+	return fmt.Sprintf("agent %s (%s)", agent.Id, agent.Hostname)
+}
+
+// Suggests the most VRAM on each GPU, in whole MiB, that lets the session be placed
+func (frontend *Frontend) suggestReduceVram(eligible []*restapi.Agent, requirements restapi.SessionRequirements) *restapi.PlacementSuggestion {
+	var required uint64
+	for _, gpu := range requirements.Gpus {
+		if gpu.VramRequired > required {
+			required = gpu.VramRequired
+		}
+	}
+
+	// The session fits with the VRAM required capped at the VRAM available on one of the GPUs or
+	// at their per-session cap
+	present := map[uint64]bool{}
+	caps := []uint64{}
+	for _, agent := range eligible {
+		candidates := frontend.capacityGpuSet(*agent).VramAvailable()
+		for _, gpu := range agent.Gpus {
+			candidates = append(candidates, gpu.SessionVram)
+		}
+
+		for _, candidate := range candidates {
+			candidate = candidate / mebibyte * mebibyte
+			if candidate > 0 && candidate < required && !present[candidate] {
+				present[candidate] = true
+				caps = append(caps, candidate)
+			}
+		}
+	}
+
+	sort.Slice(caps, func(i, j int) bool {
+		return caps[i] > caps[j]
+	})
+
+	for _, limit := range caps {
+		reduced := requirements
+		reduced.Gpus = make([]restapi.GpuRequirements, len(requirements.Gpus))
+		for index, gpu := range requirements.Gpus {
+			if gpu.VramRequired > limit {
+				gpu.VramRequired = limit
+			}
+			reduced.Gpus[index] = gpu
+		}
+
+		if frontend.fitsAnyAgent(eligible, reduced) {
+			return &restapi.PlacementSuggestion{
+				Kind:         restapi.SuggestionReduceVram,
+				Message:      fmt.Sprintf("reduce the VRAM required on each GPU to %d MiB", limit/mebibyte),
+				VramRequired: limit,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Suggests the most GPUs that let the session be placed
+func (frontend *Frontend) suggestReduceGpus(eligible []*restapi.Agent, requirements restapi.SessionRequirements) *restapi.PlacementSuggestion {
+	for count := len(requirements.Gpus) - 1; count > 0; count-- {
+		reduced := requirements
+		reduced.Gpus = requirements.Gpus[:count]
+
+		if frontend.fitsAnyAgent(eligible, reduced) {
+			return &restapi.PlacementSuggestion{
+				Kind:    restapi.SuggestionReduceGpus,
+				Message: fmt.Sprintf("reduce the GPUs required to %d", count),
+				Gpus:    count,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (frontend *Frontend) suggestCpuFallback(eligible []*restapi.Agent, requirements restapi.SessionRequirements) *restapi.PlacementSuggestion {
+	if requirements.AllowCpuFallback {
+		return nil
+	}
+
+	for _, agent := range eligible {
+		if agent.CpuFallbackCapacity > storage.CpuFallbackSessions(*agent) {
+			return &restapi.PlacementSuggestion{
+				Kind:     restapi.SuggestionAllowCpuFallback,
+				Message:  fmt.Sprintf("allow falling back to CPU rendering on %s", agentName(*agent)),
+				AgentId:  agent.Id,
+				Hostname: agent.Hostname,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the smallest changes to the requirements that match the agent, nil when the session
+// would not fit on the agent once matched
+func (frontend *Frontend) matchAgent(agent restapi.Agent, requirements restapi.SessionRequirements) *restapi.PlacementSuggestion {
+	suggestion := restapi.PlacementSuggestion{
+		AgentId:  agent.Id,
+		Hostname: agent.Hostname,
+	}
+
+	relaxed := requirements
+	relaxed.MatchLabels = map[string]string{}
+	for key, value := range requirements.MatchLabels {
+		if agent.Labels[key] == value {
+			relaxed.MatchLabels[key] = value
+		} else {
+			suggestion.RemoveLabels = append(suggestion.RemoveLabels, key)
+		}
+	}
+
+	relaxed.Tolerates = map[string]string{}
+	for key, value := range requirements.Tolerates {
+		relaxed.Tolerates[key] = value
+	}
+	for key, value := range agent.Taints {
+		if requirements.Tolerates[key] != value {
+			if suggestion.Tolerates == nil {
+				suggestion.Tolerates = map[string]string{}
+			}
+			suggestion.Tolerates[key] = value
+			relaxed.Tolerates[key] = value
+		}
+	}
+
+	relaxed.RequireCapabilities = []string{}
+	for _, capability := range requirements.RequireCapabilities {
+		if agent.HasCapability(capability) {
+			relaxed.RequireCapabilities = append(relaxed.RequireCapabilities, capability)
+		} else {
+			suggestion.RemoveCapabilities = append(suggestion.RemoveCapabilities, capability)
+		}
+	}
+
+	if frontend.scheduling.Paused(storage.Pool(relaxed.MatchLabels)) || !frontend.fitsAgent(agent, relaxed) {
+		return nil
+	}
+
+	sort.Strings(suggestion.RemoveLabels)
+
+	tolerates := []string{}
+	for key, value := range suggestion.Tolerates {
+		tolerates = append(tolerates, fmt.Sprint(key, "=", value))
+	}
+	sort.Strings(tolerates)
+
+	changes := []string{}
+	kinds := 0
+	if len(tolerates) > 0 {
+		suggestion.Kind = restapi.SuggestionTolerateTaints
+		changes = append(changes, fmt.Sprint("tolerate the taints ", strings.Join(tolerates, ", ")))
+		kinds++
+	}
+	if len(suggestion.RemoveLabels) > 0 {
+		suggestion.Kind = restapi.SuggestionDropLabels
+		changes = append(changes, fmt.Sprint("stop matching the labels ", strings.Join(suggestion.RemoveLabels, ", ")))
+		kinds++
+	}
+	if len(suggestion.RemoveCapabilities) > 0 {
+		suggestion.Kind = restapi.SuggestionDropCapabilities
+		changes = append(changes, fmt.Sprint("stop requiring the capabilities ", strings.Join(suggestion.RemoveCapabilities, ", ")))
+		kinds++
+	}
+	if kinds > 1 {
+		suggestion.Kind = restapi.SuggestionMatchAgent
+	}
+
+	suggestion.Message = fmt.Sprintf("%s to be placed on %s", strings.Join(changes, " and "), agentName(agent))
+	return &suggestion
+}
+
+func matchChanges(suggestion restapi.PlacementSuggestion) int {
+	return len(suggestion.Tolerates) + len(suggestion.RemoveLabels) + len(suggestion.RemoveCapabilities)
+}
+
+// Suggests the fewest changes of each kind to the labels matched, taints tolerated, and
+// capabilities required that match an agent the session would fit on. Changes of more than one
+// kind are only suggested when none of a single kind are found.
+func (frontend *Frontend) suggestMatchAgent(allocatable []*restapi.Agent, requirements restapi.SessionRequirements) []restapi.PlacementSuggestion {
+	best := map[string]*restapi.PlacementSuggestion{}
+	for _, agent := range allocatable {
+		if storage.AgentEligible(*agent, requirements) {
+			continue
+		}
+
+		suggestion := frontend.matchAgent(*agent, requirements)
+		if suggestion == nil {
+			continue
+		}
+
+		previous, present := best[suggestion.Kind]
+		if !present || matchChanges(*suggestion) < matchChanges(*previous) {
+			best[suggestion.Kind] = suggestion
+		}
+	}
+
+	suggestions := []restapi.PlacementSuggestion{}
+	for _, kind := range []string{restapi.SuggestionTolerateTaints, restapi.SuggestionDropLabels, restapi.SuggestionDropCapabilities} {
+		if suggestion, present := best[kind]; present {
+			suggestions = append(suggestions, *suggestion)
+		}
+	}
+
+	if len(suggestions) == 0 {
+		if suggestion, present := best[restapi.SuggestionMatchAgent]; present {
+			suggestions = append(suggestions, *suggestion)
+		}
+	}
+
+	return suggestions
+}
+
+// Returns when the session is expected to have closed, zero when unknown
+func sessionClosesAt(session restapi.Session, now time.Time) time.Time {
+	if session.State == restapi.SessionCanceling {
+		return now
+	}
+
+	if session.Reservation != nil {
+		return session.Reservation.EndAt()
+	}
+
+	return time.Time{}
+}
+
+// Returns the sessions that close on the agent before the session fits and when they are
+// expected to have closed, closing the sessions expected to close first. Nil when the session
+// does not fit on the agent without sessions.
+func (frontend *Frontend) waitForSessions(agent restapi.Agent, requirements restapi.SessionRequirements, now time.Time) ([]string, time.Time) {
+	running := []restapi.Session{}
+	for _, session := range agent.Sessions {
+		if !session.CpuFallback && len(session.Gpus) > 0 {
+			running = append(running, session)
+		}
+	}
+
+	sort.SliceStable(running, func(i, j int) bool {
+		closesAt, otherClosesAt := sessionClosesAt(running[i], now), sessionClosesAt(running[j], now)
+		if closesAt.IsZero() || otherClosesAt.IsZero() {
+			return !closesAt.IsZero()
+		}
+
+		return closesAt.Before(otherClosesAt)
+	})
+
+	closed := []string{}
+	var readyAt time.Time
+	for index, session := range running {
+		closesAt := sessionClosesAt(session, now)
+		if index == 0 || (!readyAt.IsZero() && closesAt.After(readyAt)) || closesAt.IsZero() {
+			readyAt = closesAt
+		}
+		closed = append(closed, session.Id)
+
+		agent.Sessions = running[index+1:]
+		if frontend.fitsAgent(agent, requirements) {
+			return closed, readyAt
+		}
+	}
+
+	return nil, time.Time{}
+}
+
+// Suggests waiting for the sessions on an agent the session is eligible for expected to close
+// first, then for the fewest sessions
+func (frontend *Frontend) suggestWaitForSessions(eligible []*restapi.Agent, requirements restapi.SessionRequirements, now time.Time) *restapi.PlacementSuggestion {
+	var best *restapi.PlacementSuggestion
+	for _, agent := range eligible {
+		sessions, readyAt := frontend.waitForSessions(*agent, requirements, now)
+		if sessions == nil {
+			continue
+		}
+
+		if best != nil {
+			if best.ReadyAt.IsZero() != readyAt.IsZero() {
+				if readyAt.IsZero() {
+					continue
+				}
+			} else if !readyAt.Equal(best.ReadyAt) {
+				if readyAt.After(best.ReadyAt) {
+					continue
+				}
+			} else if len(sessions) >= len(best.Sessions) {
+				continue
+			}
+		}
+
+		message := fmt.Sprintf("wait for the sessions %s on %s to close", strings.Join(sessions, ", "), agentName(*agent))
+		if !readyAt.IsZero() {
+			message = fmt.Sprintf("%s, expected in %s", message, readyAt.Sub(now).Round(time.Second))
+		}
+
+		best = &restapi.PlacementSuggestion{
+			Kind:     restapi.SuggestionWaitForSessions,
+			Message:  message,
+			AgentId:  agent.Id,
+			Hostname: agent.Hostname,
+			Sessions: sessions,
+			ReadyAt:  readyAt,
+		}
+	}
+
+	return best
+}
+
+// Suggests waiting for an unavailable agent the session is eligible for and would fit on
+func (frontend *Frontend) suggestWaitForAgent(unavailable []restapi.Agent, requirements restapi.SessionRequirements) *restapi.PlacementSuggestion {
+	for _, agent := range unavailable {
+		if !storage.AgentEligible(agent, requirements) || !frontend.fitsAgent(agent, requirements) {
+			continue
+		}
+
+		reason := "to be enabled"
+		if agent.Draining {
+			reason = "to be resumed from draining"
+		} else if unhealthy := storage.UnhealthyGpus(agent); len(unhealthy) > 0 {
+			reason = fmt.Sprintf("to recover %d unhealthy GPUs", len(unhealthy))
+		}
+
+		return &restapi.PlacementSuggestion{
+			Kind:     restapi.SuggestionWaitForAgent,
+			Message:  fmt.Sprintf("wait for %s %s", agentName(agent), reason),
+			AgentId:  agent.Id,
+			Hostname: agent.Hostname,
+		}
+	}
+
+	return nil
+}
+
+// Places the sessions queued ahead of the session as the next scheduling pass would, then
+// returns whether the session is placed and the smallest changes that would place it when not.
+// The session is queued behind those of its priority when it is not queued yet.
+func (frontend *Frontend) analyzePlacement(session storage.QueuedSession) (restapi.PlacementAnalysis, error) {
+	reader := frontend.storage.StaleReads()
+
+	agents, err := reader.GetAgents()
+	if err != nil {
+		return restapi.PlacementAnalysis{}, err
+	}
+
+	allocatable := []*restapi.Agent{}
+	unavailable := []restapi.Agent{}
+	for agents.Next() {
+		agent := agents.Value()
+		if agent.State != restapi.AgentActive && agent.State != restapi.AgentDisabled {
+			continue
+		}
+
+		if !storage.Schedulable(agent) {
+			unavailable = append(unavailable, agent)
+			continue
+		}
+
+		// Queued sessions placed on the agent are appended to a copy of its sessions
+		sessions := make([]restapi.Session, len(agent.Sessions))
+		copy(sessions, agent.Sessions)
+		agent.Sessions = sessions
+
+		allocatable = append(allocatable, &agent)
+	}
+
+	iterator, err := reader.GetQueuedSessionsIterator()
+	if err != nil {
+		return restapi.PlacementAnalysis{}, err
+	}
+
+	queued := []storage.QueuedSession{}
+	for iterator.Next() {
+		if iterator.Value().Id != session.Id {
+			queued = append(queued, iterator.Value())
+		}
+	}
+
+	queued = append(queued, session)
+	storage.SortQueuedSessions(queued)
+
+	for _, ahead := range queued {
+		if ahead.Id == session.Id {
+			break
+		}
+
+		frontend.placeQueuedSession(allocatable, unavailable, ahead)
+	}
+
+	requirements := session.Requirements
+	analysis := restapi.PlacementAnalysis{
+		Pool:        storage.Pool(requirements.MatchLabels),
+		Blocker:     frontend.placeQueuedSession(allocatable, unavailable, session),
+		Suggestions: []restapi.PlacementSuggestion{},
+	}
+
+	analysis.Schedulable = analysis.Blocker == ""
+	if analysis.Schedulable {
+		return analysis, nil
+	}
+
+	if analysis.Blocker == restapi.BlockerPoolPaused {
+		analysis.Suggestions = append(analysis.Suggestions, restapi.PlacementSuggestion{
+			Kind:    restapi.SuggestionResumePool,
+			Message: fmt.Sprintf("wait for an operator to resume scheduling pool %s", analysis.Pool),
+		})
+		return analysis, nil
+	}
+
+	eligible := []*restapi.Agent{}
+	for _, agent := range allocatable {
+		if storage.AgentEligible(*agent, requirements) {
+			eligible = append(eligible, agent)
+		}
+	}
+
+	for _, suggestion := range []*restapi.PlacementSuggestion{
+		frontend.suggestReduceVram(eligible, requirements),
+		frontend.suggestReduceGpus(eligible, requirements),
+		frontend.suggestCpuFallback(eligible, requirements),
+	} {
+		if suggestion != nil {
+			analysis.Suggestions = append(analysis.Suggestions, *suggestion)
+		}
+	}
+
+	analysis.Suggestions = append(analysis.Suggestions, frontend.suggestMatchAgent(allocatable, requirements)...)
+
+	for _, suggestion := range []*restapi.PlacementSuggestion{
+		frontend.suggestWaitForSessions(eligible, requirements, time.Now()),
+		frontend.suggestWaitForAgent(unavailable, requirements),
+	} {
+		if suggestion != nil {
+			analysis.Suggestions = append(analysis.Suggestions, *suggestion)
+		}
+	}
+
+	return analysis, nil
+}
+
+// Analyzes the placement of a session queued with the requirements now. Reserved sessions are
+// analyzed as if their window started now.
+func (frontend *Frontend) analyzeRequirements(requirements restapi.SessionRequirements) (restapi.PlacementAnalysis, error) {
+	frontend.sessionClasses.Apply(&requirements)
+
+	return frontend.analyzePlacement(storage.QueuedSession{
+		Requirements: requirements,
+		RequestedAt:  time.Now(),
+	})
+}
+
+// Analyzes the placement of the queued session
+func (frontend *Frontend) analyzeQueuedSession(id string) (restapi.PlacementAnalysis, error) {
+	session, err := frontend.storage.GetSessionById(id)
+	if err != nil {
+		return restapi.PlacementAnalysis{}, err
+	}
+
+	if session.State != restapi.SessionQueued {
+		return restapi.PlacementAnalysis{}, pkgerrors.Errorf(pkgerrors.ErrConflict, "session %s is %s rather than queued", id, session.State)
+	}
+
+	iterator, err := frontend.storage.StaleReads().GetQueuedSessionsIterator()
+	if err != nil {
+		return restapi.PlacementAnalysis{}, err
+	}
+
+	for iterator.Next() {
+		if iterator.Value().Id == id {
+			return frontend.analyzePlacement(iterator.Value())
+		}
+	}
+
+	return restapi.PlacementAnalysis{}, pkgerrors.Errorf(pkgerrors.ErrConflict, "session %s is no longer queued", id)
+}
+
+// Returns whether a session with the requirements would be placed and, if not, the smallest
+// changes that would place it, for clients to surface before or while waiting on the queue
+func (frontend *Frontend) analyzeSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/analyze/session").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := frontend.checkClientToken(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			requirements, err := pkgnet.ReadRequestBody[restapi.SessionRequirements](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = frontend.resources.ApplyTemplate(&requirements)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			if requirements.Class != "" && !restapi.IsSessionClass(requirements.Class) {
+				err = fmt.Errorf("class must be %s, %s, or %s", restapi.SessionClassInteractive, restapi.SessionClassBatch, restapi.SessionClassPreemptible)
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			analysis, err := frontend.analyzeRequirements(requirements)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, analysis)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+
+	router.Methods("GET").Path("/v1/session/{id}/analysis").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := frontend.checkClientToken(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			analysis, err := frontend.analyzeQueuedSession(mux.Vars(r)["id"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, analysis)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,363 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/server"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	authorizationPolicyFile = flag.String("authorization-policy-file", "", "JSON file declaring the roles granted by bearer tokens and the roles allowed to use the agent, client, admin, debug, and recordings endpoints, every request is allowed when not set")
+	agentAddress            = flag.String("agent-address", "", "The IP address and port to use for listening for agents, the agent endpoints are then no longer served on --address")
+
+	requireAgentCertificates = flag.Bool("require-agent-certificates", false, "Rejects requests to the agent endpoints, such as registrations, without an agent certificate verified against the certificate authority or --client-ca-file. Agents without a certificate may still request one with --agent-bootstrap-token")
+)
+
+// Groups of endpoints authorized together
+const (
+	// Served to every request on every listener, used to negotiate the API version and bootstrap TLS
+	endpointsPublic = "public"
+	// Used by agents to register, sync, and report their state
+	endpointsAgent = "agent"
+	// Used by juicify and other clients to request and use sessions
+	endpointsClient = "client"
+	// Used by operators to inspect and manage the fleet
+	endpointsAdmin = "admin"
+	// Used by operators to run diagnostic commands in live sessions and profile the controller,
+	// authorized as the admin endpoints when the policy does not list them
+	endpointsDebug = "debug"
+	// Used by operators to retrieve the recordings of sessions, authorized as the admin endpoints
+	// when the policy does not list them
+	endpointsRecordings = "recordings"
+)
+
+// Roles granted without a token
+const (
+	// Granted to every request
+	roleAnonymous = "anonymous"
+	// Granted to requests presenting a certificate issued to an agent by the controller's certificate authority
+	roleAgent = "agent"
+	// Granted to requests presenting a certificate issued to a client by the controller's certificate
+	// authority or a token minted by the controller
+	roleClient = "client"
+)
+
+type authorizationToken struct {
+	Token string   `json:"token"`
+	Roles []string `json:"roles"`
+
+	// Identifies the token without disclosing it, such as to revoke it, see restapi.RevocationToken
+	Name string `json:"name,omitempty"`
+
+	// The user recorded on the sessions requested with the token
+	User string `json:"user,omitempty"`
+	// Service account tokens may request sessions on behalf of the user named by the
+	// restapi.OnBehalfOfHeader header, which is then recorded as the session's user
+	Delegate bool `json:"delegate,omitempty"`
+}
+
+type authorizationPolicy struct {
+	// Roles granted to requests presenting each bearer token
+	Tokens []authorizationToken `json:"tokens"`
+	// Roles allowed to use each group of endpoints, groups not listed allow every request
+	Endpoints map[string][]string `json:"endpoints"`
+
+	// Holds the role bindings granting roles to users, see restapi.RoleBinding
+	resources *resources.Store
+}
+
+// Returns nil when --authorization-policy-file is not set
+func loadAuthorizationPolicy(resources *resources.Store) (*authorizationPolicy, error) {
+	if *authorizationPolicyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(*authorizationPolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", *authorizationPolicyFile, err)
+	}
+
+	policy := &authorizationPolicy{
+		resources: resources,
+	}
+	err = json.Unmarshal(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s, %v", *authorizationPolicyFile, err)
+	}
+
+	for endpoints := range policy.Endpoints {
+		if endpoints != endpointsAgent && endpoints != endpointsClient && endpoints != endpointsAdmin && endpoints != endpointsDebug && endpoints != endpointsRecordings {
+			return nil, fmt.Errorf("%s: unknown endpoint group %s, expected %s, %s, %s, %s, or %s",
+				*authorizationPolicyFile, endpoints, endpointsAgent, endpointsClient, endpointsAdmin, endpointsDebug, endpointsRecordings)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, token := range policy.Tokens {
+		if token.Delegate && token.User == "" {
+			return nil, fmt.Errorf("%s: tokens allowed to delegate must name the user of their service account", *authorizationPolicyFile)
+		}
+
+		if token.Name != "" {
+			if names[token.Name] {
+				return nil, fmt.Errorf("%s: more than one token is named %s", *authorizationPolicyFile, token.Name)
+			}
+			names[token.Name] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// Returns the roles granted to the request by its certificate and bearer token, and by the role
+// bindings of its user
+func (policy *authorizationPolicy) roles(r *http.Request) map[string]struct{} {
+	roles := map[string]struct{}{
+		roleAnonymous: {},
+	}
+
+	if role := certificateRole(r); role != "" {
+		roles[role] = struct{}{}
+	}
+
+	if token := policy.token(r); token != nil {
+		for _, role := range token.Roles {
+			roles[role] = struct{}{}
+		}
+	}
+
+	// Minted tokens are only added to the requests to the client, admin, debug, and recordings
+	// endpoints
+	if _, found := apiTokenOf(r); found {
+		roles[roleClient] = struct{}{}
+	}
+
+	if user := policy.user(r); user != "" {
+		for _, binding := range resources.Specs[restapi.RoleBinding](policy.resources, restapi.ConfigRoleBinding) {
+			for _, bound := range binding.Users {
+				if bound != user {
+					continue
+				}
+
+				for _, role := range binding.Roles {
+					roles[role] = struct{}{}
+				}
+			}
+		}
+	}
+
+	return roles
+}
+
+// Returns the user named by the token presented with the request, the policy's or a minted one,
+// or otherwise the common name of its verified certificate, empty when none names a user
+func (policy *authorizationPolicy) user(r *http.Request) string {
+	if token := policy.token(r); token != nil && token.User != "" {
+		return token.User
+	}
+
+	if token, found := apiTokenOf(r); found && token.User != "" {
+		return token.User
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	return ""
+}
+
+// Returns the role granted by the certificate presented with the request, empty when it presented
+// none. Only certificates verified against the certificate authority or --client-ca-file grant roles.
+func certificateRole(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	for _, usage := range r.TLS.VerifiedChains[0][0].ExtKeyUsage {
+		// Only agent certificates are issued for serving
+		if usage == x509.ExtKeyUsageServerAuth {
+			return roleAgent
+		}
+	}
+
+	return roleClient
+}
+
+// Returns an error when --require-agent-certificates cannot be enforced
+func validateRequireAgentCertificates(tlsConfig *tls.Config) error {
+	if *requireAgentCertificates && (tlsConfig == nil || tlsConfig.ClientCAs == nil) {
+		return errors.New("--require-agent-certificates requires TLS and a certificate authority to verify agents against, see --ca-cert-file, --generate-ca, and --client-ca-file")
+	}
+
+	return nil
+}
+
+// Rejects requests without an agent certificate, other than agents requesting one
+func requireAgentCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == agentCertificatePath || certificateRole(r) == roleAgent {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := pkgerrors.Errorf(pkgerrors.ErrUnauthorized, "%s %s requires an agent certificate, see --require-agent-certificates", r.Method, r.URL.Path)
+		err = errors.Join(err, pkgnet.RespondWithError(w, err))
+		logger.Error(err)
+	})
+}
+
+// Returns the policy's token presented by the request, nil when there is none
+func (policy *authorizationPolicy) token(r *http.Request) *authorizationToken {
+	if policy == nil {
+		return nil
+	}
+
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		for index, granted := range policy.Tokens {
+			if subtle.ConstantTimeCompare([]byte(granted.Token), []byte(token)) == 1 {
+				return &policy.Tokens[index]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the name of the policy's token presented by the request, empty when there is none or
+// it is not named
+func (policy *authorizationPolicy) tokenName(r *http.Request) string {
+	if token := policy.token(r); token != nil {
+		return token.Name
+	}
+
+	return ""
+}
+
+// Returns the user requesting a session and, when the request is made on behalf of the user by
+// a service account, the service account's user. The user is named by the token presented or
+// otherwise the common name of the verified certificate.
+func (policy *authorizationPolicy) requester(r *http.Request) (string, string, error) {
+	user := ""
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		user = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	token := policy.token(r)
+	if token != nil && token.User != "" {
+		user = token.User
+	}
+
+	onBehalfOf := r.Header.Get(restapi.OnBehalfOfHeader)
+	if onBehalfOf == "" {
+		return user, "", nil
+	}
+
+	if token == nil || !token.Delegate {
+		return "", "", pkgerrors.Errorf(pkgerrors.ErrForbidden, "%s requires a token the authorization policy allows to delegate", restapi.OnBehalfOfHeader)
+	}
+
+	return onBehalfOf, user, nil
+}
+
+// Returns whether the request is granted one of the roles the policy allows to use the admin
+// endpoints, never without a policy or when the policy does not restrict them
+func (policy *authorizationPolicy) admin(r *http.Request) bool {
+	if policy == nil {
+		return false
+	}
+
+	roles := policy.roles(r)
+	for _, role := range policy.Endpoints[endpointsAdmin] {
+		if _, granted := roles[role]; granted {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *authorizationPolicy) middleware(endpoints string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if policy == nil || endpoints == endpointsPublic {
+			return next
+		}
+
+		allowed, present := policy.Endpoints[endpoints]
+		if !present && (endpoints == endpointsDebug || endpoints == endpointsRecordings) {
+			allowed, present = policy.Endpoints[endpointsAdmin]
+		}
+		if !present {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			roles := policy.roles(r)
+			for _, role := range allowed {
+				if _, granted := roles[role]; granted {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			err := pkgerrors.Errorf(pkgerrors.ErrUnauthorized, "%s %s requires one of the roles %s", r.Method, r.URL.Path, strings.Join(allowed, ", "))
+			err = errors.Join(err, pkgnet.RespondWithError(w, err))
+			logger.Error(err)
+		})
+	}
+}
+
+// Serves the endpoint on the listener of its group, authorizing its requests by the policy of the group
+func (frontend *Frontend) addEndpoint(endpoints string, createEndpoint server.CreateEndpointFn) {
+	authorized := func(group task.Group, router *mux.Router) error {
+		subrouter := router.NewRoute().Subrouter()
+		if endpoints == endpointsAgent && *requireAgentCertificates {
+			subrouter.Use(requireAgentCertificate)
+		}
+		// Minted tokens identify the users of the sessions they requested to the endpoints of their
+		// sessions, and the users role bindings grant roles to the admin endpoints
+		if endpoints == endpointsClient || endpoints == endpointsAdmin || endpoints == endpointsDebug || endpoints == endpointsRecordings {
+			subrouter.Use(frontend.authenticateApiToken)
+		}
+		if endpoints != endpointsPublic {
+			subrouter.Use(frontend.rejectRevoked)
+		}
+		subrouter.Use(frontend.policy.middleware(endpoints))
+		return createEndpoint(group, subrouter)
+	}
+
+	switch {
+	case frontend.agentServer == nil:
+		frontend.server.AddCreateEndpoint(authorized)
+
+	case endpoints == endpointsPublic:
+		frontend.server.AddCreateEndpoint(authorized)
+		frontend.agentServer.AddCreateEndpoint(authorized)
+
+	case endpoints == endpointsAgent:
+		frontend.agentServer.AddCreateEndpoint(authorized)
+
+	default:
+		frontend.server.AddCreateEndpoint(authorized)
+	}
+}
@@ -0,0 +1,470 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/features"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	capacitySampleInterval = flag.Duration("capacity-sample-interval", time.Minute, "Interval between samples of the demand for VRAM in each pool, the committed VRAM and the VRAM queued sessions require, forecasting when the pools run out of VRAM, see /v1/capacity")
+	capacityTrendWindow    = flag.Duration("capacity-trend-window", 24*time.Hour, "How long the samples of --capacity-sample-interval are kept, the forecast follows the trend of the demand over this window")
+)
+
+const (
+	// Blockers reported for each pool
+	capacityTopBlockers = 5
+
+	// Forecasts need a few samples to tell a trend from noise
+	capacityMinSamples = 3
+	// Exhaustion forecast further out than this is not reported
+	capacityForecastHorizon = 365 * 24 * time.Hour
+)
+
+// Blockers closer to the session being placed are reported over the others when the agents
+// matching disagree
+var blockerCloseness = map[string]int{
+	restapi.BlockerSessionLimit:  4,
+	restapi.BlockerFragmentation: 3,
+	restapi.BlockerVram:          2,
+	restapi.BlockerGpuVram:       1,
+	restapi.BlockerGpuCount:      0,
+}
+
+type capacitySample struct {
+	at     time.Time
+	demand float64
+}
+
+// Samples of the demand for VRAM in each pool, kept in memory for --capacity-trend-window so
+// every frontend forecasts from the samples it took itself
+type capacityTrends struct {
+	mutex   sync.Mutex
+	samples map[string][]capacitySample
+}
+
+func newCapacityTrends() (*capacityTrends, error) {
+	if *capacitySampleInterval <= 0 {
+		return nil, errors.New("--capacity-sample-interval must be greater than 0")
+	}
+
+	if *capacityTrendWindow < *capacitySampleInterval {
+		return nil, errors.New("--capacity-trend-window must be at least --capacity-sample-interval")
+	}
+
+	return &capacityTrends{
+		samples: map[string][]capacitySample{},
+	}, nil
+}
+
+func capacityDemand(capacity restapi.PoolCapacity) float64 {
+	return float64(capacity.CommittedVram + capacity.QueuedVramRequired)
+}
+
+func (trends *capacityTrends) record(capacities []restapi.PoolCapacity, now time.Time) {
+	trends.mutex.Lock()
+	defer trends.mutex.Unlock()
+
+	for _, capacity := range capacities {
+		trends.samples[capacity.Pool] = append(trends.samples[capacity.Pool], capacitySample{
+			at:     now,
+			demand: capacityDemand(capacity),
+		})
+	}
+
+	for pool, samples := range trends.samples {
+		kept := 0
+		for kept < len(samples) && now.Sub(samples[kept].at) > *capacityTrendWindow {
+			kept++
+		}
+
+		if kept == len(samples) {
+			delete(trends.samples, pool)
+		} else {
+			trends.samples[pool] = samples[kept:]
+		}
+	}
+}
+
+// Fits a line to the samples of the pool's demand by least squares and extends it from the
+// current demand until it reaches the allocatable VRAM
+func (trends *capacityTrends) forecast(capacity restapi.PoolCapacity, now time.Time) restapi.CapacityForecast {
+	trends.mutex.Lock()
+	samples := trends.samples[capacity.Pool]
+	trends.mutex.Unlock()
+
+	demand := capacityDemand(capacity)
+	forecast := restapi.CapacityForecast{
+		Samples:   len(samples),
+		Exhausted: demand > float64(capacity.AllocatableVram),
+	}
+
+	if len(samples) < capacityMinSamples {
+		return forecast
+	}
+
+	forecast.WindowSeconds = samples[len(samples)-1].at.Sub(samples[0].at).Seconds()
+
+	var meanX, meanY float64
+	for _, sample := range samples {
+		meanX += sample.at.Sub(samples[0].at).Seconds()
+		meanY += sample.demand
+	}
+	meanX /= float64(len(samples))
+	meanY /= float64(len(samples))
+
+	var covariance, variance float64
+	for _, sample := range samples {
+		x := sample.at.Sub(samples[0].at).Seconds() - meanX
+		covariance += x * (sample.demand - meanY)
+		variance += x * x
+	}
+
+	if variance == 0 {
+		return forecast
+	}
+
+	perSecond := covariance / variance
+	forecast.DemandPerHour = perSecond * time.Hour.Seconds()
+
+	if perSecond > 0 && !forecast.Exhausted {
+		remaining := time.Duration((float64(capacity.AllocatableVram) - demand) / perSecond * float64(time.Second))
+		if remaining <= capacityForecastHorizon {
+			forecast.ExhaustedAt = now.Add(remaining).UTC()
+		}
+	}
+
+	return forecast
+}
+
+func (frontend *Frontend) sampleCapacity(group task.Group) error {
+	ticker := time.NewTicker(*capacitySampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			capacities, err := frontend.getPoolCapacities()
+			if err != nil {
+				logger.Warningf("unable to sample the capacity of the pools, %v", err)
+				continue
+			}
+
+			frontend.capacityTrends.record(capacities, time.Now())
+		}
+	}
+}
+
+// The GPUs of the agent with the VRAM of its sessions allocated, as the backend places sessions
+func (frontend *Frontend) capacityGpuSet(agent restapi.Agent) *gpu.GpuSet {
+	gpuSet := storage.AgentGpuSet(agent)
+	if !frontend.features.Enabled(features.PerGpuSessionLimits) {
+		gpuSet.LimitSessionsPerGpu(0)
+	}
+
+	return gpuSet
+}
+
+// Returns why the session could not be placed on the agent, which it is eligible for
+func (frontend *Frontend) agentBlocker(agent restapi.Agent, requirements restapi.SessionRequirements) string {
+	if len(agent.Gpus) < len(requirements.Gpus) {
+		return restapi.BlockerGpuCount
+	}
+
+	selected, err := gpu.NewGpuSet(agent.Gpus).Find(requirements.Gpus)
+	if err != nil || selected == nil {
+		return restapi.BlockerGpuVram
+	}
+
+	unlimited := storage.AgentGpuSet(agent)
+	unlimited.LimitSessionsPerGpu(0)
+	selected, err = unlimited.Find(requirements.Gpus)
+	if err == nil && selected != nil {
+		return restapi.BlockerSessionLimit
+	}
+
+	var vramAvailable uint64
+	for _, available := range frontend.capacityGpuSet(agent).VramAvailable() {
+		vramAvailable += available
+	}
+
+	if vramAvailable >= storage.TotalVramRequired(requirements) {
+		return restapi.BlockerFragmentation
+	}
+
+	return restapi.BlockerVram
+}
+
+// Places the queued session on the allocatable agents as the next scheduling pass would,
+// returning why it is not placed, empty when it is
+func (frontend *Frontend) placeQueuedSession(allocatable []*restapi.Agent, unavailable []restapi.Agent, session storage.QueuedSession) string {
+	requirements := session.Requirements
+	if frontend.scheduling.Paused(storage.Pool(requirements.MatchLabels)) {
+		return restapi.BlockerPoolPaused
+	}
+
+	eligible := []*restapi.Agent{}
+	for _, agent := range allocatable {
+		if storage.AgentEligible(*agent, requirements) {
+			eligible = append(eligible, agent)
+		}
+	}
+
+	if len(eligible) == 0 {
+		for _, agent := range unavailable {
+			if storage.AgentEligible(agent, requirements) {
+				return restapi.BlockerAgentsUnavailable
+			}
+		}
+
+		return restapi.BlockerNoMatchingAgent
+	}
+
+	blocker := ""
+	if len(requirements.Gpus) > 0 {
+		for _, agent := range eligible {
+			selected, err := frontend.capacityGpuSet(*agent).Find(requirements.Gpus)
+			if err == nil && selected != nil {
+				agent.Sessions = append(agent.Sessions, restapi.Session{
+					Id:    session.Id,
+					State: restapi.SessionAssigned,
+					Gpus:  selected.GetGpus(),
+				})
+				return ""
+			}
+
+			reason := frontend.agentBlocker(*agent, requirements)
+			if blocker == "" || blockerCloseness[reason] > blockerCloseness[blocker] {
+				blocker = reason
+			}
+		}
+	}
+
+	if requirements.AllowCpuFallback {
+		for _, agent := range eligible {
+			if agent.CpuFallbackCapacity > storage.CpuFallbackSessions(*agent) {
+				agent.Sessions = append(agent.Sessions, restapi.Session{
+					Id:          session.Id,
+					State:       restapi.SessionAssigned,
+					CpuFallback: true,
+				})
+				return ""
+			}
+		}
+	}
+
+	if blocker == "" {
+		blocker = restapi.BlockerVram
+	}
+
+	return blocker
+}
+
+// Returns the capacity of each pool ordered by name, without forecasts
+func (frontend *Frontend) getPoolCapacities() ([]restapi.PoolCapacity, error) {
+	pools := map[string]*restapi.PoolCapacity{}
+	get := func(pool string) *restapi.PoolCapacity {
+		capacity, present := pools[pool]
+		if !present {
+			capacity = &restapi.PoolCapacity{
+				Pool:     pool,
+				Paused:   frontend.scheduling.Paused(pool),
+				Blockers: []restapi.CapacityBlocker{},
+			}
+			pools[pool] = capacity
+		}
+
+		return capacity
+	}
+
+	// Both reads come from the same view so the agents and queued sessions are equally stale
+	reader := frontend.storage.StaleReads()
+
+	agents, err := reader.GetAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	// VRAM available on each pool's allocatable agents, weighting their fragmentation
+	vramAvailable := map[string]uint64{}
+
+	allocatable := []*restapi.Agent{}
+	unavailable := []restapi.Agent{}
+	for agents.Next() {
+		agent := agents.Value()
+		if agent.State != restapi.AgentActive && agent.State != restapi.AgentDisabled {
+			continue
+		}
+
+		pool := storage.Pool(agent.Labels)
+		capacity := get(pool)
+		capacity.Agents++
+		capacity.Gpus += len(agent.Gpus)
+		capacity.Vram += storage.TotalVram(agent.Gpus)
+
+		if !storage.Schedulable(agent) {
+			unavailable = append(unavailable, agent)
+			continue
+		}
+
+		allocated := storage.WithVramAllocation(agent)
+		capacity.AllocatableAgents++
+		capacity.AllocatableGpus += len(agent.Gpus)
+		capacity.AllocatableVram += storage.TotalVram(agent.Gpus)
+
+		var agentVramAvailable uint64
+		for _, gpu := range allocated.Gpus {
+			capacity.CommittedVram += gpu.Vram - gpu.VramAvailable
+			if gpu.Sessions > 0 {
+				capacity.CommittedGpus++
+			}
+
+			if gpu.VramAvailable > capacity.LargestVramAvailable {
+				capacity.LargestVramAvailable = gpu.VramAvailable
+			}
+
+			agentVramAvailable += gpu.VramAvailable
+		}
+
+		capacity.Fragmentation += allocated.VramFragmentation * float64(agentVramAvailable)
+		vramAvailable[pool] += agentVramAvailable
+
+		// Queued sessions placed on the agent are appended to a copy of its sessions
+		sessions := make([]restapi.Session, len(agent.Sessions))
+		copy(sessions, agent.Sessions)
+		agent.Sessions = sessions
+
+		allocatable = append(allocatable, &agent)
+	}
+
+	for pool, capacity := range pools {
+		if vramAvailable[pool] > 0 {
+			capacity.Fragmentation /= float64(vramAvailable[pool])
+		}
+	}
+
+	iterator, err := reader.GetQueuedSessionsIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	queued := []storage.QueuedSession{}
+	for iterator.Next() {
+		queued = append(queued, iterator.Value())
+	}
+
+	storage.SortQueuedSessions(queued)
+
+	blockers := map[string]map[string]*restapi.CapacityBlocker{}
+	for _, session := range queued {
+		pool := storage.Pool(session.Requirements.MatchLabels)
+		vramRequired := storage.TotalVramRequired(session.Requirements)
+
+		capacity := get(pool)
+		capacity.Queued++
+		capacity.QueuedVramRequired += vramRequired
+
+		reason := frontend.placeQueuedSession(allocatable, unavailable, session)
+		if reason == "" {
+			continue
+		}
+
+		if blockers[pool] == nil {
+			blockers[pool] = map[string]*restapi.CapacityBlocker{}
+		}
+
+		blocker, present := blockers[pool][reason]
+		if !present {
+			blocker = &restapi.CapacityBlocker{
+				Reason:       reason,
+				OldestQueued: session.RequestedAt,
+			}
+			blockers[pool][reason] = blocker
+		}
+
+		blocker.Sessions++
+		blocker.VramRequired += vramRequired
+		if session.RequestedAt.Before(blocker.OldestQueued) {
+			blocker.OldestQueued = session.RequestedAt
+		}
+	}
+
+	capacities := make([]restapi.PoolCapacity, 0, len(pools))
+	for pool, capacity := range pools {
+		for _, blocker := range blockers[pool] {
+			capacity.Blockers = append(capacity.Blockers, *blocker)
+		}
+
+		sort.Slice(capacity.Blockers, func(i, j int) bool {
+			if capacity.Blockers[i].Sessions != capacity.Blockers[j].Sessions {
+				return capacity.Blockers[i].Sessions > capacity.Blockers[j].Sessions
+			}
+
+			return capacity.Blockers[i].Reason < capacity.Blockers[j].Reason
+		})
+
+		if len(capacity.Blockers) > capacityTopBlockers {
+			capacity.Blockers = capacity.Blockers[:capacityTopBlockers]
+		}
+
+		capacities = append(capacities, *capacity)
+	}
+
+	sort.Slice(capacities, func(i, j int) bool {
+		return capacities[i].Pool < capacities[j].Pool
+	})
+
+	return capacities, nil
+}
+
+// Returns the capacity of each pool ordered by name with the forecast of when it runs out of VRAM
+func (frontend *Frontend) getCapacity() ([]restapi.PoolCapacity, error) {
+	capacities, err := frontend.getPoolCapacities()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for index := range capacities {
+		capacities[index].Forecast = frontend.capacityTrends.forecast(capacities[index], now)
+	}
+
+	return capacities, nil
+}
+
+func (frontend *Frontend) getCapacityEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/capacity").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			capacities, err := frontend.getCapacity()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, capacities)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
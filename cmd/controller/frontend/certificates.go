@@ -0,0 +1,161 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	certificateTtl              = flag.Duration("ca-certificate-ttl", 24*time.Hour, "The lifetime of certificates issued to agents and clients by the controller's certificate authority")
+	agentBootstrapToken         = flag.String("agent-bootstrap-token", "", "The token agents must present to be issued a certificate")
+	agentBootstrapTokenFromFile = flag.String("agent-bootstrap-token-from-file", "", "Reads --agent-bootstrap-token from the given file")
+)
+
+// Agents request their certificate before they have one, see --require-agent-certificates
+const agentCertificatePath = "/v1/certificate/agent"
+
+var (
+	errInvalidBootstrapToken      = pkgerrors.New(pkgerrors.ErrUnauthorized, "invalid bootstrap token")
+	errCertificateAuthorityAbsent = pkgerrors.New(pkgerrors.ErrNotFound, "certificate authority is not configured")
+)
+
+func loadBootstrapToken() (string, error) {
+	if *agentBootstrapToken != "" && *agentBootstrapTokenFromFile != "" {
+		return "", errors.New("--agent-bootstrap-token and --agent-bootstrap-token-from-file are mutually exclusive, one or the other but not both")
+	}
+
+	if *agentBootstrapTokenFromFile != "" {
+		text, err := os.ReadFile(*agentBootstrapTokenFromFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read file %s, %v", *agentBootstrapTokenFromFile, err)
+		}
+
+		return strings.TrimSpace(string(text)), nil
+	}
+
+	return *agentBootstrapToken, nil
+}
+
+func (frontend *Frontend) signCertificate(request restapi.CertificateRequest, commonName string, extKeyUsage ...x509.ExtKeyUsage) (restapi.Certificate, error) {
+	if frontend.authority == nil {
+		return restapi.Certificate{}, errCertificateAuthorityAbsent
+	}
+
+	certificate, notAfter, err := frontend.authority.SignCsr([]byte(request.Csr), commonName, *certificateTtl, extKeyUsage...)
+	if err != nil {
+		return restapi.Certificate{}, err
+	}
+
+	return restapi.Certificate{
+		Certificate:   string(certificate),
+		CaCertificate: string(frontend.authority.CertificatePem()),
+		NotAfter:      notAfter,
+	}, nil
+}
+
+func (frontend *Frontend) issueAgentCertificate(request restapi.CertificateRequest) (restapi.Certificate, error) {
+	if frontend.bootstrapToken == "" || subtle.ConstantTimeCompare([]byte(frontend.bootstrapToken), []byte(request.Token)) != 1 {
+		return restapi.Certificate{}, errInvalidBootstrapToken
+	}
+
+	return frontend.signCertificate(request, "", x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth)
+}
+
+func (frontend *Frontend) issueClientCertificate(request restapi.CertificateRequest) (restapi.Certificate, error) {
+	session, err := frontend.storage.GetSessionById(request.SessionId)
+	if err != nil {
+		return restapi.Certificate{}, err
+	}
+
+	if session.State == restapi.SessionClosed {
+		return restapi.Certificate{}, fmt.Errorf("session %s is closed", session.Id)
+	}
+
+	// Client certificates are bound to the session they were requested for
+	return frontend.signCertificate(request, session.Id, x509.ExtKeyUsageClientAuth)
+}
+
+func (frontend *Frontend) getCaCertificateEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/certificate/ca").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if frontend.authority == nil {
+				err := errors.Join(errCertificateAuthorityAbsent, pkgnet.RespondWithError(w, errCertificateAuthorityAbsent))
+				logger.Error(err)
+				return
+			}
+
+			err := pkgnet.RespondWithString(w, http.StatusOK, string(frontend.authority.CertificatePem()))
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) requestAgentCertificateEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path(agentCertificatePath).HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			request, err := pkgnet.ReadRequestBody[restapi.CertificateRequest](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			certificate, err := frontend.issueAgentCertificate(request)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, pkgerrors.HttpStatusOr(err, http.StatusBadRequest), err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, certificate)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) requestClientCertificateEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/certificate/client").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			request, err := pkgnet.ReadRequestBody[restapi.CertificateRequest](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			certificate, err := frontend.issueClientCertificate(request)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, pkgerrors.HttpStatusOr(err, http.StatusBadRequest), err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, certificate)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
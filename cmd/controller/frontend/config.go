@@ -0,0 +1,90 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+func (frontend *Frontend) getConfigResourcesEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/config/{kind}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			kind := mux.Vars(r)["kind"]
+			if _, found := restapi.ConfigKinds[kind]; !found {
+				err := pkgerrors.Errorf(pkgerrors.ErrNotFound, "unknown kind %s", kind)
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			list := frontend.resources.List(kind)
+			for index := range list {
+				list[index] = resources.Redact(list[index])
+			}
+
+			err := pkgnet.Respond(w, http.StatusOK, list)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Creates or replaces the resource for every controller sharing the storage
+func (frontend *Frontend) putConfigResourceEp(group task.Group, router *mux.Router) error {
+	router.Methods("PUT").Path("/v1/config/{kind}/{name}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+
+			resource, err := pkgnet.ReadRequestBody[restapi.ConfigResource](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			resource.Kind = vars["kind"]
+			resource.Name = vars["name"]
+
+			resource, err = frontend.resources.Put(resource)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, pkgerrors.HttpStatusOr(err, http.StatusBadRequest), err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, resources.Redact(resource))
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) deleteConfigResourceEp(group task.Group, router *mux.Router) error {
+	router.Methods("DELETE").Path("/v1/config/{kind}/{name}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+
+			err := frontend.resources.Delete(vars["kind"], vars["name"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	dataChannelPolicyFile = flag.String("data-channel-policy-file", "", "JSON file declaring, by tenant, the restrictions on the files clients push to and pull from their sessions, which agents enforce. Only the agents' limits apply when not set")
+)
+
+// Restrictions on the data channels of sessions by their tenant
+type dataChannelPolicies struct {
+	// Applied to the sessions of tenants not listed, no restrictions when not set
+	Default *restapi.DataChannelPolicy `json:"default,omitempty"`
+	// By tenant, see restapi.SessionRequirements.Tenant
+	Tenants map[string]restapi.DataChannelPolicy `json:"tenants,omitempty"`
+}
+
+func validateDataChannelPolicy(policy restapi.DataChannelPolicy) error {
+	var err error
+	if policy.MaxTransferSize < 0 {
+		err = errors.Join(err, errors.New("maxTransferSize must not be negative"))
+	}
+
+	for _, direction := range policy.Directions {
+		if direction != restapi.DataChannelPush && direction != restapi.DataChannelPull {
+			err = errors.Join(err, fmt.Errorf("unknown direction %s, expected %s or %s", direction, restapi.DataChannelPush, restapi.DataChannelPull))
+		}
+	}
+
+	return err
+}
+
+// Returns nil when --data-channel-policy-file is not set
+func loadDataChannelPolicies() (*dataChannelPolicies, error) {
+	if *dataChannelPolicyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(*dataChannelPolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", *dataChannelPolicyFile, err)
+	}
+
+	policies := &dataChannelPolicies{}
+	err = json.Unmarshal(data, policies)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s, %v", *dataChannelPolicyFile, err)
+	}
+
+	if policies.Default != nil {
+		err = validateDataChannelPolicy(*policies.Default)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid default policy, %v", *dataChannelPolicyFile, err)
+		}
+	}
+
+	for tenant, policy := range policies.Tenants {
+		err = validateDataChannelPolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid policy of tenant %s, %v", *dataChannelPolicyFile, tenant, err)
+		}
+	}
+
+	return policies, nil
+}
+
+// Returns the policy of the tenant, nil when its sessions are not restricted
+func (policies *dataChannelPolicies) forTenant(tenant string) *restapi.DataChannelPolicy {
+	if policies == nil {
+		return nil
+	}
+
+	if policy, found := policies.Tenants[tenant]; found {
+		return &policy
+	}
+
+	return policies.Default
+}
+
+// Sets the data channel policy of the session's tenant, sent to the agent with the session
+func (frontend *Frontend) withDataChannelPolicy(session restapi.Session) restapi.Session {
+	session.DataChannel = frontend.dataChannels.forTenant(session.Tenant)
+	return session
+}
@@ -0,0 +1,103 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Only operators drain agents. An agent registering again with the identity of a draining agent,
+// such as after it restarted, keeps draining until it is resumed.
+func (frontend *Frontend) keepDraining(agent *restapi.Agent) error {
+	agent.Draining = false
+
+	if agent.Id == "" {
+		return nil
+	}
+
+	previous, err := frontend.storage.GetAgentById(agent.Id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	agent.Draining = previous.Draining
+	return nil
+}
+
+// Stops or resumes placing new sessions on the agent, returning the agent
+func (frontend *Frontend) setAgentDraining(id string, draining bool) (restapi.Agent, error) {
+	err := frontend.storage.SetAgentDraining(id, draining)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	agent, err := frontend.getAgentById(id)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	message := fmt.Sprintf("agent %s (%s) is draining, %d sessions left to finish", id, agent.Hostname, len(agent.Sessions))
+	if !draining {
+		message = fmt.Sprintf("agent %s (%s) is no longer draining", id, agent.Hostname)
+	}
+
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventAgentDraining,
+			Message: message,
+			AgentId: id,
+			Data: map[string]string{
+				"hostname": agent.Hostname,
+				"draining": strconv.FormatBool(draining),
+				"sessions": strconv.Itoa(len(agent.Sessions)),
+			},
+		})
+	} else {
+		logger.Info(message)
+	}
+
+	return agent, nil
+}
+
+func (frontend *Frontend) drainAgentEndpoint(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agent, err := frontend.setAgentDraining(mux.Vars(r)["id"], draining)
+		if err != nil {
+			err = errors.Join(err, pkgnet.RespondWithError(w, err))
+			logger.Error(err)
+			return
+		}
+
+		err = pkgnet.Respond(w, http.StatusOK, agent)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// Stops placing new sessions on the agent while the sessions it runs finish, so the agent can be
+// taken out of rotation without interrupting them
+func (frontend *Frontend) drainAgentEp(group task.Group, router *mux.Router) error {
+	router.Methods("PUT").Path("/v1/agent/{id}/drain").HandlerFunc(frontend.drainAgentEndpoint(true))
+	return nil
+}
+
+// Places new sessions on the draining agent again
+func (frontend *Frontend) resumeAgentEp(group task.Group, router *mux.Router) error {
+	router.Methods("DELETE").Path("/v1/agent/{id}/drain").HandlerFunc(frontend.drainAgentEndpoint(false))
+	return nil
+}
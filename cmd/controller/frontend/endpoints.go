@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -14,31 +15,90 @@ import (
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/server"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
 
 func (frontend *Frontend) initializeEndpoints() {
-	frontend.server.AddCreateEndpoint(frontend.getStatusFormer)
-	frontend.server.AddCreateEndpoint(frontend.getStatusEp)
-	frontend.server.AddCreateEndpoint(frontend.registerAgentEp)
-	frontend.server.AddCreateEndpoint(frontend.getAgentEp)
-	frontend.server.AddCreateEndpoint(frontend.getAgentsEp)
-	frontend.server.AddCreateEndpoint(frontend.updateAgentEp)
-	frontend.server.AddCreateEndpoint(frontend.requestSessionEp)
-	frontend.server.AddCreateEndpoint(frontend.getSessionEp)
+	frontend.addEndpoint(endpointsPublic, frontend.getStatusEp)
+	frontend.addEndpoint(endpointsPublic, frontend.getCaCertificateEp)
+
+	frontend.addEndpoint(endpointsAgent, frontend.registerAgentEp)
+	frontend.addEndpoint(endpointsAgent, frontend.getAgentEp)
+	frontend.addEndpoint(endpointsAgent, frontend.updateAgentEp)
+	frontend.addEndpoint(endpointsAgent, frontend.reconcileAgentEp)
+	frontend.addEndpoint(endpointsAgent, frontend.requestAgentCertificateEp)
+	frontend.addEndpoint(endpointsAgent, frontend.requestRecordingKeyEp)
+
+	frontend.addEndpoint(endpointsClient, frontend.requestSessionEp)
+	frontend.addEndpoint(endpointsClient, frontend.getSessionEp)
+	frontend.addEndpoint(endpointsClient, frontend.getSessionTraceEp)
+	frontend.addEndpoint(endpointsClient, frontend.analyzeSessionEp)
+	frontend.addEndpoint(endpointsClient, frontend.releaseSessionEp)
+	frontend.addEndpoint(endpointsClient, frontend.deleteSessionEp)
+	frontend.addEndpoint(endpointsClient, frontend.updateSessionFramesEp)
+	frontend.addEndpoint(endpointsClient, frontend.requestClientCertificateEp)
+	frontend.addEndpoint(endpointsClient, frontend.streamEventsEp)
+
+	frontend.addEndpoint(endpointsAdmin, frontend.getStatusFormer)
+	frontend.addEndpoint(endpointsAdmin, frontend.getAgentsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.drainAgentEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.resumeAgentEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.patchAgentLabelsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getSessionsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getQueueEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.cancelSessionEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getSlosEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getUsageEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getFeaturesEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.updateFeatureEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getPoolSchedulingEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.updatePoolSchedulingEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getLeaderEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getEventsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getEventSchemasEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getJournalEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.importAgentsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getImportEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getFleetHealthEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getCapacityEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getMetricsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getRevocationsEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.revokeCredentialEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.removeRevocationEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getApiTokensEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.mintApiTokenEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.deleteApiTokenEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.getConfigResourcesEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.putConfigResourceEp)
+	frontend.addEndpoint(endpointsAdmin, frontend.deleteConfigResourceEp)
+
+	frontend.addEndpoint(endpointsDebug, frontend.execSessionEp)
+
+	frontend.addEndpoint(endpointsRecordings, frontend.getSessionRecordingEp)
+	frontend.addProfilingEndpoints()
+
+	// Must be last, routes /v2 requests without a dedicated handler to their /v1 handler
+	frontend.server.AddCreateEndpoint(frontend.apiV2ShimEp)
+	if frontend.agentServer != nil {
+		frontend.agentServer.AddCreateEndpoint(frontend.apiV2ShimEp)
+	}
 }
 
 func (frontend *Frontend) getStatusEp(group task.Group, router *mux.Router) error {
 	router.Methods("GET").Path("/v1/status").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			err := pkgnet.Respond(w, http.StatusOK, restapi.Status{
-				State:    "Active",
-				Version:  build.Version,
-				Hostname: frontend.hostname,
+				State:       "Active",
+				Version:     build.Version,
+				Hostname:    frontend.hostname,
+				ApiVersions: servedApiVersions,
+				Features:    frontend.features.Map(),
+				Time:        time.Now().UTC(),
 			})
 
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 			}
 		})
@@ -50,18 +110,22 @@ func (frontend *Frontend) registerAgentEp(group task.Group, router *mux.Router)
 		func(w http.ResponseWriter, r *http.Request) {
 			agent, err := pkgnet.ReadRequestBody[restapi.Agent](r)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
 
+			agent.Address = inferAgentAddress(agent.Address, server.ClientIP(r))
+
 			id, err := frontend.registerAgent(agent)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
 
+			setHeartbeatSchedule(w.Header(), frontend.heartbeats.assign())
+
 			err = pkgnet.RespondWithString(w, http.StatusOK, id)
 			if err != nil {
 				logger.Error(err)
@@ -77,11 +141,15 @@ func (frontend *Frontend) getAgentEp(group task.Group, router *mux.Router) error
 
 			agent, err := frontend.getAgentById(id)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
 
+			if !frontend.reconciled.contains(id) {
+				w.Header().Set(restapi.ReconcileRequestedHeader, "true")
+			}
+
 			pkgnet.Respond(w, http.StatusOK, agent)
 		})
 	return nil
@@ -90,14 +158,22 @@ func (frontend *Frontend) getAgentEp(group task.Group, router *mux.Router) error
 func (frontend *Frontend) getAgentsEp(group task.Group, router *mux.Router) error {
 	router.Methods("GET").Path("/v1/agents").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			agents, err := frontend.getAgents()
+			query, err := parseListQuery(r, "agents", agentStates)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
 				logger.Error(err)
 				return
 			}
 
-			pkgnet.Respond(w, http.StatusOK, agents)
+			page, err := frontend.getAgents(query)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			setPageHeaders(w, "agents", query, page)
+			pkgnet.Respond(w, http.StatusOK, page.Items)
 		})
 	return nil
 }
@@ -109,7 +185,7 @@ func (frontend *Frontend) updateAgentEp(group task.Group, router *mux.Router) er
 
 			update, err := pkgnet.ReadRequestBody[restapi.AgentUpdate](r)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -123,7 +199,7 @@ func (frontend *Frontend) updateAgentEp(group task.Group, router *mux.Router) er
 
 			err = frontend.updateAgent(update)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -136,16 +212,82 @@ func (frontend *Frontend) updateAgentEp(group task.Group, router *mux.Router) er
 func (frontend *Frontend) requestSessionEp(group task.Group, router *mux.Router) error {
 	router.Methods("POST").Path("/v1/request/session").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			err := frontend.checkClientToken(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
 			sessionRequirements, err := pkgnet.ReadRequestBody[restapi.SessionRequirements](r)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
 
+			err = frontend.resources.ApplyTemplate(&sessionRequirements)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			sessionRequirements.User, sessionRequirements.DelegatedBy, err = frontend.requester(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			sessionRequirements.TokenName = frontend.policy.tokenName(r)
+
+			if token, found := apiTokenOf(r); found {
+				sessionRequirements.TokenName = token.Name
+			}
+
+			if sessionRequirements.Placement != "" && !restapi.IsPlacementStrategy(sessionRequirements.Placement) {
+				err = fmt.Errorf("placement must be %s, %s, or %s", restapi.PlacementBinPack, restapi.PlacementSpread, restapi.PlacementRandom)
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			if sessionRequirements.Class != "" && !restapi.IsSessionClass(sessionRequirements.Class) {
+				err = fmt.Errorf("class must be %s, %s, or %s", restapi.SessionClassInteractive, restapi.SessionClassBatch, restapi.SessionClassPreemptible)
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			if sessionRequirements.MetricsPort < 0 || sessionRequirements.MetricsPort > 65535 {
+				err = fmt.Errorf("metricsPort must be between 1 and 65535, or 0 to export no metrics")
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = validateReservation(sessionRequirements.Reservation, time.Now())
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			if sessionRequirements.Record {
+				if frontend.recordingKeyring == nil {
+					err = errors.Join(errRecordingDisabled, pkgnet.RespondWithError(w, errRecordingDisabled))
+					logger.Error(err)
+					return
+				}
+
+				// Recorded sessions are only placed on agents able to record them
+				sessionRequirements.RequireCapabilities = append(sessionRequirements.RequireCapabilities, restapi.CapabilitySessionRecording)
+			}
+
 			id, err := frontend.requestSession(sessionRequirements)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -161,11 +303,18 @@ func (frontend *Frontend) requestSessionEp(group task.Group, router *mux.Router)
 func (frontend *Frontend) getSessionEp(group task.Group, router *mux.Router) error {
 	router.Methods("GET").Path("/v1/session/{id}").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			err := frontend.checkClientToken(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
 			id := mux.Vars(r)["id"]
 
 			session, err := frontend.getSessionById(id)
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 				return
 			}
@@ -177,3 +326,163 @@ func (frontend *Frontend) getSessionEp(group task.Group, router *mux.Router) err
 		})
 	return nil
 }
+
+func (frontend *Frontend) releaseSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/release/session/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			release, err := pkgnet.ReadRequestBody[restapi.SessionRelease](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = frontend.releaseSession(id, release)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
+
+func (frontend *Frontend) updateSessionFramesEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/session/{id}/frames").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			frames, err := pkgnet.ReadRequestBody[restapi.FrameMetrics](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			err = frontend.storage.UpdateSessionFrames(id, frames)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
+
+func (frontend *Frontend) getFeaturesEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/features").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := pkgnet.Respond(w, http.StatusOK, frontend.features.List())
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) updateFeatureEp(group task.Group, router *mux.Router) error {
+	router.Methods("PUT").Path("/v1/feature/{name}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			name := mux.Vars(r)["name"]
+
+			update, err := pkgnet.ReadRequestBody[restapi.FeatureUpdate](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			feature, err := frontend.features.Set(name, update.Enabled)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, feature)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) getPoolSchedulingEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/scheduling/pools").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := pkgnet.Respond(w, http.StatusOK, frontend.scheduling.Status())
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Pauses or resumes scheduling a pool, the pool need not have any agents or sessions yet
+func (frontend *Frontend) updatePoolSchedulingEp(group task.Group, router *mux.Router) error {
+	router.Methods("PUT").Path("/v1/scheduling/pool/{pool}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			pool := mux.Vars(r)["pool"]
+
+			update, err := pkgnet.ReadRequestBody[restapi.PoolSchedulingUpdate](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			status, err := frontend.scheduling.SetPaused(pool, update.Paused)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, status)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Returns the usage of the sessions closed longer ago than --usage-rollup-age by month and tenant
+func (frontend *Frontend) getUsageEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/usage").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			aggregates, err := frontend.storage.StaleReads().GetUsageAggregates()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, aggregates)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) getSlosEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/slos").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			statuses := []restapi.SloStatus{}
+			if frontend.tracker != nil {
+				statuses = frontend.tracker.Status()
+			}
+
+			err := pkgnet.Respond(w, http.StatusOK, statuses)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const (
+	defaultEventReplayLimit = 100
+	maxEventReplayLimit     = 1000
+)
+
+// Parses the since and limit query parameters of /v1/events
+func parseEventReplay(r *http.Request) (uint64, int, error) {
+	query := r.URL.Query()
+
+	var since uint64
+	if value := query.Get("since"); value != "" {
+		var err error
+		since, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("since must be an event sequence, %s", err)
+		}
+	}
+
+	limit := defaultEventReplayLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive number of events")
+		}
+
+		if limit > maxEventReplayLimit {
+			limit = maxEventReplayLimit
+		}
+	}
+
+	return since, limit, nil
+}
+
+// Replays the events published after a sequence, for consumers recovering the events they missed
+func (frontend *Frontend) getEventsEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/events").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			since, limit, err := parseEventReplay(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			events, err := frontend.storage.GetEventsSince(since, limit)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			replay := restapi.EventReplay{
+				Events: events,
+				Next:   since,
+			}
+
+			if len(events) > 0 {
+				replay.Next = events[len(events)-1].Sequence
+
+				// Sequences are consecutive, a gap after since was removed by --event-retention
+				replay.Missed = since > 0 && events[0].Sequence > since+1
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, replay)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) getEventSchemasEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/events/schemas").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			schemas := make([]restapi.EventSchema, 0, len(restapi.EventTypes))
+			for _, eventType := range restapi.EventTypes {
+				schemas = append(schemas, eventType.Schema())
+			}
+
+			err := pkgnet.Respond(w, http.StatusOK, schemas)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	agentExecToken = flag.String("agent-exec-token", "", "Bearer token presented to agents to run diagnostic commands in their sessions, the agents' --exec-token. Running commands is disabled when not set. Commands run only in the sessions of their user unless requested by a role allowed to use the admin endpoints")
+	agentExecTls   = flag.Bool("agent-exec-tls", false, "Connect to agents over TLS to run diagnostic commands, verifying their certificates against the certificate authority when it is enabled")
+)
+
+var errExecDisabled = pkgerrors.New(pkgerrors.ErrForbidden, "running commands in sessions is disabled, see --agent-exec-token")
+
+// Returns the transport used to relay diagnostic commands to agents
+func newExecTransport(authority *crypto.CertificateAuthority) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *agentExecTls && authority != nil {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: authority.CertPool(),
+		}
+	}
+
+	return transport
+}
+
+// Relays a diagnostic command to the agent running the session, streaming its output back.
+// Commands run only in the sessions of the user requesting them, or for the admins of the
+// authorization policy.
+func (frontend *Frontend) execSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/session/{id}/exec").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			if *agentExecToken == "" {
+				err := errors.Join(errExecDisabled, pkgnet.RespondWithError(w, errExecDisabled))
+				logger.Error(err)
+				return
+			}
+
+			request, err := pkgnet.ReadRequestBody[restapi.SessionExec](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			user, _, err := frontend.requester(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			session, err := frontend.storage.GetSessionById(id)
+			if err == nil && (session.User == "" || session.User != user) && !frontend.policy.admin(r) {
+				err = pkgerrors.Errorf(pkgerrors.ErrForbidden, "session %s was requested by another user, commands run only in the sessions of their user unless requested by an admin", id)
+			}
+			if err == nil && session.State != restapi.SessionAssigned && session.State != restapi.SessionActive {
+				err = pkgerrors.Errorf(pkgerrors.ErrConflict, "session %s is %s, commands run only in assigned and active sessions", id, session.State)
+			}
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			body, err := json.Marshal(request)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			command := strings.Join(append([]string{request.Command}, request.Args...), " ")
+
+			if frontend.bus != nil {
+				frontend.bus.Publish(restapi.Event{
+					Type:      restapi.EventSessionExec,
+					Message:   fmt.Sprintf("%s ran in session %s", command, id),
+					SessionId: id,
+					Data: map[string]string{
+						"command": command,
+						"user":    user,
+					},
+				})
+			}
+
+			scheme := "http"
+			if *agentExecTls {
+				scheme = "https"
+			}
+
+			proxy := &httputil.ReverseProxy{
+				Director: func(r *http.Request) {
+					r.URL.Scheme = scheme
+					r.URL.Host = session.Address
+					r.URL.Path = fmt.Sprintf("/v1/session/%s/exec", id)
+					r.URL.RawPath = ""
+					r.URL.RawQuery = ""
+					r.Host = session.Address
+
+					// Credentials presented to the controller are not passed on to the agent
+					r.Header.Del(restapi.OnBehalfOfHeader)
+					r.Header.Set("Authorization", "Bearer "+*agentExecToken)
+
+					r.Body = io.NopCloser(bytes.NewReader(body))
+					r.ContentLength = int64(len(body))
+				},
+				Transport: frontend.execTransport,
+
+				// Output is sent to the client as soon as the agent sends it
+				FlushInterval: -1,
+
+				ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+					err = pkgerrors.Errorf(pkgerrors.ErrUnavailable, "unable to reach agent %s of session %s, %v", session.Address, id, err)
+					err = errors.Join(err, pkgnet.RespondWithError(w, err))
+					logger.Error(err)
+				},
+			}
+
+			proxy.ServeHTTP(w, r)
+		})
+	return nil
+}
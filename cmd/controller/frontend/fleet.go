@@ -0,0 +1,299 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const importBatchSize = 100
+
+var (
+	errInvalidJoinToken = pkgerrors.New(pkgerrors.ErrUnauthorized, "invalid join token")
+)
+
+// Agents exposing an address without a host, or with an unspecified host such as 0.0.0.0,
+// are reached at the address they registered from
+func inferAgentAddress(address string, client net.IP) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || client == nil {
+		return address
+	}
+
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsUnspecified() {
+			return address
+		}
+	}
+
+	return net.JoinHostPort(client.String(), port)
+}
+
+// Matches a registering agent with its expected agent, the agent adopts the expected
+// agent's id, pool, labels, and taints
+func (frontend *Frontend) adoptExpectedAgent(agent *restapi.Agent) error {
+	joinToken := agent.JoinToken
+	agent.JoinToken = ""
+
+	// Agents only keep an identity they have been given by an expected agent
+	agent.Id = ""
+
+	expected, err := frontend.storage.GetExpectedAgentByHostname(agent.Hostname)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if expected.Token != "" && subtle.ConstantTimeCompare([]byte(expected.Token), []byte(joinToken)) != 1 {
+		return errInvalidJoinToken
+	}
+
+	agent.Id = expected.Id
+
+	if agent.Labels == nil {
+		agent.Labels = map[string]string{}
+	}
+	for key, value := range expected.Labels {
+		agent.Labels[key] = value
+	}
+	if expected.Pool != "" {
+		agent.Labels[restapi.PoolLabel] = expected.Pool
+	}
+
+	if agent.Taints == nil {
+		agent.Taints = map[string]string{}
+	}
+	for key, value := range expected.Taints {
+		agent.Taints[key] = value
+	}
+
+	logger.Infof("agent %s adopted expected identity %s", agent.Hostname, agent.Id)
+	return nil
+}
+
+func (frontend *Frontend) getImport(id string) (restapi.ImportStatus, bool) {
+	frontend.importsMutex.Lock()
+	defer frontend.importsMutex.Unlock()
+
+	status, found := frontend.imports[id]
+	return status, found
+}
+
+func (frontend *Frontend) setImport(status restapi.ImportStatus) {
+	frontend.importsMutex.Lock()
+	defer frontend.importsMutex.Unlock()
+
+	frontend.imports[status.Id] = status
+}
+
+// Imports the expected agents in batches, the import status is updated after each batch
+func (frontend *Frontend) importExpectedAgents(status restapi.ImportStatus, agents []restapi.ExpectedAgent) {
+	for start := 0; start < len(agents); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(agents) {
+			end = len(agents)
+		}
+
+		err := frontend.storage.ImportExpectedAgents(agents[start:end])
+		if err != nil {
+			status.State = restapi.ImportFailed
+			status.Error = err.Error()
+			frontend.setImport(status)
+
+			logger.Errorf("import %s failed with %s", status.Id, err)
+			return
+		}
+
+		status.Imported = end
+		frontend.setImport(status)
+	}
+
+	status.State = restapi.ImportCompleted
+	frontend.setImport(status)
+
+	logger.Infof("import %s completed, %d expected agents", status.Id, status.Imported)
+}
+
+func sameGpus(expected []restapi.Gpu, actual []restapi.Gpu) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	names := func(gpus []restapi.Gpu) []string {
+		result := make([]string, len(gpus))
+		for index, gpu := range gpus {
+			result[index] = gpu.Name
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	expectedNames := names(expected)
+	actualNames := names(actual)
+	for index := range expectedNames {
+		if expectedNames[index] != "" && expectedNames[index] != actualNames[index] {
+			return false
+		}
+	}
+
+	if storage.TotalVram(expected) != 0 && storage.TotalVram(expected) != storage.TotalVram(actual) {
+		return false
+	}
+
+	return true
+}
+
+func (frontend *Frontend) getFleetHealth() (restapi.FleetHealth, error) {
+	health := restapi.FleetHealth{
+		Missing:    []string{},
+		Unexpected: []string{},
+		Mismatched: []string{},
+	}
+
+	connected := map[string]restapi.Agent{}
+
+	// Both reads come from the same view so the agents and expected agents are equally stale
+	reader := frontend.storage.StaleReads()
+
+	agents, err := reader.GetAgents()
+	if err != nil {
+		return restapi.FleetHealth{}, err
+	}
+
+	for agents.Next() {
+		agent := agents.Value()
+		if agent.State == restapi.AgentActive || agent.State == restapi.AgentDisabled {
+			connected[agent.Hostname] = agent
+		}
+	}
+
+	health.Connected = len(connected)
+
+	expectedAgents, err := reader.GetExpectedAgents()
+	if err != nil {
+		return restapi.FleetHealth{}, err
+	}
+
+	expected := map[string]bool{}
+	for expectedAgents.Next() {
+		expectedAgent := expectedAgents.Value()
+		expected[expectedAgent.Hostname] = true
+
+		agent, found := connected[expectedAgent.Hostname]
+		if !found {
+			health.Missing = append(health.Missing, expectedAgent.Hostname)
+		} else if len(expectedAgent.Gpus) > 0 && !sameGpus(expectedAgent.Gpus, agent.Gpus) {
+			health.Mismatched = append(health.Mismatched, expectedAgent.Hostname)
+		}
+	}
+
+	health.Expected = len(expected)
+
+	for hostname := range connected {
+		if !expected[hostname] {
+			health.Unexpected = append(health.Unexpected, hostname)
+		}
+	}
+
+	sort.Strings(health.Missing)
+	sort.Strings(health.Unexpected)
+	sort.Strings(health.Mismatched)
+
+	return health, nil
+}
+
+func (frontend *Frontend) importAgentsEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/import/agents").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			agents, err := pkgnet.ReadRequestBody[[]restapi.ExpectedAgent](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			for _, agent := range agents {
+				if agent.Hostname == "" {
+					err = errors.New("expected agents require a hostname")
+					err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+					logger.Error(err)
+					return
+				}
+			}
+
+			status := restapi.ImportStatus{
+				Id:    uuid.NewString(),
+				State: restapi.ImportRunning,
+				Total: len(agents),
+			}
+			frontend.setImport(status)
+
+			group.GoFn(fmt.Sprint("Import ", status.Id), func(group task.Group) error {
+				frontend.importExpectedAgents(status, agents)
+				return nil
+			})
+
+			err = pkgnet.Respond(w, http.StatusAccepted, status)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) getImportEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/import/agents/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			status, found := frontend.getImport(id)
+			if !found {
+				err := pkgerrors.Errorf(pkgerrors.ErrNotFound, "no import found with id %s", id)
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err := pkgnet.Respond(w, http.StatusOK, status)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) getFleetHealthEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/fleet/health").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			health, err := frontend.getFleetHealth()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, health)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -62,7 +62,7 @@ type StatusFormer struct {
 }
 
 func (frontend *Frontend) GetActiveAgents() ([]restapi.Agent, error) {
-	iterator, err := frontend.storage.GetAgents()
+	iterator, err := frontend.storage.StaleReads().GetAgents()
 	if err != nil {
 		return nil, err
 	}
@@ -144,7 +144,7 @@ func (frontend *Frontend) getStatusFormer(group task.Group, router *mux.Router)
 			}
 
 			if err != nil {
-				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusInternalServerError, err.Error()))
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
 				logger.Error(err)
 			}
 		})
@@ -6,10 +6,20 @@ package frontend
 import (
 	"crypto/tls"
 	"flag"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/callbacks"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/features"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/journal"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/slo"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/server"
@@ -27,9 +37,48 @@ type Frontend struct {
 
 	server  *server.Server
 	storage storage.Storage
+
+	// Serves the agent endpoints when --agent-address is set, nil otherwise
+	agentServer *server.Server
+	policy      *authorizationPolicy
+	bus         *events.Bus
+	journal     *journal.Journal
+	tracker     *slo.Tracker
+	features    *features.Set
+	scheduling  *scheduling.Pools
+	resources   *resources.Store
+
+	authority      *crypto.CertificateAuthority
+	bootstrapToken string
+
+	heartbeats *heartbeatScheduler
+	reconciled *reconciledAgents
+
+	// Relays diagnostic commands to the agents running sessions, and retrieves their recordings
+	execTransport *http.Transport
+
+	// Encrypts the keys of recorded sessions, nil when --recording-key-file is not set
+	recordingKeyring *crypto.Keyring
+
+	// Sessions placed on each GPU by pool, from --pool-max-sessions-per-gpu
+	maxSessionsPerGpu map[string]int
+
+	// Nil when --data-channel-policy-file is not set
+	dataChannels *dataChannelPolicies
+
+	// Sets the priority of the sessions requested with a class
+	sessionClasses scheduling.SessionClasses
+
+	revocations *revocations
+
+	// Samples forecasting when the pools run out of VRAM, see /v1/capacity
+	capacityTrends *capacityTrends
+
+	importsMutex sync.Mutex
+	imports      map[string]restapi.ImportStatus
 }
 
-func NewFrontend(tlsConfig *tls.Config, storage storage.Storage) (*Frontend, error) {
+func NewFrontend(tlsConfig *tls.Config, storage storage.Storage, bus *events.Bus, journal *journal.Journal, tracker *slo.Tracker, features *features.Set, pools *scheduling.Pools, resources *resources.Store, authority *crypto.CertificateAuthority) (*Frontend, error) {
 	if tlsConfig == nil {
 		logger.Warning("TLS is disabled, data will be unencrypted")
 	}
@@ -39,16 +88,100 @@ func NewFrontend(tlsConfig *tls.Config, storage storage.Storage) (*Frontend, err
 		return nil, err
 	}
 
-	server, err := server.NewServer(*address, tlsConfig)
+	err = validateRequireAgentCertificates(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateSelfTestAction()
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrapToken, err := loadBootstrapToken()
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := loadAuthorizationPolicy(resources)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats, err := newHeartbeatScheduler()
+	if err != nil {
+		return nil, err
+	}
+
+	maxSessionsPerGpu, err := parsePoolMaxSessionsPerGpu()
+	if err != nil {
+		return nil, err
+	}
+
+	dataChannels, err := loadDataChannelPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	sessionClasses, err := scheduling.LoadSessionClasses()
+	if err != nil {
+		return nil, err
+	}
+
+	revocations, err := newRevocations(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	capacityTrends, err := newCapacityTrends()
+	if err != nil {
+		return nil, err
+	}
+
+	recordingKeyring, err := loadRecordingKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	frontendServer, err := server.NewServer(*address, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 
+	var agentServer *server.Server
+	if *agentAddress != "" {
+		agentServer, err = server.NewServer(*agentAddress, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	frontend := &Frontend{
-		startTime: time.Now(),
-		hostname:  hostname,
-		server:    server,
-		storage:   storage,
+		startTime:      time.Now(),
+		hostname:       hostname,
+		server:         frontendServer,
+		storage:        storage,
+		agentServer:    agentServer,
+		policy:         policy,
+		bus:            bus,
+		journal:        journal,
+		tracker:        tracker,
+		features:       features,
+		scheduling:     pools,
+		resources:      resources,
+		authority:      authority,
+		bootstrapToken: bootstrapToken,
+		heartbeats:     heartbeats,
+		reconciled:     newReconciledAgents(),
+		execTransport:  newExecTransport(authority),
+		imports:        map[string]restapi.ImportStatus{},
+
+		maxSessionsPerGpu: maxSessionsPerGpu,
+		dataChannels:      dataChannels,
+		sessionClasses:    sessionClasses,
+		revocations:       revocations,
+		capacityTrends:    capacityTrends,
+		recordingKeyring:  recordingKeyring,
 	}
 
 	frontend.initializeEndpoints()
@@ -58,40 +191,161 @@ func NewFrontend(tlsConfig *tls.Config, storage storage.Storage) (*Frontend, err
 
 func (frontend *Frontend) Run(group task.Group) error {
 	group.Go("Frontend Server", frontend.server)
+	if frontend.agentServer != nil {
+		group.Go("Frontend Agent Server", frontend.agentServer)
+	}
+	group.GoFn("Frontend Revocations", frontend.revocations.run)
+	group.GoFn("Frontend Capacity", frontend.sampleCapacity)
 	return nil
 }
 
 func (frontend *Frontend) registerAgent(agent restapi.Agent) (string, error) {
 	agent.State = restapi.AgentActive
-	return frontend.storage.RegisterAgent(agent)
+
+	err := frontend.adoptExpectedAgent(&agent)
+	if err != nil {
+		return "", err
+	}
+
+	frontend.limitSessionsPerGpu(&agent)
+
+	err = frontend.keepDraining(&agent)
+	if err != nil {
+		return "", err
+	}
+
+	err = frontend.applySelfTest(&agent)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := frontend.storage.RegisterAgent(agent)
+	if err == nil {
+		frontend.publishAgentState(id, agent.State)
+	}
+
+	return id, err
 }
 
-func (frontend *Frontend) getAgents() ([]restapi.Agent, error) {
-	iterator, err := frontend.storage.GetAgents()
+func (frontend *Frontend) getAgents(query restapi.ListQuery) (storage.Page[restapi.Agent], error) {
+	page, err := frontend.storage.StaleReads().QueryAgents(query)
 	if err != nil {
-		return nil, err
+		return storage.Page[restapi.Agent]{}, err
 	}
 
-	agents := make([]restapi.Agent, 0)
-	for iterator.Next() {
-		agents = append(agents, iterator.Value())
+	for index, agent := range page.Items {
+		page.Items[index] = storage.WithVramAllocation(agent)
 	}
 
-	return agents, nil
+	return page, nil
 }
 
 func (frontend *Frontend) getAgentById(id string) (restapi.Agent, error) {
-	return frontend.storage.GetAgentById(id)
+	agent, err := frontend.storage.GetAgentById(id)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	for index, session := range agent.Sessions {
+		agent.Sessions[index] = frontend.withDataChannelPolicy(session)
+	}
+
+	return storage.WithVramAllocation(agent), nil
+}
+
+// Returns whether the session the agent reported closed was returned to the queue
+func (frontend *Frontend) requeued(id string) bool {
+	session, err := frontend.storage.GetSessionById(id)
+	return err == nil && session.State == restapi.SessionQueued
 }
 
 func (frontend *Frontend) updateAgent(update restapi.AgentUpdate) error {
-	return frontend.storage.UpdateAgent(update)
+	err := frontend.storage.UpdateAgent(update)
+	if err != nil {
+		return err
+	}
+
+	if frontend.bus != nil {
+		for _, event := range update.Events {
+			event.AgentId = update.Id
+			frontend.bus.Publish(event)
+		}
+	}
+
+	// Agents only send the state of sessions that changed since their last update. Preempted
+	// sessions the agent closed returned to the queue instead, see restapi.Session.Preempted.
+	for id, session := range update.Sessions {
+		if session.State == restapi.SessionClosed && frontend.requeued(id) {
+			frontend.publishSessionState(id, "", restapi.SessionQueued, "")
+		} else if session.State != "" {
+			frontend.publishSessionState(id, update.Id, session.State, session.ExitStatus)
+		}
+	}
+
+	// Active agents keep sending their state, registering published it
+	if update.State != "" && update.State != restapi.AgentActive {
+		frontend.publishAgentState(update.Id, update.State)
+	}
+
+	return nil
 }
 
 func (frontend *Frontend) requestSession(sessionRequirements restapi.SessionRequirements) (string, error) {
-	return frontend.storage.RequestSession(sessionRequirements)
+	if sessionRequirements.DelegatedBy != "" {
+		// Usage of delegated sessions is attributed to the user rather than the service account
+		if sessionRequirements.Tenant == "" {
+			sessionRequirements.Tenant = sessionRequirements.User
+		}
+
+		logger.Infof("%s requesting a session on behalf of %s", sessionRequirements.DelegatedBy, sessionRequirements.User)
+	}
+
+	frontend.sessionClasses.Apply(&sessionRequirements)
+
+	if sessionRequirements.CallbackUrl != "" {
+		err := callbacks.ValidateUrl(sessionRequirements.CallbackUrl)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := frontend.checkReservations(sessionRequirements)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := frontend.storage.RequestSession(sessionRequirements)
+	if err == nil {
+		frontend.publishSessionState(id, "", restapi.SessionQueued, "")
+	}
+
+	return id, err
 }
 
 func (frontend *Frontend) getSessionById(id string) (restapi.Session, error) {
-	return frontend.storage.GetSessionById(id)
+	session, err := frontend.storage.GetSessionById(id)
+	if err == nil && session.State != restapi.SessionClosed {
+		// Reading the session shows the requester is still around to use it
+		err = frontend.storage.ClaimSession(id)
+	}
+
+	return frontend.withDataChannelPolicy(session), err
+}
+
+func (frontend *Frontend) releaseSession(id string, release restapi.SessionRelease) error {
+	err := frontend.storage.ReleaseSession(id, release)
+	if err == nil {
+		logger.WithSession(id).Infof("session %s released by its client after %s, exit status %s (%d)",
+			id, release.EndedAt.Sub(release.StartedAt).Round(time.Millisecond), release.ExitStatus, release.ExitCode)
+
+		// Releasing closes queued sessions and cancels running ones unless they are persistent
+		if frontend.bus != nil {
+			session, err := frontend.storage.GetSessionById(id)
+			if err == nil && (session.State == restapi.SessionClosed || session.State == restapi.SessionCanceling) {
+				frontend.publishSessionState(id, "", session.State, session.ExitStatus)
+			}
+		}
+	}
+
+	return err
 }
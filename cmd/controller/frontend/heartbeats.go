@@ -0,0 +1,62 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	heartbeatInterval = flag.Duration("agent-heartbeat-interval", 5*time.Second, "Interval between the updates of each agent, agents are assigned evenly spread offsets within the interval when they register")
+)
+
+// Agents are marked missing after 30 seconds without an update, leave room for a couple of failed updates
+const maxHeartbeatInterval = 10 * time.Second
+
+// Assigns each registering agent an offset within the heartbeat interval. Offsets follow the
+// golden ratio sequence, so however many agents register, and in whatever order, their updates
+// are close to evenly spread over the interval rather than arriving in bursts, such as when
+// every agent registers again after the controller restarts.
+type heartbeatScheduler struct {
+	mutex sync.Mutex
+
+	interval time.Duration
+	next     uint64
+}
+
+func newHeartbeatScheduler() (*heartbeatScheduler, error) {
+	if *heartbeatInterval < time.Second || *heartbeatInterval > maxHeartbeatInterval {
+		return nil, fmt.Errorf("--agent-heartbeat-interval must be between 1s and %s", maxHeartbeatInterval)
+	}
+
+	return &heartbeatScheduler{
+		interval: *heartbeatInterval,
+	}, nil
+}
+
+func (scheduler *heartbeatScheduler) assign() restapi.HeartbeatSchedule {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	_, fraction := math.Modf(float64(scheduler.next) * math.Phi)
+	scheduler.next++
+
+	return restapi.HeartbeatSchedule{
+		Interval: scheduler.interval,
+		Offset:   time.Duration(fraction * float64(scheduler.interval)).Truncate(time.Millisecond),
+	}
+}
+
+func setHeartbeatSchedule(header http.Header, schedule restapi.HeartbeatSchedule) {
+	header.Set(restapi.HeartbeatIntervalHeader, strconv.FormatInt(schedule.Interval.Milliseconds(), 10))
+	header.Set(restapi.HeartbeatOffsetHeader, strconv.FormatInt(schedule.Offset.Milliseconds(), 10))
+}
@@ -0,0 +1,109 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const (
+	defaultJournalLimit = 1000
+	maxJournalLimit     = 10000
+	maxJournalWait      = time.Minute
+)
+
+// Parses the since, limit, and wait query parameters of /v1/journal
+func parseJournalReplay(r *http.Request) (uint64, int, time.Duration, error) {
+	query := r.URL.Query()
+
+	var since uint64
+	if value := query.Get("since"); value != "" {
+		var err error
+		since, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("since must be a journal sequence, %s", err)
+		}
+	}
+
+	limit := defaultJournalLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return 0, 0, 0, errors.New("limit must be a positive number of entries")
+		}
+
+		if limit > maxJournalLimit {
+			limit = maxJournalLimit
+		}
+	}
+
+	var wait time.Duration
+	if value := query.Get("wait"); value != "" {
+		var err error
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			return 0, 0, 0, errors.New("wait must be a duration such as 30s")
+		}
+
+		if wait > maxJournalWait {
+			wait = maxJournalWait
+		}
+	}
+
+	return since, limit, wait, nil
+}
+
+// Returns the storage mutations recorded after a sequence, waiting up to wait for one when there
+// are none yet so consumers follow the changes with long polls. The journal is shared by the
+// controllers, consumers resynchronize when Missed is set once the entries they had not replayed
+// were removed by --journal-retention.
+func (frontend *Frontend) getJournalEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/journal").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			since, limit, wait, err := parseJournalReplay(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			if wait > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), wait)
+				frontend.journal.Wait(ctx, since)
+				cancel()
+			}
+
+			entries, next, missed, err := frontend.journal.Since(since, limit)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			replay := restapi.JournalReplay{
+				Entries: entries,
+				Next:    next,
+				Missed:  missed,
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, replay)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+func validateLabelsPatch(patch restapi.AgentLabelsPatch) error {
+	if len(patch.Labels) == 0 && len(patch.RemoveLabels) == 0 && len(patch.Taints) == 0 && len(patch.RemoveTaints) == 0 {
+		return errors.New("the patch changes no labels or taints")
+	}
+
+	for _, keys := range [][]string{patch.RemoveLabels, patch.RemoveTaints} {
+		for _, key := range keys {
+			if key == "" {
+				return errors.New("keys must not be empty")
+			}
+		}
+	}
+
+	for _, keyValues := range []map[string]string{patch.Labels, patch.Taints} {
+		for key := range keyValues {
+			if key == "" {
+				return errors.New("keys must not be empty")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the key values as comma separated key=value pairs in order of key
+func formatKeyValues(keyValues map[string]string) string {
+	pairs := make([]string, 0, len(keyValues))
+	for key, value := range keyValues {
+		pairs = append(pairs, fmt.Sprint(key, "=", value))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// Changes the labels and taints of the agent, returning the agent. The backend places sessions by
+// them from its next scheduling pass.
+func (frontend *Frontend) patchAgentLabels(id string, patch restapi.AgentLabelsPatch) (restapi.Agent, error) {
+	err := frontend.storage.PatchAgentLabels(id, patch)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	agent, err := frontend.getAgentById(id)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	message := fmt.Sprintf("agent %s (%s) labels are %s, taints are %s", id, agent.Hostname, formatKeyValues(agent.Labels), formatKeyValues(agent.Taints))
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventAgentLabelsChanged,
+			Message: message,
+			AgentId: id,
+			Data: map[string]string{
+				"hostname": agent.Hostname,
+				"labels":   formatKeyValues(agent.Labels),
+				"taints":   formatKeyValues(agent.Taints),
+			},
+		})
+	} else {
+		logger.Info(message)
+	}
+
+	return agent, nil
+}
+
+// Adds, replaces, and removes labels and taints of a live agent, the agent keeps running its
+// sessions and does not need to restart
+func (frontend *Frontend) patchAgentLabelsEp(group task.Group, router *mux.Router) error {
+	router.Methods("PATCH").Path("/v1/agent/{id}/labels").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			patch, err := pkgnet.ReadRequestBody[restapi.AgentLabelsPatch](r)
+			if err == nil {
+				err = validateLabelsPatch(patch)
+			}
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			agent, err := frontend.patchAgentLabels(mux.Vars(r)["id"], patch)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, agent)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+
+	return nil
+}
@@ -0,0 +1,36 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Returns the scheduler lease of the controller replica running the scheduling loop, not found
+// when the replicas do not elect a leader or none holds the lease, see --leader-election
+func (frontend *Frontend) getLeaderEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/leader").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			lease, err := frontend.storage.GetLease(restapi.SchedulerLease)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, lease)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
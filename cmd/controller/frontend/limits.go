@@ -0,0 +1,61 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	poolMaxSessionsPerGpu = flag.String("pool-max-sessions-per-gpu", "", "Comma separated list of pool=count pairs limiting the concurrent sessions placed on each GPU of the pool's agents, agents keep a lower --max-sessions-per-gpu")
+)
+
+func parsePoolMaxSessionsPerGpu() (map[string]int, error) {
+	limits := map[string]int{}
+	if *poolMaxSessionsPerGpu == "" {
+		return limits, nil
+	}
+
+	var err error
+	for _, pair := range strings.Split(*poolMaxSessionsPerGpu, ",") {
+		keyValue := strings.Split(pair, "=")
+		if len(keyValue) != 2 {
+			err = errors.Join(err, fmt.Errorf("limit '%s' must be in the format pool=count", pair))
+			continue
+		}
+
+		count, parseErr := strconv.Atoi(strings.TrimSpace(keyValue[1]))
+		if parseErr != nil || count < 0 {
+			err = errors.Join(err, fmt.Errorf("limit '%s' must have a count of 0 or more", pair))
+			continue
+		}
+
+		limits[strings.TrimSpace(keyValue[0])] = count
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --pool-max-sessions-per-gpu with %s", err)
+	}
+
+	return limits, nil
+}
+
+// Applies the limit of the agent's pool when the agent does not report a lower one
+func (frontend *Frontend) limitSessionsPerGpu(agent *restapi.Agent) {
+	limit, found := frontend.maxSessionsPerGpu[storage.Pool(agent.Labels)]
+	if !found || limit == 0 {
+		return
+	}
+
+	if agent.MaxSessionsPerGpu == 0 || limit < agent.MaxSessionsPerGpu {
+		agent.MaxSessionsPerGpu = limit
+	}
+}
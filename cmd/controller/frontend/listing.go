@@ -0,0 +1,169 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+const maxListLimit = 1000
+
+var (
+	agentStates = []string{restapi.AgentActive, restapi.AgentDisabled, restapi.AgentMissing, restapi.AgentClosed}
+	// Of the sessions placed on agents
+	placedSessionStates = []string{restapi.SessionAssigned, restapi.SessionActive, restapi.SessionCanceling}
+)
+
+// Continues a listing, see restapi.ListQuery.Cursor. Encoded as base64 JSON, clients treat it as
+// opaque.
+type listCursor struct {
+	// The snapshot of the listing recorded by its first page, see storage.ListPage
+	Snapshot string `json:"snapshot"`
+	// The position of the page in the snapshot
+	Offset int `json:"offset"`
+	// Identifies the list and filters of the listing, see listFilters
+	Filters string `json:"filters"`
+}
+
+// Returns a digest of the list and the query's filters, a cursor only continues the listing it
+// was returned with
+func listFilters(list string, query restapi.ListQuery) string {
+	keys := make([]string, 0, len(query.Labels))
+	for key := range query.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s", list, query.State, query.GpuName)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "\x00%s=%s", key, query.Labels[key])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+func decodeListCursor(list string, query restapi.ListQuery) (restapi.ListQuery, error) {
+	invalid := errors.New("cursor is not one returned by this listing")
+
+	data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return restapi.ListQuery{}, invalid
+	}
+
+	var cursor listCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.Offset <= 0 {
+		return restapi.ListQuery{}, invalid
+	}
+
+	_, err = uuid.Parse(cursor.Snapshot)
+	if err != nil {
+		return restapi.ListQuery{}, invalid
+	}
+
+	if cursor.Filters != listFilters(list, query) {
+		return restapi.ListQuery{}, errors.New("cursor was returned by a listing with different filters")
+	}
+
+	query.Snapshot = cursor.Snapshot
+	query.Offset = cursor.Offset
+	return query, nil
+}
+
+// Sets the headers describing the page, the total count and the cursor of the next page
+func setPageHeaders[T any](w http.ResponseWriter, list string, query restapi.ListQuery, page storage.Page[T]) {
+	w.Header().Set(restapi.TotalCountHeader, strconv.Itoa(page.Total))
+
+	if !page.More || page.Snapshot == "" {
+		return
+	}
+
+	data, err := json.Marshal(listCursor{
+		Snapshot: page.Snapshot,
+		Offset:   query.Offset + len(page.Items),
+		Filters:  listFilters(list, query),
+	})
+	if err == nil {
+		w.Header().Set(restapi.NextCursorHeader, base64.RawURLEncoding.EncodeToString(data))
+	}
+}
+
+// Parses the state, label, gpu, offset, limit, and cursor query parameters of the list,
+// /v1/agents or /v1/sessions, see restapi.ListQuery. Every item is listed when no limit is given.
+func parseListQuery(r *http.Request, list string, states []string) (restapi.ListQuery, error) {
+	values := r.URL.Query()
+
+	query := restapi.ListQuery{
+		State:   values.Get("state"),
+		GpuName: values.Get("gpu"),
+	}
+
+	if query.State != "" {
+		known := false
+		for _, state := range states {
+			known = known || state == query.State
+		}
+
+		if !known {
+			return restapi.ListQuery{}, fmt.Errorf("state must be one of %s", strings.Join(states, ", "))
+		}
+	}
+
+	for _, label := range values["label"] {
+		key, value, found := strings.Cut(label, "=")
+		if !found || key == "" {
+			return restapi.ListQuery{}, fmt.Errorf("label %s must be of the form key=value", label)
+		}
+
+		if query.Labels == nil {
+			query.Labels = map[string]string{}
+		}
+		query.Labels[key] = value
+	}
+
+	if value := values.Get("offset"); value != "" {
+		var err error
+		query.Offset, err = strconv.Atoi(value)
+		if err != nil || query.Offset < 0 {
+			return restapi.ListQuery{}, errors.New("offset must be a number of items to skip")
+		}
+	}
+
+	if value := values.Get("limit"); value != "" {
+		var err error
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit < 1 {
+			return restapi.ListQuery{}, errors.New("limit must be a positive number of items")
+		}
+
+		if query.Limit > maxListLimit {
+			query.Limit = maxListLimit
+		}
+	}
+
+	if query.Cursor = values.Get("cursor"); query.Cursor != "" {
+		if query.Offset != 0 {
+			return restapi.ListQuery{}, errors.New("cursor and offset may not both be given")
+		}
+
+		return decodeListCursor(list, query)
+	}
+
+	return query, nil
+}
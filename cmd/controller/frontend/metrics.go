@@ -0,0 +1,19 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Serves the controller's Prometheus metrics alongside the API, the same metrics served on
+// --prometheus-address when --prometheus is set
+func (frontend *Frontend) getMetricsEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/metrics").Handler(
+		promhttp.Handler())
+	return nil
+}
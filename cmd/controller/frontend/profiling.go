@@ -0,0 +1,27 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"flag"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/server"
+)
+
+var (
+	enableProfiling = flag.Bool("enable-profiling", false, "Serves the controller's runtime profiles on /debug/pprof/ to the roles allowed to use the debug endpoints, see juicectl profile")
+)
+
+func (frontend *Frontend) addProfilingEndpoints() {
+	if !*enableProfiling {
+		return
+	}
+
+	if frontend.policy == nil {
+		logger.Warning("profiling endpoints are served to every request, see --authorization-policy-file")
+	}
+
+	frontend.addEndpoint(endpointsDebug, server.ProfilingEp)
+}
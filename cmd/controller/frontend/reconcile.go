@@ -0,0 +1,189 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// The agents that reported the sessions they run since the controller started. Until then the
+// controller's records of an agent may be stale, such as when sessions changed while the
+// controller was down, and each agent is asked to report its sessions.
+type reconciledAgents struct {
+	mutex  sync.Mutex
+	agents map[string]struct{}
+}
+
+func newReconciledAgents() *reconciledAgents {
+	return &reconciledAgents{
+		agents: map[string]struct{}{},
+	}
+}
+
+func (reconciled *reconciledAgents) contains(id string) bool {
+	reconciled.mutex.Lock()
+	defer reconciled.mutex.Unlock()
+
+	_, found := reconciled.agents[id]
+	return found
+}
+
+func (reconciled *reconciledAgents) add(id string) {
+	reconciled.mutex.Lock()
+	defer reconciled.mutex.Unlock()
+
+	reconciled.agents[id] = struct{}{}
+}
+
+func isRunning(state string) bool {
+	return state == restapi.SessionAssigned || state == restapi.SessionActive
+}
+
+// Corrects the records of the agent to the sessions it reports running. The agent is authoritative
+// for the sessions it runs: sessions missing from the records are adopted with the GPUs they run
+// on, so their capacity is not assigned again, and sessions the agent no longer runs are closed.
+// Assigned sessions the agent has yet to start are left for it to start.
+func (frontend *Frontend) reconcileAgent(id string, sessions []restapi.Session) (restapi.AgentReconciliationResult, error) {
+	result := restapi.AgentReconciliationResult{}
+
+	agent, err := frontend.storage.GetAgentById(id)
+	if err != nil {
+		return result, err
+	}
+
+	recorded := map[string]restapi.Session{}
+	for _, session := range agent.Sessions {
+		recorded[session.Id] = session
+	}
+
+	updates := map[string]restapi.SessionUpdate{}
+	reported := map[string]struct{}{}
+
+	for _, session := range sessions {
+		if !isRunning(session.State) {
+			// Closing sessions are reported by the agent's updates
+			continue
+		}
+
+		reported[session.Id] = struct{}{}
+
+		if record, found := recorded[session.Id]; found {
+			if isRunning(record.State) && record.State != session.State {
+				updates[session.Id] = restapi.SessionUpdate{
+					State: session.State,
+				}
+				result.Corrected = append(result.Corrected, session.Id)
+			}
+
+			continue
+		}
+
+		err = frontend.storage.AdoptSession(id, session)
+		if errors.Is(err, storage.ErrConflict) {
+			logger.Warningf("agent %s runs session %s, %v", id, session.Id, err)
+			result.Conflicting = append(result.Conflicting, session.Id)
+			continue
+		} else if err != nil {
+			return result, err
+		}
+
+		result.Adopted = append(result.Adopted, session.Id)
+	}
+
+	for _, record := range agent.Sessions {
+		if _, found := reported[record.Id]; found {
+			continue
+		}
+
+		switch record.State {
+		case restapi.SessionActive:
+			updates[record.Id] = restapi.SessionUpdate{
+				State:      restapi.SessionClosed,
+				ExitStatus: restapi.ExitStatusFailure,
+			}
+			result.Closed = append(result.Closed, record.Id)
+
+		case restapi.SessionCanceling:
+			updates[record.Id] = restapi.SessionUpdate{
+				State:      restapi.SessionClosed,
+				ExitStatus: restapi.ExitStatusCanceled,
+			}
+			result.Closed = append(result.Closed, record.Id)
+		}
+	}
+
+	if len(updates) > 0 {
+		err = frontend.storage.UpdateAgent(restapi.AgentUpdate{
+			Id:       id,
+			State:    agent.State,
+			Sessions: updates,
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	frontend.reconciled.add(id)
+
+	if len(result.Adopted) > 0 || len(result.Corrected) > 0 || len(result.Closed) > 0 {
+		message := fmt.Sprintf("agent %s reconciled, adopted %d sessions, corrected %d, and closed %d",
+			id, len(result.Adopted), len(result.Corrected), len(result.Closed))
+
+		if frontend.bus != nil {
+			frontend.bus.Publish(restapi.Event{
+				Type:    restapi.EventAgentReconciled,
+				Message: message,
+				AgentId: id,
+				Data: map[string]string{
+					"adopted":   strconv.Itoa(len(result.Adopted)),
+					"corrected": strconv.Itoa(len(result.Corrected)),
+					"closed":    strconv.Itoa(len(result.Closed)),
+				},
+			})
+		} else {
+			logger.Info(message)
+		}
+	}
+
+	return result, nil
+}
+
+func (frontend *Frontend) reconcileAgentEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/reconcile/agent/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			reconciliation, err := pkgnet.ReadRequestBody[restapi.AgentReconciliation](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			result, err := frontend.reconcileAgent(id, reconciliation.Sessions)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, result)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/recording"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	recordingKeyFile    = flag.String("recording-key-file", "", "File of <key id>:<base64 32 byte key> lines the keys of recorded sessions are encrypted with, the first key encrypts and the remaining keys are kept to retrieve older recordings. Sessions requiring recording are rejected when not set")
+	agentRecordingToken = flag.String("agent-recording-token", "", "Bearer token presented to agents to retrieve the recordings of their sessions, the agents' --recording-token. Connects over TLS with --agent-exec-tls")
+)
+
+var errRecordingDisabled = pkgerrors.New(pkgerrors.ErrForbidden, "recording sessions is disabled, see --recording-key-file")
+
+// Returns nil when --recording-key-file is not set
+func loadRecordingKeyring() (*crypto.Keyring, error) {
+	if *recordingKeyFile == "" {
+		return nil, nil
+	}
+
+	return crypto.LoadKeyring(*recordingKeyFile)
+}
+
+// Returns a new key for a session's recording and the key encrypted with the keyring, which the
+// agent stores with the recording. Only the controller can then decrypt the recording.
+func (frontend *Frontend) newRecordingKey() (restapi.RecordingKey, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return restapi.RecordingKey{}, err
+	}
+
+	wrappedKey, err := frontend.recordingKeyring.Encrypt(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return restapi.RecordingKey{}, err
+	}
+
+	return restapi.RecordingKey{
+		Key:        key,
+		WrappedKey: wrappedKey,
+	}, nil
+}
+
+func (frontend *Frontend) unwrapRecordingKey(wrappedKey string) ([]byte, error) {
+	if !crypto.IsEncrypted(wrappedKey) {
+		return nil, errors.New("the key is not encrypted")
+	}
+
+	encodedKey, err := frontend.recordingKeyring.Decrypt(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(encodedKey)
+}
+
+// Gives the agent the key to encrypt the recording of a session assigned to it with
+func (frontend *Frontend) requestRecordingKeyEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/agent/{id}/session/{sessionId}/recording-key").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			agentId := mux.Vars(r)["id"]
+			sessionId := mux.Vars(r)["sessionId"]
+
+			if frontend.recordingKeyring == nil {
+				err := errors.Join(errRecordingDisabled, pkgnet.RespondWithError(w, errRecordingDisabled))
+				logger.Error(err)
+				return
+			}
+
+			agent, err := frontend.storage.GetAgentById(agentId)
+			if err == nil {
+				err = pkgerrors.Errorf(pkgerrors.ErrNotFound, "session %s is not assigned to agent %s", sessionId, agentId)
+				for _, session := range agent.Sessions {
+					if session.Id == sessionId {
+						err = nil
+						if !session.Record {
+							err = pkgerrors.Errorf(pkgerrors.ErrConflict, "session %s is not recorded", sessionId)
+						}
+						break
+					}
+				}
+			}
+
+			var key restapi.RecordingKey
+			if err == nil {
+				key, err = frontend.newRecordingKey()
+			}
+
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, key)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Retrieves the recording of a session from the agent that ran it, streaming it decrypted one
+// restapi.RecordingChunk per line
+func (frontend *Frontend) getSessionRecordingEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/session/{id}/recording").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			if frontend.recordingKeyring == nil {
+				err := errors.Join(errRecordingDisabled, pkgnet.RespondWithError(w, errRecordingDisabled))
+				logger.Error(err)
+				return
+			}
+
+			user, _, err := frontend.requester(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			session, err := frontend.storage.GetSessionById(id)
+			if err == nil && !session.Record {
+				err = pkgerrors.Errorf(pkgerrors.ErrNotFound, "session %s is not recorded", id)
+			}
+			if err == nil && session.Address == "" {
+				err = pkgerrors.Errorf(pkgerrors.ErrNotFound, "session %s was never placed on an agent", id)
+			}
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			// Every retrieval is recorded, including those that then fail
+			if frontend.bus != nil {
+				frontend.bus.Publish(restapi.Event{
+					Type:      restapi.EventSessionRecordingAccessed,
+					Message:   fmt.Sprintf("%s retrieved the recording of session %s", user, id),
+					SessionId: id,
+					Data: map[string]string{
+						"user":      user,
+						"tokenName": frontend.policy.tokenName(r),
+					},
+				})
+			}
+
+			scheme := "http"
+			if *agentExecTls {
+				scheme = "https"
+			}
+
+			agentApi := restapi.Client{
+				Client:  &http.Client{Transport: frontend.execTransport},
+				Scheme:  scheme,
+				Address: session.Address,
+				Token:   *agentRecordingToken,
+			}
+
+			reader, writer := io.Pipe()
+			go func() {
+				_, err := agentApi.GetSessionRecordingWithContext(r.Context(), id, writer)
+				writer.CloseWithError(err)
+			}()
+			defer reader.Close()
+
+			recorded, err := recording.NewReader(reader, frontend.unwrapRecordingKey)
+			if err != nil {
+				if errors.Is(err, pkgerrors.ErrNotFound) {
+					err = pkgerrors.Errorf(pkgerrors.ErrNotFound, "agent %s does not have the recording of session %s, %v", session.Address, id, err)
+				} else {
+					err = pkgerrors.Errorf(pkgerrors.ErrUnavailable, "unable to retrieve the recording of session %s from agent %s, %v", id, session.Address, err)
+				}
+
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+
+			// Responses are not buffered whole as recordings may be large, errors after the first
+			// chunk can only end the response early
+			encoder := json.NewEncoder(w)
+			for {
+				chunk, err := recorded.Next()
+				if err == nil {
+					err = encoder.Encode(chunk)
+				}
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						logger.Errorf("/v1/session/%s/recording: %v", id, err)
+					}
+					return
+				}
+			}
+		})
+	return nil
+}
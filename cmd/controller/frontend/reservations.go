@@ -0,0 +1,179 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// The VRAM of a reserved session, queued or placed
+type reservedVram struct {
+	reservation restapi.SessionReservation
+	vram        uint64
+}
+
+// The VRAM of a pool and the reservations holding it
+type poolReservations struct {
+	// VRAM of the pool's schedulable agents, and how much of it sessions have left
+	vram          uint64
+	vramAvailable uint64
+
+	// Reserved sessions not yet placed, whose VRAM is not allocated yet
+	queued []reservedVram
+	// Reserved sessions placed on the pool's agents
+	placed []reservedVram
+}
+
+func (frontend *Frontend) getPoolReservations(pool string) (poolReservations, error) {
+	var reservations poolReservations
+
+	agents, err := frontend.storage.GetAgents()
+	if err != nil {
+		return reservations, err
+	}
+
+	for agents.Next() {
+		agent := agents.Value()
+		if storage.Pool(agent.Labels) != pool || !storage.Schedulable(agent) {
+			continue
+		}
+
+		reservations.vram += storage.TotalVram(agent.Gpus)
+		for _, gpu := range storage.WithVramAllocation(agent).Gpus {
+			reservations.vramAvailable += gpu.VramAvailable
+		}
+
+		for _, session := range agent.Sessions {
+			if session.Reservation != nil && session.State != restapi.SessionClosed {
+				reservations.placed = append(reservations.placed, reservedVram{
+					reservation: *session.Reservation,
+					vram:        storage.AllocatedVram(session.Gpus),
+				})
+			}
+		}
+	}
+
+	iterator, err := frontend.storage.GetQueuedSessionsIterator()
+	if err != nil {
+		return reservations, err
+	}
+
+	for iterator.Next() {
+		session := iterator.Value()
+		if session.Requirements.Reservation != nil && storage.Pool(session.Requirements.MatchLabels) == pool {
+			reservations.queued = append(reservations.queued, reservedVram{
+				reservation: *session.Requirements.Reservation,
+				vram:        storage.TotalVramRequired(session.Requirements),
+			})
+		}
+	}
+
+	return reservations, nil
+}
+
+// Returns the most VRAM the reservations overlapping the window hold at once during it, the
+// reservations overlapping most of it all start at one of the starts within it
+func (reservations poolReservations) peakVram(window restapi.SessionReservation) (uint64, time.Time) {
+	all := append(append([]reservedVram{}, reservations.queued...), reservations.placed...)
+
+	starts := []time.Time{window.StartAt}
+	for _, reserved := range all {
+		if reserved.reservation.StartAt.After(window.StartAt) && reserved.reservation.StartAt.Before(window.EndAt()) {
+			starts = append(starts, reserved.reservation.StartAt)
+		}
+	}
+
+	var peak uint64
+	peakAt := window.StartAt
+	for _, at := range starts {
+		var vram uint64
+		for _, reserved := range all {
+			if !at.Before(reserved.reservation.StartAt) && at.Before(reserved.reservation.EndAt()) {
+				vram += reserved.vram
+			}
+		}
+
+		if vram > peak {
+			peak = vram
+			peakAt = at
+		}
+	}
+
+	return peak, peakAt
+}
+
+// Returns the VRAM held now for the reserved sessions of the pool not yet placed, and when the
+// earliest of them starts
+func (reservations poolReservations) heldVram(now time.Time) (uint64, time.Time) {
+	var held uint64
+	var earliest time.Time
+	for _, reserved := range reservations.queued {
+		if scheduling.ReservationHeld(&reserved.reservation, now) {
+			held += reserved.vram
+			if earliest.IsZero() || reserved.reservation.StartAt.Before(earliest) {
+				earliest = reserved.reservation.StartAt
+			}
+		}
+	}
+
+	return held, earliest
+}
+
+// Rejects reserved sessions the VRAM of their pool cannot hold alongside the reservations
+// overlapping them, and on-demand sessions that would only fit on the VRAM held for reservations.
+// On-demand sessions that do not fit either way are queued as usual.
+func (frontend *Frontend) checkReservations(requirements restapi.SessionRequirements) error {
+	vramRequired := storage.TotalVramRequired(requirements)
+	if vramRequired == 0 {
+		return nil
+	}
+
+	pool := storage.Pool(requirements.MatchLabels)
+
+	reservations, err := frontend.getPoolReservations(pool)
+	if err != nil {
+		return err
+	}
+
+	if requirements.Reservation != nil {
+		peak, peakAt := reservations.peakVram(*requirements.Reservation)
+		if peak+vramRequired > reservations.vram {
+			return pkgerrors.Errorf(pkgerrors.ErrConflict, "pool %s cannot hold the reservation, %d of its %d bytes of VRAM are reserved at %s",
+				pool, peak, reservations.vram, peakAt.UTC().Format(time.RFC3339))
+		}
+
+		return nil
+	}
+
+	held, earliest := reservations.heldVram(time.Now())
+	if held > 0 && reservations.vramAvailable >= vramRequired && reservations.vramAvailable < held+vramRequired {
+		return pkgerrors.Errorf(pkgerrors.ErrConflict, "the VRAM available in pool %s is held for sessions reserved from %s",
+			pool, earliest.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Returns why the reservation is invalid, nil when it is valid
+func validateReservation(reservation *restapi.SessionReservation, now time.Time) error {
+	if reservation == nil {
+		return nil
+	}
+
+	if reservation.DurationSeconds <= 0 {
+		return fmt.Errorf("reservation durationSeconds must be greater than 0")
+	}
+
+	if !reservation.StartAt.After(now) {
+		return fmt.Errorf("reservation startAt must be in the future")
+	}
+
+	return nil
+}
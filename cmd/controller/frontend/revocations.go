@@ -0,0 +1,357 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	revocationRefresh = flag.Duration("revocation-refresh", 5*time.Second, "Interval between reloads of the revoked credentials from the storage. Credentials revoked through this controller are rejected immediately, those revoked through another controller within the interval")
+)
+
+type revocationKey struct {
+	kind    string
+	subject string
+}
+
+// The revoked credentials, kept in memory as every request is checked against them
+type revocations struct {
+	storage storage.Storage
+
+	mutex   sync.RWMutex
+	revoked map[revocationKey]restapi.Revocation
+}
+
+func newRevocations(storage storage.Storage) (*revocations, error) {
+	if *revocationRefresh <= 0 {
+		return nil, errors.New("--revocation-refresh must be greater than 0")
+	}
+
+	revocations := &revocations{
+		storage: storage,
+	}
+
+	err := revocations.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+func (revocations *revocations) load() error {
+	loaded, err := revocations.storage.GetRevocations()
+	if err != nil {
+		return err
+	}
+
+	revoked := map[revocationKey]restapi.Revocation{}
+	for _, revocation := range loaded {
+		revoked[revocationKey{revocation.Kind, revocation.Subject}] = revocation
+	}
+
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+
+	revocations.revoked = revoked
+	return nil
+}
+
+func (revocations *revocations) run(group task.Group) error {
+	ticker := time.NewTicker(*revocationRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			err := revocations.load()
+			if err != nil {
+				logger.Warningf("unable to reload the revoked credentials, %v", err)
+			}
+		}
+	}
+}
+
+func (revocations *revocations) set(revocation restapi.Revocation) {
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+
+	revocations.revoked[revocationKey{revocation.Kind, revocation.Subject}] = revocation
+}
+
+func (revocations *revocations) remove(kind string, subject string) {
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+
+	delete(revocations.revoked, revocationKey{kind, subject})
+}
+
+func (revocations *revocations) find(kind string, subject string) (restapi.Revocation, bool) {
+	if subject == "" {
+		return restapi.Revocation{}, false
+	}
+
+	revocations.mutex.RLock()
+	defer revocations.mutex.RUnlock()
+
+	revocation, revoked := revocations.revoked[revocationKey{kind, subject}]
+	return revocation, revoked
+}
+
+// Returns the revocation of a credential the request presents, false when none is revoked. The
+// users of a request are the user its token or minted token names, the common name of its certificate, and the
+// user a service account requests on behalf of.
+func (frontend *Frontend) revokedCredential(r *http.Request) (restapi.Revocation, bool) {
+	users := []string{r.Header.Get(restapi.OnBehalfOfHeader)}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		users = append(users, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+
+	if token := frontend.policy.token(r); token != nil {
+		if revocation, revoked := frontend.revocations.find(restapi.RevocationToken, token.Name); revoked {
+			return revocation, true
+		}
+
+		users = append(users, token.User)
+	}
+
+	if token, found := apiTokenOf(r); found {
+		if revocation, revoked := frontend.revocations.find(restapi.RevocationToken, token.Name); revoked {
+			return revocation, true
+		}
+
+		users = append(users, token.User)
+	}
+
+	for _, user := range users {
+		if revocation, revoked := frontend.revocations.find(restapi.RevocationUser, user); revoked {
+			return revocation, true
+		}
+	}
+
+	return restapi.Revocation{}, false
+}
+
+// Rejects requests presenting a revoked credential
+func (frontend *Frontend) rejectRevoked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revocation, revoked := frontend.revokedCredential(r)
+		if !revoked {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := pkgerrors.Errorf(pkgerrors.ErrUnauthorized, "%s %s: the %s %s was revoked", r.Method, r.URL.Path, revocation.Kind, revocation.Subject)
+		err = errors.Join(err, pkgnet.RespondWithError(w, err))
+		logger.Error(err)
+	})
+}
+
+// Returns whether the session was requested with the credential
+func requestedWith(revocation restapi.Revocation, user string, delegatedBy string, tokenName string) bool {
+	switch revocation.Kind {
+	case restapi.RevocationToken:
+		return tokenName == revocation.Subject
+
+	case restapi.RevocationUser:
+		return user == revocation.Subject || delegatedBy == revocation.Subject
+	}
+
+	return false
+}
+
+// Returns the sessions requested with the credential, queued and, when evicting, placed on agents
+func (frontend *Frontend) sessionsRequestedWith(revocation restapi.Revocation) ([]string, error) {
+	ids := []string{}
+
+	queued, err := frontend.storage.GetQueuedSessionsIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	for queued.Next() {
+		requirements := queued.Value().Requirements
+		if requestedWith(revocation, requirements.User, requirements.DelegatedBy, requirements.TokenName) {
+			ids = append(ids, queued.Value().Id)
+		}
+	}
+
+	if !revocation.EvictSessions {
+		return ids, nil
+	}
+
+	agents, err := frontend.storage.GetAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	for agents.Next() {
+		for _, session := range agents.Value().Sessions {
+			if requestedWith(revocation, session.User, session.DelegatedBy, session.TokenName) {
+				ids = append(ids, session.Id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// Rejects the requests presenting the credential from now on, then cancels its sessions
+func (frontend *Frontend) revokeCredential(revocation restapi.Revocation) (restapi.RevocationResult, error) {
+	revocation.RevokedAt = time.Now().UTC()
+
+	err := frontend.storage.RevokeCredential(revocation)
+	if err != nil {
+		return restapi.RevocationResult{}, err
+	}
+
+	frontend.revocations.set(revocation)
+
+	result := restapi.RevocationResult{
+		Revocation:       revocation,
+		CanceledSessions: []string{},
+	}
+
+	ids, err := frontend.sessionsRequestedWith(revocation)
+	for _, id := range ids {
+		_, err_ := frontend.cancelSession(id, "an operator")
+		if err_ == nil {
+			result.CanceledSessions = append(result.CanceledSessions, id)
+		} else if !errors.Is(err_, storage.ErrNotFound) {
+			err = errors.Join(err, err_)
+		}
+	}
+
+	message := fmt.Sprintf("%s %s revoked, %d sessions canceled", revocation.Kind, revocation.Subject, len(result.CanceledSessions))
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventCredentialRevoked,
+			Message: message,
+			Data: map[string]string{
+				"kind":     revocation.Kind,
+				"subject":  revocation.Subject,
+				"reason":   revocation.Reason,
+				"evicted":  strconv.FormatBool(revocation.EvictSessions),
+				"canceled": strconv.Itoa(len(result.CanceledSessions)),
+			},
+		})
+	} else {
+		logger.Info(message)
+	}
+
+	// The credential stays revoked when some of its sessions could not be canceled
+	return result, err
+}
+
+func (frontend *Frontend) removeRevocation(kind string, subject string) error {
+	err := frontend.storage.RemoveRevocation(kind, subject)
+	if err != nil {
+		return err
+	}
+
+	frontend.revocations.remove(kind, subject)
+
+	message := fmt.Sprintf("%s %s is no longer revoked", kind, subject)
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventCredentialRestored,
+			Message: message,
+			Data: map[string]string{
+				"kind":    kind,
+				"subject": subject,
+			},
+		})
+	} else {
+		logger.Info(message)
+	}
+
+	return nil
+}
+
+func (frontend *Frontend) getRevocationsEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/revocations").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			revocations, err := frontend.storage.GetRevocations()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, revocations)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Revokes a token or the credentials of a user, canceling the sessions requested with them
+func (frontend *Frontend) revokeCredentialEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/revocations").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			revocation, err := pkgnet.ReadRequestBody[restapi.Revocation](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			if (revocation.Kind != restapi.RevocationToken && revocation.Kind != restapi.RevocationUser) || revocation.Subject == "" {
+				err = fmt.Errorf("/v1/revocations: expected a kind of %s or %s and a subject", restapi.RevocationToken, restapi.RevocationUser)
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			result, err := frontend.revokeCredential(revocation)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, result)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) removeRevocationEp(group task.Group, router *mux.Router) error {
+	router.Methods("DELETE").Path("/v1/revocations/{kind}/{subject}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+
+			err := frontend.removeRevocation(vars["kind"], vars["subject"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
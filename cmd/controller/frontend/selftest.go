@@ -0,0 +1,111 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+const (
+	selfTestActionNone   = ""
+	selfTestActionCordon = "cordon"
+	selfTestActionRefuse = "refuse"
+)
+
+var (
+	agentSelfTestAction = flag.String("agent-self-test-action", selfTestActionNone, "What is done with agents registering with critical checks of their self-test failing, see --agent-critical-checks. cordon taints them with selfTest=failed until an operator removes the taint, refuse rejects their registration, and the failure is only recorded and published when not set")
+
+	agentCriticalChecks = []string{restapi.SelfTestLibraries, restapi.SelfTestGpuDriver, restapi.SelfTestVulkan}
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &agentCriticalChecks}, "agent-critical-checks", "A comma-separated list of the checks of the agents' self-test --agent-self-test-action applies to, from libraries, gpuDriver, vulkan, controller, and clockSkew")
+}
+
+func validateSelfTestAction() error {
+	switch *agentSelfTestAction {
+	case selfTestActionNone, selfTestActionCordon, selfTestActionRefuse:
+	default:
+		return fmt.Errorf("--agent-self-test-action must be one of cordon or refuse, got %s", *agentSelfTestAction)
+	}
+
+	for _, check := range agentCriticalChecks {
+		switch check {
+		case restapi.SelfTestLibraries, restapi.SelfTestGpuDriver, restapi.SelfTestVulkan, restapi.SelfTestController, restapi.SelfTestClockSkew:
+		default:
+			return fmt.Errorf("--agent-critical-checks has an unknown check %s", check)
+		}
+	}
+
+	return nil
+}
+
+// Returns the critical checks of the self-test that failed
+func failedCriticalChecks(selfTest restapi.SelfTest) []string {
+	failed := []string{}
+	for _, check := range selfTest.Failed() {
+		for _, critical := range agentCriticalChecks {
+			if check == critical {
+				failed = append(failed, check)
+				break
+			}
+		}
+	}
+
+	return failed
+}
+
+// Applies --agent-self-test-action to the registering agent when critical checks of its
+// self-test failed. Agents not reporting a self-test are registered as usual.
+func (frontend *Frontend) applySelfTest(agent *restapi.Agent) error {
+	if agent.SelfTest == nil {
+		return nil
+	}
+
+	failed := failedCriticalChecks(*agent.SelfTest)
+	if len(failed) == 0 {
+		return nil
+	}
+
+	action := *agentSelfTestAction
+	if action == selfTestActionNone {
+		action = "none"
+	}
+
+	message := fmt.Sprintf("agent %s (%s) failed the critical checks %s of its self-test", agent.Id, agent.Hostname, strings.Join(failed, ", "))
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventAgentSelfTestFailed,
+			Message: message,
+			AgentId: agent.Id,
+			Data: map[string]string{
+				"hostname": agent.Hostname,
+				"failed":   strings.Join(failed, ","),
+				"action":   action,
+			},
+		})
+	} else {
+		logger.Warning(message)
+	}
+
+	switch *agentSelfTestAction {
+	case selfTestActionCordon:
+		if agent.Taints == nil {
+			agent.Taints = map[string]string{}
+		}
+		agent.Taints[restapi.SelfTestTaint] = "failed"
+
+	case selfTestActionRefuse:
+		return pkgerrors.Errorf(pkgerrors.ErrForbidden, "agent %s failed the critical checks %s of its self-test", agent.Hostname, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
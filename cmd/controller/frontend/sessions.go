@@ -0,0 +1,177 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+func (frontend *Frontend) getQueue() ([]restapi.QueuedSession, error) {
+	iterator, err := frontend.storage.StaleReads().GetQueuedSessionsIterator()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]restapi.QueuedSession, 0)
+	for iterator.Next() {
+		session := iterator.Value()
+		sessions = append(sessions, restapi.QueuedSession{
+			Id:           session.Id,
+			Pool:         storage.Pool(session.Requirements.MatchLabels),
+			Requirements: session.Requirements,
+			RequestedAt:  session.RequestedAt,
+		})
+	}
+
+	return sessions, nil
+}
+
+// Cancels the session on behalf of canceledBy, such as an operator, returning the session
+func (frontend *Frontend) cancelSession(id string, canceledBy string) (restapi.Session, error) {
+	session, err := frontend.storage.GetSessionById(id)
+	if err != nil {
+		return restapi.Session{}, err
+	}
+
+	if session.State == restapi.SessionClosed || session.State == restapi.SessionCanceling {
+		return session, nil
+	}
+
+	err = frontend.storage.CancelSession(id)
+	if err != nil {
+		return restapi.Session{}, err
+	}
+
+	session, err = frontend.storage.GetSessionById(id)
+	if err != nil {
+		return restapi.Session{}, err
+	}
+
+	logger.WithSession(id).Infof("session %s canceled by %s, %s", id, canceledBy, session.State)
+	frontend.publishSessionState(id, "", session.State, session.ExitStatus)
+
+	return session, nil
+}
+
+// Lists the sessions placed on agents matching the query, including the agent each is placed on.
+// See parseListQuery
+func (frontend *Frontend) getSessionsEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/sessions").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			query, err := parseListQuery(r, "sessions", placedSessionStates)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			page, err := frontend.storage.StaleReads().QuerySessions(query)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			setPageHeaders(w, "sessions", query, page)
+			err = pkgnet.Respond(w, http.StatusOK, page.Items)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Lists the queued sessions in the order they are placed
+func (frontend *Frontend) getQueueEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/queue").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			sessions, err := frontend.getQueue()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, sessions)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Cancels the session whether or not it is persistent, unlike clients releasing their sessions
+func (frontend *Frontend) cancelSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/cancel/session/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			session, err := frontend.cancelSession(mux.Vars(r)["id"], "an operator")
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, session)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+// Cancels a session on behalf of the user who requested it, such as one requested with the wrong
+// requirements. Closes the session when queued, otherwise has its agent cancel it even when
+// persistent. Sessions recording their user may only be canceled by that user.
+func (frontend *Frontend) deleteSessionEp(group task.Group, router *mux.Router) error {
+	router.Methods("DELETE").Path("/v1/session/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := mux.Vars(r)["id"]
+
+			user, _, err := frontend.requester(r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			session, err := frontend.storage.GetSessionById(id)
+			if err == nil && session.User != "" && session.User != user {
+				err = pkgerrors.Errorf(pkgerrors.ErrForbidden, "session %s was requested by another user", id)
+			}
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			canceledBy := "its requester"
+			if user != "" {
+				canceledBy = fmt.Sprint("its user ", user)
+			}
+
+			session, err = frontend.cancelSession(id, canceledBy)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, session)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const (
+	// Interval the event log is read for state changes to stream, state changes may be published
+	// by the controller serving the backend rather than this one
+	eventStreamInterval = time.Second
+
+	eventStreamPingInterval = 30 * time.Second
+	eventStreamPongTimeout  = 2 * eventStreamPingInterval
+	eventStreamWriteTimeout = 10 * time.Second
+)
+
+var eventStreamUpgrader = websocket.Upgrader{}
+
+func (frontend *Frontend) publishSessionState(sessionId string, agentId string, state string, exitStatus string) {
+	if frontend.bus == nil {
+		return
+	}
+
+	message := fmt.Sprintf("session %s is %s", sessionId, state)
+	if exitStatus != "" {
+		message = fmt.Sprintf("%s, exit status %s", message, exitStatus)
+	}
+
+	frontend.bus.Publish(restapi.Event{
+		Type:      restapi.EventSessionStateChanged,
+		Message:   message,
+		AgentId:   agentId,
+		SessionId: sessionId,
+		Data: map[string]string{
+			"state":      state,
+			"exitStatus": exitStatus,
+		},
+	})
+}
+
+func (frontend *Frontend) publishAgentState(agentId string, state string) {
+	if frontend.bus == nil {
+		return
+	}
+
+	frontend.bus.Publish(restapi.Event{
+		Type:    restapi.EventAgentStateChanged,
+		Message: fmt.Sprintf("agent %s is %s", agentId, state),
+		AgentId: agentId,
+		Data: map[string]string{
+			"state": state,
+		},
+	})
+}
+
+// Returns whether the state change is one the subscription streams
+func subscribed(subscription restapi.EventSubscription, event restapi.Event) bool {
+	if event.Type != restapi.EventSessionStateChanged && event.Type != restapi.EventAgentStateChanged {
+		return false
+	}
+
+	if len(subscription.SessionIds) == 0 && len(subscription.AgentIds) == 0 {
+		return true
+	}
+
+	for _, id := range subscription.SessionIds {
+		if event.SessionId != "" && event.SessionId == id {
+			return true
+		}
+	}
+
+	for _, id := range subscription.AgentIds {
+		if event.AgentId != "" && event.AgentId == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads the subscriptions sent by the client until the connection closes or done is closed
+func readEventSubscriptions(conn *websocket.Conn, subscriptions chan<- restapi.EventSubscription, done <-chan struct{}) error {
+	conn.SetReadDeadline(time.Now().Add(eventStreamPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(eventStreamPongTimeout))
+	})
+
+	for {
+		var subscription restapi.EventSubscription
+		err := conn.ReadJSON(&subscription)
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+
+			return err
+		}
+
+		select {
+		case subscriptions <- subscription:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Streams the state changes of sessions and agents to clients over a WebSocket, so they need not
+// poll /v1/session/{id}. The client chooses the state changes streamed by sending a
+// restapi.EventSubscription, nothing is streamed until it does.
+func (frontend *Frontend) streamEventsEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/events").MatcherFunc(
+		func(r *http.Request, _ *mux.RouteMatch) bool {
+			return websocket.IsWebSocketUpgrade(r)
+		}).HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Responds to the client when the upgrade fails
+			conn, err := eventStreamUpgrader.Upgrade(w, r, nil)
+			if err != nil {
+				logger.Debugf("unable to upgrade %s to a WebSocket, %v", r.URL.Path, err)
+				return
+			}
+			defer conn.Close()
+
+			done := make(chan struct{})
+			defer close(done)
+
+			subscriptions := make(chan restapi.EventSubscription)
+			readErr := make(chan error, 1)
+			go func() {
+				readErr <- readEventSubscriptions(conn, subscriptions, done)
+				close(subscriptions)
+			}()
+
+			err = frontend.streamEvents(group, conn, subscriptions)
+			if err == nil {
+				// Set when the stream ended because the client closed the connection
+				select {
+				case err = <-readErr:
+				default:
+				}
+			}
+
+			if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Debugf("event stream closed, %v", err)
+			}
+		})
+	return nil
+}
+
+// Writes the subscribed state changes to the client until it closes the connection or the
+// controller stops
+func (frontend *Frontend) streamEvents(group task.Group, conn *websocket.Conn, subscriptions <-chan restapi.EventSubscription) error {
+	ticker := time.NewTicker(eventStreamInterval)
+	defer ticker.Stop()
+
+	pinger := time.NewTicker(eventStreamPingInterval)
+	defer pinger.Stop()
+
+	var subscription *restapi.EventSubscription
+	var next uint64
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "the controller is stopping"),
+				time.Now().Add(eventStreamWriteTimeout))
+
+		case <-pinger.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventStreamWriteTimeout))
+			if err != nil {
+				return err
+			}
+
+		case received, open := <-subscriptions:
+			if !open {
+				return nil
+			}
+
+			subscription = &received
+			next = received.Since
+
+			err := frontend.streamEventsSince(conn, *subscription, &next)
+			if err != nil {
+				return err
+			}
+
+		case <-ticker.C:
+			if subscription == nil {
+				continue
+			}
+
+			err := frontend.streamEventsSince(conn, *subscription, &next)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Writes the subscribed state changes published after next, advancing it past the events read
+func (frontend *Frontend) streamEventsSince(conn *websocket.Conn, subscription restapi.EventSubscription, next *uint64) error {
+	for {
+		events, err := frontend.storage.GetEventsSince(*next, maxEventReplayLimit)
+		if err != nil {
+			return errors.Join(err, conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "unable to read events"),
+				time.Now().Add(eventStreamWriteTimeout)))
+		}
+
+		for _, event := range events {
+			*next = event.Sequence
+
+			if subscribed(subscription, event) {
+				conn.SetWriteDeadline(time.Now().Add(eventStreamWriteTimeout))
+				err = conn.WriteJSON(event)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(events) < maxEventReplayLimit {
+			return nil
+		}
+	}
+}
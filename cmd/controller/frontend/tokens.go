@@ -0,0 +1,258 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	requireClientTokens = flag.Bool("require-client-tokens", false, "Rejects session requests and lookups without a bearer token, either minted through /v1/tokens, e.g. juicectl mint-token, or granted by --authorization-policy-file")
+)
+
+// Bytes of randomness in each minted token
+const apiTokenSize = 32
+
+type apiTokenKey struct{}
+
+// Tokens are random rather than chosen by users so an unsalted hash is enough to keep the stored
+// hashes from being used as tokens
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the minted token presented by the request, see authenticateApiToken
+func apiTokenOf(r *http.Request) (restapi.ApiToken, bool) {
+	token, found := r.Context().Value(apiTokenKey{}).(restapi.ApiToken)
+	return token, found
+}
+
+// Returns the user making the request and the user delegating it, see
+// authorizationPolicy.requester. The user of a minted token presented names the user.
+func (frontend *Frontend) requester(r *http.Request) (string, string, error) {
+	user, delegatedBy, err := frontend.policy.requester(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	if token, found := apiTokenOf(r); found && token.User != "" {
+		user = token.User
+	}
+
+	return user, delegatedBy, nil
+}
+
+// Adds the minted token presented by the request to its context, rejecting expired tokens. Bearer
+// tokens that were not minted are left to the authorization policy.
+func (frontend *Frontend) authenticateApiToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || bearer == "" || frontend.policy.token(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := frontend.storage.GetApiTokenByHash(hashApiToken(bearer))
+		if errors.Is(err, storage.ErrNotFound) {
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			err = errors.Join(err, pkgnet.RespondWithError(w, err))
+			logger.Error(err)
+			return
+		}
+
+		if token.Expired(time.Now()) {
+			err = pkgerrors.Errorf(pkgerrors.ErrUnauthorized, "%s %s: the token %s expired at %s", r.Method, r.URL.Path, token.Name, token.ExpiresAt.Format(time.RFC3339))
+			err = errors.Join(err, pkgnet.RespondWithError(w, err))
+			logger.Error(err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	})
+}
+
+// Returns an error when --require-client-tokens rejects the request for presenting no token
+func (frontend *Frontend) checkClientToken(r *http.Request) error {
+	if !*requireClientTokens {
+		return nil
+	}
+
+	if _, found := apiTokenOf(r); found || frontend.policy.token(r) != nil {
+		return nil
+	}
+
+	return pkgerrors.Errorf(pkgerrors.ErrUnauthorized, "%s %s requires a bearer token, see --require-client-tokens", r.Method, r.URL.Path)
+}
+
+// Mints a token, returning it along with the token itself, which is not stored
+func (frontend *Frontend) mintApiToken(request restapi.ApiTokenRequest) (restapi.ApiToken, error) {
+	random := make([]byte, apiTokenSize)
+	_, err := rand.Read(random)
+	if err != nil {
+		return restapi.ApiToken{}, err
+	}
+
+	token := restapi.ApiToken{
+		Id:        uuid.NewString(),
+		Name:      request.Name,
+		User:      request.User,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Token:     base64.RawURLEncoding.EncodeToString(random),
+	}
+
+	if request.TtlSeconds > 0 {
+		token.ExpiresAt = token.CreatedAt.Add(time.Duration(request.TtlSeconds) * time.Second)
+	}
+
+	err = frontend.storage.CreateApiToken(token, hashApiToken(token.Token))
+	if err != nil {
+		return restapi.ApiToken{}, err
+	}
+
+	expiresAt := ""
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = token.ExpiresAt.Format(time.RFC3339)
+	}
+
+	message := fmt.Sprintf("token %s minted", token.Name)
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventTokenMinted,
+			Message: message,
+			Data: map[string]string{
+				"id":        token.Id,
+				"name":      token.Name,
+				"user":      token.User,
+				"expiresAt": expiresAt,
+			},
+		})
+	} else {
+		logger.Info(message)
+	}
+
+	return token, nil
+}
+
+func (frontend *Frontend) deleteApiToken(id string) error {
+	token, err := frontend.storage.DeleteApiToken(id)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("token %s deleted", token.Name)
+	if frontend.bus != nil {
+		frontend.bus.Publish(restapi.Event{
+			Type:    restapi.EventTokenDeleted,
+			Message: message,
+			Data: map[string]string{
+				"id":   token.Id,
+				"name": token.Name,
+			},
+		})
+	} else {
+		logger.Info(message)
+	}
+
+	return nil
+}
+
+func (frontend *Frontend) mintApiTokenEp(group task.Group, router *mux.Router) error {
+	router.Methods("POST").Path("/v1/tokens").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			request, err := pkgnet.ReadRequestBody[restapi.ApiTokenRequest](r)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			if request.Name == "" || request.TtlSeconds < 0 {
+				err = errors.New("/v1/tokens: expected a name and a ttlSeconds of at least 0")
+				err = errors.Join(err, pkgnet.RespondWithString(w, http.StatusBadRequest, err.Error()))
+				logger.Error(err)
+				return
+			}
+
+			// Revoking a token by name must not also revoke another
+			if frontend.policy != nil {
+				for _, granted := range frontend.policy.Tokens {
+					if granted.Name == request.Name {
+						err = pkgerrors.Errorf(pkgerrors.ErrConflict, "/v1/tokens: --authorization-policy-file names a token %s", request.Name)
+						err = errors.Join(err, pkgnet.RespondWithError(w, err))
+						logger.Error(err)
+						return
+					}
+				}
+			}
+
+			token, err := frontend.mintApiToken(request)
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, token)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) getApiTokensEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/tokens").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			tokens, err := frontend.storage.GetApiTokens()
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, tokens)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
+
+func (frontend *Frontend) deleteApiTokenEp(group task.Group, router *mux.Router) error {
+	router.Methods("DELETE").Path("/v1/tokens/{id}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := frontend.deleteApiToken(mux.Vars(r)["id"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			pkgnet.RespondEmpty(w, http.StatusOK)
+		})
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Returns the session with the events published about it and the agent it was last placed on.
+// Events are not indexed by session, so every event kept by --event-retention is read.
+func (frontend *Frontend) getSessionTrace(id string) (restapi.SessionTrace, error) {
+	session, err := frontend.storage.GetSessionById(id)
+	if err != nil {
+		return restapi.SessionTrace{}, err
+	}
+
+	trace := restapi.SessionTrace{
+		Session: frontend.withDataChannelPolicy(session),
+		Events:  []restapi.Event{},
+	}
+
+	agentId := ""
+	var since uint64
+	for {
+		events, err := frontend.storage.GetEventsSince(since, maxEventReplayLimit)
+		if err != nil {
+			return restapi.SessionTrace{}, err
+		}
+
+		for _, event := range events {
+			since = event.Sequence
+
+			if event.SessionId == id {
+				trace.Events = append(trace.Events, event)
+				if event.AgentId != "" {
+					agentId = event.AgentId
+				}
+			}
+		}
+
+		if len(events) < maxEventReplayLimit {
+			break
+		}
+	}
+
+	if agentId != "" {
+		agent, err := frontend.storage.GetAgentById(agentId)
+		if err == nil {
+			// The other sessions on the agent are not the requester's
+			agent.Sessions = nil
+			trace.Agent = &agent
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return restapi.SessionTrace{}, err
+		}
+	}
+
+	return trace, nil
+}
+
+// Returns how the controller placed the session, for clients attaching it to bug reports
+func (frontend *Frontend) getSessionTraceEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path("/v1/session/{id}/trace").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			trace, err := frontend.getSessionTrace(mux.Vars(r)["id"])
+			if err != nil {
+				err = errors.Join(err, pkgnet.RespondWithError(w, err))
+				logger.Error(err)
+				return
+			}
+
+			err = pkgnet.Respond(w, http.StatusOK, trace)
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	pkgnet "github.com/Juice-Labs/Juice-Labs/pkg/net"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	apiV1Sunset = flag.String("api-v1-sunset", "", "Date (YYYY-MM-DD) after which /v1 routes may be removed, advertised to clients in the Sunset header")
+)
+
+var servedApiVersions = []string{restapi.ApiV1, restapi.ApiV2}
+
+type shimContextKey struct{}
+
+// Buffers responses with an error status so they can be rewritten as a structured error
+type structuredErrorWriter struct {
+	http.ResponseWriter
+
+	status int
+	body   bytes.Buffer
+}
+
+func (writer *structuredErrorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && !strings.HasPrefix(writer.Header().Get("Content-Type"), "application/json") {
+		writer.status = status
+		return
+	}
+
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *structuredErrorWriter) Write(data []byte) (int, error) {
+	if writer.status != 0 {
+		return writer.body.Write(data)
+	}
+
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *structuredErrorWriter) flush() error {
+	if writer.status == 0 {
+		return nil
+	}
+
+	writer.Header().Del("Content-Type")
+	writer.Header().Del("Content-Length")
+
+	return pkgnet.Respond(writer.ResponseWriter, writer.status, restapi.Error{
+		Status:  writer.status,
+		Code:    restapi.ErrorCodeFromStatus(writer.status),
+		Message: strings.TrimSpace(writer.body.String()),
+	})
+}
+
+func (frontend *Frontend) deprecationMiddleware(next http.Handler) http.Handler {
+	var sunset string
+	if *apiV1Sunset != "" {
+		date, err := time.Parse(time.DateOnly, *apiV1Sunset)
+		if err != nil {
+			logger.Warningf("--api-v1-sunset is not a valid date, %s", err)
+		} else {
+			sunset = date.UTC().Format(http.TimeFormat)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, found := strings.CutPrefix(r.URL.Path, "/v1/"); found && r.Context().Value(shimContextKey{}) == nil {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", fmt.Sprintf("</%s/%s>; rel=\"successor-version\"", restapi.ApiV2, rest))
+			if sunset != "" {
+				w.Header().Set("Sunset", sunset)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serves /v2 routes that have no dedicated handler using their /v1 handler,
+// converting error responses into structured errors
+func (frontend *Frontend) apiV2ShimEp(group task.Group, router *mux.Router) error {
+	router.Use(frontend.deprecationMiddleware)
+
+	router.PathPrefix("/v2/").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+
+			shimmed := r.Clone(context.WithValue(r.Context(), shimContextKey{}, true))
+			shimmed.URL.Path = fmt.Sprint("/v1/", rest)
+			shimmed.URL.RawPath = ""
+
+			var match mux.RouteMatch
+			if !router.Match(shimmed, &match) || match.MatchErr != nil {
+				err := pkgnet.Respond(w, http.StatusNotFound, restapi.Error{
+					Status:  http.StatusNotFound,
+					Code:    restapi.ErrorNotFound,
+					Message: fmt.Sprintf("%s %s is not a known route", r.Method, r.URL.Path),
+				})
+				if err != nil {
+					logger.Error(err)
+				}
+				return
+			}
+
+			writer := &structuredErrorWriter{ResponseWriter: w}
+			router.ServeHTTP(writer, shimmed)
+
+			err := writer.flush()
+			if err != nil {
+				logger.Error(err)
+			}
+		})
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// A Transport connects the ingester to an external message queue
+type Transport interface {
+	// Delivers request messages to handler until ctx is done. A message is
+	// acknowledged when handler returns nil and redelivered otherwise
+	Subscribe(ctx context.Context, handler func(data []byte) error) error
+
+	// Publishes a result message
+	Publish(ctx context.Context, data []byte) error
+
+	Close() error
+}
+
+type pendingRequest struct {
+	requestId string
+	state     string
+}
+
+// Ingests session requests from a Transport and publishes the progress of the
+// resulting sessions back through it
+type Ingester struct {
+	storage   storage.Storage
+	transport Transport
+
+	mutex   sync.Mutex
+	pending map[string]pendingRequest
+}
+
+func NewIngester(storage storage.Storage, transport Transport) *Ingester {
+	return &Ingester{
+		storage:   storage,
+		transport: transport,
+		pending:   map[string]pendingRequest{},
+	}
+}
+
+func (ingester *Ingester) Run(group task.Group) error {
+	group.GoFn("Ingest Close", func(group task.Group) error {
+		<-group.Ctx().Done()
+		return ingester.transport.Close()
+	})
+
+	group.GoFn("Ingest Results", func(group task.Group) error {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-group.Ctx().Done():
+				return nil
+
+			case <-ticker.C:
+				ingester.publishResults(group.Ctx())
+			}
+		}
+	})
+
+	return ingester.transport.Subscribe(group.Ctx(), func(data []byte) error {
+		return ingester.handleRequest(group.Ctx(), data)
+	})
+}
+
+func (ingester *Ingester) handleRequest(ctx context.Context, data []byte) error {
+	var request restapi.QueueRequest
+	err := json.Unmarshal(data, &request)
+	if err != nil {
+		// Malformed requests will never succeed, drop them rather than redelivering
+		logger.Errorf("Ingester: dropping malformed request, %s", err)
+		return nil
+	}
+
+	id, err := ingester.storage.RequestSession(request.Requirements)
+	if err != nil {
+		return fmt.Errorf("Ingester.handleRequest: failed to request session with %s", err)
+	}
+
+	// Requesters learn of their session through the published results rather than
+	// by polling, claim it on their behalf so it is not canceled as abandoned
+	err = ingester.storage.ClaimSession(id)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	ingester.mutex.Lock()
+	ingester.pending[id] = pendingRequest{
+		requestId: request.RequestId,
+		state:     restapi.SessionQueued,
+	}
+	ingester.mutex.Unlock()
+
+	return ingester.publish(ctx, restapi.QueueResult{
+		RequestId: request.RequestId,
+		SessionId: id,
+		State:     restapi.SessionQueued,
+	})
+}
+
+func (ingester *Ingester) publish(ctx context.Context, result restapi.QueueResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return ingester.transport.Publish(ctx, data)
+}
+
+func (ingester *Ingester) publishResults(ctx context.Context) {
+	ingester.mutex.Lock()
+	pending := make(map[string]pendingRequest, len(ingester.pending))
+	for id, request := range ingester.pending {
+		pending[id] = request
+	}
+	ingester.mutex.Unlock()
+
+	for id, request := range pending {
+		session, err := ingester.storage.GetSessionById(id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				session = restapi.Session{
+					Id:    id,
+					State: restapi.SessionClosed,
+				}
+			} else {
+				logger.Error(err)
+				continue
+			}
+		}
+
+		if session.State == request.state {
+			continue
+		}
+
+		err = ingester.publish(ctx, restapi.QueueResult{
+			RequestId:  request.requestId,
+			SessionId:  id,
+			State:      session.State,
+			ExitStatus: session.ExitStatus,
+			Address:    session.Address,
+		})
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		ingester.mutex.Lock()
+		if session.State == restapi.SessionClosed {
+			delete(ingester.pending, id)
+		} else {
+			request.state = session.State
+			ingester.pending[id] = request
+		}
+		ingester.mutex.Unlock()
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package ingest
+
+import (
+	"context"
+	"flag"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+var (
+	NatsUrl           = flag.String("ingest-nats-url", "", "NATS server to ingest session requests from using JetStream, disabled when empty")
+	natsStream        = flag.String("ingest-nats-stream", "JUICE_SESSIONS", "JetStream stream containing --ingest-nats-subject")
+	natsSubject       = flag.String("ingest-nats-subject", "juice.sessions.request", "Subject session requests are received on")
+	natsResultSubject = flag.String("ingest-nats-result-subject", "juice.sessions.result", "Subject session results are published on")
+	natsDurable       = flag.String("ingest-nats-durable", "juice-controller", "Durable consumer name shared by the controllers ingesting requests")
+)
+
+type natsTransport struct {
+	conn      *nats.Conn
+	jetStream nats.JetStreamContext
+}
+
+func OpenNatsTransport() (Transport, error) {
+	conn, err := nats.Connect(*NatsUrl, nats.Name("Juice Controller"))
+	if err != nil {
+		return nil, err
+	}
+
+	jetStream, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &natsTransport{
+		conn:      conn,
+		jetStream: jetStream,
+	}, nil
+}
+
+func (transport *natsTransport) Subscribe(ctx context.Context, handler func(data []byte) error) error {
+	// Queue subscribing with a durable consumer load balances requests across controllers
+	subscription, err := transport.jetStream.QueueSubscribe(*natsSubject, *natsDurable, func(message *nats.Msg) {
+		err := handler(message.Data)
+		if err != nil {
+			logger.Error(err)
+			err = message.Nak()
+		} else {
+			err = message.Ack()
+		}
+
+		if err != nil {
+			logger.Error(err)
+		}
+	}, nats.BindStream(*natsStream), nats.Durable(*natsDurable), nats.ManualAck())
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	return subscription.Drain()
+}
+
+func (transport *natsTransport) Publish(ctx context.Context, data []byte) error {
+	return transport.conn.Publish(*natsResultSubject, data)
+}
+
+func (transport *natsTransport) Close() error {
+	transport.conn.Close()
+	return nil
+}
@@ -0,0 +1,332 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Labels agents with the rack, datacenter, owner, and warranty of their host recorded in an
+// external inventory, such as a CMDB, so sessions may select agents by them
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	source    = flag.String("inventory-source", "", "The URL or file the inventory records of the agents' hosts are read from, see restapi.InventoryRecord. Agents are not labeled with inventory records when not set")
+	format    = flag.String("inventory-format", FormatJson, "The format of --inventory-source, json for an array of records or csv with a header naming the columns fingerprint, rack, datacenter, owner, and warranty")
+	tokenFile = flag.String("inventory-token-file", "", "File holding the bearer token presented to an --inventory-source URL")
+	interval  = flag.Duration("inventory-interval", time.Hour, "Interval between reads of --inventory-source")
+)
+
+const (
+	FormatJson = "json"
+	FormatCsv  = "csv"
+)
+
+const (
+	// Interval agents are labeled with the records last read, agents registering again replace
+	// their labels with the labels they register with
+	labelInterval = 10 * time.Second
+
+	fetchTimeout = time.Minute
+)
+
+// The labels of the inventory records, replaced on each agent by the labels of its record
+var inventoryLabels = []string{
+	restapi.InventoryRackLabel,
+	restapi.InventoryDatacenterLabel,
+	restapi.InventoryOwnerLabel,
+	restapi.InventoryWarrantyLabel,
+}
+
+type Importer struct {
+	storage storage.Storage
+	client  *http.Client
+	token   string
+
+	// By fingerprint in lower case, nil until the source is first read
+	records map[string]restapi.InventoryRecord
+}
+
+// Returns nil when --inventory-source is not set
+func NewImporter(storage storage.Storage) (*Importer, error) {
+	if *source == "" {
+		return nil, nil
+	}
+
+	if *format != FormatJson && *format != FormatCsv {
+		return nil, fmt.Errorf("--inventory-format must be %s or %s", FormatJson, FormatCsv)
+	}
+
+	if *interval <= 0 {
+		return nil, errors.New("--inventory-interval must be positive")
+	}
+
+	importer := &Importer{
+		storage: storage,
+		client: &http.Client{
+			Timeout: fetchTimeout,
+		},
+	}
+
+	if *tokenFile != "" {
+		token, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file %s, %v", *tokenFile, err)
+		}
+
+		importer.token = string(bytes.TrimSpace(token))
+	}
+
+	return importer, nil
+}
+
+func (importer *Importer) Run(group task.Group) error {
+	importer.read(group.Ctx())
+
+	reader := time.NewTicker(*interval)
+	defer reader.Stop()
+
+	labeler := time.NewTicker(labelInterval)
+	defer labeler.Stop()
+
+	for {
+		err := importer.label()
+		if err != nil {
+			logger.Warningf("unable to label agents with their inventory records, %v", err)
+		}
+
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-reader.C:
+			importer.read(group.Ctx())
+
+		case <-labeler.C:
+		}
+	}
+}
+
+// Reads the records from the source, keeping the records last read when it fails
+func (importer *Importer) read(ctx context.Context) {
+	records, err := importer.fetch(ctx)
+	if err != nil {
+		logger.Warningf("unable to read the inventory from %s, %v", *source, err)
+		return
+	}
+
+	byFingerprint := make(map[string]restapi.InventoryRecord, len(records))
+	for _, record := range records {
+		byFingerprint[strings.ToLower(record.Fingerprint)] = record
+	}
+
+	importer.records = byFingerprint
+	logger.Infof("read %d inventory records from %s", len(byFingerprint), *source)
+}
+
+func (importer *Importer) fetch(ctx context.Context) ([]restapi.InventoryRecord, error) {
+	if !strings.HasPrefix(*source, "http://") && !strings.HasPrefix(*source, "https://") {
+		file, err := os.Open(*source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		return parseRecords(file, *format)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, *source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if importer.token != "" {
+		request.Header.Set("Authorization", "Bearer "+importer.token)
+	}
+
+	response, err := importer.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("responded with code %d, %s", response.StatusCode, string(message))
+	}
+
+	return parseRecords(response.Body, *format)
+}
+
+func parseRecords(reader io.Reader, format string) ([]restapi.InventoryRecord, error) {
+	var records []restapi.InventoryRecord
+	if format == FormatCsv {
+		var err error
+		records, err = parseCsv(reader)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := json.NewDecoder(reader).Decode(&records)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for index, record := range records {
+		if record.Fingerprint == "" {
+			return nil, fmt.Errorf("record %d has no fingerprint", index+1)
+		}
+	}
+
+	return records, nil
+}
+
+// Reads the records by the columns named in the header, other columns are ignored
+func parseCsv(reader io.Reader) ([]restapi.InventoryRecord, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header, %v", err)
+	}
+
+	columns := map[string]int{}
+	for index, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = index
+	}
+
+	if _, present := columns["fingerprint"]; !present {
+		return nil, errors.New("the header has no fingerprint column")
+	}
+
+	records := []restapi.InventoryRecord{}
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		column := func(name string) string {
+			index, present := columns[name]
+			if !present || index >= len(row) {
+				return ""
+			}
+
+			return strings.TrimSpace(row[index])
+		}
+
+		records = append(records, restapi.InventoryRecord{
+			Fingerprint: column("fingerprint"),
+			Rack:        column("rack"),
+			Datacenter:  column("datacenter"),
+			Owner:       column("owner"),
+			Warranty:    column("warranty"),
+		})
+	}
+}
+
+// Returns the record of the agent's host, matched by its hostname or the UUIDs of its GPUs
+func (importer *Importer) match(agent restapi.Agent) (restapi.InventoryRecord, bool) {
+	record, found := importer.records[strings.ToLower(agent.Hostname)]
+	if found {
+		return record, true
+	}
+
+	for _, gpu := range agent.Gpus {
+		if gpu.Uuid == "" {
+			continue
+		}
+
+		record, found = importer.records[strings.ToLower(gpu.Uuid)]
+		if found {
+			return record, true
+		}
+	}
+
+	return restapi.InventoryRecord{}, false
+}
+
+// Replaces the inventory labels of each agent with the labels of its record, removing them from
+// agents without one
+func (importer *Importer) label() error {
+	if importer.records == nil {
+		return nil
+	}
+
+	iterator, err := importer.storage.GetAgents()
+	if err != nil {
+		return err
+	}
+
+	agents := []restapi.Agent{}
+	for iterator.Next() {
+		agent := iterator.Value()
+		if agent.State != restapi.AgentClosed {
+			agents = append(agents, agent)
+		}
+	}
+
+	for _, agent := range agents {
+		labels := map[string]string{}
+		for key, value := range agent.Labels {
+			labels[key] = value
+		}
+
+		for _, key := range inventoryLabels {
+			delete(labels, key)
+		}
+
+		if record, found := importer.match(agent); found {
+			for key, value := range record.Labels() {
+				labels[key] = value
+			}
+		}
+
+		if sameLabels(labels, agent.Labels) {
+			continue
+		}
+
+		err_ := importer.storage.SetAgentLabels(agent.Id, labels)
+		if err_ != nil && !errors.Is(err_, storage.ErrNotFound) {
+			err = errors.Join(err, err_)
+		}
+	}
+
+	return err
+}
+
+func sameLabels(labels map[string]string, other map[string]string) bool {
+	if len(labels) != len(other) {
+		return false
+	}
+
+	for key, value := range labels {
+		otherValue, present := other[key]
+		if !present || otherValue != value {
+			return false
+		}
+	}
+
+	return true
+}
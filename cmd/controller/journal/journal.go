@@ -0,0 +1,272 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Records the storage mutations made through the controllers in order, the same whichever storage
+// driver is used, for the /v1/journal long poll, webhook delivery, and the scheduler's agent cache
+// to follow changes without polling the storage's tables.
+//
+// The journal is kept in the storage, shared by the controllers sharing it and kept across their
+// restarts. Each mutation is appended as pending ahead of being applied, a mutation the journal
+// cannot be written for is not made, and its entry is updated once it completes. Readers stop at
+// the first entry still pending so the entries after it are not followed past while it may yet
+// be applied, an entry left pending longer than interruptedAfter by a controller that stopped is
+// returned as possibly applied.
+package journal
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var journalPoll = flag.Duration("journal-poll", time.Second, "Interval between reads of the journal for the mutations made by the other controllers sharing the storage")
+
+const (
+	// A pending entry is taken as interrupted once this old, the controllers' clocks must agree
+	// to well within it
+	interruptedAfter = time.Minute
+
+	// Entries read at a time following the journal
+	followLimit = 1000
+)
+
+type Journal struct {
+	storage storage.Storage
+	clock   clock.Clock
+
+	mutex sync.Mutex
+
+	// The sequence followed up to by Run
+	followed uint64
+	// The sequences appended through this controller and not yet followed, whose agents were
+	// notified as they completed
+	local map[uint64]struct{}
+
+	// Closed and replaced as entries complete, see Wait
+	completed chan struct{}
+
+	watchers storage.AgentWatchers
+}
+
+// Returns the journal kept in storage, which must be the driver rather than the storage Wrap
+// returns. Mutations already in the journal are not notified to the agent watchers.
+func New(ctx context.Context, storage storage.Storage) (*Journal, error) {
+	if *journalPoll <= 0 {
+		return nil, errors.New("--journal-poll must be positive")
+	}
+
+	sequence, err := storage.GetJournalSequence()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		storage:   storage,
+		clock:     clock.FromContext(ctx),
+		followed:  sequence,
+		local:     map[uint64]struct{}{},
+		completed: make(chan struct{}),
+	}, nil
+}
+
+// Appends the mutation as pending ahead of making it, returning the entry with its sequence and
+// time assigned
+func (journal *Journal) begin(entry restapi.JournalEntry) (restapi.JournalEntry, error) {
+	entry.State = restapi.JournalPending
+
+	entry, err := journal.storage.AppendJournalEntry(entry)
+	if err != nil {
+		return restapi.JournalEntry{}, err
+	}
+
+	journal.mutex.Lock()
+	journal.local[entry.Sequence] = struct{}{}
+	journal.mutex.Unlock()
+
+	return entry, nil
+}
+
+// Records the mutation entry was appended for completed in state, and notifies the agent watchers
+// of the agents it changed when it was applied. The mutation has already completed, failing to
+// record it leaves the entry pending until it is taken as interrupted.
+func (journal *Journal) end(entry restapi.JournalEntry, state string) {
+	entry.State = state
+
+	err := journal.storage.UpdateJournalEntry(entry)
+	if err != nil {
+		logger.Errorf("unable to record %s %d as %s in the journal, %v", entry.Operation, entry.Sequence, state, err)
+	}
+
+	journal.mutex.Lock()
+	close(journal.completed)
+	journal.completed = make(chan struct{})
+	journal.mutex.Unlock()
+
+	if state == restapi.JournalApplied {
+		journal.notify(entry)
+	}
+}
+
+func (journal *Journal) notify(entry restapi.JournalEntry) {
+	if entry.AllAgents {
+		journal.watchers.Notify("")
+	} else {
+		journal.watchers.Notify(entry.AgentIds...)
+	}
+}
+
+// Returns the sequence of the last entry appended by any controller, 0 when there are none
+func (journal *Journal) Sequence() (uint64, error) {
+	return journal.storage.GetJournalSequence()
+}
+
+// Returns up to limit entries of the mutations applied, or that may have been, with a sequence
+// greater than since, 0 for the oldest kept, in order of sequence. Entries of the mutations that
+// failed or changed nothing are skipped. Returns the sequence to continue from, which is that of
+// the last entry read whether or not it was returned, and whether entries after since are no
+// longer kept or since is past the last entry appended.
+func (journal *Journal) Since(since uint64, limit int) ([]restapi.JournalEntry, uint64, bool, error) {
+	sequence, err := journal.storage.GetJournalSequence()
+	if err != nil {
+		return nil, since, false, err
+	}
+
+	missed := false
+	if since > sequence {
+		missed = true
+		since = 0
+	} else if since > 0 {
+		oldest, err := journal.storage.GetJournalEntriesSince(0, 1)
+		if err != nil {
+			return nil, since, false, err
+		}
+
+		// Sequences are not always contiguous, a sequence can be taken by an append that failed,
+		// only the entries removed from before the oldest kept are missed
+		missed = (len(oldest) > 0 && oldest[0].Sequence > since+1) || (len(oldest) == 0 && since < sequence)
+	}
+
+	stored, err := journal.storage.GetJournalEntriesSince(since, limit)
+	if err != nil {
+		return nil, since, missed, err
+	}
+
+	next := since
+	entries := []restapi.JournalEntry{}
+	for _, entry := range stored {
+		if entry.State == restapi.JournalPending && journal.clock.Since(entry.Time) < interruptedAfter {
+			break
+		}
+
+		next = entry.Sequence
+		if entry.State == restapi.JournalFailed || entry.State == restapi.JournalUnchanged {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, missed, nil
+}
+
+// Waits until an entry with a sequence greater than since completes or ctx is done, returning
+// immediately when Since would continue from after since. Entries completed by the other
+// controllers are read every --journal-poll.
+func (journal *Journal) Wait(ctx context.Context, since uint64) {
+	ticker := time.NewTicker(*journalPoll)
+	defer ticker.Stop()
+
+	for {
+		journal.mutex.Lock()
+		completed := journal.completed
+		journal.mutex.Unlock()
+
+		_, next, missed, err := journal.Since(since, 1)
+		if err != nil || missed || next != since {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-completed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Follows the entries appended by the other controllers sharing the storage, notifying the agent
+// watchers of the agents they changed
+func (journal *Journal) Run(group task.Group) error {
+	ticker := time.NewTicker(*journalPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			err := journal.follow()
+			if err != nil {
+				logger.Warningf("unable to follow the journal, %v", err)
+			}
+		}
+	}
+}
+
+func (journal *Journal) follow() error {
+	for {
+		entries, next, missed, err := journal.Since(journal.followed, followLimit)
+		if err != nil {
+			return err
+		}
+
+		// The changes removed from the journal before they were followed may be to any agent
+		if missed {
+			journal.watchers.Notify("")
+		}
+
+		// Those appended through this controller were notified as they completed
+		others := []restapi.JournalEntry{}
+
+		journal.mutex.Lock()
+		for _, entry := range entries {
+			if _, found := journal.local[entry.Sequence]; !found {
+				others = append(others, entry)
+			}
+		}
+		for sequence := range journal.local {
+			if sequence <= next {
+				delete(journal.local, sequence)
+			}
+		}
+		journal.mutex.Unlock()
+
+		for _, entry := range others {
+			journal.notify(entry)
+		}
+
+		if next == journal.followed {
+			return nil
+		}
+		journal.followed = next
+	}
+}
+
+// Calls notify with the id of each agent the mutations change, or with an empty id when they may
+// have changed any agent. The mutations made through this controller are notified as they
+// complete, those made by the other controllers as they are followed. notify must not block or
+// call back into the storage. Returns a function to stop watching.
+func (journal *Journal) WatchAgents(notify func(agentId string)) func() {
+	return journal.watchers.Watch(notify)
+}
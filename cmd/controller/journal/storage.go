@@ -0,0 +1,668 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package journal
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Records the mutations made through the storage in the journal ahead of making them
+type journaledStorage struct {
+	storage storage.Storage
+	journal *Journal
+
+	tracked *trackedIds
+}
+
+// What the drivers do not return from the mutations but the journal records of them
+type trackedIds struct {
+	mutex sync.Mutex
+
+	// The agents marked missing, whose removal is recorded by RemoveMissingAgentsIfNotUpdatedFor
+	seeded  bool
+	missing map[string]struct{}
+
+	// The agents sessions were placed on by session, until the sessions close
+	sessionAgents map[string]string
+}
+
+// Returns the storage recording its mutations in the journal
+func (journal *Journal) Wrap(storage storage.Storage) storage.Storage {
+	return journaledStorage{
+		storage: storage,
+		journal: journal,
+		tracked: &trackedIds{
+			missing:       map[string]struct{}{},
+			sessionAgents: map[string]string{},
+		},
+	}
+}
+
+// Appends the mutation as pending, the mutation must not be made when this fails
+func (s journaledStorage) begin(operation string, kind string, id string, agentIds ...string) (restapi.JournalEntry, error) {
+	return s.journal.begin(restapi.JournalEntry{
+		Operation: operation,
+		Kind:      kind,
+		Id:        id,
+		AgentIds:  agentIds,
+	})
+}
+
+// Appends a mutation whose agents are only known once it is made, it may have changed any agent
+// when it is interrupted
+func (s journaledStorage) beginAllAgents(operation string, kind string) (restapi.JournalEntry, error) {
+	return s.journal.begin(restapi.JournalEntry{
+		Operation: operation,
+		Kind:      kind,
+		AllAgents: true,
+	})
+}
+
+// Records the mutation as applied, or failed when err is set
+func (s journaledStorage) end(entry restapi.JournalEntry, err error) {
+	if err != nil {
+		s.journal.end(entry, restapi.JournalFailed)
+	} else {
+		s.journal.end(entry, restapi.JournalApplied)
+	}
+}
+
+// Records the mutation as applied when it changed anything
+func (s journaledStorage) endIfChanged(entry restapi.JournalEntry, changed bool, err error) {
+	if err == nil && !changed {
+		s.journal.end(entry, restapi.JournalUnchanged)
+	} else {
+		s.end(entry, err)
+	}
+}
+
+func (s journaledStorage) placed(sessionId string, agentId string) {
+	s.tracked.mutex.Lock()
+	defer s.tracked.mutex.Unlock()
+
+	s.tracked.sessionAgents[sessionId] = agentId
+}
+
+// Returns the agent the session was placed on through the storage, false when it is not known
+func (s journaledStorage) sessionAgent(sessionId string) (string, bool) {
+	s.tracked.mutex.Lock()
+	defer s.tracked.mutex.Unlock()
+
+	agentId, found := s.tracked.sessionAgents[sessionId]
+	return agentId, found
+}
+
+func (s journaledStorage) Close() error {
+	return s.storage.Close()
+}
+
+func (s journaledStorage) StaleReads() storage.Storage {
+	return journaledStorage{
+		storage: s.storage.StaleReads(),
+		journal: s.journal,
+		tracked: s.tracked,
+	}
+}
+
+func (s journaledStorage) AggregateData() (storage.AggregatedData, error) {
+	return s.storage.AggregateData()
+}
+
+func (s journaledStorage) RegisterAgent(agent restapi.Agent) (string, error) {
+	entry, err := s.beginAllAgents("RegisterAgent", restapi.JournalAgent)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := s.storage.RegisterAgent(agent)
+	if err == nil {
+		entry.Id = id
+		entry.AgentIds = []string{id}
+		entry.AllAgents = false
+	}
+	s.end(entry, err)
+	return id, err
+}
+
+func (s journaledStorage) GetAgentById(id string) (restapi.Agent, error) {
+	return s.storage.GetAgentById(id)
+}
+
+func (s journaledStorage) UpdateAgent(update restapi.AgentUpdate) error {
+	entry, err := s.begin("UpdateAgent", restapi.JournalAgent, update.Id, update.Id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.UpdateAgent(update)
+	if err == nil {
+		s.tracked.mutex.Lock()
+		if update.State != restapi.AgentMissing {
+			delete(s.tracked.missing, update.Id)
+		}
+		for sessionId, session := range update.Sessions {
+			if session.State == restapi.SessionClosed {
+				delete(s.tracked.sessionAgents, sessionId)
+			}
+		}
+		s.tracked.mutex.Unlock()
+	}
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) SetAgentDraining(id string, draining bool) error {
+	entry, err := s.begin("SetAgentDraining", restapi.JournalAgent, id, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.SetAgentDraining(id, draining)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) SetAgentLabels(id string, labels map[string]string) error {
+	entry, err := s.begin("SetAgentLabels", restapi.JournalAgent, id, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.SetAgentLabels(id, labels)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) PatchAgentLabels(id string, patch restapi.AgentLabelsPatch) error {
+	entry, err := s.begin("PatchAgentLabels", restapi.JournalAgent, id, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.PatchAgentLabels(id, patch)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) RequestSession(requirements restapi.SessionRequirements) (string, error) {
+	entry, err := s.begin("RequestSession", restapi.JournalSession, "")
+	if err != nil {
+		return "", err
+	}
+
+	id, err := s.storage.RequestSession(requirements)
+	entry.Id = id
+	s.end(entry, err)
+	return id, err
+}
+
+func (s journaledStorage) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu, cpuFallback bool) error {
+	entry, err := s.begin("AssignSession", restapi.JournalSession, sessionId, agentId)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.AssignSession(sessionId, agentId, gpus, cpuFallback)
+	if err == nil {
+		s.placed(sessionId, agentId)
+	}
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) GetSessionById(id string) (restapi.Session, error) {
+	return s.storage.GetSessionById(id)
+}
+
+func (s journaledStorage) AdoptSession(agentId string, session restapi.Session) error {
+	entry, err := s.begin("AdoptSession", restapi.JournalSession, session.Id, agentId)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.AdoptSession(agentId, session)
+	if err == nil {
+		s.placed(session.Id, agentId)
+	}
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) ClaimSession(id string) error {
+	entry, err := s.begin("ClaimSession", restapi.JournalSession, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.ClaimSession(id)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) ReleaseSession(id string, release restapi.SessionRelease) error {
+	entry, err := s.begin("ReleaseSession", restapi.JournalSession, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.ReleaseSession(id, release)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) CancelSession(id string) error {
+	entry, err := s.begin("CancelSession", restapi.JournalSession, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.CancelSession(id)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) PreemptSession(id string) error {
+	entry, err := s.begin("PreemptSession", restapi.JournalSession, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.PreemptSession(id)
+	s.end(entry, err)
+	return err
+}
+
+// The preemptibility of the sessions placed on an agent changes which sessions the agent takes
+func (s journaledStorage) SetSessionPreemptible(id string, preemptible bool) error {
+	entry := restapi.JournalEntry{
+		Operation: "SetSessionPreemptible",
+		Kind:      restapi.JournalSession,
+		Id:        id,
+		AllAgents: true,
+	}
+
+	if agentId, found := s.sessionAgent(id); found {
+		entry.AgentIds = []string{agentId}
+		entry.AllAgents = false
+	}
+
+	entry, err := s.journal.begin(entry)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.SetSessionPreemptible(id, preemptible)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) UpdateSessionFrames(id string, frames restapi.FrameMetrics) error {
+	entry, err := s.begin("UpdateSessionFrames", restapi.JournalSession, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.UpdateSessionFrames(id, frames)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	return s.storage.GetQueuedSessionById(id)
+}
+
+func (s journaledStorage) GetAgents() (storage.Iterator[restapi.Agent], error) {
+	return s.storage.GetAgents()
+}
+
+func (s journaledStorage) QueryAgents(query restapi.ListQuery) (storage.Page[restapi.Agent], error) {
+	return s.storage.QueryAgents(query)
+}
+
+func (s journaledStorage) QuerySessions(query restapi.ListQuery) (storage.Page[restapi.PlacedSession], error) {
+	return s.storage.QuerySessions(query)
+}
+
+func (s journaledStorage) GetAvailableAgentsMatching(gpuVramAvailableAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+	return s.storage.GetAvailableAgentsMatching(gpuVramAvailableAtLeast)
+}
+
+func (s journaledStorage) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	return s.storage.GetQueuedSessionsIterator()
+}
+
+func (s journaledStorage) GetSessionsClosedWithin(duration time.Duration) (storage.Iterator[storage.ClosedSession], error) {
+	return s.storage.GetSessionsClosedWithin(duration)
+}
+
+func (s journaledStorage) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) ([]string, error) {
+	entry, err := s.beginAllAgents("SetAgentsMissingIfNotUpdatedFor", restapi.JournalAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.storage.SetAgentsMissingIfNotUpdatedFor(duration)
+	if err == nil {
+		s.tracked.mutex.Lock()
+		for _, id := range ids {
+			s.tracked.missing[id] = struct{}{}
+		}
+		s.tracked.mutex.Unlock()
+
+		entry.AgentIds = ids
+		entry.AllAgents = false
+	}
+	s.endIfChanged(entry, len(ids) > 0, err)
+	return ids, err
+}
+
+func (s journaledStorage) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
+	s.tracked.mutex.Lock()
+	defer s.tracked.mutex.Unlock()
+
+	// Agents left missing before the controller started are only known to the storage
+	if !s.tracked.seeded {
+		page, err := s.storage.QueryAgents(restapi.ListQuery{
+			State: restapi.AgentMissing,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, agent := range page.Items {
+			s.tracked.missing[agent.Id] = struct{}{}
+		}
+		s.tracked.seeded = true
+	}
+
+	entry, err := s.beginAllAgents("RemoveMissingAgentsIfNotUpdatedFor", restapi.JournalAgent)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.RemoveMissingAgentsIfNotUpdatedFor(duration)
+	if err != nil {
+		s.end(entry, err)
+		return err
+	}
+
+	removed := []string{}
+	for id := range s.tracked.missing {
+		_, err := s.storage.GetAgentById(id)
+		if errors.Is(err, storage.ErrNotFound) {
+			removed = append(removed, id)
+			delete(s.tracked.missing, id)
+		}
+	}
+
+	entry.AgentIds = removed
+	entry.AllAgents = false
+	s.endIfChanged(entry, len(removed) > 0, nil)
+	return nil
+}
+
+func (s journaledStorage) CancelUnclaimedSessionsOlderThan(duration time.Duration) (int, error) {
+	entry, err := s.beginAllAgents("CancelUnclaimedSessionsOlderThan", restapi.JournalSession)
+	if err != nil {
+		return 0, err
+	}
+
+	canceled, err := s.storage.CancelUnclaimedSessionsOlderThan(duration)
+	s.endIfChanged(entry, canceled > 0, err)
+	return canceled, err
+}
+
+func (s journaledStorage) ImportExpectedAgents(agents []restapi.ExpectedAgent) error {
+	entry, err := s.begin("ImportExpectedAgents", restapi.JournalExpectedAgent, "")
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.ImportExpectedAgents(agents)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) GetExpectedAgentByHostname(hostname string) (restapi.ExpectedAgent, error) {
+	return s.storage.GetExpectedAgentByHostname(hostname)
+}
+
+func (s journaledStorage) GetExpectedAgents() (storage.Iterator[restapi.ExpectedAgent], error) {
+	return s.storage.GetExpectedAgents()
+}
+
+func (s journaledStorage) RevokeCredential(revocation restapi.Revocation) error {
+	entry, err := s.begin("RevokeCredential", restapi.JournalRevocation, revocation.Subject)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.RevokeCredential(revocation)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) RemoveRevocation(kind string, subject string) error {
+	entry, err := s.begin("RemoveRevocation", restapi.JournalRevocation, subject)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.RemoveRevocation(kind, subject)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) GetRevocations() ([]restapi.Revocation, error) {
+	return s.storage.GetRevocations()
+}
+
+func (s journaledStorage) CreateApiToken(token restapi.ApiToken, hash string) error {
+	entry, err := s.begin("CreateApiToken", restapi.JournalApiToken, token.Id)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.CreateApiToken(token, hash)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) GetApiTokenByHash(hash string) (restapi.ApiToken, error) {
+	return s.storage.GetApiTokenByHash(hash)
+}
+
+func (s journaledStorage) GetApiTokens() ([]restapi.ApiToken, error) {
+	return s.storage.GetApiTokens()
+}
+
+func (s journaledStorage) DeleteApiToken(id string) (restapi.ApiToken, error) {
+	entry, err := s.begin("DeleteApiToken", restapi.JournalApiToken, id)
+	if err != nil {
+		return restapi.ApiToken{}, err
+	}
+
+	token, err := s.storage.DeleteApiToken(id)
+	s.end(entry, err)
+	return token, err
+}
+
+// Leases are renewed every few seconds and change nothing about the fleet, they are not journaled
+func (s journaledStorage) AcquireLease(name string, holder string, duration time.Duration) (restapi.Lease, error) {
+	return s.storage.AcquireLease(name, holder, duration)
+}
+
+func (s journaledStorage) ReleaseLease(name string, holder string) error {
+	return s.storage.ReleaseLease(name, holder)
+}
+
+func (s journaledStorage) GetLease(name string) (restapi.Lease, error) {
+	return s.storage.GetLease(name)
+}
+
+// Pool pauses and feature flags change no agents or sessions, they are not journaled
+func (s journaledStorage) SetPoolPaused(pool string, paused bool) error {
+	return s.storage.SetPoolPaused(pool, paused)
+}
+
+func (s journaledStorage) PutListSnapshot(snapshot storage.ListSnapshot) error {
+	return s.storage.PutListSnapshot(snapshot)
+}
+
+func (s journaledStorage) GetListSnapshot(id string) (storage.ListSnapshot, error) {
+	return s.storage.GetListSnapshot(id)
+}
+
+func (s journaledStorage) GetPausedPools() ([]string, error) {
+	return s.storage.GetPausedPools()
+}
+
+func (s journaledStorage) SetFeatureOverride(override storage.FeatureOverride) error {
+	return s.storage.SetFeatureOverride(override)
+}
+
+func (s journaledStorage) GetFeatureOverrides() ([]storage.FeatureOverride, error) {
+	return s.storage.GetFeatureOverrides()
+}
+
+func (s journaledStorage) PutConfigResource(resource restapi.ConfigResource) error {
+	entry, err := s.begin("PutConfigResource", restapi.JournalConfigResource, resource.Kind+"/"+resource.Name)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.PutConfigResource(resource)
+	s.end(entry, err)
+	return err
+}
+
+func (s journaledStorage) GetConfigResources(kind string) ([]restapi.ConfigResource, error) {
+	return s.storage.GetConfigResources(kind)
+}
+
+func (s journaledStorage) DeleteConfigResource(kind string, name string) error {
+	entry, err := s.begin("DeleteConfigResource", restapi.JournalConfigResource, kind+"/"+name)
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.DeleteConfigResource(kind, name)
+	s.end(entry, err)
+	return err
+}
+
+// Re-encrypting secrets changes none of the values read, it is not journaled
+func (s journaledStorage) RotateSecrets() (int, error) {
+	return s.storage.RotateSecrets()
+}
+
+func (s journaledStorage) RollUpUsageOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	if dryRun {
+		return s.storage.RollUpUsageOlderThan(duration, dryRun)
+	}
+
+	entry, err := s.begin("RollUpUsageOlderThan", restapi.JournalUsage, "")
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := s.storage.RollUpUsageOlderThan(duration, dryRun)
+	s.endIfChanged(entry, count > 0, err)
+	return count, err
+}
+
+func (s journaledStorage) GetUsageAggregates() ([]restapi.UsageAggregate, error) {
+	return s.storage.GetUsageAggregates()
+}
+
+func (s journaledStorage) RemoveClosedSessionsOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	if dryRun {
+		return s.storage.RemoveClosedSessionsOlderThan(duration, dryRun)
+	}
+
+	entry, err := s.begin("RemoveClosedSessionsOlderThan", restapi.JournalSession, "")
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := s.storage.RemoveClosedSessionsOlderThan(duration, dryRun)
+	s.endIfChanged(entry, count > 0, err)
+	return count, err
+}
+
+func (s journaledStorage) AppendEvent(event restapi.Event) (restapi.Event, error) {
+	entry, err := s.begin("AppendEvent", restapi.JournalEvent, "")
+	if err != nil {
+		return restapi.Event{}, err
+	}
+
+	event, err = s.storage.AppendEvent(event)
+	if err == nil {
+		entry.Id = strconv.FormatUint(event.Sequence, 10)
+		entry.Event = &event
+	}
+	s.end(entry, err)
+	return event, err
+}
+
+func (s journaledStorage) GetEventsSince(since uint64, limit int) ([]restapi.Event, error) {
+	return s.storage.GetEventsSince(since, limit)
+}
+
+func (s journaledStorage) RemoveEventsOlderThan(duration time.Duration) error {
+	entry, err := s.begin("RemoveEventsOlderThan", restapi.JournalEvent, "")
+	if err != nil {
+		return err
+	}
+
+	err = s.storage.RemoveEventsOlderThan(duration)
+	s.end(entry, err)
+	return err
+}
+
+// The journal itself is not journaled
+func (s journaledStorage) AppendJournalEntry(entry restapi.JournalEntry) (restapi.JournalEntry, error) {
+	return s.storage.AppendJournalEntry(entry)
+}
+
+func (s journaledStorage) UpdateJournalEntry(entry restapi.JournalEntry) error {
+	return s.storage.UpdateJournalEntry(entry)
+}
+
+func (s journaledStorage) GetJournalEntriesSince(since uint64, limit int) ([]restapi.JournalEntry, error) {
+	return s.storage.GetJournalEntriesSince(since, limit)
+}
+
+func (s journaledStorage) GetJournalSequence() (uint64, error) {
+	return s.storage.GetJournalSequence()
+}
+
+func (s journaledStorage) RemoveJournalEntriesOlderThan(duration time.Duration) error {
+	return s.storage.RemoveJournalEntriesOlderThan(duration)
+}
+
+func (s journaledStorage) PutJournalCursor(cursor storage.JournalCursor) error {
+	return s.storage.PutJournalCursor(cursor)
+}
+
+func (s journaledStorage) GetJournalCursor(name string) (storage.JournalCursor, error) {
+	return s.storage.GetJournalCursor(name)
+}
+
+func (s journaledStorage) DeleteJournalCursor(name string) error {
+	return s.storage.DeleteJournalCursor(name)
+}
+
+// Notifies of the agents changed from the journal, those changed through this controller as the
+// mutations complete and those changed by the other controllers sharing the storage as Run
+// follows them
+func (s journaledStorage) WatchAgents(notify func(agentId string)) (func(), error) {
+	return s.journal.WatchAgents(notify), nil
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,14 +14,30 @@ import (
 	"strings"
 
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/backend"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/callbacks"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/election"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/features"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/frontend"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/ingest"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/inventory"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/journal"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/notify"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/retention"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/slo"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/bolt"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/memdb"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/postgres"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/sqlite"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/webhooks"
 	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
 	"github.com/Juice-Labs/Juice-Labs/pkg/appmain"
 	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
 
@@ -30,20 +47,53 @@ var (
 	generateCert = flag.Bool("generate-cert", false, "Generates a certificate for https")
 	disableTls   = flag.Bool("disable-tls", true, "")
 
+	caCertFile = flag.String("ca-cert-file", "", "Certificate of the authority used to issue agent and client certificates")
+	caKeyFile  = flag.String("ca-key-file", "", "Private key of the authority used to issue agent and client certificates")
+	generateCa = flag.Bool("generate-ca", false, "Generates an ephemeral certificate authority used to issue agent and client certificates")
+
+	clientCaFile = flag.String("client-ca-file", "", "Certificates of additional authorities agent and client certificates are verified against, such as an organization's PKI issuing agents their certificates")
+
 	enableFrontend   = flag.Bool("frontend", false, "")
 	enableBackend    = flag.Bool("backend", false, "")
 	enablePrometheus = flag.Bool("prometheus", false, "")
 
 	psqlConnection         = flag.String("psql-connection", "", "See https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters")
 	psqlConnectionFromFile = flag.String("psql-connection-from-file", "", "See https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters")
+
+	psqlReplicaConnection         = flag.String("psql-replica-connection", "", "Connection to a read replica of --psql-connection serving reads that tolerate staleness, such as dashboards and metrics")
+	psqlReplicaConnectionFromFile = flag.String("psql-replica-connections-from-file", "", "File of read replica connections, one per line, used in turn like --psql-replica-connection")
+
+	psqlMigrate = flag.Bool("psql-migrate", false, "Migrates the schema to the version this controller requires before starting, see juicectl migrate")
+
+	boltPath = flag.String("bolt-path", "", "Persists the controller's state in an embedded database file at this path, created when it does not exist, for persistence without postgres")
+
+	sqlitePath = flag.String("sqlite-path", "", "Persists the controller's state in a SQLite database file at this path in WAL mode, created when it does not exist, for persistence without postgres on a single controller")
+
+	storageEncryptionKeyFile = flag.String("storage-encryption-key-file", "", "File of <key id>:<base64 32 byte key> lines used to encrypt secrets stored in postgres, --bolt-path, or --sqlite-path, the first key encrypts and the secrets encrypted with the remaining keys are re-encrypted with it at startup")
 )
 
+func loadKeyring() (*crypto.Keyring, error) {
+	if *storageEncryptionKeyFile == "" {
+		return nil, nil
+	}
+
+	return crypto.LoadKeyring(*storageEncryptionKeyFile)
+}
+
 func openStorage(ctx context.Context) (storage.Storage, error) {
 	if len(*psqlConnection) > 0 || len(*psqlConnectionFromFile) > 0 {
 		if len(*psqlConnection) > 0 && len(*psqlConnectionFromFile) > 0 {
 			return nil, errors.New("--psql-connection and --psql-connection-from-file are mutually exclusive, one or the other but not both")
 		}
 
+		if len(*boltPath) > 0 {
+			return nil, errors.New("--bolt-path and --psql-connection are mutually exclusive, one or the other but not both")
+		}
+
+		if len(*sqlitePath) > 0 {
+			return nil, errors.New("--sqlite-path and --psql-connection are mutually exclusive, one or the other but not both")
+		}
+
 		connection := ""
 		if len(*psqlConnection) > 0 {
 			connection = *psqlConnection
@@ -56,27 +106,182 @@ func openStorage(ctx context.Context) (storage.Storage, error) {
 			connection = strings.TrimSpace(string(text))
 		}
 
-		return postgres.OpenStorage(ctx, connection)
+		keyring, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+
+		replicaConnections, err := readReplicaConnections()
+		if err != nil {
+			return nil, err
+		}
+
+		if *psqlMigrate {
+			err = migrateStorage(ctx, connection)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return postgres.OpenStorage(ctx, connection, replicaConnections, keyring)
+	}
+
+	if len(*psqlReplicaConnection) > 0 || len(*psqlReplicaConnectionFromFile) > 0 {
+		logger.Warning("--psql-replica-connection and --psql-replica-connections-from-file are ignored without --psql-connection")
+	}
+
+	if len(*boltPath) > 0 && len(*sqlitePath) > 0 {
+		return nil, errors.New("--bolt-path and --sqlite-path are mutually exclusive, one or the other but not both")
+	}
+
+	if len(*boltPath) > 0 {
+		keyring, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+
+		return bolt.OpenStorage(ctx, *boltPath, keyring)
+	}
+
+	if len(*sqlitePath) > 0 {
+		keyring, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+
+		return sqlite.OpenStorage(ctx, *sqlitePath, keyring)
+	}
+
+	if *storageEncryptionKeyFile != "" {
+		logger.Warning("--storage-encryption-key-file is ignored, the in-memory storage is not persisted")
 	}
 
 	return memdb.OpenStorage(ctx)
 }
 
+func migrateStorage(ctx context.Context, connection string) error {
+	migrator, err := postgres.OpenMigrator(connection)
+	if err != nil {
+		return err
+	}
+
+	_, err = migrator.Migrate(ctx, postgres.LatestSchemaVersion(), false, func(step postgres.MigrationStep) {
+		logger.Infof("schema migration: %s", step)
+	})
+
+	return errors.Join(err, migrator.Close())
+}
+
+func readReplicaConnections() ([]string, error) {
+	replicaConnections := []string{}
+	if len(*psqlReplicaConnection) > 0 {
+		replicaConnections = append(replicaConnections, *psqlReplicaConnection)
+	}
+
+	if len(*psqlReplicaConnectionFromFile) > 0 {
+		text, err := ioutil.ReadFile(*psqlReplicaConnectionFromFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file %s, %v", *psqlReplicaConnectionFromFile, err)
+		}
+
+		for _, line := range strings.Split(string(text), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				replicaConnections = append(replicaConnections, line)
+			}
+		}
+	}
+
+	return replicaConnections, nil
+}
+
 func main() {
 	appmain.Run("Juice Controller", build.Version, func(group task.Group) error {
 		var err error
 
+		// Records the mutations made through the storage in its journal, whichever driver is used
+		var mutations *journal.Journal
+
 		storage, err := openStorage(group.Ctx())
 		if err == nil {
+			// Re-encrypts the secrets encrypted with keys other than the primary, so the old keys
+			// can be removed from the file once every controller has restarted with the new key
+			var rotated int
+			rotated, err = storage.RotateSecrets()
+			if err != nil {
+				return errors.Join(fmt.Errorf("unable to re-encrypt the stored secrets, %v", err), storage.Close())
+			}
+			if rotated > 0 {
+				logger.Infof("re-encrypted %d stored secrets with the primary key", rotated)
+			}
+
+			mutations, err = journal.New(group.Ctx(), storage)
+			if err != nil {
+				return errors.Join(err, storage.Close())
+			}
+			group.Go("Journal", mutations)
+
+			storage = prometheus.InstrumentStorage(mutations.Wrap(storage))
+
 			group.GoFn("Storage Close", func(group task.Group) error {
 				<-group.Ctx().Done()
 				return storage.Close()
 			})
 		}
 
+		bus := events.NewBus(storage)
+		tracker := slo.NewTracker(bus)
+
+		// Feature flags and paused pools are shared through the storage by the controller replicas
+		var featureSet *features.Set
+		if err == nil {
+			featureSet, err = features.Load(storage)
+			if err == nil {
+				group.Go("Features", featureSet)
+			}
+		}
+
+		var pools *scheduling.Pools
+		if err == nil {
+			pools, err = scheduling.NewPools(storage)
+			if err == nil {
+				group.Go("Paused Pools", pools)
+			}
+		}
+
+		// Quotas, role bindings and webhooks applied through the API, also shared through the storage
+		var resourceStore *resources.Store
+		if err == nil {
+			resourceStore, err = resources.Load(storage)
+			if err == nil {
+				group.Go("Config Resources", resourceStore)
+			}
+		}
+
+		// Only applied by the backend, nil when it is disabled
+		var retentionManager *retention.Manager
+		if err == nil && *enableBackend {
+			retentionManager, err = retention.NewManager(storage)
+		}
+
+		var authority *crypto.CertificateAuthority
+		if err == nil && *enableFrontend {
+			if *caCertFile != "" && *caKeyFile != "" {
+				authority, err = crypto.LoadCertificateAuthority(*caCertFile, *caKeyFile)
+			} else if *generateCa {
+				authority, err = crypto.GenerateCertificateAuthority()
+			}
+		}
+
+		// Certificates monitored for expiry by the name they are reported with
+		certificates := map[string]*x509.Certificate{}
+		if authority != nil {
+			certificates["certificate authority"] = authority.Certificate()
+		}
+
 		var tlsConfig *tls.Config
 
-		if (*enableFrontend || *enablePrometheus) && !*disableTls {
+		if err == nil && (*enableFrontend || *enablePrometheus) && !*disableTls {
 			var certificate tls.Certificate
 			if *certFile != "" && *keyFile != "" {
 				certificate, err = tls.LoadX509KeyPair(*certFile, *keyFile)
@@ -87,15 +292,35 @@ func main() {
 			}
 
 			if err == nil {
+				leaf, err_ := x509.ParseCertificate(certificate.Certificate[0])
+				if err_ == nil {
+					certificates["controller"] = leaf
+				} else {
+					logger.Warningf("unable to parse the controller certificate, its expiry is not monitored, %v", err_)
+				}
+
 				tlsConfig = &tls.Config{
 					Certificates: []tls.Certificate{certificate},
 				}
+
+				if authority != nil {
+					tlsConfig.ClientCAs = authority.CertPool()
+				}
+
+				if *clientCaFile != "" {
+					tlsConfig.ClientCAs, err = crypto.AppendCertsFromFile(tlsConfig.ClientCAs, *clientCaFile)
+				}
+
+				if tlsConfig.ClientCAs != nil {
+					tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+				}
 			}
 		}
 
 		if *enableFrontend {
 			if err == nil {
-				frontend, err := frontend.NewFrontend(tlsConfig, storage)
+				frontend, err_ := frontend.NewFrontend(tlsConfig, storage, bus, mutations, tracker, featureSet, pools, resourceStore, authority)
+				err = err_
 				if err == nil {
 					group.Go("Frontend", frontend)
 				}
@@ -103,14 +328,89 @@ func main() {
 		}
 
 		if *enableBackend {
+			var sender *callbacks.Sender
+			if err == nil {
+				sender, err = callbacks.NewSender(storage, bus)
+			}
+
+			var importer *inventory.Importer
+			if err == nil {
+				importer, err = inventory.NewImporter(storage)
+			}
+
+			// Webhooks are posted from the journal for the events published by every controller
+			var dispatcher *webhooks.Dispatcher
+			if err == nil {
+				dispatcher, err = webhooks.NewDispatcher(mutations, storage, resourceStore)
+			}
+
+			// Each term of a leader runs a backend of its own, its state is rebuilt from the storage
+			lead := func(group task.Group) error {
+				group.Go("Backend", backend.NewBackend(storage, bus, tracker, featureSet, pools, resourceStore))
+
+				if sender != nil {
+					group.Go("Callbacks", sender)
+				}
+
+				group.Go("Retention", retentionManager)
+
+				if importer != nil {
+					group.Go("Inventory", importer)
+				}
+
+				if dispatcher != nil {
+					group.Go("Webhooks", dispatcher)
+				}
+
+				return nil
+			}
+
+			if err == nil {
+				if *election.Enabled {
+					elector, err_ := election.NewElector(storage, bus, lead)
+					err = err_
+					if err == nil {
+						group.Go("Election", elector)
+					}
+				} else {
+					err = lead(group)
+				}
+			}
+		}
+
+		if *ingest.NatsUrl != "" {
+			if err == nil {
+				transport, err_ := ingest.OpenNatsTransport()
+				err = err_
+				if err == nil {
+					group.Go("Ingest", ingest.NewIngester(storage, transport))
+				}
+			}
+		}
+
+		if err == nil {
+			dispatcher, err_ := notify.NewDispatcher(bus)
+			err = err_
+			if err == nil {
+				if dispatcher != nil {
+					group.Go("Notify", dispatcher)
+				}
+
+				group.Go("Certificate Monitor", notify.NewCertificateMonitor(bus, certificates))
+			}
+		}
+
+		// Served by the frontend on /metrics as well as on --prometheus-address
+		if *enableFrontend || *enablePrometheus {
 			if err == nil {
-				group.Go("Backend", backend.NewBackend(storage))
+				group.Go("Metrics", prometheus.NewCollector(storage, tracker, featureSet, pools, retentionManager))
 			}
 		}
 
 		if *enablePrometheus {
 			if err == nil {
-				frontend, err := prometheus.NewFrontend(tlsConfig, storage)
+				frontend, err_ := prometheus.NewFrontend(tlsConfig)
+				err = err_
 				if err == nil {
 					group.Go("Prometheus", frontend)
 				}
@@ -0,0 +1,96 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package notify
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	certificateExpiryWarning = flag.Duration("certificate-expiry-warning", 14*24*time.Hour, "Publishes an event daily once the controller's certificate or certificate authority expires within this duration, 0 disables")
+)
+
+// Publishes an event for each certificate expiring within --certificate-expiry-warning
+type CertificateMonitor struct {
+	bus *events.Bus
+	// Certificates by the name they are reported with
+	certificates map[string]*x509.Certificate
+
+	lastPublished map[string]time.Time
+}
+
+func NewCertificateMonitor(bus *events.Bus, certificates map[string]*x509.Certificate) *CertificateMonitor {
+	return &CertificateMonitor{
+		bus:           bus,
+		certificates:  certificates,
+		lastPublished: map[string]time.Time{},
+	}
+}
+
+func (monitor *CertificateMonitor) Run(group task.Group) error {
+	if *certificateExpiryWarning <= 0 || len(monitor.certificates) == 0 {
+		return nil
+	}
+
+	monitor.check()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			monitor.check()
+		}
+	}
+}
+
+func (monitor *CertificateMonitor) check() {
+	now := time.Now()
+
+	names := make([]string, 0, len(monitor.certificates))
+	for name := range monitor.certificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		certificate := monitor.certificates[name]
+
+		expiresIn := certificate.NotAfter.Sub(now)
+		if expiresIn > *certificateExpiryWarning {
+			continue
+		}
+
+		if lastPublished, present := monitor.lastPublished[name]; present && now.Sub(lastPublished) < 24*time.Hour {
+			continue
+		}
+		monitor.lastPublished[name] = now
+
+		message := fmt.Sprintf("%s certificate %s expires in %s, at %s", name, certificate.Subject.CommonName, expiresIn.Round(time.Minute), certificate.NotAfter.Format(time.RFC3339))
+		if expiresIn <= 0 {
+			message = fmt.Sprintf("%s certificate %s expired at %s", name, certificate.Subject.CommonName, certificate.NotAfter.Format(time.RFC3339))
+		}
+
+		monitor.bus.Publish(restapi.Event{
+			Type:    restapi.EventCertificateExpiring,
+			Message: message,
+			Data: map[string]string{
+				"certificate": name,
+				"notAfter":    certificate.NotAfter.Format(time.RFC3339),
+			},
+		})
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Sends operator alerts for events published on the controller's event bus by email and Slack,
+// for deployments without a monitoring pipeline of their own
+package notify
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Classes of events operators are notified of
+const (
+	ClassAgentMissing      = "agentMissing"
+	ClassQueueSaturation   = "queueSaturation"
+	ClassQuotaExhaustion   = "quotaExhaustion"
+	ClassCertificateExpiry = "certificateExpiry"
+	ClassSlo               = "slo"
+)
+
+var classes = map[string][]string{
+	ClassAgentMissing:      {restapi.EventAgentMissing},
+	ClassQueueSaturation:   {restapi.EventQueueSaturated, restapi.EventQueueRecovered},
+	ClassQuotaExhaustion:   {restapi.EventPoolCapacityExhausted, restapi.EventPoolCapacityRecovered},
+	ClassCertificateExpiry: {restapi.EventCertificateExpiring},
+	ClassSlo:               {restapi.EventSloBudgetExceeded, restapi.EventSloBudgetRecovered},
+}
+
+var (
+	notifyEvents   = flag.String("notify-events", strings.Join([]string{ClassAgentMissing, ClassQueueSaturation, ClassQuotaExhaustion, ClassCertificateExpiry}, ","), "Comma separated classes of events sent to the notifiers, from agentMissing, queueSaturation, quotaExhaustion, certificateExpiry, and slo")
+	notifyThrottle = flag.Duration("notify-throttle", 15*time.Minute, "Events repeating within this duration, such as the same agent going missing again, are counted and reported with the next one sent rather than sent again")
+)
+
+// Sends a notification of the event
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event restapi.Event, suppressed int) error
+}
+
+type Dispatcher struct {
+	bus       *events.Bus
+	notifiers []Notifier
+	types     map[string]struct{}
+
+	// When each event was last sent and how many repeats have been suppressed since, by dedupeKey
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+}
+
+// Returns nil when no notifiers are configured
+func NewDispatcher(bus *events.Bus) (*Dispatcher, error) {
+	notifiers := []Notifier{}
+
+	slack, err := newSlackNotifier()
+	if err != nil {
+		return nil, err
+	}
+	if slack != nil {
+		notifiers = append(notifiers, slack)
+	}
+
+	email, err := newSmtpNotifier()
+	if err != nil {
+		return nil, err
+	}
+	if email != nil {
+		notifiers = append(notifiers, email)
+	}
+
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+
+	types := map[string]struct{}{}
+	for _, class := range strings.Split(*notifyEvents, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+
+		eventTypes, present := classes[class]
+		if !present {
+			return nil, fmt.Errorf("--notify-events: unknown class %s", class)
+		}
+
+		for _, eventType := range eventTypes {
+			types[eventType] = struct{}{}
+		}
+	}
+
+	return &Dispatcher{
+		bus:        bus,
+		notifiers:  notifiers,
+		types:      types,
+		lastSent:   map[string]time.Time{},
+		suppressed: map[string]int{},
+	}, nil
+}
+
+// Events about the same subject deduplicate each other
+func dedupeKey(event restapi.Event) string {
+	return strings.Join([]string{event.Type, event.AgentId, event.SessionId, event.Pool, event.Data["certificate"], event.Data["indicator"]}, "/")
+}
+
+func (dispatcher *Dispatcher) Run(group task.Group) error {
+	channel, unsubscribe := dispatcher.bus.Subscribe(256)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case event := <-channel:
+			if _, present := dispatcher.types[event.Type]; !present {
+				continue
+			}
+
+			key := dedupeKey(event)
+			if lastSent, present := dispatcher.lastSent[key]; present && event.Time.Sub(lastSent) < *notifyThrottle {
+				dispatcher.suppressed[key]++
+				logger.Debugf("notify: event %s suppressed, last sent at %s", event.Type, lastSent.Format(time.RFC3339))
+				continue
+			}
+
+			suppressed := dispatcher.suppressed[key]
+			dispatcher.lastSent[key] = event.Time
+			delete(dispatcher.suppressed, key)
+
+			dispatcher.notify(group.Ctx(), event, suppressed)
+			dispatcher.forget(event.Time)
+		}
+	}
+}
+
+// Failing to notify never stops the controller, the event is logged by the bus regardless
+func (dispatcher *Dispatcher) notify(ctx context.Context, event restapi.Event, suppressed int) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var err error
+	for _, notifier := range dispatcher.notifiers {
+		err_ := notifier.Notify(ctx, event, suppressed)
+		if err_ != nil {
+			err = errors.Join(err, fmt.Errorf("notify: unable to send event %s with %s, %v", event.Type, notifier.Name(), err_))
+		}
+	}
+
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// Drops the events sent longer than the throttle ago, those with suppressed repeats are kept
+// so the repeats are reported with the next one sent
+func (dispatcher *Dispatcher) forget(now time.Time) {
+	for key, lastSent := range dispatcher.lastSent {
+		if _, present := dispatcher.suppressed[key]; !present && now.Sub(lastSent) >= *notifyThrottle {
+			delete(dispatcher.lastSent, key)
+		}
+	}
+}
+
+// Returns the text sent for the event
+func formatEvent(event restapi.Event, suppressed int) string {
+	text := fmt.Sprintf("[%s] %s", event.Type, event.Message)
+	if suppressed > 0 {
+		text = fmt.Sprintf("%s (repeated %d times since last sent)", text, suppressed)
+	}
+
+	return text
+}
@@ -0,0 +1,75 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	slackWebhook = flag.String("notify-slack-webhook", "", "Slack incoming webhook URL events are posted to")
+)
+
+type slackNotifier struct {
+	webhook string
+	client  *http.Client
+}
+
+// Returns nil when --notify-slack-webhook is not set
+func newSlackNotifier() (*slackNotifier, error) {
+	if *slackWebhook == "" {
+		return nil, nil
+	}
+
+	_, err := url.ParseRequestURI(*slackWebhook)
+	if err != nil {
+		return nil, fmt.Errorf("--notify-slack-webhook: %v", err)
+	}
+
+	return &slackNotifier{
+		webhook: *slackWebhook,
+		client:  &http.Client{},
+	}, nil
+}
+
+func (notifier *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (notifier *slackNotifier) Notify(ctx context.Context, event restapi.Event, suppressed int) error {
+	body, err := json.Marshal(map[string]string{
+		"text": formatEvent(event, suppressed),
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("webhook responded with code %d, %s", response.StatusCode, string(message))
+	}
+
+	return nil
+}
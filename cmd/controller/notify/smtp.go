@@ -0,0 +1,110 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package notify
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	smtpAddress      = flag.String("notify-smtp-address", "", "The host and port of the SMTP server events are emailed through")
+	smtpUsername     = flag.String("notify-smtp-username", "", "Username authenticating with the SMTP server, no authentication when not set")
+	smtpPasswordFile = flag.String("notify-smtp-password-file", "", "File containing the password authenticating with the SMTP server")
+	smtpFrom         = flag.String("notify-smtp-from", "", "The address events are emailed from")
+	smtpTo           = flag.String("notify-smtp-to", "", "Comma separated addresses events are emailed to")
+)
+
+type smtpNotifier struct {
+	address string
+	auth    smtp.Auth
+	from    string
+	to      []string
+}
+
+// Returns nil when --notify-smtp-address is not set
+func newSmtpNotifier() (*smtpNotifier, error) {
+	if *smtpAddress == "" {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(*smtpAddress)
+	if err != nil {
+		return nil, fmt.Errorf("--notify-smtp-address: %v", err)
+	}
+
+	if *smtpFrom == "" {
+		return nil, errors.New("--notify-smtp-from is required with --notify-smtp-address")
+	}
+
+	to := []string{}
+	for _, address := range strings.Split(*smtpTo, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			to = append(to, address)
+		}
+	}
+
+	if len(to) == 0 {
+		return nil, errors.New("--notify-smtp-to is required with --notify-smtp-address")
+	}
+
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		password, err := os.ReadFile(*smtpPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read file %s, %v", *smtpPasswordFile, err)
+		}
+
+		auth = smtp.PlainAuth("", *smtpUsername, strings.TrimSpace(string(password)), host)
+	}
+
+	return &smtpNotifier{
+		address: *smtpAddress,
+		auth:    auth,
+		from:    *smtpFrom,
+		to:      to,
+	}, nil
+}
+
+func (notifier *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+func (notifier *smtpNotifier) Notify(ctx context.Context, event restapi.Event, suppressed int) error {
+	subject := fmt.Sprintf("Juice controller: %s", event.Type)
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", notifier.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(notifier.to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&message, "%s\r\n", formatEvent(event, suppressed))
+	for key, value := range event.Data {
+		fmt.Fprintf(&message, "%s: %s\r\n", key, value)
+	}
+
+	// smtp.SendMail does not take a context, give up waiting on it when the context is done
+	result := make(chan error, 1)
+	go func() {
+		result <- smtp.SendMail(notifier.address, notifier.auth, notifier.from, notifier.to, []byte(message.String()))
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -13,8 +13,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/features"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus/metrics"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/retention"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/scheduling"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/slo"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/server"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
@@ -23,11 +29,47 @@ var (
 	address = flag.String("prometheus-address", "0.0.0.0:9090", "The IP address and port to use for listening for Prometheus connections")
 )
 
+// Serves the metrics of the Collector on --prometheus-address
 type Frontend struct {
+	server *server.Server
+}
+
+func NewFrontend(tlsConfig *tls.Config) (*Frontend, error) {
+	if tlsConfig == nil {
+		logger.Warning("TLS is disabled, data will be unencrypted")
+	}
+
+	server, err := server.NewServer(*address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	server.AddCreateEndpoint(func(group task.Group, router *mux.Router) error {
+		router.Methods("GET").Path("/metrics").Handler(
+			promhttp.Handler())
+
+		return nil
+	})
+
+	return &Frontend{
+		server: server,
+	}, nil
+}
+
+func (frontend *Frontend) Run(group task.Group) error {
+	return frontend.server.Run(group)
+}
+
+// Gathers the metrics of the fleet from the storage, served by the Frontend and by the
+// controller's frontend on /metrics
+type Collector struct {
 	sync.Mutex
 
-	server  *server.Server
-	storage storage.Storage
+	storage    storage.Storage
+	tracker    *slo.Tracker
+	features   *features.Set
+	scheduling *scheduling.Pools
+	retention  *retention.Manager
 
 	agents                   prometheus.Gauge
 	agentsByStatus           *prometheus.GaugeVec
@@ -45,83 +87,101 @@ type Frontend struct {
 	utilizationByGpuName     *prometheus.GaugeVec
 	powerDraw                prometheus.Gauge
 	powerDrawByGpuName       *prometheus.GaugeVec
+	sloBurnRate              *prometheus.GaugeVec
+	sloBudgetRemaining       *prometheus.GaugeVec
+	vramFragmentation        prometheus.Gauge
+	frameIntervalP95         *prometheus.GaugeVec
+	inputLatencyP95          *prometheus.GaugeVec
+	stutters                 *prometheus.GaugeVec
+	featureEnabled           *prometheus.GaugeVec
+	poolQueued               *prometheus.GaugeVec
+	poolPaused               *prometheus.GaugeVec
+	poolPassSeconds          *prometheus.GaugeVec
+	retentionRecords         *prometheus.GaugeVec
+	retentionLastRun         *prometheus.GaugeVec
+	agentsByInventory        *prometheus.GaugeVec
 }
 
 func getGaugeOpts(name string) prometheus.GaugeOpts {
 	return prometheus.GaugeOpts{
-		Namespace: "Juice",
-		Subsystem: "Controller",
+		Namespace: metrics.Namespace,
+		Subsystem: metrics.Subsystem,
 		Name:      name,
 	}
 }
 
-func NewFrontend(tlsConfig *tls.Config, storage storage.Storage) (*Frontend, error) {
-	if tlsConfig == nil {
-		logger.Warning("TLS is disabled, data will be unencrypted")
-	}
-
-	server, err := server.NewServer(*address, tlsConfig)
-	if err != nil {
-		return nil, err
+func NewCollector(storage storage.Storage, tracker *slo.Tracker, features *features.Set, scheduling *scheduling.Pools, retention *retention.Manager) *Collector {
+	collector := &Collector{
+		storage:    storage,
+		tracker:    tracker,
+		features:   features,
+		scheduling: scheduling,
+		retention:  retention,
+
+		agents:                   prometheus.NewGauge(getGaugeOpts(metrics.Agents)),
+		agentsByStatus:           prometheus.NewGaugeVec(getGaugeOpts(metrics.AgentsByStatus), []string{metrics.LabelStatus}),
+		sessions:                 prometheus.NewGauge(getGaugeOpts(metrics.Sessions)),
+		sessionsByStatus:         prometheus.NewGaugeVec(getGaugeOpts(metrics.SessionsByStatus), []string{metrics.LabelStatus}),
+		gpus:                     prometheus.NewGauge(getGaugeOpts(metrics.Gpus)),
+		gpusByGpuName:            prometheus.NewGaugeVec(getGaugeOpts(metrics.GpusByGpuName), []string{metrics.LabelGpu}),
+		vram:                     prometheus.NewGauge(getGaugeOpts(metrics.Vram)),
+		vramByGpuName:            prometheus.NewGaugeVec(getGaugeOpts(metrics.VramByGpuName), []string{metrics.LabelGpu}),
+		vramUsed:                 prometheus.NewGauge(getGaugeOpts(metrics.VramUsed)),
+		vramUsedByGpuName:        prometheus.NewGaugeVec(getGaugeOpts(metrics.VramUsedByGpuName), []string{metrics.LabelGpu}),
+		vramGBAvailable:          prometheus.NewGaugeVec(getGaugeOpts(metrics.VramGBAvailable), []string{metrics.LabelPercentile}),
+		vramGBAvailableByGpuName: prometheus.NewGaugeVec(getGaugeOpts(metrics.VramGBAvailableByGpuName), []string{metrics.LabelGpu, metrics.LabelPercentile}),
+		utilization:              prometheus.NewGauge(getGaugeOpts(metrics.Utilization)),
+		utilizationByGpuName:     prometheus.NewGaugeVec(getGaugeOpts(metrics.UtilizationByGpuName), []string{metrics.LabelGpu}),
+		powerDraw:                prometheus.NewGauge(getGaugeOpts(metrics.PowerDraw)),
+		powerDrawByGpuName:       prometheus.NewGaugeVec(getGaugeOpts(metrics.PowerDrawByGpuName), []string{metrics.LabelGpu}),
+		sloBurnRate:              prometheus.NewGaugeVec(getGaugeOpts(metrics.SloBurnRate), []string{metrics.LabelPool, metrics.LabelIndicator}),
+		sloBudgetRemaining:       prometheus.NewGaugeVec(getGaugeOpts(metrics.SloBudgetRemaining), []string{metrics.LabelPool, metrics.LabelIndicator}),
+		vramFragmentation:        prometheus.NewGauge(getGaugeOpts(metrics.VramFragmentation)),
+		frameIntervalP95:         prometheus.NewGaugeVec(getGaugeOpts(metrics.FrameIntervalP95), []string{metrics.LabelPool, metrics.LabelAggregate}),
+		inputLatencyP95:          prometheus.NewGaugeVec(getGaugeOpts(metrics.InputLatencyP95), []string{metrics.LabelPool, metrics.LabelAggregate}),
+		stutters:                 prometheus.NewGaugeVec(getGaugeOpts(metrics.Stutters), []string{metrics.LabelPool}),
+		featureEnabled:           prometheus.NewGaugeVec(getGaugeOpts(metrics.FeatureEnabled), []string{metrics.LabelFeature, metrics.LabelStage}),
+		poolQueued:               prometheus.NewGaugeVec(getGaugeOpts(metrics.PoolQueued), []string{metrics.LabelPool}),
+		poolPaused:               prometheus.NewGaugeVec(getGaugeOpts(metrics.PoolPaused), []string{metrics.LabelPool}),
+		poolPassSeconds:          prometheus.NewGaugeVec(getGaugeOpts(metrics.PoolPassSeconds), []string{metrics.LabelPool}),
+		retentionRecords:         prometheus.NewGaugeVec(getGaugeOpts(metrics.RetentionRecords), []string{metrics.LabelTable}),
+		retentionLastRun:         prometheus.NewGaugeVec(getGaugeOpts(metrics.RetentionLastRun), []string{metrics.LabelTable}),
+		agentsByInventory:        prometheus.NewGaugeVec(getGaugeOpts(metrics.AgentsByInventory), []string{metrics.LabelDatacenter, metrics.LabelRack, metrics.LabelOwner}),
 	}
+	prometheus.MustRegister(collector)
 
-	frontend := &Frontend{
-		server:  server,
-		storage: storage,
-
-		agents:                   prometheus.NewGauge(getGaugeOpts("agents")),
-		agentsByStatus:           prometheus.NewGaugeVec(getGaugeOpts("agentsByStatus"), []string{"status"}),
-		sessions:                 prometheus.NewGauge(getGaugeOpts("sessions")),
-		sessionsByStatus:         prometheus.NewGaugeVec(getGaugeOpts("sessionsByStatus"), []string{"status"}),
-		gpus:                     prometheus.NewGauge(getGaugeOpts("gpus")),
-		gpusByGpuName:            prometheus.NewGaugeVec(getGaugeOpts("gpusByGpuName"), []string{"gpu"}),
-		vram:                     prometheus.NewGauge(getGaugeOpts("vram")),
-		vramByGpuName:            prometheus.NewGaugeVec(getGaugeOpts("vramByGpuName"), []string{"gpu"}),
-		vramUsed:                 prometheus.NewGauge(getGaugeOpts("vramUsed")),
-		vramUsedByGpuName:        prometheus.NewGaugeVec(getGaugeOpts("vramUsedByGpuName"), []string{"gpu"}),
-		vramGBAvailable:          prometheus.NewGaugeVec(getGaugeOpts("vramGBAvailable"), []string{"percentile"}),
-		vramGBAvailableByGpuName: prometheus.NewGaugeVec(getGaugeOpts("vramGBAvailableByGpuName"), []string{"gpu", "percentile"}),
-		utilization:              prometheus.NewGauge(getGaugeOpts("utilization")),
-		utilizationByGpuName:     prometheus.NewGaugeVec(getGaugeOpts("utilizationByGpuName"), []string{"gpu"}),
-		powerDraw:                prometheus.NewGauge(getGaugeOpts("powerDrawWatts")),
-		powerDrawByGpuName:       prometheus.NewGaugeVec(getGaugeOpts("powerDrawWattsByGpuName"), []string{"gpu"}),
-	}
-	prometheus.MustRegister(frontend)
-
-	server.AddCreateEndpoint(func(group task.Group, router *mux.Router) error {
-		router.Methods("GET").Path("/metrics").Handler(
-			promhttp.Handler())
-
-		return nil
-	})
-
-	return frontend, nil
+	return collector
 }
 
-func (frontend *Frontend) Run(group task.Group) error {
-	group.Go("Frontend Server", frontend.server)
+// Failing to update keeps the metrics last gathered, the frontend serving /metrics must not stop
+// with them
+func (collector *Collector) Run(group task.Group) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 
-	err := frontend.update()
-	if err == nil {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
+	for {
+		err := collector.update()
+		if err != nil {
+			logger.Warningf("unable to update the metrics, %v", err)
+		}
 
-		for err == nil {
-			select {
-			case <-group.Ctx().Done():
-				return err
+		select {
+		case <-group.Ctx().Done():
+			return nil
 
-			case <-ticker.C:
-				err = frontend.update()
-			}
+		case <-ticker.C:
 		}
 	}
-
-	return err
 }
 
-func (c *Frontend) update() error {
-	data, err := c.storage.AggregateData()
+func (c *Collector) update() error {
+	data, err := c.storage.StaleReads().AggregateData()
+	if err != nil {
+		return err
+	}
+
+	// Sessions are aggregated from the agents they are placed on, which queued sessions are not
+	queued, err := c.countQueuedSessions()
 	if err != nil {
 		return err
 	}
@@ -140,6 +200,7 @@ func (c *Frontend) update() error {
 	for key, value := range data.SessionsByStatus {
 		c.sessionsByStatus.WithLabelValues(key).Set(float64(value))
 	}
+	c.sessionsByStatus.WithLabelValues(restapi.SessionQueued).Set(float64(queued))
 
 	c.gpus.Set(float64(data.Gpus))
 	c.gpusByGpuName.Reset()
@@ -186,10 +247,82 @@ func (c *Frontend) update() error {
 		c.powerDrawByGpuName.WithLabelValues(key).Set(float64(value))
 	}
 
+	fragmentation, err := c.meanVramFragmentation()
+	if err != nil {
+		return err
+	}
+	c.vramFragmentation.Set(fragmentation)
+
+	frames, err := c.frameMetricsByPool()
+	if err != nil {
+		return err
+	}
+
+	c.frameIntervalP95.Reset()
+	c.inputLatencyP95.Reset()
+	c.stutters.Reset()
+	for pool, summary := range frames {
+		c.frameIntervalP95.WithLabelValues(pool, "mean").Set(summary.frameIntervalP95.mean())
+		c.frameIntervalP95.WithLabelValues(pool, "max").Set(summary.frameIntervalP95.max)
+		if summary.inputLatencyP95.count > 0 {
+			c.inputLatencyP95.WithLabelValues(pool, "mean").Set(summary.inputLatencyP95.mean())
+			c.inputLatencyP95.WithLabelValues(pool, "max").Set(summary.inputLatencyP95.max)
+		}
+		c.stutters.WithLabelValues(pool).Set(float64(summary.stutters))
+	}
+
+	if c.tracker != nil {
+		c.sloBurnRate.Reset()
+		c.sloBudgetRemaining.Reset()
+		for _, status := range c.tracker.Status() {
+			c.sloBurnRate.WithLabelValues(status.Pool, status.Indicator).Set(status.BurnRate)
+			c.sloBudgetRemaining.WithLabelValues(status.Pool, status.Indicator).Set(status.BudgetRemaining)
+		}
+	}
+
+	c.featureEnabled.Reset()
+	for _, feature := range c.features.List() {
+		enabled := 0.0
+		if feature.Enabled {
+			enabled = 1
+		}
+		c.featureEnabled.WithLabelValues(feature.Name, feature.Stage).Set(enabled)
+	}
+
+	c.poolQueued.Reset()
+	c.poolPaused.Reset()
+	c.poolPassSeconds.Reset()
+	for _, status := range c.scheduling.Status() {
+		paused := 0.0
+		if status.Paused {
+			paused = 1
+		}
+		c.poolQueued.WithLabelValues(status.Pool).Set(float64(status.Queued))
+		c.poolPaused.WithLabelValues(status.Pool).Set(paused)
+		c.poolPassSeconds.WithLabelValues(status.Pool).Set(status.LastPassSeconds)
+	}
+
+	c.retentionRecords.Reset()
+	c.retentionLastRun.Reset()
+	for _, status := range c.retention.Status() {
+		c.retentionRecords.WithLabelValues(status.Table).Set(float64(status.Records))
+		c.retentionLastRun.WithLabelValues(status.Table).Set(float64(status.LastRun.Unix()))
+	}
+
+	inventory, err := c.countAgentsByInventory()
+	if err != nil {
+		return err
+	}
+
+	c.agentsByInventory.Reset()
+	for key, count := range inventory {
+		c.agentsByInventory.WithLabelValues(key.datacenter, key.rack, key.owner).Set(float64(count))
+	}
+
 	return err
 }
 
-func (c *Frontend) Describe(ch chan<- *prometheus.Desc) {
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	c.agents.Describe(ch)
 	c.agentsByStatus.Describe(ch)
 	c.sessions.Describe(ch)
@@ -206,9 +339,22 @@ func (c *Frontend) Describe(ch chan<- *prometheus.Desc) {
 	c.utilizationByGpuName.Describe(ch)
 	c.powerDraw.Describe(ch)
 	c.powerDrawByGpuName.Describe(ch)
+	c.sloBurnRate.Describe(ch)
+	c.sloBudgetRemaining.Describe(ch)
+	c.vramFragmentation.Describe(ch)
+	c.frameIntervalP95.Describe(ch)
+	c.inputLatencyP95.Describe(ch)
+	c.stutters.Describe(ch)
+	c.featureEnabled.Describe(ch)
+	c.poolQueued.Describe(ch)
+	c.poolPaused.Describe(ch)
+	c.poolPassSeconds.Describe(ch)
+	c.retentionRecords.Describe(ch)
+	c.retentionLastRun.Describe(ch)
+	c.agentsByInventory.Describe(ch)
 }
 
-func (c *Frontend) Collect(ch chan<- prometheus.Metric) {
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	c.Lock()
 	defer c.Unlock()
 
@@ -228,4 +374,147 @@ func (c *Frontend) Collect(ch chan<- prometheus.Metric) {
 	c.utilizationByGpuName.Collect(ch)
 	c.powerDraw.Collect(ch)
 	c.powerDrawByGpuName.Collect(ch)
+	c.sloBurnRate.Collect(ch)
+	c.sloBudgetRemaining.Collect(ch)
+	c.vramFragmentation.Collect(ch)
+	c.frameIntervalP95.Collect(ch)
+	c.inputLatencyP95.Collect(ch)
+	c.stutters.Collect(ch)
+	c.featureEnabled.Collect(ch)
+	c.poolQueued.Collect(ch)
+	c.poolPaused.Collect(ch)
+	c.poolPassSeconds.Collect(ch)
+	c.retentionRecords.Collect(ch)
+	c.retentionLastRun.Collect(ch)
+	c.agentsByInventory.Collect(ch)
+}
+
+// Returns the mean VRAM fragmentation of the agents with GPUs
+func (c *Collector) meanVramFragmentation() (float64, error) {
+	iterator, err := c.storage.StaleReads().GetAgents()
+	if err != nil {
+		return 0, err
+	}
+
+	var total float64
+	var count int
+	for iterator.Next() {
+		agent := iterator.Value()
+		if len(agent.Gpus) > 0 {
+			total += storage.AgentGpuSet(agent).Fragmentation()
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	return total / float64(count), nil
+}
+
+type aggregate struct {
+	total float64
+	max   float64
+	count int
+}
+
+func (a *aggregate) add(value float64) {
+	a.total += value
+	if value > a.max {
+		a.max = value
+	}
+	a.count++
+}
+
+func (a aggregate) mean() float64 {
+	if a.count == 0 {
+		return 0
+	}
+
+	return a.total / float64(a.count)
+}
+
+type poolFrameMetrics struct {
+	frameIntervalP95 aggregate
+	inputLatencyP95  aggregate
+	stutters         uint64
+}
+
+// Returns the frame metrics reported by the clients of the active sessions by the pool of their agent
+func (c *Collector) frameMetricsByPool() (map[string]*poolFrameMetrics, error) {
+	iterator, err := c.storage.StaleReads().GetAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	pools := map[string]*poolFrameMetrics{}
+	for iterator.Next() {
+		agent := iterator.Value()
+		for _, session := range agent.Sessions {
+			if session.Frames == nil || session.Frames.Frames == 0 {
+				continue
+			}
+
+			pool := storage.Pool(agent.Labels)
+			summary, present := pools[pool]
+			if !present {
+				summary = &poolFrameMetrics{}
+				pools[pool] = summary
+			}
+
+			summary.frameIntervalP95.add(session.Frames.FrameIntervalP95)
+			if session.Frames.InputLatencyP95 > 0 {
+				summary.inputLatencyP95.add(session.Frames.InputLatencyP95)
+			}
+			summary.stutters += session.Frames.Stutters
+		}
+	}
+
+	return pools, nil
+}
+
+type inventoryKey struct {
+	datacenter string
+	rack       string
+	owner      string
+}
+
+// Returns the number of connected agents by the inventory labels of their host, see
+// restapi.InventoryRecord
+func (c *Collector) countAgentsByInventory() (map[inventoryKey]int, error) {
+	iterator, err := c.storage.StaleReads().GetAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[inventoryKey]int{}
+	for iterator.Next() {
+		agent := iterator.Value()
+		if agent.State != restapi.AgentActive && agent.State != restapi.AgentDisabled {
+			continue
+		}
+
+		counts[inventoryKey{
+			datacenter: agent.Labels[restapi.InventoryDatacenterLabel],
+			rack:       agent.Labels[restapi.InventoryRackLabel],
+			owner:      agent.Labels[restapi.InventoryOwnerLabel],
+		}]++
+	}
+
+	return counts, nil
+}
+
+func (c *Collector) countQueuedSessions() (int, error) {
+	iterator, err := c.storage.StaleReads().GetQueuedSessionsIterator()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for iterator.Next() {
+		count++
+	}
+
+	return count, nil
 }
@@ -0,0 +1,453 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package prometheus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus/metrics"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Observed as they happen rather than gathered by the Collector, so recorded by the controller
+// doing the work, the backend for scheduling
+var (
+	schedulingLatency = prometheus.NewHistogramVec(getHistogramOpts(metrics.SchedulingLatency, prometheus.ExponentialBuckets(0.01, 2, 16)), []string{metrics.LabelPool, metrics.LabelClass})
+	schedulingPass    = prometheus.NewHistogramVec(getHistogramOpts(metrics.SchedulingPass, prometheus.ExponentialBuckets(0.001, 2, 14)), []string{metrics.LabelPool})
+	storageOperation  = prometheus.NewHistogramVec(getHistogramOpts(metrics.StorageOperation, prometheus.ExponentialBuckets(0.0005, 2, 14)), []string{metrics.LabelOperation})
+
+	quotaBorrowed      = prometheus.NewCounterVec(getCounterOpts(metrics.QuotaBorrowed), []string{metrics.LabelTenant})
+	quotaReclaimed     = prometheus.NewCounterVec(getCounterOpts(metrics.QuotaReclaimed), []string{metrics.LabelTenant})
+	tenantGpus         = prometheus.NewGaugeVec(getGaugeOpts(metrics.TenantGpus), []string{metrics.LabelTenant})
+	tenantGpusBorrowed = prometheus.NewGaugeVec(getGaugeOpts(metrics.TenantGpusBorrowed), []string{metrics.LabelTenant})
+
+	sessionsWaitExceeded = prometheus.NewCounterVec(getCounterOpts(metrics.SessionsWaitExceeded), []string{metrics.LabelClass})
+	sessionsPreempted    = prometheus.NewCounterVec(getCounterOpts(metrics.SessionsPreempted), []string{metrics.LabelClass})
+	webhooks             = prometheus.NewCounterVec(getCounterOpts(metrics.Webhooks), []string{metrics.LabelWebhook, metrics.LabelResult})
+)
+
+func init() {
+	prometheus.MustRegister(schedulingLatency, schedulingPass, storageOperation, quotaBorrowed, quotaReclaimed, tenantGpus, tenantGpusBorrowed,
+		sessionsWaitExceeded, sessionsPreempted, webhooks)
+}
+
+func getCounterOpts(name string) prometheus.CounterOpts {
+	return prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metrics.Subsystem,
+		Name:      name,
+	}
+}
+
+func getHistogramOpts(name string, buckets []float64) prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metrics.Subsystem,
+		Name:      name,
+		Buckets:   buckets,
+	}
+}
+
+// Records the time the session of the class waited in the queue of the pool before it was
+// assigned, the class is empty for sessions requested without one
+func ObserveSchedulingLatency(pool string, class string, latency time.Duration) {
+	schedulingLatency.WithLabelValues(pool, class).Observe(latency.Seconds())
+}
+
+// Records the duration of a scheduling pass of the pool
+func ObserveSchedulingPass(pool string, duration time.Duration) {
+	schedulingPass.WithLabelValues(pool).Observe(duration.Seconds())
+}
+
+// Counts the sessions of the tenant placed beyond its guaranteed GPUs
+func ObserveQuotaBorrowed(tenant string) {
+	quotaBorrowed.WithLabelValues(tenant).Inc()
+}
+
+// Counts the preemptible sessions of the tenant canceled for a tenant within its guarantee
+func ObserveQuotaReclaimed(tenant string) {
+	quotaReclaimed.WithLabelValues(tenant).Inc()
+}
+
+// Counts the sessions of the class closed for waiting in the queue longer than the class allows
+func ObserveSessionWaitExceeded(class string) {
+	sessionsWaitExceeded.WithLabelValues(class).Inc()
+}
+
+// Counts the sessions of the preemptible class canceled for sessions of other classes
+func ObserveSessionPreempted(class string) {
+	sessionsPreempted.WithLabelValues(class).Inc()
+}
+
+// Records the outcome of a webhook, delivered or failed once its attempts ran out
+func ObserveWebhook(webhook string, result string) {
+	webhooks.WithLabelValues(webhook, result).Inc()
+}
+
+// Records the GPUs used by the sessions of each tenant with a quota, and of those the GPUs used
+// beyond the tenant's guarantee, replacing the tenants previously recorded
+func ObserveTenantGpus(used map[string]int, borrowed map[string]int) {
+	tenantGpus.Reset()
+	for tenant, gpus := range used {
+		tenantGpus.WithLabelValues(tenant).Set(float64(gpus))
+	}
+
+	tenantGpusBorrowed.Reset()
+	for tenant, gpus := range borrowed {
+		tenantGpusBorrowed.WithLabelValues(tenant).Set(float64(gpus))
+	}
+}
+
+// Records the duration of each operation on the storage, labeled by the name of its method.
+// Iterators are timed until they are returned, not while they are read.
+type instrumentedStorage struct {
+	storage storage.Storage
+}
+
+func InstrumentStorage(storage storage.Storage) storage.Storage {
+	return instrumentedStorage{
+		storage: storage,
+	}
+}
+
+func observeStorage(operation string, startedAt time.Time) {
+	storageOperation.WithLabelValues(operation).Observe(time.Since(startedAt).Seconds())
+}
+
+func (s instrumentedStorage) Close() error {
+	return s.storage.Close()
+}
+
+func (s instrumentedStorage) StaleReads() storage.Storage {
+	return instrumentedStorage{
+		storage: s.storage.StaleReads(),
+	}
+}
+
+func (s instrumentedStorage) AggregateData() (storage.AggregatedData, error) {
+	defer observeStorage("AggregateData", time.Now())
+	return s.storage.AggregateData()
+}
+
+func (s instrumentedStorage) RegisterAgent(agent restapi.Agent) (string, error) {
+	defer observeStorage("RegisterAgent", time.Now())
+	return s.storage.RegisterAgent(agent)
+}
+
+func (s instrumentedStorage) GetAgentById(id string) (restapi.Agent, error) {
+	defer observeStorage("GetAgentById", time.Now())
+	return s.storage.GetAgentById(id)
+}
+
+func (s instrumentedStorage) UpdateAgent(update restapi.AgentUpdate) error {
+	defer observeStorage("UpdateAgent", time.Now())
+	return s.storage.UpdateAgent(update)
+}
+
+func (s instrumentedStorage) SetAgentDraining(id string, draining bool) error {
+	defer observeStorage("SetAgentDraining", time.Now())
+	return s.storage.SetAgentDraining(id, draining)
+}
+
+func (s instrumentedStorage) SetAgentLabels(id string, labels map[string]string) error {
+	defer observeStorage("SetAgentLabels", time.Now())
+	return s.storage.SetAgentLabels(id, labels)
+}
+
+func (s instrumentedStorage) PatchAgentLabels(id string, patch restapi.AgentLabelsPatch) error {
+	defer observeStorage("PatchAgentLabels", time.Now())
+	return s.storage.PatchAgentLabels(id, patch)
+}
+
+func (s instrumentedStorage) RequestSession(requirements restapi.SessionRequirements) (string, error) {
+	defer observeStorage("RequestSession", time.Now())
+	return s.storage.RequestSession(requirements)
+}
+
+func (s instrumentedStorage) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu, cpuFallback bool) error {
+	defer observeStorage("AssignSession", time.Now())
+	return s.storage.AssignSession(sessionId, agentId, gpus, cpuFallback)
+}
+
+func (s instrumentedStorage) GetSessionById(id string) (restapi.Session, error) {
+	defer observeStorage("GetSessionById", time.Now())
+	return s.storage.GetSessionById(id)
+}
+
+func (s instrumentedStorage) AdoptSession(agentId string, session restapi.Session) error {
+	defer observeStorage("AdoptSession", time.Now())
+	return s.storage.AdoptSession(agentId, session)
+}
+
+func (s instrumentedStorage) ClaimSession(id string) error {
+	defer observeStorage("ClaimSession", time.Now())
+	return s.storage.ClaimSession(id)
+}
+
+func (s instrumentedStorage) ReleaseSession(id string, release restapi.SessionRelease) error {
+	defer observeStorage("ReleaseSession", time.Now())
+	return s.storage.ReleaseSession(id, release)
+}
+
+func (s instrumentedStorage) CancelSession(id string) error {
+	defer observeStorage("CancelSession", time.Now())
+	return s.storage.CancelSession(id)
+}
+
+func (s instrumentedStorage) PreemptSession(id string) error {
+	defer observeStorage("PreemptSession", time.Now())
+	return s.storage.PreemptSession(id)
+}
+
+func (s instrumentedStorage) SetSessionPreemptible(id string, preemptible bool) error {
+	defer observeStorage("SetSessionPreemptible", time.Now())
+	return s.storage.SetSessionPreemptible(id, preemptible)
+}
+
+func (s instrumentedStorage) UpdateSessionFrames(id string, frames restapi.FrameMetrics) error {
+	defer observeStorage("UpdateSessionFrames", time.Now())
+	return s.storage.UpdateSessionFrames(id, frames)
+}
+
+func (s instrumentedStorage) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	defer observeStorage("GetQueuedSessionById", time.Now())
+	return s.storage.GetQueuedSessionById(id)
+}
+
+func (s instrumentedStorage) GetAgents() (storage.Iterator[restapi.Agent], error) {
+	defer observeStorage("GetAgents", time.Now())
+	return s.storage.GetAgents()
+}
+
+func (s instrumentedStorage) QueryAgents(query restapi.ListQuery) (storage.Page[restapi.Agent], error) {
+	defer observeStorage("QueryAgents", time.Now())
+	return s.storage.QueryAgents(query)
+}
+
+func (s instrumentedStorage) QuerySessions(query restapi.ListQuery) (storage.Page[restapi.PlacedSession], error) {
+	defer observeStorage("QuerySessions", time.Now())
+	return s.storage.QuerySessions(query)
+}
+
+func (s instrumentedStorage) GetAvailableAgentsMatching(gpuVramAvailableAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+	defer observeStorage("GetAvailableAgentsMatching", time.Now())
+	return s.storage.GetAvailableAgentsMatching(gpuVramAvailableAtLeast)
+}
+
+func (s instrumentedStorage) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	defer observeStorage("GetQueuedSessionsIterator", time.Now())
+	return s.storage.GetQueuedSessionsIterator()
+}
+
+func (s instrumentedStorage) GetSessionsClosedWithin(duration time.Duration) (storage.Iterator[storage.ClosedSession], error) {
+	defer observeStorage("GetSessionsClosedWithin", time.Now())
+	return s.storage.GetSessionsClosedWithin(duration)
+}
+
+func (s instrumentedStorage) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) ([]string, error) {
+	defer observeStorage("SetAgentsMissingIfNotUpdatedFor", time.Now())
+	return s.storage.SetAgentsMissingIfNotUpdatedFor(duration)
+}
+
+func (s instrumentedStorage) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
+	defer observeStorage("RemoveMissingAgentsIfNotUpdatedFor", time.Now())
+	return s.storage.RemoveMissingAgentsIfNotUpdatedFor(duration)
+}
+
+func (s instrumentedStorage) CancelUnclaimedSessionsOlderThan(duration time.Duration) (int, error) {
+	defer observeStorage("CancelUnclaimedSessionsOlderThan", time.Now())
+	return s.storage.CancelUnclaimedSessionsOlderThan(duration)
+}
+
+func (s instrumentedStorage) ImportExpectedAgents(agents []restapi.ExpectedAgent) error {
+	defer observeStorage("ImportExpectedAgents", time.Now())
+	return s.storage.ImportExpectedAgents(agents)
+}
+
+func (s instrumentedStorage) GetExpectedAgentByHostname(hostname string) (restapi.ExpectedAgent, error) {
+	defer observeStorage("GetExpectedAgentByHostname", time.Now())
+	return s.storage.GetExpectedAgentByHostname(hostname)
+}
+
+func (s instrumentedStorage) GetExpectedAgents() (storage.Iterator[restapi.ExpectedAgent], error) {
+	defer observeStorage("GetExpectedAgents", time.Now())
+	return s.storage.GetExpectedAgents()
+}
+
+func (s instrumentedStorage) RevokeCredential(revocation restapi.Revocation) error {
+	defer observeStorage("RevokeCredential", time.Now())
+	return s.storage.RevokeCredential(revocation)
+}
+
+func (s instrumentedStorage) RemoveRevocation(kind string, subject string) error {
+	defer observeStorage("RemoveRevocation", time.Now())
+	return s.storage.RemoveRevocation(kind, subject)
+}
+
+func (s instrumentedStorage) GetRevocations() ([]restapi.Revocation, error) {
+	defer observeStorage("GetRevocations", time.Now())
+	return s.storage.GetRevocations()
+}
+
+func (s instrumentedStorage) CreateApiToken(token restapi.ApiToken, hash string) error {
+	defer observeStorage("CreateApiToken", time.Now())
+	return s.storage.CreateApiToken(token, hash)
+}
+
+func (s instrumentedStorage) GetApiTokenByHash(hash string) (restapi.ApiToken, error) {
+	defer observeStorage("GetApiTokenByHash", time.Now())
+	return s.storage.GetApiTokenByHash(hash)
+}
+
+func (s instrumentedStorage) GetApiTokens() ([]restapi.ApiToken, error) {
+	defer observeStorage("GetApiTokens", time.Now())
+	return s.storage.GetApiTokens()
+}
+
+func (s instrumentedStorage) DeleteApiToken(id string) (restapi.ApiToken, error) {
+	defer observeStorage("DeleteApiToken", time.Now())
+	return s.storage.DeleteApiToken(id)
+}
+
+func (s instrumentedStorage) AcquireLease(name string, holder string, duration time.Duration) (restapi.Lease, error) {
+	defer observeStorage("AcquireLease", time.Now())
+	return s.storage.AcquireLease(name, holder, duration)
+}
+
+func (s instrumentedStorage) ReleaseLease(name string, holder string) error {
+	defer observeStorage("ReleaseLease", time.Now())
+	return s.storage.ReleaseLease(name, holder)
+}
+
+func (s instrumentedStorage) GetLease(name string) (restapi.Lease, error) {
+	defer observeStorage("GetLease", time.Now())
+	return s.storage.GetLease(name)
+}
+
+func (s instrumentedStorage) SetPoolPaused(pool string, paused bool) error {
+	defer observeStorage("SetPoolPaused", time.Now())
+	return s.storage.SetPoolPaused(pool, paused)
+}
+
+func (s instrumentedStorage) PutListSnapshot(snapshot storage.ListSnapshot) error {
+	defer observeStorage("PutListSnapshot", time.Now())
+	return s.storage.PutListSnapshot(snapshot)
+}
+
+func (s instrumentedStorage) GetListSnapshot(id string) (storage.ListSnapshot, error) {
+	defer observeStorage("GetListSnapshot", time.Now())
+	return s.storage.GetListSnapshot(id)
+}
+
+func (s instrumentedStorage) GetPausedPools() ([]string, error) {
+	defer observeStorage("GetPausedPools", time.Now())
+	return s.storage.GetPausedPools()
+}
+
+func (s instrumentedStorage) SetFeatureOverride(override storage.FeatureOverride) error {
+	defer observeStorage("SetFeatureOverride", time.Now())
+	return s.storage.SetFeatureOverride(override)
+}
+
+func (s instrumentedStorage) GetFeatureOverrides() ([]storage.FeatureOverride, error) {
+	defer observeStorage("GetFeatureOverrides", time.Now())
+	return s.storage.GetFeatureOverrides()
+}
+
+func (s instrumentedStorage) PutConfigResource(resource restapi.ConfigResource) error {
+	defer observeStorage("PutConfigResource", time.Now())
+	return s.storage.PutConfigResource(resource)
+}
+
+func (s instrumentedStorage) GetConfigResources(kind string) ([]restapi.ConfigResource, error) {
+	defer observeStorage("GetConfigResources", time.Now())
+	return s.storage.GetConfigResources(kind)
+}
+
+func (s instrumentedStorage) DeleteConfigResource(kind string, name string) error {
+	defer observeStorage("DeleteConfigResource", time.Now())
+	return s.storage.DeleteConfigResource(kind, name)
+}
+
+func (s instrumentedStorage) RollUpUsageOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	defer observeStorage("RollUpUsageOlderThan", time.Now())
+	return s.storage.RollUpUsageOlderThan(duration, dryRun)
+}
+
+func (s instrumentedStorage) GetUsageAggregates() ([]restapi.UsageAggregate, error) {
+	defer observeStorage("GetUsageAggregates", time.Now())
+	return s.storage.GetUsageAggregates()
+}
+
+func (s instrumentedStorage) RemoveClosedSessionsOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	defer observeStorage("RemoveClosedSessionsOlderThan", time.Now())
+	return s.storage.RemoveClosedSessionsOlderThan(duration, dryRun)
+}
+
+func (s instrumentedStorage) AppendEvent(event restapi.Event) (restapi.Event, error) {
+	defer observeStorage("AppendEvent", time.Now())
+	return s.storage.AppendEvent(event)
+}
+
+func (s instrumentedStorage) GetEventsSince(since uint64, limit int) ([]restapi.Event, error) {
+	defer observeStorage("GetEventsSince", time.Now())
+	return s.storage.GetEventsSince(since, limit)
+}
+
+func (s instrumentedStorage) RemoveEventsOlderThan(duration time.Duration) error {
+	defer observeStorage("RemoveEventsOlderThan", time.Now())
+	return s.storage.RemoveEventsOlderThan(duration)
+}
+
+func (s instrumentedStorage) AppendJournalEntry(entry restapi.JournalEntry) (restapi.JournalEntry, error) {
+	defer observeStorage("AppendJournalEntry", time.Now())
+	return s.storage.AppendJournalEntry(entry)
+}
+
+func (s instrumentedStorage) UpdateJournalEntry(entry restapi.JournalEntry) error {
+	defer observeStorage("UpdateJournalEntry", time.Now())
+	return s.storage.UpdateJournalEntry(entry)
+}
+
+func (s instrumentedStorage) GetJournalEntriesSince(since uint64, limit int) ([]restapi.JournalEntry, error) {
+	defer observeStorage("GetJournalEntriesSince", time.Now())
+	return s.storage.GetJournalEntriesSince(since, limit)
+}
+
+func (s instrumentedStorage) GetJournalSequence() (uint64, error) {
+	defer observeStorage("GetJournalSequence", time.Now())
+	return s.storage.GetJournalSequence()
+}
+
+func (s instrumentedStorage) RemoveJournalEntriesOlderThan(duration time.Duration) error {
+	defer observeStorage("RemoveJournalEntriesOlderThan", time.Now())
+	return s.storage.RemoveJournalEntriesOlderThan(duration)
+}
+
+func (s instrumentedStorage) PutJournalCursor(cursor storage.JournalCursor) error {
+	defer observeStorage("PutJournalCursor", time.Now())
+	return s.storage.PutJournalCursor(cursor)
+}
+
+func (s instrumentedStorage) GetJournalCursor(name string) (storage.JournalCursor, error) {
+	defer observeStorage("GetJournalCursor", time.Now())
+	return s.storage.GetJournalCursor(name)
+}
+
+func (s instrumentedStorage) DeleteJournalCursor(name string) error {
+	defer observeStorage("DeleteJournalCursor", time.Now())
+	return s.storage.DeleteJournalCursor(name)
+}
+
+func (s instrumentedStorage) RotateSecrets() (int, error) {
+	defer observeStorage("RotateSecrets", time.Now())
+	return s.storage.RotateSecrets()
+}
+
+func (s instrumentedStorage) WatchAgents(notify func(agentId string)) (func(), error) {
+	return s.storage.WatchAgents(notify)
+}
@@ -0,0 +1,80 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics exported by the controller, shared with the tools generating rules from them
+const (
+	Namespace = "Juice"
+	Subsystem = "Controller"
+
+	Agents                   = "agents"
+	AgentsByStatus           = "agentsByStatus"
+	Sessions                 = "sessions"
+	SessionsByStatus         = "sessionsByStatus"
+	Gpus                     = "gpus"
+	GpusByGpuName            = "gpusByGpuName"
+	Vram                     = "vram"
+	VramByGpuName            = "vramByGpuName"
+	VramUsed                 = "vramUsed"
+	VramUsedByGpuName        = "vramUsedByGpuName"
+	VramGBAvailable          = "vramGBAvailable"
+	VramGBAvailableByGpuName = "vramGBAvailableByGpuName"
+	Utilization              = "utilization"
+	UtilizationByGpuName     = "utilizationByGpuName"
+	PowerDraw                = "powerDrawWatts"
+	PowerDrawByGpuName       = "powerDrawWattsByGpuName"
+	SloBurnRate              = "sloBurnRate"
+	SloBudgetRemaining       = "sloBudgetRemaining"
+	VramFragmentation        = "vramFragmentation"
+	FrameIntervalP95         = "frameIntervalP95Milliseconds"
+	InputLatencyP95          = "inputLatencyP95Milliseconds"
+	Stutters                 = "stutters"
+	FeatureEnabled           = "featureEnabled"
+	PoolQueued               = "poolQueued"
+	PoolPaused               = "poolPaused"
+	PoolPassSeconds          = "poolPassSeconds"
+	RetentionRecords         = "retentionRecords"
+	RetentionLastRun         = "retentionLastRunTimestampSeconds"
+	AgentsByInventory        = "agentsByInventory"
+	SchedulingLatency        = "schedulingLatencySeconds"
+	SchedulingPass           = "schedulingPassSeconds"
+	StorageOperation         = "storageOperationSeconds"
+	QuotaBorrowed            = "quotaBorrowedSessions"
+	QuotaReclaimed           = "quotaReclaimedSessions"
+	TenantGpus               = "tenantGpus"
+	TenantGpusBorrowed       = "tenantGpusBorrowed"
+	SessionsWaitExceeded     = "sessionsWaitExceeded"
+	SessionsPreempted        = "sessionsPreempted"
+	Webhooks                 = "webhooks"
+)
+
+// The labels of the metrics
+const (
+	LabelStatus     = "status"
+	LabelGpu        = "gpu"
+	LabelPercentile = "percentile"
+	LabelPool       = "pool"
+	LabelIndicator  = "indicator"
+	LabelAggregate  = "aggregate"
+	LabelFeature    = "feature"
+	LabelStage      = "stage"
+	LabelTable      = "table"
+	LabelDatacenter = "datacenter"
+	LabelRack       = "rack"
+	LabelOwner      = "owner"
+	LabelOperation  = "operation"
+	LabelTenant     = "tenant"
+	LabelClass      = "class"
+	LabelWebhook    = "webhook"
+	LabelResult     = "result"
+)
+
+// Returns the name of the metric as scraped by Prometheus
+func Name(metric string) string {
+	return prometheus.BuildFQName(Namespace, Subsystem, metric)
+}
@@ -0,0 +1,407 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Keeps the configuration resources applied through /v1/config/{kind}, such as by juicectl apply,
+// which the controllers sharing the storage apply over the configuration of their files and flags
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	resourcesRefresh = flag.Duration("config-resources-refresh", 5*time.Second, "Interval between reloads of the configuration resources applied through /v1/config/{kind} from the storage, such as quotas and webhooks. Resources applied through another controller sharing the storage apply within the interval")
+)
+
+type entry struct {
+	resource restapi.ConfigResource
+	// The decoded spec, a pointer to the value restapi.ConfigKinds returns for the kind
+	spec any
+}
+
+type Store struct {
+	storage storage.Storage
+
+	mutex sync.Mutex
+	// By kind and name
+	entries map[string]map[string]entry
+}
+
+// Returns the resources of every kind stored
+func Load(storage storage.Storage) (*Store, error) {
+	if *resourcesRefresh <= 0 {
+		return nil, errors.New("--config-resources-refresh must be greater than 0")
+	}
+
+	store := &Store{
+		storage: storage,
+		entries: map[string]map[string]entry{},
+	}
+
+	err := store.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *Store) load() error {
+	entries := map[string]map[string]entry{}
+	for kind := range restapi.ConfigKinds {
+		resources, err := store.storage.GetConfigResources(kind)
+		if err != nil {
+			return err
+		}
+
+		entries[kind] = map[string]entry{}
+		for _, resource := range resources {
+			spec, err := decode(resource)
+			if err != nil {
+				// Resources stored by another version of the controller may not decode
+				logger.Warningf("ignoring %s %s, %v", resource.Kind, resource.Name, err)
+				continue
+			}
+
+			entries[kind][resource.Name] = entry{
+				resource: resource,
+				spec:     spec,
+			}
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.entries = entries
+	return nil
+}
+
+// Reloads the resources every --config-resources-refresh, so the resources applied through
+// another controller apply to this one
+func (store *Store) Run(group task.Group) error {
+	ticker := time.NewTicker(*resourcesRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			err := store.load()
+			if err != nil {
+				logger.Warningf("unable to reload the configuration resources, %v", err)
+			}
+		}
+	}
+}
+
+// Returns the spec of the resource, rejecting unknown kinds and fields and invalid specs
+func decode(resource restapi.ConfigResource) (any, error) {
+	newSpec, found := restapi.ConfigKinds[resource.Kind]
+	if !found {
+		kinds := make([]string, 0, len(restapi.ConfigKinds))
+		for kind := range restapi.ConfigKinds {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		return nil, pkgerrors.Errorf(pkgerrors.ErrNotFound, "unknown kind %s, must be one of %s", resource.Kind, strings.Join(kinds, ", "))
+	}
+
+	if resource.Name == "" {
+		return nil, fmt.Errorf("%s has no name", resource.Kind)
+	}
+
+	spec := newSpec()
+
+	decoder := json.NewDecoder(bytes.NewReader(resource.Spec))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", resource.Kind, resource.Name, err)
+	}
+
+	switch spec := spec.(type) {
+	case *restapi.TenantQuota:
+		err = ValidateTenantQuota(*spec)
+	case *restapi.RoleBinding:
+		err = validateRoleBinding(*spec)
+	case *restapi.WebhookSubscription:
+		err = validateWebhook(*spec)
+	case *restapi.SessionTemplate:
+		err = validateSessionTemplate(*spec)
+	case *restapi.MaintenanceWindow:
+		err = validateMaintenanceWindow(*spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", resource.Kind, resource.Name, err)
+	}
+
+	return spec, nil
+}
+
+func ValidateTenantQuota(quota restapi.TenantQuota) error {
+	var err error
+	if quota.GuaranteedGpus < 0 {
+		err = errors.Join(err, errors.New("guaranteedGpus must not be negative"))
+	}
+
+	if quota.BurstGpus != 0 && quota.BurstGpus < quota.GuaranteedGpus {
+		err = errors.Join(err, errors.New("burstGpus must not be less than guaranteedGpus"))
+	}
+
+	return err
+}
+
+func validateRoleBinding(binding restapi.RoleBinding) error {
+	var err error
+	if len(binding.Users) == 0 {
+		err = errors.Join(err, errors.New("users must not be empty"))
+	}
+
+	if len(binding.Roles) == 0 {
+		err = errors.Join(err, errors.New("roles must not be empty"))
+	}
+
+	for _, value := range append(append([]string{}, binding.Users...), binding.Roles...) {
+		if strings.TrimSpace(value) == "" {
+			err = errors.Join(err, errors.New("users and roles must not be blank"))
+			break
+		}
+	}
+
+	return err
+}
+
+// Returns an error when the URL is not an http or https URL
+func ValidateWebhookUrl(webhookUrl string) error {
+	parsed, err := url.ParseRequestURI(webhookUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s is not an http or https URL", webhookUrl)
+	}
+
+	return nil
+}
+
+func validateWebhook(webhook restapi.WebhookSubscription) error {
+	err := ValidateWebhookUrl(webhook.Url)
+
+	for _, webhookType := range webhook.Events {
+		known := false
+		for _, supported := range restapi.WebhookTypes {
+			known = known || supported == webhookType
+		}
+		if !known {
+			err = errors.Join(err, fmt.Errorf("unknown webhook %s", webhookType))
+		}
+	}
+
+	if webhook.Secret == "" {
+		err = errors.Join(err, errors.New("secret must be set"))
+	}
+
+	return err
+}
+
+func validateSessionTemplate(template restapi.SessionTemplate) error {
+	var err error
+	if template.Class != "" && !restapi.IsSessionClass(template.Class) {
+		err = errors.Join(err, fmt.Errorf("class must be %s, %s, or %s", restapi.SessionClassInteractive, restapi.SessionClassBatch, restapi.SessionClassPreemptible))
+	}
+
+	if template.Placement != "" && !restapi.IsPlacementStrategy(template.Placement) {
+		err = errors.Join(err, fmt.Errorf("placement must be %s, %s, or %s", restapi.PlacementBinPack, restapi.PlacementSpread, restapi.PlacementRandom))
+	}
+
+	if template.IdleTimeoutSeconds < 0 {
+		err = errors.Join(err, errors.New("idleTimeoutSeconds must not be negative"))
+	}
+
+	return err
+}
+
+func validateMaintenanceWindow(window restapi.MaintenanceWindow) error {
+	var err error
+	if len(window.Hostnames) == 0 && len(window.MatchLabels) == 0 {
+		err = errors.Join(err, errors.New("hostnames or matchLabels must select the agents"))
+	}
+
+	if window.Start.IsZero() || window.End.IsZero() {
+		err = errors.Join(err, errors.New("start and end must be set"))
+	} else if !window.End.After(window.Start) {
+		err = errors.Join(err, errors.New("end must be after start"))
+	}
+
+	return err
+}
+
+// Returns the resource as returned by the API, without the secrets of its spec
+func Redact(resource restapi.ConfigResource) restapi.ConfigResource {
+	if resource.Kind != restapi.ConfigWebhook {
+		return resource
+	}
+
+	var webhook restapi.WebhookSubscription
+	if json.Unmarshal(resource.Spec, &webhook) != nil {
+		return resource
+	}
+
+	webhook.SecretSha256 = restapi.SecretSha256Of(webhook.Secret)
+	webhook.Secret = ""
+
+	spec, err := json.Marshal(webhook)
+	if err == nil {
+		resource.Spec = spec
+	}
+
+	return resource
+}
+
+// Returns the resources of the kind ordered by name, none on a nil Store
+func (store *Store) List(kind string) []restapi.ConfigResource {
+	resources := []restapi.ConfigResource{}
+	if store == nil {
+		return resources
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, entry := range store.entries[kind] {
+		resources = append(resources, entry.resource)
+	}
+
+	storage.SortConfigResources(resources)
+	return resources
+}
+
+// Returns the specs of the resources of the kind by name, T being the type restapi.ConfigKinds
+// returns a pointer to. None on a nil Store.
+func Specs[T any](store *Store, kind string) map[string]T {
+	specs := map[string]T{}
+	if store == nil {
+		return specs
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for name, entry := range store.entries[kind] {
+		if spec, ok := entry.spec.(*T); ok {
+			specs[name] = *spec
+		}
+	}
+
+	return specs
+}
+
+// Returns the spec of the resource of the kind named, false when there is none or on a nil Store
+func Spec[T any](store *Store, kind string, name string) (T, bool) {
+	var spec T
+	if store == nil {
+		return spec, false
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	decoded, ok := store.entries[kind][name].spec.(*T)
+	if !ok {
+		return spec, false
+	}
+
+	return *decoded, true
+}
+
+// Sets the requirements left unset from the template they name, returns ErrNotFound when there
+// is no such template
+func (store *Store) ApplyTemplate(requirements *restapi.SessionRequirements) error {
+	if requirements.Template == "" {
+		return nil
+	}
+
+	template, found := Spec[restapi.SessionTemplate](store, restapi.ConfigTemplate, requirements.Template)
+	if !found {
+		return pkgerrors.Errorf(pkgerrors.ErrNotFound, "template %s not found, see GET /v1/config/template", requirements.Template)
+	}
+
+	template.Apply(requirements)
+	return nil
+}
+
+// Validates and stores the resource for every controller sharing the storage, returning it as
+// stored
+func (store *Store) Put(resource restapi.ConfigResource) (restapi.ConfigResource, error) {
+	spec, err := decode(resource)
+	if err != nil {
+		return restapi.ConfigResource{}, err
+	}
+
+	// Stored as decoded, leaving out what the spec does not hold
+	resource.Spec, err = json.Marshal(spec)
+	if err != nil {
+		return restapi.ConfigResource{}, err
+	}
+
+	resource.UpdatedAt = time.Now().UTC()
+
+	err = store.storage.PutConfigResource(resource)
+	if err != nil {
+		return restapi.ConfigResource{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.entries[resource.Kind] == nil {
+		store.entries[resource.Kind] = map[string]entry{}
+	}
+	store.entries[resource.Kind][resource.Name] = entry{
+		resource: resource,
+		spec:     spec,
+	}
+
+	logger.Infof("%s %s applied", resource.Kind, resource.Name)
+	return resource, nil
+}
+
+// Removes the resource for every controller sharing the storage, returns ErrNotFound when there
+// is no such resource
+func (store *Store) Delete(kind string, name string) error {
+	if _, found := restapi.ConfigKinds[kind]; !found {
+		return pkgerrors.Errorf(pkgerrors.ErrNotFound, "unknown kind %s", kind)
+	}
+
+	err := store.storage.DeleteConfigResource(kind, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return pkgerrors.Errorf(pkgerrors.ErrNotFound, "%s %s not found", kind, name)
+	} else if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.entries[kind], name)
+
+	logger.Infof("%s %s deleted", kind, name)
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/memdb"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+func openStore(t *testing.T) *Store {
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func put(t *testing.T, store *Store, kind string, name string, spec string) error {
+	t.Helper()
+
+	_, err := store.Put(restapi.ConfigResource{
+		Kind: kind,
+		Name: name,
+		Spec: json.RawMessage(spec),
+	})
+	return err
+}
+
+func TestApplyTemplate(t *testing.T) {
+	store := openStore(t)
+
+	err := put(t, store, restapi.ConfigTemplate, "render", `{
+		"gpus": [{"vramRequired": 8589934592}],
+		"matchLabels": {"gpu": "a100", "zone": "west"},
+		"tenant": "studio",
+		"class": "batch",
+		"requireCapabilities": ["gpuFairness"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requirements := restapi.SessionRequirements{
+		MatchLabels: map[string]string{"zone": "east"},
+		Class:       restapi.SessionClassInteractive,
+		Template:    "render",
+	}
+
+	err = store.ApplyTemplate(&requirements)
+
+	// What the request sets is kept, the rest comes from the template
+	expected := restapi.SessionRequirements{
+		Gpus:                []restapi.GpuRequirements{{VramRequired: 8589934592}},
+		MatchLabels:         map[string]string{"gpu": "a100", "zone": "east"},
+		Tenant:              "studio",
+		Class:               restapi.SessionClassInteractive,
+		RequireCapabilities: []string{"gpuFairness"},
+		Template:            "render",
+	}
+	compareRequirements(t, expected, requirements, err)
+
+	requirements = restapi.SessionRequirements{Template: "missing"}
+	err = store.ApplyTemplate(&requirements)
+	if !errors.Is(err, pkgerrors.ErrNotFound) {
+		t.Errorf("expected ErrNotFound applying a missing template, instead received %v", err)
+	}
+
+	// Requirements naming no template are left as they are
+	requirements = restapi.SessionRequirements{Tenant: "studio"}
+	err = store.ApplyTemplate(&requirements)
+	compareRequirements(t, restapi.SessionRequirements{Tenant: "studio"}, requirements, err)
+}
+
+func compareRequirements(t *testing.T, expected restapi.SessionRequirements, requirements restapi.SessionRequirements, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(expected, requirements) {
+		t.Errorf("expected %+v, instead received %+v", expected, requirements)
+	}
+}
+
+func TestPutRejectsInvalidSpecs(t *testing.T) {
+	store := openStore(t)
+
+	tests := []struct {
+		kind string
+		spec string
+	}{
+		{restapi.ConfigQuota, `{"guaranteedGpus":-1}`},
+		{restapi.ConfigQuota, `{"guaranteedGpus":1,"unknown":true}`},
+		{restapi.ConfigRoleBinding, `{"users":["alice"]}`},
+		{restapi.ConfigWebhook, `{"url":"ftp://example.com","secret":"s3cret"}`},
+		{restapi.ConfigWebhook, `{"url":"https://example.com"}`},
+		{restapi.ConfigTemplate, `{"class":"urgent"}`},
+		{restapi.ConfigTemplate, `{"placement":"anywhere"}`},
+		{restapi.ConfigMaintenanceWindow, `{"start":"2023-06-01T00:00:00Z","end":"2023-06-02T00:00:00Z"}`},
+		{restapi.ConfigMaintenanceWindow, `{"hostnames":["gpu-1"],"start":"2023-06-02T00:00:00Z","end":"2023-06-01T00:00:00Z"}`},
+		{"pool", `{}`},
+	}
+
+	for _, test := range tests {
+		err := put(t, store, test.kind, "invalid", test.spec)
+		if err == nil {
+			t.Errorf("expected the %s %s to be rejected", test.kind, test.spec)
+		}
+	}
+
+	if resources := store.List(restapi.ConfigTemplate); len(resources) != 0 {
+		t.Errorf("expected no resources to be stored, instead received %+v", resources)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Removes the history the controller no longer needs by a policy per table, so the storage of
+// long-lived deployments does not grow unboundedly
+package retention
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	sessionRetention = flag.Duration("session-retention", 90*24*time.Hour, "How long closed sessions are kept, their usage is kept in the monthly aggregates of /v1/usage once removed, 0 disables")
+	eventRetention   = flag.Duration("event-retention", 14*24*time.Hour, "How long published events are kept for consumers to replay through /v1/events, 0 disables")
+	journalRetention = flag.Duration("journal-retention", 7*24*time.Hour, "How long journal entries are kept for consumers to replay through /v1/journal and webhooks to be delivered from, 0 disables")
+	usageRollupAge   = flag.Duration("usage-rollup-age", 30*24*time.Hour, "Closed sessions are added to the monthly usage aggregates of their tenant once closed this long, 0 disables")
+	interval         = flag.Duration("retention-interval", time.Hour, "Interval between applications of the retention policies")
+	dryRun           = flag.Bool("retention-dry-run", false, "Counts the records the retention policies would remove or aggregate, reported in the logs and metrics, without changing them")
+)
+
+// The tables retention policies apply to
+const (
+	TableSessions = "sessions"
+	TableEvents   = "events"
+	TableUsage    = "usage"
+	TableJournal  = "journal"
+)
+
+// Events and journal entries are counted in pages of this size before they are removed
+const eventPageSize = 1000
+
+// The outcome of the last application of a table's policy
+type Status struct {
+	Table string
+	// Removed, or aggregated for TableUsage, would have been when DryRun
+	Records int
+	DryRun  bool
+	LastRun time.Time
+}
+
+type Manager struct {
+	storage storage.Storage
+
+	mutex    sync.Mutex
+	statuses map[string]Status
+}
+
+func NewManager(storage storage.Storage) (*Manager, error) {
+	var err error
+	for name, duration := range map[string]time.Duration{
+		"session-retention": *sessionRetention,
+		"event-retention":   *eventRetention,
+		"journal-retention": *journalRetention,
+		"usage-rollup-age":  *usageRollupAge,
+	} {
+		if duration < 0 {
+			err = errors.Join(err, fmt.Errorf("--%s must not be negative", name))
+		}
+	}
+
+	if *interval <= 0 {
+		err = errors.Join(err, errors.New("--retention-interval must be positive"))
+	}
+
+	// Sessions must be aggregated before they are removed or their usage is lost
+	if *sessionRetention > 0 && *usageRollupAge > 0 && *sessionRetention < *usageRollupAge {
+		err = errors.Join(err, fmt.Errorf("--session-retention %s must be at least --usage-rollup-age %s", *sessionRetention, *usageRollupAge))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		storage:  storage,
+		statuses: map[string]Status{},
+	}, nil
+}
+
+func (manager *Manager) Run(group task.Group) error {
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		err := manager.apply()
+		if err != nil {
+			logger.Warningf("unable to apply the retention policies, %v", err)
+		}
+
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// Applies the policy of each table, usage first so sessions are aggregated before their removal
+func (manager *Manager) apply() error {
+	var err error
+	if *usageRollupAge > 0 {
+		err = errors.Join(err, manager.record(TableUsage, func() (int, error) {
+			return manager.storage.RollUpUsageOlderThan(*usageRollupAge, *dryRun)
+		}))
+	}
+
+	if *sessionRetention > 0 {
+		err = errors.Join(err, manager.record(TableSessions, func() (int, error) {
+			return manager.storage.RemoveClosedSessionsOlderThan(*sessionRetention, *dryRun)
+		}))
+	}
+
+	if *eventRetention > 0 {
+		err = errors.Join(err, manager.record(TableEvents, manager.removeEvents))
+	}
+
+	if *journalRetention > 0 {
+		err = errors.Join(err, manager.record(TableJournal, manager.removeJournalEntries))
+	}
+
+	return err
+}
+
+func (manager *Manager) record(table string, apply func() (int, error)) error {
+	records, err := apply()
+	if err != nil {
+		return fmt.Errorf("%s, %v", table, err)
+	}
+
+	if records > 0 {
+		action := "removed"
+		if table == TableUsage {
+			action = "aggregated"
+		}
+
+		if *dryRun {
+			logger.Infof("retention dry run, %d %s records would have been %s", records, table, action)
+		} else {
+			logger.Infof("retention %s %d %s records", action, records, table)
+		}
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.statuses[table] = Status{
+		Table:   table,
+		Records: records,
+		DryRun:  *dryRun,
+		LastRun: time.Now(),
+	}
+
+	return nil
+}
+
+// Counts the events older than --event-retention, events are appended in order of time so
+// counting stops at the first event to keep
+func (manager *Manager) removeEvents() (int, error) {
+	before := time.Now().Add(-*eventRetention)
+
+	count := 0
+	var since uint64
+	for {
+		events, err := manager.storage.GetEventsSince(since, eventPageSize)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, event := range events {
+			if event.Time.After(before) {
+				return manager.removeEventsCounted(count)
+			}
+
+			count++
+			since = event.Sequence
+		}
+
+		if len(events) < eventPageSize {
+			return manager.removeEventsCounted(count)
+		}
+	}
+}
+
+func (manager *Manager) removeEventsCounted(count int) (int, error) {
+	if *dryRun || count == 0 {
+		return count, nil
+	}
+
+	return count, manager.storage.RemoveEventsOlderThan(*eventRetention)
+}
+
+// Counts the journal entries older than --journal-retention the same way as removeEvents
+func (manager *Manager) removeJournalEntries() (int, error) {
+	before := time.Now().Add(-*journalRetention)
+
+	count := 0
+	var since uint64
+	for {
+		entries, err := manager.storage.GetJournalEntriesSince(since, eventPageSize)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, entry := range entries {
+			if entry.Time.After(before) {
+				return manager.removeJournalEntriesCounted(count)
+			}
+
+			count++
+			since = entry.Sequence
+		}
+
+		if len(entries) < eventPageSize {
+			return manager.removeJournalEntriesCounted(count)
+		}
+	}
+}
+
+func (manager *Manager) removeJournalEntriesCounted(count int) (int, error) {
+	if *dryRun || count == 0 {
+		return count, nil
+	}
+
+	return count, manager.storage.RemoveJournalEntriesOlderThan(*journalRetention)
+}
+
+// Returns the outcome of the last application of each table's policy ordered by table, safe to
+// call on nil
+func (manager *Manager) Status() []Status {
+	statuses := []Status{}
+	if manager == nil {
+		return statuses
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, status := range manager.statuses {
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Table < statuses[j].Table
+	})
+
+	return statuses
+}
@@ -0,0 +1,99 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package scheduling
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	sessionClassFile = flag.String("session-class-file", "", "JSON file overriding, by session class, the priority, preemptibility, and maximum wait in the queue of the interactive, batch, and preemptible presets")
+)
+
+// The scheduling behavior of the sessions of a class, see restapi.SessionRequirements.Class
+type SessionClass struct {
+	// Replaces the priority of the session's requirements
+	Priority int `json:"priority"`
+	// Sessions of the class are canceled when a session of a class that is not preemptible needs
+	// their GPUs, whatever the quota of their tenant
+	Preemptible bool `json:"preemptible"`
+	// Queued sessions not placed within this many seconds are closed, 0 leaves them queued
+	MaxWaitSeconds int `json:"maxWaitSeconds,omitempty"`
+}
+
+func (class SessionClass) MaxWait() time.Duration {
+	return time.Duration(class.MaxWaitSeconds) * time.Second
+}
+
+// Session classes by name
+type SessionClasses map[string]SessionClass
+
+// Returns the presets of the classes
+func DefaultSessionClasses() SessionClasses {
+	return SessionClasses{
+		restapi.SessionClassInteractive: {
+			Priority:       100,
+			MaxWaitSeconds: 300,
+		},
+		restapi.SessionClassBatch: {
+			Priority: 0,
+		},
+		restapi.SessionClassPreemptible: {
+			Priority:    -100,
+			Preemptible: true,
+		},
+	}
+}
+
+// Returns the presets with the classes declared by --session-class-file replacing them
+func LoadSessionClasses() (SessionClasses, error) {
+	classes := DefaultSessionClasses()
+	if *sessionClassFile == "" {
+		return classes, nil
+	}
+
+	data, err := os.ReadFile(*sessionClassFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", *sessionClassFile, err)
+	}
+
+	declared := SessionClasses{}
+	err = json.Unmarshal(data, &declared)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s, %v", *sessionClassFile, err)
+	}
+
+	for name, class := range declared {
+		if !restapi.IsSessionClass(name) {
+			return nil, fmt.Errorf("%s: unknown session class %s, must be %s, %s, or %s", *sessionClassFile, name,
+				restapi.SessionClassInteractive, restapi.SessionClassBatch, restapi.SessionClassPreemptible)
+		}
+
+		if class.MaxWaitSeconds < 0 {
+			return nil, fmt.Errorf("%s: invalid session class %s, maxWaitSeconds must not be negative", *sessionClassFile, name)
+		}
+
+		classes[name] = class
+	}
+
+	return classes, nil
+}
+
+// Returns the class of the name, the zero class for sessions without a class
+func (classes SessionClasses) Get(name string) SessionClass {
+	return classes[name]
+}
+
+// Sets the priority of the requirements from their class
+func (classes SessionClasses) Apply(requirements *restapi.SessionRequirements) {
+	if requirements.Class != "" {
+		requirements.Priority = classes.Get(requirements.Class).Priority
+	}
+}
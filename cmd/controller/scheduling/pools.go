@@ -0,0 +1,219 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package scheduling
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	pausedPools  = flag.String("paused-pools", "", "Comma separated list of pools paused when the controller starts, for every controller sharing its storage, whose queued sessions are not scheduled until resumed through /v1/scheduling/pool/{pool}")
+	poolsRefresh = flag.Duration("paused-pools-refresh", 5*time.Second, "Interval between reloads of the paused pools from the storage. Pools paused or resumed through another controller sharing the storage are paused or resumed on this one within the interval")
+)
+
+// Scheduling state of each pool, shared by the backend scheduling the pools and the frontends
+// reporting and controlling it. Pauses are kept in the storage shared by the controllers, the
+// state of the scheduling passes is this controller's.
+type Pools struct {
+	storage storage.Storage
+
+	mutex sync.Mutex
+	pools map[string]*restapi.PoolScheduling
+}
+
+func NewPools(storage storage.Storage) (*Pools, error) {
+	if *poolsRefresh <= 0 {
+		return nil, errors.New("--paused-pools-refresh must be greater than 0")
+	}
+
+	pools := &Pools{
+		storage: storage,
+		pools:   map[string]*restapi.PoolScheduling{},
+	}
+
+	if *pausedPools != "" {
+		for _, pool := range strings.Split(*pausedPools, ",") {
+			err := storage.SetPoolPaused(strings.TrimSpace(pool), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err := pools.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return pools, nil
+}
+
+func (pools *Pools) load() error {
+	paused, err := pools.storage.GetPausedPools()
+	if err != nil {
+		return err
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	stored := map[string]bool{}
+	for _, pool := range paused {
+		stored[pool] = true
+		pools.get(pool)
+	}
+
+	for pool, state := range pools.pools {
+		pools.setPaused(state, stored[pool])
+	}
+
+	return nil
+}
+
+// Reloads the paused pools every --paused-pools-refresh, pausing or resuming the pools paused or
+// resumed through another controller
+func (pools *Pools) Run(group task.Group) error {
+	ticker := time.NewTicker(*poolsRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			err := pools.load()
+			if err != nil {
+				logger.Warningf("unable to reload the paused pools, %v", err)
+			}
+		}
+	}
+}
+
+// Requires the mutex to be held
+func (pools *Pools) get(pool string) *restapi.PoolScheduling {
+	state, present := pools.pools[pool]
+	if !present {
+		state = &restapi.PoolScheduling{
+			Pool: pool,
+		}
+		pools.pools[pool] = state
+	}
+
+	return state
+}
+
+// Returns whether the pool's queued sessions are left queued, safe to call on nil
+func (pools *Pools) Paused(pool string) bool {
+	if pools == nil {
+		return false
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	return pools.get(pool).Paused
+}
+
+// Pauses or resumes the pool for every controller sharing the storage
+func (pools *Pools) SetPaused(pool string, paused bool) (restapi.PoolScheduling, error) {
+	err := pools.storage.SetPoolPaused(pool, paused)
+	if err != nil {
+		return restapi.PoolScheduling{}, err
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	state := pools.get(pool)
+	pools.setPaused(state, paused)
+	return *state, nil
+}
+
+// Requires the mutex to be held
+func (pools *Pools) setPaused(state *restapi.PoolScheduling, paused bool) {
+	if state.Paused != paused {
+		if paused {
+			logger.Infof("scheduling of pool %s paused", state.Pool)
+		} else {
+			logger.Infof("scheduling of pool %s resumed", state.Pool)
+		}
+	}
+
+	state.Paused = paused
+}
+
+// Records that a scheduling pass of the pool started with queued sessions, safe to call on nil
+func (pools *Pools) ObservePassStarted(pool string, queued int) {
+	if pools == nil {
+		return
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	state := pools.get(pool)
+	state.Running = true
+	state.Queued = queued
+}
+
+// Records a completed scheduling pass of the pool, safe to call on nil
+func (pools *Pools) ObservePass(pool string, startedAt time.Time, assigned int) {
+	if pools == nil {
+		return
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	state := pools.get(pool)
+	state.Running = false
+	state.Queued -= assigned
+	state.LastPassAt = startedAt
+	state.LastPassSeconds = time.Since(startedAt).Seconds()
+	state.LastPassAssigned = assigned
+}
+
+// Records the sessions queued in a pool that is not scheduled, such as while paused, safe to call on nil
+func (pools *Pools) ObserveQueued(pool string, queued int) {
+	if pools == nil {
+		return
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	pools.get(pool).Queued = queued
+}
+
+// Returns the state of the pools ordered by name, safe to call on nil
+func (pools *Pools) Status() []restapi.PoolScheduling {
+	statuses := []restapi.PoolScheduling{}
+	if pools == nil {
+		return statuses
+	}
+
+	pools.mutex.Lock()
+	defer pools.mutex.Unlock()
+
+	for _, state := range pools.pools {
+		statuses = append(statuses, *state)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Pool < statuses[j].Pool
+	})
+
+	return statuses
+}
@@ -0,0 +1,31 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package scheduling
+
+import (
+	"flag"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	reservationHoldLead = flag.Duration("reservation-hold-lead", 15*time.Minute, "How long before the window of a reserved session starts the VRAM it requires is held in its pool, on-demand sessions are neither placed on nor requested against the VRAM held. See restapi.SessionReservation")
+)
+
+// Returns whether the reserved session may be placed, sessions without a reservation always may
+func ReservationStarted(reservation *restapi.SessionReservation, now time.Time) bool {
+	return reservation == nil || !now.Before(reservation.StartAt)
+}
+
+// Returns whether the window of the reserved session ended, it is then canceled
+func ReservationEnded(reservation *restapi.SessionReservation, now time.Time) bool {
+	return reservation != nil && !now.Before(reservation.EndAt())
+}
+
+// Returns whether the VRAM of the reserved session is held while it is queued, from
+// --reservation-hold-lead before its window starts until the window ends
+func ReservationHeld(reservation *restapi.SessionReservation, now time.Time) bool {
+	return reservation != nil && !now.Before(reservation.StartAt.Add(-*reservationHoldLead)) && !ReservationEnded(reservation, now)
+}
@@ -0,0 +1,227 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package slo
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/events"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	window = flag.Duration("slo-window", time.Hour, "The rolling window SLOs are evaluated over")
+
+	assignmentLatencyThreshold = flag.Duration("slo-assignment-latency", 30*time.Second, "Sessions assigned slower than this count against the assignment latency SLO")
+	assignmentLatencyObjective = flag.Float64("slo-assignment-latency-objective", 0.99, "Fraction of sessions that must be assigned within --slo-assignment-latency")
+	sessionSuccessObjective    = flag.Float64("slo-session-success-objective", 0.99, "Fraction of closed sessions that must not have failed")
+)
+
+type observation struct {
+	time time.Time
+	bad  bool
+}
+
+type indicator struct {
+	observations []observation
+	exceeded     bool
+}
+
+func (indicator *indicator) expire(since time.Time) {
+	index := sort.Search(len(indicator.observations), func(i int) bool {
+		return !indicator.observations[i].time.Before(since)
+	})
+
+	indicator.observations = indicator.observations[index:]
+}
+
+func (indicator *indicator) counts() (int, int) {
+	bad := 0
+	for _, observation := range indicator.observations {
+		if observation.bad {
+			bad++
+		}
+	}
+
+	return len(indicator.observations), bad
+}
+
+type indicatorKey struct {
+	pool      string
+	indicator string
+}
+
+type Tracker struct {
+	mutex sync.Mutex
+
+	bus *events.Bus
+
+	window     time.Duration
+	objectives map[string]float64
+
+	indicators map[indicatorKey]*indicator
+
+	// Closed sessions are reported by id, remember them for the window to avoid counting them twice
+	closedSessions map[string]time.Time
+}
+
+func NewTracker(bus *events.Bus) *Tracker {
+	return &Tracker{
+		bus:    bus,
+		window: *window,
+		objectives: map[string]float64{
+			restapi.SloAssignmentLatency: *assignmentLatencyObjective,
+			restapi.SloSessionSuccess:    *sessionSuccessObjective,
+		},
+		indicators:     map[indicatorKey]*indicator{},
+		closedSessions: map[string]time.Time{},
+	}
+}
+
+func (tracker *Tracker) Window() time.Duration {
+	return tracker.window
+}
+
+func (tracker *Tracker) ObserveAssignment(pool string, latency time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.observe(pool, restapi.SloAssignmentLatency, time.Now(), latency > *assignmentLatencyThreshold)
+}
+
+func (tracker *Tracker) ObserveSessionClosed(id string, pool string, exitStatus string, closedAt time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if _, present := tracker.closedSessions[id]; present || closedAt.Before(time.Now().Add(-tracker.window)) {
+		return
+	}
+
+	tracker.closedSessions[id] = closedAt
+	tracker.observe(pool, restapi.SloSessionSuccess, closedAt, exitStatus == restapi.ExitStatusFailure)
+}
+
+func (tracker *Tracker) observe(pool string, name string, at time.Time, bad bool) {
+	key := indicatorKey{pool: pool, indicator: name}
+
+	value, present := tracker.indicators[key]
+	if !present {
+		value = &indicator{}
+		tracker.indicators[key] = value
+	}
+
+	// Keep the observations ordered by time for expiry
+	index := sort.Search(len(value.observations), func(i int) bool {
+		return value.observations[i].time.After(at)
+	})
+
+	value.observations = append(value.observations, observation{})
+	copy(value.observations[index+1:], value.observations[index:])
+	value.observations[index] = observation{
+		time: at,
+		bad:  bad,
+	}
+}
+
+// Expires observations outside of the window and publishes events for
+// indicators that have started or stopped exceeding their error budget
+func (tracker *Tracker) Update() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	since := time.Now().Add(-tracker.window)
+
+	for id, closed := range tracker.closedSessions {
+		if closed.Before(since) {
+			delete(tracker.closedSessions, id)
+		}
+	}
+
+	for key, value := range tracker.indicators {
+		value.expire(since)
+
+		status := tracker.status(key, value)
+		if status.Exceeded != value.exceeded {
+			value.exceeded = status.Exceeded
+
+			eventType := restapi.EventSloBudgetRecovered
+			message := fmt.Sprintf("%s error budget for pool %s recovered, burn rate %.2f", key.indicator, key.pool, status.BurnRate)
+			if status.Exceeded {
+				eventType = restapi.EventSloBudgetExceeded
+				message = fmt.Sprintf("%s error budget for pool %s exceeded, burn rate %.2f", key.indicator, key.pool, status.BurnRate)
+			}
+
+			if tracker.bus != nil {
+				tracker.bus.Publish(restapi.Event{
+					Type:    eventType,
+					Message: message,
+					Pool:    key.pool,
+					Data: map[string]string{
+						"indicator": key.indicator,
+						"burnRate":  fmt.Sprintf("%f", status.BurnRate),
+					},
+				})
+			}
+		}
+
+		if len(value.observations) == 0 && !value.exceeded {
+			delete(tracker.indicators, key)
+		}
+	}
+}
+
+func (tracker *Tracker) status(key indicatorKey, value *indicator) restapi.SloStatus {
+	objective := tracker.objectives[key.indicator]
+	total, bad := value.counts()
+
+	status := restapi.SloStatus{
+		Pool:            key.pool,
+		Indicator:       key.indicator,
+		Objective:       objective,
+		Total:           total,
+		Bad:             bad,
+		BudgetRemaining: 1,
+	}
+
+	if total > 0 {
+		budget := 1 - objective
+		errorRate := float64(bad) / float64(total)
+
+		if budget > 0 {
+			status.BurnRate = errorRate / budget
+			status.BudgetRemaining = 1 - status.BurnRate
+		} else if bad > 0 {
+			status.BurnRate = 1
+			status.BudgetRemaining = 0
+		}
+
+		status.Exceeded = status.BudgetRemaining < 0 || (budget <= 0 && bad > 0)
+	}
+
+	return status
+}
+
+func (tracker *Tracker) Status() []restapi.SloStatus {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	statuses := make([]restapi.SloStatus, 0, len(tracker.indicators))
+	for key, value := range tracker.indicators {
+		statuses = append(statuses, tracker.status(key, value))
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Pool != statuses[j].Pool {
+			return statuses[i].Pool < statuses[j].Pool
+		}
+
+		return statuses[i].Indicator < statuses[j].Indicator
+	})
+
+	return statuses
+}
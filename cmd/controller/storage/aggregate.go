@@ -0,0 +1,143 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"sort"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Aggregates the metrics of the agents, for drivers without a query language to aggregate them
+func Aggregate(agents []restapi.Agent) AggregatedData {
+	data := AggregatedData{
+		AgentsByStatus:           map[string]int{},
+		SessionsByStatus:         map[string]int{},
+		GpusByGpuName:            map[string]int{},
+		VramByGpuName:            map[string]uint64{},
+		VramUsedByGpuName:        map[string]uint64{},
+		VramGBAvailableByGpuName: map[string]Percentile[int]{},
+		UtilizationByGpuName:     map[string]float64{},
+		PowerDrawByGpuName:       map[string]float64{},
+	}
+
+	vramGBAvailable := map[int]int{}
+	vramGBAvailableByGpuName := map[string]map[int]int{}
+
+	var utilization uint64
+	utilizationByGpuName := map[string]uint64{}
+
+	var powerDraw uint64
+	powerDrawByGpuName := map[string]uint64{}
+
+	for _, agent := range agents {
+		data.Agents++
+		data.AgentsByStatus[agent.State]++
+
+		data.Sessions += len(agent.Sessions)
+		for _, session := range agent.Sessions {
+			data.SessionsByStatus[session.State]++
+		}
+
+		data.Gpus += len(agent.Gpus)
+		for _, gpu := range agent.Gpus {
+			data.GpusByGpuName[gpu.Name]++
+			data.Vram += gpu.Vram
+			data.VramByGpuName[gpu.Name] += gpu.Vram
+			data.VramUsed += gpu.Metrics.VramUsed
+			data.VramUsedByGpuName[gpu.Name] += gpu.Metrics.VramUsed
+
+			gb := int((gpu.Vram - gpu.Metrics.VramUsed) / (1024 * 1024 * 1024))
+			vramGBAvailable[gb]++
+
+			if _, ok := vramGBAvailableByGpuName[gpu.Name]; !ok {
+				vramGBAvailableByGpuName[gpu.Name] = map[int]int{}
+			}
+
+			vramGBAvailableByGpuName[gpu.Name][gb]++
+
+			utilization += uint64(gpu.Metrics.UtilizationGpu)
+			utilizationByGpuName[gpu.Name] += uint64(gpu.Metrics.UtilizationGpu)
+			powerDraw += uint64(gpu.Metrics.PowerDraw)
+			powerDrawByGpuName[gpu.Name] += uint64(gpu.Metrics.PowerDraw)
+		}
+	}
+
+	if data.Gpus > 0 {
+		calculatePercentiles := func(counts map[int]int, total int) Percentile[int] {
+			sortedKeys := []int{}
+			for key := range counts {
+				sortedKeys = append(sortedKeys, key)
+			}
+			sort.Ints(sortedKeys)
+
+			indexP90 := int(float64(total) * 0.90)
+			indexP75 := int(float64(total) * 0.75)
+			indexP50 := int(float64(total) * 0.50)
+			indexP25 := int(float64(total) * 0.25)
+			indexP10 := int(float64(total) * 0.10)
+
+			percentile := Percentile[int]{
+				P100: sortedKeys[len(sortedKeys)-1],
+			}
+
+			index := 0
+			keysIndex := 0
+			key := sortedKeys[keysIndex]
+			for keysIndex < len(sortedKeys) && index < indexP10 {
+				index += counts[key]
+				keysIndex++
+				key = sortedKeys[keysIndex]
+			}
+			percentile.P10 = key
+
+			for keysIndex < len(sortedKeys) && index < indexP25 {
+				index += counts[key]
+				keysIndex++
+				key = sortedKeys[keysIndex]
+			}
+			percentile.P25 = key
+
+			for keysIndex < len(sortedKeys) && index < indexP50 {
+				index += counts[key]
+				keysIndex++
+				key = sortedKeys[keysIndex]
+			}
+			percentile.P50 = key
+
+			for keysIndex < len(sortedKeys) && index < indexP75 {
+				index += counts[key]
+				keysIndex++
+				key = sortedKeys[keysIndex]
+			}
+			percentile.P75 = key
+
+			for keysIndex < len(sortedKeys) && index < indexP90 {
+				index += counts[key]
+				keysIndex++
+				key = sortedKeys[keysIndex]
+			}
+			percentile.P90 = key
+
+			return percentile
+		}
+
+		data.VramGBAvailable = calculatePercentiles(vramGBAvailable, data.Gpus)
+		for key, gbAvailable := range vramGBAvailableByGpuName {
+			data.VramGBAvailableByGpuName[key] = calculatePercentiles(gbAvailable, data.GpusByGpuName[key])
+		}
+
+		data.Utilization = float64(utilization) / float64(data.Gpus)
+		for key, value := range utilizationByGpuName {
+			data.UtilizationByGpuName[key] = float64(value) / float64(data.Gpus)
+		}
+
+		data.PowerDraw = float64(powerDraw) / float64(data.Gpus) / 1000.0
+		for key, value := range powerDrawByGpuName {
+			data.PowerDrawByGpuName[key] = float64(value) / float64(data.Gpus) / 1000.0
+		}
+	}
+
+	return data
+}
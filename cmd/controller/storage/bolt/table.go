@@ -0,0 +1,192 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	bbolt "go.etcd.io/bbolt"
+)
+
+// Separates the indexed value from the id of the record in the keys of an index bucket,
+// ids never contain it
+const indexSeparator = 0
+
+// A bucket of JSON records keyed by id. bbolt only orders keys, so each secondary index is
+// emulated with a bucket of <indexed value><indexSeparator><id> keys kept in step with the records.
+type table[T any] struct {
+	name    string
+	id      func(T) string
+	indexes map[string]func(T) []byte
+}
+
+func (table *table[T]) indexBucket(index string) []byte {
+	return []byte(fmt.Sprint(table.name, ".", index))
+}
+
+func (table *table[T]) create(tx *bbolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(table.name))
+	if err != nil {
+		return err
+	}
+
+	for index := range table.indexes {
+		_, err = tx.CreateBucketIfNotExists(table.indexBucket(index))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func indexKey(value []byte, id string) []byte {
+	key := make([]byte, 0, len(value)+1+len(id))
+	key = append(key, value...)
+	key = append(key, indexSeparator)
+	return append(key, id...)
+}
+
+// Splits an index key into its indexed value and the id of its record
+func splitIndexKey(key []byte) ([]byte, string) {
+	separator := bytes.LastIndexByte(key, indexSeparator)
+	return key[:separator], string(key[separator+1:])
+}
+
+func (table *table[T]) get(tx *bbolt.Tx, id string) (T, bool, error) {
+	var record T
+
+	data := tx.Bucket([]byte(table.name)).Get([]byte(id))
+	if data == nil {
+		return record, false, nil
+	}
+
+	err := json.Unmarshal(data, &record)
+	return record, err == nil, err
+}
+
+func (table *table[T]) put(tx *bbolt.Tx, record T) error {
+	id := table.id(record)
+
+	previous, found, err := table.get(tx, id)
+	if err != nil {
+		return err
+	}
+
+	for index, value := range table.indexes {
+		bucket := tx.Bucket(table.indexBucket(index))
+
+		if found {
+			err = bucket.Delete(indexKey(value(previous), id))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = bucket.Put(indexKey(value(record), id), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(table.name)).Put([]byte(id), data)
+}
+
+func (table *table[T]) delete(tx *bbolt.Tx, id string) error {
+	previous, found, err := table.get(tx, id)
+	if err != nil || !found {
+		return err
+	}
+
+	for index, value := range table.indexes {
+		err = tx.Bucket(table.indexBucket(index)).Delete(indexKey(value(previous), id))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(table.name)).Delete([]byte(id))
+}
+
+// Returns every record in order of id
+func (table *table[T]) all(tx *bbolt.Tx) ([]T, error) {
+	records := []T{}
+	err := tx.Bucket([]byte(table.name)).ForEach(func(_, data []byte) error {
+		var record T
+		err := json.Unmarshal(data, &record)
+		if err == nil {
+			records = append(records, record)
+		}
+		return err
+	})
+
+	return records, err
+}
+
+// Returns the records whose indexed value is between from and to inclusive, in order of the
+// indexed value. A nil bound is unbounded.
+func (table *table[T]) between(tx *bbolt.Tx, index string, from []byte, to []byte) ([]T, error) {
+	records := []T{}
+
+	cursor := tx.Bucket(table.indexBucket(index)).Cursor()
+
+	key, _ := cursor.First()
+	if from != nil {
+		key, _ = cursor.Seek(from)
+	}
+
+	for ; key != nil; key, _ = cursor.Next() {
+		value, id := splitIndexKey(key)
+		if from != nil && bytes.Compare(value, from) < 0 {
+			continue
+		}
+		if to != nil && bytes.Compare(value, to) > 0 {
+			break
+		}
+
+		record, found, err := table.get(tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// Returns the records whose indexed value is value
+func (table *table[T]) lookup(tx *bbolt.Tx, index string, value []byte) ([]T, error) {
+	return table.between(tx, index, value, value)
+}
+
+// Returns the first record whose indexed value is value, for indexes that are unique
+func (table *table[T]) first(tx *bbolt.Tx, index string, value []byte) (T, bool, error) {
+	records, err := table.lookup(tx, index, value)
+	if err != nil || len(records) == 0 {
+		var record T
+		return record, false, err
+	}
+
+	return records[0], true, nil
+}
+
+func stringIndex(value string) []byte {
+	return []byte(value)
+}
+
+// Orders unix times by their bytes
+func timeIndex(unix int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(unix))
+}
@@ -5,13 +5,16 @@ package memdb
 
 import (
 	"context"
-	"sort"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-memdb"
 
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
 )
@@ -25,19 +28,59 @@ type Agent struct {
 	LastUpdated int64
 }
 
+// A storage.ListSnapshot with when it expires
+type ListSnapshot struct {
+	storage.ListSnapshot
+
+	ExpiresAt time.Time
+}
+
 type Session struct {
 	restapi.Session
 
 	AgentId      string
 	Requirements restapi.SessionRequirements
 	VramRequired uint64
+	RequestedAt  time.Time
+	Claimed      bool
+
+	// Whether the session was added to the usage aggregates, see RollUpUsageOlderThan
+	RolledUp bool
 
 	LastUpdated int64
 }
 
+type Usage struct {
+	restapi.UsageAggregate
+
+	// The month and tenant of the aggregate, see usageKey
+	Key string
+}
+
+// A token minted for clients, by the hash of the token
+type ApiToken struct {
+	restapi.ApiToken
+
+	Hash string
+}
+
+func usageKey(month string, tenant string) string {
+	return fmt.Sprint(month, "/", tenant)
+}
+
 type storageDriver struct {
-	ctx context.Context
-	db  *memdb.MemDB
+	ctx   context.Context
+	db    *memdb.MemDB
+	clock clock.Clock
+
+	watchers storage.AgentWatchers
+
+	// Sequence of the last event appended, only changed within write transactions which memdb
+	// serializes. Kept apart from the events so sequences are not reused once they are removed.
+	lastSequence uint64
+	// Sequence of the last journal entry appended, only changed within write transactions, read
+	// by GetJournalSequence outside of them
+	lastJournalSequence atomic.Uint64
 }
 
 func OpenStorage(ctx context.Context) (storage.Storage, error) {
@@ -83,6 +126,155 @@ func OpenStorage(ctx context.Context) (storage.Storage, error) {
 					},
 				},
 			},
+			"expected_agents": {
+				Name: "expected_agents",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+					"hostname": {
+						Name:    "hostname",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Hostname"},
+					},
+				},
+			},
+			"usage": {
+				Name: "usage",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Key"},
+					},
+				},
+			},
+			"revocations": {
+				Name: "revocations",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Kind"},
+								&memdb.StringFieldIndex{Field: "Subject"},
+							},
+						},
+					},
+				},
+			},
+			"api_tokens": {
+				Name: "api_tokens",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UUIDFieldIndex{Field: "Id"},
+					},
+					"name": {
+						Name:    "name",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+					},
+					"hash": {
+						Name:    "hash",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Hash"},
+					},
+				},
+			},
+			"leases": {
+				Name: "leases",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+					},
+				},
+			},
+			"list_snapshots": {
+				Name: "list_snapshots",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Id"},
+					},
+				},
+			},
+			"paused_pools": {
+				Name: "paused_pools",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Pool"},
+					},
+				},
+			},
+			"config_resources": {
+				Name: "config_resources",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Kind"},
+								&memdb.StringFieldIndex{Field: "Name"},
+							},
+						},
+					},
+					"kind": {
+						Name:    "kind",
+						Indexer: &memdb.StringFieldIndex{Field: "Kind"},
+					},
+				},
+			},
+			"journal_cursors": {
+				Name: "journal_cursors",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+					},
+				},
+			},
+			"feature_overrides": {
+				Name: "feature_overrides",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+					},
+				},
+			},
+			"events": {
+				Name: "events",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UintFieldIndex{Field: "Sequence"},
+					},
+				},
+			},
+			"journal": {
+				Name: "journal",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UintFieldIndex{Field: "Sequence"},
+					},
+				},
+			},
 		},
 	}
 
@@ -92,8 +284,9 @@ func OpenStorage(ctx context.Context) (storage.Storage, error) {
 	}
 
 	return &storageDriver{
-		ctx: ctx,
-		db:  db,
+		ctx:   ctx,
+		db:    db,
+		clock: clock.FromContext(ctx),
 	}, nil
 }
 
@@ -101,6 +294,11 @@ func (driver *storageDriver) Close() error {
 	return nil
 }
 
+// Reads from memory are never stale
+func (driver *storageDriver) StaleReads() storage.Storage {
+	return driver
+}
+
 func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 	txn := driver.db.Snapshot().Txn(false)
 	defer txn.Abort()
@@ -110,149 +308,42 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 		return storage.AggregatedData{}, err
 	}
 
-	data := storage.AggregatedData{
-		AgentsByStatus:           map[string]int{},
-		SessionsByStatus:         map[string]int{},
-		GpusByGpuName:            map[string]int{},
-		VramByGpuName:            map[string]uint64{},
-		VramUsedByGpuName:        map[string]uint64{},
-		VramGBAvailableByGpuName: map[string]storage.Percentile[int]{},
-		UtilizationByGpuName:     map[string]float64{},
-		PowerDrawByGpuName:       map[string]float64{},
-	}
-
-	vramGBAvailable := map[int]int{}
-	vramGBAvailableByGpuName := map[string]map[int]int{}
-
-	var utilization uint64
-	utilizationByGpuName := map[string]uint64{}
-
-	var powerDraw uint64
-	powerDrawByGpuName := map[string]uint64{}
-
+	var agents []restapi.Agent
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-
-		data.Agents++
-		data.AgentsByStatus[agent.State]++
-
-		data.Sessions += len(agent.Sessions)
-		for _, session := range agent.Sessions {
-			data.SessionsByStatus[session.State]++
-		}
-
-		data.Gpus += len(agent.Gpus)
-		for _, gpu := range agent.Gpus {
-			data.GpusByGpuName[gpu.Name]++
-			data.Vram += gpu.Vram
-			data.VramByGpuName[gpu.Name] += gpu.Vram
-			data.VramUsed += gpu.Metrics.VramUsed
-			data.VramUsedByGpuName[gpu.Name] += gpu.Metrics.VramUsed
-
-			gb := int((gpu.Vram - gpu.Metrics.VramUsed) / (1024 * 1024 * 1024))
-			vramGBAvailable[gb]++
-
-			if _, ok := vramGBAvailableByGpuName[gpu.Name]; !ok {
-				vramGBAvailableByGpuName[gpu.Name] = map[int]int{}
-			}
-
-			vramGBAvailableByGpuName[gpu.Name][gb]++
-
-			utilization += uint64(gpu.Metrics.UtilizationGpu)
-			utilizationByGpuName[gpu.Name] += uint64(gpu.Metrics.UtilizationGpu)
-			powerDraw += uint64(gpu.Metrics.PowerDraw)
-			powerDrawByGpuName[gpu.Name] += uint64(gpu.Metrics.PowerDraw)
-		}
-	}
-
-	if data.Gpus > 0 {
-		calculatePercentiles := func(counts map[int]int, total int) storage.Percentile[int] {
-			sortedKeys := []int{}
-			for key := range counts {
-				sortedKeys = append(sortedKeys, key)
-			}
-			sort.Ints(sortedKeys)
-
-			indexP90 := int(float64(total) * 0.90)
-			indexP75 := int(float64(total) * 0.75)
-			indexP50 := int(float64(total) * 0.50)
-			indexP25 := int(float64(total) * 0.25)
-			indexP10 := int(float64(total) * 0.10)
-
-			percentile := storage.Percentile[int]{
-				P100: sortedKeys[len(sortedKeys)-1],
-			}
-
-			index := 0
-			keysIndex := 0
-			key := sortedKeys[keysIndex]
-			for keysIndex < len(sortedKeys) && index < indexP10 {
-				index += counts[key]
-				keysIndex++
-				key = sortedKeys[keysIndex]
-			}
-			percentile.P10 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP25 {
-				index += counts[key]
-				keysIndex++
-				key = sortedKeys[keysIndex]
-			}
-			percentile.P25 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP50 {
-				index += counts[key]
-				keysIndex++
-				key = sortedKeys[keysIndex]
-			}
-			percentile.P50 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP75 {
-				index += counts[key]
-				keysIndex++
-				key = sortedKeys[keysIndex]
-			}
-			percentile.P75 = key
-
-			for keysIndex < len(sortedKeys) && index < indexP90 {
-				index += counts[key]
-				keysIndex++
-				key = sortedKeys[keysIndex]
-			}
-			percentile.P90 = key
-
-			return percentile
-		}
-
-		data.VramGBAvailable = calculatePercentiles(vramGBAvailable, data.Gpus)
-		for key, gbAvailable := range vramGBAvailableByGpuName {
-			data.VramGBAvailableByGpuName[key] = calculatePercentiles(gbAvailable, data.GpusByGpuName[key])
-		}
-
-		data.Utilization = float64(utilization) / float64(data.Gpus)
-		for key, value := range utilizationByGpuName {
-			data.UtilizationByGpuName[key] = float64(value) / float64(data.Gpus)
-		}
-
-		data.PowerDraw = float64(powerDraw) / float64(data.Gpus) / 1000.0
-		for key, value := range powerDrawByGpuName {
-			data.PowerDrawByGpuName[key] = float64(value) / float64(data.Gpus) / 1000.0
-		}
+		agents = append(agents, utilities.Require[Agent](obj).Agent)
 	}
 
-	return data, nil
+	return storage.Aggregate(agents), nil
 }
 
 func (driver *storageDriver) RegisterAgent(apiAgent restapi.Agent) (string, error) {
 	agent := Agent{
 		Agent:         apiAgent,
 		VramAvailable: storage.TotalVram(apiAgent.Gpus),
-		LastUpdated:   time.Now().Unix(),
+		LastUpdated:   driver.clock.Now().Unix(),
 	}
 
-	agent.Id = uuid.NewString()
-
 	txn := driver.db.Txn(true)
+
+	if agent.Id == "" {
+		agent.Id = uuid.NewString()
+	} else {
+		// The agent is adopting an existing identity, replace its previous registration
+		obj, err := txn.First("agents", "id", agent.Id)
+		if err != nil {
+			txn.Abort()
+			return "", err
+		}
+
+		if obj != nil {
+			err = deleteAgent(txn, utilities.Require[Agent](obj))
+			if err != nil {
+				txn.Abort()
+				return "", err
+			}
+		}
+	}
+
 	err := txn.Insert("agents", agent)
 	if err != nil {
 		txn.Abort()
@@ -260,9 +351,25 @@ func (driver *storageDriver) RegisterAgent(apiAgent restapi.Agent) (string, erro
 	}
 
 	txn.Commit()
+	driver.watchers.Notify(agent.Id)
 	return agent.Id, nil
 }
 
+func deleteAgent(txn *memdb.Txn, agent Agent) error {
+	sessionIds := make([]interface{}, len(agent.SessionIds))
+	for index, id := range agent.SessionIds {
+		sessionIds[index] = id
+	}
+
+	_, err := txn.DeleteAll("sessions", "id", sessionIds...)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.DeleteAll("agents", "id", agent.Id)
+	return err
+}
+
 func (driver *storageDriver) GetAgentById(id string) (restapi.Agent, error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
@@ -280,7 +387,7 @@ func (driver *storageDriver) GetAgentById(id string) (restapi.Agent, error) {
 }
 
 func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
-	now := time.Now().Unix()
+	now := driver.clock.Now().Unix()
 
 	txn := driver.db.Txn(true)
 
@@ -291,6 +398,8 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	}
 
 	agent := utilities.Require[Agent](obj)
+	previousState := agent.State
+	previousSessions := len(agent.SessionIds)
 	agent.State = update.State
 	agent.LastUpdated = now
 
@@ -302,7 +411,12 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 			sessionUpdate, present := update.Sessions[sessionId]
 			if present {
 				// First, update the session information within the agent structure
-				agent.Sessions[index].State = sessionUpdate.State
+				if sessionUpdate.State != "" {
+					agent.Sessions[index].State = sessionUpdate.State
+				}
+				if sessionUpdate.Network != nil {
+					agent.Sessions[index].Network = sessionUpdate.Network
+				}
 
 				// Next, update the session object itself
 				obj, err = txn.First("sessions", "id", sessionId)
@@ -311,11 +425,28 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 					return err
 				}
 				session := utilities.Require[Session](obj)
-				session.State = sessionUpdate.State
+				if sessionUpdate.State != "" {
+					session.State = sessionUpdate.State
+				}
+				if sessionUpdate.ExitStatus != "" {
+					session.ExitStatus = storage.ReconcileExitStatus(sessionUpdate.ExitStatus, session.Release)
+				}
+				if sessionUpdate.Network != nil {
+					session.Network = sessionUpdate.Network
+				}
+				if sessionUpdate.LogExcerpt != "" {
+					session.LogExcerpt = sessionUpdate.LogExcerpt
+				}
 				session.LastUpdated = now
 
 				if session.State == restapi.SessionClosed {
-					agent.VramAvailable += session.VramRequired
+					if !session.CpuFallback {
+						agent.VramAvailable += session.VramRequired
+					}
+
+					if session.Preempted {
+						requeueSession(&session)
+					}
 				} else {
 					sessionIds = append(sessionIds, sessionId)
 					sessions = append(sessions, session.Session)
@@ -345,38 +476,129 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 			return err
 		}
 	} else {
-		sessionIds := make([]interface{}, len(agent.SessionIds))
-		for index, id := range agent.SessionIds {
-			sessionIds[index] = id
-		}
-
-		_, err = txn.DeleteAll("sessions", "id", sessionIds...)
+		err = deleteAgent(txn, agent)
 		if err != nil {
 			txn.Abort()
 			return err
 		}
+	}
 
-		_, err = txn.DeleteAll("agents", "id", agent.Id)
-		if err != nil {
-			txn.Abort()
-			return err
-		}
+	txn.Commit()
+
+	// Metrics alone do not change the placement of sessions
+	if agent.State != previousState || len(agent.SessionIds) != previousSessions {
+		driver.watchers.Notify(agent.Id)
+	}
+	return nil
+}
+
+func (driver *storageDriver) SetAgentDraining(id string, draining bool) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("agents", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	agent := utilities.Require[Agent](obj)
+	agent.Draining = draining
+
+	err = txn.Insert("agents", agent)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	driver.watchers.Notify(id)
+	return nil
+}
+
+func (driver *storageDriver) SetAgentLabels(id string, labels map[string]string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("agents", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	agent := utilities.Require[Agent](obj)
+	agent.Labels = labels
+
+	err = txn.Insert("agents", agent)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	driver.watchers.Notify(id)
+	return nil
+}
+
+func (driver *storageDriver) PatchAgentLabels(id string, patch restapi.AgentLabelsPatch) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("agents", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	agent := utilities.Require[Agent](obj)
+	agent.Labels = storage.PatchLabels(agent.Labels, patch.Labels, patch.RemoveLabels)
+	agent.Taints = storage.PatchLabels(agent.Taints, patch.Taints, patch.RemoveTaints)
+
+	err = txn.Insert("agents", agent)
+	if err != nil {
+		txn.Abort()
+		return err
 	}
 
 	txn.Commit()
+	driver.watchers.Notify(id)
 	return nil
 }
 
 func (driver *storageDriver) RequestSession(requirements restapi.SessionRequirements) (string, error) {
 	session := Session{
 		Session: restapi.Session{
-			Id:      uuid.NewString(),
-			Version: requirements.Version,
-			State:   restapi.SessionQueued,
+			Id:          uuid.NewString(),
+			Version:     requirements.Version,
+			State:       restapi.SessionQueued,
+			Tenant:      requirements.Tenant,
+			User:        requirements.User,
+			DelegatedBy: requirements.DelegatedBy,
+			TokenName:   requirements.TokenName,
+
+			IdleTimeoutSeconds: requirements.IdleTimeoutSeconds,
+			Class:              requirements.Class,
+			MetricsPort:        requirements.MetricsPort,
+			Record:             requirements.Record,
+			Reservation:        requirements.Reservation,
+			Priority:           requirements.Priority,
 		},
 		Requirements: requirements,
 		VramRequired: storage.TotalVramRequired(requirements),
-		LastUpdated:  time.Now().Unix(),
+		RequestedAt:  driver.clock.Now(),
+		LastUpdated:  driver.clock.Now().Unix(),
 	}
 
 	txn := driver.db.Txn(true)
@@ -391,8 +613,8 @@ func (driver *storageDriver) RequestSession(requirements restapi.SessionRequirem
 	return session.Id, nil
 }
 
-func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu) error {
-	now := time.Now().Unix()
+func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu, cpuFallback bool) error {
+	now := driver.clock.Now().Unix()
 
 	txn := driver.db.Txn(true)
 
@@ -412,6 +634,9 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 	session.AgentId = agentId
 	session.Address = agent.Address
 	session.Gpus = gpus
+	session.CpuFallback = cpuFallback
+	// Shared GPUs may allocate the session more VRAM than it requires
+	session.VramRequired = storage.AllocatedVram(gpus)
 	session.LastUpdated = now
 
 	err = txn.Insert("sessions", session)
@@ -422,7 +647,9 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 
 	agent.Sessions = append(agent.Sessions, session.Session)
 	agent.SessionIds = append(agent.SessionIds, sessionId)
-	agent.VramAvailable -= session.VramRequired
+	if !session.CpuFallback {
+		agent.VramAvailable -= session.VramRequired
+	}
 	agent.LastUpdated = now
 
 	err = txn.Insert("agents", agent)
@@ -432,129 +659,1370 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 	}
 
 	txn.Commit()
+	driver.watchers.Notify(agentId)
 	return nil
 }
 
-func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
-	txn := driver.db.Txn(false)
-	defer txn.Abort()
+func (driver *storageDriver) AdoptSession(agentId string, apiSession restapi.Session) error {
+	now := driver.clock.Now()
+
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+	agent := utilities.Require[Agent](obj)
+
+	requirements := storage.AdoptedRequirements(apiSession)
+	session := Session{
+		Session: restapi.Session{
+			Id:         apiSession.Id,
+			Version:    apiSession.Version,
+			Persistent: apiSession.Persistent,
+			Tenant:     apiSession.Tenant,
+		},
+		Requirements: requirements,
+		RequestedAt:  now,
+	}
+
+	obj, err = txn.First("sessions", "id", apiSession.Id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj != nil {
+		session = utilities.Require[Session](obj)
+
+		if session.State != restapi.SessionClosed && session.AgentId != "" {
+			txn.Abort()
+			if session.AgentId == agentId {
+				// Already placed on the agent
+				return nil
+			}
+
+			return pkgerrors.Errorf(storage.ErrConflict, "session %s is placed on agent %s", session.Id, session.AgentId)
+		}
+	}
+
+	session.State = apiSession.State
+	session.ExitStatus = restapi.ExitStatusUnknown
+	session.AgentId = agentId
+	session.Address = agent.Address
+	session.Gpus = apiSession.Gpus
+	session.CpuFallback = apiSession.CpuFallback
+	session.VramRequired = storage.TotalVramRequired(requirements)
+	session.Claimed = true
+	session.LastUpdated = now.Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	agent.Sessions = append(agent.Sessions, session.Session)
+	agent.SessionIds = append(agent.SessionIds, session.Id)
+	if !session.CpuFallback {
+		agent.VramAvailable -= session.VramRequired
+	}
+	agent.LastUpdated = now.Unix()
+
+	err = txn.Insert("agents", agent)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	driver.watchers.Notify(agentId)
+	return nil
+}
+
+func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		return restapi.Session{}, err
+	}
+
+	if obj == nil {
+		return restapi.Session{}, storage.ErrNotFound
+	}
+
+	return utilities.Require[Session](obj).Session, nil
+}
+
+func (driver *storageDriver) ClaimSession(id string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	if session.Claimed {
+		txn.Abort()
+		return nil
+	}
+
+	session.Claimed = true
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// Updates the state of the session within the agent structure
+func setAgentSessionState(txn *memdb.Txn, agentId string, sessionId string, state string) error {
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil || obj == nil {
+		return err
+	}
+
+	agent := utilities.Require[Agent](obj)
+	sessions := make([]restapi.Session, len(agent.Sessions))
+	copy(sessions, agent.Sessions)
+	for index := range sessions {
+		if sessions[index].Id == sessionId {
+			sessions[index].State = state
+		}
+	}
+	agent.Sessions = sessions
+
+	return txn.Insert("agents", agent)
+}
+
+func (driver *storageDriver) ReleaseSession(id string, release restapi.SessionRelease) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	session.Release = &release
+	session.LastUpdated = driver.clock.Now().Unix()
+
+	switch session.State {
+	case restapi.SessionQueued:
+		session.State = restapi.SessionClosed
+		session.ExitStatus = restapi.ExitStatusCanceled
+
+	case restapi.SessionAssigned, restapi.SessionActive:
+		// Persistent sessions outlive the client, otherwise the agent cancels the session and reports it closed
+		if !session.Persistent {
+			session.State = restapi.SessionCanceling
+
+			err = setAgentSessionState(txn, session.AgentId, session.Id, restapi.SessionCanceling)
+			if err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+
+	case restapi.SessionClosed:
+		session.ExitStatus = storage.ReconcileExitStatus(session.ExitStatus, session.Release)
+	}
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) CancelSession(id string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+
+	switch session.State {
+	case restapi.SessionQueued:
+		session.State = restapi.SessionClosed
+		session.ExitStatus = restapi.ExitStatusCanceled
+
+	case restapi.SessionAssigned, restapi.SessionActive:
+		session.State = restapi.SessionCanceling
+
+		err = setAgentSessionState(txn, session.AgentId, session.Id, restapi.SessionCanceling)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+
+	case restapi.SessionCanceling:
+		if !session.Preempted {
+			txn.Abort()
+			return nil
+		}
+
+		// Canceled by its requester while preempted, it closes rather than returns to the queue
+		session.Preempted = false
+
+	default:
+		txn.Abort()
+		return nil
+	}
+
+	session.LastUpdated = driver.clock.Now().Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) PreemptSession(id string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	if session.State != restapi.SessionAssigned && session.State != restapi.SessionActive {
+		txn.Abort()
+		return nil
+	}
+
+	session.State = restapi.SessionCanceling
+	session.Preempted = true
+	session.LastUpdated = driver.clock.Now().Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	err = setAgentSessionPreempted(txn, session.AgentId, session.Id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	driver.watchers.Notify(session.AgentId)
+	return nil
+}
+
+func setAgentSessionPreempted(txn *memdb.Txn, agentId string, sessionId string) error {
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil || obj == nil {
+		return err
+	}
+
+	agent := utilities.Require[Agent](obj)
+	sessions := make([]restapi.Session, len(agent.Sessions))
+	copy(sessions, agent.Sessions)
+	for index := range sessions {
+		if sessions[index].Id == sessionId {
+			sessions[index].State = restapi.SessionCanceling
+			sessions[index].Preempted = true
+		}
+	}
+	agent.Sessions = sessions
+
+	return txn.Insert("agents", agent)
+}
+
+// Returns the preempted session its agent closed to the queue, as it was before it was assigned
+func requeueSession(session *Session) {
+	session.State = restapi.SessionQueued
+	session.ExitStatus = ""
+	session.AgentId = ""
+	session.Address = ""
+	session.Gpus = nil
+	session.CpuFallback = false
+	session.Preemptible = false
+	session.Preempted = false
+	session.VramRequired = storage.TotalVramRequired(session.Requirements)
+}
+
+func (driver *storageDriver) SetSessionPreemptible(id string, preemptible bool) error {
+	txn := driver.db.Txn(true)
 
 	obj, err := txn.First("sessions", "id", id)
 	if err != nil {
-		return restapi.Session{}, err
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	session.Preemptible = preemptible
+	session.LastUpdated = driver.clock.Now().Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if session.AgentId != "" {
+		err = setAgentSessionPreemptible(txn, session.AgentId, session.Id, preemptible)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	txn.Commit()
+
+	if session.AgentId != "" {
+		driver.watchers.Notify(session.AgentId)
+	}
+	return nil
+}
+
+// Updates whether the session is preemptible within the agent structure
+func setAgentSessionPreemptible(txn *memdb.Txn, agentId string, sessionId string, preemptible bool) error {
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil || obj == nil {
+		return err
+	}
+
+	agent := utilities.Require[Agent](obj)
+	sessions := make([]restapi.Session, len(agent.Sessions))
+	copy(sessions, agent.Sessions)
+	for index := range sessions {
+		if sessions[index].Id == sessionId {
+			sessions[index].Preemptible = preemptible
+		}
+	}
+	agent.Sessions = sessions
+
+	return txn.Insert("agents", agent)
+}
+
+func (driver *storageDriver) UpdateSessionFrames(id string, frames restapi.FrameMetrics) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+	session.Frames = &frames
+	session.LastUpdated = driver.clock.Now().Unix()
+
+	err = txn.Insert("sessions", session)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if session.AgentId != "" {
+		err = setAgentSessionFrames(txn, session.AgentId, session.Id, &frames)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// Updates the frame metrics of the session within the agent structure
+func setAgentSessionFrames(txn *memdb.Txn, agentId string, sessionId string, frames *restapi.FrameMetrics) error {
+	obj, err := txn.First("agents", "id", agentId)
+	if err != nil || obj == nil {
+		return err
+	}
+
+	agent := utilities.Require[Agent](obj)
+	sessions := make([]restapi.Session, len(agent.Sessions))
+	copy(sessions, agent.Sessions)
+	for index := range sessions {
+		if sessions[index].Id == sessionId {
+			sessions[index].Frames = frames
+		}
+	}
+	agent.Sessions = sessions
+
+	return txn.Insert("agents", agent)
+}
+
+func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("sessions", "id", id)
+	if err != nil {
+		return storage.QueuedSession{}, err
+	}
+
+	if obj == nil {
+		return storage.QueuedSession{}, storage.ErrNotFound
+	}
+
+	session := utilities.Require[Session](obj)
+
+	return storage.QueuedSession{
+		Id:           session.Id,
+		Requirements: session.Requirements,
+		RequestedAt:  session.RequestedAt,
+	}, nil
+}
+
+func (driver *storageDriver) GetAgents() (storage.Iterator[restapi.Agent], error) {
+	agents, err := driver.allAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+func (driver *storageDriver) allAgents() ([]restapi.Agent, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("agents", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	agents := []restapi.Agent{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agents = append(agents, utilities.Require[Agent](obj).Agent)
+	}
+
+	return agents, nil
+}
+
+func (driver *storageDriver) QueryAgents(query restapi.ListQuery) (storage.Page[restapi.Agent], error) {
+	return storage.ListPage(driver, query, func() ([]restapi.Agent, error) {
+		agents, err := driver.allAgents()
+		return storage.MatchingAgents(agents, query), err
+	})
+}
+
+func (driver *storageDriver) QuerySessions(query restapi.ListQuery) (storage.Page[restapi.PlacedSession], error) {
+	return storage.ListPage(driver, query, func() ([]restapi.PlacedSession, error) {
+		agents, err := driver.allAgents()
+		return storage.MatchingSessions(agents, query), err
+	})
+}
+
+func (driver *storageDriver) PutListSnapshot(snapshot storage.ListSnapshot) error {
+	now := driver.clock.Now()
+
+	txn := driver.db.Txn(true)
+
+	iterator, err := txn.Get("list_snapshots", "id")
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	expired := []ListSnapshot{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		if stored := utilities.Require[ListSnapshot](obj); !now.Before(stored.ExpiresAt) {
+			expired = append(expired, stored)
+		}
+	}
+
+	for _, stored := range expired {
+		err = txn.Delete("list_snapshots", stored)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	err = txn.Insert("list_snapshots", ListSnapshot{
+		ListSnapshot: snapshot,
+		ExpiresAt:    now.Add(storage.ListSnapshotTtl),
+	})
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetListSnapshot(id string) (storage.ListSnapshot, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("list_snapshots", "id", id)
+	if err != nil {
+		return storage.ListSnapshot{}, err
+	}
+
+	if obj == nil {
+		return storage.ListSnapshot{}, storage.ErrNotFound
+	}
+
+	snapshot := utilities.Require[ListSnapshot](obj)
+	if !driver.clock.Now().Before(snapshot.ExpiresAt) {
+		return storage.ListSnapshot{}, storage.ErrNotFound
+	}
+
+	return snapshot.ListSnapshot, nil
+}
+
+func (driver *storageDriver) GetAvailableAgentsMatching(gpuVramAvailableAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("agents", "state", restapi.AgentActive)
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []restapi.Agent
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+
+		if agent.VramAvailable >= gpuVramAvailableAtLeast && storage.GpuAvailable(agent.Agent, gpuVramAvailableAtLeast) {
+			agents = append(agents, agent.Agent)
+		}
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("sessions", "state", restapi.SessionQueued)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []storage.QueuedSession
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		sessions = append(sessions, storage.QueuedSession{
+			Id:           session.Id,
+			Requirements: session.Requirements,
+			RequestedAt:  session.RequestedAt,
+		})
+	}
+
+	storage.SortQueuedSessions(sessions)
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (driver *storageDriver) GetSessionsClosedWithin(duration time.Duration) (storage.Iterator[storage.ClosedSession], error) {
+	since := driver.clock.Now().Add(-duration).Unix()
+
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.LowerBound("sessions", "last_updated", since)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []storage.ClosedSession
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		session := utilities.Require[Session](obj)
+		if session.State == restapi.SessionClosed {
+			sessions = append(sessions, storage.ClosedSession{
+				Id:           session.Id,
+				ExitStatus:   session.ExitStatus,
+				Requirements: session.Requirements,
+				ClosedAt:     time.Unix(session.LastUpdated, 0),
+			})
+		}
+	}
+
+	return storage.NewDefaultIterator(sessions), nil
+}
+
+func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) ([]string, error) {
+	nowTime := driver.clock.Now()
+	now := nowTime.Unix()
+	since := nowTime.Add(-duration).Unix()
+
+	txn := driver.db.Txn(true)
+
+	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+
+	var missing []Agent
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.State == restapi.AgentActive {
+			missing = append(missing, agent)
+		}
+	}
+
+	agentIds := make([]string, 0, len(missing))
+	for _, agent := range missing {
+		agent.State = restapi.AgentMissing
+		agent.LastUpdated = now
+
+		err = txn.Insert("agents", agent)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+
+		agentIds = append(agentIds, agent.Id)
+	}
+
+	txn.Commit()
+	driver.watchers.Notify(agentIds...)
+	return agentIds, nil
+}
+
+func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
+	since := driver.clock.Now().Add(-duration).Unix()
+
+	txn := driver.db.Txn(true)
+
+	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	agentIds := make([]interface{}, 0)
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agent := utilities.Require[Agent](obj)
+		if agent.State == restapi.AgentMissing {
+			agentIds = append(agentIds, agent.Id)
+		}
+	}
+
+	if len(agentIds) > 0 {
+		_, err = txn.DeleteAll("agents", "id", agentIds...)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+
+		txn.Commit()
+
+		for _, agentId := range agentIds {
+			driver.watchers.Notify(agentId.(string))
+		}
+	} else {
+		txn.Abort()
+	}
+
+	return nil
+}
+
+func (driver *storageDriver) CancelUnclaimedSessionsOlderThan(duration time.Duration) (int, error) {
+	nowTime := driver.clock.Now()
+	now := nowTime.Unix()
+	before := nowTime.Add(-duration)
+
+	txn := driver.db.Txn(true)
+
+	var expired []Session
+	for _, state := range []string{restapi.SessionQueued, restapi.SessionAssigned, restapi.SessionActive} {
+		iterator, err := txn.Get("sessions", "state", state)
+		if err != nil {
+			txn.Abort()
+			return 0, err
+		}
+
+		for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+			session := utilities.Require[Session](obj)
+			if !session.Claimed && storage.UnclaimedSince(session.RequestedAt, session.Requirements).Before(before) {
+				expired = append(expired, session)
+			}
+		}
+	}
+
+	for _, session := range expired {
+		if session.State == restapi.SessionQueued {
+			session.State = restapi.SessionClosed
+			session.ExitStatus = restapi.ExitStatusCanceled
+		} else {
+			// Assigned sessions are canceled by their agent which then reports them closed
+			session.State = restapi.SessionCanceling
+
+			err := setAgentSessionState(txn, session.AgentId, session.Id, restapi.SessionCanceling)
+			if err != nil {
+				txn.Abort()
+				return 0, err
+			}
+		}
+		session.LastUpdated = now
+
+		err := txn.Insert("sessions", session)
+		if err != nil {
+			txn.Abort()
+			return 0, err
+		}
+	}
+
+	txn.Commit()
+	return len(expired), nil
+}
+
+func (driver *storageDriver) ImportExpectedAgents(agents []restapi.ExpectedAgent) error {
+	txn := driver.db.Txn(true)
+
+	for _, agent := range agents {
+		obj, err := txn.First("expected_agents", "hostname", agent.Hostname)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+
+		if obj != nil {
+			agent.Id = utilities.Require[restapi.ExpectedAgent](obj).Id
+		} else if agent.Id == "" {
+			agent.Id = uuid.NewString()
+		}
+
+		err = txn.Insert("expected_agents", agent)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetExpectedAgentByHostname(hostname string) (restapi.ExpectedAgent, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("expected_agents", "hostname", hostname)
+	if err != nil {
+		return restapi.ExpectedAgent{}, err
+	}
+
+	if obj == nil {
+		return restapi.ExpectedAgent{}, storage.ErrNotFound
+	}
+
+	return utilities.Require[restapi.ExpectedAgent](obj), nil
+}
+
+func (driver *storageDriver) GetExpectedAgents() (storage.Iterator[restapi.ExpectedAgent], error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("expected_agents", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []restapi.ExpectedAgent
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		agents = append(agents, utilities.Require[restapi.ExpectedAgent](obj))
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+func (driver *storageDriver) RevokeCredential(revocation restapi.Revocation) error {
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("revocations", revocation)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) RemoveRevocation(kind string, subject string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("revocations", "id", kind, subject)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	err = txn.Delete("revocations", obj)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetRevocations() ([]restapi.Revocation, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("revocations", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	revocations := []restapi.Revocation{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		revocations = append(revocations, utilities.Require[restapi.Revocation](obj))
+	}
+
+	storage.SortRevocations(revocations)
+
+	return revocations, nil
+}
+
+func (driver *storageDriver) CreateApiToken(token restapi.ApiToken, hash string) error {
+	txn := driver.db.Txn(true)
+
+	// Unique indexes other than the id are not enforced by memdb
+	existing, err := txn.First("api_tokens", "name", token.Name)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if existing != nil {
+		txn.Abort()
+		return pkgerrors.Errorf(storage.ErrConflict, "a token named %s exists", token.Name)
+	}
+
+	token.Token = ""
+	err = txn.Insert("api_tokens", ApiToken{
+		ApiToken: token,
+		Hash:     hash,
+	})
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetApiTokenByHash(hash string) (restapi.ApiToken, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("api_tokens", "hash", hash)
+	if err != nil {
+		return restapi.ApiToken{}, err
+	}
+
+	if obj == nil {
+		return restapi.ApiToken{}, storage.ErrNotFound
+	}
+
+	return utilities.Require[ApiToken](obj).ApiToken, nil
+}
+
+func (driver *storageDriver) GetApiTokens() ([]restapi.ApiToken, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("api_tokens", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []restapi.ApiToken{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		tokens = append(tokens, utilities.Require[ApiToken](obj).ApiToken)
+	}
+
+	storage.SortApiTokens(tokens)
+
+	return tokens, nil
+}
+
+func (driver *storageDriver) DeleteApiToken(id string) (restapi.ApiToken, error) {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("api_tokens", "id", id)
+	if err != nil {
+		txn.Abort()
+		return restapi.ApiToken{}, err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return restapi.ApiToken{}, storage.ErrNotFound
+	}
+
+	err = txn.Delete("api_tokens", obj)
+	if err != nil {
+		txn.Abort()
+		return restapi.ApiToken{}, err
+	}
+
+	txn.Commit()
+	return utilities.Require[ApiToken](obj).ApiToken, nil
+}
+
+func (driver *storageDriver) AcquireLease(name string, holder string, duration time.Duration) (restapi.Lease, error) {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("leases", "id", name)
+	if err != nil {
+		txn.Abort()
+		return restapi.Lease{}, err
+	}
+
+	var lease restapi.Lease
+	if obj != nil {
+		lease = utilities.Require[restapi.Lease](obj)
+	}
+
+	lease, acquired := storage.AcquireLease(lease, obj != nil, name, holder, duration, driver.clock.Now())
+	if !acquired {
+		txn.Abort()
+		return lease, nil
+	}
+
+	err = txn.Insert("leases", lease)
+	if err != nil {
+		txn.Abort()
+		return restapi.Lease{}, err
+	}
+
+	txn.Commit()
+	return lease, nil
+}
+
+func (driver *storageDriver) ReleaseLease(name string, holder string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("leases", "id", name)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil || utilities.Require[restapi.Lease](obj).Holder != holder {
+		txn.Abort()
+		return nil
+	}
+
+	err = txn.Delete("leases", obj)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetLease(name string) (restapi.Lease, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("leases", "id", name)
+	if err != nil {
+		return restapi.Lease{}, err
+	}
+
+	if obj == nil {
+		return restapi.Lease{}, storage.ErrNotFound
+	}
+
+	lease := utilities.Require[restapi.Lease](obj)
+	if !driver.clock.Now().Before(lease.ExpiresAt) {
+		return restapi.Lease{}, storage.ErrNotFound
+	}
+
+	return lease, nil
+}
+
+func (driver *storageDriver) SetPoolPaused(pool string, paused bool) error {
+	txn := driver.db.Txn(true)
+
+	var err error
+	if paused {
+		err = txn.Insert("paused_pools", storage.PausedPool{Pool: pool})
+	} else {
+		_, err = txn.DeleteAll("paused_pools", "id", pool)
+	}
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetPausedPools() ([]string, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.Get("paused_pools", "id")
+	if err != nil {
+		return nil, err
 	}
 
-	if obj == nil {
-		return restapi.Session{}, storage.ErrNotFound
+	pools := []string{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		pools = append(pools, utilities.Require[storage.PausedPool](obj).Pool)
 	}
 
-	return utilities.Require[Session](obj).Session, nil
+	return pools, nil
 }
 
-func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+func (driver *storageDriver) SetFeatureOverride(override storage.FeatureOverride) error {
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("feature_overrides", override)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetFeatureOverrides() ([]storage.FeatureOverride, error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	obj, err := txn.First("sessions", "id", id)
+	iterator, err := txn.Get("feature_overrides", "id")
 	if err != nil {
-		return storage.QueuedSession{}, err
+		return nil, err
 	}
 
-	if obj == nil {
-		return storage.QueuedSession{}, storage.ErrNotFound
+	overrides := []storage.FeatureOverride{}
+	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
+		overrides = append(overrides, utilities.Require[storage.FeatureOverride](obj))
 	}
 
-	session := utilities.Require[Session](obj)
+	return overrides, nil
+}
 
-	return storage.QueuedSession{
-		Id:           session.Id,
-		Requirements: session.Requirements,
-	}, nil
+func (driver *storageDriver) PutConfigResource(resource restapi.ConfigResource) error {
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("config_resources", resource)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
 }
 
-func (driver *storageDriver) GetAgents() (storage.Iterator[restapi.Agent], error) {
+func (driver *storageDriver) GetConfigResources(kind string) ([]restapi.ConfigResource, error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	iterator, err := txn.Get("agents", "id")
+	iterator, err := txn.Get("config_resources", "kind", kind)
 	if err != nil {
 		return nil, err
 	}
 
-	var agents []restapi.Agent
+	resources := []restapi.ConfigResource{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agents = append(agents, utilities.Require[Agent](obj).Agent)
+		resources = append(resources, utilities.Require[restapi.ConfigResource](obj))
 	}
 
-	return storage.NewDefaultIterator(agents), nil
+	storage.SortConfigResources(resources)
+
+	return resources, nil
+}
+
+func (driver *storageDriver) DeleteConfigResource(kind string, name string) error {
+	txn := driver.db.Txn(true)
+
+	obj, err := txn.First("config_resources", "id", kind, name)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
+	}
+
+	err = txn.Delete("config_resources", obj)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// The in-memory storage is not persisted, its secrets are not encrypted
+func (driver *storageDriver) RotateSecrets() (int, error) {
+	return 0, nil
+}
+
+func (driver *storageDriver) AppendEvent(event restapi.Event) (restapi.Event, error) {
+	txn := driver.db.Txn(true)
+
+	event.Sequence = driver.lastSequence + 1
+
+	err := txn.Insert("events", event)
+	if err != nil {
+		txn.Abort()
+		return restapi.Event{}, err
+	}
+
+	driver.lastSequence = event.Sequence
+
+	txn.Commit()
+	return event, nil
 }
 
-func (driver *storageDriver) GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+func (driver *storageDriver) GetEventsSince(since uint64, limit int) ([]restapi.Event, error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	iterator, err := txn.Get("agents", "state", restapi.AgentActive)
+	iterator, err := txn.LowerBound("events", "id", since+1)
 	if err != nil {
 		return nil, err
 	}
 
-	var agents []restapi.Agent
+	events := []restapi.Event{}
+	for obj := iterator.Next(); obj != nil && len(events) < limit; obj = iterator.Next() {
+		events = append(events, utilities.Require[restapi.Event](obj))
+	}
+
+	return events, nil
+}
+
+// Requires a transaction, returns the sessions closed at least duration ago
+func (driver *storageDriver) closedSessionsOlderThan(txn *memdb.Txn, duration time.Duration) ([]Session, error) {
+	before := driver.clock.Now().Add(-duration).Unix()
+
+	// Keys of the non-unique index are suffixed by the id, so the bound is the next second to
+	// include the sessions closed at before
+	iterator, err := txn.ReverseLowerBound("sessions", "last_updated", before+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var closed []Session
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
+		session := utilities.Require[Session](obj)
+		if session.State == restapi.SessionClosed {
+			closed = append(closed, session)
+		}
+	}
 
-		if agent.VramAvailable >= totalAvailableVramAtLeast {
-			agents = append(agents, agent.Agent)
+	return closed, nil
+}
+
+func (driver *storageDriver) RollUpUsageOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	txn := driver.db.Txn(!dryRun)
+
+	closed, err := driver.closedSessionsOlderThan(txn, duration)
+	if err != nil {
+		txn.Abort()
+		return 0, err
+	}
+
+	count := 0
+	for _, session := range closed {
+		if session.RolledUp {
+			continue
+		}
+
+		count++
+		if dryRun {
+			continue
+		}
+
+		closedAt := time.Unix(session.LastUpdated, 0)
+		key := usageKey(storage.UsageMonth(closedAt), session.Tenant)
+
+		usage := Usage{
+			UsageAggregate: restapi.UsageAggregate{
+				Month:  storage.UsageMonth(closedAt),
+				Tenant: session.Tenant,
+			},
+			Key: key,
+		}
+
+		obj, err := txn.First("usage", "id", key)
+		if err != nil {
+			txn.Abort()
+			return 0, err
+		}
+
+		if obj != nil {
+			usage = utilities.Require[Usage](obj)
+		}
+
+		storage.AddSessionUsage(&usage.UsageAggregate, session.Session, session.RequestedAt, closedAt)
+
+		err = txn.Insert("usage", usage)
+		if err != nil {
+			txn.Abort()
+			return 0, err
+		}
+
+		session.RolledUp = true
+		err = txn.Insert("sessions", session)
+		if err != nil {
+			txn.Abort()
+			return 0, err
 		}
 	}
 
-	return storage.NewDefaultIterator(agents), nil
+	if dryRun {
+		txn.Abort()
+	} else {
+		txn.Commit()
+	}
+
+	return count, nil
 }
 
-func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+func (driver *storageDriver) GetUsageAggregates() ([]restapi.UsageAggregate, error) {
 	txn := driver.db.Txn(false)
 	defer txn.Abort()
 
-	iterator, err := txn.Get("sessions", "state", restapi.SessionQueued)
+	iterator, err := txn.Get("usage", "id")
 	if err != nil {
 		return nil, err
 	}
 
-	var sessions []storage.QueuedSession
+	aggregates := []restapi.UsageAggregate{}
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		session := utilities.Require[Session](obj)
-		sessions = append(sessions, storage.QueuedSession{
-			Id:           session.Id,
-			Requirements: session.Requirements,
-		})
+		aggregates = append(aggregates, utilities.Require[Usage](obj).UsageAggregate)
 	}
 
-	return storage.NewDefaultIterator(sessions), nil
+	storage.SortUsageAggregates(aggregates)
+
+	return aggregates, nil
 }
 
-func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
-	nowTime := time.Now()
-	now := nowTime.Unix()
-	since := nowTime.Add(-duration).Unix()
+func (driver *storageDriver) RemoveClosedSessionsOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	txn := driver.db.Txn(!dryRun)
+
+	closed, err := driver.closedSessionsOlderThan(txn, duration)
+	if err != nil || dryRun {
+		txn.Abort()
+		return len(closed), err
+	}
+
+	for _, session := range closed {
+		err = txn.Delete("sessions", session)
+		if err != nil {
+			txn.Abort()
+			return 0, err
+		}
+	}
 
+	txn.Commit()
+	return len(closed), nil
+}
+
+func (driver *storageDriver) RemoveEventsOlderThan(duration time.Duration) error {
 	txn := driver.db.Txn(true)
 
-	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	iterator, err := txn.Get("events", "id")
 	if err != nil {
 		txn.Abort()
 		return err
 	}
 
+	// Events are appended in order of time, removal stops at the first event to keep
+	var expired []restapi.Event
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-		if agent.State == restapi.AgentActive {
-			agent.State = restapi.AgentMissing
-			agent.LastUpdated = now
+		event := utilities.Require[restapi.Event](obj)
+		if driver.clock.Since(event.Time) < duration {
+			break
+		}
 
-			err = txn.Insert("agents", agent)
-			if err != nil {
-				txn.Abort()
-				return err
-			}
+		expired = append(expired, event)
+	}
+
+	for _, event := range expired {
+		err = txn.Delete("events", event)
+		if err != nil {
+			txn.Abort()
+			return err
 		}
 	}
 
@@ -562,36 +2030,140 @@ func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Durat
 	return nil
 }
 
-func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
-	since := time.Now().Add(-duration).Unix()
+func (driver *storageDriver) AppendJournalEntry(entry restapi.JournalEntry) (restapi.JournalEntry, error) {
+	txn := driver.db.Txn(true)
+
+	entry.Sequence = driver.lastJournalSequence.Load() + 1
+	entry.Time = driver.clock.Now()
+
+	err := txn.Insert("journal", entry)
+	if err != nil {
+		txn.Abort()
+		return restapi.JournalEntry{}, err
+	}
+
+	driver.lastJournalSequence.Store(entry.Sequence)
 
+	txn.Commit()
+	return entry, nil
+}
+
+func (driver *storageDriver) UpdateJournalEntry(entry restapi.JournalEntry) error {
 	txn := driver.db.Txn(true)
 
-	iterator, err := txn.ReverseLowerBound("agents", "last_updated", since)
+	obj, err := txn.First("journal", "id", entry.Sequence)
 	if err != nil {
 		txn.Abort()
 		return err
+	} else if obj == nil {
+		txn.Abort()
+		return storage.ErrNotFound
 	}
 
-	agentIds := make([]interface{}, 0)
+	err = txn.Insert("journal", entry)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetJournalEntriesSince(since uint64, limit int) ([]restapi.JournalEntry, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	iterator, err := txn.LowerBound("journal", "id", since+1)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []restapi.JournalEntry{}
+	for obj := iterator.Next(); obj != nil && len(entries) < limit; obj = iterator.Next() {
+		entries = append(entries, utilities.Require[restapi.JournalEntry](obj))
+	}
+
+	return entries, nil
+}
+
+func (driver *storageDriver) GetJournalSequence() (uint64, error) {
+	return driver.lastJournalSequence.Load(), nil
+}
+
+func (driver *storageDriver) RemoveJournalEntriesOlderThan(duration time.Duration) error {
+	txn := driver.db.Txn(true)
+
+	iterator, err := txn.Get("journal", "id")
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	// Entries are appended in order of time, removal stops at the first entry to keep
+	var expired []restapi.JournalEntry
 	for obj := iterator.Next(); obj != nil; obj = iterator.Next() {
-		agent := utilities.Require[Agent](obj)
-		if agent.State == restapi.AgentMissing {
-			agentIds = append(agentIds, agent.Id)
+		entry := utilities.Require[restapi.JournalEntry](obj)
+		if driver.clock.Since(entry.Time) < duration {
+			break
 		}
+
+		expired = append(expired, entry)
 	}
 
-	if len(agentIds) > 0 {
-		_, err = txn.DeleteAll("agents", "id", agentIds...)
+	for _, entry := range expired {
+		err = txn.Delete("journal", entry)
 		if err != nil {
 			txn.Abort()
 			return err
 		}
+	}
 
-		txn.Commit()
-	} else {
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) PutJournalCursor(cursor storage.JournalCursor) error {
+	txn := driver.db.Txn(true)
+
+	err := txn.Insert("journal_cursors", cursor)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (driver *storageDriver) GetJournalCursor(name string) (storage.JournalCursor, error) {
+	txn := driver.db.Txn(false)
+	defer txn.Abort()
+
+	obj, err := txn.First("journal_cursors", "id", name)
+	if err != nil {
+		return storage.JournalCursor{}, err
+	}
+	if obj == nil {
+		return storage.JournalCursor{}, storage.ErrNotFound
+	}
+
+	return utilities.Require[storage.JournalCursor](obj), nil
+}
+
+func (driver *storageDriver) DeleteJournalCursor(name string) error {
+	txn := driver.db.Txn(true)
+
+	_, err := txn.DeleteAll("journal_cursors", "id", name)
+	if err != nil {
 		txn.Abort()
+		return err
 	}
 
+	txn.Commit()
 	return nil
 }
+
+func (driver *storageDriver) WatchAgents(notify func(agentId string)) (func(), error) {
+	return driver.watchers.Watch(notify), nil
+}
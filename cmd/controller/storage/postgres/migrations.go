@@ -0,0 +1,373 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are scripts/<version>_<name>.sql, applied in order of version, rolled back by
+// scripts/rollback/<version>_<name>.sql. Migrations starting with compatibleMarker leave the
+// schema usable by controllers that predate them, so controllers can be upgraded one at a time.
+//
+//go:embed scripts/*.sql scripts/rollback/*.sql
+var scripts embed.FS
+
+const compatibleMarker = "-- juice:compatible"
+
+// Schemas created before migrations were recorded have every migration up to this version
+const legacySchemaVersion = 7
+
+// Serializes migrations across controllers and juicectl, chosen arbitrarily
+const migrationLockId = 7_243_133
+
+type Migration struct {
+	Version int
+	Name    string
+	// Controllers that predate the migration keep working once it is applied
+	Compatible bool
+
+	up   string
+	down string
+}
+
+type MigrationStep struct {
+	Migration Migration
+	// Whether the step rolls back the migration rather than applying it
+	Rollback bool
+}
+
+func (step MigrationStep) String() string {
+	if step.Rollback {
+		return fmt.Sprintf("roll back %d_%s", step.Migration.Version, step.Migration.Name)
+	}
+
+	return fmt.Sprintf("apply %d_%s", step.Migration.Version, step.Migration.Name)
+}
+
+// Returns the migrations embedded in this build in order of version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(scripts, "scripts")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		prefix, name, found := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !found || err != nil {
+			return nil, fmt.Errorf("Migrations: %s is not named <version>_<name>.sql", entry.Name())
+		}
+
+		up, err := scripts.ReadFile(path.Join("scripts", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		// Not every migration can be rolled back
+		down, err := scripts.ReadFile(path.Join("scripts", "rollback", entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       name,
+			Compatible: strings.HasPrefix(string(up), compatibleMarker),
+			up:         string(up),
+			down:       string(down),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for index, migration := range migrations {
+		if migration.Version != index+1 {
+			return nil, fmt.Errorf("Migrations: expected migration %d, found %d_%s", index+1, migration.Version, migration.Name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Returns the version of the latest migration embedded in this build
+func LatestSchemaVersion() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].Version
+}
+
+// A migration recorded as applied to the schema
+type appliedMigration struct {
+	version    int
+	name       string
+	compatible bool
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Returns the migrations applied to the schema in order of version. Schemas created before
+// migrations were recorded are reported as having every migration up to legacySchemaVersion.
+func appliedMigrations(ctx context.Context, db queryer) ([]appliedMigration, error) {
+	var history, agents sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations')::text, to_regclass('agents')::text").Scan(&history, &agents)
+	if err != nil {
+		return nil, err
+	}
+
+	if !history.Valid {
+		applied := []appliedMigration{}
+		if agents.Valid {
+			migrations, err := Migrations()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, migration := range migrations[:legacySchemaVersion] {
+				applied = append(applied, appliedMigration{
+					version:    migration.Version,
+					name:       migration.Name,
+					compatible: migration.Compatible,
+				})
+			}
+		}
+
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, name, compatible FROM schema_migrations ORDER BY version ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := []appliedMigration{}
+	for rows.Next() {
+		var migration appliedMigration
+		err = rows.Scan(&migration.version, &migration.name, &migration.compatible)
+		if err != nil {
+			return nil, err
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, rows.Err()
+}
+
+func schemaVersion(applied []appliedMigration) int {
+	if len(applied) == 0 {
+		return 0
+	}
+
+	return applied[len(applied)-1].version
+}
+
+// Refuses schemas this build cannot use, those with migrations still to apply and those with
+// migrations from a newer build that older controllers cannot use
+func checkSchema(ctx context.Context, db queryer) error {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return fmt.Errorf("unable to read the schema version, %v", err)
+	}
+
+	current := schemaVersion(applied)
+	latest := LatestSchemaVersion()
+
+	if current < latest {
+		return fmt.Errorf("the schema is at version %d and this controller requires version %d, run juicectl migrate or start the controller with --psql-migrate", current, latest)
+	}
+
+	for _, migration := range applied {
+		if migration.version > latest && !migration.compatible {
+			return fmt.Errorf("the schema is at version %d and migration %d_%s is not compatible with this controller, which supports up to version %d, upgrade the controller",
+				current, migration.version, migration.name, latest)
+		}
+	}
+
+	return nil
+}
+
+type Migrator struct {
+	db *sql.DB
+}
+
+func OpenMigrator(connection string) (*Migrator, error) {
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db: db,
+	}, nil
+}
+
+func (migrator *Migrator) Close() error {
+	return migrator.db.Close()
+}
+
+// Returns the version of the schema, 0 for an empty database
+func (migrator *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := appliedMigrations(ctx, migrator.db)
+	if err != nil {
+		return 0, err
+	}
+
+	return schemaVersion(applied), nil
+}
+
+// Returns the steps migrating the schema from the applied migrations to version
+func planMigration(migrations []Migration, applied []appliedMigration, version int) ([]MigrationStep, error) {
+	current := schemaVersion(applied)
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+
+	if current > latest {
+		return nil, fmt.Errorf("the schema is at version %d, newer than the version %d known to this build", current, latest)
+	}
+
+	if version < 0 || version > latest {
+		return nil, fmt.Errorf("unknown schema version %d, expected 0 through %d", version, latest)
+	}
+
+	steps := []MigrationStep{}
+	if version >= current {
+		for _, migration := range migrations[current:version] {
+			steps = append(steps, MigrationStep{
+				Migration: migration,
+			})
+		}
+	} else {
+		for index := current - 1; index >= version; index-- {
+			migration := migrations[index]
+			if migration.down == "" {
+				return nil, fmt.Errorf("migration %d_%s cannot be rolled back", migration.Version, migration.Name)
+			}
+
+			steps = append(steps, MigrationStep{
+				Migration: migration,
+				Rollback:  true,
+			})
+		}
+	}
+
+	return steps, nil
+}
+
+// Migrates the schema to version, applying or rolling back migrations as needed, and returns
+// the steps taken. When dryRun is true the steps are returned without being taken. Each step is
+// taken in its own transaction, migrations already taken are kept when a later step fails.
+func (migrator *Migrator) Migrate(ctx context.Context, version int, dryRun bool, step func(MigrationStep)) ([]MigrationStep, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// Advisory locks belong to the connection, hold one for the whole migration
+	conn, err := migrator.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockId)
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := planMigration(migrations, applied, version)
+	if err != nil || dryRun || len(steps) == 0 {
+		return steps, err
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		compatible boolean NOT NULL,
+		applied_at TIMESTAMP DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the migrations of schemas created before migrations were recorded
+	for _, migration := range applied {
+		_, err = conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, compatible) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			migration.version, migration.name, migration.compatible)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for index, migrationStep := range steps {
+		err = migrator.take(ctx, conn, migrationStep)
+		if err != nil {
+			return steps[:index], fmt.Errorf("unable to %s, %v", migrationStep, err)
+		}
+
+		if step != nil {
+			step(migrationStep)
+		}
+	}
+
+	return steps, nil
+}
+
+func (migrator *Migrator) take(ctx context.Context, conn *sql.Conn, step MigrationStep) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	migration := step.Migration
+	if step.Rollback {
+		_, err = tx.ExecContext(ctx, migration.down)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, migration.up)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, compatible) VALUES ($1, $2, $3)",
+				migration.Version, migration.Name, migration.Compatible)
+		}
+	}
+
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return tx.Commit()
+}
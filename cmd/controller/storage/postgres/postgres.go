@@ -10,19 +10,49 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 )
 
 type storageDriver struct {
-	ctx context.Context
-	db  *sql.DB
+	ctx        context.Context
+	db         *sql.DB
+	connection string
+
+	// Times computed from the ages the database reports, its own expiry math uses its clock
+	clock clock.Clock
+
+	// Serves the read-only operations, the primary unless the driver is a view returned by StaleReads
+	reader *sql.DB
+	view   bool
+
+	// Read replicas used by StaleReads in turn
+	replicas    []*sql.DB
+	nextReplica *atomic.Uint32
+
+	// Encrypts secret-bearing columns at rest, nil when encryption is disabled
+	keyring *crypto.Keyring
+
+	notifications *agentNotifications
+}
+
+// Receives the agent change notifications raised by the triggers in 6_agent_notifications.sql,
+// started by the first call to WatchAgents
+type agentNotifications struct {
+	mutex    sync.Mutex
+	listener *pq.Listener
+	watchers storage.AgentWatchers
 }
 
 type sqlRow interface {
@@ -106,7 +136,7 @@ func (iterator *tableIterator[T]) Value() T {
 }
 
 const (
-	selectAgents = `SELECT id, state, hostname, address, version, gpus, 
+	selectAgents = `SELECT id, state, hostname, address, version, gpus, cpu_fallback_capacity, max_sessions_per_gpu, draining, capabilities, rootless, self_test, 
 			( SELECT ARRAY (
 				SELECT ( SELECT row(key, value) FROM key_values WHERE id = agent_labels.key_value_id ) FROM agent_labels WHERE agent_id = agents.id
 			) ) labels, 
@@ -114,14 +144,17 @@ const (
 				SELECT ( SELECT row(key, value) FROM key_values WHERE id = agent_taints.key_value_id ) FROM agent_taints WHERE agent_id = agents.id
 			) ) taints, 
 			( SELECT ARRAY (
-				SELECT row(id, state, exit_status, address, version, persistent, gpus) FROM sessions tab WHERE tab.agent_id = agents.id AND tab.state != 'closed'
+				SELECT row(id, state, exit_status, address, version, persistent, gpus, cpu_fallback, network, release, frames, COALESCE(requirements->>'tenant', ''), COALESCE(requirements->>'user', ''), COALESCE(requirements->>'delegatedBy', ''), COALESCE(requirements->>'tokenName', ''), COALESCE((requirements->>'idleTimeoutSeconds')::int, 0), COALESCE(log_excerpt, ''), preemptible, COALESCE(requirements->>'class', ''), COALESCE((requirements->>'metricsPort')::int, 0), COALESCE((requirements->>'record')::boolean, false), requirements->'reservation', COALESCE((requirements->>'priority')::int, 0), preempted) FROM sessions tab WHERE tab.agent_id = agents.id AND tab.state != 'closed'
 			) ) sessions
 		FROM agents`
-	selectSessions       = "SELECT id, state, exit_status, address, version, persistent, gpus FROM sessions"
-	selectQueuedSessions = "SELECT id, requirements FROM sessions WHERE state = 'queued'"
+	selectSessions       = "SELECT id, state, exit_status, address, version, persistent, gpus, cpu_fallback, network, release, frames, COALESCE(requirements->>'tenant', ''), COALESCE(requirements->>'user', ''), COALESCE(requirements->>'delegatedBy', ''), COALESCE(requirements->>'tokenName', ''), COALESCE((requirements->>'idleTimeoutSeconds')::int, 0), COALESCE(log_excerpt, ''), preemptible, COALESCE(requirements->>'class', ''), COALESCE((requirements->>'metricsPort')::int, 0), COALESCE((requirements->>'record')::boolean, false), requirements->'reservation', COALESCE((requirements->>'priority')::int, 0), preempted FROM sessions"
+	selectQueuedSessions = "SELECT id, requirements, EXTRACT(EPOCH FROM now() - created_at) FROM sessions WHERE state = 'queued'"
 
 	orderBy     = " ORDER BY created_at ASC"
 	offsetLimit = " OFFSET $1 LIMIT "
+
+	// Highest priority first then oldest first, see storage.SortQueuedSessions
+	queuedOrderBy = " ORDER BY COALESCE((requirements->>'priority')::int, 0) DESC, created_at ASC"
 )
 
 func selectAgentsWhere(where string) string {
@@ -137,7 +170,7 @@ func selectAgentsIteratorWhere(where string, limit int) string {
 }
 
 func unmarshalAgent(row sqlRow) (restapi.Agent, error) {
-	var gpus []byte
+	var gpus, capabilities, selfTest []byte
 	var labels, taints, sessions pq.ByteaArray
 
 	agent := restapi.Agent{
@@ -146,7 +179,7 @@ func unmarshalAgent(row sqlRow) (restapi.Agent, error) {
 		Sessions: make([]restapi.Session, 0),
 	}
 
-	err := row.Scan(&agent.Id, &agent.State, &agent.Hostname, &agent.Address, &agent.Version, &gpus, &labels, &taints, &sessions)
+	err := row.Scan(&agent.Id, &agent.State, &agent.Hostname, &agent.Address, &agent.Version, &gpus, &agent.CpuFallbackCapacity, &agent.MaxSessionsPerGpu, &agent.Draining, &capabilities, &agent.Rootless, &selfTest, &labels, &taints, &sessions)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = storage.ErrNotFound
@@ -160,6 +193,18 @@ func unmarshalAgent(row sqlRow) (restapi.Agent, error) {
 		return restapi.Agent{}, err
 	}
 
+	err = json.Unmarshal(capabilities, &agent.Capabilities)
+	if err != nil {
+		return restapi.Agent{}, err
+	}
+
+	if selfTest != nil {
+		err = json.Unmarshal(selfTest, &agent.SelfTest)
+		if err != nil {
+			return restapi.Agent{}, err
+		}
+	}
+
 	for _, label := range labels {
 		var key, value string
 		err = Composite(label).Scan(&key, &value)
@@ -200,8 +245,12 @@ func unmarshalSession(row sqlRow) (restapi.Session, error) {
 	var session restapi.Session
 	var address []byte
 	var gpus []byte
+	var network []byte
+	var release []byte
+	var frames []byte
+	var reservation []byte
 
-	err := row.Scan(&session.Id, &session.State, &session.ExitStatus, &address, &session.Version, &session.Persistent, &gpus)
+	err := row.Scan(&session.Id, &session.State, &session.ExitStatus, &address, &session.Version, &session.Persistent, &gpus, &session.CpuFallback, &network, &release, &frames, &session.Tenant, &session.User, &session.DelegatedBy, &session.TokenName, &session.IdleTimeoutSeconds, &session.LogExcerpt, &session.Preemptible, &session.Class, &session.MetricsPort, &session.Record, &reservation, &session.Priority, &session.Preempted)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = storage.ErrNotFound
@@ -225,26 +274,58 @@ func unmarshalSession(row sqlRow) (restapi.Session, error) {
 		}
 	}
 
+	if network != nil {
+		err = json.Unmarshal(network, &session.Network)
+		if err != nil {
+			return restapi.Session{}, err
+		}
+	}
+
+	if release != nil {
+		err = json.Unmarshal(release, &session.Release)
+		if err != nil {
+			return restapi.Session{}, err
+		}
+	}
+
+	if frames != nil {
+		err = json.Unmarshal(frames, &session.Frames)
+		if err != nil {
+			return restapi.Session{}, err
+		}
+	}
+
+	if reservation != nil {
+		err = json.Unmarshal(reservation, &session.Reservation)
+		if err != nil {
+			return restapi.Session{}, err
+		}
+	}
+
 	return session, nil
 }
 
 func selectQueuedSessionsWhere(where string) string {
-	return fmt.Sprint(selectQueuedSessions, " AND ", where, orderBy)
+	return fmt.Sprint(selectQueuedSessions, " AND ", where, queuedOrderBy)
 }
 
 func selectQueuedSessionsIteratorWhere(where string, limit int) string {
-	return fmt.Sprint(selectQueuedSessions, " AND ", where, orderBy, offsetLimit, limit)
+	return fmt.Sprint(selectQueuedSessions, " AND ", where, queuedOrderBy, offsetLimit, limit)
 }
 
-func unmarshalQueuedSession(row sqlRow) (storage.QueuedSession, error) {
+func (driver *storageDriver) unmarshalQueuedSession(row sqlRow) (storage.QueuedSession, error) {
 	session := storage.QueuedSession{}
 
 	var requirements string
-	err := row.Scan(&session.Id, &requirements)
+	var age float64
+	err := row.Scan(&session.Id, &requirements, &age)
 	if err != nil {
 		return storage.QueuedSession{}, err
 	}
 
+	// Ages are computed by the database to avoid depending on its timezone
+	session.RequestedAt = driver.clock.Now().Add(-time.Duration(age * float64(time.Second)))
+
 	err = json.Unmarshal([]byte(requirements), &session.Requirements)
 	if err != nil {
 		return storage.QueuedSession{}, err
@@ -253,20 +334,112 @@ func unmarshalQueuedSession(row sqlRow) (storage.QueuedSession, error) {
 	return session, nil
 }
 
-func OpenStorage(ctx context.Context, connection string) (storage.Storage, error) {
+// Writes and reads go to the primary given by connection, reads through StaleReads go to the
+// replicas given by replicaConnections when there are any
+func OpenStorage(ctx context.Context, connection string, replicaConnections []string, keyring *crypto.Keyring) (storage.Storage, error) {
 	db, err := sql.Open("postgres", connection)
 	if err != nil {
 		return nil, err
 	}
 
+	err = checkSchema(ctx, db)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	replicas := make([]*sql.DB, 0, len(replicaConnections))
+	for _, replicaConnection := range replicaConnections {
+		replica, err := sql.Open("postgres", replicaConnection)
+		if err != nil {
+			for _, opened := range replicas {
+				err = errors.Join(err, opened.Close())
+			}
+
+			return nil, errors.Join(err, db.Close())
+		}
+
+		replicas = append(replicas, replica)
+	}
+
 	return &storageDriver{
-		ctx: ctx,
-		db:  db,
+		ctx:           ctx,
+		db:            db,
+		connection:    connection,
+		clock:         clock.FromContext(ctx),
+		reader:        db,
+		replicas:      replicas,
+		nextReplica:   &atomic.Uint32{},
+		keyring:       keyring,
+		notifications: &agentNotifications{},
 	}, nil
 }
 
+func (driver *storageDriver) StaleReads() storage.Storage {
+	if len(driver.replicas) == 0 {
+		return driver
+	}
+
+	view := *driver
+	view.reader = driver.replicas[int(driver.nextReplica.Add(1))%len(driver.replicas)]
+	view.view = true
+	return &view
+}
+
+// Encrypts a secret-bearing value before it is written
+func (driver *storageDriver) sealSecret(value string) (string, error) {
+	if driver.keyring == nil || value == "" {
+		return value, nil
+	}
+
+	return driver.keyring.Encrypt(value)
+}
+
+// Re-encrypts a secret-bearing value with the primary key, counting it when it was not
+func (driver *storageDriver) rotateSecret(value string, rotated *int) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	value, changed, err := driver.keyring.Rotate(value)
+	if changed {
+		*rotated++
+	}
+	return value, err
+}
+
+// Decrypts a secret-bearing value after it is read
+func (driver *storageDriver) openSecret(value string) (string, error) {
+	if driver.keyring == nil {
+		if crypto.IsEncrypted(value) {
+			return "", errors.New("value is encrypted, --storage-encryption-key-file is required")
+		}
+
+		return value, nil
+	}
+
+	return driver.keyring.Decrypt(value)
+}
+
 func (driver *storageDriver) Close() error {
-	return driver.db.Close()
+	// Views share the connections of the driver they were created from
+	if driver.view {
+		return nil
+	}
+
+	driver.notifications.mutex.Lock()
+	defer driver.notifications.mutex.Unlock()
+
+	var err error
+	if driver.notifications.listener != nil {
+		err = driver.notifications.listener.Close()
+		driver.notifications.listener = nil
+	}
+
+	for _, replica := range driver.replicas {
+		err = errors.Join(err, replica.Close())
+	}
+
+	return errors.Join(err, driver.db.Close())
 }
 
 func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
@@ -275,7 +448,7 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 	var sessions int
 	var sessionsByStatusArray pq.ByteaArray
 
-	row := driver.db.QueryRowContext(driver.ctx, `SELECT 
+	row := driver.reader.QueryRowContext(driver.ctx, `SELECT 
 		(SELECT COUNT(*) FROM agents),
 		ARRAY(SELECT row(state, COUNT(*)) FROM agents GROUP BY state),
 		(SELECT COUNT(*) FROM sessions),
@@ -323,7 +496,7 @@ func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
 	var powerDraw uint64
 	powerDrawByGpuName := map[string]uint64{}
 
-	rows, err := driver.db.QueryContext(driver.ctx, "SELECT gpus FROM agents WHERE state = 'active'")
+	rows, err := driver.reader.QueryContext(driver.ctx, "SELECT gpus FROM agents WHERE state = 'active'")
 	if err != nil {
 		return storage.AggregatedData{}, err
 	}
@@ -453,19 +626,40 @@ func (driver *storageDriver) RegisterAgent(agent restapi.Agent) (string, error)
 		return "", err
 	}
 
+	capabilities, err := json.Marshal(agent.Capabilities)
+	if err != nil {
+		return "", err
+	}
+
+	var selfTest []byte
+	if agent.SelfTest != nil {
+		selfTest, err = json.Marshal(agent.SelfTest)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	tx, err := driver.db.BeginTx(driver.ctx, nil)
 	if err != nil {
 		return "", err
 	}
 
+	if agent.Id != "" {
+		// The agent is adopting an existing identity, replace its previous registration
+		_, err = driver.db.ExecContext(driver.ctx, "DELETE FROM agents WHERE id = $1", agent.Id)
+		if err != nil {
+			return "", errors.Join(err, tx.Rollback())
+		}
+	}
+
 	var id string
 	err = driver.db.QueryRowContext(driver.ctx, "INSERT INTO agents ("+
-		"state, hostname, address, version, gpus, vram_available, updated_at"+
+		"id, state, hostname, address, version, gpus, vram_available, cpu_fallback_capacity, max_sessions_per_gpu, draining, capabilities, rootless, self_test, updated_at"+
 		") VALUES ("+
-		"$1, $2, $3, $4, $5, $6, now()"+
+		"COALESCE(NULLIF($1, '')::uuid, uuid_generate_v4()), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, now()"+
 		") RETURNING id",
-		agent.State, agent.Hostname, agent.Address, agent.Version,
-		gpus, storage.TotalVram(agent.Gpus)).Scan(&id)
+		agent.Id, agent.State, agent.Hostname, agent.Address, agent.Version,
+		gpus, storage.TotalVram(agent.Gpus), agent.CpuFallbackCapacity, agent.MaxSessionsPerGpu, agent.Draining, capabilities, agent.Rootless, selfTest).Scan(&id)
 	if err != nil {
 		return "", errors.Join(err, tx.Rollback())
 	}
@@ -514,7 +708,7 @@ func (driver *storageDriver) RegisterAgent(agent restapi.Agent) (string, error)
 }
 
 func (driver *storageDriver) GetAgentById(id string) (restapi.Agent, error) {
-	return unmarshalAgent(driver.db.QueryRowContext(driver.ctx, selectAgentsWhere("id = $1"), id))
+	return unmarshalAgent(driver.reader.QueryRowContext(driver.ctx, selectAgentsWhere("id = $1"), id))
 }
 
 func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
@@ -555,8 +749,8 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	}
 
 	if closedSessionsCount > 0 {
-		_, err = driver.db.ExecContext(driver.ctx, `UPDATE agents SET vram_available = (
-				SELECT SUM(vram_required) FROM sessions WHERE id = ANY($1)
+		_, err = driver.db.ExecContext(driver.ctx, `UPDATE agents SET vram_available = vram_available + (
+				SELECT COALESCE(SUM(vram_required), 0) FROM sessions WHERE id = ANY($1) AND NOT cpu_fallback
 			), state = $2, gpus = $3, updated_at = now() WHERE id = $4`,
 			pq.StringArray(closedSessions), update.State, gpusData, update.Id)
 	} else {
@@ -568,15 +762,225 @@ func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
 	}
 
 	for id, sessionUpdate := range update.Sessions {
-		_, err = driver.db.ExecContext(driver.ctx, "UPDATE sessions SET state = $1 WHERE id = $2", sessionUpdate.State, id)
+		var network []byte
+		if sessionUpdate.Network != nil {
+			network, err = json.Marshal(sessionUpdate.Network)
+			if err != nil {
+				return errors.Join(err, tx.Rollback())
+			}
+		}
+
+		if sessionUpdate.State == "" {
+			_, err = driver.db.ExecContext(driver.ctx, "UPDATE sessions SET network = COALESCE($1, network), updated_at = now() WHERE id = $2 AND state != 'closed'", network, id)
+		} else if sessionUpdate.ExitStatus != "" {
+			_, err = driver.db.ExecContext(driver.ctx, `UPDATE sessions SET state = $1, exit_status = CASE
+					WHEN release IS NULL OR COALESCE(release->>'exitStatus', '') = '' OR $2::session_exit_status = 'failure' THEN $2::session_exit_status
+					ELSE (release->>'exitStatus')::session_exit_status
+				END, network = COALESCE($3, network), updated_at = now() WHERE id = $4 AND state != 'closed'`, sessionUpdate.State, sessionUpdate.ExitStatus, network, id)
+		} else {
+			_, err = driver.db.ExecContext(driver.ctx, "UPDATE sessions SET state = $1, network = COALESCE($2, network), updated_at = now() WHERE id = $3 AND state != 'closed'", sessionUpdate.State, network, id)
+		}
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		if sessionUpdate.LogExcerpt != "" {
+			_, err = driver.db.ExecContext(driver.ctx, "UPDATE sessions SET log_excerpt = $1 WHERE id = $2", sessionUpdate.LogExcerpt, id)
+			if err != nil {
+				return errors.Join(err, tx.Rollback())
+			}
+		}
+	}
+
+	if closedSessionsCount > 0 {
+		err = driver.requeuePreempted(closedSessions)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Returns the preempted sessions among those closed to the queue, as they were before they were
+// assigned
+func (driver *storageDriver) requeuePreempted(closedSessions []string) error {
+	rows, err := driver.db.QueryContext(driver.ctx, "SELECT id, requirements FROM sessions WHERE id = ANY($1) AND preempted AND state = 'closed'", pq.StringArray(closedSessions))
+	if err != nil {
+		return err
+	}
+
+	vramRequired := map[string]uint64{}
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return errors.Join(err, rows.Close())
+		}
+
+		var requirements restapi.SessionRequirements
+		err = json.Unmarshal(data, &requirements)
+		if err != nil {
+			return errors.Join(err, rows.Close())
+		}
+
+		vramRequired[id] = storage.TotalVramRequired(requirements)
+	}
+
+	err = errors.Join(rows.Err(), rows.Close())
+	if err != nil {
+		return err
+	}
+
+	for id, vram := range vramRequired {
+		_, err = driver.db.ExecContext(driver.ctx, `UPDATE sessions SET state = $1, exit_status = $2, agent_id = NULL, address = NULL,
+				gpus = NULL, cpu_fallback = false, vram_required = $3, preemptible = false, preempted = false, updated_at = now() WHERE id = $4`,
+			restapi.SessionQueued, restapi.ExitStatusUnknown, vram, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (driver *storageDriver) SetAgentDraining(id string, draining bool) error {
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE agents SET draining = $1 WHERE id = $2", draining, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) SetAgentLabels(id string, labels map[string]string) error {
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Serializes replacing the agent's labels
+	err = tx.QueryRowContext(driver.ctx, "SELECT id FROM agents WHERE id = $1 FOR UPDATE", id).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, "DELETE FROM agent_labels WHERE agent_id = $1", id)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	for key, value := range labels {
+		_, err = tx.ExecContext(driver.ctx, "INSERT INTO key_values ("+
+			"key, value"+
+			") VALUES ("+
+			"$1, $2"+
+			") ON CONFLICT DO NOTHING", key, value)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		_, err = tx.ExecContext(driver.ctx, "INSERT INTO agent_labels ("+
+			"agent_id, key_value_id"+
+			") VALUES ("+
+			"$1, (SELECT id FROM key_values WHERE key = $2 AND value = $3)"+
+			")", id, key, value)
 		if err != nil {
 			return errors.Join(err, tx.Rollback())
 		}
 	}
 
+	// Only inserts into agent_labels notify the watchers, not removals
+	_, err = tx.ExecContext(driver.ctx, "SELECT pg_notify($1, $2)", agentsChangedChannel, id)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return tx.Commit()
+}
+
+func (driver *storageDriver) PatchAgentLabels(id string, patch restapi.AgentLabelsPatch) error {
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Serializes changing the agent's labels and taints
+	err = tx.QueryRowContext(driver.ctx, "SELECT id FROM agents WHERE id = $1 FOR UPDATE", id).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	err = patchAgentKeyValues(driver.ctx, tx, "agent_labels", id, patch.Labels, patch.RemoveLabels)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	err = patchAgentKeyValues(driver.ctx, tx, "agent_taints", id, patch.Taints, patch.RemoveTaints)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	// Removals do not notify the watchers
+	_, err = tx.ExecContext(driver.ctx, "SELECT pg_notify($1, $2)", agentsChangedChannel, id)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
 	return tx.Commit()
 }
 
+// Removes the keys of remove and then those of set from the agent's key values in table,
+// agent_labels or agent_taints, before inserting set
+func patchAgentKeyValues(ctx context.Context, tx *sql.Tx, table string, id string, set map[string]string, remove []string) error {
+	keys := append([]string{}, remove...)
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE agent_id = $1 AND "+
+			"key_value_id IN (SELECT id FROM key_values WHERE key = $2)", id, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, value := range set {
+		_, err := tx.ExecContext(ctx, "INSERT INTO key_values ("+
+			"key, value"+
+			") VALUES ("+
+			"$1, $2"+
+			") ON CONFLICT DO NOTHING", key, value)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+table+" ("+
+			"agent_id, key_value_id"+
+			") VALUES ("+
+			"$1, (SELECT id FROM key_values WHERE key = $2 AND value = $3)"+
+			")", id, key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (driver *storageDriver) RequestSession(sessionRequirements restapi.SessionRequirements) (string, error) {
 	requirements, err := json.Marshal(sessionRequirements)
 	if err != nil {
@@ -643,7 +1047,7 @@ func (driver *storageDriver) RequestSession(sessionRequirements restapi.SessionR
 	return id, tx.Commit()
 }
 
-func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu) error {
+func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu, cpuFallback bool) error {
 	gpusData, err := json.Marshal(gpus)
 	if err != nil {
 		return err
@@ -654,16 +1058,21 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 		return errors.Join(err, tx.Rollback())
 	}
 
-	_, err = driver.db.ExecContext(driver.ctx, `UPDATE agents SET vram_available = vram_available - (
-			SELECT vram_required FROM sessions WHERE id = $1
-		), updated_at = now() WHERE id = $2`, sessionId, agentId)
+	if cpuFallback {
+		_, err = driver.db.ExecContext(driver.ctx, "UPDATE agents SET updated_at = now() WHERE id = $1", agentId)
+	} else {
+		// Shared GPUs may allocate the session more VRAM than it requires
+		_, err = driver.db.ExecContext(driver.ctx, "UPDATE agents SET vram_available = vram_available - $1, updated_at = now() WHERE id = $2",
+			storage.AllocatedVram(gpus), agentId)
+	}
 	if err != nil {
 		return errors.Join(err, tx.Rollback())
 	}
 
 	_, err = driver.db.ExecContext(driver.ctx, `UPDATE sessions SET agent_id = $1, state = $2, exit_status = $3, address = (
 			SELECT address FROM agents WHERE id = $1
-		), gpus = $4, updated_at = now() WHERE id = $5`, agentId, restapi.SessionAssigned, restapi.ExitStatusUnknown, gpusData, sessionId)
+		), gpus = $4, cpu_fallback = $5, vram_required = $6, updated_at = now() WHERE id = $7`,
+		agentId, restapi.SessionAssigned, restapi.ExitStatusUnknown, gpusData, cpuFallback, storage.AllocatedVram(gpus), sessionId)
 	if err != nil {
 		return errors.Join(err, tx.Rollback())
 	}
@@ -671,48 +1080,1158 @@ func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpu
 	return tx.Commit()
 }
 
-func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
-	return unmarshalSession(driver.db.QueryRowContext(driver.ctx, selectSessionsWhere("id = $1"), id))
-}
+func (driver *storageDriver) AdoptSession(agentId string, session restapi.Session) error {
+	requirements := storage.AdoptedRequirements(session)
 
-func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
-	return unmarshalQueuedSession(driver.db.QueryRowContext(driver.ctx, selectQueuedSessionsWhere("id = $1"), id))
-}
+	requirementsData, err := json.Marshal(requirements)
+	if err != nil {
+		return err
+	}
 
-func (driver *storageDriver) GetAgents() (storage.Iterator[restapi.Agent], error) {
-	statement, err := driver.db.PrepareContext(driver.ctx, selectAgentsIterator(20))
+	gpusData, err := json.Marshal(session.Gpus)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return newIterator(driver.ctx, statement, unmarshalAgent)
-}
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
 
-func (driver *storageDriver) GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
-	statement, err := driver.db.PrepareContext(driver.ctx, selectAgentsIteratorWhere(
-		fmt.Sprint("state = 'active' AND vram_available >= ", totalAvailableVramAtLeast), 20))
+	var address string
+	err = tx.QueryRowContext(driver.ctx, "SELECT address FROM agents WHERE id = $1 FOR UPDATE", agentId).Scan(&address)
+	if err == sql.ErrNoRows {
+		err = storage.ErrNotFound
+	}
 	if err != nil {
-		return nil, err
+		return errors.Join(err, tx.Rollback())
 	}
 
-	return newIterator(driver.ctx, statement, unmarshalAgent)
-}
+	// Locks the session against being assigned while it is adopted
+	var state string
+	var placedOn sql.NullString
+	err = tx.QueryRowContext(driver.ctx, "SELECT state, agent_id FROM sessions WHERE id = $1 FOR UPDATE", session.Id).Scan(&state, &placedOn)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(driver.ctx, "INSERT INTO sessions ("+
+			"id, state, exit_status, version, persistent, requirements, vram_required, updated_at"+
+			") VALUES ("+
+			"$1, $2, $3, $4, $5, $6, $7, now()"+
+			")", session.Id, session.State, restapi.ExitStatusUnknown, session.Version, session.Persistent, requirementsData, storage.TotalVramRequired(requirements))
+	} else if err == nil && state != restapi.SessionClosed && placedOn.Valid {
+		err = tx.Rollback()
+		if err != nil || placedOn.String == agentId {
+			// Already placed on the agent
+			return err
+		}
 
-func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
-	statement, err := driver.db.PrepareContext(driver.ctx, selectQueuedSessionsIteratorWhere("state = 'queued'", 20))
+		return pkgerrors.Errorf(storage.ErrConflict, "session %s is placed on agent %s", session.Id, placedOn.String)
+	}
 	if err != nil {
-		return nil, err
+		return errors.Join(err, tx.Rollback())
 	}
 
-	return newIterator(driver.ctx, statement, unmarshalQueuedSession)
-}
-
-func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error {
-	_, err := driver.db.ExecContext(driver.ctx, "UPDATE agents SET state = 'missing', updated_at = now() WHERE state = 'active' AND updated_at <= now()-make_interval(secs=>$1)", duration.Seconds())
-	return err
-}
+	vramRequired := storage.TotalVramRequired(requirements)
+	if session.CpuFallback {
+		vramRequired = 0
+	}
+
+	_, err = tx.ExecContext(driver.ctx, "UPDATE agents SET vram_available = vram_available - $1, updated_at = now() WHERE id = $2", vramRequired, agentId)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	_, err = tx.ExecContext(driver.ctx, `UPDATE sessions SET agent_id = $1, state = $2, exit_status = $3, address = $4,
+			gpus = $5, cpu_fallback = $6, vram_required = $7, claimed = true, updated_at = now() WHERE id = $8`,
+		agentId, session.State, restapi.ExitStatusUnknown, address, gpusData, session.CpuFallback, storage.TotalVramRequired(requirements), session.Id)
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+
+	return tx.Commit()
+}
+
+func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
+	return unmarshalSession(driver.reader.QueryRowContext(driver.ctx, selectSessionsWhere("id = $1"), id))
+}
+
+func (driver *storageDriver) ClaimSession(id string) error {
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE sessions SET claimed = true WHERE id = $1 AND NOT claimed", id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		// Either already claimed or missing
+		var exists bool
+		err = driver.db.QueryRowContext(driver.ctx, "SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1)", id).Scan(&exists)
+		if err == nil && !exists {
+			err = storage.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+func (driver *storageDriver) ReleaseSession(id string, release restapi.SessionRelease) error {
+	releaseData, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+
+	var exitStatus *string
+	if release.ExitStatus != "" {
+		exitStatus = &release.ExitStatus
+	}
+
+	// See storage.ReconcileExitStatus, persistent sessions outlive the client
+	result, err := driver.db.ExecContext(driver.ctx, `UPDATE sessions SET release = $1, updated_at = now(),
+			state = CASE
+				WHEN state = 'queued' THEN 'closed'::session_state
+				WHEN state IN ('assigned', 'active') AND NOT persistent THEN 'canceling'::session_state
+				ELSE state
+			END,
+			exit_status = CASE
+				WHEN state = 'queued' THEN 'canceled'::session_exit_status
+				WHEN state = 'closed' AND exit_status != 'failure' THEN COALESCE($2::session_exit_status, exit_status)
+				ELSE exit_status
+			END
+		WHERE id = $3`, releaseData, exitStatus, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) CancelSession(id string) error {
+	result, err := driver.db.ExecContext(driver.ctx, `UPDATE sessions SET
+			state = CASE
+				WHEN state = 'queued' THEN 'closed'::session_state
+				WHEN state IN ('assigned', 'active') THEN 'canceling'::session_state
+				ELSE state
+			END,
+			exit_status = CASE
+				WHEN state = 'queued' THEN 'canceled'::session_exit_status
+				ELSE exit_status
+			END,
+			preempted = false,
+			updated_at = CASE
+				WHEN state IN ('queued', 'assigned', 'active') THEN now()
+				ELSE updated_at
+			END
+		WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) PreemptSession(id string) error {
+	result, err := driver.db.ExecContext(driver.ctx, `UPDATE sessions SET
+			state = CASE
+				WHEN state IN ('assigned', 'active') THEN 'canceling'::session_state
+				ELSE state
+			END,
+			preempted = state IN ('assigned', 'active') OR preempted,
+			updated_at = CASE
+				WHEN state IN ('assigned', 'active') THEN now()
+				ELSE updated_at
+			END
+		WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) SetSessionPreemptible(id string, preemptible bool) error {
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE sessions SET preemptible = $1, updated_at = now() WHERE id = $2", preemptible, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) UpdateSessionFrames(id string, frames restapi.FrameMetrics) error {
+	framesData, err := json.Marshal(frames)
+	if err != nil {
+		return err
+	}
+
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE sessions SET frames = $1, updated_at = now() WHERE id = $2", framesData, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	return driver.unmarshalQueuedSession(driver.reader.QueryRowContext(driver.ctx, selectQueuedSessionsWhere("id = $1"), id))
+}
+
+func (driver *storageDriver) GetAgents() (storage.Iterator[restapi.Agent], error) {
+	statement, err := driver.reader.PrepareContext(driver.ctx, selectAgentsIterator(20))
+	if err != nil {
+		return nil, err
+	}
+
+	return newIterator(driver.ctx, statement, unmarshalAgent)
+}
+
+func (driver *storageDriver) GetAvailableAgentsMatching(gpuVramAvailableAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+	statement, err := driver.reader.PrepareContext(driver.ctx, selectAgentsIteratorWhere(
+		fmt.Sprint("state = 'active' AND vram_available >= ", gpuVramAvailableAtLeast), 20))
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := newIterator(driver.ctx, statement, unmarshalAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	// The VRAM of each GPU is only known from the agent's sessions
+	var agents []restapi.Agent
+	for iterator.Next() {
+		if storage.GpuAvailable(iterator.Value(), gpuVramAvailableAtLeast) {
+			agents = append(agents, iterator.Value())
+		}
+	}
+
+	return storage.NewDefaultIterator(agents), nil
+}
+
+func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	statement, err := driver.reader.PrepareContext(driver.ctx, selectQueuedSessionsIteratorWhere("state = 'queued'", 20))
+	if err != nil {
+		return nil, err
+	}
+
+	return newIterator(driver.ctx, statement, driver.unmarshalQueuedSession)
+}
+
+func (driver *storageDriver) GetSessionsClosedWithin(duration time.Duration) (storage.Iterator[storage.ClosedSession], error) {
+	rows, err := driver.reader.QueryContext(driver.ctx, `SELECT id, exit_status, requirements, EXTRACT(EPOCH FROM now() - updated_at) FROM sessions
+		WHERE state = 'closed' AND updated_at >= now()-make_interval(secs=>$1)`, duration.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := driver.clock.Now()
+
+	sessions := make([]storage.ClosedSession, 0)
+	for rows.Next() {
+		var session storage.ClosedSession
+		var requirements []byte
+		var age float64
+
+		err = rows.Scan(&session.Id, &session.ExitStatus, &requirements, &age)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(requirements, &session.Requirements)
+		if err != nil {
+			return nil, err
+		}
+
+		session.ClosedAt = now.Add(-time.Duration(age * float64(time.Second)))
+		sessions = append(sessions, session)
+	}
+
+	return storage.NewDefaultIterator(sessions), rows.Err()
+}
+
+func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) ([]string, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, "UPDATE agents SET state = 'missing', updated_at = now() WHERE state = 'active' AND updated_at <= now()-make_interval(secs=>$1) RETURNING id", duration.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	agentIds := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		agentIds = append(agentIds, id)
+	}
+
+	return agentIds, rows.Err()
+}
 
 func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
 	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM agents WHERE state = 'missing' AND updated_at <= now()-make_interval(secs=>$1)", duration.Seconds())
 	return err
 }
+
+func (driver *storageDriver) CancelUnclaimedSessionsOlderThan(duration time.Duration) (int, error) {
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	queued, err := tx.ExecContext(driver.ctx, `UPDATE sessions SET state = $1, exit_status = $2, updated_at = now()
+		WHERE state = 'queued' AND NOT claimed AND GREATEST(created_at, COALESCE((requirements->'reservation'->>'startAt')::timestamptz, created_at)) <= now()-make_interval(secs=>$3)`,
+		restapi.SessionClosed, restapi.ExitStatusCanceled, duration.Seconds())
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	// Assigned sessions are canceled by their agent which then reports them closed
+	assigned, err := tx.ExecContext(driver.ctx, `UPDATE sessions SET state = $1, updated_at = now()
+		WHERE state IN ('assigned', 'active') AND NOT claimed AND GREATEST(created_at, COALESCE((requirements->'reservation'->>'startAt')::timestamptz, created_at)) <= now()-make_interval(secs=>$2)`,
+		restapi.SessionCanceling, duration.Seconds())
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	queuedCount, err := queued.RowsAffected()
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	assignedCount, err := assigned.RowsAffected()
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	return int(queuedCount + assignedCount), tx.Commit()
+}
+
+func (driver *storageDriver) ImportExpectedAgents(agents []restapi.ExpectedAgent) error {
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, agent := range agents {
+		gpus, err := json.Marshal(agent.Gpus)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		labels, err := json.Marshal(agent.Labels)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		taints, err := json.Marshal(agent.Taints)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		token, err := driver.sealSecret(agent.Token)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+
+		_, err = tx.ExecContext(driver.ctx, `INSERT INTO expected_agents (
+				id, hostname, pool, gpus, labels, taints, token, updated_at
+			) VALUES (
+				COALESCE(NULLIF($1, '')::uuid, uuid_generate_v4()), $2, $3, $4, $5, $6, $7, now()
+			) ON CONFLICT (hostname) DO UPDATE SET
+				pool = EXCLUDED.pool, gpus = EXCLUDED.gpus, labels = EXCLUDED.labels,
+				taints = EXCLUDED.taints, token = EXCLUDED.token, updated_at = now()`,
+			agent.Id, agent.Hostname, agent.Pool, gpus, labels, taints, token)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+
+	return tx.Commit()
+}
+
+const selectExpectedAgents = "SELECT id, hostname, pool, gpus, labels, taints, token FROM expected_agents"
+
+func (driver *storageDriver) unmarshalExpectedAgent(row sqlRow) (restapi.ExpectedAgent, error) {
+	var agent restapi.ExpectedAgent
+	var gpus, labels, taints []byte
+
+	err := row.Scan(&agent.Id, &agent.Hostname, &agent.Pool, &gpus, &labels, &taints, &agent.Token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+
+		return restapi.ExpectedAgent{}, err
+	}
+
+	err = errors.Join(
+		json.Unmarshal(gpus, &agent.Gpus),
+		json.Unmarshal(labels, &agent.Labels),
+		json.Unmarshal(taints, &agent.Taints),
+	)
+	if err != nil {
+		return restapi.ExpectedAgent{}, err
+	}
+
+	agent.Token, err = driver.openSecret(agent.Token)
+	if err != nil {
+		return restapi.ExpectedAgent{}, err
+	}
+
+	return agent, nil
+}
+
+func (driver *storageDriver) GetExpectedAgentByHostname(hostname string) (restapi.ExpectedAgent, error) {
+	return driver.unmarshalExpectedAgent(driver.reader.QueryRowContext(driver.ctx, fmt.Sprint(selectExpectedAgents, " WHERE hostname = $1"), hostname))
+}
+
+func (driver *storageDriver) GetExpectedAgents() (storage.Iterator[restapi.ExpectedAgent], error) {
+	statement, err := driver.reader.PrepareContext(driver.ctx, fmt.Sprint(selectExpectedAgents, orderBy, offsetLimit, 20))
+	if err != nil {
+		return nil, err
+	}
+
+	return newIterator(driver.ctx, statement, driver.unmarshalExpectedAgent)
+}
+
+func (driver *storageDriver) RevokeCredential(revocation restapi.Revocation) error {
+	_, err := driver.db.ExecContext(driver.ctx, `INSERT INTO revocations (kind, subject, reason, evict_sessions, revoked_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (kind, subject) DO UPDATE SET reason = EXCLUDED.reason, evict_sessions = EXCLUDED.evict_sessions, revoked_at = EXCLUDED.revoked_at`,
+		revocation.Kind, revocation.Subject, revocation.Reason, revocation.EvictSessions, revocation.RevokedAt)
+	return err
+}
+
+func (driver *storageDriver) RemoveRevocation(kind string, subject string) error {
+	result, err := driver.db.ExecContext(driver.ctx, "DELETE FROM revocations WHERE kind = $1 AND subject = $2", kind, subject)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = storage.ErrNotFound
+	}
+
+	return err
+}
+
+func (driver *storageDriver) GetRevocations() ([]restapi.Revocation, error) {
+	rows, err := driver.reader.QueryContext(driver.ctx, "SELECT kind, subject, reason, evict_sessions, revoked_at FROM revocations ORDER BY kind ASC, subject ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := []restapi.Revocation{}
+	for rows.Next() {
+		var revocation restapi.Revocation
+		err = rows.Scan(&revocation.Kind, &revocation.Subject, &revocation.Reason, &revocation.EvictSessions, &revocation.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		revocations = append(revocations, revocation)
+	}
+
+	return revocations, rows.Err()
+}
+
+func (driver *storageDriver) CreateApiToken(token restapi.ApiToken, hash string) error {
+	var expiresAt sql.NullTime
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: token.ExpiresAt, Valid: true}
+	}
+
+	result, err := driver.db.ExecContext(driver.ctx, `INSERT INTO api_tokens (id, name, "user", hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name) DO NOTHING`,
+		token.Id, token.Name, token.User, hash, token.CreatedAt, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err == nil && count == 0 {
+		err = pkgerrors.Errorf(storage.ErrConflict, "a token named %s exists", token.Name)
+	}
+
+	return err
+}
+
+func unmarshalApiToken(row sqlRow) (restapi.ApiToken, error) {
+	var token restapi.ApiToken
+	var expiresAt sql.NullTime
+	err := row.Scan(&token.Id, &token.Name, &token.User, &token.CreatedAt, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+
+		return restapi.ApiToken{}, err
+	}
+
+	if expiresAt.Valid {
+		token.ExpiresAt = expiresAt.Time
+	}
+
+	return token, nil
+}
+
+func (driver *storageDriver) GetApiTokenByHash(hash string) (restapi.ApiToken, error) {
+	row := driver.reader.QueryRowContext(driver.ctx, `SELECT id, name, "user", created_at, expires_at FROM api_tokens WHERE hash = $1`, hash)
+	return unmarshalApiToken(row)
+}
+
+func (driver *storageDriver) GetApiTokens() ([]restapi.ApiToken, error) {
+	rows, err := driver.reader.QueryContext(driver.ctx, `SELECT id, name, "user", created_at, expires_at FROM api_tokens ORDER BY name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []restapi.ApiToken{}
+	for rows.Next() {
+		token, err := unmarshalApiToken(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (driver *storageDriver) DeleteApiToken(id string) (restapi.ApiToken, error) {
+	row := driver.db.QueryRowContext(driver.ctx, `DELETE FROM api_tokens WHERE id = $1 RETURNING id, name, "user", created_at, expires_at`, id)
+	return unmarshalApiToken(row)
+}
+
+// Leases expire against the database's clock so the replicas sharing it agree on when they do
+func (driver *storageDriver) AcquireLease(name string, holder string, duration time.Duration) (restapi.Lease, error) {
+	_, err := driver.db.ExecContext(driver.ctx, `INSERT INTO leases (name, holder, acquired_at, expires_at) VALUES ($1, $2, now(), now()+make_interval(secs=>$3))
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at,
+			acquired_at = CASE WHEN leases.holder = EXCLUDED.holder THEN leases.acquired_at ELSE EXCLUDED.acquired_at END
+		WHERE leases.holder = EXCLUDED.holder OR leases.expires_at <= now()`,
+		name, holder, duration.Seconds())
+	if err != nil {
+		return restapi.Lease{}, err
+	}
+
+	lease := restapi.Lease{Name: name}
+	err = driver.db.QueryRowContext(driver.ctx, "SELECT holder, acquired_at, expires_at FROM leases WHERE name = $1", name).
+		Scan(&lease.Holder, &lease.AcquiredAt, &lease.ExpiresAt)
+	if err != nil {
+		return restapi.Lease{}, err
+	}
+
+	return lease, nil
+}
+
+func (driver *storageDriver) ReleaseLease(name string, holder string) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM leases WHERE name = $1 AND holder = $2", name, holder)
+	return err
+}
+
+// Reads from the primary, a replica behind it could report a replica no longer holding the lease
+func (driver *storageDriver) GetLease(name string) (restapi.Lease, error) {
+	lease := restapi.Lease{Name: name}
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT holder, acquired_at, expires_at FROM leases WHERE name = $1 AND expires_at > now()", name).
+		Scan(&lease.Holder, &lease.AcquiredAt, &lease.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = storage.ErrNotFound
+		}
+
+		return restapi.Lease{}, err
+	}
+
+	return lease, nil
+}
+
+func (driver *storageDriver) SetPoolPaused(pool string, paused bool) error {
+	var err error
+	if paused {
+		_, err = driver.db.ExecContext(driver.ctx, "INSERT INTO paused_pools (pool) VALUES ($1) ON CONFLICT (pool) DO NOTHING", pool)
+	} else {
+		_, err = driver.db.ExecContext(driver.ctx, "DELETE FROM paused_pools WHERE pool = $1", pool)
+	}
+	return err
+}
+
+// Reads from the primary so the leader pauses a pool paused through another replica on its next reload
+func (driver *storageDriver) GetPausedPools() ([]string, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, "SELECT pool FROM paused_pools ORDER BY pool")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pools := []string{}
+	for rows.Next() {
+		var pool string
+		err = rows.Scan(&pool)
+		if err != nil {
+			return nil, err
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, rows.Err()
+}
+
+func (driver *storageDriver) SetFeatureOverride(override storage.FeatureOverride) error {
+	_, err := driver.db.ExecContext(driver.ctx, "INSERT INTO feature_overrides (name, enabled) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled",
+		override.Name, override.Enabled)
+	return err
+}
+
+func (driver *storageDriver) GetFeatureOverrides() ([]storage.FeatureOverride, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, "SELECT name, enabled FROM feature_overrides ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []storage.FeatureOverride{}
+	for rows.Next() {
+		var override storage.FeatureOverride
+		err = rows.Scan(&override.Name, &override.Enabled)
+		if err != nil {
+			return nil, err
+		}
+
+		overrides = append(overrides, override)
+	}
+
+	return overrides, rows.Err()
+}
+
+func (driver *storageDriver) PutConfigResource(resource restapi.ConfigResource) error {
+	resource, err := storage.TransformConfigResourceSecrets(resource, driver.sealSecret)
+	if err != nil {
+		return err
+	}
+
+	_, err = driver.db.ExecContext(driver.ctx, "INSERT INTO config_resources (kind, name, spec, updated_at) VALUES ($1, $2, $3, $4) ON CONFLICT (kind, name) DO UPDATE SET spec = EXCLUDED.spec, updated_at = EXCLUDED.updated_at",
+		resource.Kind, resource.Name, string(resource.Spec), resource.UpdatedAt)
+	return err
+}
+
+// Reads from the primary so the resources applied through another replica apply on its next reload
+func (driver *storageDriver) GetConfigResources(kind string) ([]restapi.ConfigResource, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, "SELECT name, spec, updated_at FROM config_resources WHERE kind = $1 ORDER BY name", kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resources := []restapi.ConfigResource{}
+	for rows.Next() {
+		resource := restapi.ConfigResource{
+			Kind: kind,
+		}
+
+		var spec []byte
+		err = rows.Scan(&resource.Name, &spec, &resource.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		resource.Spec = spec
+		resource.UpdatedAt = resource.UpdatedAt.UTC()
+
+		resource, err = storage.TransformConfigResourceSecrets(resource, driver.openSecret)
+		if err != nil {
+			return nil, err
+		}
+
+		resources = append(resources, resource)
+	}
+
+	return resources, rows.Err()
+}
+
+func (driver *storageDriver) DeleteConfigResource(kind string, name string) error {
+	result, err := driver.db.ExecContext(driver.ctx, "DELETE FROM config_resources WHERE kind = $1 AND name = $2", kind, name)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+func (driver *storageDriver) RotateSecrets() (int, error) {
+	if driver.keyring == nil {
+		return 0, nil
+	}
+
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+
+	type secret struct {
+		id    string
+		value string
+	}
+
+	// Read before they are updated, a transaction runs one statement at a time
+	read := func(query string) ([]secret, error) {
+		rows, err := tx.QueryContext(driver.ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		secrets := []secret{}
+		for rows.Next() {
+			var secret secret
+			err = rows.Scan(&secret.id, &secret.value)
+			if err != nil {
+				return nil, err
+			}
+
+			secrets = append(secrets, secret)
+		}
+
+		return secrets, rows.Err()
+	}
+
+	tokens, err := read("SELECT hostname, token FROM expected_agents WHERE token <> '' FOR UPDATE")
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	for _, token := range tokens {
+		count := rotated
+		value, err := driver.rotateSecret(token.value, &rotated)
+		if err == nil && rotated > count {
+			_, err = tx.ExecContext(driver.ctx, "UPDATE expected_agents SET token = $1 WHERE hostname = $2", value, token.id)
+		}
+		if err != nil {
+			return 0, errors.Join(fmt.Errorf("expected agent %s, %w", token.id, err), tx.Rollback())
+		}
+	}
+
+	specs, err := read(fmt.Sprintf("SELECT name, spec FROM config_resources WHERE kind = '%s' FOR UPDATE", restapi.ConfigWebhook))
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	for _, spec := range specs {
+		count := rotated
+		resource, err := storage.TransformConfigResourceSecrets(restapi.ConfigResource{
+			Kind: restapi.ConfigWebhook,
+			Name: spec.id,
+			Spec: json.RawMessage(spec.value),
+		}, func(secret string) (string, error) {
+			return driver.rotateSecret(secret, &rotated)
+		})
+		if err == nil && rotated > count {
+			_, err = tx.ExecContext(driver.ctx, "UPDATE config_resources SET spec = $1 WHERE kind = $2 AND name = $3", string(resource.Spec), resource.Kind, resource.Name)
+		}
+		if err != nil {
+			return 0, errors.Join(fmt.Errorf("%s %s, %w", restapi.ConfigWebhook, spec.id, err), tx.Rollback())
+		}
+	}
+
+	return rotated, tx.Commit()
+}
+
+func (driver *storageDriver) AppendEvent(event restapi.Event) (restapi.Event, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return restapi.Event{}, err
+	}
+
+	err = driver.db.QueryRowContext(driver.ctx, "INSERT INTO events (event) VALUES ($1) RETURNING sequence", data).Scan(&event.Sequence)
+	if err != nil {
+		return restapi.Event{}, err
+	}
+
+	return event, nil
+}
+
+// Reads from the primary, a replica behind it would skip the events it has not yet received
+// once the consumer continues from a later sequence
+func (driver *storageDriver) GetEventsSince(since uint64, limit int) ([]restapi.Event, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, "SELECT sequence, event FROM events WHERE sequence > $1 ORDER BY sequence ASC LIMIT $2", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []restapi.Event{}
+	for rows.Next() {
+		var sequence uint64
+		var data []byte
+
+		err = rows.Scan(&sequence, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		var event restapi.Event
+		err = json.Unmarshal(data, &event)
+		if err != nil {
+			return nil, err
+		}
+
+		event.Sequence = sequence
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// Serializes appending to the journal, a sequence is allocated when the row is inserted while it
+// becomes visible when the transaction commits. Without the lock a reader could see a later
+// sequence committed before an earlier one and follow past it.
+const journalLockId = 7_243_134
+
+func (driver *storageDriver) AppendJournalEntry(entry restapi.JournalEntry) (restapi.JournalEntry, error) {
+	entry.Sequence = 0
+	entry.Time = driver.clock.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return restapi.JournalEntry{}, err
+	}
+
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return restapi.JournalEntry{}, err
+	}
+
+	_, err = tx.ExecContext(driver.ctx, "SELECT pg_advisory_xact_lock($1)", journalLockId)
+	if err == nil {
+		err = tx.QueryRowContext(driver.ctx, "INSERT INTO journal (entry) VALUES ($1) RETURNING sequence", data).Scan(&entry.Sequence)
+	}
+	if err != nil {
+		return restapi.JournalEntry{}, errors.Join(err, tx.Rollback())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return restapi.JournalEntry{}, err
+	}
+
+	return entry, nil
+}
+
+func (driver *storageDriver) UpdateJournalEntry(entry restapi.JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	result, err := driver.db.ExecContext(driver.ctx, "UPDATE journal SET entry = $1 WHERE sequence = $2", data, entry.Sequence)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		err = storage.ErrNotFound
+	}
+	return err
+}
+
+// Reads from the primary for the same reason as GetEventsSince
+func (driver *storageDriver) GetJournalEntriesSince(since uint64, limit int) ([]restapi.JournalEntry, error) {
+	rows, err := driver.db.QueryContext(driver.ctx, "SELECT sequence, entry FROM journal WHERE sequence > $1 ORDER BY sequence ASC LIMIT $2", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []restapi.JournalEntry{}
+	for rows.Next() {
+		var sequence uint64
+		var data []byte
+
+		err = rows.Scan(&sequence, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry restapi.JournalEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Sequence = sequence
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (driver *storageDriver) GetJournalSequence() (uint64, error) {
+	// The sequence is kept once the entries are removed, is_called is false until the first
+	// entry is appended
+	var sequence uint64
+	var called bool
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT last_value, is_called FROM journal_sequence_seq").Scan(&sequence, &called)
+	if err != nil {
+		return 0, err
+	}
+	if !called {
+		return 0, nil
+	}
+
+	return sequence, nil
+}
+
+func (driver *storageDriver) RollUpUsageOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	if dryRun {
+		var count int
+		err := driver.db.QueryRowContext(driver.ctx, `SELECT count(*) FROM sessions
+			WHERE state = 'closed' AND NOT rolled_up AND updated_at <= now()-make_interval(secs=>$1)`, duration.Seconds()).Scan(&count)
+		return count, err
+	}
+
+	tx, err := driver.db.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(driver.ctx, `SELECT id, gpus, network, release, COALESCE(requirements->>'tenant', ''),
+		EXTRACT(EPOCH FROM now() - created_at), EXTRACT(EPOCH FROM now() - updated_at) FROM sessions
+		WHERE state = 'closed' AND NOT rolled_up AND updated_at <= now()-make_interval(secs=>$1) FOR UPDATE`, duration.Seconds())
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	now := driver.clock.Now()
+
+	ids := []string{}
+	aggregates := map[string]*restapi.UsageAggregate{}
+	for rows.Next() {
+		var session restapi.Session
+		var gpus, network, release []byte
+		var requestedAge, closedAge float64
+
+		err = rows.Scan(&session.Id, &gpus, &network, &release, &session.Tenant, &requestedAge, &closedAge)
+		if err == nil && gpus != nil {
+			err = json.Unmarshal(gpus, &session.Gpus)
+		}
+		if err == nil && network != nil {
+			err = json.Unmarshal(network, &session.Network)
+		}
+		if err == nil && release != nil {
+			err = json.Unmarshal(release, &session.Release)
+		}
+		if err != nil {
+			return 0, errors.Join(err, rows.Close(), tx.Rollback())
+		}
+
+		requestedAt := now.Add(-time.Duration(requestedAge * float64(time.Second)))
+		closedAt := now.Add(-time.Duration(closedAge * float64(time.Second)))
+
+		month := storage.UsageMonth(closedAt)
+		key := fmt.Sprint(month, "/", session.Tenant)
+		if _, found := aggregates[key]; !found {
+			aggregates[key] = &restapi.UsageAggregate{
+				Month:  month,
+				Tenant: session.Tenant,
+			}
+		}
+
+		storage.AddSessionUsage(aggregates[key], session, requestedAt, closedAt)
+		ids = append(ids, session.Id)
+	}
+
+	err = errors.Join(rows.Err(), rows.Close())
+	if err != nil {
+		return 0, errors.Join(err, tx.Rollback())
+	}
+
+	for _, aggregate := range aggregates {
+		_, err = tx.ExecContext(driver.ctx, `INSERT INTO usage_aggregates (month, tenant, sessions, session_seconds, gpu_seconds, bytes_sent, bytes_received)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (month, tenant) DO UPDATE SET
+				sessions = usage_aggregates.sessions + EXCLUDED.sessions,
+				session_seconds = usage_aggregates.session_seconds + EXCLUDED.session_seconds,
+				gpu_seconds = usage_aggregates.gpu_seconds + EXCLUDED.gpu_seconds,
+				bytes_sent = usage_aggregates.bytes_sent + EXCLUDED.bytes_sent,
+				bytes_received = usage_aggregates.bytes_received + EXCLUDED.bytes_received`,
+			aggregate.Month, aggregate.Tenant, aggregate.Sessions, aggregate.SessionSeconds, aggregate.GpuSeconds, aggregate.BytesSent, aggregate.BytesReceived)
+		if err != nil {
+			return 0, errors.Join(err, tx.Rollback())
+		}
+	}
+
+	if len(ids) > 0 {
+		_, err = tx.ExecContext(driver.ctx, "UPDATE sessions SET rolled_up = true WHERE id = ANY($1)", pq.Array(ids))
+		if err != nil {
+			return 0, errors.Join(err, tx.Rollback())
+		}
+	}
+
+	return len(ids), tx.Commit()
+}
+
+func (driver *storageDriver) GetUsageAggregates() ([]restapi.UsageAggregate, error) {
+	rows, err := driver.reader.QueryContext(driver.ctx, `SELECT month, tenant, sessions, session_seconds, gpu_seconds, bytes_sent, bytes_received
+		FROM usage_aggregates ORDER BY month ASC, tenant ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []restapi.UsageAggregate{}
+	for rows.Next() {
+		var aggregate restapi.UsageAggregate
+		err = rows.Scan(&aggregate.Month, &aggregate.Tenant, &aggregate.Sessions, &aggregate.SessionSeconds, &aggregate.GpuSeconds, &aggregate.BytesSent, &aggregate.BytesReceived)
+		if err != nil {
+			return nil, err
+		}
+
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates, rows.Err()
+}
+
+func (driver *storageDriver) RemoveClosedSessionsOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	if dryRun {
+		var count int
+		err := driver.db.QueryRowContext(driver.ctx, `SELECT count(*) FROM sessions
+			WHERE state = 'closed' AND updated_at <= now()-make_interval(secs=>$1)`, duration.Seconds()).Scan(&count)
+		return count, err
+	}
+
+	result, err := driver.db.ExecContext(driver.ctx, "DELETE FROM sessions WHERE state = 'closed' AND updated_at <= now()-make_interval(secs=>$1)", duration.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+func (driver *storageDriver) RemoveEventsOlderThan(duration time.Duration) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM events WHERE created_at <= now()-make_interval(secs=>$1)", duration.Seconds())
+	return err
+}
+
+func (driver *storageDriver) RemoveJournalEntriesOlderThan(duration time.Duration) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM journal WHERE created_at <= now()-make_interval(secs=>$1)", duration.Seconds())
+	return err
+}
+
+func (driver *storageDriver) PutJournalCursor(cursor storage.JournalCursor) error {
+	_, err := driver.db.ExecContext(driver.ctx, "INSERT INTO journal_cursors (name, sequence) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET sequence = EXCLUDED.sequence",
+		cursor.Name, cursor.Sequence)
+	return err
+}
+
+func (driver *storageDriver) GetJournalCursor(name string) (storage.JournalCursor, error) {
+	cursor := storage.JournalCursor{Name: name}
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT sequence FROM journal_cursors WHERE name = $1", name).Scan(&cursor.Sequence)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.JournalCursor{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return storage.JournalCursor{}, err
+	}
+
+	return cursor, nil
+}
+
+func (driver *storageDriver) DeleteJournalCursor(name string) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM journal_cursors WHERE name = $1", name)
+	return err
+}
+
+const agentsChangedChannel = "agents_changed"
+
+func (driver *storageDriver) WatchAgents(notify func(agentId string)) (func(), error) {
+	driver.notifications.mutex.Lock()
+	defer driver.notifications.mutex.Unlock()
+
+	if driver.notifications.listener == nil {
+		listener := pq.NewListener(driver.connection, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				logger.Warningf("agent notifications, %s", err.Error())
+			}
+		})
+
+		err := listener.Listen(agentsChangedChannel)
+		if err != nil {
+			return nil, errors.Join(err, listener.Close())
+		}
+
+		driver.notifications.listener = listener
+		go driver.listen(listener)
+	}
+
+	return driver.notifications.watchers.Watch(notify), nil
+}
+
+func (driver *storageDriver) listen(listener *pq.Listener) {
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-driver.ctx.Done():
+			return
+
+		case notification, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+
+			// A nil notification follows a reconnect, notifications may have been lost
+			if notification == nil {
+				driver.notifications.watchers.Notify("")
+			} else {
+				driver.notifications.watchers.Notify(notification.Extra)
+			}
+
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Accumulates the conditions of a query and their numbered arguments
+type conditions struct {
+	clauses []string
+	args    []any
+}
+
+// Adds the condition, formatted with the placeholders of the arguments
+func (c *conditions) add(format string, args ...any) {
+	placeholders := make([]any, 0, len(args))
+	for _, arg := range args {
+		c.args = append(c.args, arg)
+		placeholders = append(placeholders, fmt.Sprint("$", len(c.args)))
+	}
+
+	c.clauses = append(c.clauses, fmt.Sprintf(format, placeholders...))
+}
+
+// Adds a condition on the agents of the table, or the agent the session is placed on, having
+// every label
+func (c *conditions) addLabels(agentId string, labels map[string]string) {
+	for key, value := range labels {
+		c.add(`EXISTS (SELECT 1 FROM agent_labels JOIN key_values ON key_values.id = agent_labels.key_value_id
+			WHERE agent_labels.agent_id = `+agentId+` AND key_values.key = %s AND key_values.value = %s)`, key, value)
+	}
+}
+
+func (c *conditions) where() string {
+	if len(c.clauses) == 0 {
+		return " WHERE TRUE"
+	}
+
+	return fmt.Sprint(" WHERE ", strings.Join(c.clauses, " AND "))
+}
+
+func (driver *storageDriver) QueryAgents(query restapi.ListQuery) (storage.Page[restapi.Agent], error) {
+	return storage.ListPage(driver, query, func() ([]restapi.Agent, error) {
+		filters := &conditions{}
+		if query.State != "" {
+			filters.add("state = %s", query.State)
+		}
+
+		filters.addLabels("agents.id", query.Labels)
+
+		if query.GpuName != "" {
+			filters.add("gpus @> jsonb_build_array(jsonb_build_object('name', %s::text))", query.GpuName)
+		}
+
+		rows, err := driver.reader.QueryContext(driver.ctx, fmt.Sprint(selectAgents, filters.where(), " ORDER BY id"), filters.args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		agents := []restapi.Agent{}
+		for rows.Next() {
+			agent, err := unmarshalAgent(rows)
+			if err != nil {
+				return nil, err
+			}
+
+			agents = append(agents, agent)
+		}
+
+		return agents, rows.Err()
+	})
+}
+
+// Scans the agent a session is placed on from the columns following the session's
+type placedSessionRow struct {
+	row     sqlRow
+	session *restapi.PlacedSession
+}
+
+func (row placedSessionRow) Scan(dest ...any) error {
+	return row.row.Scan(append(dest, &row.session.AgentId, &row.session.Hostname)...)
+}
+
+func (driver *storageDriver) QuerySessions(query restapi.ListQuery) (storage.Page[restapi.PlacedSession], error) {
+	return storage.ListPage(driver, query, func() ([]restapi.PlacedSession, error) {
+		filters := &conditions{}
+		filters.add("agent_id IS NOT NULL AND state NOT IN ('queued', 'closed')")
+
+		if query.State != "" {
+			filters.add("state = %s", query.State)
+		}
+
+		filters.addLabels("sessions.agent_id", query.Labels)
+
+		if query.GpuName != "" {
+			// Sessions on the CPU rendering fallback use no GPU
+			filters.add(`CASE WHEN jsonb_typeof(sessions.gpus) = 'array' THEN EXISTS (
+				SELECT 1 FROM agents, jsonb_array_elements(agents.gpus) agent_gpu, jsonb_array_elements(sessions.gpus) session_gpu
+				WHERE agents.id = sessions.agent_id AND agent_gpu->>'index' = session_gpu->>'index' AND agent_gpu->>'name' = %s
+			) ELSE FALSE END`, query.GpuName)
+		}
+
+		selectPlacedSessions := strings.Replace(selectSessions, " FROM sessions",
+			", agent_id, ( SELECT hostname FROM agents WHERE agents.id = sessions.agent_id ) FROM sessions", 1)
+
+		rows, err := driver.reader.QueryContext(driver.ctx, fmt.Sprint(selectPlacedSessions, filters.where(), " ORDER BY id"), filters.args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		sessions := []restapi.PlacedSession{}
+		for rows.Next() {
+			var placed restapi.PlacedSession
+			placed.Session, err = unmarshalSession(placedSessionRow{rows, &placed})
+			if err != nil {
+				return nil, err
+			}
+
+			sessions = append(sessions, placed)
+		}
+
+		return sessions, rows.Err()
+	})
+}
+
+// Snapshots are written to and read from the primary, the following pages of a listing may be
+// read before a replica has the snapshot of its first page
+func (driver *storageDriver) PutListSnapshot(snapshot storage.ListSnapshot) error {
+	_, err := driver.db.ExecContext(driver.ctx, "DELETE FROM list_snapshots WHERE expires_at <= now()")
+	if err != nil {
+		return err
+	}
+
+	_, err = driver.db.ExecContext(driver.ctx, "INSERT INTO list_snapshots (id, items, expires_at) VALUES ($1, $2, now()+make_interval(secs=>$3))",
+		snapshot.Id, string(snapshot.Items), storage.ListSnapshotTtl.Seconds())
+	return err
+}
+
+func (driver *storageDriver) GetListSnapshot(id string) (storage.ListSnapshot, error) {
+	snapshot := storage.ListSnapshot{
+		Id: id,
+	}
+
+	var items []byte
+	err := driver.db.QueryRowContext(driver.ctx, "SELECT items FROM list_snapshots WHERE id = $1 AND expires_at > now()", id).Scan(&items)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.ListSnapshot{}, storage.ErrNotFound
+	} else if err != nil {
+		return storage.ListSnapshot{}, err
+	}
+
+	snapshot.Items = items
+	return snapshot, nil
+}
@@ -0,0 +1,8 @@
+-- juice:compatible
+create table events (
+    sequence bigserial PRIMARY KEY,
+    event jsonb NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+create index on events (created_at);
@@ -0,0 +1,2 @@
+-- juice:compatible
+alter table sessions add column log_excerpt text;
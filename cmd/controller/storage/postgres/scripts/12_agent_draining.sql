@@ -0,0 +1,9 @@
+-- juice:compatible
+alter table agents add column draining boolean NOT NULL DEFAULT false;
+
+-- Draining changes the placement of sessions
+create trigger agents_draining_changed
+    after update of draining on agents
+    for each row
+    when (OLD.draining IS DISTINCT FROM NEW.draining)
+    execute function notify_agent_changed();
@@ -0,0 +1,17 @@
+-- juice:compatible
+alter table sessions add column rolled_up boolean NOT NULL DEFAULT false;
+
+create index on sessions (state, updated_at);
+
+-- The usage of closed sessions by the month they closed in and their tenant, kept once the
+-- sessions are removed
+create table usage_aggregates (
+    month text NOT NULL,
+    tenant text NOT NULL,
+    sessions bigint NOT NULL,
+    session_seconds double precision NOT NULL,
+    gpu_seconds double precision NOT NULL,
+    bytes_sent bigint NOT NULL,
+    bytes_received bigint NOT NULL,
+    PRIMARY KEY (month, tenant)
+);
@@ -0,0 +1,10 @@
+-- juice:compatible
+-- Credentials whose requests the controllers reject, see restapi.Revocation
+create table revocations (
+    kind text NOT NULL,
+    subject text NOT NULL,
+    reason text NOT NULL,
+    evict_sessions boolean NOT NULL,
+    revoked_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (kind, subject)
+);
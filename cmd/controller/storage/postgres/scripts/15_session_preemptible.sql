@@ -0,0 +1,9 @@
+-- juice:compatible
+alter table sessions add column preemptible boolean NOT NULL DEFAULT false;
+
+-- Preemptible sessions are reclaimed from the agent they are placed on
+create trigger sessions_preemptible_changed
+    after update of preemptible on sessions
+    for each row
+    when (NEW.agent_id IS NOT NULL AND OLD.preemptible IS DISTINCT FROM NEW.preemptible)
+    execute function notify_agent_changed();
@@ -0,0 +1,3 @@
+-- juice:compatible
+alter table agents add column capabilities jsonb NOT NULL DEFAULT '[]';
+alter table agents add column rootless boolean NOT NULL DEFAULT false;
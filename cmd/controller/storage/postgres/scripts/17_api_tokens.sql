@@ -0,0 +1,10 @@
+-- juice:compatible
+-- Tokens minted for clients, see restapi.ApiToken. Only the hash of each token is stored
+create table api_tokens (
+    id uuid PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    "user" text NOT NULL,
+    hash text NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP
+);
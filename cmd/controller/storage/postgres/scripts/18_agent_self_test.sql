@@ -0,0 +1,2 @@
+-- juice:compatible
+alter table agents add column self_test jsonb;
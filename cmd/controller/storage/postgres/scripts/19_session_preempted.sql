@@ -0,0 +1,9 @@
+-- juice:compatible
+alter table sessions add column preempted boolean NOT NULL DEFAULT false;
+
+-- Preempted sessions are canceled by the agent they are placed on
+create trigger sessions_preempted_changed
+    after update of preempted on sessions
+    for each row
+    when (NEW.agent_id IS NOT NULL AND OLD.preempted IS DISTINCT FROM NEW.preempted)
+    execute function notify_agent_changed();
@@ -18,7 +18,7 @@ create type session_exit_status as enum (
     'canceled'
 );
 
-create extension "uuid-ossp";
+create extension if not exists "uuid-ossp";
 
 create table agents (
     id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -0,0 +1,8 @@
+-- juice:compatible
+-- Held by one controller replica at a time, see restapi.Lease
+create table leases (
+    name text PRIMARY KEY,
+    holder text NOT NULL,
+    acquired_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,10 @@
+-- juice:compatible
+-- Shared by the controller replicas, see scheduling.Pools and features.Set
+create table paused_pools (
+    pool text PRIMARY KEY
+);
+
+create table feature_overrides (
+    name text PRIMARY KEY,
+    enabled BOOLEAN NOT NULL
+);
@@ -0,0 +1,9 @@
+-- juice:compatible
+-- The items matched by the first page of listings, see storage.ListPage
+create table list_snapshots (
+    id uuid PRIMARY KEY,
+    items jsonb NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+create index list_snapshots_expires_at on list_snapshots (expires_at);
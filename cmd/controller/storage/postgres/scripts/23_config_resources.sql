@@ -0,0 +1,9 @@
+-- juice:compatible
+-- Shared by the controller replicas, see restapi.ConfigResource
+create table config_resources (
+    kind text NOT NULL,
+    name text NOT NULL,
+    spec jsonb NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (kind, name)
+);
@@ -0,0 +1,9 @@
+-- juice:compatible
+-- Written ahead of the changes to the storage, see restapi.JournalEntry
+create table journal (
+    sequence bigserial PRIMARY KEY,
+    entry jsonb NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+create index on journal (created_at);
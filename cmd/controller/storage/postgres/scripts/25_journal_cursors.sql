@@ -0,0 +1,6 @@
+-- juice:compatible
+-- How far the consumers of the journal followed it, see storage.JournalCursor
+create table journal_cursors (
+    name text PRIMARY KEY,
+    sequence bigint NOT NULL
+);
@@ -0,0 +1,4 @@
+-- juice:compatible
+alter table agents add column cpu_fallback_capacity integer NOT NULL DEFAULT 0;
+
+alter table sessions add column cpu_fallback boolean NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+-- juice:compatible
+alter table sessions add column claimed boolean NOT NULL DEFAULT false;
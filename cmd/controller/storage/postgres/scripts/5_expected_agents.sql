@@ -0,0 +1,14 @@
+-- juice:compatible
+create table expected_agents (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    hostname text NOT NULL,
+    pool text NOT NULL,
+    gpus jsonb NOT NULL,
+    labels jsonb NOT NULL,
+    taints jsonb NOT NULL,
+    token text NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP
+);
+
+create unique index on expected_agents (hostname);
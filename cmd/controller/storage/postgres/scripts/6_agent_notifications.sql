@@ -0,0 +1,41 @@
+-- juice:compatible
+create function notify_agent_changed() returns trigger as $$
+begin
+    if TG_TABLE_NAME = 'sessions' then
+        perform pg_notify('agents_changed', NEW.agent_id::text);
+    elsif TG_OP = 'DELETE' then
+        perform pg_notify('agents_changed', OLD.id::text);
+    elsif TG_TABLE_NAME = 'agents' then
+        perform pg_notify('agents_changed', NEW.id::text);
+    else
+        perform pg_notify('agents_changed', NEW.agent_id::text);
+    end if;
+    return null;
+end;
+$$ language plpgsql;
+
+create trigger agents_changed_insert_delete
+    after insert or delete on agents
+    for each row execute function notify_agent_changed();
+
+-- Updates to the GPU metrics alone do not change the placement of sessions
+create trigger agents_changed_update
+    after update of state, vram_available on agents
+    for each row
+    when (OLD.state IS DISTINCT FROM NEW.state OR OLD.vram_available IS DISTINCT FROM NEW.vram_available)
+    execute function notify_agent_changed();
+
+create trigger agent_labels_changed
+    after insert on agent_labels
+    for each row execute function notify_agent_changed();
+
+create trigger agent_taints_changed
+    after insert on agent_taints
+    for each row execute function notify_agent_changed();
+
+-- CPU fallback sessions are only reflected in the sessions of the agent
+create trigger sessions_changed
+    after update of agent_id, state on sessions
+    for each row
+    when (NEW.agent_id IS NOT NULL AND (OLD.agent_id IS DISTINCT FROM NEW.agent_id OR (NEW.state = 'closed' AND OLD.state != 'closed')))
+    execute function notify_agent_changed();
@@ -0,0 +1,2 @@
+-- juice:compatible
+alter table sessions add column release jsonb;
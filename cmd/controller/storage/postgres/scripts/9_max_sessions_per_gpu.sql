@@ -0,0 +1,2 @@
+-- juice:compatible
+alter table agents add column max_sessions_per_gpu integer NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+drop trigger agents_draining_changed on agents;
+alter table agents drop column draining;
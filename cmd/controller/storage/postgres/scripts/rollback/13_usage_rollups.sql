@@ -0,0 +1,3 @@
+drop table usage_aggregates;
+drop index sessions_state_updated_at_idx;
+alter table sessions drop column rolled_up;
@@ -0,0 +1,2 @@
+drop trigger sessions_preemptible_changed on sessions;
+alter table sessions drop column preemptible;
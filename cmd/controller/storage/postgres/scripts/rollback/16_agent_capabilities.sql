@@ -0,0 +1,2 @@
+alter table agents drop column rootless;
+alter table agents drop column capabilities;
@@ -0,0 +1 @@
+alter table agents drop column self_test;
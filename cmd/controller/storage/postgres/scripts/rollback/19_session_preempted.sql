@@ -0,0 +1,2 @@
+drop trigger sessions_preempted_changed on sessions;
+alter table sessions drop column preempted;
@@ -0,0 +1,11 @@
+drop table session_tolerates;
+drop table session_match_labels;
+drop table agent_taints;
+drop table agent_labels;
+drop table key_values;
+drop table sessions;
+drop table agents;
+
+drop type session_exit_status;
+drop type session_state;
+drop type agent_state;
@@ -0,0 +1 @@
+drop table list_snapshots;
@@ -0,0 +1 @@
+drop table config_resources;
@@ -0,0 +1,3 @@
+alter table sessions drop column cpu_fallback;
+
+alter table agents drop column cpu_fallback_capacity;
@@ -0,0 +1 @@
+drop table expected_agents;
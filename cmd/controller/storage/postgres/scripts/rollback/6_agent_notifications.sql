@@ -0,0 +1,7 @@
+drop trigger sessions_changed on sessions;
+drop trigger agent_taints_changed on agent_taints;
+drop trigger agent_labels_changed on agent_labels;
+drop trigger agents_changed_update on agents;
+drop trigger agents_changed_insert_delete on agents;
+
+drop function notify_agent_changed();
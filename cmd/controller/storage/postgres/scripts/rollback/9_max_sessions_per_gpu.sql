@@ -0,0 +1 @@
+alter table agents drop column max_sessions_per_gpu;
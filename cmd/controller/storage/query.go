@@ -0,0 +1,196 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Snapshots of listings expire this long after the first page was listed, see restapi.ListQuery.Cursor
+const ListSnapshotTtl = 10 * time.Minute
+
+// A page of the results of a restapi.ListQuery
+type Page[T any] struct {
+	Items []T
+	// The number of results across every page
+	Total int
+	// Whether results follow the page
+	More bool
+	// The snapshot the following pages are read from, see ListPage
+	Snapshot string
+}
+
+// Returns the page of items selected by the query's offset and limit
+func Paginate[T any](items []T, query restapi.ListQuery) Page[T] {
+	page := Page[T]{
+		Items: []T{},
+		Total: len(items),
+	}
+
+	if query.Offset >= len(items) {
+		return page
+	}
+
+	items = items[query.Offset:]
+	if query.Limit > 0 && query.Limit < len(items) {
+		items = items[:query.Limit]
+		page.More = true
+	}
+
+	page.Items = append(page.Items, items...)
+	return page
+}
+
+// Returns the page of the items matching the query, those matching returns. The items matching
+// the first page of a listing with more pages are recorded in a snapshot, which the following
+// pages, listed with the query's Snapshot, are read from rather than the current items, so that
+// the pages of a listing are consistent as the items change.
+func ListPage[T any](db Storage, query restapi.ListQuery, matching func() ([]T, error)) (Page[T], error) {
+	if query.Snapshot != "" {
+		snapshot, err := db.GetListSnapshot(query.Snapshot)
+		if errors.Is(err, ErrNotFound) {
+			return Page[T]{}, pkgerrors.Errorf(ErrNotFound, "the listing expired %s after its first page, list again from the first page", ListSnapshotTtl)
+		} else if err != nil {
+			return Page[T]{}, err
+		}
+
+		var items []T
+		err = json.Unmarshal(snapshot.Items, &items)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		page := Paginate(items, query)
+		page.Snapshot = snapshot.Id
+		return page, nil
+	}
+
+	items, err := matching()
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	page := Paginate(items, query)
+	if page.More {
+		data, err := json.Marshal(items)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		snapshot := ListSnapshot{
+			Id:    uuid.NewString(),
+			Items: data,
+		}
+
+		err = db.PutListSnapshot(snapshot)
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		page.Snapshot = snapshot.Id
+	}
+
+	return page, nil
+}
+
+func hasLabels(agent restapi.Agent, labels map[string]string) bool {
+	for key, value := range labels {
+		if agentValue, present := agent.Labels[key]; !present || agentValue != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasGpuNamed(gpus []restapi.Gpu, name string) bool {
+	for _, gpu := range gpus {
+		if gpu.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns whether the agent matches the query's filters
+func AgentMatches(agent restapi.Agent, query restapi.ListQuery) bool {
+	return (query.State == "" || agent.State == query.State) &&
+		hasLabels(agent, query.Labels) &&
+		(query.GpuName == "" || hasGpuNamed(agent.Gpus, query.GpuName))
+}
+
+// Returns the sessions placed on the agent matching the query's filters
+func PlacedSessionsMatching(agent restapi.Agent, query restapi.ListQuery) []restapi.PlacedSession {
+	if !hasLabels(agent, query.Labels) {
+		return nil
+	}
+
+	sessions := []restapi.PlacedSession{}
+	for _, session := range agent.Sessions {
+		if query.State != "" && session.State != query.State {
+			continue
+		}
+
+		if query.GpuName != "" {
+			gpus := []restapi.Gpu{}
+			for _, sessionGpu := range session.Gpus {
+				if sessionGpu.Index >= 0 && sessionGpu.Index < len(agent.Gpus) {
+					gpus = append(gpus, agent.Gpus[sessionGpu.Index])
+				}
+			}
+
+			if !hasGpuNamed(gpus, query.GpuName) {
+				continue
+			}
+		}
+
+		sessions = append(sessions, restapi.PlacedSession{
+			Session:  session,
+			AgentId:  agent.Id,
+			Hostname: agent.Hostname,
+		})
+	}
+
+	return sessions
+}
+
+// Returns the agents matching the query ordered by id, for drivers filtering agents in memory
+func MatchingAgents(agents []restapi.Agent, query restapi.ListQuery) []restapi.Agent {
+	matching := []restapi.Agent{}
+	for _, agent := range agents {
+		if AgentMatches(agent, query) {
+			matching = append(matching, agent)
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Id < matching[j].Id
+	})
+
+	return matching
+}
+
+// Returns the sessions placed on the agents matching the query ordered by id, for drivers
+// filtering sessions in memory
+func MatchingSessions(agents []restapi.Agent, query restapi.ListQuery) []restapi.PlacedSession {
+	matching := []restapi.PlacedSession{}
+	for _, agent := range agents {
+		matching = append(matching, PlacedSessionsMatching(agent, query)...)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Id < matching[j].Id
+	})
+
+	return matching
+}
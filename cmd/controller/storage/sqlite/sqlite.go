@@ -0,0 +1,1933 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+type Agent struct {
+	restapi.Agent
+
+	SessionIds    []string `json:"sessionIds"`
+	VramAvailable uint64   `json:"vramAvailable"`
+
+	LastUpdated int64 `json:"lastUpdated"`
+}
+
+// A storage.ListSnapshot with when it expires
+type ListSnapshot struct {
+	storage.ListSnapshot
+
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type Session struct {
+	restapi.Session
+
+	AgentId      string                      `json:"agentId"`
+	Requirements restapi.SessionRequirements `json:"requirements"`
+	VramRequired uint64                      `json:"vramRequired"`
+	RequestedAt  time.Time                   `json:"requestedAt"`
+	Claimed      bool                        `json:"claimed"`
+
+	// Whether the session was added to the usage aggregates, see RollUpUsageOlderThan
+	RolledUp bool `json:"rolledUp,omitempty"`
+
+	LastUpdated int64 `json:"lastUpdated"`
+}
+
+// A token minted for clients, by the hash of the token
+type ApiToken struct {
+	restapi.ApiToken
+
+	Hash string `json:"hash"`
+}
+
+var (
+	agents = &table[Agent]{
+		name: "agents",
+		id:   func(agent Agent) string { return agent.Id },
+		indexes: map[string]index[Agent]{
+			"state":        textIndex(func(agent Agent) string { return agent.State }),
+			"last_updated": integerIndex(func(agent Agent) int64 { return agent.LastUpdated }),
+		},
+	}
+
+	sessions = &table[Session]{
+		name: "sessions",
+		id:   func(session Session) string { return session.Id },
+		indexes: map[string]index[Session]{
+			"state":        textIndex(func(session Session) string { return session.State }),
+			"last_updated": integerIndex(func(session Session) int64 { return session.LastUpdated }),
+		},
+	}
+
+	// Keyed by month and tenant
+	usage = &table[restapi.UsageAggregate]{
+		name: "usage",
+		id: func(aggregate restapi.UsageAggregate) string {
+			return fmt.Sprint(aggregate.Month, "/", aggregate.Tenant)
+		},
+	}
+
+	// Keyed by kind and subject
+	revocations = &table[restapi.Revocation]{
+		name: "revocations",
+		id: func(revocation restapi.Revocation) string {
+			return revocationId(revocation.Kind, revocation.Subject)
+		},
+	}
+
+	// Keyed by name
+	leases = &table[restapi.Lease]{
+		name: "leases",
+		id:   func(lease restapi.Lease) string { return lease.Name },
+	}
+
+	listSnapshots = &table[ListSnapshot]{
+		name: "list_snapshots",
+		id:   func(snapshot ListSnapshot) string { return snapshot.Id },
+		indexes: map[string]index[ListSnapshot]{
+			"expires_at": integerIndex(func(snapshot ListSnapshot) int64 { return snapshot.ExpiresAt.Unix() }),
+		},
+	}
+
+	pausedPools = &table[storage.PausedPool]{
+		name: "paused_pools",
+		id:   func(pool storage.PausedPool) string { return pool.Pool },
+	}
+
+	featureOverrides = &table[storage.FeatureOverride]{
+		name: "feature_overrides",
+		id:   func(override storage.FeatureOverride) string { return override.Name },
+	}
+
+	journalCursors = &table[storage.JournalCursor]{
+		name: "journal_cursors",
+		id:   func(cursor storage.JournalCursor) string { return cursor.Name },
+	}
+
+	// Keyed by kind and name
+	configResources = &table[restapi.ConfigResource]{
+		name: "config_resources",
+		id: func(resource restapi.ConfigResource) string {
+			return configResourceId(resource.Kind, resource.Name)
+		},
+		indexes: map[string]index[restapi.ConfigResource]{
+			"kind": textIndex(func(resource restapi.ConfigResource) string { return resource.Kind }),
+		},
+	}
+
+	apiTokens = &table[ApiToken]{
+		name: "api_tokens",
+		id:   func(token ApiToken) string { return token.Id },
+		indexes: map[string]index[ApiToken]{
+			"name": uniqueTextIndex(func(token ApiToken) string { return token.Name }),
+			"hash": uniqueTextIndex(func(token ApiToken) string { return token.Hash }),
+		},
+	}
+
+	expectedAgents = &table[restapi.ExpectedAgent]{
+		name: "expected_agents",
+		id:   func(agent restapi.ExpectedAgent) string { return agent.Id },
+		indexes: map[string]index[restapi.ExpectedAgent]{
+			"hostname": uniqueTextIndex(func(agent restapi.ExpectedAgent) string { return agent.Hostname }),
+		},
+	}
+)
+
+// Events are kept apart from the tables, AUTOINCREMENT never reuses the sequence of an event
+// once it is removed. Events are removed by the time they were published.
+const createEvents = `CREATE TABLE IF NOT EXISTS events (
+	sequence INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_time ON events (time)`
+
+// The journal is kept the same way as the events
+const createJournal = `CREATE TABLE IF NOT EXISTS journal (
+	sequence INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS journal_time ON journal (time)`
+
+type storageDriver struct {
+	ctx   context.Context
+	clock clock.Clock
+
+	// Writes go through a single connection as SQLite allows one writer at a time, while WAL
+	// mode lets reads proceed on the other connections as it commits
+	writer *sql.DB
+	reader *sql.DB
+
+	// Encrypts the tokens of expected agents at rest, nil when encryption is disabled
+	keyring *crypto.Keyring
+
+	watchers storage.AgentWatchers
+}
+
+// Returns the data source of the database file at path for the modernc.org/sqlite driver with
+// the pragmas every connection is opened with
+func dataSource(path string, pragmas ...string) string {
+	values := url.Values{}
+	for _, pragma := range pragmas {
+		values.Add("_pragma", pragma)
+	}
+
+	return fmt.Sprint("file:", path, "?", values.Encode())
+}
+
+// Opens the database file at path in WAL mode, creating it when it does not exist. The file is
+// only opened by one controller at a time, controllers sharing it are not notified of each
+// other's changes.
+func OpenStorage(ctx context.Context, path string, keyring *crypto.Keyring) (storage.Storage, error) {
+	pragmas := []string{"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(NORMAL)"}
+
+	writer, err := sql.Open("sqlite", dataSource(path, pragmas...))
+	if err != nil {
+		return nil, err
+	}
+	writer.SetMaxOpenConns(1)
+
+	reader, err := sql.Open("sqlite", dataSource(path, append(pragmas, "query_only(1)")...))
+	if err != nil {
+		return nil, errors.Join(err, writer.Close())
+	}
+
+	driver := &storageDriver{
+		ctx:     ctx,
+		clock:   clock.FromContext(ctx),
+		writer:  writer,
+		reader:  reader,
+		keyring: keyring,
+	}
+
+	err = driver.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(createEvents)
+		_, err_ := tx.Exec(createJournal)
+		return errors.Join(err, err_, agents.create(tx), sessions.create(tx), usage.create(tx), expectedAgents.create(tx), revocations.create(tx), apiTokens.create(tx), leases.create(tx), listSnapshots.create(tx), pausedPools.create(tx), featureOverrides.create(tx), configResources.create(tx), journalCursors.create(tx))
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to open %s, %w", path, err), driver.Close())
+	}
+
+	return driver, nil
+}
+
+// Runs change within a write transaction, committed when change succeeds
+func (driver *storageDriver) update(change func(tx *sql.Tx) error) error {
+	tx, err := driver.writer.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = change(tx)
+	if err != nil {
+		// The error is returned as is for callers comparing it, such as with storage.ErrNotFound
+		err_ := tx.Rollback()
+		if err_ != nil {
+			return errors.Join(err, err_)
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Runs read within a transaction so it reads a consistent snapshot
+func (driver *storageDriver) view(read func(tx *sql.Tx) error) error {
+	tx, err := driver.reader.BeginTx(driver.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = read(tx)
+	err_ := tx.Rollback()
+	if err_ != nil {
+		return errors.Join(err, err_)
+	}
+
+	return err
+}
+
+func (driver *storageDriver) Close() error {
+	return errors.Join(driver.reader.Close(), driver.writer.Close())
+}
+
+// Reads are served by the only copy of the database and are never stale
+func (driver *storageDriver) StaleReads() storage.Storage {
+	return driver
+}
+
+// Encrypts a secret-bearing value before it is written
+func (driver *storageDriver) sealSecret(value string) (string, error) {
+	if driver.keyring == nil || value == "" {
+		return value, nil
+	}
+
+	return driver.keyring.Encrypt(value)
+}
+
+// Re-encrypts a secret-bearing value with the primary key, counting it when it was not
+func (driver *storageDriver) rotateSecret(value string, rotated *int) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	value, changed, err := driver.keyring.Rotate(value)
+	if changed {
+		*rotated++
+	}
+	return value, err
+}
+
+// Decrypts a secret-bearing value after it is read
+func (driver *storageDriver) openSecret(value string) (string, error) {
+	if driver.keyring == nil {
+		if crypto.IsEncrypted(value) {
+			return "", errors.New("value is encrypted, --storage-encryption-key-file is required")
+		}
+
+		return value, nil
+	}
+
+	return driver.keyring.Decrypt(value)
+}
+
+func (driver *storageDriver) AggregateData() (storage.AggregatedData, error) {
+	var apiAgents []restapi.Agent
+	err := driver.view(func(tx *sql.Tx) error {
+		records, err := agents.all(tx)
+		for _, agent := range records {
+			apiAgents = append(apiAgents, agent.Agent)
+		}
+		return err
+	})
+	if err != nil {
+		return storage.AggregatedData{}, err
+	}
+
+	return storage.Aggregate(apiAgents), nil
+}
+
+func (driver *storageDriver) RegisterAgent(apiAgent restapi.Agent) (string, error) {
+	agent := Agent{
+		Agent:         apiAgent,
+		VramAvailable: storage.TotalVram(apiAgent.Gpus),
+		LastUpdated:   driver.clock.Now().Unix(),
+	}
+
+	// Only presented to adopt an expected agent's identity, never stored
+	agent.JoinToken = ""
+
+	if agent.Id == "" {
+		agent.Id = uuid.NewString()
+	}
+
+	err := driver.update(func(tx *sql.Tx) error {
+		// The agent may be adopting an existing identity, replace its previous registration
+		err := deleteAgent(tx, agent.Id)
+		if err != nil {
+			return err
+		}
+
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	driver.watchers.Notify(agent.Id)
+	return agent.Id, nil
+}
+
+func deleteAgent(tx *sql.Tx, id string) error {
+	agent, found, err := agents.get(tx, id)
+	if err != nil || !found {
+		return err
+	}
+
+	for _, sessionId := range agent.SessionIds {
+		err = sessions.delete(tx, sessionId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return agents.delete(tx, id)
+}
+
+func (driver *storageDriver) GetAgentById(id string) (restapi.Agent, error) {
+	var agent Agent
+	err := driver.view(func(tx *sql.Tx) error {
+		var found bool
+		var err error
+		agent, found, err = agents.get(tx, id)
+		if err == nil && !found {
+			err = storage.ErrNotFound
+		}
+		return err
+	})
+
+	return agent.Agent, err
+}
+
+func (driver *storageDriver) UpdateAgent(update restapi.AgentUpdate) error {
+	now := driver.clock.Now().Unix()
+
+	var notify bool
+	err := driver.update(func(tx *sql.Tx) error {
+		agent, found, err := agents.get(tx, update.Id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		previousState := agent.State
+		previousSessions := len(agent.SessionIds)
+		agent.State = update.State
+		agent.LastUpdated = now
+
+		if agent.State == restapi.AgentClosed {
+			notify = true
+			return deleteAgent(tx, agent.Id)
+		}
+
+		sessionIds := make([]string, 0, len(agent.SessionIds))
+		agentSessions := make([]restapi.Session, 0, len(agent.Sessions))
+
+		for index, sessionId := range agent.SessionIds {
+			sessionUpdate, present := update.Sessions[sessionId]
+			if !present {
+				sessionIds = append(sessionIds, sessionId)
+				agentSessions = append(agentSessions, agent.Sessions[index])
+				continue
+			}
+
+			session, found, err := sessions.get(tx, sessionId)
+			if err != nil {
+				return err
+			}
+
+			if !found {
+				continue
+			}
+
+			if sessionUpdate.State != "" {
+				session.State = sessionUpdate.State
+			}
+			if sessionUpdate.ExitStatus != "" {
+				session.ExitStatus = storage.ReconcileExitStatus(sessionUpdate.ExitStatus, session.Release)
+			}
+			if sessionUpdate.Network != nil {
+				session.Network = sessionUpdate.Network
+			}
+			if sessionUpdate.LogExcerpt != "" {
+				session.LogExcerpt = sessionUpdate.LogExcerpt
+			}
+			session.LastUpdated = now
+
+			if session.State == restapi.SessionClosed {
+				if !session.CpuFallback {
+					agent.VramAvailable += session.VramRequired
+				}
+
+				if session.Preempted {
+					requeueSession(&session)
+				}
+			} else {
+				sessionIds = append(sessionIds, sessionId)
+				agentSessions = append(agentSessions, session.Session)
+			}
+
+			err = sessions.put(tx, session)
+			if err != nil {
+				return err
+			}
+		}
+
+		for index, gpuMetrics := range update.Gpus {
+			if index < len(agent.Gpus) {
+				agent.Gpus[index].Metrics = gpuMetrics
+			}
+		}
+
+		agent.SessionIds = sessionIds
+		agent.Sessions = agentSessions
+
+		// Metrics alone do not change the placement of sessions
+		notify = agent.State != previousState || len(agent.SessionIds) != previousSessions
+
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return err
+	}
+
+	if notify {
+		driver.watchers.Notify(update.Id)
+	}
+	return nil
+}
+
+func (driver *storageDriver) SetAgentDraining(id string, draining bool) error {
+	err := driver.update(func(tx *sql.Tx) error {
+		agent, found, err := agents.get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		agent.Draining = draining
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return err
+	}
+
+	driver.watchers.Notify(id)
+	return nil
+}
+
+func (driver *storageDriver) SetAgentLabels(id string, labels map[string]string) error {
+	err := driver.update(func(tx *sql.Tx) error {
+		agent, found, err := agents.get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		agent.Labels = labels
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return err
+	}
+
+	driver.watchers.Notify(id)
+	return nil
+}
+
+func (driver *storageDriver) PatchAgentLabels(id string, patch restapi.AgentLabelsPatch) error {
+	err := driver.update(func(tx *sql.Tx) error {
+		agent, found, err := agents.get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		agent.Labels = storage.PatchLabels(agent.Labels, patch.Labels, patch.RemoveLabels)
+		agent.Taints = storage.PatchLabels(agent.Taints, patch.Taints, patch.RemoveTaints)
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return err
+	}
+
+	driver.watchers.Notify(id)
+	return nil
+}
+
+func (driver *storageDriver) RequestSession(requirements restapi.SessionRequirements) (string, error) {
+	session := Session{
+		Session: restapi.Session{
+			Id:          uuid.NewString(),
+			Version:     requirements.Version,
+			State:       restapi.SessionQueued,
+			Tenant:      requirements.Tenant,
+			User:        requirements.User,
+			DelegatedBy: requirements.DelegatedBy,
+			TokenName:   requirements.TokenName,
+
+			IdleTimeoutSeconds: requirements.IdleTimeoutSeconds,
+			Class:              requirements.Class,
+			MetricsPort:        requirements.MetricsPort,
+			Record:             requirements.Record,
+			Reservation:        requirements.Reservation,
+			Priority:           requirements.Priority,
+		},
+		Requirements: requirements,
+		VramRequired: storage.TotalVramRequired(requirements),
+		RequestedAt:  driver.clock.Now(),
+		LastUpdated:  driver.clock.Now().Unix(),
+	}
+
+	err := driver.update(func(tx *sql.Tx) error {
+		return sessions.put(tx, session)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return session.Id, nil
+}
+
+func (driver *storageDriver) AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu, cpuFallback bool) error {
+	now := driver.clock.Now().Unix()
+
+	err := driver.update(func(tx *sql.Tx) error {
+		agent, found, err := agents.get(tx, agentId)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		session, found, err := sessions.get(tx, sessionId)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		session.State = restapi.SessionAssigned
+		session.ExitStatus = restapi.ExitStatusUnknown
+		session.AgentId = agentId
+		session.Address = agent.Address
+		session.Gpus = gpus
+		session.CpuFallback = cpuFallback
+		// Shared GPUs may allocate the session more VRAM than it requires
+		session.VramRequired = storage.AllocatedVram(gpus)
+		session.LastUpdated = now
+
+		err = sessions.put(tx, session)
+		if err != nil {
+			return err
+		}
+
+		agent.Sessions = append(agent.Sessions, session.Session)
+		agent.SessionIds = append(agent.SessionIds, sessionId)
+		if !session.CpuFallback {
+			agent.VramAvailable -= session.VramRequired
+		}
+		agent.LastUpdated = now
+
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return err
+	}
+
+	driver.watchers.Notify(agentId)
+	return nil
+}
+
+func (driver *storageDriver) AdoptSession(agentId string, apiSession restapi.Session) error {
+	now := driver.clock.Now()
+
+	var adopted bool
+	err := driver.update(func(tx *sql.Tx) error {
+		agent, found, err := agents.get(tx, agentId)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		requirements := storage.AdoptedRequirements(apiSession)
+
+		session, found, err := sessions.get(tx, apiSession.Id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			session = Session{
+				Session: restapi.Session{
+					Id:         apiSession.Id,
+					Version:    apiSession.Version,
+					Persistent: apiSession.Persistent,
+					Tenant:     apiSession.Tenant,
+				},
+				Requirements: requirements,
+				RequestedAt:  now,
+			}
+		} else if session.State != restapi.SessionClosed && session.AgentId != "" {
+			if session.AgentId == agentId {
+				// Already placed on the agent
+				return nil
+			}
+
+			return pkgerrors.Errorf(storage.ErrConflict, "session %s is placed on agent %s", session.Id, session.AgentId)
+		}
+
+		session.State = apiSession.State
+		session.ExitStatus = restapi.ExitStatusUnknown
+		session.AgentId = agentId
+		session.Address = agent.Address
+		session.Gpus = apiSession.Gpus
+		session.CpuFallback = apiSession.CpuFallback
+		session.VramRequired = storage.TotalVramRequired(requirements)
+		session.Claimed = true
+		session.LastUpdated = now.Unix()
+
+		err = sessions.put(tx, session)
+		if err != nil {
+			return err
+		}
+
+		agent.Sessions = append(agent.Sessions, session.Session)
+		agent.SessionIds = append(agent.SessionIds, session.Id)
+		if !session.CpuFallback {
+			agent.VramAvailable -= session.VramRequired
+		}
+		agent.LastUpdated = now.Unix()
+
+		adopted = true
+		return agents.put(tx, agent)
+	})
+	if err != nil {
+		return err
+	}
+
+	if adopted {
+		driver.watchers.Notify(agentId)
+	}
+	return nil
+}
+
+func (driver *storageDriver) getSession(id string) (Session, error) {
+	var session Session
+	err := driver.view(func(tx *sql.Tx) error {
+		var found bool
+		var err error
+		session, found, err = sessions.get(tx, id)
+		if err == nil && !found {
+			err = storage.ErrNotFound
+		}
+		return err
+	})
+
+	return session, err
+}
+
+func (driver *storageDriver) GetSessionById(id string) (restapi.Session, error) {
+	session, err := driver.getSession(id)
+	return session.Session, err
+}
+
+// Reads the session, applies change, and writes the session back, returning storage.ErrNotFound
+// when there is no such session
+func updateSession(tx *sql.Tx, id string, change func(session *Session) error) error {
+	session, found, err := sessions.get(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return storage.ErrNotFound
+	}
+
+	err = change(&session)
+	if err != nil {
+		return err
+	}
+
+	return sessions.put(tx, session)
+}
+
+func (driver *storageDriver) ClaimSession(id string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return updateSession(tx, id, func(session *Session) error {
+			session.Claimed = true
+			return nil
+		})
+	})
+}
+
+// Updates the session within the agent structure
+func updateAgentSession(tx *sql.Tx, agentId string, sessionId string, change func(session *restapi.Session)) error {
+	agent, found, err := agents.get(tx, agentId)
+	if err != nil || !found {
+		return err
+	}
+
+	for index := range agent.Sessions {
+		if agent.Sessions[index].Id == sessionId {
+			change(&agent.Sessions[index])
+		}
+	}
+
+	return agents.put(tx, agent)
+}
+
+func (driver *storageDriver) ReleaseSession(id string, release restapi.SessionRelease) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return updateSession(tx, id, func(session *Session) error {
+			session.Release = &release
+			session.LastUpdated = driver.clock.Now().Unix()
+
+			switch session.State {
+			case restapi.SessionQueued:
+				session.State = restapi.SessionClosed
+				session.ExitStatus = restapi.ExitStatusCanceled
+
+			case restapi.SessionAssigned, restapi.SessionActive:
+				// Persistent sessions outlive the client, otherwise the agent cancels the session and reports it closed
+				if !session.Persistent {
+					session.State = restapi.SessionCanceling
+
+					return updateAgentSession(tx, session.AgentId, session.Id, func(agentSession *restapi.Session) {
+						agentSession.State = restapi.SessionCanceling
+					})
+				}
+
+			case restapi.SessionClosed:
+				session.ExitStatus = storage.ReconcileExitStatus(session.ExitStatus, session.Release)
+			}
+
+			return nil
+		})
+	})
+}
+
+func (driver *storageDriver) CancelSession(id string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return updateSession(tx, id, func(session *Session) error {
+			switch session.State {
+			case restapi.SessionQueued:
+				session.State = restapi.SessionClosed
+				session.ExitStatus = restapi.ExitStatusCanceled
+				session.LastUpdated = driver.clock.Now().Unix()
+
+			case restapi.SessionAssigned, restapi.SessionActive:
+				session.State = restapi.SessionCanceling
+				session.LastUpdated = driver.clock.Now().Unix()
+
+				return updateAgentSession(tx, session.AgentId, session.Id, func(agentSession *restapi.Session) {
+					agentSession.State = restapi.SessionCanceling
+				})
+
+			case restapi.SessionCanceling:
+				// Canceled by its requester while preempted, it closes rather than returns to the queue
+				session.Preempted = false
+			}
+
+			return nil
+		})
+	})
+}
+
+func (driver *storageDriver) PreemptSession(id string) error {
+	var agentId string
+	err := driver.update(func(tx *sql.Tx) error {
+		return updateSession(tx, id, func(session *Session) error {
+			if session.State != restapi.SessionAssigned && session.State != restapi.SessionActive {
+				return nil
+			}
+
+			session.State = restapi.SessionCanceling
+			session.Preempted = true
+			session.LastUpdated = driver.clock.Now().Unix()
+
+			agentId = session.AgentId
+			return updateAgentSession(tx, session.AgentId, session.Id, func(agentSession *restapi.Session) {
+				agentSession.State = restapi.SessionCanceling
+				agentSession.Preempted = true
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if agentId != "" {
+		driver.watchers.Notify(agentId)
+	}
+	return nil
+}
+
+// Returns the preempted session its agent closed to the queue, as it was before it was assigned
+func requeueSession(session *Session) {
+	session.State = restapi.SessionQueued
+	session.ExitStatus = ""
+	session.AgentId = ""
+	session.Address = ""
+	session.Gpus = nil
+	session.CpuFallback = false
+	session.Preemptible = false
+	session.Preempted = false
+	session.VramRequired = storage.TotalVramRequired(session.Requirements)
+}
+
+func (driver *storageDriver) SetSessionPreemptible(id string, preemptible bool) error {
+	var agentId string
+	err := driver.update(func(tx *sql.Tx) error {
+		return updateSession(tx, id, func(session *Session) error {
+			session.Preemptible = preemptible
+			session.LastUpdated = driver.clock.Now().Unix()
+
+			agentId = session.AgentId
+			if agentId == "" {
+				return nil
+			}
+
+			return updateAgentSession(tx, session.AgentId, session.Id, func(agentSession *restapi.Session) {
+				agentSession.Preemptible = preemptible
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if agentId != "" {
+		driver.watchers.Notify(agentId)
+	}
+	return nil
+}
+
+func (driver *storageDriver) UpdateSessionFrames(id string, frames restapi.FrameMetrics) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return updateSession(tx, id, func(session *Session) error {
+			session.Frames = &frames
+			session.LastUpdated = driver.clock.Now().Unix()
+
+			if session.AgentId == "" {
+				return nil
+			}
+
+			return updateAgentSession(tx, session.AgentId, session.Id, func(agentSession *restapi.Session) {
+				agentSession.Frames = &frames
+			})
+		})
+	})
+}
+
+func queuedSession(session Session) storage.QueuedSession {
+	return storage.QueuedSession{
+		Id:           session.Id,
+		Requirements: session.Requirements,
+		RequestedAt:  session.RequestedAt,
+	}
+}
+
+func (driver *storageDriver) GetQueuedSessionById(id string) (storage.QueuedSession, error) {
+	session, err := driver.getSession(id)
+	if err != nil {
+		return storage.QueuedSession{}, err
+	}
+
+	return queuedSession(session), nil
+}
+
+func (driver *storageDriver) GetAgents() (storage.Iterator[restapi.Agent], error) {
+	apiAgents, err := driver.allAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewDefaultIterator(apiAgents), nil
+}
+
+func (driver *storageDriver) allAgents() ([]restapi.Agent, error) {
+	apiAgents := []restapi.Agent{}
+	err := driver.view(func(tx *sql.Tx) error {
+		records, err := agents.all(tx)
+		for _, agent := range records {
+			apiAgents = append(apiAgents, agent.Agent)
+		}
+		return err
+	})
+
+	return apiAgents, err
+}
+
+func (driver *storageDriver) QueryAgents(query restapi.ListQuery) (storage.Page[restapi.Agent], error) {
+	return storage.ListPage(driver, query, func() ([]restapi.Agent, error) {
+		agents, err := driver.allAgents()
+		return storage.MatchingAgents(agents, query), err
+	})
+}
+
+func (driver *storageDriver) QuerySessions(query restapi.ListQuery) (storage.Page[restapi.PlacedSession], error) {
+	return storage.ListPage(driver, query, func() ([]restapi.PlacedSession, error) {
+		agents, err := driver.allAgents()
+		return storage.MatchingSessions(agents, query), err
+	})
+}
+
+func (driver *storageDriver) PutListSnapshot(snapshot storage.ListSnapshot) error {
+	now := driver.clock.Now()
+
+	return driver.update(func(tx *sql.Tx) error {
+		expired, err := listSnapshots.between(tx, "expires_at", nil, now.Unix())
+		if err != nil {
+			return err
+		}
+
+		for _, stored := range expired {
+			err = listSnapshots.delete(tx, stored.Id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return listSnapshots.put(tx, ListSnapshot{
+			ListSnapshot: snapshot,
+			ExpiresAt:    now.Add(storage.ListSnapshotTtl),
+		})
+	})
+}
+
+func (driver *storageDriver) GetListSnapshot(id string) (storage.ListSnapshot, error) {
+	var snapshot ListSnapshot
+	var found bool
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		snapshot, found, err = listSnapshots.get(tx, id)
+		return err
+	})
+	if err != nil {
+		return storage.ListSnapshot{}, err
+	}
+
+	if !found || !driver.clock.Now().Before(snapshot.ExpiresAt) {
+		return storage.ListSnapshot{}, storage.ErrNotFound
+	}
+
+	return snapshot.ListSnapshot, nil
+}
+func (driver *storageDriver) GetAvailableAgentsMatching(gpuVramAvailableAtLeast uint64) (storage.Iterator[restapi.Agent], error) {
+	var apiAgents []restapi.Agent
+	err := driver.view(func(tx *sql.Tx) error {
+		records, err := agents.lookup(tx, "state", restapi.AgentActive)
+		for _, agent := range records {
+			if agent.VramAvailable >= gpuVramAvailableAtLeast && storage.GpuAvailable(agent.Agent, gpuVramAvailableAtLeast) {
+				apiAgents = append(apiAgents, agent.Agent)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewDefaultIterator(apiAgents), nil
+}
+
+func (driver *storageDriver) GetQueuedSessionsIterator() (storage.Iterator[storage.QueuedSession], error) {
+	var queued []storage.QueuedSession
+	err := driver.view(func(tx *sql.Tx) error {
+		records, err := sessions.lookup(tx, "state", restapi.SessionQueued)
+		for _, session := range records {
+			queued = append(queued, queuedSession(session))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storage.SortQueuedSessions(queued)
+
+	return storage.NewDefaultIterator(queued), nil
+}
+
+func (driver *storageDriver) GetSessionsClosedWithin(duration time.Duration) (storage.Iterator[storage.ClosedSession], error) {
+	since := driver.clock.Now().Add(-duration).Unix()
+
+	var closed []storage.ClosedSession
+	err := driver.view(func(tx *sql.Tx) error {
+		records, err := sessions.between(tx, "last_updated", since, nil)
+		for _, session := range records {
+			if session.State == restapi.SessionClosed {
+				closed = append(closed, storage.ClosedSession{
+					Id:           session.Id,
+					ExitStatus:   session.ExitStatus,
+					Requirements: session.Requirements,
+					ClosedAt:     time.Unix(session.LastUpdated, 0),
+				})
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewDefaultIterator(closed), nil
+}
+
+func (driver *storageDriver) SetAgentsMissingIfNotUpdatedFor(duration time.Duration) ([]string, error) {
+	nowTime := driver.clock.Now()
+	now := nowTime.Unix()
+	since := nowTime.Add(-duration).Unix()
+
+	agentIds := []string{}
+	err := driver.update(func(tx *sql.Tx) error {
+		records, err := agents.between(tx, "last_updated", nil, since)
+		if err != nil {
+			return err
+		}
+
+		for _, agent := range records {
+			if agent.State != restapi.AgentActive {
+				continue
+			}
+
+			agent.State = restapi.AgentMissing
+			agent.LastUpdated = now
+
+			err = agents.put(tx, agent)
+			if err != nil {
+				return err
+			}
+
+			agentIds = append(agentIds, agent.Id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	driver.watchers.Notify(agentIds...)
+	return agentIds, nil
+}
+
+func (driver *storageDriver) RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error {
+	since := driver.clock.Now().Add(-duration).Unix()
+
+	agentIds := []string{}
+	err := driver.update(func(tx *sql.Tx) error {
+		records, err := agents.between(tx, "last_updated", nil, since)
+		if err != nil {
+			return err
+		}
+
+		for _, agent := range records {
+			if agent.State != restapi.AgentMissing {
+				continue
+			}
+
+			err = agents.delete(tx, agent.Id)
+			if err != nil {
+				return err
+			}
+
+			agentIds = append(agentIds, agent.Id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	driver.watchers.Notify(agentIds...)
+	return nil
+}
+
+func (driver *storageDriver) CancelUnclaimedSessionsOlderThan(duration time.Duration) (int, error) {
+	nowTime := driver.clock.Now()
+	now := nowTime.Unix()
+	before := nowTime.Add(-duration)
+
+	var canceled int
+	err := driver.update(func(tx *sql.Tx) error {
+		canceled = 0
+
+		for _, state := range []string{restapi.SessionQueued, restapi.SessionAssigned, restapi.SessionActive} {
+			records, err := sessions.lookup(tx, "state", state)
+			if err != nil {
+				return err
+			}
+
+			for _, session := range records {
+				if session.Claimed || !storage.UnclaimedSince(session.RequestedAt, session.Requirements).Before(before) {
+					continue
+				}
+
+				if session.State == restapi.SessionQueued {
+					session.State = restapi.SessionClosed
+					session.ExitStatus = restapi.ExitStatusCanceled
+				} else {
+					// Assigned sessions are canceled by their agent which then reports them closed
+					session.State = restapi.SessionCanceling
+
+					err = updateAgentSession(tx, session.AgentId, session.Id, func(agentSession *restapi.Session) {
+						agentSession.State = restapi.SessionCanceling
+					})
+					if err != nil {
+						return err
+					}
+				}
+				session.LastUpdated = now
+
+				err = sessions.put(tx, session)
+				if err != nil {
+					return err
+				}
+
+				canceled++
+			}
+		}
+
+		return nil
+	})
+
+	return canceled, err
+}
+
+func (driver *storageDriver) ImportExpectedAgents(imported []restapi.ExpectedAgent) error {
+	return driver.update(func(tx *sql.Tx) error {
+		for _, agent := range imported {
+			existing, found, err := expectedAgents.first(tx, "hostname", agent.Hostname)
+			if err != nil {
+				return err
+			}
+
+			if found {
+				agent.Id = existing.Id
+			} else if agent.Id == "" {
+				agent.Id = uuid.NewString()
+			}
+
+			agent.Token, err = driver.sealSecret(agent.Token)
+			if err != nil {
+				return err
+			}
+
+			err = expectedAgents.put(tx, agent)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (driver *storageDriver) GetExpectedAgentByHostname(hostname string) (restapi.ExpectedAgent, error) {
+	var agent restapi.ExpectedAgent
+	err := driver.view(func(tx *sql.Tx) error {
+		var found bool
+		var err error
+		agent, found, err = expectedAgents.first(tx, "hostname", hostname)
+		if err == nil && !found {
+			err = storage.ErrNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return restapi.ExpectedAgent{}, err
+	}
+
+	agent.Token, err = driver.openSecret(agent.Token)
+	return agent, err
+}
+
+func (driver *storageDriver) GetExpectedAgents() (storage.Iterator[restapi.ExpectedAgent], error) {
+	var records []restapi.ExpectedAgent
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		records, err = expectedAgents.all(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range records {
+		records[index].Token, err = driver.openSecret(records[index].Token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return storage.NewDefaultIterator(records), nil
+}
+
+func revocationId(kind string, subject string) string {
+	return fmt.Sprint(kind, "/", subject)
+}
+
+func (driver *storageDriver) RevokeCredential(revocation restapi.Revocation) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return revocations.put(tx, revocation)
+	})
+}
+
+func (driver *storageDriver) RemoveRevocation(kind string, subject string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		id := revocationId(kind, subject)
+		_, found, err := revocations.get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		return revocations.delete(tx, id)
+	})
+}
+
+func (driver *storageDriver) GetRevocations() ([]restapi.Revocation, error) {
+	var records []restapi.Revocation
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		records, err = revocations.all(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storage.SortRevocations(records)
+
+	return records, nil
+}
+
+func (driver *storageDriver) CreateApiToken(token restapi.ApiToken, hash string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		_, found, err := apiTokens.first(tx, "name", token.Name)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			return pkgerrors.Errorf(storage.ErrConflict, "a token named %s exists", token.Name)
+		}
+
+		token.Token = ""
+		return apiTokens.put(tx, ApiToken{
+			ApiToken: token,
+			Hash:     hash,
+		})
+	})
+}
+
+func (driver *storageDriver) GetApiTokenByHash(hash string) (restapi.ApiToken, error) {
+	var token ApiToken
+	var found bool
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		token, found, err = apiTokens.first(tx, "hash", hash)
+		return err
+	})
+	if err != nil {
+		return restapi.ApiToken{}, err
+	}
+
+	if !found {
+		return restapi.ApiToken{}, storage.ErrNotFound
+	}
+
+	return token.ApiToken, nil
+}
+
+func (driver *storageDriver) GetApiTokens() ([]restapi.ApiToken, error) {
+	var records []ApiToken
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		records, err = apiTokens.all(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]restapi.ApiToken, 0, len(records))
+	for _, record := range records {
+		tokens = append(tokens, record.ApiToken)
+	}
+
+	storage.SortApiTokens(tokens)
+
+	return tokens, nil
+}
+
+func (driver *storageDriver) DeleteApiToken(id string) (restapi.ApiToken, error) {
+	var token ApiToken
+	err := driver.update(func(tx *sql.Tx) error {
+		var found bool
+		var err error
+		token, found, err = apiTokens.get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		return apiTokens.delete(tx, id)
+	})
+
+	return token.ApiToken, err
+}
+
+// Leases expire against the controller's clock, the replicas sharing the database file run on
+// the same host
+func (driver *storageDriver) AcquireLease(name string, holder string, duration time.Duration) (restapi.Lease, error) {
+	var lease restapi.Lease
+	err := driver.update(func(tx *sql.Tx) error {
+		held, found, err := leases.get(tx, name)
+		if err != nil {
+			return err
+		}
+
+		var acquired bool
+		lease, acquired = storage.AcquireLease(held, found, name, holder, duration, driver.clock.Now())
+		if !acquired {
+			return nil
+		}
+
+		return leases.put(tx, lease)
+	})
+
+	return lease, err
+}
+
+func (driver *storageDriver) ReleaseLease(name string, holder string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		lease, found, err := leases.get(tx, name)
+		if err != nil || !found || lease.Holder != holder {
+			return err
+		}
+
+		return leases.delete(tx, name)
+	})
+}
+
+func (driver *storageDriver) GetLease(name string) (restapi.Lease, error) {
+	var lease restapi.Lease
+	var found bool
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		lease, found, err = leases.get(tx, name)
+		return err
+	})
+	if err != nil {
+		return restapi.Lease{}, err
+	}
+
+	if !found || !driver.clock.Now().Before(lease.ExpiresAt) {
+		return restapi.Lease{}, storage.ErrNotFound
+	}
+
+	return lease, nil
+}
+
+func (driver *storageDriver) SetPoolPaused(pool string, paused bool) error {
+	return driver.update(func(tx *sql.Tx) error {
+		if paused {
+			return pausedPools.put(tx, storage.PausedPool{Pool: pool})
+		}
+
+		return pausedPools.delete(tx, pool)
+	})
+}
+
+func (driver *storageDriver) GetPausedPools() ([]string, error) {
+	var records []storage.PausedPool
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		records, err = pausedPools.all(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make([]string, 0, len(records))
+	for _, record := range records {
+		pools = append(pools, record.Pool)
+	}
+
+	return pools, nil
+}
+
+func (driver *storageDriver) SetFeatureOverride(override storage.FeatureOverride) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return featureOverrides.put(tx, override)
+	})
+}
+
+func (driver *storageDriver) GetFeatureOverrides() ([]storage.FeatureOverride, error) {
+	var records []storage.FeatureOverride
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		records, err = featureOverrides.all(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func configResourceId(kind string, name string) string {
+	return fmt.Sprint(kind, "/", name)
+}
+
+func (driver *storageDriver) PutConfigResource(resource restapi.ConfigResource) error {
+	resource, err := storage.TransformConfigResourceSecrets(resource, driver.sealSecret)
+	if err != nil {
+		return err
+	}
+
+	return driver.update(func(tx *sql.Tx) error {
+		return configResources.put(tx, resource)
+	})
+}
+
+func (driver *storageDriver) GetConfigResources(kind string) ([]restapi.ConfigResource, error) {
+	var records []restapi.ConfigResource
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		records, err = configResources.lookup(tx, "kind", kind)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range records {
+		records[index], err = storage.TransformConfigResourceSecrets(records[index], driver.openSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	storage.SortConfigResources(records)
+
+	return records, nil
+}
+
+func (driver *storageDriver) DeleteConfigResource(kind string, name string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		id := configResourceId(kind, name)
+		_, found, err := configResources.get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+
+		return configResources.delete(tx, id)
+	})
+}
+
+// Events are stored without their sequence, which is the row's
+func (driver *storageDriver) RotateSecrets() (int, error) {
+	if driver.keyring == nil {
+		return 0, nil
+	}
+
+	rotated := 0
+	err := driver.update(func(tx *sql.Tx) error {
+		agents, err := expectedAgents.all(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, agent := range agents {
+			count := rotated
+			agent.Token, err = driver.rotateSecret(agent.Token, &rotated)
+			if err == nil && rotated > count {
+				err = expectedAgents.put(tx, agent)
+			}
+			if err != nil {
+				return fmt.Errorf("expected agent %s, %w", agent.Hostname, err)
+			}
+		}
+
+		resources, err := configResources.lookup(tx, "kind", restapi.ConfigWebhook)
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range resources {
+			count := rotated
+			resource, err = storage.TransformConfigResourceSecrets(resource, func(secret string) (string, error) {
+				return driver.rotateSecret(secret, &rotated)
+			})
+			if err == nil && rotated > count {
+				err = configResources.put(tx, resource)
+			}
+			if err != nil {
+				return fmt.Errorf("%s %s, %w", resource.Kind, resource.Name, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return rotated, nil
+}
+
+func (driver *storageDriver) AppendEvent(event restapi.Event) (restapi.Event, error) {
+	event.Sequence = 0
+	data, err := json.Marshal(event)
+	if err != nil {
+		return restapi.Event{}, err
+	}
+
+	err = driver.update(func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO events (time, data) VALUES (?, ?)", event.Time.UnixNano(), string(data))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := result.LastInsertId()
+		event.Sequence = uint64(sequence)
+		return err
+	})
+	if err != nil {
+		return restapi.Event{}, err
+	}
+
+	return event, nil
+}
+
+func (driver *storageDriver) GetEventsSince(since uint64, limit int) ([]restapi.Event, error) {
+	events := []restapi.Event{}
+	err := driver.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT sequence, data FROM events WHERE sequence > ? ORDER BY sequence LIMIT ?", int64(since), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sequence int64
+			var data []byte
+			err = rows.Scan(&sequence, &data)
+			if err != nil {
+				return err
+			}
+
+			var event restapi.Event
+			err = json.Unmarshal(data, &event)
+			if err != nil {
+				return err
+			}
+			event.Sequence = uint64(sequence)
+
+			events = append(events, event)
+		}
+
+		return rows.Err()
+	})
+
+	return events, err
+}
+
+func (driver *storageDriver) AppendJournalEntry(entry restapi.JournalEntry) (restapi.JournalEntry, error) {
+	entry.Sequence = 0
+	entry.Time = driver.clock.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return restapi.JournalEntry{}, err
+	}
+
+	err = driver.update(func(tx *sql.Tx) error {
+		result, err := tx.Exec("INSERT INTO journal (time, data) VALUES (?, ?)", entry.Time.UnixNano(), string(data))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := result.LastInsertId()
+		entry.Sequence = uint64(sequence)
+		return err
+	})
+	if err != nil {
+		return restapi.JournalEntry{}, err
+	}
+
+	return entry, nil
+}
+
+func (driver *storageDriver) UpdateJournalEntry(entry restapi.JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return driver.update(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE journal SET data = ? WHERE sequence = ?", string(data), int64(entry.Sequence))
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err == nil && updated == 0 {
+			err = storage.ErrNotFound
+		}
+		return err
+	})
+}
+
+func (driver *storageDriver) GetJournalEntriesSince(since uint64, limit int) ([]restapi.JournalEntry, error) {
+	entries := []restapi.JournalEntry{}
+	err := driver.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT sequence, data FROM journal WHERE sequence > ? ORDER BY sequence LIMIT ?", int64(since), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sequence int64
+			var data []byte
+			err = rows.Scan(&sequence, &data)
+			if err != nil {
+				return err
+			}
+
+			var entry restapi.JournalEntry
+			err = json.Unmarshal(data, &entry)
+			if err != nil {
+				return err
+			}
+			entry.Sequence = uint64(sequence)
+
+			entries = append(entries, entry)
+		}
+
+		return rows.Err()
+	})
+
+	return entries, err
+}
+
+func (driver *storageDriver) GetJournalSequence() (uint64, error) {
+	var sequence int64
+	err := driver.view(func(tx *sql.Tx) error {
+		// AUTOINCREMENT keeps the last sequence used in sqlite_sequence, even once the journal
+		// is emptied
+		err := tx.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'journal'").Scan(&sequence)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+
+	return uint64(sequence), err
+}
+
+func (driver *storageDriver) RemoveJournalEntriesOlderThan(duration time.Duration) error {
+	return driver.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM journal WHERE time <= ?", driver.clock.Now().Add(-duration).UnixNano())
+		return err
+	})
+}
+
+// Returns the sessions closed at least duration ago
+func (driver *storageDriver) closedSessionsOlderThan(tx *sql.Tx, duration time.Duration) ([]Session, error) {
+	before := driver.clock.Now().Add(-duration).Unix()
+
+	records, err := sessions.between(tx, "last_updated", nil, before)
+	if err != nil {
+		return nil, err
+	}
+
+	closed := []Session{}
+	for _, session := range records {
+		if session.State == restapi.SessionClosed {
+			closed = append(closed, session)
+		}
+	}
+
+	return closed, nil
+}
+
+func (driver *storageDriver) RollUpUsageOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	count := 0
+	rollUp := func(tx *sql.Tx) error {
+		closed, err := driver.closedSessionsOlderThan(tx, duration)
+		if err != nil {
+			return err
+		}
+
+		for _, session := range closed {
+			if session.RolledUp {
+				continue
+			}
+
+			count++
+			if dryRun {
+				continue
+			}
+
+			closedAt := time.Unix(session.LastUpdated, 0)
+			aggregate := restapi.UsageAggregate{
+				Month:  storage.UsageMonth(closedAt),
+				Tenant: session.Tenant,
+			}
+
+			previous, found, err := usage.get(tx, usage.id(aggregate))
+			if err != nil {
+				return err
+			}
+
+			if found {
+				aggregate = previous
+			}
+
+			storage.AddSessionUsage(&aggregate, session.Session, session.RequestedAt, closedAt)
+
+			session.RolledUp = true
+			err = errors.Join(usage.put(tx, aggregate), sessions.put(tx, session))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var err error
+	if dryRun {
+		err = driver.view(rollUp)
+	} else {
+		err = driver.update(rollUp)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (driver *storageDriver) GetUsageAggregates() ([]restapi.UsageAggregate, error) {
+	var aggregates []restapi.UsageAggregate
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		aggregates, err = usage.all(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storage.SortUsageAggregates(aggregates)
+
+	return aggregates, nil
+}
+
+func (driver *storageDriver) RemoveClosedSessionsOlderThan(duration time.Duration, dryRun bool) (int, error) {
+	count := 0
+	remove := func(tx *sql.Tx) error {
+		closed, err := driver.closedSessionsOlderThan(tx, duration)
+		if err != nil {
+			return err
+		}
+
+		count = len(closed)
+		if dryRun {
+			return nil
+		}
+
+		for _, session := range closed {
+			err = sessions.delete(tx, session.Id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var err error
+	if dryRun {
+		err = driver.view(remove)
+	} else {
+		err = driver.update(remove)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (driver *storageDriver) RemoveEventsOlderThan(duration time.Duration) error {
+	return driver.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM events WHERE time <= ?", driver.clock.Now().Add(-duration).UnixNano())
+		return err
+	})
+}
+
+func (driver *storageDriver) PutJournalCursor(cursor storage.JournalCursor) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return journalCursors.put(tx, cursor)
+	})
+}
+
+func (driver *storageDriver) GetJournalCursor(name string) (storage.JournalCursor, error) {
+	var cursor storage.JournalCursor
+	var found bool
+	err := driver.view(func(tx *sql.Tx) error {
+		var err error
+		cursor, found, err = journalCursors.get(tx, name)
+		return err
+	})
+	if err != nil {
+		return storage.JournalCursor{}, err
+	}
+	if !found {
+		return storage.JournalCursor{}, storage.ErrNotFound
+	}
+
+	return cursor, nil
+}
+
+func (driver *storageDriver) DeleteJournalCursor(name string) error {
+	return driver.update(func(tx *sql.Tx) error {
+		return journalCursors.delete(tx, name)
+	})
+}
+
+func (driver *storageDriver) WatchAgents(notify func(agentId string)) (func(), error) {
+	return driver.watchers.Watch(notify), nil
+}
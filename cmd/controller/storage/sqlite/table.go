@@ -0,0 +1,210 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A column of a table indexed for lookups, kept in step with the records
+type index[T any] struct {
+	// Declared type of the column, TEXT or INTEGER
+	sqlType string
+	unique  bool
+	value   func(T) any
+}
+
+// A table of JSON records keyed by id with the indexes of the matching memdb table, each
+// indexed value is stored in a column of its own beside the record
+type table[T any] struct {
+	name    string
+	id      func(T) string
+	indexes map[string]index[T]
+}
+
+// Returns the names of the indexed columns in a stable order
+func (table *table[T]) columns() []string {
+	columns := make([]string, 0, len(table.indexes))
+	for column := range table.indexes {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	return columns
+}
+
+func (table *table[T]) create(tx *sql.Tx) error {
+	definitions := []string{"id TEXT PRIMARY KEY"}
+	for _, column := range table.columns() {
+		definitions = append(definitions, fmt.Sprint(column, " ", table.indexes[column].sqlType, " NOT NULL"))
+	}
+	definitions = append(definitions, "data TEXT NOT NULL")
+
+	_, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table.name, strings.Join(definitions, ", ")))
+	if err != nil {
+		return err
+	}
+
+	for _, column := range table.columns() {
+		// Records sharing a value are ordered by id
+		statement := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %s (%s, id)", table.name, column, table.name, column)
+		if table.indexes[column].unique {
+			statement = fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_%s ON %s (%s)", table.name, column, table.name, column)
+		}
+
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decodes the records of rows selecting the data column, closing rows
+func scanRecords[T any](rows *sql.Rows) ([]T, error) {
+	defer rows.Close()
+
+	records := []T{}
+	for rows.Next() {
+		var data []byte
+		err := rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		var record T
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (table *table[T]) get(tx *sql.Tx, id string) (T, bool, error) {
+	var record T
+
+	var data []byte
+	err := tx.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE id = ?", table.name), id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, false, nil
+	} else if err != nil {
+		return record, false, err
+	}
+
+	err = json.Unmarshal(data, &record)
+	return record, err == nil, err
+}
+
+func (table *table[T]) put(tx *sql.Tx, record T) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	columns := append([]string{"id"}, table.columns()...)
+	columns = append(columns, "data")
+
+	values := []any{table.id(record)}
+	for _, column := range table.columns() {
+		values = append(values, table.indexes[column].value(record))
+	}
+	values = append(values, string(data))
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+
+	updates := make([]string, 0, len(columns)-1)
+	for _, column := range columns[1:] {
+		updates = append(updates, fmt.Sprint(column, " = excluded.", column))
+	}
+
+	// Conflicts on a unique index other than the id fail rather than replacing the other record
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (id) DO UPDATE SET %s",
+		table.name, strings.Join(columns, ", "), placeholders, strings.Join(updates, ", ")), values...)
+	return err
+}
+
+func (table *table[T]) delete(tx *sql.Tx, id string) error {
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", table.name), id)
+	return err
+}
+
+// Returns every record in order of id
+func (table *table[T]) all(tx *sql.Tx) ([]T, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT data FROM %s ORDER BY id", table.name))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanRecords[T](rows)
+}
+
+// Returns the records whose indexed value is between from and to inclusive, in order of the
+// indexed value. A nil bound is unbounded.
+func (table *table[T]) between(tx *sql.Tx, index string, from any, to any) ([]T, error) {
+	conditions := []string{"1"}
+	values := []any{}
+	if from != nil {
+		conditions = append(conditions, fmt.Sprint(index, " >= ?"))
+		values = append(values, from)
+	}
+	if to != nil {
+		conditions = append(conditions, fmt.Sprint(index, " <= ?"))
+		values = append(values, to)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT data FROM %s WHERE %s ORDER BY %s, id",
+		table.name, strings.Join(conditions, " AND "), index), values...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanRecords[T](rows)
+}
+
+// Returns the records whose indexed value is value
+func (table *table[T]) lookup(tx *sql.Tx, index string, value any) ([]T, error) {
+	return table.between(tx, index, value, value)
+}
+
+// Returns the first record whose indexed value is value, for indexes that are unique
+func (table *table[T]) first(tx *sql.Tx, index string, value any) (T, bool, error) {
+	records, err := table.lookup(tx, index, value)
+	if err != nil || len(records) == 0 {
+		var record T
+		return record, false, err
+	}
+
+	return records[0], true, nil
+}
+
+func textIndex[T any](value func(T) string) index[T] {
+	return index[T]{
+		sqlType: "TEXT",
+		value:   func(record T) any { return value(record) },
+	}
+}
+
+func uniqueTextIndex[T any](value func(T) string) index[T] {
+	index := textIndex(value)
+	index.unique = true
+	return index
+}
+
+// Indexes unix times
+func integerIndex[T any](value func(T) int64) index[T] {
+	return index[T]{
+		sqlType: "INTEGER",
+		value:   func(record T) any { return value(record) },
+	}
+}
@@ -4,9 +4,12 @@
 package storage
 
 import (
-	"errors"
+	"encoding/json"
+	"sort"
 	"time"
 
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/gpu"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 )
 
@@ -41,6 +44,14 @@ type AggregatedData struct {
 type QueuedSession struct {
 	Id           string
 	Requirements restapi.SessionRequirements
+	RequestedAt  time.Time
+}
+
+type ClosedSession struct {
+	Id           string
+	ExitStatus   string
+	Requirements restapi.SessionRequirements
+	ClosedAt     time.Time
 }
 
 type Iterator[T any] interface {
@@ -77,27 +88,197 @@ func (iterator *DefaultIterator[T]) Value() T {
 type Storage interface {
 	Close() error
 
+	// Returns a view of the storage whose reads may be served by a read replica and so may not
+	// yet reflect recent writes. Only for reads that tolerate staleness, such as dashboards and
+	// metrics, never for reads that decide a write. Closing the view does not close the storage.
+	StaleReads() Storage
+
 	AggregateData() (AggregatedData, error)
 
 	RegisterAgent(agent restapi.Agent) (string, error)
 	GetAgentById(id string) (restapi.Agent, error)
 	UpdateAgent(update restapi.AgentUpdate) error
+	// Stops or resumes placing new sessions on the agent, see restapi.Agent.Draining
+	SetAgentDraining(id string, draining bool) error
+	// Replaces the agent's labels
+	SetAgentLabels(id string, labels map[string]string) error
+	// Adds, replaces, and removes some of the agent's labels and taints, see PatchLabels
+	PatchAgentLabels(id string, patch restapi.AgentLabelsPatch) error
 
 	RequestSession(requirements restapi.SessionRequirements) (string, error)
-	AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu) error
+	// cpuFallback assigns the session to the agent's CPU rendering fallback, without gpus
+	AssignSession(sessionId string, agentId string, gpus []restapi.SessionGpu, cpuFallback bool) error
 	GetSessionById(id string) (restapi.Session, error)
+	// Places a session the agent reports running on the agent, allocating its GPUs, such as one
+	// the controller lost track of. Sessions placed on another agent and not yet closed are left
+	// to it, returning pkgerrors.ErrConflict.
+	AdoptSession(agentId string, session restapi.Session) error
+	// Records that the requester of the session has observed it
+	ClaimSession(id string) error
+	// Records the client's usage summary, canceling the session unless it is persistent
+	ReleaseSession(id string, release restapi.SessionRelease) error
+	// Closes the session when queued, otherwise has its agent cancel it even when persistent.
+	// Sessions closed or canceling are left as they are, except that preempted sessions then close
+	// rather than return to the queue.
+	CancelSession(id string) error
+	// See restapi.Session.Preemptible
+	SetSessionPreemptible(id string, preemptible bool) error
+	// Has the agent of the assigned or active session cancel it like CancelSession, returning it
+	// to the queue rather than closing it once the agent reports it closed, see
+	// restapi.Session.Preempted. Sessions in any other state are left as they are.
+	PreemptSession(id string) error
+	// Records the frame pacing and input latency reported by the client
+	UpdateSessionFrames(id string, frames restapi.FrameMetrics) error
 	GetQueuedSessionById(id string) (QueuedSession, error) // For Testing
 
 	GetAgents() (Iterator[restapi.Agent], error)
-	GetAvailableAgentsMatching(totalAvailableVramAtLeast uint64) (Iterator[restapi.Agent], error)
+	// Returns the page of the agents matching the query, ordered by id, see ListPage
+	QueryAgents(query restapi.ListQuery) (Page[restapi.Agent], error)
+	// Returns the page of the sessions placed on agents, neither queued nor closed, matching the
+	// query, ordered by id, see ListPage
+	QuerySessions(query restapi.ListQuery) (Page[restapi.PlacedSession], error)
+	// Records the items, encoded as JSON, matched by the first page of a listing with more pages,
+	// expiring after ListSnapshotTtl, and removes the snapshots expired
+	PutListSnapshot(snapshot ListSnapshot) error
+	// Returns ErrNotFound when the snapshot expired
+	GetListSnapshot(id string) (ListSnapshot, error)
+	// Returns the active agents with a GPU that could take another session allocated
+	// gpuVramAvailableAtLeast, accounting for the VRAM and sessions of each GPU
+	GetAvailableAgentsMatching(gpuVramAvailableAtLeast uint64) (Iterator[restapi.Agent], error)
+	// Ordered as they are scheduled, see SortQueuedSessions
 	GetQueuedSessionsIterator() (Iterator[QueuedSession], error)
+	GetSessionsClosedWithin(duration time.Duration) (Iterator[ClosedSession], error)
 
-	SetAgentsMissingIfNotUpdatedFor(duration time.Duration) error
+	// Marks the active agents not updated within duration missing, returning their ids
+	SetAgentsMissingIfNotUpdatedFor(duration time.Duration) ([]string, error)
 	RemoveMissingAgentsIfNotUpdatedFor(duration time.Duration) error
+	// Cancels sessions requested at least duration ago that have never been claimed,
+	// returning the number of sessions canceled
+	CancelUnclaimedSessionsOlderThan(duration time.Duration) (int, error)
+
+	// Creates or replaces expected agents by hostname, existing expected agents keep their id
+	ImportExpectedAgents(agents []restapi.ExpectedAgent) error
+	GetExpectedAgentByHostname(hostname string) (restapi.ExpectedAgent, error)
+	GetExpectedAgents() (Iterator[restapi.ExpectedAgent], error)
+
+	// Creates or replaces the revocation of the credential by its kind and subject
+	RevokeCredential(revocation restapi.Revocation) error
+	// Returns ErrNotFound when the credential is not revoked
+	RemoveRevocation(kind string, subject string) error
+	// Ordered by kind then subject, see SortRevocations
+	GetRevocations() ([]restapi.Revocation, error)
+
+	// Records a token minted for clients by the hash of the token, without the token itself.
+	// Returns ErrConflict when a token with the same name exists
+	CreateApiToken(token restapi.ApiToken, hash string) error
+	// Returns ErrNotFound when no token has the hash
+	GetApiTokenByHash(hash string) (restapi.ApiToken, error)
+	// Ordered by name
+	GetApiTokens() ([]restapi.ApiToken, error)
+	// Returns ErrNotFound when there is no token with the id
+	DeleteApiToken(id string) (restapi.ApiToken, error)
+
+	// Acquires the lease for the holder for duration when it is free, expired, or already held by
+	// the holder, which renews it. Returns the lease as it is after, held by another holder when
+	// it was not acquired.
+	AcquireLease(name string, holder string, duration time.Duration) (restapi.Lease, error)
+	// Frees the lease when held by the holder, so another holder acquires it without waiting for
+	// it to expire
+	ReleaseLease(name string, holder string) error
+	// Returns ErrNotFound when the lease is free
+	GetLease(name string) (restapi.Lease, error)
+
+	// Pauses or resumes scheduling the pool for every controller sharing the storage
+	SetPoolPaused(pool string, paused bool) error
+	// Ordered by name
+	GetPausedPools() ([]string, error)
+	// Turns the feature flag on or off for every controller sharing the storage, over their --features
+	SetFeatureOverride(override FeatureOverride) error
+	// Ordered by name
+	GetFeatureOverrides() ([]FeatureOverride, error)
+	// Creates or replaces the configuration resource of its kind with its name
+	PutConfigResource(resource restapi.ConfigResource) error
+	// Ordered by name
+	GetConfigResources(kind string) ([]restapi.ConfigResource, error)
+	// Returns ErrNotFound when there is no such resource
+	DeleteConfigResource(kind string, name string) error
+	// Re-encrypts the secrets not encrypted with the primary key of the keyring the storage was
+	// opened with, including those written before it had one, returning how many were. Does
+	// nothing when the storage has no keyring.
+	//
+	// The secrets encrypted are the expected agents' join tokens and the webhook subscriptions'
+	// secrets. API tokens are stored only as the hashes they are looked up by, which cannot be
+	// used as tokens, and an agent's join token is never stored. Session tokens are configured on
+	// the agents and the webhook secret on the controller's command line, neither is stored.
+	RotateSecrets() (int, error)
+
+	// Adds the sessions closed at least duration ago to the monthly usage aggregates, each session
+	// once, returning the number of sessions added or, when dryRun is set, that would be
+	RollUpUsageOlderThan(duration time.Duration, dryRun bool) (int, error)
+	// Ordered by month then tenant
+	GetUsageAggregates() ([]restapi.UsageAggregate, error)
+	// Removes the sessions closed at least duration ago, returning the number removed or, when
+	// dryRun is set, that would be
+	RemoveClosedSessionsOlderThan(duration time.Duration, dryRun bool) (int, error)
+
+	// Persists the event, returning it with the next sequence assigned
+	AppendEvent(event restapi.Event) (restapi.Event, error)
+	// Returns up to limit events with a sequence greater than since, in order of sequence
+	GetEventsSince(since uint64, limit int) ([]restapi.Event, error)
+	RemoveEventsOlderThan(duration time.Duration) error
+
+	// Persists the entry ahead of its mutation, returning it with the next sequence and the time
+	// assigned. Entries are visible to GetJournalEntriesSince in order of sequence.
+	AppendJournalEntry(entry restapi.JournalEntry) (restapi.JournalEntry, error)
+	// Replaces the entry with its sequence once its mutation completes, returns ErrNotFound when
+	// it was removed
+	UpdateJournalEntry(entry restapi.JournalEntry) error
+	// Returns up to limit entries with a sequence greater than since, in order of sequence
+	GetJournalEntriesSince(since uint64, limit int) ([]restapi.JournalEntry, error)
+	// Returns the sequence of the last entry appended, 0 when none were
+	GetJournalSequence() (uint64, error)
+	RemoveJournalEntriesOlderThan(duration time.Duration) error
+	// Creates or replaces how far the consumer with its name has followed the journal
+	PutJournalCursor(cursor JournalCursor) error
+	// Returns ErrNotFound when the consumer has not followed the journal
+	GetJournalCursor(name string) (JournalCursor, error)
+	DeleteJournalCursor(name string) error
+
+	// Calls notify with the id of each agent whose state, labels, taints, or allocated sessions
+	// change, or with an empty id when changes may have been missed and every agent must be
+	// reloaded. notify must not block or call back into the storage. Returns a function to
+	// stop watching.
+	WatchAgents(notify func(agentId string)) (func(), error)
+}
+
+// The items a listing matched when its first page was listed, the following pages are read from
+// it, see ListPage
+type ListSnapshot struct {
+	Id    string          `json:"id"`
+	Items json.RawMessage `json:"items"`
+}
+
+// A pool whose scheduling is paused, see scheduling.Pools
+type PausedPool struct {
+	Pool string `json:"pool"`
+}
+
+// A feature flag turned on or off through the API, see features.Set
+type FeatureOverride struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// The sequence a consumer of the journal, such as a webhook subscription, continues from after
+// a restart, see journal.Journal
+type JournalCursor struct {
+	Name     string `json:"name"`
+	Sequence uint64 `json:"sequence"`
 }
 
 var (
-	ErrNotFound = errors.New("object not found")
+	ErrNotFound = pkgerrors.ErrNotFound
+	ErrConflict = pkgerrors.ErrConflict
 )
 
 func TotalVram(gpus []restapi.Gpu) uint64 {
@@ -117,3 +298,273 @@ func TotalVramRequired(requirements restapi.SessionRequirements) uint64 {
 
 	return vramRequired
 }
+
+// Returns when the requester of a session is expected to claim it from, see
+// CancelUnclaimedSessionsOlderThan. Reserved sessions are not claimed before their window starts.
+func UnclaimedSince(requestedAt time.Time, requirements restapi.SessionRequirements) time.Time {
+	if requirements.Reservation != nil && requirements.Reservation.StartAt.After(requestedAt) {
+		return requirements.Reservation.StartAt
+	}
+
+	return requestedAt
+}
+
+// Returns the VRAM allocated to a session on its GPUs, more than it requires on GPUs whose
+// sessions are allocated a fraction, see restapi.Gpu.SessionVram
+func AllocatedVram(gpus []restapi.SessionGpu) uint64 {
+	var vram uint64
+	for _, gpu := range gpus {
+		vram += gpu.VramRequired
+	}
+
+	return vram
+}
+
+// Returns the requirements recorded for a session adopted from an agent, which only knows
+// the GPUs the session runs on
+func AdoptedRequirements(session restapi.Session) restapi.SessionRequirements {
+	requirements := restapi.SessionRequirements{
+		Version:          session.Version,
+		Persistent:       session.Persistent,
+		Gpus:             make([]restapi.GpuRequirements, 0, len(session.Gpus)),
+		AllowCpuFallback: session.CpuFallback,
+		Tenant:           session.Tenant,
+	}
+
+	for _, gpu := range session.Gpus {
+		requirements.Gpus = append(requirements.Gpus, restapi.GpuRequirements{
+			VramRequired: gpu.VramRequired,
+		})
+	}
+
+	return requirements
+}
+
+// Orders queued sessions as they are scheduled, highest priority first then oldest first
+func SortQueuedSessions(sessions []QueuedSession) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if sessions[i].Requirements.Priority != sessions[j].Requirements.Priority {
+			return sessions[i].Requirements.Priority > sessions[j].Requirements.Priority
+		}
+
+		return sessions[i].RequestedAt.Before(sessions[j].RequestedAt)
+	})
+}
+
+func SortRevocations(revocations []restapi.Revocation) {
+	sort.Slice(revocations, func(i, j int) bool {
+		if revocations[i].Kind != revocations[j].Kind {
+			return revocations[i].Kind < revocations[j].Kind
+		}
+
+		return revocations[i].Subject < revocations[j].Subject
+	})
+}
+
+func SortConfigResources(resources []restapi.ConfigResource) {
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Name < resources[j].Name
+	})
+}
+
+// Applies transform to the secrets of the resource's spec, the secret of a webhook subscription,
+// for the drivers to encrypt them at rest
+func TransformConfigResourceSecrets(resource restapi.ConfigResource, transform func(string) (string, error)) (restapi.ConfigResource, error) {
+	if resource.Kind != restapi.ConfigWebhook {
+		return resource, nil
+	}
+
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(resource.Spec, &fields)
+	if err != nil {
+		return restapi.ConfigResource{}, err
+	}
+
+	var secret string
+	if value, found := fields["secret"]; found {
+		err = json.Unmarshal(value, &secret)
+		if err != nil {
+			return restapi.ConfigResource{}, err
+		}
+	}
+
+	transformed, err := transform(secret)
+	if err != nil {
+		return restapi.ConfigResource{}, err
+	}
+
+	// The spec is left as it was written when nothing changed
+	if transformed == secret {
+		return resource, nil
+	}
+
+	fields["secret"], err = json.Marshal(transformed)
+	if err == nil {
+		resource.Spec, err = json.Marshal(fields)
+	}
+	if err != nil {
+		return restapi.ConfigResource{}, err
+	}
+
+	return resource, nil
+}
+
+func SortApiTokens(tokens []restapi.ApiToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+}
+
+func Pool(labels map[string]string) string {
+	pool, present := labels[restapi.PoolLabel]
+	if !present || pool == "" {
+		return restapi.DefaultPool
+	}
+
+	return pool
+}
+
+// Returns whether new sessions may be placed on the agent
+func Schedulable(agent restapi.Agent) bool {
+	return agent.State == restapi.AgentActive && !agent.Draining && len(UnhealthyGpus(agent)) == 0
+}
+
+// Returns the indexes of the GPUs the agent reports unhealthy, no sessions are placed on the
+// agent until they recover
+func UnhealthyGpus(agent restapi.Agent) []int {
+	unhealthy := []int{}
+	for _, gpu := range agent.Gpus {
+		if gpu.Metrics.Unhealthy != "" {
+			unhealthy = append(unhealthy, gpu.Index)
+		}
+	}
+
+	return unhealthy
+}
+
+func isSubset(set, subset map[string]string) bool {
+	for key, value := range subset {
+		checkValue, present := set[key]
+		if !present || value != checkValue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the labels with the patch applied, keys removed before the others are set
+func PatchLabels(labels map[string]string, set map[string]string, remove []string) map[string]string {
+	patched := make(map[string]string, len(labels)+len(set))
+	for key, value := range labels {
+		patched[key] = value
+	}
+
+	for _, key := range remove {
+		delete(patched, key)
+	}
+
+	for key, value := range set {
+		patched[key] = value
+	}
+
+	return patched
+}
+
+// Returns whether the agent supports every feature required, agents running without root forgo
+// some of them, see restapi.Agent.Rootless
+func hasCapabilities(agent restapi.Agent, required []string) bool {
+	for _, capability := range required {
+		if !agent.HasCapability(capability) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns whether sessions with the requirements may be placed on the agent regardless of its
+// capacity, the agent has the labels matched, the requirements tolerate its taints, and it
+// supports the capabilities required
+func AgentEligible(agent restapi.Agent, requirements restapi.SessionRequirements) bool {
+	return isSubset(agent.Labels, requirements.MatchLabels) && isSubset(requirements.Tolerates, agent.Taints) &&
+		hasCapabilities(agent, requirements.RequireCapabilities)
+}
+
+// Returns the agent's GPUs with the VRAM of its assigned sessions allocated
+func AgentGpuSet(agent restapi.Agent) *gpu.GpuSet {
+	gpuSet := gpu.NewGpuSet(agent.Gpus)
+	gpuSet.LimitSessionsPerGpu(agent.MaxSessionsPerGpu)
+
+	for _, session := range agent.Sessions {
+		if !session.CpuFallback && len(session.Gpus) > 0 {
+			gpuSet.Select(session.Gpus)
+		}
+	}
+
+	return gpuSet
+}
+
+// Returns whether one of the agent's GPUs could take another session allocated vramRequired
+func GpuAvailable(agent restapi.Agent, vramRequired uint64) bool {
+	_, err := AgentGpuSet(agent).Find([]restapi.GpuRequirements{{VramRequired: vramRequired}})
+	return err == nil
+}
+
+// Fills in the VRAM available and the sessions on each of the agent's GPUs and its fragmentation
+func WithVramAllocation(agent restapi.Agent) restapi.Agent {
+	gpuSet := AgentGpuSet(agent)
+
+	gpus := make([]restapi.Gpu, len(agent.Gpus))
+	copy(gpus, agent.Gpus)
+	for index, vramAvailable := range gpuSet.VramAvailable() {
+		gpus[index].VramAvailable = vramAvailable
+	}
+	for index, sessions := range gpuSet.Sessions() {
+		gpus[index].Sessions = sessions
+	}
+
+	agent.Gpus = gpus
+	agent.VramFragmentation = gpuSet.Fragmentation()
+	return agent
+}
+
+// Combines the exit status reported by the agent with the one observed by the client,
+// the client knows how the application exited unless the agent saw the session fail
+func ReconcileExitStatus(agentExitStatus string, release *restapi.SessionRelease) string {
+	if release == nil || release.ExitStatus == "" || agentExitStatus == restapi.ExitStatusFailure {
+		return agentExitStatus
+	}
+
+	return release.ExitStatus
+}
+
+// Returns the lease as it is once the holder tried to acquire it for duration at now, and whether
+// it was acquired or renewed, see Storage.AcquireLease. found is whether the lease is held.
+func AcquireLease(lease restapi.Lease, found bool, name string, holder string, duration time.Duration, now time.Time) (restapi.Lease, bool) {
+	if found && lease.Holder != holder && now.Before(lease.ExpiresAt) {
+		return lease, false
+	}
+
+	if !found || lease.Holder != holder {
+		lease = restapi.Lease{
+			Name:       name,
+			Holder:     holder,
+			AcquiredAt: now,
+		}
+	}
+
+	lease.ExpiresAt = now.Add(duration)
+	return lease, true
+}
+
+func CpuFallbackSessions(agent restapi.Agent) int {
+	count := 0
+	for _, session := range agent.Sessions {
+		if session.CpuFallback {
+			count++
+		}
+	}
+
+	return count
+}
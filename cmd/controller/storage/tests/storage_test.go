@@ -5,16 +5,30 @@ package tests
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/clock"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/journal"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/bolt"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/memdb"
 	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/postgres"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/sqlite"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
 
 func openMemdb(t *testing.T) storage.Storage {
@@ -26,8 +40,38 @@ func openMemdb(t *testing.T) storage.Storage {
 	return db
 }
 
+func openBolt(t *testing.T) storage.Storage {
+	db, err := bolt.OpenStorage(context.Background(), filepath.Join(t.TempDir(), "juice.db"), nil)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return db
+}
+
+func openSqlite(t *testing.T) storage.Storage {
+	db, err := sqlite.OpenStorage(context.Background(), filepath.Join(t.TempDir(), "juice.sqlite"), nil)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return db
+}
+
+const postgresConnection = "user=postgres password=password dbname=postgres sslmode=disable"
+
 func openPostgres(t *testing.T) storage.Storage {
-	db, err := postgres.OpenStorage(context.Background(), "user=postgres password=password dbname=postgres sslmode=disable")
+	migrator, err := postgres.OpenMigrator(postgresConnection)
+	if err == nil {
+		_, err = migrator.Migrate(context.Background(), postgres.LatestSchemaVersion(), false, nil)
+		err = errors.Join(err, migrator.Close())
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	db, err := postgres.OpenStorage(context.Background(), postgresConnection, nil, nil)
 	if err != nil {
 		t.Log(err)
 		t.FailNow()
@@ -159,6 +203,13 @@ func checkSession(t *testing.T, db storage.Storage, check restapi.Session) {
 func checkQueuedSession(t *testing.T, db storage.Storage, check storage.QueuedSession) {
 	t.Helper()
 	against, err := db.GetQueuedSessionById(check.Id)
+	if err == nil {
+		// The request time is assigned by the storage, only require it to be recent
+		if time.Since(against.RequestedAt) > time.Minute || time.Until(against.RequestedAt) > time.Minute {
+			t.Errorf("unexpected request time %s", against.RequestedAt)
+		}
+		check.RequestedAt = against.RequestedAt
+	}
 	compare(t, check, against, err)
 }
 
@@ -191,7 +242,12 @@ func TestAgents(t *testing.T) {
 		time.Sleep(time.Second)
 
 		agent.State = restapi.AgentMissing
-		db.SetAgentsMissingIfNotUpdatedFor(0)
+		missing, err := db.SetAgentsMissingIfNotUpdatedFor(0)
+		if err != nil {
+			t.Error(err)
+		} else if len(missing) != 1 || missing[0] != agent.Id {
+			t.Errorf("expected agent %s to be set missing, instead received %v", agent.Id, missing)
+		}
 		checkAgent(t, db, agent)
 
 		agent.State = restapi.AgentActive
@@ -210,7 +266,7 @@ func TestAgents(t *testing.T) {
 		time.Sleep(time.Second)
 
 		db.RemoveMissingAgentsIfNotUpdatedFor(0)
-		_, err := db.GetAgentById(agent.Id)
+		_, err = db.GetAgentById(agent.Id)
 		if err == nil {
 			t.Error("expected storage.ErrNotFound, instead did not receive an error")
 		} else if err != storage.ErrNotFound {
@@ -224,6 +280,73 @@ func TestAgents(t *testing.T) {
 		run(t, db)
 	})
 
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAgentLabels(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		agent.Labels = map[string]string{
+			restapi.PoolLabel:          "pool",
+			restapi.InventoryRackLabel: "rack",
+		}
+		err := db.SetAgentLabels(agent.Id, agent.Labels)
+		if err != nil {
+			t.Error(err)
+		}
+		checkAgent(t, db, agent)
+
+		// Labels not set are removed
+		agent.Labels = map[string]string{
+			restapi.PoolLabel: "pool",
+		}
+		err = db.SetAgentLabels(agent.Id, agent.Labels)
+		if err != nil {
+			t.Error(err)
+		}
+		checkAgent(t, db, agent)
+
+		err = db.SetAgentLabels(uuid.NewString(), agent.Labels)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
 	t.Run("postgresql", func(t *testing.T) {
 		db := openPostgres(t)
 		defer db.Close()
@@ -250,6 +373,62 @@ func TestSessions(t *testing.T) {
 		run(t, db)
 	})
 
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestDelegatedSessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		requirements := createSessionRequirements()
+		requirements.Tenant = "alice"
+		requirements.User = "alice"
+		requirements.DelegatedBy = "ci"
+		id := queueSession(t, db, requirements)
+
+		session, err := db.GetSessionById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if session.Tenant != "alice" || session.User != "alice" || session.DelegatedBy != "ci" {
+			t.Errorf("expected tenant alice, user alice, and delegated by ci, instead received tenant %s, user %s, and delegated by %s",
+				session.Tenant, session.User, session.DelegatedBy)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
 	t.Run("postgresql", func(t *testing.T) {
 		db := openPostgres(t)
 		defer db.Close()
@@ -271,7 +450,7 @@ func TestAssigningSessions(t *testing.T) {
 			},
 		}
 
-		err := db.AssignSession(sessionId, agent.Id, selectedGpus)
+		err := db.AssignSession(sessionId, agent.Id, selectedGpus, false)
 		if err != nil {
 			t.Log(err)
 			t.FailNow()
@@ -327,6 +506,167 @@ func TestAssigningSessions(t *testing.T) {
 		run(t, db)
 	})
 
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSharedGpus(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := defaultAgent(48 * 1024 * 1024 * 1024)
+		agent.Gpus[0].MaxSessions = 2
+		agent.Gpus[0].SessionVram = 20 * 1024 * 1024 * 1024
+		agent = registerAgent(t, db, agent)
+		checkAgent(t, db, agent)
+
+		available := func(vram uint64) bool {
+			iterator, err := db.GetAvailableAgentsMatching(vram)
+			compare(t, nil, err, nil)
+
+			found := false
+			for iterator.Next() {
+				found = found || iterator.Value().Id == agent.Id
+			}
+			return found
+		}
+
+		// Sessions without a VRAM requirement are allocated the GPU's fraction
+		sessionIds := []string{
+			queueSession(t, db, defaultSessionRequirements(0)),
+			queueSession(t, db, defaultSessionRequirements(0)),
+		}
+
+		err := db.AssignSession(sessionIds[0], agent.Id, []restapi.SessionGpu{
+			{
+				Index:        0,
+				VramRequired: agent.Gpus[0].SessionVram,
+			},
+		}, false)
+		compare(t, nil, err, nil)
+
+		if !available(20 * 1024 * 1024 * 1024) {
+			t.Error("expected the shared GPU to take another session")
+		}
+
+		// 28GB remains, more than the fraction of each session
+		if available(24 * 1024 * 1024 * 1024) {
+			t.Error("expected the shared GPU to refuse sessions requiring more than its fraction")
+		}
+
+		err = db.AssignSession(sessionIds[1], agent.Id, []restapi.SessionGpu{
+			{
+				Index:        0,
+				VramRequired: agent.Gpus[0].SessionVram,
+			},
+		}, false)
+		compare(t, nil, err, nil)
+
+		if available(1024 * 1024 * 1024) {
+			t.Error("expected the shared GPU to refuse sessions beyond its limit")
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: agent.State,
+			Sessions: map[string]restapi.SessionUpdate{
+				sessionIds[0]: {
+					State: restapi.SessionClosed,
+				},
+			},
+		})
+		compare(t, nil, err, nil)
+
+		if !available(20 * 1024 * 1024 * 1024) {
+			t.Error("expected the closed session's fraction to be released")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestCpuFallbackSessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		fallbackId := queueSession(t, db, requirements)
+		gpulessId := queueSession(t, db, restapi.SessionRequirements{Version: requirements.Version})
+
+		err := db.AssignSession(fallbackId, agent.Id, []restapi.SessionGpu{}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Sessions requiring no GPUs are not CPU fallback sessions
+		err = db.AssignSession(gpulessId, agent.Id, []restapi.SessionGpu{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := db.GetSessionById(fallbackId)
+		compare(t, true, session.CpuFallback, err)
+
+		session, err = db.GetSessionById(gpulessId)
+		compare(t, false, session.CpuFallback, err)
+
+		agent, err = db.GetAgentById(agent.Id)
+		compare(t, 1, storage.CpuFallbackSessions(agent), err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
 	t.Run("postgresql", func(t *testing.T) {
 		db := openPostgres(t)
 		defer db.Close()
@@ -367,9 +707,2916 @@ func TestGetQueuedSessionsIterator(t *testing.T) {
 		run(t, db)
 	})
 
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestGetQueuedSessionsIteratorPriority(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		priorities := map[string]int{}
+		for _, priority := range []int{0, 10, -5, 5} {
+			requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+			requirements.Priority = priority
+			priorities[queueSession(t, db, requirements)] = priority
+		}
+
+		iterator, err := db.GetQueuedSessionsIterator()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		order := []int{}
+		for iterator.Next() {
+			session := iterator.Value()
+			if priority, present := priorities[session.Id]; present {
+				compare(t, priority, session.Requirements.Priority, nil)
+				order = append(order, priority)
+			}
+		}
+
+		compare(t, []int{10, 5, 0, -5}, order, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
 	t.Run("postgresql", func(t *testing.T) {
 		db := openPostgres(t)
 		defer db.Close()
 		run(t, db)
 	})
 }
+
+func TestGetSessionsClosedWithin(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: agent.State,
+			Sessions: map[string]restapi.SessionUpdate{
+				sessionId: {
+					State:      restapi.SessionClosed,
+					ExitStatus: restapi.ExitStatusFailure,
+					LogExcerpt: "renderer exited\n",
+				},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, "renderer exited\n", session.LogExcerpt, err)
+
+		iterator, err := db.GetSessionsClosedWithin(time.Minute)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		found := false
+		for iterator.Next() {
+			closed := iterator.Value()
+			if closed.Id == sessionId {
+				found = true
+				compare(t, restapi.ExitStatusFailure, closed.ExitStatus, nil)
+				compare(t, requirements, closed.Requirements, nil)
+			}
+		}
+
+		if !found {
+			t.Error("closed session not found")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestCancelUnclaimedSessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		claimedId := queueSession(t, db, requirements)
+		unclaimedId := queueSession(t, db, requirements)
+		assignedId := queueSession(t, db, requirements)
+
+		err := db.ClaimSession(claimedId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.AssignSession(assignedId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		canceled, err := db.CancelUnclaimedSessionsOlderThan(0)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if canceled < 2 {
+			t.Errorf("expected at least 2 sessions canceled, canceled %d", canceled)
+		}
+
+		session, err := db.GetSessionById(claimedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+
+		session, err = db.GetSessionById(unclaimedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, restapi.ExitStatusCanceled, session.ExitStatus, err)
+
+		session, err = db.GetSessionById(assignedId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+
+		against, err := db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(against.Sessions) != 1 || against.Sessions[0].State != restapi.SessionCanceling {
+			t.Error("expected the agent's session to be canceling")
+		}
+
+		err = db.ClaimSession(uuid.NewString())
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionNetworkUpdates(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		network := restapi.NetworkMetrics{
+			BytesSent:     1024 * 1024,
+			BytesReceived: 1024,
+			SendRate:      1024,
+			ReceiveRate:   32,
+			Rtt:           1500,
+			RttMax:        4000,
+		}
+
+		// An update without a state must not change the state of the session
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			Sessions: map[string]restapi.SessionUpdate{
+				sessionId: {
+					Network: &network,
+				},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, restapi.SessionAssigned, session.State, err)
+		if session.Network == nil {
+			t.Error("expected the session to have network metrics")
+		} else {
+			compare(t, network, *session.Network, err)
+		}
+
+		against, err := db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(against.Sessions) != 1 || against.Sessions[0].State != restapi.SessionAssigned || against.Sessions[0].Network == nil {
+			t.Error("expected the agent's session to be assigned with network metrics")
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestExpectedAgents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		hostname := uuid.NewString()
+
+		err := db.ImportExpectedAgents([]restapi.ExpectedAgent{
+			{
+				Hostname: hostname,
+				Pool:     "test",
+				Gpus:     defaultAgent(24 * 1024 * 1024 * 1024).Gpus,
+				Labels:   map[string]string{"rack": "1"},
+				Taints:   map[string]string{},
+				Token:    "token",
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		expected, err := db.GetExpectedAgentByHostname(hostname)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		compare(t, "test", expected.Pool, err)
+		compare(t, "token", expected.Token, err)
+
+		// Importing the same hostname again replaces its configuration but keeps its id
+		err = db.ImportExpectedAgents([]restapi.ExpectedAgent{
+			{
+				Hostname: hostname,
+				Pool:     "other",
+				Labels:   map[string]string{},
+				Taints:   map[string]string{},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		reimported, err := db.GetExpectedAgentByHostname(hostname)
+		compare(t, expected.Id, reimported.Id, err)
+		compare(t, "other", reimported.Pool, err)
+
+		found := false
+		iterator, err := db.GetExpectedAgents()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		for iterator.Next() {
+			found = found || iterator.Value().Id == expected.Id
+		}
+		if !found {
+			t.Error("expected agent not returned by GetExpectedAgents")
+		}
+
+		_, err = db.GetExpectedAgentByHostname(uuid.NewString())
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		// Registering with the expected id adopts it, registering again replaces the previous registration
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Id = expected.Id
+		agent.Hostname = hostname
+		for i := 0; i < 2; i++ {
+			id, err := db.RegisterAgent(agent)
+			compare(t, expected.Id, id, err)
+		}
+
+		agents, err := db.GetAgents()
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		registrations := 0
+		for agents.Next() {
+			if agents.Value().Id == expected.Id {
+				registrations++
+			}
+		}
+		if registrations != 1 {
+			t.Errorf("expected 1 registration of the expected agent, found %d", registrations)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestReleaseSession(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		queuedId := queueSession(t, db, requirements)
+		assignedId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(assignedId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		startedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+		release := restapi.SessionRelease{
+			ExitStatus: restapi.ExitStatusFailure,
+			ExitCode:   3,
+			StartedAt:  startedAt,
+			EndedAt:    startedAt.Add(time.Minute),
+		}
+
+		err = db.ReleaseSession(queuedId, release)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err := db.GetSessionById(queuedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, restapi.ExitStatusCanceled, session.ExitStatus, err)
+
+		err = db.ReleaseSession(assignedId, release)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err = db.GetSessionById(assignedId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+		if session.Release == nil || session.Release.ExitCode != 3 || !session.Release.StartedAt.Equal(startedAt) {
+			t.Errorf("expected the release to be recorded, found %v", session.Release)
+		}
+
+		// The agent reports the session canceled, the client observed the application fail
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: restapi.AgentActive,
+			Sessions: map[string]restapi.SessionUpdate{
+				assignedId: {
+					State:      restapi.SessionClosed,
+					ExitStatus: restapi.ExitStatusCanceled,
+				},
+			},
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err = db.GetSessionById(assignedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, restapi.ExitStatusFailure, session.ExitStatus, err)
+
+		err = db.ReleaseSession(uuid.NewString(), release)
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestCancelSession(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		queuedId := queueSession(t, db, requirements)
+
+		// Persistent sessions are canceled all the same
+		requirements.Persistent = true
+		assignedId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(assignedId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.CancelSession(queuedId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err := db.GetSessionById(queuedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, restapi.ExitStatusCanceled, session.ExitStatus, err)
+
+		err = db.CancelSession(assignedId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err = db.GetSessionById(assignedId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+
+		agent, err = db.GetAgentById(agent.Id)
+		if err != nil || len(agent.Sessions) != 1 {
+			t.Fatalf("expected the agent to have the session, found %v, %v", agent.Sessions, err)
+		}
+		compare(t, restapi.SessionCanceling, agent.Sessions[0].State, nil)
+
+		// Closed sessions are left as they are
+		err = db.CancelSession(queuedId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(queuedId)
+		compare(t, restapi.SessionClosed, session.State, err)
+
+		err = db.CancelSession(uuid.NewString())
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionFrames(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		frames := restapi.FrameMetrics{
+			Frames:           1800,
+			FrameRate:        59.9,
+			FrameIntervalP50: 16.6,
+			FrameIntervalP95: 18.2,
+			FrameIntervalP99: 40.1,
+			Stutters:         4,
+			InputLatencyP50:  32.5,
+			InputLatencyP95:  51,
+		}
+
+		err = db.UpdateSessionFrames(sessionId, frames)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if session.Frames == nil || *session.Frames != frames {
+			t.Errorf("expected frames %v, found %v", frames, session.Frames)
+		}
+
+		// The agent's sessions carry the frames for the Prometheus metrics
+		agent, err = db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(agent.Sessions) != 1 || agent.Sessions[0].Frames == nil || *agent.Sessions[0].Frames != frames {
+			t.Errorf("expected the agent's session to have frames %v, found %v", frames, agent.Sessions)
+		}
+
+		err = db.UpdateSessionFrames(uuid.NewString(), frames)
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAdoptSession(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+		other := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		session := restapi.Session{
+			Id:         uuid.NewString(),
+			State:      restapi.SessionActive,
+			ExitStatus: restapi.ExitStatusUnknown,
+			Address:    agent.Address,
+			Version:    "Test",
+			Gpus: []restapi.SessionGpu{
+				{
+					Index:        0,
+					VramRequired: 4 * 1024 * 1024 * 1024,
+				},
+			},
+		}
+
+		err := db.AdoptSession(agent.Id, session)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		checkSession(t, db, session)
+
+		agent.Sessions = append(agent.Sessions, session)
+		checkAgent(t, db, agent)
+
+		// Reported again, the session is already placed on the agent
+		err = db.AdoptSession(agent.Id, session)
+		compare(t, nil, err, nil)
+		checkAgent(t, db, agent)
+
+		err = db.AdoptSession(other.Id, session)
+		if !errors.Is(err, storage.ErrConflict) {
+			t.Errorf("expected a conflict adopting a session placed on another agent, found %v", err)
+		}
+
+		// The session's VRAM is allocated, leaving 20GB
+		iterator, err := db.GetAvailableAgentsMatching(21 * 1024 * 1024 * 1024)
+		compare(t, nil, err, nil)
+		for iterator.Next() {
+			if iterator.Value().Id == agent.Id {
+				t.Errorf("expected agent %s to have the adopted session's VRAM allocated", agent.Id)
+			}
+		}
+
+		// Adopted sessions have been claimed by their client
+		canceled, err := db.CancelUnclaimedSessionsOlderThan(0)
+		compare(t, 0, canceled, err)
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    agent.Id,
+			State: agent.State,
+			Sessions: map[string]restapi.SessionUpdate{
+				session.Id: {
+					State: restapi.SessionClosed,
+				},
+			},
+		})
+		compare(t, nil, err, nil)
+
+		// Closed sessions may be adopted by the agent that reports running them
+		err = db.AdoptSession(other.Id, session)
+		compare(t, nil, err, nil)
+
+		session.Address = other.Address
+		checkSession(t, db, session)
+
+		other.Sessions = append(other.Sessions, session)
+		checkAgent(t, db, other)
+
+		err = db.AdoptSession(uuid.NewString(), session)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected adopting a session on an unknown agent to fail with not found, found %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestEvents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		appended := []restapi.Event{}
+		for _, pool := range []string{"a", "b", "c"} {
+			event, err := db.AppendEvent(restapi.Event{
+				Type:    restapi.EventPoolCapacityExhausted,
+				Version: 1,
+				Time:    time.Now(),
+				Pool:    pool,
+				Data: map[string]string{
+					"queued": "1",
+				},
+			})
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			if len(appended) > 0 && event.Sequence != appended[len(appended)-1].Sequence+1 {
+				t.Errorf("expected sequence %d, found %d", appended[len(appended)-1].Sequence+1, event.Sequence)
+			}
+
+			appended = append(appended, event)
+		}
+
+		since := appended[0].Sequence - 1
+
+		events, err := db.GetEventsSince(since, 10)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(events) != len(appended) {
+			t.Fatalf("expected %d events, found %d", len(appended), len(events))
+		}
+
+		for index, event := range events {
+			if event.Sequence != appended[index].Sequence || event.Pool != appended[index].Pool || event.Data["queued"] != "1" {
+				t.Errorf("expected event %v, found %v", appended[index], event)
+			}
+		}
+
+		events, err = db.GetEventsSince(appended[0].Sequence, 1)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(events) != 1 || events[0].Sequence != appended[1].Sequence {
+			t.Errorf("expected only the event after sequence %d, found %v", appended[0].Sequence, events)
+		}
+
+		err = db.RemoveEventsOlderThan(time.Hour)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		events, err = db.GetEventsSince(since, 10)
+		compare(t, len(appended), len(events), err)
+
+		err = db.RemoveEventsOlderThan(0)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		events, err = db.GetEventsSince(since, 10)
+		compare(t, 0, len(events), err)
+
+		// Sequences are not reused once their events are removed
+		event, err := db.AppendEvent(restapi.Event{
+			Type: restapi.EventQueueRecovered,
+			Time: time.Now(),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if event.Sequence <= appended[len(appended)-1].Sequence {
+			t.Errorf("expected a sequence after %d, found %d", appended[len(appended)-1].Sequence, event.Sequence)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestUsageRollup(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Tenant = "tenant"
+		sessionId := queueSession(t, db, requirements)
+
+		startedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+		err := db.ReleaseSession(sessionId, restapi.SessionRelease{
+			ExitStatus: restapi.ExitStatusSuccess,
+			StartedAt:  startedAt,
+			EndedAt:    startedAt.Add(time.Minute),
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		count, err := db.RollUpUsageOlderThan(time.Hour, false)
+		compare(t, 0, count, err)
+
+		count, err = db.RollUpUsageOlderThan(0, true)
+		compare(t, 1, count, err)
+
+		aggregates, err := db.GetUsageAggregates()
+		compare(t, 0, len(aggregates), err)
+
+		count, err = db.RollUpUsageOlderThan(0, false)
+		compare(t, 1, count, err)
+
+		// Sessions are only aggregated once
+		count, err = db.RollUpUsageOlderThan(0, false)
+		compare(t, 0, count, err)
+
+		aggregates, err = db.GetUsageAggregates()
+		if err != nil || len(aggregates) != 1 {
+			t.Fatalf("expected one aggregate, found %v, %v", aggregates, err)
+		}
+		compare(t, "tenant", aggregates[0].Tenant, nil)
+		compare(t, 1, aggregates[0].Sessions, nil)
+		compare(t, 60.0, aggregates[0].SessionSeconds, nil)
+
+		count, err = db.RemoveClosedSessionsOlderThan(0, true)
+		compare(t, 1, count, err)
+
+		_, err = db.GetSessionById(sessionId)
+		if err != nil {
+			t.Errorf("expected the session to be kept by the dry run, %v", err)
+		}
+
+		count, err = db.RemoveClosedSessionsOlderThan(0, false)
+		compare(t, 1, count, err)
+
+		_, err = db.GetSessionById(sessionId)
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		// The usage outlives the session
+		aggregates, err = db.GetUsageAggregates()
+		compare(t, 1, len(aggregates), err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestRevocations(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		revokedAt := time.Now().UTC().Truncate(time.Second)
+
+		err := db.RevokeCredential(restapi.Revocation{
+			Kind:      restapi.RevocationUser,
+			Subject:   "mallory",
+			RevokedAt: revokedAt,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.RevokeCredential(restapi.Revocation{
+			Kind:      restapi.RevocationToken,
+			Subject:   "ci",
+			RevokedAt: revokedAt,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// Revoking a credential again replaces its revocation
+		err = db.RevokeCredential(restapi.Revocation{
+			Kind:          restapi.RevocationUser,
+			Subject:       "mallory",
+			Reason:        "offboarded",
+			EvictSessions: true,
+			RevokedAt:     revokedAt,
+		})
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		revocations, err := db.GetRevocations()
+		if err != nil || len(revocations) != 2 {
+			t.Fatalf("expected 2 revocations, instead received %v, %v", revocations, err)
+		}
+
+		compare(t, restapi.RevocationToken, revocations[0].Kind, nil)
+		compare(t, "ci", revocations[0].Subject, nil)
+		compare(t, "mallory", revocations[1].Subject, nil)
+		compare(t, "offboarded", revocations[1].Reason, nil)
+		compare(t, true, revocations[1].EvictSessions, nil)
+		compare(t, true, revokedAt.Equal(revocations[1].RevokedAt), nil)
+
+		err = db.RemoveRevocation(restapi.RevocationToken, "ci")
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = db.RemoveRevocation(restapi.RevocationToken, "ci")
+		if err != storage.ErrNotFound {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		revocations, err = db.GetRevocations()
+		if err != nil || len(revocations) != 1 {
+			t.Fatalf("expected 1 revocation, instead received %v, %v", revocations, err)
+		}
+
+		// Sessions record the token they were requested with so revoking it can cancel them
+		requirements := createSessionRequirements()
+		requirements.TokenName = "ci"
+		session, err := db.GetSessionById(queueSession(t, db, requirements))
+		compare(t, "ci", session.TokenName, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestApiTokens(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		createdAt := time.Now().UTC().Truncate(time.Second)
+
+		ci := restapi.ApiToken{
+			Id:        uuid.NewString(),
+			Name:      "ci",
+			User:      "ci-bot",
+			CreatedAt: createdAt,
+			ExpiresAt: createdAt.Add(time.Hour),
+			Token:     "secret",
+		}
+		err := db.CreateApiToken(ci, "ci-hash")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.CreateApiToken(restapi.ApiToken{
+			Id:        uuid.NewString(),
+			Name:      "alice",
+			CreatedAt: createdAt,
+		}, "alice-hash")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = db.CreateApiToken(restapi.ApiToken{
+			Id:        uuid.NewString(),
+			Name:      "ci",
+			CreatedAt: createdAt,
+		}, "other-hash")
+		if !errors.Is(err, storage.ErrConflict) {
+			t.Errorf("expected storage.ErrConflict, instead received %v", err)
+		}
+
+		// The token itself is never stored
+		token, err := db.GetApiTokenByHash("ci-hash")
+		compare(t, "", token.Token, err)
+		compare(t, ci.Id, token.Id, nil)
+		compare(t, "ci-bot", token.User, nil)
+		compare(t, true, createdAt.Equal(token.CreatedAt), nil)
+		compare(t, true, ci.ExpiresAt.Equal(token.ExpiresAt), nil)
+
+		_, err = db.GetApiTokenByHash("secret")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		tokens, err := db.GetApiTokens()
+		if err != nil || len(tokens) != 2 {
+			t.Fatalf("expected 2 tokens, instead received %v, %v", tokens, err)
+		}
+
+		compare(t, "alice", tokens[0].Name, nil)
+		compare(t, true, tokens[0].ExpiresAt.IsZero(), nil)
+		compare(t, "ci", tokens[1].Name, nil)
+
+		deleted, err := db.DeleteApiToken(ci.Id)
+		compare(t, "ci", deleted.Name, err)
+
+		_, err = db.DeleteApiToken(ci.Id)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		_, err = db.GetApiTokenByHash("ci-hash")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		requirements := createSessionRequirements()
+		requirements.IdleTimeoutSeconds = 300
+		id := queueSession(t, db, requirements)
+
+		session, err := db.GetSessionById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compare(t, 300, session.IdleTimeoutSeconds, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionMetricsPort(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MetricsPort = 9400
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, 9400, session.MetricsPort, err)
+
+		// Agents start the sessions assigned to them from their own record
+		agent, err = db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(agent.Sessions) != 1 {
+			t.Fatalf("expected 1 session on the agent, found %d", len(agent.Sessions))
+		}
+		compare(t, 9400, agent.Sessions[0].MetricsPort, nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPatchAgentLabels(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Taints = map[string]string{
+			"reserved": "true",
+		}
+		agentId := registerAgent(t, db, agent).Id
+
+		err := db.PatchAgentLabels(agentId, restapi.AgentLabelsPatch{
+			Labels: map[string]string{
+				"Key2": "Changed",
+				"Key3": "Value3",
+			},
+			RemoveLabels: []string{"Key1"},
+			Taints: map[string]string{
+				"maintenance": "true",
+			},
+			RemoveTaints: []string{"reserved"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		agent, err = db.GetAgentById(agentId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compare(t, map[string]string{"Key2": "Changed", "Key3": "Value3"}, agent.Labels, nil)
+		compare(t, map[string]string{"maintenance": "true"}, agent.Taints, nil)
+
+		// Scheduling reads the labels and taints patched
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.MatchLabels = map[string]string{"Key3": "Value3"}
+		requirements.Tolerates = map[string]string{"maintenance": "true"}
+
+		iterator, err := db.GetAvailableAgentsMatching(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		eligible := false
+		for iterator.Next() {
+			eligible = eligible || (iterator.Value().Id == agentId && storage.AgentEligible(iterator.Value(), requirements))
+		}
+		compare(t, true, eligible, nil)
+
+		err = db.PatchAgentLabels(uuid.NewString(), restapi.AgentLabelsPatch{
+			RemoveLabels: []string{"Key2"},
+		})
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected patching an unknown agent to fail with %v, got %v", storage.ErrNotFound, err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionRecord(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Record = true
+		recordedId := queueSession(t, db, requirements)
+		unrecordedId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		for _, sessionId := range []string{recordedId, unrecordedId} {
+			err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+				{
+					Index:        agent.Gpus[0].Index,
+					VramRequired: requirements.Gpus[0].VramRequired,
+				},
+			}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		session, err := db.GetSessionById(recordedId)
+		compare(t, true, session.Record, err)
+
+		session, err = db.GetSessionById(unrecordedId)
+		compare(t, false, session.Record, err)
+
+		// The controller gives recording keys only for the recorded sessions on the agent
+		agent, err = db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(agent.Sessions) != 2 {
+			t.Fatalf("expected 2 sessions on the agent, found %d", len(agent.Sessions))
+		}
+		for _, session := range agent.Sessions {
+			compare(t, session.Id == recordedId, session.Record, nil)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionReservation(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		reservation := restapi.SessionReservation{
+			StartAt:         time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+			DurationSeconds: 3600,
+		}
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Reservation = &reservation
+		reservedId := queueSession(t, db, requirements)
+		onDemandId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+		// Reserved sessions are not claimed before their window starts
+		_, err := db.CancelUnclaimedSessionsOlderThan(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := db.GetSessionById(reservedId)
+		compare(t, restapi.SessionQueued, session.State, err)
+		if session.Reservation == nil || !session.Reservation.StartAt.Equal(reservation.StartAt) || session.Reservation.DurationSeconds != reservation.DurationSeconds {
+			t.Errorf("expected the session to be reserved for %v, found %v", reservation, session.Reservation)
+		}
+
+		session, err = db.GetSessionById(onDemandId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		if session.Reservation != nil {
+			t.Errorf("expected the on-demand session to have no reservation, found %v", session.Reservation)
+		}
+
+		// The backend cancels the reserved sessions on agents once their window ends
+		err = db.AssignSession(reservedId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		agent, err = db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(agent.Sessions) != 1 || agent.Sessions[0].Reservation == nil || !agent.Sessions[0].Reservation.EndAt().Equal(reservation.EndAt()) {
+			t.Errorf("expected the agent's session to be reserved for %v", reservation)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestSessionPreemptible(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, db, requirements)
+
+		err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.SetSessionPreemptible(sessionId, true)
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, true, session.Preemptible, err)
+
+		placed, err := db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Error(err)
+		} else if len(placed.Sessions) != 1 || !placed.Sessions[0].Preemptible {
+			t.Errorf("expected the session placed on the agent to be preemptible, instead received %v", placed.Sessions)
+		}
+
+		err = db.SetSessionPreemptible(uuid.NewString(), true)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestPreemptSession(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.Priority = 5
+		sessionId := queueSession(t, db, requirements)
+
+		assign := func() {
+			t.Helper()
+
+			err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+				{
+					Index:        agent.Gpus[0].Index,
+					VramRequired: requirements.Gpus[0].VramRequired,
+				},
+			}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		closeSession := func() {
+			t.Helper()
+
+			err := db.UpdateAgent(restapi.AgentUpdate{
+				Id:    agent.Id,
+				State: restapi.AgentActive,
+				Sessions: map[string]restapi.SessionUpdate{
+					sessionId: {
+						State:      restapi.SessionClosed,
+						ExitStatus: restapi.ExitStatusCanceled,
+					},
+				},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		assign()
+
+		err := db.PreemptSession(sessionId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err := db.GetSessionById(sessionId)
+		compare(t, restapi.SessionCanceling, session.State, err)
+		compare(t, true, session.Preempted, nil)
+		compare(t, 5, session.Priority, nil)
+
+		placed, err := db.GetAgentById(agent.Id)
+		if err != nil {
+			t.Error(err)
+		} else if len(placed.Sessions) != 1 || !placed.Sessions[0].Preempted || placed.Sessions[0].State != restapi.SessionCanceling {
+			t.Errorf("expected the session placed on the agent to be preempted, instead received %v", placed.Sessions)
+		}
+
+		// Once closed by its agent, the session returns to the queue and the agent's VRAM is freed
+		closeSession()
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionQueued, session.State, err)
+		compare(t, false, session.Preempted, nil)
+		compare(t, 0, len(session.Gpus), nil)
+
+		queued, err := db.GetQueuedSessionById(sessionId)
+		compare(t, requirements.Priority, queued.Requirements.Priority, err)
+
+		placed, err = db.GetAgentById(agent.Id)
+		compare(t, 0, len(placed.Sessions), err)
+
+		available, err := db.GetAvailableAgentsMatching(24 * 1024 * 1024 * 1024)
+		compare(t, true, available.Next(), err)
+
+		// Canceled while preempted, the session closes
+		assign()
+
+		err = db.PreemptSession(sessionId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = db.CancelSession(sessionId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		closeSession()
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionClosed, session.State, err)
+
+		// Sessions no longer running are left as they are
+		err = db.PreemptSession(sessionId)
+		if err != nil {
+			t.Error(err)
+		}
+
+		session, err = db.GetSessionById(sessionId)
+		compare(t, restapi.SessionClosed, session.State, err)
+		compare(t, false, session.Preempted, nil)
+
+		err = db.PreemptSession(uuid.NewString())
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestJournal(t *testing.T) {
+	// Controllers follow each other's entries every --journal-poll
+	err := flag.Set("journal-poll", "10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, ctx context.Context, db storage.Storage, fake *clock.Fake) {
+		mutations, err := journal.New(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The postgres database is shared by the tests, sequences continue from theirs
+		first, err := mutations.Sequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		journaled := mutations.Wrap(db)
+
+		notified := make(chan string, 64)
+		stop, err := journaled.WatchAgents(func(agentId string) {
+			notified <- agentId
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+
+		waitNotified := func(notified chan string, agentId string) {
+			t.Helper()
+
+			for {
+				select {
+				case id := <-notified:
+					if id == agentId {
+						return
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected agent %s to be notified", agentId)
+				}
+			}
+		}
+
+		agent := registerAgent(t, journaled, defaultAgent(24*1024*1024*1024))
+		waitNotified(notified, agent.Id)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		sessionId := queueSession(t, journaled, requirements)
+
+		err = journaled.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+			{
+				Index:        agent.Gpus[0].Index,
+				VramRequired: requirements.Gpus[0].VramRequired,
+			},
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitNotified(notified, agent.Id)
+
+		// Failed mutations are recorded as failed and not replayed
+		err = journaled.SetAgentDraining(uuid.NewString(), true)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		err = journaled.SetSessionPreemptible(sessionId, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, next, missed, err := mutations.Since(first, 100)
+		compare(t, false, missed, err)
+
+		operations := []string{}
+		for _, entry := range entries {
+			compare(t, restapi.JournalApplied, entry.State, nil)
+			operations = append(operations, entry.Operation)
+		}
+		compare(t, []string{"RegisterAgent", "RequestSession", "AssignSession", "SetSessionPreemptible"}, operations, nil)
+		if len(entries) != 4 {
+			t.FailNow()
+		}
+		compare(t, first+5, next, nil)
+		compare(t, restapi.JournalEntry{
+			Sequence:  first + 3,
+			Time:      entries[2].Time,
+			State:     restapi.JournalApplied,
+			Operation: "AssignSession",
+			Kind:      restapi.JournalSession,
+			Id:        sessionId,
+			AgentIds:  []string{agent.Id},
+		}, entries[2], nil)
+		compare(t, []string{agent.Id}, entries[3].AgentIds, nil)
+
+		entries, next, missed, err = mutations.Since(first+2, 1)
+		compare(t, false, missed, err)
+		compare(t, 1, len(entries), nil)
+		compare(t, first+3, next, nil)
+
+		// Sequences past the last are from before the storage was replaced
+		sequence, err := mutations.Sequence()
+		compare(t, first+5, sequence, err)
+
+		_, _, missed, err = mutations.Since(sequence+10, 100)
+		compare(t, true, missed, err)
+
+		// The journal is kept in the storage, another controller sharing it replays the same
+		// entries and follows those appended by the first
+		other, err := journal.New(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		replayed, _, _, err := other.Since(first, 100)
+		compare(t, 4, len(replayed), err)
+
+		// Consumers such as webhook subscriptions continue from the cursors they record
+		_, err = db.GetJournalCursor("webhook/billing")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		for _, sequence := range []uint64{first + 2, first + 4} {
+			err = db.PutJournalCursor(storage.JournalCursor{Name: "webhook/billing", Sequence: sequence})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cursor, err := db.GetJournalCursor("webhook/billing")
+			compare(t, storage.JournalCursor{Name: "webhook/billing", Sequence: sequence}, cursor, err)
+		}
+
+		err = db.DeleteJournalCursor("webhook/billing")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.GetJournalCursor("webhook/billing")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound once deleted, instead received %v", err)
+		}
+
+		otherNotified := make(chan string, 64)
+		stopOther := other.WatchAgents(func(agentId string) {
+			otherNotified <- agentId
+		})
+		defer stopOther()
+
+		group := task.NewTaskManager(ctx)
+		group.Go("Journal", other)
+		defer func() {
+			group.Cancel()
+			group.Wait()
+		}()
+
+		// Waits return once an entry is completed after since
+		waited := make(chan struct{})
+		go func() {
+			mutations.Wait(context.Background(), sequence)
+			close(waited)
+		}()
+
+		err = journaled.SetAgentDraining(agent.Id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-waited:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the wait to return once an entry was completed")
+		}
+
+		waitNotified(otherNotified, agent.Id)
+
+		// Readers stop at an entry still pending, the mutations after it may have been made
+		// while it is yet to be
+		pending, err := db.AppendJournalEntry(restapi.JournalEntry{
+			State:     restapi.JournalPending,
+			Operation: "SetAgentLabels",
+			Kind:      restapi.JournalAgent,
+			Id:        agent.Id,
+			AgentIds:  []string{agent.Id},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = journaled.SetAgentLabels(agent.Id, map[string]string{"zone": "west"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, next, _, err = mutations.Since(sequence+1, 100)
+		compare(t, 0, len(entries), err)
+		compare(t, sequence+1, next, nil)
+
+		if fake != nil {
+			// Entries left pending by a controller that stopped are replayed once interrupted
+			fake.Advance(time.Minute)
+
+			entries, _, _, err = mutations.Since(sequence+1, 100)
+			compare(t, 2, len(entries), err)
+			if len(entries) == 2 {
+				compare(t, restapi.JournalPending, entries[0].State, nil)
+				compare(t, restapi.JournalApplied, entries[1].State, nil)
+			}
+		}
+
+		pending.State = restapi.JournalFailed
+		err = db.UpdateJournalEntry(pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, next, _, err = mutations.Since(sequence+1, 100)
+		compare(t, 1, len(entries), err)
+		compare(t, pending.Sequence+1, next, nil)
+
+		if fake == nil {
+			return
+		}
+
+		// The agents removed while missing are recorded though the drivers do not return them
+		since := next
+
+		fake.Advance(time.Second)
+		_, err = journaled.SetAgentsMissingIfNotUpdatedFor(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fake.Advance(time.Second)
+		err = journaled.RemoveMissingAgentsIfNotUpdatedFor(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, _, _, err = mutations.Since(since, 100)
+		removed := false
+		for _, entry := range entries {
+			if entry.Operation == "RemoveMissingAgentsIfNotUpdatedFor" {
+				for _, id := range entry.AgentIds {
+					removed = removed || id == agent.Id
+				}
+			}
+		}
+		compare(t, true, removed, err)
+
+		// Sweeps that change nothing are recorded as unchanged and not replayed
+		sequence, err = mutations.Sequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = journaled.CancelUnclaimedSessionsOlderThan(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, next, _, err = mutations.Since(sequence, 100)
+		compare(t, 0, len(entries), err)
+		compare(t, sequence+1, next, nil)
+
+		// Sequences are kept once the entries are removed, replaying from before them is missed
+		fake.Advance(time.Hour)
+		err = db.RemoveJournalEntriesOlderThan(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last, err := mutations.Sequence()
+		compare(t, sequence+1, last, err)
+
+		_, _, missed, err = mutations.Since(since, 100)
+		compare(t, true, missed, err)
+
+		_, _, missed, err = mutations.Since(last, 100)
+		compare(t, false, missed, err)
+	}
+
+	start := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("memdb", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		ctx := clock.NewContext(context.Background(), fake)
+		db, err := memdb.OpenStorage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, ctx, db, fake)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		ctx := clock.NewContext(context.Background(), fake)
+		db, err := bolt.OpenStorage(ctx, filepath.Join(t.TempDir(), "juice.db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, ctx, db, fake)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		ctx := clock.NewContext(context.Background(), fake)
+		db, err := sqlite.OpenStorage(ctx, filepath.Join(t.TempDir(), "juice.sqlite"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, ctx, db, fake)
+	})
+
+	// The postgres storage removes entries against the database's clock
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, context.Background(), db, nil)
+	})
+}
+
+func TestAgentCapabilities(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.Capabilities = []string{restapi.CapabilityGpuMetrics, restapi.CapabilityGpuFairness}
+		agent.Rootless = true
+
+		// Checks the capabilities are kept
+		registerAgent(t, db, agent)
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		requirements.RequireCapabilities = []string{restapi.CapabilityGpuFairness}
+		sessionId := queueSession(t, db, requirements)
+
+		queued, err := db.GetQueuedSessionById(sessionId)
+		compare(t, requirements.RequireCapabilities, queued.Requirements.RequireCapabilities, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestAgentSelfTest(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := defaultAgent(24 * 1024 * 1024 * 1024)
+		agent.SelfTest = &restapi.SelfTest{
+			RanAt: time.Now().UTC().Truncate(time.Second),
+			Checks: []restapi.SelfTestCheck{
+				{Name: restapi.SelfTestLibraries, Passed: true},
+				{Name: restapi.SelfTestVulkan, Passed: false, Message: "no GPUs"},
+			},
+		}
+
+		// Checks the self-test is kept
+		agent = registerAgent(t, db, agent)
+
+		agent, err := db.GetAgentById(agent.Id)
+		compare(t, []string{restapi.SelfTestVulkan}, agent.SelfTest.Failed(), err)
+
+		// Agents not running a self-test register without one
+		registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestQueryAgents(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		ids := []string{}
+		for index := 0; index < 3; index++ {
+			agent := defaultAgent(24 * 1024 * 1024 * 1024)
+			if index == 2 {
+				agent.Labels["Key1"] = "Other"
+				agent.Gpus[0].Name = "Other"
+			}
+			ids = append(ids, registerAgent(t, db, agent).Id)
+		}
+		sort.Strings(ids)
+
+		page, err := db.QueryAgents(restapi.ListQuery{})
+		compare(t, 3, page.Total, err)
+		compare(t, 3, len(page.Items), nil)
+
+		page, err = db.QueryAgents(restapi.ListQuery{Offset: 1, Limit: 1})
+		compare(t, 3, page.Total, err)
+		if len(page.Items) != 1 || page.Items[0].Id != ids[1] {
+			t.Errorf("expected agent %s, instead received %v", ids[1], page.Items)
+		}
+
+		page, err = db.QueryAgents(restapi.ListQuery{Labels: map[string]string{"Key1": "Other"}})
+		compare(t, 1, page.Total, err)
+
+		page, err = db.QueryAgents(restapi.ListQuery{GpuName: "Test"})
+		compare(t, 2, page.Total, err)
+
+		page, err = db.QueryAgents(restapi.ListQuery{State: restapi.AgentMissing})
+		compare(t, 0, page.Total, err)
+		compare(t, 0, len(page.Items), nil)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestQuerySessions(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		requirements := defaultSessionRequirements(4 * 1024 * 1024 * 1024)
+		for index := 0; index < 2; index++ {
+			sessionId := queueSession(t, db, requirements)
+			err := db.AssignSession(sessionId, agent.Id, []restapi.SessionGpu{
+				{
+					Index:        agent.Gpus[0].Index,
+					VramRequired: requirements.Gpus[0].VramRequired,
+				},
+			}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Queued sessions are not placed
+		queueSession(t, db, requirements)
+
+		page, err := db.QuerySessions(restapi.ListQuery{})
+		compare(t, 2, page.Total, err)
+		for _, session := range page.Items {
+			if session.AgentId != agent.Id || session.Hostname != agent.Hostname {
+				t.Errorf("expected session %s placed on agent %s, instead placed on %s", session.Id, agent.Id, session.AgentId)
+			}
+		}
+
+		page, err = db.QuerySessions(restapi.ListQuery{Limit: 1})
+		compare(t, 2, page.Total, err)
+		compare(t, 1, len(page.Items), nil)
+
+		page, err = db.QuerySessions(restapi.ListQuery{GpuName: "Test", Labels: map[string]string{"Key2": "Value2"}})
+		compare(t, 2, page.Total, err)
+
+		page, err = db.QuerySessions(restapi.ListQuery{GpuName: "Other"})
+		compare(t, 0, page.Total, err)
+
+		page, err = db.QuerySessions(restapi.ListQuery{State: restapi.SessionActive})
+		compare(t, 0, page.Total, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestQuerySnapshot(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage, fake *clock.Fake) {
+		ids := []string{}
+		for index := 0; index < 4; index++ {
+			ids = append(ids, registerAgent(t, db, defaultAgent(24*1024*1024*1024)).Id)
+		}
+		sort.Strings(ids)
+
+		first, err := db.QueryAgents(restapi.ListQuery{State: restapi.AgentActive, Limit: 2})
+		compare(t, 4, first.Total, err)
+		compare(t, true, first.More, nil)
+		if first.Snapshot == "" {
+			t.Fatal("expected the first page to record a snapshot")
+		}
+
+		// Agents registered, closed, or relabeled after the first page leave the pages following it
+		// as they were listed
+		registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		err = db.UpdateAgent(restapi.AgentUpdate{
+			Id:    ids[0],
+			State: restapi.AgentClosed,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.PatchAgentLabels(ids[2], restapi.AgentLabelsPatch{
+			Labels: map[string]string{"zone": "west"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next, err := db.QueryAgents(restapi.ListQuery{
+			State:    restapi.AgentActive,
+			Limit:    2,
+			Offset:   len(first.Items),
+			Snapshot: first.Snapshot,
+		})
+		compare(t, 4, next.Total, err)
+		compare(t, false, next.More, nil)
+
+		listed := []string{}
+		for _, agent := range append(first.Items, next.Items...) {
+			listed = append(listed, agent.Id)
+		}
+		compare(t, ids, listed, nil)
+		compare(t, defaultAgent(24*1024*1024*1024).Labels, next.Items[0].Labels, nil)
+
+		page, err := db.QueryAgents(restapi.ListQuery{State: restapi.AgentActive})
+		compare(t, 4, page.Total, err)
+		compare(t, "", page.Snapshot, nil)
+
+		if fake != nil {
+			fake.Advance(storage.ListSnapshotTtl)
+
+			_, err = db.QueryAgents(restapi.ListQuery{
+				State:    restapi.AgentActive,
+				Offset:   len(first.Items),
+				Snapshot: first.Snapshot,
+			})
+			if !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+			}
+		}
+	}
+
+	start := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("memdb", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := memdb.OpenStorage(clock.NewContext(context.Background(), fake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := bolt.OpenStorage(clock.NewContext(context.Background(), fake), filepath.Join(t.TempDir(), "juice.db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := sqlite.OpenStorage(clock.NewContext(context.Background(), fake), filepath.Join(t.TempDir(), "juice.sqlite"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	// The postgres storage expires snapshots against the database's clock
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db, nil)
+	})
+}
+func TestFakeClockExpiry(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage, fake *clock.Fake) {
+		agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+
+		fake.Advance(29 * time.Second)
+		missing, err := db.SetAgentsMissingIfNotUpdatedFor(30 * time.Second)
+		compare(t, 0, len(missing), err)
+
+		fake.Advance(2 * time.Second)
+		missing, err = db.SetAgentsMissingIfNotUpdatedFor(30 * time.Second)
+		compare(t, []string{agent.Id}, missing, err)
+
+		fake.Advance(4 * time.Minute)
+		err = db.RemoveMissingAgentsIfNotUpdatedFor(5 * time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+
+		placed, err := db.GetAgentById(agent.Id)
+		compare(t, restapi.AgentMissing, placed.State, err)
+
+		fake.Advance(2 * time.Minute)
+		err = db.RemoveMissingAgentsIfNotUpdatedFor(5 * time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = db.GetAgentById(agent.Id)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		sessionId := queueSession(t, db, createSessionRequirements())
+
+		queued, err := db.GetQueuedSessionById(sessionId)
+		compare(t, fake.Now().Unix(), queued.RequestedAt.Unix(), err)
+
+		fake.Advance(9 * time.Minute)
+		canceled, err := db.CancelUnclaimedSessionsOlderThan(10 * time.Minute)
+		compare(t, 0, canceled, err)
+
+		fake.Advance(2 * time.Minute)
+		canceled, err = db.CancelUnclaimedSessionsOlderThan(10 * time.Minute)
+		compare(t, 1, canceled, err)
+
+		closed, err := db.GetSessionsClosedWithin(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count := 0
+		for closed.Next() {
+			count++
+		}
+		compare(t, 1, count, nil)
+
+		fake.Advance(2 * time.Minute)
+		closed, err = db.GetSessionsClosedWithin(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare(t, false, closed.Next(), nil)
+	}
+
+	// The postgres storage does its expiry math against the database's clock
+	start := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("memdb", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := memdb.OpenStorage(clock.NewContext(context.Background(), fake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := bolt.OpenStorage(clock.NewContext(context.Background(), fake), filepath.Join(t.TempDir(), "juice.db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := sqlite.OpenStorage(clock.NewContext(context.Background(), fake), filepath.Join(t.TempDir(), "juice.sqlite"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+}
+
+func TestLeases(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage, fake *clock.Fake) {
+		_, err := db.GetLease(restapi.SchedulerLease)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		acquiredAt := fake.Now()
+		lease, err := db.AcquireLease(restapi.SchedulerLease, "first", 15*time.Second)
+		compare(t, "first", lease.Holder, err)
+		compare(t, acquiredAt.Add(15*time.Second).Unix(), lease.ExpiresAt.Unix(), nil)
+
+		// Held by another holder until it expires
+		fake.Advance(10 * time.Second)
+		lease, err = db.AcquireLease(restapi.SchedulerLease, "second", 15*time.Second)
+		compare(t, "first", lease.Holder, err)
+
+		// Renewing keeps when the lease was acquired
+		lease, err = db.AcquireLease(restapi.SchedulerLease, "first", 15*time.Second)
+		compare(t, "first", lease.Holder, err)
+		compare(t, acquiredAt.Unix(), lease.AcquiredAt.Unix(), nil)
+		compare(t, fake.Now().Add(15*time.Second).Unix(), lease.ExpiresAt.Unix(), nil)
+
+		lease, err = db.GetLease(restapi.SchedulerLease)
+		compare(t, "first", lease.Holder, err)
+
+		fake.Advance(16 * time.Second)
+		_, err = db.GetLease(restapi.SchedulerLease)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected storage.ErrNotFound, instead received %v", err)
+		}
+
+		lease, err = db.AcquireLease(restapi.SchedulerLease, "second", 15*time.Second)
+		compare(t, "second", lease.Holder, err)
+		compare(t, fake.Now().Unix(), lease.AcquiredAt.Unix(), nil)
+
+		// Only the holder releases the lease
+		err = db.ReleaseLease(restapi.SchedulerLease, "first")
+		compare(t, nil, err, nil)
+
+		lease, err = db.GetLease(restapi.SchedulerLease)
+		compare(t, "second", lease.Holder, err)
+
+		err = db.ReleaseLease(restapi.SchedulerLease, "second")
+		compare(t, nil, err, nil)
+
+		lease, err = db.AcquireLease(restapi.SchedulerLease, "first", 15*time.Second)
+		compare(t, "first", lease.Holder, err)
+	}
+
+	// The postgres storage expires leases against the database's clock
+	start := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("memdb", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := memdb.OpenStorage(clock.NewContext(context.Background(), fake))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := bolt.OpenStorage(clock.NewContext(context.Background(), fake), filepath.Join(t.TempDir(), "juice.db"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		fake := clock.NewFake(start)
+		db, err := sqlite.OpenStorage(clock.NewContext(context.Background(), fake), filepath.Join(t.TempDir(), "juice.sqlite"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		run(t, db, fake)
+	})
+}
+
+func TestPausedPoolsAndFeatureOverrides(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		pools, err := db.GetPausedPools()
+		compare(t, []string{}, pools, err)
+
+		for _, pool := range []string{"render", "batch", "render"} {
+			err = db.SetPoolPaused(pool, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pools, err = db.GetPausedPools()
+		compare(t, []string{"batch", "render"}, pools, err)
+
+		// Resuming a pool that is not paused changes nothing
+		for _, pool := range []string{"render", "training"} {
+			err = db.SetPoolPaused(pool, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pools, err = db.GetPausedPools()
+		compare(t, []string{"batch"}, pools, err)
+
+		overrides, err := db.GetFeatureOverrides()
+		compare(t, []storage.FeatureOverride{}, overrides, err)
+
+		for _, override := range []storage.FeatureOverride{
+			{Name: "perGpuSessionLimits", Enabled: true},
+			{Name: "localityScheduling", Enabled: false},
+			{Name: "perGpuSessionLimits", Enabled: false},
+		} {
+			err = db.SetFeatureOverride(override)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		overrides, err = db.GetFeatureOverrides()
+		compare(t, []storage.FeatureOverride{
+			{Name: "localityScheduling", Enabled: false},
+			{Name: "perGpuSessionLimits", Enabled: false},
+		}, overrides, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestConfigResources(t *testing.T) {
+	run := func(t *testing.T, db storage.Storage) {
+		updatedAt := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+		resource := func(kind string, name string, spec string) restapi.ConfigResource {
+			return restapi.ConfigResource{
+				Kind:      kind,
+				Name:      name,
+				Spec:      json.RawMessage(spec),
+				UpdatedAt: updatedAt,
+			}
+		}
+
+		// The specs as compacted with their keys sorted, postgresql returns them formatted
+		getResources := func(kind string) ([]restapi.ConfigResource, error) {
+			resources, err := db.GetConfigResources(kind)
+			for index, resource := range resources {
+				var spec map[string]any
+				err = errors.Join(err, json.Unmarshal(resource.Spec, &spec))
+				resources[index].Spec, _ = json.Marshal(spec)
+			}
+			return resources, err
+		}
+
+		resources, err := getResources(restapi.ConfigQuota)
+		compare(t, []restapi.ConfigResource{}, resources, err)
+
+		for _, resource := range []restapi.ConfigResource{
+			resource(restapi.ConfigQuota, "research", `{"guaranteedGpus":2}`),
+			resource(restapi.ConfigQuota, "ml", `{"guaranteedGpus":1}`),
+			resource(restapi.ConfigRoleBinding, "ml", `{"roles":["admin"],"users":["alice"]}`),
+			resource(restapi.ConfigQuota, "research", `{"guaranteedGpus":4}`),
+		} {
+			err = db.PutConfigResource(resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Replaced by name within their kind, ordered by name
+		resources, err = getResources(restapi.ConfigQuota)
+		compare(t, []restapi.ConfigResource{
+			resource(restapi.ConfigQuota, "ml", `{"guaranteedGpus":1}`),
+			resource(restapi.ConfigQuota, "research", `{"guaranteedGpus":4}`),
+		}, resources, err)
+
+		err = db.DeleteConfigResource(restapi.ConfigQuota, "ml")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.DeleteConfigResource(restapi.ConfigQuota, "ml")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected ErrNotFound deleting a deleted resource, instead received %v", err)
+		}
+
+		resources, err = getResources(restapi.ConfigQuota)
+		compare(t, []restapi.ConfigResource{
+			resource(restapi.ConfigQuota, "research", `{"guaranteedGpus":4}`),
+		}, resources, err)
+
+		resources, err = getResources(restapi.ConfigRoleBinding)
+		compare(t, []restapi.ConfigResource{
+			resource(restapi.ConfigRoleBinding, "ml", `{"roles":["admin"],"users":["alice"]}`),
+		}, resources, err)
+	}
+
+	t.Run("memdb", func(t *testing.T) {
+		db := openMemdb(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db := openBolt(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		db := openSqlite(t)
+		defer db.Close()
+		run(t, db)
+	})
+
+	t.Run("postgresql", func(t *testing.T) {
+		db := openPostgres(t)
+		defer db.Close()
+		run(t, db)
+	})
+}
+
+func TestBoltPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "juice.db")
+
+	db, err := bolt.OpenStorage(context.Background(), path, nil)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+	sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+	err = db.Close()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	db, err = bolt.OpenStorage(context.Background(), path, nil)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer db.Close()
+
+	reopened, err := db.GetAgentById(agent.Id)
+	compare(t, agent.Hostname, reopened.Hostname, err)
+
+	session, err := db.GetSessionById(sessionId)
+	compare(t, restapi.SessionQueued, session.State, err)
+}
+
+func TestSqlitePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "juice.sqlite")
+
+	db, err := sqlite.OpenStorage(context.Background(), path, nil)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	agent := registerAgent(t, db, defaultAgent(24*1024*1024*1024))
+	sessionId := queueSession(t, db, defaultSessionRequirements(4*1024*1024*1024))
+
+	err = db.Close()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	db, err = sqlite.OpenStorage(context.Background(), path, nil)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer db.Close()
+
+	reopened, err := db.GetAgentById(agent.Id)
+	compare(t, agent.Hostname, reopened.Hostname, err)
+
+	session, err := db.GetSessionById(sessionId)
+	compare(t, restapi.SessionQueued, session.State, err)
+}
+
+func TestSecretRotation(t *testing.T) {
+	// Loads a keyring of the keys with the ids given, the first being the primary
+	loadKeyring := func(t *testing.T, ids ...string) *crypto.Keyring {
+		lines := ""
+		for _, id := range ids {
+			key := make([]byte, 32)
+			copy(key, id)
+			lines += id + ":" + base64.StdEncoding.EncodeToString(key) + "\n"
+		}
+
+		path := filepath.Join(t.TempDir(), "keys")
+		err := os.WriteFile(path, []byte(lines), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyring, err := crypto.LoadKeyring(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyring
+	}
+
+	run := func(t *testing.T, open func(keyring *crypto.Keyring) (storage.Storage, error)) {
+		db, err := open(loadKeyring(t, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hostname := uuid.NewString()
+		err = db.ImportExpectedAgents([]restapi.ExpectedAgent{
+			{
+				Hostname: hostname,
+				Labels:   map[string]string{},
+				Taints:   map[string]string{},
+				Token:    "token",
+			},
+		})
+		if err == nil {
+			err = db.PutConfigResource(restapi.ConfigResource{
+				Kind: restapi.ConfigWebhook,
+				Name: "billing",
+				Spec: json.RawMessage(`{"secret":"s3cret","url":"https://example.com"}`),
+			})
+		}
+		if err == nil {
+			err = db.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Encrypted at rest, they cannot be read without the key
+		db, err = open(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.GetExpectedAgentByHostname(hostname)
+		if err == nil {
+			t.Error("expected reading the expected agent's token without the keyring to fail")
+		}
+
+		_, err = db.GetConfigResources(restapi.ConfigWebhook)
+		if err == nil {
+			t.Error("expected reading the webhook's secret without the keyring to fail")
+		}
+
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Re-encrypted with the new primary key, keeping the old key to decrypt them
+		db, err = open(loadKeyring(t, "b", "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rotated, err := db.RotateSecrets()
+		compare(t, 2, rotated, err)
+
+		rotated, err = db.RotateSecrets()
+		compare(t, 0, rotated, err)
+
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Readable once the old key is removed
+		db, err = open(loadKeyring(t, "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		expected, err := db.GetExpectedAgentByHostname(hostname)
+		compare(t, "token", expected.Token, err)
+
+		resources, err := db.GetConfigResources(restapi.ConfigWebhook)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var subscription restapi.WebhookSubscription
+		if len(resources) == 1 {
+			err = json.Unmarshal(resources[0].Spec, &subscription)
+		}
+		compare(t, "s3cret", subscription.Secret, err)
+	}
+
+	t.Run("bolt", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "juice.db")
+		run(t, func(keyring *crypto.Keyring) (storage.Storage, error) {
+			return bolt.OpenStorage(context.Background(), path, keyring)
+		})
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "juice.sqlite")
+		run(t, func(keyring *crypto.Keyring) (storage.Storage, error) {
+			return sqlite.OpenStorage(context.Background(), path, keyring)
+		})
+	})
+}
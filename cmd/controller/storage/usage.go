@@ -0,0 +1,49 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Returns the month the usage of a session closed at the time is aggregated in
+func UsageMonth(closedAt time.Time) string {
+	return closedAt.UTC().Format("2006-01")
+}
+
+// Adds the usage of the closed session to the aggregate, for drivers without a query language to
+// aggregate it. See restapi.UsageAggregate.SessionSeconds for the duration of the session.
+func AddSessionUsage(aggregate *restapi.UsageAggregate, session restapi.Session, requestedAt time.Time, closedAt time.Time) {
+	duration := closedAt.Sub(requestedAt)
+	if session.Release != nil && !session.Release.StartedAt.IsZero() && session.Release.EndedAt.After(session.Release.StartedAt) {
+		duration = session.Release.EndedAt.Sub(session.Release.StartedAt)
+	}
+
+	if duration < 0 {
+		duration = 0
+	}
+
+	aggregate.Sessions++
+	aggregate.SessionSeconds += duration.Seconds()
+	aggregate.GpuSeconds += duration.Seconds() * float64(len(session.Gpus))
+
+	if session.Network != nil {
+		aggregate.BytesSent += session.Network.BytesSent
+		aggregate.BytesReceived += session.Network.BytesReceived
+	}
+}
+
+// Orders usage aggregates by month then tenant
+func SortUsageAggregates(aggregates []restapi.UsageAggregate) {
+	sort.Slice(aggregates, func(i, j int) bool {
+		if aggregates[i].Month != aggregates[j].Month {
+			return aggregates[i].Month < aggregates[j].Month
+		}
+
+		return aggregates[i].Tenant < aggregates[j].Tenant
+	})
+}
@@ -0,0 +1,50 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package storage
+
+import (
+	"sync"
+)
+
+// Fans out agent change notifications to the functions given to Storage.WatchAgents
+type AgentWatchers struct {
+	mutex sync.Mutex
+
+	nextId   int
+	watchers map[int]func(agentId string)
+}
+
+// Registers notify, returning a function to unregister it
+func (watchers *AgentWatchers) Watch(notify func(agentId string)) func() {
+	watchers.mutex.Lock()
+	defer watchers.mutex.Unlock()
+
+	if watchers.watchers == nil {
+		watchers.watchers = map[int]func(agentId string){}
+	}
+
+	id := watchers.nextId
+	watchers.nextId++
+
+	watchers.watchers[id] = notify
+
+	return func() {
+		watchers.mutex.Lock()
+		defer watchers.mutex.Unlock()
+
+		delete(watchers.watchers, id)
+	}
+}
+
+// Notifies every watcher of the change, an empty agentId notifies that changes may have been missed
+func (watchers *AgentWatchers) Notify(agentIds ...string) {
+	watchers.mutex.Lock()
+	defer watchers.mutex.Unlock()
+
+	for _, notify := range watchers.watchers {
+		for _, agentId := range agentIds {
+			notify(agentId)
+		}
+	}
+}
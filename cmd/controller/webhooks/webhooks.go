@@ -0,0 +1,504 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Posts the lifecycle changes of sessions and agents recorded in the journal to webhook URLs, so
+// billing and alerting systems react to them without polling the controller.
+//
+// Each URL follows the journal from a cursor kept in the storage, the webhooks of the events
+// published while the controller was stopped are posted once it restarts, as long as they are
+// kept by --journal-retention.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/journal"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	webhookSecretFile = flag.String("webhook-secret-file", "", "File holding the secret webhooks are signed with, see restapi.WebhookSignatureHeader. Required with --webhook-urls")
+	webhookAttempts   = flag.Int("webhook-attempts", 5, "Attempts made to post a webhook to a URL before giving up")
+	webhookBackoff    = flag.Duration("webhook-backoff", time.Second, "Wait before retrying a webhook that failed, doubled after each attempt up to --webhook-max-backoff")
+	webhookMaxBackoff = flag.Duration("webhook-max-backoff", time.Minute, "Maximum wait between the attempts to post a webhook")
+	_                 = flag.Int("webhook-queue-size", 1024, "Deprecated: Webhooks are posted from the journal, waiting in it as long as --journal-retention")
+
+	webhookUrls  []string
+	webhookTypes = append([]string{}, restapi.WebhookTypes...)
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &webhookUrls}, "webhook-urls", "A comma-separated list of the URLs the lifecycle changes of sessions and agents are posted to, see restapi.Webhook")
+	flag.Var(&utilities.CommaValue{Value: &webhookTypes}, "webhook-events", "A comma-separated list of the webhooks posted, from session.queued, session.assigned, session.failed, session.closed, agent.registered, and agent.missing")
+}
+
+const webhookTimeout = 10 * time.Second
+
+// Results of the webhooks recorded by prometheus.ObserveWebhook
+const (
+	resultDelivered = "delivered"
+	resultFailed    = "failed"
+)
+
+// Journal entries read at a time by each URL
+const journalBatch = 100
+
+// Webhook ids are derived from their event so the webhooks posted again after a restart keep
+// theirs, see restapi.Webhook
+var webhookNamespace = uuid.MustParse("592b4c3f-914b-49b6-849e-cad72640dac2")
+
+// How often the subscriptions applied through the API are checked for changes, they are reloaded
+// from the storage every --config-resources-refresh
+const subscriptionsCheck = time.Second
+
+// A URL the webhooks are posted to
+type target struct {
+	// Of the cursor the URL follows the journal from
+	cursor string
+
+	url    string
+	secret []byte
+	// The webhooks posted
+	types map[string]struct{}
+
+	// Stops the delivery of a subscription removed or changed through the API
+	cancel context.CancelFunc
+}
+
+type Dispatcher struct {
+	journal *journal.Journal
+	storage storage.Storage
+	client  *http.Client
+
+	// The --webhook-urls
+	targets []*target
+
+	// The subscriptions applied through the API, see restapi.ConfigWebhook
+	resources *resources.Store
+	// By the name of their resource, with the spec they were started with
+	subscriptions map[string]*target
+	specs         map[string]restapi.WebhookSubscription
+}
+
+// Returns the webhooks of the types, every webhook when none are set
+func typesOf(webhookTypes []string) (map[string]struct{}, error) {
+	types := map[string]struct{}{}
+	for _, webhookType := range webhookTypes {
+		webhookType = strings.TrimSpace(webhookType)
+		if webhookType == "" {
+			continue
+		}
+
+		known := false
+		for _, supported := range restapi.WebhookTypes {
+			known = known || supported == webhookType
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown webhook %s", webhookType)
+		}
+
+		types[webhookType] = struct{}{}
+	}
+
+	if len(types) == 0 {
+		for _, webhookType := range restapi.WebhookTypes {
+			types[webhookType] = struct{}{}
+		}
+	}
+
+	return types, nil
+}
+
+// Returns nil when --webhook-urls is not set and there is no store of the subscriptions applied
+// through the API
+func NewDispatcher(mutations *journal.Journal, storage storage.Storage, store *resources.Store) (*Dispatcher, error) {
+	urls := []string{}
+	for _, webhookUrl := range webhookUrls {
+		webhookUrl = strings.TrimSpace(webhookUrl)
+		if webhookUrl != "" {
+			urls = append(urls, webhookUrl)
+		}
+	}
+
+	if len(urls) == 0 && store == nil {
+		return nil, nil
+	}
+
+	if *webhookAttempts < 1 {
+		return nil, errors.New("--webhook-attempts must be at least 1")
+	}
+
+	dispatcher := &Dispatcher{
+		journal: mutations,
+		storage: storage,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+		},
+		targets:       []*target{},
+		resources:     store,
+		subscriptions: map[string]*target{},
+		specs:         map[string]restapi.WebhookSubscription{},
+	}
+
+	if len(urls) == 0 {
+		return dispatcher, nil
+	}
+
+	for _, webhookUrl := range urls {
+		err := resources.ValidateWebhookUrl(webhookUrl)
+		if err != nil {
+			return nil, fmt.Errorf("--webhook-urls: %v", err)
+		}
+	}
+
+	if *webhookSecretFile == "" {
+		return nil, errors.New("--webhook-secret-file is required with --webhook-urls")
+	}
+
+	secret, err := os.ReadFile(*webhookSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", *webhookSecretFile, err)
+	}
+
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("--webhook-secret-file: %s is empty", *webhookSecretFile)
+	}
+
+	types, err := typesOf(webhookTypes)
+	if err != nil {
+		return nil, fmt.Errorf("--webhook-events: %v", err)
+	}
+
+	for _, webhookUrl := range urls {
+		dispatcher.targets = append(dispatcher.targets, &target{
+			cursor: "webhook-urls/" + webhookUrl,
+			url:    webhookUrl,
+			secret: secret,
+			types:  types,
+		})
+	}
+
+	return dispatcher, nil
+}
+
+// Returns the webhook sent for the event, false for events no webhook is sent for
+func webhookOf(event restapi.Event) (restapi.Webhook, bool) {
+	webhook := restapi.Webhook{
+		Time:      event.Time,
+		SessionId: event.SessionId,
+		AgentId:   event.AgentId,
+		Event:     event,
+	}
+
+	switch event.Type {
+	case restapi.EventSessionStateChanged:
+		webhook.State = event.Data["state"]
+		webhook.ExitStatus = event.Data["exitStatus"]
+
+		switch webhook.State {
+		case restapi.SessionQueued:
+			webhook.Type = restapi.WebhookSessionQueued
+		case restapi.SessionAssigned:
+			webhook.Type = restapi.WebhookSessionAssigned
+		case restapi.SessionClosed:
+			webhook.Type = restapi.WebhookSessionClosed
+			if webhook.ExitStatus == restapi.ExitStatusFailure {
+				webhook.Type = restapi.WebhookSessionFailed
+			}
+		default:
+			return restapi.Webhook{}, false
+		}
+
+	case restapi.EventAgentStateChanged:
+		// Agents stay active once registered, the frontend only publishes the state of active
+		// agents when they register
+		if event.Data["state"] != restapi.AgentActive {
+			return restapi.Webhook{}, false
+		}
+		webhook.Type = restapi.WebhookAgentRegistered
+
+	case restapi.EventAgentMissing:
+		webhook.Type = restapi.WebhookAgentMissing
+
+	default:
+		return restapi.Webhook{}, false
+	}
+
+	webhook.Id = uuid.NewSHA1(webhookNamespace, []byte(strconv.FormatUint(event.Sequence, 10))).String()
+	return webhook, true
+}
+
+func (dispatcher *Dispatcher) start(group task.Group, target *target) {
+	ctx, cancel := context.WithCancel(group.Ctx())
+	target.cancel = cancel
+
+	group.GoFn("Webhooks "+target.url, func(group task.Group) error {
+		dispatcher.deliver(ctx, target)
+		return nil
+	})
+}
+
+// Returns the cursor of a subscription applied through the API
+func subscriptionCursor(name string) string {
+	return "webhook/" + name
+}
+
+// Starts the delivery to the subscriptions applied through the API and stops it for those
+// removed, restarting it for those changed from where it was
+func (dispatcher *Dispatcher) subscribe(group task.Group) {
+	specs := resources.Specs[restapi.WebhookSubscription](dispatcher.resources, restapi.ConfigWebhook)
+
+	for name, target := range dispatcher.subscriptions {
+		spec, found := specs[name]
+		if !found || !reflect.DeepEqual(spec, dispatcher.specs[name]) {
+			target.cancel()
+			delete(dispatcher.subscriptions, name)
+			delete(dispatcher.specs, name)
+
+			// A subscription applied again with the name starts from the journal's end
+			if !found {
+				err := dispatcher.storage.DeleteJournalCursor(subscriptionCursor(name))
+				if err != nil {
+					logger.Warningf("unable to remove the journal cursor of webhook %s, %v", name, err)
+				}
+			}
+		}
+	}
+
+	for name, spec := range specs {
+		if _, found := dispatcher.subscriptions[name]; found {
+			continue
+		}
+
+		// Validated when applied
+		types, err := typesOf(spec.Events)
+		if err != nil {
+			logger.Warningf("ignoring webhook %s, %v", name, err)
+			continue
+		}
+
+		target := &target{
+			cursor: subscriptionCursor(name),
+			url:    spec.Url,
+			secret: []byte(spec.Secret),
+			types:  types,
+		}
+		dispatcher.start(group, target)
+
+		dispatcher.subscriptions[name] = target
+		dispatcher.specs[name] = spec
+	}
+}
+
+// Webhooks are posted for the events published by every controller sharing the storage, only
+// the controller running the backend posts them
+func (dispatcher *Dispatcher) Run(group task.Group) error {
+	for _, target := range dispatcher.targets {
+		dispatcher.start(group, target)
+	}
+
+	dispatcher.subscribe(group)
+
+	ticker := time.NewTicker(subscriptionsCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+			dispatcher.subscribe(group)
+		}
+	}
+}
+
+// Returns the sequence the URL continues from, the journal's end for a URL that has not followed
+// it yet so the events published before it was added are not posted
+func (dispatcher *Dispatcher) load(target *target) (uint64, error) {
+	cursor, err := dispatcher.storage.GetJournalCursor(target.cursor)
+	if err == nil {
+		return cursor.Sequence, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return 0, err
+	}
+
+	sequence, err := dispatcher.journal.Sequence()
+	if err != nil {
+		return 0, err
+	}
+
+	return sequence, dispatcher.storage.PutJournalCursor(storage.JournalCursor{
+		Name:     target.cursor,
+		Sequence: sequence,
+	})
+}
+
+// Posts the webhooks of the events in the journal to the URL in order, a webhook is retried
+// before the next is posted. The cursor is recorded after each webhook, a webhook is posted again
+// after a restart only when the controller stopped while posting it.
+func (dispatcher *Dispatcher) deliver(ctx context.Context, target *target) {
+	var since uint64
+	loaded := false
+
+	for ctx.Err() == nil {
+		var err error
+		if !loaded {
+			since, err = dispatcher.load(target)
+			if err != nil {
+				logger.Warningf("unable to load the journal cursor of webhooks to %s, %v", target.url, err)
+				wait(ctx, *webhookBackoff)
+				continue
+			}
+			loaded = true
+		}
+
+		entries, next, missed, err := dispatcher.journal.Since(since, journalBatch)
+		if err != nil {
+			logger.Warningf("unable to read the journal for webhooks to %s, %v", target.url, err)
+			wait(ctx, *webhookBackoff)
+			continue
+		}
+
+		if missed {
+			logger.Warningf("webhooks to %s were not posted for the events removed from the journal by --journal-retention", target.url)
+		}
+
+		for _, entry := range entries {
+			if entry.Event == nil {
+				continue
+			}
+
+			webhook, found := webhookOf(*entry.Event)
+			if !found {
+				continue
+			}
+
+			if _, enabled := target.types[webhook.Type]; !enabled {
+				continue
+			}
+
+			if !dispatcher.attempt(ctx, target, webhook) {
+				return
+			}
+
+			dispatcher.advance(target, entry.Sequence)
+		}
+
+		if next == since {
+			dispatcher.journal.Wait(ctx, since)
+			continue
+		}
+
+		dispatcher.advance(target, next)
+		since = next
+	}
+}
+
+// Records the sequence the URL continues from, a failure is retried with the next
+func (dispatcher *Dispatcher) advance(target *target, sequence uint64) {
+	err := dispatcher.storage.PutJournalCursor(storage.JournalCursor{
+		Name:     target.cursor,
+		Sequence: sequence,
+	})
+	if err != nil {
+		logger.Warningf("unable to record the journal cursor of webhooks to %s, %v", target.url, err)
+	}
+}
+
+// Posts the webhook up to --webhook-attempts times, returns false when ctx is done first
+func (dispatcher *Dispatcher) attempt(ctx context.Context, target *target, webhook restapi.Webhook) bool {
+	backoff := *webhookBackoff
+
+	var err error
+	for attempt := 1; attempt <= *webhookAttempts; attempt++ {
+		err = dispatcher.post(ctx, target, webhook)
+		if err == nil || attempt == *webhookAttempts {
+			break
+		}
+
+		logger.Debugf("webhook %s %s to %s failed, attempt %d of %d, %v", webhook.Type, webhook.Id, target.url, attempt, *webhookAttempts, err)
+
+		if !wait(ctx, backoff) {
+			return false
+		}
+
+		backoff *= 2
+		if backoff > *webhookMaxBackoff {
+			backoff = *webhookMaxBackoff
+		}
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		prometheus.ObserveWebhook(webhook.Type, resultFailed)
+		logger.Warningf("gave up posting webhook %s %s to %s after %d attempts, %v", webhook.Type, webhook.Id, target.url, *webhookAttempts, err)
+		return true
+	}
+
+	prometheus.ObserveWebhook(webhook.Type, resultDelivered)
+	return true
+}
+
+// Returns false when ctx is done before duration passes
+func wait(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+func (dispatcher *Dispatcher) post(ctx context.Context, target *target, webhook restapi.Webhook) error {
+	body, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(restapi.WebhookSignatureHeader, restapi.SignWebhook(target.secret, body))
+
+	response, err := dispatcher.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("webhook responded with code %d, %s", response.StatusCode, string(message))
+	}
+
+	return nil
+}
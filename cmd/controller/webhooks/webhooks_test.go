@@ -0,0 +1,198 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/journal"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/resources"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/memdb"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const secret = "s3cret"
+
+// Receives the webhooks posted to the server, checking their signatures
+func receive(t *testing.T) (*httptest.Server, chan restapi.Webhook) {
+	received := make(chan restapi.Webhook, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !restapi.VerifyWebhook([]byte(secret), body, r.Header.Get(restapi.WebhookSignatureHeader)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var webhook restapi.Webhook
+		err = json.Unmarshal(body, &webhook)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- webhook
+	}))
+	t.Cleanup(server.Close)
+
+	return server, received
+}
+
+func publishQueued(t *testing.T, db storage.Storage) string {
+	t.Helper()
+
+	sessionId := uuid.NewString()
+	_, err := db.AppendEvent(restapi.Event{
+		Type:      restapi.EventSessionStateChanged,
+		Time:      time.Now(),
+		SessionId: sessionId,
+		Data:      map[string]string{"state": restapi.SessionQueued},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sessionId
+}
+
+func expectWebhook(t *testing.T, received chan restapi.Webhook, sessionId string) restapi.Webhook {
+	t.Helper()
+
+	select {
+	case webhook := <-received:
+		if webhook.Type != restapi.WebhookSessionQueued || webhook.SessionId != sessionId {
+			t.Fatalf("expected %s of session %s, instead received %s of session %s", restapi.WebhookSessionQueued, sessionId, webhook.Type, webhook.SessionId)
+		}
+		return webhook
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the webhook of session %s to be posted", sessionId)
+		return restapi.Webhook{}
+	}
+}
+
+func TestWebhooksReplayedAfterRestart(t *testing.T) {
+	err := flag.Set("journal-poll", "10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := memdb.OpenStorage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mutations, err := journal.New(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journaled := mutations.Wrap(db)
+
+	store, err := resources.Load(journaled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, received := receive(t)
+
+	spec, err := json.Marshal(restapi.WebhookSubscription{
+		Url:    server.URL,
+		Secret: secret,
+	})
+	if err == nil {
+		_, err = store.Put(restapi.ConfigResource{
+			Kind: restapi.ConfigWebhook,
+			Name: "billing",
+			Spec: spec,
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Runs a dispatcher until the returned function is called, as a controller would until it
+	// stops, once the subscription follows the journal
+	start := func() func() {
+		dispatcher, err := NewDispatcher(mutations, journaled, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group := task.NewTaskManager(context.Background())
+		group.Go("Webhooks", dispatcher)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, err := db.GetJournalCursor(subscriptionCursor("billing"))
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, storage.ErrNotFound) || time.Now().After(deadline) {
+				t.Fatalf("expected the subscription to follow the journal, %v", err)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return func() {
+			group.Cancel()
+			group.Wait()
+		}
+	}
+
+	stop := start()
+
+	first := publishQueued(t, journaled)
+	webhook := expectWebhook(t, received, first)
+
+	// A webhook is posted again when the controller stops before it is recorded as posted
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sequence, err := mutations.Sequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cursor, err := db.GetJournalCursor(subscriptionCursor("billing"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cursor.Sequence == sequence {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the subscription to follow the journal to %d, instead it is at %d", sequence, cursor.Sequence)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop()
+
+	// The event published while the controller was stopped is posted once it restarts, the
+	// one already posted is not posted again
+	second := publishQueued(t, journaled)
+
+	stop = start()
+	defer stop()
+
+	replayed := expectWebhook(t, received, second)
+	if replayed.Id == webhook.Id {
+		t.Errorf("expected the webhooks of different events to have different ids, both have %s", webhook.Id)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Runs the command with the arguments following its name
+type commandFn = func(group task.Group, args []string) error
+
+var commands = map[string]commandFn{
+	"agents":       runAgents,
+	"apply":        runApply,
+	"capacity":     runCapacity,
+	"cancel":       runCancel,
+	"delete-token": runDeleteToken,
+	"drain":        runDrain,
+	"gen-alerts":   runGenAlerts,
+	"label":        runLabel,
+	"migrate":      runMigrate,
+	"mint-token":   runMintToken,
+	"profile":      runProfile,
+	"queue":        runQueue,
+	"recording":    runRecording,
+	"resume":       runResume,
+	"revocations":  runRevocations,
+	"revoke":       runRevoke,
+	"session":      runSession,
+	"sessions":     runSessions,
+	"tokens":       runTokens,
+	"unrevoke":     runUnrevoke,
+}
+
+func usage() error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("usage: juicectl [options] <%s> [command options]", strings.Join(names, " | "))
+}
+
+func Run(group task.Group) error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return usage()
+	}
+
+	command, present := commands[args[0]]
+	if !present {
+		return errors.Join(fmt.Errorf("juicectl: unknown command %s", args[0]), usage())
+	}
+
+	return command(group, args[1:])
+}
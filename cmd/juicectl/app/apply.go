@@ -0,0 +1,645 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/manifest"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const applyUsage = "usage: juicectl apply [controller options] [--dry-run] [--prune] <manifest | -> ..."
+
+// Kinds of the resources declared by manifests
+const (
+	kindPool    = "pool"
+	kindFeature = "feature"
+	kindAgent   = "agent"
+	kindToken   = "token"
+)
+
+type poolSpec struct {
+	Paused bool `yaml:"paused"`
+}
+
+type featureSpec struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Agents are declared by hostname, as they register with a new id each time. With --prune the
+// labels and taints not declared are removed.
+type agentSpec struct {
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Taints map[string]string `yaml:"taints,omitempty"`
+}
+
+// A token whose user differs is deleted and minted again, the ttl only applies when it is minted
+type tokenSpec struct {
+	User string        `yaml:"user,omitempty"`
+	Ttl  time.Duration `yaml:"ttl,omitempty"`
+}
+
+// A change made to the controller to match the manifests, or that would be with --dry-run
+type change struct {
+	manifest.Change
+
+	// The token minted, only shown once
+	Token *restapi.ApiToken `json:"token,omitempty"`
+
+	apply func(ctx context.Context, api restapi.Client, change *change) error
+}
+
+// Plans the changes making the controller's resources of a kind match those declared
+type planFn = func(ctx context.Context, api restapi.Client, declared []manifest.Resource, prune bool) ([]change, error)
+
+type applyKind struct {
+	name string
+	spec func() any
+	plan planFn
+}
+
+// The kinds in the order they are applied
+var applyKinds = []applyKind{
+	{kindPool, func() any { return &poolSpec{} }, fetchPools},
+	{kindFeature, func() any { return &featureSpec{} }, fetchFeatures},
+	{kindAgent, func() any { return &agentSpec{} }, fetchAgents},
+	{kindToken, func() any { return &tokenSpec{} }, fetchTokens},
+	{restapi.ConfigQuota, restapi.ConfigKinds[restapi.ConfigQuota], fetchConfigResources(restapi.ConfigQuota)},
+	{restapi.ConfigRoleBinding, restapi.ConfigKinds[restapi.ConfigRoleBinding], fetchConfigResources(restapi.ConfigRoleBinding)},
+	{restapi.ConfigWebhook, restapi.ConfigKinds[restapi.ConfigWebhook], fetchConfigResources(restapi.ConfigWebhook)},
+	{restapi.ConfigTemplate, restapi.ConfigKinds[restapi.ConfigTemplate], fetchConfigResources(restapi.ConfigTemplate)},
+	{restapi.ConfigMaintenanceWindow, restapi.ConfigKinds[restapi.ConfigMaintenanceWindow], fetchConfigResources(restapi.ConfigMaintenanceWindow)},
+}
+
+// Reconciles the pools, feature flags, agent labels, API tokens, and the configuration resources
+// of the controller, its tenant quotas, role bindings, webhooks, session templates, and
+// maintenance windows, with the resources declared by YAML manifests, printing the changes made
+func runApply(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	dryRun := flags.Bool("dry-run", false, "Prints the changes without making them")
+	prune := flags.Bool("prune", false, "Also resumes the pools, resets the feature flags, removes the agent labels and taints, and deletes the tokens, quotas, role bindings, webhooks, templates, and maintenance windows the manifests do not declare, of the kinds they declare")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New(applyUsage)
+	}
+
+	kinds := manifest.Kinds{}
+	for _, kind := range applyKinds {
+		kinds[kind.name] = kind.spec
+	}
+
+	resources := []manifest.Resource{}
+	for _, path := range flags.Args() {
+		read, err := readManifest(path, kinds)
+		if err != nil {
+			return err
+		}
+
+		resources = append(resources, read...)
+	}
+
+	resources, err = uniqueResources(resources)
+	if err != nil {
+		return err
+	}
+
+	api, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	changes, err := planChanges(group.Ctx(), api, resources, *prune)
+	if err != nil {
+		return err
+	}
+
+	// Changes are printed as they are made, so those made before one fails are listed
+	for i := range changes {
+		if !*dryRun {
+			err = changes[i].apply(group.Ctx(), api, &changes[i])
+			if err != nil {
+				return errors.Join(fmt.Errorf("juicectl apply: %s", changes[i]), err)
+			}
+		}
+
+		if !options.structured() {
+			fmt.Fprintln(os.Stdout, changes[i])
+			if changes[i].Token != nil {
+				fmt.Fprintf(os.Stdout, "  token %s (%s) minted, it is not shown again:\n  %s\n", changes[i].Token.Name, changes[i].Token.Id, changes[i].Token.Token)
+			}
+		}
+	}
+
+	if options.structured() {
+		return options.print(changes)
+	}
+
+	if len(changes) == 0 {
+		fmt.Fprintln(os.Stderr, "no changes")
+	} else if *dryRun {
+		fmt.Fprintf(os.Stderr, "%d changes, none made with --dry-run\n", len(changes))
+	}
+
+	return nil
+}
+
+// Reads the resources of the YAML documents of the manifest, - reading stdin
+func readManifest(path string, kinds manifest.Kinds) ([]manifest.Resource, error) {
+	reader := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		reader = file
+	}
+
+	resources, err := manifest.Decode(reader, kinds)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return resources, nil
+}
+
+// Rejects the resources declared by more than one manifest
+func uniqueResources(resources []manifest.Resource) ([]manifest.Resource, error) {
+	declared := map[string]struct{}{}
+	for _, resource := range resources {
+		key := resource.Kind + "/" + resource.Name
+		if _, present := declared[key]; present {
+			return nil, fmt.Errorf("%s %s is declared more than once", resource.Kind, resource.Name)
+		}
+		declared[key] = struct{}{}
+	}
+
+	return resources, nil
+}
+
+// Returns the changes making the controller match the resources, in the order of applyKinds
+func planChanges(ctx context.Context, api restapi.Client, resources []manifest.Resource, prune bool) ([]change, error) {
+	changes := []change{}
+	for _, kind := range applyKinds {
+		declared := []manifest.Resource{}
+		for _, resource := range resources {
+			if resource.Kind == kind.name {
+				declared = append(declared, resource)
+			}
+		}
+
+		// Kinds without resources are left alone, even with --prune
+		if len(declared) == 0 {
+			continue
+		}
+
+		planned, err := kind.plan(ctx, api, declared, prune)
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, planned...)
+	}
+
+	return changes, nil
+}
+
+// Returns the fields of each resource by name
+func flattenResources[T any](resources map[string]T) (map[string]manifest.Fields, error) {
+	fields := map[string]manifest.Fields{}
+	for name, resource := range resources {
+		flattened, err := manifest.Flatten(resource)
+		if err != nil {
+			return nil, err
+		}
+
+		fields[name] = flattened
+	}
+
+	return fields, nil
+}
+
+// Returns the specs of the resources by name
+func specsOf[T any](resources []manifest.Resource) map[string]T {
+	specs := map[string]T{}
+	for _, resource := range resources {
+		specs[resource.Name] = *resource.Spec.(*T)
+	}
+
+	return specs
+}
+
+func fetchPools(ctx context.Context, api restapi.Client, declared []manifest.Resource, prune bool) ([]change, error) {
+	statuses, err := api.GetPoolSchedulingWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return planPools(statuses, specsOf[poolSpec](declared), prune)
+}
+
+// Pools are never deleted, with prune the paused pools not declared are resumed
+func planPools(statuses []restapi.PoolScheduling, declared map[string]poolSpec, prune bool) ([]change, error) {
+	current := map[string]poolSpec{}
+	for _, status := range statuses {
+		current[status.Pool] = poolSpec{Paused: status.Paused}
+
+		if _, present := declared[status.Pool]; !present && prune {
+			declared[status.Pool] = poolSpec{}
+		}
+	}
+
+	// Pools are created as their sessions are queued, those declared before are not paused
+	for pool := range declared {
+		if _, present := current[pool]; !present {
+			current[pool] = poolSpec{}
+		}
+	}
+
+	currentFields, err := flattenResources(current)
+	if err != nil {
+		return nil, err
+	}
+
+	declaredFields, err := flattenResources(declared)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []change{}
+	for _, planned := range manifest.Plan(kindPool, currentFields, declaredFields, false) {
+		paused := declared[planned.Name].Paused
+		changes = append(changes, change{
+			Change: planned,
+			apply: func(ctx context.Context, api restapi.Client, change *change) error {
+				_, err := api.UpdatePoolSchedulingWithContext(ctx, change.Name, restapi.PoolSchedulingUpdate{
+					Paused: paused,
+				})
+				return err
+			},
+		})
+	}
+
+	return changes, nil
+}
+
+func fetchFeatures(ctx context.Context, api restapi.Client, declared []manifest.Resource, prune bool) ([]change, error) {
+	features, err := api.GetFeaturesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return planFeatures(features, specsOf[featureSpec](declared), prune)
+}
+
+// Features are never created or deleted, with prune those not declared are reset to their default
+func planFeatures(features []restapi.Feature, declared map[string]featureSpec, prune bool) ([]change, error) {
+	current := map[string]featureSpec{}
+	for _, feature := range features {
+		current[feature.Name] = featureSpec{Enabled: feature.Enabled}
+
+		if _, present := declared[feature.Name]; !present && prune {
+			declared[feature.Name] = featureSpec{Enabled: feature.Default}
+		}
+	}
+
+	for name := range declared {
+		if _, present := current[name]; !present {
+			return nil, fmt.Errorf("unknown feature %s, see GET /v1/features", name)
+		}
+	}
+
+	currentFields, err := flattenResources(current)
+	if err != nil {
+		return nil, err
+	}
+
+	declaredFields, err := flattenResources(declared)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []change{}
+	for _, planned := range manifest.Plan(kindFeature, currentFields, declaredFields, false) {
+		enabled := declared[planned.Name].Enabled
+		changes = append(changes, change{
+			Change: planned,
+			apply: func(ctx context.Context, api restapi.Client, change *change) error {
+				_, err := api.UpdateFeatureWithContext(ctx, change.Name, restapi.FeatureUpdate{
+					Enabled: enabled,
+				})
+				return err
+			},
+		})
+	}
+
+	return changes, nil
+}
+
+// Returns the patch making the current labels or taints match those declared, and describes it
+// as manifest.Diff does, the keys prefixed by field. Without prune, or when the field is not
+// declared, the current keys not declared are kept.
+func diffKeyValues(field string, current map[string]string, declared map[string]string, prune bool) (map[string]string, []string, []string) {
+	set := map[string]string{}
+	remove := []string{}
+	diff := []string{}
+
+	keys := make([]string, 0, len(declared))
+	for key := range declared {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, present := current[key]
+		if !present {
+			set[key] = declared[key]
+			diff = append(diff, fmt.Sprintf("+%s.%s=%s", field, key, declared[key]))
+		} else if value != declared[key] {
+			set[key] = declared[key]
+			diff = append(diff, fmt.Sprintf("~%s.%s=%s (was %s)", field, key, declared[key], value))
+		}
+	}
+
+	if prune && declared != nil {
+		keys = keys[:0]
+		for key := range current {
+			if _, present := declared[key]; !present {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			remove = append(remove, key)
+			diff = append(diff, fmt.Sprintf("-%s.%s", field, key))
+		}
+	}
+
+	return set, remove, diff
+}
+
+func fetchAgents(ctx context.Context, api restapi.Client, declared []manifest.Resource, prune bool) ([]change, error) {
+	agents, err := api.GetAgentsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return planAgents(agents, specsOf[agentSpec](declared), prune)
+}
+
+// Agents are never created or deleted, every agent registered with the hostname declared is
+// patched
+func planAgents(agents []restapi.Agent, declared map[string]agentSpec, prune bool) ([]change, error) {
+	hostnames := make([]string, 0, len(declared))
+	for hostname := range declared {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	changes := []change{}
+	for _, hostname := range hostnames {
+		spec := declared[hostname]
+
+		matched := false
+		for _, agent := range agents {
+			if agent.Hostname != hostname || agent.State == restapi.AgentClosed {
+				continue
+			}
+			matched = true
+
+			labels, removeLabels, labelsDiff := diffKeyValues("labels", agent.Labels, spec.Labels, prune)
+			taints, removeTaints, taintsDiff := diffKeyValues("taints", agent.Taints, spec.Taints, prune)
+			if len(labelsDiff) == 0 && len(taintsDiff) == 0 {
+				continue
+			}
+
+			id := agent.Id
+			patch := restapi.AgentLabelsPatch{
+				Labels:       labels,
+				RemoveLabels: removeLabels,
+				Taints:       taints,
+				RemoveTaints: removeTaints,
+			}
+
+			changes = append(changes, change{
+				Change: manifest.Change{
+					Action: manifest.Update,
+					Kind:   kindAgent,
+					Name:   fmt.Sprintf("%s (%s)", agent.Hostname, id),
+					Diff:   append(labelsDiff, taintsDiff...),
+				},
+				apply: func(ctx context.Context, api restapi.Client, change *change) error {
+					_, err := api.PatchAgentLabelsWithContext(ctx, id, patch)
+					return err
+				},
+			})
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("no agent with the hostname %s is registered", hostname)
+		}
+	}
+
+	return changes, nil
+}
+
+func fetchTokens(ctx context.Context, api restapi.Client, declared []manifest.Resource, prune bool) ([]change, error) {
+	tokens, err := api.GetApiTokensWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return planTokens(tokens, specsOf[tokenSpec](declared), prune)
+}
+
+// Tokens are minted when none has their name, and deleted and minted again when their user
+// differs or more than one has their name. The ttl of a token minted is not compared, it is only
+// set when minting.
+func planTokens(tokens []restapi.ApiToken, declared map[string]tokenSpec, prune bool) ([]change, error) {
+	current := map[string][]restapi.ApiToken{}
+	for _, token := range tokens {
+		current[token.Name] = append(current[token.Name], token)
+	}
+
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changes := []change{}
+	for _, name := range names {
+		spec := declared[name]
+		minted := current[name]
+		if len(minted) == 1 && minted[0].User == spec.User {
+			continue
+		}
+
+		request := restapi.ApiTokenRequest{
+			Name:       name,
+			User:       spec.User,
+			TtlSeconds: int(spec.Ttl.Seconds()),
+		}
+
+		change := change{
+			Change: manifest.Change{
+				Action: manifest.Create,
+				Kind:   kindToken,
+				Name:   name,
+			},
+			apply: func(ctx context.Context, api restapi.Client, change *change) error {
+				for _, token := range minted {
+					err := api.DeleteApiTokenWithContext(ctx, token.Id)
+					if err != nil {
+						return err
+					}
+				}
+
+				token, err := api.MintApiTokenWithContext(ctx, request)
+				if err == nil {
+					change.Token = &token
+				}
+				return err
+			},
+		}
+
+		if spec.User != "" {
+			change.Diff = append(change.Diff, fmt.Sprintf("+user=%s", spec.User))
+		}
+		if len(minted) > 0 {
+			change.Action = manifest.Replace
+			for _, token := range minted {
+				change.Diff = append(change.Diff, fmt.Sprintf("-%s (user %s)", token.Id, orNone(token.User)))
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	if prune {
+		for _, token := range tokens {
+			if _, present := declared[token.Name]; present {
+				continue
+			}
+
+			id := token.Id
+			changes = append(changes, change{
+				Change: manifest.Change{
+					Action: manifest.Delete,
+					Kind:   kindToken,
+					Name:   token.Name,
+					Diff:   []string{fmt.Sprintf("-%s (user %s)", id, orNone(token.User))},
+				},
+				apply: func(ctx context.Context, api restapi.Client, change *change) error {
+					return api.DeleteApiTokenWithContext(ctx, id)
+				},
+			})
+		}
+	}
+
+	return changes, nil
+}
+
+func fetchConfigResources(kind string) planFn {
+	return func(ctx context.Context, api restapi.Client, declared []manifest.Resource, prune bool) ([]change, error) {
+		resources, err := api.GetConfigResourcesWithContext(ctx, kind)
+		if err != nil {
+			return nil, err
+		}
+
+		return planConfigResources(kind, resources, declared, prune)
+	}
+}
+
+// Returns the spec as the controller returns it, a webhook's secret replaced by its SHA-256
+func comparableSpec(spec any) any {
+	if webhook, ok := spec.(*restapi.WebhookSubscription); ok {
+		redacted := *webhook
+		redacted.SecretSha256 = restapi.SecretSha256Of(webhook.Secret)
+		redacted.Secret = ""
+		return &redacted
+	}
+
+	return spec
+}
+
+// Configuration resources are created, replaced when their spec differs, and with prune deleted
+// when not declared. Secrets are compared by their SHA-256, the controller does not return them.
+func planConfigResources(kind string, resources []restapi.ConfigResource, declared []manifest.Resource, prune bool) ([]change, error) {
+	currentFields := map[string]manifest.Fields{}
+	for _, resource := range resources {
+		spec := restapi.ConfigKinds[kind]()
+		err := json.Unmarshal(resource.Spec, spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", kind, resource.Name, err)
+		}
+
+		currentFields[resource.Name], err = manifest.Flatten(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	specs := map[string]any{}
+	declaredFields := map[string]manifest.Fields{}
+	for _, resource := range declared {
+		fields, err := manifest.Flatten(comparableSpec(resource.Spec))
+		if err != nil {
+			return nil, err
+		}
+
+		specs[resource.Name] = resource.Spec
+		declaredFields[resource.Name] = fields
+	}
+
+	changes := []change{}
+	for _, planned := range manifest.Plan(kind, currentFields, declaredFields, prune) {
+		if planned.Action == manifest.Delete {
+			changes = append(changes, change{
+				Change: planned,
+				apply: func(ctx context.Context, api restapi.Client, change *change) error {
+					return api.DeleteConfigResourceWithContext(ctx, change.Kind, change.Name)
+				},
+			})
+			continue
+		}
+
+		spec, err := json.Marshal(specs[planned.Name])
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, change{
+			Change: planned,
+			apply: func(ctx context.Context, api restapi.Client, change *change) error {
+				_, err := api.PutConfigResourceWithContext(ctx, restapi.ConfigResource{
+					Kind: change.Kind,
+					Name: change.Name,
+					Spec: spec,
+				})
+				return err
+			},
+		})
+	}
+
+	return changes, nil
+}
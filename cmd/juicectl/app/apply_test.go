@@ -0,0 +1,409 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/manifest"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Returns the changes without their apply functions, which cannot be compared
+func plannedChanges(changes []change) []manifest.Change {
+	planned := []manifest.Change{}
+	for _, change := range changes {
+		planned = append(planned, change.Change)
+	}
+
+	return planned
+}
+
+func TestDiffKeyValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  map[string]string
+		declared map[string]string
+		prune    bool
+
+		set    map[string]string
+		remove []string
+		diff   []string
+	}{
+		{
+			name:     "create",
+			current:  map[string]string{},
+			declared: map[string]string{"gpu": "a100", "zone": "west"},
+			set:      map[string]string{"gpu": "a100", "zone": "west"},
+			remove:   []string{},
+			diff:     []string{"+labels.gpu=a100", "+labels.zone=west"},
+		},
+		{
+			name:     "update",
+			current:  map[string]string{"gpu": "a10", "zone": "west"},
+			declared: map[string]string{"gpu": "a100", "zone": "west"},
+			set:      map[string]string{"gpu": "a100"},
+			remove:   []string{},
+			diff:     []string{"~labels.gpu=a100 (was a10)"},
+		},
+		{
+			name:     "delete",
+			current:  map[string]string{"gpu": "a100", "zone": "west"},
+			declared: map[string]string{"gpu": "a100"},
+			prune:    true,
+			set:      map[string]string{},
+			remove:   []string{"zone"},
+			diff:     []string{"-labels.zone"},
+		},
+		{
+			name:     "kept without prune",
+			current:  map[string]string{"gpu": "a100", "zone": "west"},
+			declared: map[string]string{"gpu": "a100"},
+			set:      map[string]string{},
+			remove:   []string{},
+			diff:     []string{},
+		},
+		{
+			name:    "kept when not declared",
+			current: map[string]string{"gpu": "a100"},
+			prune:   true,
+			set:     map[string]string{},
+			remove:  []string{},
+			diff:    []string{},
+		},
+		{
+			name:     "no-op",
+			current:  map[string]string{"gpu": "a100", "zone": "west"},
+			declared: map[string]string{"zone": "west", "gpu": "a100"},
+			prune:    true,
+			set:      map[string]string{},
+			remove:   []string{},
+			diff:     []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set, remove, diff := diffKeyValues("labels", test.current, test.declared, test.prune)
+			if !reflect.DeepEqual(test.set, set) {
+				t.Errorf("expected to set %v, instead set %v", test.set, set)
+			}
+			if !reflect.DeepEqual(test.remove, remove) {
+				t.Errorf("expected to remove %v, instead removed %v", test.remove, remove)
+			}
+			if !reflect.DeepEqual(test.diff, diff) {
+				t.Errorf("expected the diff %q, instead received %q", test.diff, diff)
+			}
+		})
+	}
+}
+
+func TestPlanTokens(t *testing.T) {
+	tokens := []restapi.ApiToken{
+		{Id: "1", Name: "ci", User: "alice"},
+		{Id: "2", Name: "deploy", User: "bob"},
+		{Id: "3", Name: "render"},
+		{Id: "4", Name: "render"},
+	}
+
+	tests := []struct {
+		name     string
+		declared map[string]tokenSpec
+		prune    bool
+		expected []manifest.Change
+	}{
+		{
+			name: "create",
+			declared: map[string]tokenSpec{
+				"ci":      {User: "alice"},
+				"nightly": {User: "carol", Ttl: 24 * time.Hour},
+			},
+			expected: []manifest.Change{
+				{Action: manifest.Create, Kind: kindToken, Name: "nightly", Diff: []string{"+user=carol"}},
+			},
+		},
+		{
+			name: "replace",
+			declared: map[string]tokenSpec{
+				"deploy": {User: "carol"},
+				"render": {},
+			},
+			expected: []manifest.Change{
+				{Action: manifest.Replace, Kind: kindToken, Name: "deploy", Diff: []string{"+user=carol", "-2 (user bob)"}},
+				{Action: manifest.Replace, Kind: kindToken, Name: "render", Diff: []string{"-3 (user -)", "-4 (user -)"}},
+			},
+		},
+		{
+			name: "delete",
+			declared: map[string]tokenSpec{
+				"ci": {User: "alice"},
+			},
+			prune: true,
+			expected: []manifest.Change{
+				{Action: manifest.Delete, Kind: kindToken, Name: "deploy", Diff: []string{"-2 (user bob)"}},
+				{Action: manifest.Delete, Kind: kindToken, Name: "render", Diff: []string{"-3 (user -)"}},
+				{Action: manifest.Delete, Kind: kindToken, Name: "render", Diff: []string{"-4 (user -)"}},
+			},
+		},
+		{
+			name: "no-op",
+			declared: map[string]tokenSpec{
+				"ci":     {User: "alice"},
+				"deploy": {User: "bob", Ttl: time.Hour},
+			},
+			expected: []manifest.Change{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := planTokens(tokens, test.declared, test.prune)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if planned := plannedChanges(changes); !reflect.DeepEqual(test.expected, planned) {
+				t.Errorf("expected %+v, instead received %+v", test.expected, planned)
+			}
+		})
+	}
+}
+
+func TestPlanPools(t *testing.T) {
+	statuses := []restapi.PoolScheduling{
+		{Pool: "batch"},
+		{Pool: "interactive", Paused: true},
+		{Pool: "render", Paused: true},
+	}
+
+	tests := []struct {
+		name     string
+		declared map[string]poolSpec
+		prune    bool
+		expected []manifest.Change
+	}{
+		{
+			name: "create",
+			declared: map[string]poolSpec{
+				"training": {Paused: true},
+			},
+			expected: []manifest.Change{
+				{Action: manifest.Update, Kind: kindPool, Name: "training", Diff: []string{"~paused=true (was false)"}},
+			},
+		},
+		{
+			name: "update",
+			declared: map[string]poolSpec{
+				"batch":       {Paused: true},
+				"interactive": {Paused: false},
+			},
+			expected: []manifest.Change{
+				{Action: manifest.Update, Kind: kindPool, Name: "batch", Diff: []string{"~paused=true (was false)"}},
+				{Action: manifest.Update, Kind: kindPool, Name: "interactive", Diff: []string{"~paused=false (was true)"}},
+			},
+		},
+		{
+			name: "resumed with prune",
+			declared: map[string]poolSpec{
+				"interactive": {Paused: true},
+			},
+			prune: true,
+			expected: []manifest.Change{
+				{Action: manifest.Update, Kind: kindPool, Name: "render", Diff: []string{"~paused=false (was true)"}},
+			},
+		},
+		{
+			name: "no-op",
+			declared: map[string]poolSpec{
+				"batch":  {},
+				"render": {Paused: true},
+			},
+			prune:    false,
+			expected: []manifest.Change{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := planPools(statuses, test.declared, test.prune)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if planned := plannedChanges(changes); !reflect.DeepEqual(test.expected, planned) {
+				t.Errorf("expected %+v, instead received %+v", test.expected, planned)
+			}
+		})
+	}
+}
+
+func TestPlanFeatures(t *testing.T) {
+	features := []restapi.Feature{
+		{Name: "localityScheduling", Default: true, Enabled: false},
+		{Name: "perGpuSessionLimits", Default: true, Enabled: true},
+	}
+
+	changes, err := planFeatures(features, map[string]featureSpec{"perGpuSessionLimits": {Enabled: false}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []manifest.Change{
+		{Action: manifest.Update, Kind: kindFeature, Name: "localityScheduling", Diff: []string{"~enabled=true (was false)"}},
+		{Action: manifest.Update, Kind: kindFeature, Name: "perGpuSessionLimits", Diff: []string{"~enabled=false (was true)"}},
+	}
+	if planned := plannedChanges(changes); !reflect.DeepEqual(expected, planned) {
+		t.Errorf("expected %+v, instead received %+v", expected, planned)
+	}
+
+	_, err = planFeatures(features, map[string]featureSpec{"fastPath": {Enabled: true}}, false)
+	if err == nil {
+		t.Error("expected an unknown feature to be rejected")
+	}
+}
+
+func TestPlanAgents(t *testing.T) {
+	agents := []restapi.Agent{
+		{Id: "1", Hostname: "gpu-1", State: restapi.AgentActive, Labels: map[string]string{"gpu": "a10"}, Taints: map[string]string{"maintenance": "true"}},
+		{Id: "2", Hostname: "gpu-1", State: restapi.AgentClosed, Labels: map[string]string{}},
+		{Id: "3", Hostname: "gpu-2", State: restapi.AgentActive, Labels: map[string]string{"gpu": "a100"}},
+	}
+
+	changes, err := planAgents(agents, map[string]agentSpec{
+		"gpu-1": {Labels: map[string]string{"gpu": "a100"}, Taints: map[string]string{}},
+		"gpu-2": {Labels: map[string]string{"gpu": "a100"}},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []manifest.Change{
+		{Action: manifest.Update, Kind: kindAgent, Name: "gpu-1 (1)", Diff: []string{"~labels.gpu=a100 (was a10)", "-taints.maintenance"}},
+	}
+	if planned := plannedChanges(changes); !reflect.DeepEqual(expected, planned) {
+		t.Errorf("expected %+v, instead received %+v", expected, planned)
+	}
+
+	_, err = planAgents(agents, map[string]agentSpec{"gpu-3": {}}, false)
+	if err == nil {
+		t.Error("expected an agent not registered to be rejected")
+	}
+}
+
+func TestPlanConfigResources(t *testing.T) {
+	current := []restapi.ConfigResource{
+		{Kind: restapi.ConfigQuota, Name: "ml", Spec: json.RawMessage(`{"guaranteedGpus":1}`)},
+		{Kind: restapi.ConfigQuota, Name: "research", Spec: json.RawMessage(`{"guaranteedGpus":2,"burstGpus":4}`)},
+	}
+
+	tests := []struct {
+		name     string
+		declared map[string]restapi.TenantQuota
+		prune    bool
+		expected []manifest.Change
+	}{
+		{
+			name: "create",
+			declared: map[string]restapi.TenantQuota{
+				"ml":     {GuaranteedGpus: 1},
+				"render": {GuaranteedGpus: 3},
+			},
+			expected: []manifest.Change{
+				{Action: manifest.Create, Kind: restapi.ConfigQuota, Name: "render", Diff: []string{"+guaranteedGpus=3"}},
+			},
+		},
+		{
+			name: "update",
+			declared: map[string]restapi.TenantQuota{
+				"research": {GuaranteedGpus: 2},
+			},
+			expected: []manifest.Change{
+				{Action: manifest.Update, Kind: restapi.ConfigQuota, Name: "research", Diff: []string{"-burstGpus"}},
+			},
+		},
+		{
+			name: "delete",
+			declared: map[string]restapi.TenantQuota{
+				"ml": {GuaranteedGpus: 1},
+			},
+			prune: true,
+			expected: []manifest.Change{
+				{Action: manifest.Delete, Kind: restapi.ConfigQuota, Name: "research"},
+			},
+		},
+		{
+			name: "no-op",
+			declared: map[string]restapi.TenantQuota{
+				"ml":       {GuaranteedGpus: 1},
+				"research": {GuaranteedGpus: 2, BurstGpus: 4},
+			},
+			prune:    true,
+			expected: []manifest.Change{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			declared := []manifest.Resource{}
+			for name, quota := range test.declared {
+				quota := quota
+				declared = append(declared, manifest.Resource{Kind: restapi.ConfigQuota, Name: name, Spec: &quota})
+			}
+
+			changes, err := planConfigResources(restapi.ConfigQuota, current, declared, test.prune)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if planned := plannedChanges(changes); !reflect.DeepEqual(test.expected, planned) {
+				t.Errorf("expected %+v, instead received %+v", test.expected, planned)
+			}
+		})
+	}
+}
+
+func TestPlanWebhookSecrets(t *testing.T) {
+	current := []restapi.ConfigResource{
+		{
+			Kind: restapi.ConfigWebhook,
+			Name: "billing",
+			Spec: json.RawMessage(`{"url":"https://billing.example.com","secretSha256":"` + restapi.SecretSha256Of("s3cret") + `"}`),
+		},
+	}
+
+	declare := func(secret string) []manifest.Resource {
+		return []manifest.Resource{{
+			Kind: restapi.ConfigWebhook,
+			Name: "billing",
+			Spec: &restapi.WebhookSubscription{Url: "https://billing.example.com", Secret: secret},
+		}}
+	}
+
+	// The secret the controller holds is compared by its SHA-256
+	changes, err := planConfigResources(restapi.ConfigWebhook, current, declare("s3cret"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, instead received %+v", plannedChanges(changes))
+	}
+
+	changes, err = planConfigResources(restapi.ConfigWebhook, current, declare("rotated"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []manifest.Change{
+		{Action: manifest.Update, Kind: restapi.ConfigWebhook, Name: "billing", Diff: []string{
+			fmt.Sprintf("~secretSha256=%s (was %s)", restapi.SecretSha256Of("rotated"), restapi.SecretSha256Of("s3cret")),
+		}},
+	}
+	if planned := plannedChanges(changes); !reflect.DeepEqual(expected, planned) {
+		t.Errorf("expected %+v, instead received %+v", expected, planned)
+	}
+}
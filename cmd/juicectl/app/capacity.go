@@ -0,0 +1,80 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const capacityUsage = "usage: juicectl capacity [controller options]"
+
+func formatExhaustion(forecast restapi.CapacityForecast) string {
+	if forecast.Exhausted {
+		return "now"
+	}
+
+	if forecast.ExhaustedAt.IsZero() {
+		return "-"
+	}
+
+	return fmt.Sprintf("in %s", time.Until(forecast.ExhaustedAt).Round(time.Minute))
+}
+
+// Prints the capacity of each pool and why its queued sessions are not placed, answering whether
+// the pools need more GPUs
+func runCapacity(group task.Group, args []string) error {
+	api, options, _, err := parseControllerCommand("capacity", capacityUsage, args, 0)
+	if err != nil {
+		return err
+	}
+
+	capacities, err := api.GetCapacityWithContext(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(capacities)
+	}
+
+	rows := make([]string, 0, len(capacities))
+	for _, capacity := range capacities {
+		rows = append(rows, fmt.Sprintf("%s\t%d/%d\t%d/%d\t%d/%d MiB\t%d MiB, %d GPUs\t%.0f%%\t%d\t%s",
+			capacity.Pool, capacity.AllocatableAgents, capacity.Agents, capacity.AllocatableGpus, capacity.Gpus,
+			capacity.AllocatableVram/(1024*1024), capacity.Vram/(1024*1024),
+			capacity.CommittedVram/(1024*1024), capacity.CommittedGpus,
+			capacity.Fragmentation*100, capacity.Queued, formatExhaustion(capacity.Forecast)))
+	}
+
+	err = printTable("POOL\tAGENTS\tGPUS\tVRAM\tCOMMITTED\tFRAGMENTATION\tQUEUED\tEXHAUSTED", rows)
+	if err != nil {
+		return err
+	}
+
+	rows = []string{}
+	for _, capacity := range capacities {
+		for _, blocker := range capacity.Blockers {
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%d\t%d MiB\t%s",
+				capacity.Pool, blocker.Reason, blocker.Sessions, blocker.VramRequired/(1024*1024),
+				time.Since(blocker.OldestQueued).Round(time.Second)))
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err = io.WriteString(os.Stdout, "\n")
+	if err != nil {
+		return err
+	}
+
+	return printTable("POOL\tBLOCKER\tSESSIONS\tVRAM REQUIRED\tOLDEST", rows)
+}
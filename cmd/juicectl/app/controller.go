@@ -0,0 +1,577 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage"
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+// The options of the commands talking to the controller
+type controllerOptions struct {
+	address    *string
+	token      *string
+	disableTls *bool
+	caFile     *string
+	output     *string
+	json       *bool
+}
+
+// Formats of --output
+const (
+	outputTable = "table"
+	outputJson  = "json"
+	outputYaml  = "yaml"
+)
+
+func addControllerFlags(flags *flag.FlagSet) controllerOptions {
+	return controllerOptions{
+		address:    flags.String("controller", os.Getenv("JUICE_CONTROLLER"), "The IP address or hostname and port of the controller, defaults to $JUICE_CONTROLLER"),
+		token:      flags.String("controller-token", os.Getenv("JUICE_CONTROLLER_TOKEN"), "Bearer token presented to the controller, required when its authorization policy restricts the admin endpoints to tokens, defaults to $JUICE_CONTROLLER_TOKEN"),
+		disableTls: flags.Bool("disable-tls", false, "Connect to the controller over http rather than https"),
+		caFile:     flags.String("ca-file", "", "Certificates of the authorities the controller's certificate is verified against, the system's when not set"),
+		output:     flags.String("output", outputTable, "Prints the controller's responses as table, json, or yaml. JSON and YAML have the same fields as the controller's REST API responses"),
+		json:       flags.Bool("json", false, "Deprecated: Use --output json instead"),
+	}
+}
+
+func (options controllerOptions) client() (restapi.Client, error) {
+	if *options.output != outputTable && *options.output != outputJson && *options.output != outputYaml {
+		return restapi.Client{}, fmt.Errorf("--output must be table, json, or yaml, not %s", *options.output)
+	}
+
+	if *options.address == "" {
+		return restapi.Client{}, errors.New("--controller or $JUICE_CONTROLLER must be set")
+	}
+
+	tlsConfig := &tls.Config{}
+	if *options.caFile != "" {
+		pool, err := crypto.AppendCertsFromFile(nil, *options.caFile)
+		if err != nil {
+			return restapi.Client{}, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	api := restapi.Client{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		Scheme:  "https",
+		Address: *options.address,
+		Token:   *options.token,
+	}
+
+	if *options.disableTls {
+		api.Scheme = "http"
+	}
+
+	return api, nil
+}
+
+// Parses the command's flags, returning the client and the arguments following the flags
+func parseControllerCommand(name string, usage string, args []string, argCount int) (restapi.Client, controllerOptions, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	options := addControllerFlags(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return restapi.Client{}, options, nil, err
+	}
+
+	if flags.NArg() != argCount {
+		return restapi.Client{}, options, nil, errors.New(usage)
+	}
+
+	api, err := options.client()
+	return api, options, flags.Args(), err
+}
+
+// Returns the format responses are printed in, see --output
+func (options controllerOptions) format() string {
+	if *options.json {
+		return outputJson
+	}
+
+	return *options.output
+}
+
+// Returns whether responses are printed as JSON or YAML rather than as tables
+func (options controllerOptions) structured() bool {
+	return options.format() != outputTable
+}
+
+// Prints the value as YAML with --output yaml, JSON otherwise
+func (options controllerOptions) print(value any) error {
+	if options.format() == outputYaml {
+		return utilities.WriteYaml(os.Stdout, value)
+	}
+
+	return printJson(value)
+}
+
+func printJson(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Prints the rows as a table with the header, columns separated by tabs
+func printTable(header string, rows []string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, header)
+	for _, row := range rows {
+		fmt.Fprintln(writer, row)
+	}
+
+	return writer.Flush()
+}
+
+func formatGpus(gpus []restapi.SessionGpu, cpuFallback bool) string {
+	if cpuFallback {
+		return "cpu"
+	}
+
+	indices := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		indices = append(indices, strconv.Itoa(gpu.Index))
+	}
+
+	return strings.Join(indices, ",")
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+// The options filtering and paging the agents and sessions listed, see restapi.ListQuery
+type listOptions struct {
+	state   *string
+	labels  *string
+	gpuName *string
+	offset  *int
+	limit   *int
+	cursor  *string
+}
+
+func addListFlags(flags *flag.FlagSet) listOptions {
+	return listOptions{
+		state:   flags.String("state", "", "Lists only the agents or sessions in this state"),
+		labels:  flags.String("labels", "", "Comma separated list of key=value labels, lists only the agents with every label or the sessions placed on them"),
+		gpuName: flags.String("gpu", "", "Lists only the agents with a GPU of this name, or the sessions using one"),
+		offset:  flags.Int("offset", 0, "Skips this many agents or sessions, ordered by id"),
+		limit:   flags.Int("limit", 0, "Lists at most this many agents or sessions, ordered by id, every one when 0"),
+		cursor:  flags.String("cursor", "", "Lists the page after the one that printed the cursor from the snapshot of the listing taken by its first page, so no item is skipped or listed twice. Cursors expire 10 minutes after the first page. The filters must be the same, not used with --offset"),
+	}
+}
+
+func (options listOptions) query() (restapi.ListQuery, error) {
+	query := restapi.ListQuery{
+		State:   *options.state,
+		GpuName: *options.gpuName,
+		Offset:  *options.offset,
+		Limit:   *options.limit,
+		Cursor:  *options.cursor,
+	}
+
+	if query.Cursor != "" && query.Offset != 0 {
+		return restapi.ListQuery{}, errors.New("--cursor and --offset may not both be set")
+	}
+
+	if *options.labels != "" {
+		query.Labels = map[string]string{}
+		for _, label := range strings.Split(*options.labels, ",") {
+			key, value, found := strings.Cut(label, "=")
+			if !found || key == "" {
+				return restapi.ListQuery{}, fmt.Errorf("--labels: %s must be of the form key=value", label)
+			}
+
+			query.Labels[key] = value
+		}
+	}
+
+	return query, nil
+}
+
+// Parses the flags of a listing command, returning the client and the query
+func parseListCommand(name string, usage string, args []string) (restapi.Client, controllerOptions, restapi.ListQuery, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	list := addListFlags(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return restapi.Client{}, options, restapi.ListQuery{}, err
+	}
+
+	if flags.NArg() != 0 {
+		return restapi.Client{}, options, restapi.ListQuery{}, errors.New(usage)
+	}
+
+	query, err := list.query()
+	if err != nil {
+		return restapi.Client{}, options, restapi.ListQuery{}, err
+	}
+
+	api, err := options.client()
+	return api, options, query, err
+}
+
+// Tells how many were left out when the listing is a page, and the cursor listing the next
+func printPageFooter[T any](query restapi.ListQuery, page restapi.ListPage[T]) {
+	listed := len(page.Items)
+	if listed < page.Total {
+		if query.Cursor == "" {
+			fmt.Fprintf(os.Stderr, "%d to %d of %d\n", query.Offset+1, query.Offset+listed, page.Total)
+		} else {
+			fmt.Fprintf(os.Stderr, "%d of %d\n", listed, page.Total)
+		}
+	}
+
+	if page.NextCursor != "" {
+		fmt.Fprintf(os.Stderr, "next page: --cursor %s\n", page.NextCursor)
+	}
+}
+
+const agentsUsage = "usage: juicectl agents [controller options] [--state <state>] [--labels <key=value,...>] [--gpu <name>] [--offset <offset> | --cursor <cursor>] [--limit <limit>]"
+
+func runAgents(group task.Group, args []string) error {
+	api, options, query, err := parseListCommand("agents", agentsUsage, args)
+	if err != nil {
+		return err
+	}
+
+	page, err := api.QueryAgentsWithContext(group.Ctx(), query)
+	if err != nil {
+		return err
+	}
+
+	agents := page.Items
+
+	// Printed to stderr, after the page
+	defer printPageFooter(query, page)
+
+	if options.structured() {
+		return options.print(agents)
+	}
+
+	// Pages are ordered by id
+	if query.Offset == 0 && query.Limit == 0 && query.Cursor == "" {
+		sort.Slice(agents, func(i, j int) bool {
+			return agents[i].Hostname < agents[j].Hostname
+		})
+	}
+
+	rows := make([]string, 0, len(agents))
+	for _, agent := range agents {
+		var vramAvailable uint64
+		unhealthy := 0
+		for _, gpu := range agent.Gpus {
+			vramAvailable += gpu.VramAvailable
+			if gpu.Metrics.Unhealthy != "" {
+				unhealthy++
+			}
+		}
+
+		gpus := fmt.Sprint(len(agent.Gpus))
+		if unhealthy > 0 {
+			gpus = fmt.Sprintf("%d (%d unhealthy)", len(agent.Gpus), unhealthy)
+		}
+
+		version := agent.Version
+		if agent.Rootless {
+			version = fmt.Sprintf("%s (rootless)", agent.Version)
+		}
+
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%t\t%s\t%s\t%d/%d MiB\t%d\t%s",
+			agent.Id, agent.Hostname, agent.State, agent.Draining, storage.Pool(agent.Labels),
+			gpus, vramAvailable/(1024*1024), storage.TotalVram(agent.Gpus)/(1024*1024), len(agent.Sessions), version))
+	}
+
+	return printTable("ID\tHOSTNAME\tSTATE\tDRAINING\tPOOL\tGPUS\tVRAM AVAILABLE\tSESSIONS\tVERSION", rows)
+}
+
+const sessionsUsage = "usage: juicectl sessions [controller options] [--state <state>] [--labels <key=value,...>] [--gpu <name>] [--offset <offset> | --cursor <cursor>] [--limit <limit>]"
+
+func runSessions(group task.Group, args []string) error {
+	api, options, query, err := parseListCommand("sessions", sessionsUsage, args)
+	if err != nil {
+		return err
+	}
+
+	page, err := api.QuerySessionsWithContext(group.Ctx(), query)
+	if err != nil {
+		return err
+	}
+
+	sessions := page.Items
+
+	// Printed to stderr, after the page
+	defer printPageFooter(query, page)
+
+	if options.structured() {
+		return options.print(sessions)
+	}
+
+	// Pages are ordered by id
+	if query.Offset == 0 && query.Limit == 0 && query.Cursor == "" {
+		sort.Slice(sessions, func(i, j int) bool {
+			if sessions[i].Hostname != sessions[j].Hostname {
+				return sessions[i].Hostname < sessions[j].Hostname
+			}
+			return sessions[i].Id < sessions[j].Id
+		})
+	}
+
+	rows := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%t",
+			session.Id, session.State, session.Hostname, formatGpus(session.Gpus, session.CpuFallback),
+			orNone(session.Tenant), orNone(session.User), session.Persistent))
+	}
+
+	return printTable("ID\tSTATE\tAGENT\tGPUS\tTENANT\tUSER\tPERSISTENT", rows)
+}
+
+const sessionUsage = "usage: juicectl session [controller options] <id>"
+
+// Prints the session as JSON, or YAML with --output yaml, tables leave out too much of it to inspect
+func runSession(group task.Group, args []string) error {
+	api, options, args, err := parseControllerCommand("session", sessionUsage, args, 1)
+	if err != nil {
+		return err
+	}
+
+	session, err := api.GetSessionWithContext(group.Ctx(), args[0])
+	if err != nil {
+		return err
+	}
+
+	return options.print(session)
+}
+
+const cancelUsage = "usage: juicectl cancel [controller options] <session id>"
+
+func runCancel(group task.Group, args []string) error {
+	api, options, args, err := parseControllerCommand("cancel", cancelUsage, args, 1)
+	if err != nil {
+		return err
+	}
+
+	session, err := api.CancelSessionWithContext(group.Ctx(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(session)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "session %s is %s\n", session.Id, session.State)
+	return err
+}
+
+const drainUsage = "usage: juicectl drain [controller options] <agent id>"
+const resumeUsage = "usage: juicectl resume [controller options] <agent id>"
+
+func runDrain(group task.Group, args []string) error {
+	api, options, args, err := parseControllerCommand("drain", drainUsage, args, 1)
+	if err != nil {
+		return err
+	}
+
+	agent, err := api.DrainAgentWithContext(group.Ctx(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(agent)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "agent %s (%s) is draining, %d sessions left to finish\n", agent.Id, agent.Hostname, len(agent.Sessions))
+	return err
+}
+
+func runResume(group task.Group, args []string) error {
+	api, options, args, err := parseControllerCommand("resume", resumeUsage, args, 1)
+	if err != nil {
+		return err
+	}
+
+	agent, err := api.ResumeAgentWithContext(group.Ctx(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(agent)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "agent %s (%s) is no longer draining\n", agent.Id, agent.Hostname)
+	return err
+}
+
+const labelUsage = "usage: juicectl label [controller options] [--taint] <agent id> <key=value | key->..."
+
+// Parses kubectl style key=value arguments setting keys and key- arguments removing them
+func parseLabelArgs(args []string) (map[string]string, []string, error) {
+	set := map[string]string{}
+	remove := []string{}
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if found && key != "" {
+			set[key] = value
+		} else if removed, found := strings.CutSuffix(arg, "-"); found && removed != "" && !strings.Contains(removed, "=") {
+			remove = append(remove, removed)
+		} else {
+			return nil, nil, fmt.Errorf("%s must be key=value or key-, %s", arg, labelUsage)
+		}
+	}
+
+	return set, remove, nil
+}
+
+// Adds, replaces, and removes labels, or taints with --taint, of a live agent
+func runLabel(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("label", flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	taint := flags.Bool("taint", false, "Change the agent's taints rather than its labels")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() < 2 {
+		return errors.New(labelUsage)
+	}
+
+	set, remove, err := parseLabelArgs(flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	patch := restapi.AgentLabelsPatch{
+		Labels:       set,
+		RemoveLabels: remove,
+	}
+	if *taint {
+		patch = restapi.AgentLabelsPatch{
+			Taints:       set,
+			RemoveTaints: remove,
+		}
+	}
+
+	api, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	agent, err := api.PatchAgentLabelsWithContext(group.Ctx(), flags.Arg(0), patch)
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(agent)
+	}
+
+	keyValues := agent.Labels
+	name := "labels"
+	if *taint {
+		keyValues = agent.Taints
+		name = "taints"
+	}
+
+	pairs := make([]string, 0, len(keyValues))
+	for key, value := range keyValues {
+		pairs = append(pairs, fmt.Sprint(key, "=", value))
+	}
+	sort.Strings(pairs)
+
+	_, err = fmt.Fprintf(os.Stdout, "agent %s (%s) %s: %s\n", agent.Id, agent.Hostname, name, strings.Join(pairs, ","))
+	return err
+}
+
+const queueUsage = "usage: juicectl queue [controller options]"
+
+// Prints the scheduling state of each pool followed by the queued sessions in the order they are
+// placed
+func runQueue(group task.Group, args []string) error {
+	api, options, _, err := parseControllerCommand("queue", queueUsage, args, 0)
+	if err != nil {
+		return err
+	}
+
+	pools, err := api.GetPoolSchedulingWithContext(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	sessions, err := api.GetQueueWithContext(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(struct {
+			Pools    []restapi.PoolScheduling `json:"pools"`
+			Sessions []restapi.QueuedSession  `json:"sessions"`
+		}{pools, sessions})
+	}
+
+	rows := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		lastPass := "-"
+		if !pool.LastPassAt.IsZero() {
+			lastPass = fmt.Sprintf("%s ago, %.3fs, %d assigned", time.Since(pool.LastPassAt).Round(time.Second), pool.LastPassSeconds, pool.LastPassAssigned)
+		}
+
+		rows = append(rows, fmt.Sprintf("%s\t%t\t%t\t%d\t%s", pool.Pool, pool.Paused, pool.Running, pool.Queued, lastPass))
+	}
+
+	err = printTable("POOL\tPAUSED\tRUNNING\tQUEUED\tLAST PASS", rows)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(os.Stdout, "\n")
+	if err != nil {
+		return err
+	}
+
+	rows = make([]string, 0, len(sessions))
+	for index, session := range sessions {
+		rows = append(rows, fmt.Sprintf("%d\t%s\t%s\t%d\t%s\t%s\t%d\t%d MiB\t%s",
+			index+1, session.Id, session.Pool, session.Requirements.Priority, orNone(session.Requirements.Class), orNone(session.Requirements.Tenant),
+			len(session.Requirements.Gpus), storage.TotalVramRequired(session.Requirements)/(1024*1024), time.Since(session.RequestedAt).Round(time.Second)))
+	}
+
+	return printTable("POSITION\tID\tPOOL\tPRIORITY\tCLASS\tTENANT\tGPUS\tVRAM REQUIRED\tWAITING", rows)
+}
@@ -0,0 +1,330 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/prometheus/metrics"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+const genAlertsUsage = "usage: juicectl gen-alerts [--pools <pool>[=<queued>],...] [--output <file>] [rule options]"
+
+// A Prometheus rule file, see https://prometheus.io/docs/prometheus/latest/configuration/alerting_rules/
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type rulesConfig struct {
+	// The pools to alert on and the number of queued sessions that saturate each, all pools when empty
+	pools []poolThreshold
+
+	queueSaturation    int
+	queueSaturationFor time.Duration
+
+	missingAgents       int
+	missingAgentsWindow time.Duration
+
+	sloWindow                  time.Duration
+	sloAssignmentLatency       time.Duration
+	sloAssignmentObjective     float64
+	sloSessionSuccessObjective float64
+	sloBurnRateWarning         float64
+	sloFor                     time.Duration
+}
+
+type poolThreshold struct {
+	pool   string
+	queued int
+}
+
+// Parses the pools, each either a name or a name and the number of queued sessions that saturate it
+func parsePools(entries []string, queued int) ([]poolThreshold, error) {
+	pools := make([]poolThreshold, 0, len(entries))
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+
+		pool := poolThreshold{
+			pool:   entry,
+			queued: queued,
+		}
+
+		if name, threshold, found := strings.Cut(entry, "="); found {
+			value, err := strconv.Atoi(threshold)
+			if err != nil || value <= 0 {
+				return nil, fmt.Errorf("gen-alerts: invalid number of queued sessions for pool %s, %s", name, threshold)
+			}
+
+			pool.pool = name
+			pool.queued = value
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+func promDuration(duration time.Duration) string {
+	return model.Duration(duration).String()
+}
+
+// Returns the label matchers, pairs of labels and values, restricted to the configured pools
+func (config rulesConfig) selector(matchers ...string) string {
+	terms := []string{}
+	for i := 0; i+1 < len(matchers); i += 2 {
+		terms = append(terms, fmt.Sprintf("%s=%q", matchers[i], matchers[i+1]))
+	}
+
+	if len(config.pools) > 0 {
+		names := make([]string, 0, len(config.pools))
+		for _, pool := range config.pools {
+			names = append(names, regexp.QuoteMeta(pool.pool))
+		}
+
+		terms = append(terms, fmt.Sprintf("%s=~%q", metrics.LabelPool, strings.Join(names, "|")))
+	}
+
+	if len(terms) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(terms, ",") + "}"
+}
+
+func (config rulesConfig) recordingRules() []rule {
+	queuedAverage := fmt.Sprintf("%s:%s:avg_over_time%s", metrics.LabelPool, metrics.Name(metrics.PoolQueued), promDuration(config.queueSaturationFor))
+	agentsDelta := fmt.Sprintf("%s:%s:delta%s", metrics.LabelStatus, metrics.Name(metrics.AgentsByStatus), promDuration(config.missingAgentsWindow))
+
+	rules := []rule{
+		{
+			Record: queuedAverage,
+			Expr:   fmt.Sprintf("avg_over_time(%s[%s])", metrics.Name(metrics.PoolQueued), promDuration(config.queueSaturationFor)),
+		},
+		{
+			Record: agentsDelta,
+			Expr:   fmt.Sprintf("sum by (%s) (delta(%s[%s]))", metrics.LabelStatus, metrics.Name(metrics.AgentsByStatus), promDuration(config.missingAgentsWindow)),
+		},
+	}
+
+	// The controller reports burn rates, the error ratio over the window is the burn rate times the error budget
+	objectives := []struct {
+		indicator string
+		objective float64
+	}{
+		{restapi.SloAssignmentLatency, config.sloAssignmentObjective},
+		{restapi.SloSessionSuccess, config.sloSessionSuccessObjective},
+	}
+
+	for _, objective := range objectives {
+		rules = append(rules, rule{
+			Record: fmt.Sprintf("%s_%s:%s:error_ratio%s", metrics.LabelPool, metrics.LabelIndicator, metrics.Name(metrics.SloBurnRate), promDuration(config.sloWindow)),
+			Expr:   fmt.Sprintf("%s{%s=%q} * %.6g", metrics.Name(metrics.SloBurnRate), metrics.LabelIndicator, objective.indicator, 1-objective.objective),
+		})
+	}
+
+	return rules
+}
+
+func (config rulesConfig) queueRules() []rule {
+	notPaused := fmt.Sprintf("unless on (%s) %s == 1", metrics.LabelPool, metrics.Name(metrics.PoolPaused))
+	annotations := map[string]string{
+		"summary":     "Sessions are queuing in pool {{ $labels.pool }}",
+		"description": fmt.Sprintf("{{ $value }} sessions have been queued in pool {{ $labels.pool }} for %s, its agents are out of capacity or the scheduler is not assigning them", promDuration(config.queueSaturationFor)),
+	}
+
+	if len(config.pools) == 0 {
+		return []rule{
+			{
+				Alert:       "JuiceControllerQueueSaturated",
+				Expr:        fmt.Sprintf("%s > %d %s", metrics.Name(metrics.PoolQueued), config.queueSaturation, notPaused),
+				For:         promDuration(config.queueSaturationFor),
+				Labels:      map[string]string{"severity": "warning"},
+				Annotations: annotations,
+			},
+		}
+	}
+
+	rules := make([]rule, 0, len(config.pools))
+	for _, pool := range config.pools {
+		rules = append(rules, rule{
+			Alert:       "JuiceControllerQueueSaturated",
+			Expr:        fmt.Sprintf("%s{%s=%q} > %d %s", metrics.Name(metrics.PoolQueued), metrics.LabelPool, pool.pool, pool.queued, notPaused),
+			For:         promDuration(config.queueSaturationFor),
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: annotations,
+		})
+	}
+
+	return rules
+}
+
+func (config rulesConfig) sloRules(alert string, indicator string, objective string) []rule {
+	burnRate := fmt.Sprintf("%s%s", metrics.Name(metrics.SloBurnRate), config.selector(metrics.LabelIndicator, indicator))
+
+	return []rule{
+		{
+			Alert:  alert + "BudgetBurn",
+			Expr:   fmt.Sprintf("%s > %g", burnRate, config.sloBurnRateWarning),
+			For:    promDuration(config.sloFor),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Pool {{ $labels.pool }} is burning its %s error budget", indicator),
+				"description": fmt.Sprintf("Over the last %s, pool {{ $labels.pool }} used {{ $value | humanizePercentage }} of the error budget of its objective, %s", promDuration(config.sloWindow), objective),
+			},
+		},
+		{
+			Alert:  alert + "BudgetExhausted",
+			Expr:   fmt.Sprintf("%s >= 1", burnRate),
+			For:    promDuration(config.sloFor),
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Pool {{ $labels.pool }} exhausted its %s error budget", indicator),
+				"description": fmt.Sprintf("Over the last %s, pool {{ $labels.pool }} missed its objective, %s", promDuration(config.sloWindow), objective),
+			},
+		},
+	}
+}
+
+func (config rulesConfig) alertingRules() []rule {
+	rules := config.queueRules()
+
+	rules = append(rules, rule{
+		Alert:  "JuiceControllerAgentsMissing",
+		Expr:   fmt.Sprintf("%s:%s:delta%s{%s=%q} >= %d", metrics.LabelStatus, metrics.Name(metrics.AgentsByStatus), promDuration(config.missingAgentsWindow), metrics.LabelStatus, restapi.AgentMissing, config.missingAgents),
+		Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{
+			"summary":     "Agents stopped reporting to the controller",
+			"description": fmt.Sprintf("{{ $value }} more agents went missing over the last %s", promDuration(config.missingAgentsWindow)),
+		},
+	})
+
+	rules = append(rules, config.sloRules("JuiceControllerAssignmentLatency", restapi.SloAssignmentLatency,
+		fmt.Sprintf("%.6g%% of sessions assigned within %s", config.sloAssignmentObjective*100, config.sloAssignmentLatency))...)
+	rules = append(rules, config.sloRules("JuiceControllerSessionSuccess", restapi.SloSessionSuccess,
+		fmt.Sprintf("%.6g%% of closed sessions not failed", config.sloSessionSuccessObjective*100))...)
+
+	return rules
+}
+
+func (config rulesConfig) rules() ruleFile {
+	return ruleFile{
+		Groups: []ruleGroup{
+			{
+				Name:  "juice-controller.rules",
+				Rules: config.recordingRules(),
+			},
+			{
+				Name:  "juice-controller.alerts",
+				Rules: config.alertingRules(),
+			},
+		},
+	}
+}
+
+func runGenAlerts(group task.Group, args []string) error {
+	pools := []string{}
+
+	flags := flag.NewFlagSet("gen-alerts", flag.ContinueOnError)
+	flags.Var(&utilities.CommaValue{Value: &pools}, "pools", "A comma-separated list of the pools to alert on, each optionally followed by =<queued> to override --queue-saturation, all pools when not set")
+	output := flags.String("output", "", "The rule file to write, defaults to stdout")
+	queueSaturation := flags.Int("queue-saturation", 20, "Alert when more sessions than this are queued in a pool that is not paused")
+	queueSaturationFor := flags.Duration("queue-saturation-for", 10*time.Minute, "How long sessions must stay queued above --queue-saturation before alerting")
+	missingAgents := flags.Int("missing-agents", 3, "Alert when this many more agents are missing than --missing-agents-window ago")
+	missingAgentsWindow := flags.Duration("missing-agents-window", 10*time.Minute, "The window over which agents going missing are counted")
+	sloWindow := flags.Duration("slo-window", time.Hour, "The controller's --slo-window")
+	sloAssignmentLatency := flags.Duration("slo-assignment-latency", 30*time.Second, "The controller's --slo-assignment-latency")
+	sloAssignmentObjective := flags.Float64("slo-assignment-latency-objective", 0.99, "The controller's --slo-assignment-latency-objective")
+	sloSessionSuccessObjective := flags.Float64("slo-session-success-objective", 0.99, "The controller's --slo-session-success-objective")
+	sloBurnRateWarning := flags.Float64("slo-burn-rate-warning", 0.5, "Warn when a pool has used more than this fraction of an error budget, alerts are critical once it is used up")
+	sloFor := flags.Duration("slo-for", 5*time.Minute, "How long an error budget must be burning before alerting")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		return errors.New(genAlertsUsage)
+	}
+
+	if *queueSaturation <= 0 || *missingAgents <= 0 {
+		return errors.New("gen-alerts: --queue-saturation and --missing-agents must be positive")
+	}
+
+	for _, objective := range []float64{*sloAssignmentObjective, *sloSessionSuccessObjective} {
+		if objective <= 0 || objective >= 1 {
+			return fmt.Errorf("gen-alerts: invalid objective %g, objectives are between 0 and 1", objective)
+		}
+	}
+
+	config := rulesConfig{
+		queueSaturation:            *queueSaturation,
+		queueSaturationFor:         *queueSaturationFor,
+		missingAgents:              *missingAgents,
+		missingAgentsWindow:        *missingAgentsWindow,
+		sloWindow:                  *sloWindow,
+		sloAssignmentLatency:       *sloAssignmentLatency,
+		sloAssignmentObjective:     *sloAssignmentObjective,
+		sloSessionSuccessObjective: *sloSessionSuccessObjective,
+		sloBurnRateWarning:         *sloBurnRateWarning,
+		sloFor:                     *sloFor,
+	}
+
+	config.pools, err = parsePools(pools, *queueSaturation)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("# Generated by juicectl gen-alerts from the metrics exported by the controller\n")
+
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+
+	err = encoder.Encode(config.rules())
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(buffer.Bytes())
+		return err
+	}
+
+	return os.WriteFile(*output, buffer.Bytes(), 0644)
+}
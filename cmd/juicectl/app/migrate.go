@@ -0,0 +1,96 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/controller/storage/postgres"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const migrateUsage = "usage: juicectl migrate (--psql-connection <connection> | --psql-connection-from-file <file>) [--to <version> | --rollback] [--dry-run]"
+
+func runMigrate(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	psqlConnection := flags.String("psql-connection", "", "See https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters")
+	psqlConnectionFromFile := flags.String("psql-connection-from-file", "", "See https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters")
+	to := flags.Int("to", postgres.LatestSchemaVersion(), "The schema version to migrate to, migrations after it are rolled back")
+	rollback := flags.Bool("rollback", false, "Rolls back the latest migration applied to the schema")
+	dryRun := flags.Bool("dry-run", false, "Lists the migrations that would be applied or rolled back without changing the schema")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		return errors.New(migrateUsage)
+	}
+
+	connection := *psqlConnection
+	if *psqlConnectionFromFile != "" {
+		if connection != "" {
+			return errors.New("migrate: --psql-connection and --psql-connection-from-file are mutually exclusive, one or the other but not both")
+		}
+
+		text, err := os.ReadFile(*psqlConnectionFromFile)
+		if err != nil {
+			return fmt.Errorf("unable to read file %s, %v", *psqlConnectionFromFile, err)
+		}
+
+		connection = strings.TrimSpace(string(text))
+	}
+
+	if connection == "" {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := postgres.OpenMigrator(connection)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	current, err := migrator.Version(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	version := *to
+	if *rollback {
+		version = current - 1
+	}
+
+	logger.Infof("migrate: schema is at version %d, migrating to version %d", current, version)
+
+	steps, err := migrator.Migrate(group.Ctx(), version, *dryRun, func(step postgres.MigrationStep) {
+		logger.Infof("migrate: %s", step)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(steps) == 0 {
+		logger.Info("migrate: schema is up to date")
+	} else if *dryRun {
+		for _, step := range steps {
+			switch {
+			case step.Rollback:
+				logger.Infof("migrate: would %s", step)
+			case step.Migration.Compatible:
+				logger.Infof("migrate: would %s, compatible with earlier controllers", step)
+			default:
+				logger.Infof("migrate: would %s, earlier controllers refuse to start once applied", step)
+			}
+		}
+	}
+
+	return nil
+}
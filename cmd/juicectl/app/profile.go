@@ -0,0 +1,161 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const profileUsage = "usage: juicectl profile [controller options] [--agent <address> --profiling-token <token>] [--seconds <seconds>] [--delta] [--output <directory>] <cpu | heap | goroutine | allocs | block | mutex | threadcreate | trace>"
+
+// The names net/http/pprof serves each kind of profile under
+var profileNames = map[string]string{
+	"cpu":          "profile",
+	"heap":         "heap",
+	"goroutine":    "goroutine",
+	"allocs":       "allocs",
+	"block":        "block",
+	"mutex":        "mutex",
+	"threadcreate": "threadcreate",
+	"trace":        "trace",
+}
+
+// Stored next to each profile, identifying the process it was captured from
+type profileMetadata struct {
+	Kind string `json:"kind"`
+	// controller or agent
+	Target   string `json:"target"`
+	Address  string `json:"address"`
+	Hostname string `json:"hostname,omitempty"`
+	Version  string `json:"version,omitempty"`
+
+	// Duration the profile covers, 0 for the state at CapturedAt
+	Seconds    int       `json:"seconds"`
+	StartedAt  time.Time `json:"startedAt"`
+	CapturedAt time.Time `json:"capturedAt"`
+	Size       int64     `json:"size"`
+	File       string    `json:"file"`
+}
+
+// Captures a runtime profile of the controller, or of an agent with --agent, storing it in the
+// output directory with its metadata, see the controller's --enable-profiling and the agent's
+// --profiling-token
+func runProfile(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("profile", flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	agentAddress := flags.String("agent", "", "The IP address or hostname and port of the agent to profile rather than the controller, connecting with the controller options' TLS settings")
+	profilingToken := flags.String("profiling-token", os.Getenv("JUICE_PROFILING_TOKEN"), "Bearer token presented to the agent, its --profiling-token, defaults to $JUICE_PROFILING_TOKEN")
+	seconds := flags.Int("seconds", 30, "Duration the CPU profile and trace are captured over")
+	delta := flags.Bool("delta", false, "Captures the differences in the other profiles over --seconds rather than their current state")
+	output := flags.String("output", ".", "Directory the profile and its metadata are stored in")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New(profileUsage)
+	}
+
+	kind := flags.Arg(0)
+	name, known := profileNames[kind]
+	if !known {
+		return errors.Join(fmt.Errorf("unknown profile %s", kind), errors.New(profileUsage))
+	}
+
+	if *seconds <= 0 {
+		return errors.New("--seconds must be greater than 0")
+	}
+
+	metadata := profileMetadata{
+		Kind:   kind,
+		Target: "controller",
+	}
+
+	if *agentAddress != "" {
+		// Only the agent's address is needed, not the controller's
+		options.address = agentAddress
+		options.token = profilingToken
+		metadata.Target = "agent"
+	}
+
+	api, err := options.client()
+	if err != nil {
+		return err
+	}
+	metadata.Address = api.Address
+
+	// Best effort, the profile is still useful without the process' version
+	status, err := api.StatusWithContext(group.Ctx())
+	if err == nil {
+		metadata.Hostname = status.Hostname
+		metadata.Version = status.Version
+	}
+
+	if kind == "cpu" || kind == "trace" || *delta {
+		metadata.Seconds = *seconds
+	}
+
+	err = os.MkdirAll(*output, 0755)
+	if err != nil {
+		return err
+	}
+
+	metadata.StartedAt = time.Now().UTC()
+
+	extension := ".pprof"
+	if kind == "trace" {
+		extension = ".trace"
+	}
+
+	host := metadata.Hostname
+	if host == "" {
+		host = strings.ReplaceAll(metadata.Address, ":", "_")
+	}
+
+	base := filepath.Join(*output, fmt.Sprintf("%s-%s-%s-%s", metadata.Target, host, kind, metadata.StartedAt.Format("20060102T150405.000Z")))
+	metadata.File = filepath.Base(base + extension)
+
+	file, err := os.Create(base + extension)
+	if err != nil {
+		return err
+	}
+
+	if metadata.Seconds > 0 {
+		fmt.Fprintf(os.Stderr, "capturing the %s profile of %s over %d seconds\n", kind, metadata.Address, metadata.Seconds)
+	}
+
+	metadata.Size, err = api.CaptureProfileWithContext(group.Ctx(), name, metadata.Seconds, file)
+	err = errors.Join(err, file.Close())
+	if err != nil {
+		return errors.Join(err, os.Remove(base+extension))
+	}
+
+	metadata.CapturedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err == nil {
+		err = os.WriteFile(base+".json", data, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(metadata)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "%s profile of %s stored in %s\n", kind, metadata.Address, base+extension)
+	return err
+}
@@ -0,0 +1,61 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const recordingUsage = "usage: juicectl recording [controller options] [--file <path>] <session id>"
+
+// Retrieves the recording of a session decrypted by the controller, one chunk of the traffic
+// between the client and the renderer per line of JSON. Each retrieval is recorded by the
+// controller as a session.recordingAccessed event.
+func runRecording(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("recording", flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	file := flags.String("file", "", "File the recording is written to rather than stdout")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New(recordingUsage)
+	}
+
+	api, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer = os.Stdout
+	if *file != "" {
+		created, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer created.Close()
+
+		output = created
+	}
+
+	size, err := api.GetSessionRecordingWithContext(group.Ctx(), flags.Arg(0), output)
+	if err != nil {
+		return err
+	}
+
+	if *file != "" {
+		_, err = fmt.Fprintf(os.Stderr, "wrote %d bytes of the recording of session %s to %s\n", size, flags.Arg(0), *file)
+	}
+
+	return err
+}
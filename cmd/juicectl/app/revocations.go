@@ -0,0 +1,104 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const revokeUsage = "usage: juicectl revoke [controller options] [--reason <reason>] [--evict] <token | user> <name>"
+const revocationsUsage = "usage: juicectl revocations [controller options]"
+const unrevokeUsage = "usage: juicectl unrevoke [controller options] <token | user> <name>"
+
+// Revokes a token of the controller's authorization policy or the credentials of a user, for
+// offboarding and incident response
+func runRevoke(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	reason := flags.String("reason", "", "Why the credential is revoked, recorded with the revocation")
+	evict := flags.Bool("evict", false, "Also cancels the sessions requested with the credential that are running, the queued sessions are always canceled")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		return errors.New(revokeUsage)
+	}
+
+	api, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	result, err := api.RevokeCredentialWithContext(group.Ctx(), restapi.Revocation{
+		Kind:          flags.Arg(0),
+		Subject:       flags.Arg(1),
+		Reason:        *reason,
+		EvictSessions: *evict,
+	})
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(result)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "%s %s is revoked, %d sessions canceled\n", result.Revocation.Kind, result.Revocation.Subject, len(result.CanceledSessions))
+	for _, id := range result.CanceledSessions {
+		if err == nil {
+			_, err = fmt.Fprintf(os.Stdout, "  %s\n", id)
+		}
+	}
+
+	return err
+}
+
+func runRevocations(group task.Group, args []string) error {
+	api, options, _, err := parseControllerCommand("revocations", revocationsUsage, args, 0)
+	if err != nil {
+		return err
+	}
+
+	revocations, err := api.GetRevocationsWithContext(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(revocations)
+	}
+
+	rows := make([]string, 0, len(revocations))
+	for _, revocation := range revocations {
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%t\t%s",
+			revocation.Kind, revocation.Subject, revocation.RevokedAt.Local().Format(time.RFC3339), revocation.EvictSessions, orNone(revocation.Reason)))
+	}
+
+	return printTable("KIND\tNAME\tREVOKED\tEVICTED\tREASON", rows)
+}
+
+func runUnrevoke(group task.Group, args []string) error {
+	api, _, args, err := parseControllerCommand("unrevoke", unrevokeUsage, args, 2)
+	if err != nil {
+		return err
+	}
+
+	err = api.RemoveRevocationWithContext(group.Ctx(), args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "%s %s is no longer revoked\n", args[0], args[1])
+	return err
+}
@@ -0,0 +1,102 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const mintTokenUsage = "usage: juicectl mint-token [controller options] [--user <user>] [--ttl <duration>] <name>"
+const tokensUsage = "usage: juicectl tokens [controller options]"
+const deleteTokenUsage = "usage: juicectl delete-token [controller options] <id>"
+
+// Mints a token clients present to request sessions, printing the token once as the controller
+// only keeps its hash
+func runMintToken(group task.Group, args []string) error {
+	flags := flag.NewFlagSet("mint-token", flag.ContinueOnError)
+	options := addControllerFlags(flags)
+	user := flags.String("user", "", "The user the sessions requested with the token are attributed to")
+	ttl := flags.Duration("ttl", 0, "How long the token is valid for, 0 never expires it")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 || *ttl < 0 {
+		return errors.New(mintTokenUsage)
+	}
+
+	api, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	token, err := api.MintApiTokenWithContext(group.Ctx(), restapi.ApiTokenRequest{
+		Name:       flags.Arg(0),
+		User:       *user,
+		TtlSeconds: int(ttl.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(token)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "token %s (%s) minted, it is not shown again:\n%s\n", token.Name, token.Id, token.Token)
+	return err
+}
+
+func runTokens(group task.Group, args []string) error {
+	api, options, _, err := parseControllerCommand("tokens", tokensUsage, args, 0)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := api.GetApiTokensWithContext(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	if options.structured() {
+		return options.print(tokens)
+	}
+
+	rows := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		expiresAt := "-"
+		if !token.ExpiresAt.IsZero() {
+			expiresAt = token.ExpiresAt.Local().Format(time.RFC3339)
+		}
+
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s",
+			token.Id, token.Name, orNone(token.User), token.CreatedAt.Local().Format(time.RFC3339), expiresAt))
+	}
+
+	return printTable("ID\tNAME\tUSER\tCREATED\tEXPIRES", rows)
+}
+
+func runDeleteToken(group task.Group, args []string) error {
+	api, _, args, err := parseControllerCommand("delete-token", deleteTokenUsage, args, 1)
+	if err != nil {
+		return err
+	}
+
+	err = api.DeleteApiTokenWithContext(group.Ctx(), args[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "token %s is deleted\n", args[0])
+	return err
+}
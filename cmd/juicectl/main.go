@@ -0,0 +1,19 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package main
+
+import (
+	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/cmd/juicectl/app"
+	"github.com/Juice-Labs/Juice-Labs/pkg/appmain"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+func main() {
+	appmain.Run("juicectl", build.Version, func(group task.Group) error {
+		err := app.Run(group)
+		group.Cancel()
+		return err
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+// The resources granted to the session, written as JSON to the file named by
+// JUICE_ASSIGNMENT_FILE so applications can size their work to them
+type assignment struct {
+	SessionId   string          `json:"sessionId"`
+	Host        string          `json:"host"`
+	Port        int             `json:"port"`
+	CpuFallback bool            `json:"cpuFallback,omitempty"`
+	Gpus        []assignmentGpu `json:"gpus"`
+
+	// Bytes of VRAM the session may use across its GPUs
+	VramBudget uint64 `json:"vramBudget"`
+}
+
+type assignmentGpu struct {
+	// Position of the GPU among those the application sees
+	Device int `json:"device"`
+	// Index of the GPU on the agent
+	Index  int    `json:"index"`
+	Name   string `json:"name,omitempty"`
+	PciBus string `json:"pciBus,omitempty"`
+	Vram   uint64 `json:"vram,omitempty"`
+
+	// Bytes of VRAM the session may use on the GPU, all of it when the session did not require
+	// an amount
+	VramBudget uint64 `json:"vramBudget"`
+}
+
+func assignmentPath(sessionId string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("juice-session-%s.json", sessionId))
+}
+
+// Writes the assignment of the session to its file, returning the environment variables
+// describing it to the application. Returns none when juicify has no session.
+//
+// JUICE_VISIBLE_DEVICES lists the devices the application sees, 0 through the number of GPUs
+// granted less one, like CUDA_VISIBLE_DEVICES. JUICE_GPU_MODEL and JUICE_GPU_VRAM_BUDGET are
+// comma separated in the same order.
+func writeAssignment(config Configuration) []string {
+	if config.Id == "" {
+		return nil
+	}
+
+	granted := assignment{
+		SessionId:   config.Id,
+		Host:        config.Host,
+		Port:        config.Port,
+		CpuFallback: config.CpuFallback,
+		Gpus:        []assignmentGpu{},
+	}
+
+	devices := []string{}
+	models := []string{}
+	budgets := []string{}
+	for device, gpu := range config.Gpus {
+		budget := gpu.VramRequired
+		if budget == 0 {
+			budget = gpu.Vram
+		}
+
+		granted.Gpus = append(granted.Gpus, assignmentGpu{
+			Device:     device,
+			Index:      gpu.Index,
+			Name:       gpu.Name,
+			PciBus:     gpu.PciBus,
+			Vram:       gpu.Vram,
+			VramBudget: budget,
+		})
+		granted.VramBudget += budget
+
+		devices = append(devices, fmt.Sprint(device))
+		models = append(models, gpu.Name)
+		budgets = append(budgets, fmt.Sprint(budget))
+	}
+
+	env := []string{
+		fmt.Sprintf("JUICE_SESSION_ID=%s", config.Id),
+		fmt.Sprintf("JUICE_VISIBLE_DEVICES=%s", strings.Join(devices, ",")),
+		fmt.Sprintf("JUICE_GPU_COUNT=%d", len(config.Gpus)),
+		fmt.Sprintf("JUICE_GPU_MODEL=%s", strings.Join(models, ",")),
+		fmt.Sprintf("JUICE_GPU_VRAM_BUDGET=%s", strings.Join(budgets, ",")),
+		fmt.Sprintf("JUICE_VRAM_BUDGET=%d", granted.VramBudget),
+	}
+
+	if config.CpuFallback {
+		env = append(env, "JUICE_CPU_FALLBACK=1")
+	}
+
+	data, err := json.MarshalIndent(granted, "", "  ")
+	if err == nil {
+		err = os.WriteFile(assignmentPath(config.Id), data, 0600)
+	}
+	if err != nil {
+		// The variables alone still describe the assignment
+		logger.Warningf("unable to write the assignment of session %s, %v", config.Id, err)
+		return env
+	}
+
+	return append(env, fmt.Sprintf("JUICE_ASSIGNMENT_FILE=%s", assignmentPath(config.Id)))
+}
+
+// Removes the file written by writeAssignment once the application has exited
+func removeAssignment(config Configuration) {
+	if config.Id == "" {
+		return
+	}
+
+	err := os.Remove(assignmentPath(config.Id))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warningf("unable to remove %s, %v", assignmentPath(config.Id), err)
+	}
+}
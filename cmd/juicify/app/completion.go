@@ -0,0 +1,315 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	completion = flag.String("completion", "", "Prints the shell completion script for bash, zsh, fish, or powershell and exits, e.g. source <(juicify --quiet --completion bash)")
+	complete   = flag.String("complete", "", "Prints the values the completion scripts offer for the given kind, one per line, and exits. Kinds: profiles")
+)
+
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+var logLevels = []string{"fatal", "error", "warning", "info", "debug", "trace"}
+
+// How the value of an option is completed, options not listed complete nothing
+const (
+	completeProfiles    = "profiles"
+	completeShells      = "shells"
+	completeLogLevels   = "log-levels"
+	completeFiles       = "files"
+	completeDirectories = "directories"
+)
+
+var valueCompletions = map[string]string{
+	"profile":            completeProfiles,
+	"save-profile":       completeProfiles,
+	"completion":         completeShells,
+	"log-level":          completeLogLevels,
+	"profiles-file":      completeFiles,
+	"juice-config":       completeFiles,
+	"log-file":           completeFiles,
+	"create-shortcut":    completeFiles,
+	"juice-path":         completeDirectories,
+	"local-sessions-dir": completeDirectories,
+}
+
+type completionFlag struct {
+	name       string
+	usage      string
+	takesValue bool
+	values     string
+}
+
+func completionFlags() []completionFlag {
+	flags := []completionFlag{}
+	flag.VisitAll(func(f *flag.Flag) {
+		boolFlag, isBool := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{
+			name:       f.Name,
+			usage:      strings.SplitN(f.Usage, "\n", 2)[0],
+			takesValue: !isBool || !boolFlag.IsBoolFlag(),
+			values:     valueCompletions[f.Name],
+		})
+	})
+
+	return flags
+}
+
+func runCompletion() error {
+	var script string
+	switch *completion {
+	case "bash":
+		script = bashCompletion(completionFlags())
+	case "zsh":
+		script = zshCompletion(completionFlags())
+	case "fish":
+		script = fishCompletion(completionFlags())
+	case "powershell":
+		script = powershellCompletion(completionFlags())
+	default:
+		return fmt.Errorf("--completion must be one of %s", strings.Join(completionShells, ", "))
+	}
+
+	fmt.Print(script)
+	return nil
+}
+
+// Prints the values completed dynamically, the completion scripts run juicify --complete
+// as they complete so the values are current
+func runComplete() error {
+	switch *complete {
+	case completeProfiles:
+		profiles, err := loadProfiles()
+		if err != nil {
+			return err
+		}
+
+		userConfig, _, err := loadUserConfig()
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(profiles)+len(userConfig.Profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		for name := range userConfig.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Println(name)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("--complete must be %s", completeProfiles)
+}
+
+func bashCompletion(flags []completionFlag) string {
+	names := []string{}
+	cases := map[string][]string{}
+	for _, f := range flags {
+		names = append(names, "--"+f.name)
+		if f.takesValue {
+			cases[f.values] = append(cases[f.values], "--"+f.name)
+		}
+	}
+
+	values := map[string]string{
+		completeProfiles:    `COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" --quiet --complete profiles 2>/dev/null)" -- "$cur"))`,
+		completeShells:      fmt.Sprintf(`COMPREPLY=($(compgen -W "%s" -- "$cur"))`, strings.Join(completionShells, " ")),
+		completeLogLevels:   fmt.Sprintf(`COMPREPLY=($(compgen -W "%s" -- "$cur"))`, strings.Join(logLevels, " ")),
+		completeFiles:       `COMPREPLY=($(compgen -f -- "$cur"))`,
+		completeDirectories: `COMPREPLY=($(compgen -d -- "$cur"))`,
+		"":                  `COMPREPLY=()`,
+	}
+
+	lines := []string{
+		"# bash completion for juicify, generated by juicify --completion bash",
+		"_juicify() {",
+		`    local cur="${COMP_WORDS[COMP_CWORD]}"`,
+		`    local prev="${COMP_WORDS[COMP_CWORD-1]}"`,
+		"",
+		`    case "$prev" in`,
+	}
+
+	for _, kind := range []string{completeProfiles, completeShells, completeLogLevels, completeFiles, completeDirectories, ""} {
+		if len(cases[kind]) > 0 {
+			lines = append(lines,
+				fmt.Sprintf("        %s)", strings.Join(cases[kind], "|")),
+				fmt.Sprintf("            %s", values[kind]),
+				"            return;;")
+		}
+	}
+
+	lines = append(lines,
+		"    esac",
+		"",
+		`    if [[ "$cur" == -* ]]; then`,
+		fmt.Sprintf(`        COMPREPLY=($(compgen -W "%s" -- "$cur"))`, strings.Join(names, " ")),
+		"        return",
+		"    fi",
+		"",
+		`    COMPREPLY=($(compgen -c -- "$cur"))`,
+		"}",
+		"complete -o default -F _juicify juicify",
+		"")
+
+	return strings.Join(lines, "\n")
+}
+
+func zshCompletion(flags []completionFlag) string {
+	escaper := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+	values := map[string]string{
+		completeProfiles:    "profile:_juicify_profiles",
+		completeShells:      fmt.Sprintf("shell:(%s)", strings.Join(completionShells, " ")),
+		completeLogLevels:   fmt.Sprintf("level:(%s)", strings.Join(logLevels, " ")),
+		completeFiles:       "file:_files",
+		completeDirectories: "directory:_files -/",
+		"":                  "value: ",
+	}
+
+	lines := []string{
+		"#compdef juicify",
+		"# zsh completion for juicify, generated by juicify --completion zsh",
+		"",
+		"_juicify_profiles() {",
+		"    local -a profiles",
+		`    profiles=(${(f)"$(${words[1]} --quiet --complete profiles 2>/dev/null)"})`,
+		"    _describe 'profile' profiles",
+		"}",
+		"",
+		"_arguments -s -S \\",
+	}
+
+	for _, f := range flags {
+		if f.takesValue {
+			lines = append(lines, fmt.Sprintf("    '--%s=[%s]:%s' \\", f.name, escaper.Replace(f.usage), values[f.values]))
+		} else {
+			lines = append(lines, fmt.Sprintf("    '--%s[%s]' \\", f.name, escaper.Replace(f.usage)))
+		}
+	}
+
+	lines = append(lines,
+		"    '*::application:_normal'",
+		"")
+
+	return strings.Join(lines, "\n")
+}
+
+func fishCompletion(flags []completionFlag) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+	values := map[string]string{
+		completeProfiles:    "-x -a '(juicify --quiet --complete profiles 2>/dev/null)'",
+		completeShells:      fmt.Sprintf("-x -a '%s'", strings.Join(completionShells, " ")),
+		completeLogLevels:   fmt.Sprintf("-x -a '%s'", strings.Join(logLevels, " ")),
+		completeFiles:       "-r -F",
+		completeDirectories: "-x -a '(__fish_complete_directories)'",
+		"":                  "-x",
+	}
+
+	lines := []string{
+		"# fish completion for juicify, generated by juicify --completion fish",
+	}
+
+	for _, f := range flags {
+		options := ""
+		if f.takesValue {
+			options = " " + values[f.values]
+		}
+
+		lines = append(lines, fmt.Sprintf("complete -c juicify -l %s%s -d '%s'", f.name, options, escaper.Replace(f.usage)))
+	}
+
+	lines = append(lines, "")
+
+	return strings.Join(lines, "\n")
+}
+
+func powershellCompletion(flags []completionFlag) string {
+	escaper := strings.NewReplacer(`'`, `''`)
+
+	quoted := func(values []string) string {
+		items := make([]string, len(values))
+		for index, value := range values {
+			items[index] = "'" + escaper.Replace(value) + "'"
+		}
+		return "@(" + strings.Join(items, ", ") + ")"
+	}
+
+	values := map[string]string{
+		completeProfiles:    "$values = @(& $commandAst.CommandElements[0].Extent.Text --quiet --complete profiles 2>$null)",
+		completeShells:      "$values = " + quoted(completionShells),
+		completeLogLevels:   "$values = " + quoted(logLevels),
+		completeFiles:       "return",
+		completeDirectories: "return",
+		"":                  "$values = @()",
+	}
+
+	lines := []string{
+		"# PowerShell completion for juicify, generated by juicify --completion powershell",
+		"Register-ArgumentCompleter -Native -CommandName juicify, juicify.exe -ScriptBlock {",
+		"    param($wordToComplete, $commandAst, $cursorPosition)",
+		"",
+		"    $flags = @(",
+	}
+
+	for index, f := range flags {
+		separator := ","
+		if index == len(flags)-1 {
+			separator = ""
+		}
+
+		lines = append(lines, fmt.Sprintf("        @{ Name = '--%s'; Usage = '%s' }%s", f.name, escaper.Replace(f.usage), separator))
+	}
+
+	lines = append(lines,
+		"    )",
+		"",
+		"    $previous = $commandAst.CommandElements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | Select-Object -Last 1",
+		"    switch ($previous.ToString()) {")
+
+	for _, f := range flags {
+		if f.takesValue {
+			// Files and directories fall back to PowerShell's own path completion
+			lines = append(lines, fmt.Sprintf("        '--%s' { %s }", f.name, values[f.values]))
+		}
+	}
+
+	lines = append(lines,
+		"        default {",
+		"            $values = $null",
+		"        }",
+		"    }",
+		"",
+		"    if ($null -ne $values) {",
+		"        $values | Where-Object { $_ -like \"$wordToComplete*\" } | ForEach-Object {",
+		"            [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)",
+		"        }",
+		"        return",
+		"    }",
+		"",
+		"    if ($wordToComplete -like '-*') {",
+		"        $flags | Where-Object { $_.Name -like \"$wordToComplete*\" } | ForEach-Object {",
+		"            $tooltip = if ($_.Usage) { $_.Usage } else { $_.Name }",
+		"            [System.Management.Automation.CompletionResult]::new($_.Name, $_.Name, 'ParameterName', $tooltip)",
+		"        }",
+		"    }",
+		"}",
+		"")
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,134 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	agentAddress     = flag.String("agent", "", "The IP address or hostname and port of an agent to connect to directly, bypassing the controller")
+	sessionToken     = flag.String("session-token", "", "The pre-shared token required by the agent given by --agent")
+	allowCpuFallback = flag.Bool("allow-cpu-fallback", false, "Allows the sessions requested by juicify to use CPU rendering when no GPU is available")
+	tenant           = flag.String("tenant", "", "Identifies who the sessions requested by juicify are used by, agents group their metrics by tenant")
+	callbackUrl      = flag.String("callback-url", "", "URL the controller posts the outcome of the sessions requested by juicify to once they close, such as a CI system's webhook")
+	priority         = flag.Int("priority", 0, "Priority of the sessions requested from the controller, queued sessions with higher priorities are placed first")
+	sessionTemplate  = flag.String("template", "", "Names the template resource of the controller the requirements of the sessions requested by juicify are completed from, the flags set take precedence. The template's GPUs apply unless --pcibus is set")
+	sessionClass     = flag.String("session-class", "", "Class of the sessions requested from the controller, interactive, batch, or preemptible, setting their priority, preemptibility, and maximum wait in the queue together in place of --priority")
+	placement        = flag.String("placement", "", "How the controller chooses among the agents the sessions requested by juicify fit on, binpack, spread, or random, defaults to the controller's --placement-strategy")
+	metricsPort      = flag.Int("metrics-port", 0, "Port on the agent's loopback interface the workload of the sessions requested by juicify serves Prometheus metrics on, the agent exports them labeled with the session. 0 exports none")
+	idleTimeout      = flag.Duration("idle-timeout", 0, "Closes the sessions requested by juicify once the application has neither used the GPU nor sent or received data for this long, 0 leaves it to the agent's --default-idle-timeout")
+	record           = flag.Bool("record", false, "Records the sessions requested from the controller on their agents, encrypted with keys only the controller can decrypt. Only agents with --recording-dir take them")
+	vramRequired     = flag.Uint64("vram", 0, "MiB of VRAM each GPU of the sessions requested by juicify must have available, 0 requires none")
+	reserveAt        = flag.String("reserve-at", "", "Books the session requested from the controller in advance for a window starting at this time in RFC 3339, juicify waits for the window to start. Requires --reserve-for")
+	reserveFor       = flag.Duration("reserve-for", 0, "How long the window of --reserve-at lasts, the controller cancels the session once it ends")
+
+	requireCapabilities = []string{}
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &requireCapabilities}, "require-capabilities", "A comma-separated list of the features the agent running the sessions must support, e.g. gpuFairness,networkAccounting. Agents running without root forgo some of them")
+}
+
+func sessionRequirements() (restapi.SessionRequirements, error) {
+	labels, err := parseKeyValues("match-labels", *matchLabels)
+	if err != nil {
+		return restapi.SessionRequirements{}, err
+	}
+
+	requirements := restapi.SessionRequirements{
+		Version:     build.Version,
+		Gpus:        []restapi.GpuRequirements{},
+		MatchLabels: labels,
+		Tolerates:   map[string]string{},
+		Tenant:      *tenant,
+		Template:    *sessionTemplate,
+
+		IdleTimeoutSeconds:  int(idleTimeout.Seconds()),
+		RequireCapabilities: requireCapabilities,
+	}
+
+	for _, bus := range pcibus {
+		requirements.Gpus = append(requirements.Gpus, restapi.GpuRequirements{
+			VramRequired: *vramRequired * 1024 * 1024,
+			PciBus:       bus,
+		})
+	}
+
+	// Requested without GPUs, the template's are used
+	if len(requirements.Gpus) == 0 && *sessionTemplate == "" {
+		requirements.Gpus = append(requirements.Gpus, restapi.GpuRequirements{
+			VramRequired: *vramRequired * 1024 * 1024,
+		})
+	}
+
+	return requirements, nil
+}
+
+// Requests a session directly from the agent, returning its id
+func requestDirectSession(group task.Group, api *restapi.Client) (string, error) {
+	// Templates are held by the controller
+	if *sessionTemplate != "" {
+		return "", errors.New("--template requires a controller, it does not apply with --agent")
+	}
+
+	api.Token = *sessionToken
+
+	err := api.NegotiateVersionWithContext(group.Ctx())
+	if err != nil {
+		return "", err
+	}
+
+	status, err := api.StatusWithContext(group.Ctx())
+	if err != nil {
+		return "", err
+	}
+
+	// Agents predating capabilities accept direct sessions when not connected to a controller
+	if status.Capabilities != nil && !status.HasCapability(restapi.CapabilityDirectSessions) {
+		return "", fmt.Errorf("agent at %s is connected to a controller and does not accept direct sessions", api.Address)
+	}
+
+	if status.HasCapability(restapi.CapabilitySessionToken) && *sessionToken == "" {
+		return "", fmt.Errorf("agent at %s requires --session-token", api.Address)
+	}
+
+	if status.Version != build.Version {
+		logger.Warningf("agent at %s is v%s, juicify is v%s", api.Address, status.Version, build.Version)
+	}
+
+	requirements, err := sessionRequirements()
+	if err != nil {
+		return "", err
+	}
+
+	if *allowCpuFallback {
+		if status.HasCapability(restapi.CapabilityCpuFallback) {
+			requirements.AllowCpuFallback = true
+		} else {
+			logger.Warningf("agent at %s does not support CPU rendering fallback", api.Address)
+		}
+	}
+
+	// Only the connection is verified, no session is needed
+	if *testConnection {
+		return "", nil
+	}
+
+	id, err := api.RequestSessionWithContext(group.Ctx(), requirements)
+	if err != nil {
+		return "", fmt.Errorf("unable to request a session from agent at %s with %s", api.Address, err)
+	}
+
+	logger.Infof("Session %s requested directly from agent at %s", id, api.Address)
+	return id, nil
+}
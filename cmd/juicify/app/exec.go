@@ -0,0 +1,85 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const execUsage = "usage: juicify [options] exec [--session <id>] [--] <command> [<command args>]"
+
+// juicify exec runs a diagnostic command in a running session on its agent
+func isExec(application []string) bool {
+	return len(application) > 0 && application[0] == "exec"
+}
+
+func runExec(group task.Group, config Configuration, args []string) error {
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	sessionId := flags.String("session", config.Id, "The session to run the command in, defaults to the session in juice.cfg")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New(execUsage)
+	}
+
+	if *sessionId == "" {
+		return errors.New("exec: --session is required")
+	}
+
+	// Commands are authorized by the controller, which relays them to the agent
+	if *agentAddress != "" {
+		return errors.New("exec: commands are run through the controller, use --host rather than --agent")
+	}
+
+	api := restapi.Client{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: *disableTls,
+				},
+			},
+		},
+		Scheme:     "https",
+		Address:    fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Token:      *controllerToken,
+		OnBehalfOf: *onBehalfOf,
+	}
+
+	if *disableTls {
+		api.Scheme = "http"
+	}
+
+	err = api.NegotiateVersionWithContext(group.Ctx())
+	if err != nil {
+		return err
+	}
+
+	exec := restapi.SessionExec{
+		Command: flags.Arg(0),
+		Args:    flags.Args()[1:],
+	}
+
+	exitCode, err := api.ExecSessionWithContext(group.Ctx(), *sessionId, exec, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	if exitCode != 0 {
+		return fmt.Errorf("exec: %s exited with code %d", exec.Command, exitCode)
+	}
+
+	return nil
+}
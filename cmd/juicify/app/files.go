@@ -0,0 +1,106 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+var (
+	pullDir = flag.String("pull-dir", ".", "The directory files given with --pull are written to")
+
+	pushFiles = []string{}
+	pullFiles = []string{}
+)
+
+func init() {
+	flag.Var(&utilities.CommaValue{Value: &pushFiles}, "push", "A comma-separated list of files copied to the session's scratch directory on the agent before the application starts, limited in size by the agent. Not supported with map")
+	flag.Var(&utilities.CommaValue{Value: &pullFiles}, "pull", "A comma-separated list of file names copied from the session's scratch directory on the agent to --pull-dir after the application exits. Not supported with map")
+}
+
+// Copies --push to the session's scratch directory
+func pushSessionFiles(group task.Group, api restapi.Client, id string) error {
+	for _, path := range pushFiles {
+		err := pushSessionFile(group.Ctx(), api, id, path)
+		if err != nil {
+			return fmt.Errorf("unable to push %s to session %s with %s", path, id, err)
+		}
+	}
+
+	return nil
+}
+
+func pushSessionFile(ctx context.Context, api restapi.Client, id string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pushed, err := api.PutSessionFileWithContext(ctx, id, filepath.Base(path), file)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Pushed %s to session %s, %d bytes", pushed.Name, id, pushed.Size)
+	return nil
+}
+
+// Copies --pull from the session's scratch directory, the files are pulled even when the
+// application failed as they may explain why
+func pullSessionFiles(api restapi.Client, id string) error {
+	if len(pullFiles) == 0 {
+		return nil
+	}
+
+	// juicify may be exiting because it was canceled, pull the files regardless
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var err error
+	for _, name := range pullFiles {
+		err_ := pullSessionFile(ctx, api, id, name)
+		if err_ != nil {
+			err = errors.Join(err, fmt.Errorf("unable to pull %s from session %s with %s", name, id, err_))
+		}
+	}
+
+	return err
+}
+
+func pullSessionFile(ctx context.Context, api restapi.Client, id string, name string) error {
+	path := filepath.Join(*pullDir, name)
+
+	// Written beside the destination and renamed once complete, failed pulls leave no partial file
+	file, err := os.CreateTemp(*pullDir, fmt.Sprint(".", name, ".pull-*"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	size, err := api.GetSessionFileWithContext(ctx, id, name, file)
+	err = errors.Join(err, file.Close())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Pulled %s from session %s to %s, %d bytes", name, id, path, size)
+	return nil
+}
@@ -0,0 +1,237 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	frameMetricsInterval = flag.Duration("frame-metrics-interval", 10*time.Second, "Interval between reports of the session's frame pacing and input latency, 0 disables")
+	frameMetricsWindow   = flag.Duration("frame-metrics-window", 30*time.Second, "Duration of the rolling summary of the session's frame pacing and input latency")
+)
+
+// A line of the frame statistics file, appended by the client as it presents frames
+type frameStats struct {
+	// Intervals between presented frames in milliseconds
+	FrameIntervals []float64 `json:"frameIntervals"`
+	// Time from input being sent to the first frame presented after it in milliseconds
+	InputLatencies []float64 `json:"inputLatencies"`
+}
+
+type frameSample struct {
+	time  time.Time
+	stats frameStats
+}
+
+// Reads the frame statistics the client writes to Configuration.FrameStatsFile and reports
+// their rolling summary for the session every --frame-metrics-interval
+type frameReporter struct {
+	api restapi.Client
+	id  string
+
+	file    *os.File
+	reader  *bufio.Reader
+	partial string
+
+	samples []frameSample
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Returns nil when the session is not released by juicify or --frame-metrics-interval is 0,
+// otherwise points config at the frame statistics file and starts reporting
+func startFrameReporter(api *restapi.Client, config *Configuration) *frameReporter {
+	if api == nil || *frameMetricsInterval <= 0 {
+		return nil
+	}
+
+	file, err := os.CreateTemp("", "juicify-frames-*.jsonl")
+	if err != nil {
+		logger.Warningf("unable to create the frame statistics file, frame metrics are not reported, %v", err)
+		return nil
+	}
+
+	config.FrameStatsFile = file.Name()
+
+	reporter := &frameReporter{
+		api:    *api,
+		id:     config.Id,
+		file:   file,
+		reader: bufio.NewReader(file),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go reporter.run()
+
+	return reporter
+}
+
+func (reporter *frameReporter) run() {
+	defer close(reporter.done)
+
+	ticker := time.NewTicker(*frameMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-reporter.stop:
+			return
+
+		case <-ticker.C:
+			reporter.report()
+		}
+	}
+}
+
+// Stops reporting once the application exits, sending the final summary. Safe to call on nil.
+func (reporter *frameReporter) Stop() {
+	if reporter == nil {
+		return
+	}
+
+	close(reporter.stop)
+	<-reporter.done
+
+	reporter.report()
+
+	reporter.file.Close()
+	os.Remove(reporter.file.Name())
+}
+
+// Reads the lines appended since the last read, keeping a trailing partial line for the next read
+func (reporter *frameReporter) read(now time.Time) {
+	for {
+		line, err := reporter.reader.ReadString('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Debugf("unable to read the frame statistics file, %v", err)
+			}
+
+			reporter.partial += line
+			return
+		}
+
+		line = strings.TrimSpace(reporter.partial + line)
+		reporter.partial = ""
+		if line == "" {
+			continue
+		}
+
+		var stats frameStats
+		err = json.Unmarshal([]byte(line), &stats)
+		if err != nil {
+			logger.Debugf("ignoring malformed frame statistics, %v", err)
+			continue
+		}
+
+		reporter.samples = append(reporter.samples, frameSample{
+			time:  now,
+			stats: stats,
+		})
+	}
+}
+
+func (reporter *frameReporter) report() {
+	now := time.Now()
+	reporter.read(now)
+
+	samples := reporter.samples[:0]
+	for _, sample := range reporter.samples {
+		if now.Sub(sample.time) <= *frameMetricsWindow {
+			samples = append(samples, sample)
+		}
+	}
+	reporter.samples = samples
+
+	frames := summarizeFrames(reporter.samples)
+	if frames.Frames == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := reporter.api.UpdateSessionFramesWithContext(ctx, reporter.id, frames)
+	if errors.Is(err, pkgerrors.ErrNotFound) {
+		logger.Debugf("session %s was not found to report frame metrics, %v", reporter.id, err)
+	} else if err != nil {
+		logger.Warningf("unable to report the frame metrics of session %s, %v", reporter.id, err)
+	}
+}
+
+func summarizeFrames(samples []frameSample) restapi.FrameMetrics {
+	intervals := []float64{}
+	latencies := []float64{}
+	for _, sample := range samples {
+		intervals = append(intervals, sample.stats.FrameIntervals...)
+		latencies = append(latencies, sample.stats.InputLatencies...)
+	}
+
+	frames := restapi.FrameMetrics{
+		Frames: uint64(len(intervals)),
+	}
+
+	if len(intervals) == 0 {
+		return frames
+	}
+
+	sort.Float64s(intervals)
+	sort.Float64s(latencies)
+
+	var total float64
+	for _, interval := range intervals {
+		total += interval
+	}
+	if total > 0 {
+		frames.FrameRate = float64(len(intervals)) * 1000 / total
+	}
+
+	frames.FrameIntervalP50 = percentile(intervals, 0.50)
+	frames.FrameIntervalP95 = percentile(intervals, 0.95)
+	frames.FrameIntervalP99 = percentile(intervals, 0.99)
+
+	if frames.FrameIntervalP50 > 0 {
+		for _, interval := range intervals {
+			if interval >= 2*frames.FrameIntervalP50 {
+				frames.Stutters++
+			}
+		}
+	}
+
+	frames.InputLatencyP50 = percentile(latencies, 0.50)
+	frames.InputLatencyP95 = percentile(latencies, 0.95)
+
+	return frames
+}
+
+// Returns the nearest-rank percentile of sorted values, 0 when there are none
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
@@ -0,0 +1,219 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+const (
+	localSessionsWarn  = "warn"
+	localSessionsBlock = "block"
+)
+
+// Logical CPUs assumed to be needed to decode and present each session's stream when
+// --max-local-sessions is not set
+const cpusPerLocalSession = 4
+
+var (
+	maxLocalSessions       = flag.Int("max-local-sessions", 0, fmt.Sprintf("The number of Juice sessions this host may have open at once across every juicify, defaults to one per %d logical CPUs. Streams of sessions beyond what the host's CPUs and network can keep up with stutter regardless of the GPUs rendering them, -1 disables", cpusPerLocalSession))
+	maxLocalSessionsAction = flag.String("max-local-sessions-action", localSessionsWarn, "What juicify does when opening a session would exceed --max-local-sessions, one of warn or block")
+	localSessionsDir       = flag.String("local-sessions-dir", "", "Directory the sessions open on this host are recorded in, defaults to juice/sessions in the user's cache directory. Every juicify sharing the limit must use the same directory")
+)
+
+// A Juice session opened by a juicify on this host, recorded as a file in the local sessions
+// directory while it is open
+type localSession struct {
+	Pid         int       `json:"pid"`
+	Application string    `json:"application"`
+	Host        string    `json:"host"`
+	StartedAt   time.Time `json:"startedAt"`
+
+	path string
+}
+
+func getLocalSessionsPath() (string, error) {
+	if *localSessionsDir != "" {
+		return *localSessionsDir, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "juice", "sessions"), nil
+}
+
+// Returns the limit of sessions open on this host, 0 when there is none
+func localSessionLimit() int {
+	switch {
+	case *maxLocalSessions < 0:
+		return 0
+	case *maxLocalSessions > 0:
+		return *maxLocalSessions
+	}
+
+	limit := runtime.NumCPU() / cpusPerLocalSession
+	if limit < 1 {
+		limit = 1
+	}
+
+	return limit
+}
+
+// Returns the sessions recorded in the directory whose juicify is still running, removing the
+// records left behind by those that are not
+func readLocalSessions(dir string) ([]localSession, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	sessions := []localSession{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// Removed by the juicify that recorded it
+			continue
+		}
+
+		var session localSession
+		err = json.Unmarshal(data, &session)
+		if err != nil {
+			// Still being written, or left incomplete when it has not been for a while
+			if time.Since(fileModTime(entry)) > time.Minute {
+				os.Remove(path)
+			}
+
+			continue
+		}
+
+		if !processAlive(session.Pid) {
+			// Left behind by a juicify that exited without removing it
+			os.Remove(path)
+			continue
+		}
+
+		session.path = path
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func fileModTime(entry os.DirEntry) time.Time {
+	info, err := entry.Info()
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// Checks the sessions already open on this host against --max-local-sessions and records the
+// session about to be opened, returning the record to remove once the session is released.
+// Returns an error rather than the record when the limit is exceeded and the action is block.
+func openLocalSession(application []string, config Configuration) (*localSession, error) {
+	if *maxLocalSessionsAction != localSessionsWarn && *maxLocalSessionsAction != localSessionsBlock {
+		return nil, fmt.Errorf("--max-local-sessions-action must be one of %s or %s", localSessionsWarn, localSessionsBlock)
+	}
+
+	limit := localSessionLimit()
+	if limit == 0 {
+		return nil, nil
+	}
+
+	dir, err := getLocalSessionsPath()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		// The limit is advisory, never keep applications from running because it cannot be checked
+		logger.Warningf("unable to check the Juice sessions open on this host, %v", err)
+		return nil, nil
+	}
+
+	open, err := readLocalSessions(dir)
+	if err != nil {
+		logger.Warningf("unable to check the Juice sessions open on this host, %v", err)
+		return nil, nil
+	}
+
+	if len(open) >= limit {
+		applications := make([]string, 0, len(open))
+		for _, session := range open {
+			applications = append(applications, fmt.Sprintf("%s (pid %d)", session.Application, session.Pid))
+		}
+
+		message := fmt.Sprintf("%d Juice sessions are already open on this host, %s, and the host's limit is %d. Streams beyond what the host's CPUs and network can keep up with stutter regardless of the GPUs rendering them, see --max-local-sessions",
+			len(open), strings.Join(applications, ", "), limit)
+
+		if *maxLocalSessionsAction == localSessionsBlock {
+			return nil, errors.New(message)
+		}
+
+		logger.Warning(message)
+	}
+
+	session := &localSession{
+		Pid:       os.Getpid(),
+		Host:      config.Host,
+		StartedAt: time.Now(),
+	}
+	if len(application) > 0 {
+		session.Application = filepath.Base(application[0])
+	}
+
+	data, err := json.Marshal(session)
+	if err == nil {
+		var file *os.File
+		file, err = os.CreateTemp(dir, fmt.Sprintf("%d-*.json", session.Pid))
+		if err == nil {
+			session.path = file.Name()
+
+			_, err = file.Write(data)
+			err = errors.Join(err, file.Close())
+		}
+	}
+	if err != nil {
+		logger.Warningf("unable to record the Juice session in %s, %v", dir, err)
+		session.Release()
+		return nil, nil
+	}
+
+	return session, nil
+}
+
+// Removes the record of the session, which may be nil
+func (session *localSession) Release() {
+	if session == nil || session.path == "" {
+		return
+	}
+
+	err := os.Remove(session.path)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warningf("unable to remove %s, %v", session.path, err)
+	}
+}
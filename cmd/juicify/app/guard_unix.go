@@ -0,0 +1,24 @@
+//go:build !windows
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package app
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Returns whether the process is running, signal 0 checks the process exists without signaling it
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,20 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"os"
+)
+
+// Returns whether the process is running, FindProcess opens the process on Windows and so fails
+// when it does not exist
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	process.Release()
+	return true
+}
@@ -0,0 +1,58 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+type example struct {
+	description string
+	command     string
+}
+
+var examples = []example{
+	{"Check that juicify can reach the controller", "juicify --host controller.example.com:8080 --test-connection"},
+	{"Run an application on a GPU from the controller", "juicify --host controller.example.com:8080 -- ./game --fullscreen"},
+	{"Run an application on a GPU of the agent directly", "juicify --agent 10.0.0.12:43210 --session-token <token> -- ./game"},
+	{"Save the options and application as a profile, then run it", "juicify --host controller.example.com:8080 --save-profile game -- ./game\n    juicify --profile game"},
+	{"Run the command of the render profile defined in ~/.juice/config.yaml with its controller, tags, VRAM, and preloaded libraries", "juicify --profile render"},
+	{"Run the application once for each line of a file, four at a time", "juicify --host controller.example.com:8080 map --parameters scenes.txt --concurrency 4 -- ./render --scene {param}"},
+	{"Book a GPU for a nightly render from 22:00 for six hours, the controller holds the capacity for it", "juicify --host controller.example.com:8080 --reserve-at 2023-06-01T22:00:00Z --reserve-for 6h -- ./render --all-scenes"},
+	{"Send a scene to the session and fetch the image rendered from it", "juicify --host controller.example.com:8080 --push scene.json --pull frame.png -- ./render"},
+	{"Submit a Slurm job and run the application with a session while the job runs, stopping one when the other ends", "juicify --host controller.example.com:8080 paired --job simulate.sbatch --sbatch-args --partition=cpu,--nodes=4 -- ./visualize"},
+	{"Show the GPU usage of a running session, as the agent's renderer sees it", "juicify --host controller.example.com:8080 exec --session <id> -- nvidia-smi"},
+	{"Trace the system calls of a running session's renderer", "juicify --host controller.example.com:8080 exec --session <id> -- strace -f -p {renderer-pid}"},
+	{"Run the application for each line of a file and print the outcome of every task as JSON", "juicify --host controller.example.com:8080 --output-format json map --parameters scenes.txt -- ./render --scene {param} > results.json"},
+	{"Package the host, options, log, and session placement into an archive to attach to a bug report", "juicify --host controller.example.com:8080 report --session <id>"},
+	{"Refuse to open more than two sessions at once on this host, across every juicify", "juicify --host controller.example.com:8080 --max-local-sessions 2 --max-local-sessions-action block -- ./game"},
+	{"Print the options to paste into a Steam game's launch options", "juicify --host controller.example.com:8080 --steam-launch-options"},
+	{"Enable completion in bash, other shells are zsh, fish, and powershell", "source <(juicify --quiet --completion bash)"},
+}
+
+func init() {
+	flag.Usage = printUsage
+}
+
+func printUsage() {
+	output := flag.CommandLine.Output()
+
+	fmt.Fprintln(output, "usage: juicify [options] [--] <application> [<application args>]")
+	fmt.Fprintln(output, "       juicify [options] map [map options] [--] <application> [<application args>]")
+	fmt.Fprintln(output, "       juicify [options] paired --job <script> [paired options] [--] <application> [<application args>]")
+	fmt.Fprintln(output, "       juicify [options] exec [--session <id>] [--] <command> [<command args>]")
+	fmt.Fprintln(output, "       juicify [options] report [--session <id>] [--output <file>] [--log-bytes <bytes>]")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "Runs the application with its graphics rendered on a remote GPU, from a session requested from the controller at --host or from the agent at --agent.")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "Options:")
+	flag.PrintDefaults()
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "Examples:")
+	for _, example := range examples {
+		fmt.Fprintf(output, "  %s\n    %s\n\n", example.description, strings.TrimSpace(example.command))
+	}
+}
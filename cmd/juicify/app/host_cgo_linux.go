@@ -0,0 +1,22 @@
+//go:build cgo
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package app
+
+import (
+	"github.com/NVIDIA/go-nvml/pkg/dl"
+)
+
+// Loads the library as applications would
+func check(name string) error {
+	lib := dl.New(name, dl.RTLD_NOW)
+	err := lib.Open()
+	if err != nil {
+		return err
+	}
+
+	return lib.Close()
+}
@@ -0,0 +1,76 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Shared libraries Juice loads into applications
+var hostLibraries = []string{
+	"libstdc++.so.6",
+	"libvulkan.so.1",
+}
+
+func validateHost() error {
+	for _, name := range hostLibraries {
+		err := check(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the outcome of loading each library Juice loads into applications, for bug reports
+func hostLibraryChecks() []hostLibrary {
+	libraries := make([]hostLibrary, 0, len(hostLibraries))
+	for _, name := range hostLibraries {
+		library := hostLibrary{
+			Name: name,
+			Path: resolveLibrary(name),
+		}
+
+		err := check(name)
+		if err != nil {
+			library.Error = err.Error()
+		}
+
+		libraries = append(libraries, library)
+	}
+
+	return libraries
+}
+
+// Returns the file the dynamic linker resolves the library to, whose name usually carries the
+// library's full version such as libvulkan.so.1.3.239, empty when it cannot be found
+func resolveLibrary(name string) string {
+	output, err := exec.Command("ldconfig", "-p").Output()
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), name+" ") {
+			continue
+		}
+
+		_, path, found := strings.Cut(line, "=> ")
+		if !found {
+			continue
+		}
+
+		resolved, err := filepath.EvalSymlinks(strings.TrimSpace(path))
+		if err != nil {
+			return strings.TrimSpace(path)
+		}
+
+		return resolved
+	}
+
+	return ""
+}
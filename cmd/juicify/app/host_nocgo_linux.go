@@ -0,0 +1,54 @@
+//go:build !cgo
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Directories searched after LD_LIBRARY_PATH when the linker cache cannot be read
+var libraryDirs = []string{
+	"/lib",
+	"/lib64",
+	"/usr/lib",
+	"/usr/lib64",
+	"/usr/local/lib",
+	"/lib/x86_64-linux-gnu",
+	"/usr/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu",
+	"/usr/lib/aarch64-linux-gnu",
+}
+
+// Without cgo the library cannot be loaded, so it is looked up where the dynamic linker would find it
+func check(name string) error {
+	output, err := exec.Command("ldconfig", "-p").Output()
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), name+" ") {
+				return nil
+			}
+		}
+	}
+
+	dirs := append(filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")), libraryDirs...)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		_, err := os.Stat(filepath.Join(dir, name))
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: cannot open shared object file: No such file or directory", name)
+}
@@ -5,6 +5,7 @@ package app
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,11 +14,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
@@ -41,6 +44,9 @@ type Configuration struct {
 
 	DisableCompression bool `json:"disableCompression,omitempty"`
 
+	// 1 is the fastest and 9 the smallest, the client's default when 0. See streamCompressionLevels
+	CompressionLevel int `json:"compressionLevel,omitempty"`
+
 	Headless bool `json:"headless,omitempty"`
 
 	AllowTearing bool `json:"allowTearing,omitempty"`
@@ -54,6 +60,18 @@ type Configuration struct {
 	WaitForDebugger bool `json:"waitForDebugger,omitempty"`
 
 	PCIBus []string `json:"pcibus,omitempty"`
+
+	// The client appends the frame pacing and input latency it measures to this file
+	FrameStatsFile string `json:"frameStatsFile,omitempty"`
+
+	// The client rereads DisableCompression, CompressionLevel, and FrameRateLimit from this file
+	// when it changes, see streamNegotiator
+	StreamFile string `json:"streamFile,omitempty"`
+
+	// The GPUs granted to the session, described to the application rather than the client. See
+	// writeAssignment
+	Gpus        []restapi.SessionGpu `json:"-"`
+	CpuFallback bool                 `json:"-"`
 }
 
 var (
@@ -63,13 +81,18 @@ var (
 
 	disableTls = flag.Bool("disable-tls", true, "Always enabled currently. Disables https when connecting to --address")
 
+	controllerToken = flag.String("controller-token", "", "Bearer token presented to the controller, required when its authorization policy restricts the client endpoints to tokens")
+	onBehalfOf      = flag.String("on-behalf-of", "", "Requests the session on behalf of this user, --controller-token must be a service account token the controller allows to delegate")
+
 	juicePath = flag.String("juice-path", "", "Path to the juice executables if different than current executable path")
 
-	pcibus = []string{}
+	pcibus           = []string{}
+	preloadLibraries = []string{}
 )
 
 func init() {
 	flag.Var(&utilities.CommaValue{Value: &pcibus}, "pcibus", "A comma-seperated list of PCI bus addresses as advertised by the server of the form <bus>:<device>.<function> e.g. 01:00.0")
+	flag.Var(&utilities.CommaValue{Value: &preloadLibraries}, "preload", "A comma-separated list of additional libraries preloaded into the application after Juice, such as those working around an application's quirks. Linux only")
 }
 
 func Run(group task.Group) error {
@@ -77,8 +100,38 @@ func Run(group task.Group) error {
 		*testConnection = true
 	}
 
+	err := validateOutputFormat()
+	if err != nil {
+		return err
+	}
+
+	if *completion != "" {
+		return runCompletion()
+	}
+
+	if *complete != "" {
+		return runComplete()
+	}
+
+	application, err := applyProfile()
+	if err != nil {
+		return err
+	}
+
+	if *saveProfile != "" {
+		return runSaveProfile(application)
+	}
+
+	if *steamLaunchOptions {
+		return runSteamLaunchOptions()
+	}
+
+	if *createShortcut != "" {
+		return runCreateShortcut(application)
+	}
+
 	// Make sure we have an application to execute
-	if len(flag.Args()) == 0 && !*testConnection {
+	if len(application) == 0 && !*testConnection {
 		return errors.New("usage: juicify [options] [<application> <application args>]")
 	}
 
@@ -91,8 +144,9 @@ func Run(group task.Group) error {
 		*juicePath = filepath.Dir(executable)
 	}
 
-	err := validateHost()
-	if err != nil {
+	// Reports record why the host cannot run applications rather than failing
+	err = validateHost()
+	if err != nil && !isReport(application) {
 		return err
 	}
 
@@ -109,6 +163,14 @@ func Run(group task.Group) error {
 		}
 	}
 
+	if *agentAddress != "" {
+		if *address != "" {
+			return errors.New("--host and --agent are mutually exclusive, one or the other but not both")
+		}
+
+		*address = *agentAddress
+	}
+
 	if *address != "" {
 		// SplitHostPort() rejects addresses that don't have a port or a
 		// trailing ":".  Add a trailing ":" to have SplitHostPort() parse
@@ -149,11 +211,143 @@ func Run(group task.Group) error {
 		return err
 	}
 
+	if isExec(application) {
+		return runExec(group, config, application[1:])
+	}
+
+	if isMap(application) {
+		return runMap(group, config, application[1:])
+	}
+
+	if isReport(application) {
+		return runReport(group, config, application[1:])
+	}
+
+	if isPaired(application) {
+		return runPaired(group, config, application[1:])
+	}
+
+	err = validateStreamOverrides()
+	if err != nil {
+		return err
+	}
+
+	if !*testConnection {
+		local, err := openLocalSession(application, config)
+		if err != nil {
+			return err
+		}
+		defer local.Release()
+	}
+
+	server := fmt.Sprintf("%s:%d", config.Host, config.Port)
+
+	config, releaseApi, agentApi, err := connect(group, config, false)
+	if err != nil {
+		// Canceled while waiting for the session
+		if group.Ctx().Err() != nil {
+			return nil
+		}
+
+		if *testConnection {
+			return printConnectionTest(server, err)
+		}
+
+		return err
+	}
+
+	if *testConnection {
+		return printConnectionTest(server, nil)
+	}
+
+	err = pushSessionFiles(group, agentApi, config.Id)
+	if err != nil {
+		if releaseApi != nil {
+			releaseSession(*releaseApi, config.Id, time.Now(), err, group.Ctx().Err() != nil)
+		}
+
+		return err
+	}
+
+	stream := startStreamNegotiator(group, agentApi, &config)
+	frames := startFrameReporter(releaseApi, &config)
+	bridge := startQuicBridge(group, agentApi, &config)
+
+	cmd, err := applicationCommand(application, config)
+	if err != nil {
+		bridge.Stop()
+		frames.Stop()
+		stream.Stop()
+		return err
+	}
+
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	startedAt := time.Now()
+	err = runCommand(group, cmd, config)
+	removeAssignment(config)
+	bridge.Stop()
+	frames.Stop()
+	stream.Stop()
+
+	err_ := pullSessionFiles(agentApi, config.Id)
+	if err_ != nil {
+		logger.Error(err_)
+	}
+
+	if releaseApi != nil {
+		releaseSession(*releaseApi, config.Id, startedAt, err, group.Ctx().Err() != nil)
+	}
+
+	return err
+}
+
+// The result of --test-connection printed with --output-format
+type connectionTest struct {
+	Address string `json:"address"`
+	// Either agent, with --agent, or controller
+	Server    string `json:"server"`
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Prints the result of --test-connection with --output-format, returning err
+func printConnectionTest(address string, err error) error {
+	if !structuredOutput() {
+		return err
+	}
+
+	result := connectionTest{
+		Address:   address,
+		Server:    "controller",
+		Connected: err == nil,
+	}
+
+	if *agentAddress != "" {
+		result.Server = "agent"
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return errors.Join(err, printResult(result))
+}
+
+// Connects to the server for a session, requesting one from the controller when requestSession
+// is set and config has no session. Returns the configuration connecting to the agent running the
+// session, the API releasing the session, nil when the session is not released by juicify, and
+// the API of the agent running the session.
+func connect(group task.Group, config Configuration, requestSession bool) (Configuration, *restapi.Client, restapi.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: *disableTls,
+	}
+
 	client := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: *disableTls,
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
 
@@ -167,32 +361,91 @@ func Run(group task.Group) error {
 		api.Scheme = "http"
 	}
 
-	if config.Id != "" {
+	// Sessions are released through the server they were requested from
+	var releaseApi *restapi.Client
+
+	var err error
+	if *agentAddress != "" {
+		config.Id, err = requestDirectSession(group, &api)
+		if err != nil {
+			return config, releaseApi, api, err
+		}
+
+		agentApi := api
+		releaseApi = &agentApi
+
+		if config.Id != "" {
+			// The application is told about the GPUs granted, it can still run without them
+			session, err := api.GetSessionWithContext(group.Ctx(), config.Id)
+			if err != nil {
+				logger.Warningf("unable to get the GPUs of session %s, %v", config.Id, err)
+			} else {
+				config.Gpus = session.Gpus
+				config.CpuFallback = session.CpuFallback
+			}
+		}
+	} else if config.Id != "" || requestSession {
+		api.Token = *controllerToken
+		api.OnBehalfOf = *onBehalfOf
+
+		err = api.NegotiateVersionWithContext(group.Ctx())
+		if err != nil {
+			return config, releaseApi, api, err
+		}
+
+		if config.Id == "" {
+			config.Id, err = requestControllerSession(group, api)
+			if err != nil {
+				return config, releaseApi, api, err
+			}
+		}
+
+		controllerApi := api
+		releaseApi = &controllerApi
+
 		session, err := api.GetSessionWithContext(group.Ctx(), config.Id)
 		if err != nil {
-			return err
+			return config, releaseApi, api, err
 		}
 
 		if session.State == restapi.SessionQueued {
 			logger.Info("Session queued")
 
+			if session.Reservation == nil {
+				logPlacementAnalysis(group, api, config.Id)
+			}
+
 			ticker := time.NewTicker(5 * time.Second)
 			defer ticker.Stop()
 
 			for session.State == restapi.SessionQueued {
 				select {
 				case <-group.Ctx().Done():
-					return nil
+					return config, releaseApi, api, group.Ctx().Err()
 
 				case <-ticker.C:
 					session, err = api.GetSessionWithContext(group.Ctx(), config.Id)
 					if err != nil {
-						return err
+						return config, releaseApi, api, err
 					}
 				}
 			}
 		}
 
+		if session.CpuFallback {
+			logger.Warning("Session is using CPU rendering fallback, it is not running on GPU hardware")
+		}
+
+		config.Gpus = session.Gpus
+		config.CpuFallback = session.CpuFallback
+
+		if !*disableTls {
+			err = requestClientCertificate(group, api, tlsConfig, session.Id)
+			if err != nil {
+				return config, releaseApi, api, err
+			}
+		}
+
 		if session.Address != "" {
 			uri := url.URL{
 				Host: session.Address,
@@ -207,36 +460,38 @@ func Run(group task.Group) error {
 			if portStr != "" {
 				portInt, err := strconv.Atoi(portStr)
 				if err != nil {
-					return err
+					return config, releaseApi, api, err
 				}
 
 				config.Port = portInt
 			}
 
 			api.Address = fmt.Sprintf("%s:%d", config.Host, config.Port)
+			api.ApiVersion = restapi.ApiV1
 		}
+
+		// The controller's credentials are not for the agent
+		api.Token = *sessionToken
+		api.OnBehalfOf = ""
 	}
 
 	status, err := api.StatusWithContext(group.Ctx())
 	if err != nil {
-		return err
+		return config, releaseApi, api, err
 	}
 
 	logger.Infof("Connected to %s:%d, v%s", config.Host, config.Port, status.Version)
 
-	if *testConnection {
-		return nil
-	}
+	return config, releaseApi, api, nil
+}
 
+func applicationCommand(application []string, config Configuration) (*exec.Cmd, error) {
 	configOverride, err := json.Marshal(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cmd := createCommand(flag.Args())
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := createCommand(application)
 
 	icdPath := filepath.Join(*juicePath, "JuiceVlk.json")
 
@@ -247,5 +502,119 @@ func Run(group task.Group) error {
 		fmt.Sprintf("JUICE_CFG_OVERRIDE=%s", string(configOverride)),
 	)
 
-	return runCommand(group, cmd, config)
+	cmd.Env = append(cmd.Env, writeAssignment(config)...)
+
+	return cmd, nil
+}
+
+// Requests a session from the controller, returning its id
+func requestControllerSession(group task.Group, api restapi.Client) (string, error) {
+	requirements, err := sessionRequirements()
+	if err != nil {
+		return "", err
+	}
+
+	requirements.AllowCpuFallback = *allowCpuFallback
+	requirements.Priority = *priority
+	requirements.Class = *sessionClass
+	requirements.MetricsPort = *metricsPort
+	requirements.Record = *record
+	requirements.Placement = *placement
+	requirements.CallbackUrl = *callbackUrl
+
+	requirements.Reservation, err = sessionReservation()
+	if err != nil {
+		return "", err
+	}
+
+	requirements.Locality, err = localityHint(group.Ctx())
+	if err != nil {
+		return "", err
+	}
+
+	id, err := api.RequestSessionWithContext(group.Ctx(), requirements)
+	if err != nil {
+		return "", fmt.Errorf("unable to request a session from controller at %s with %s", api.Address, err)
+	}
+
+	if requirements.Reservation != nil {
+		logger.Infof("Session %s reserved from controller at %s from %s until %s", id, api.Address,
+			requirements.Reservation.StartAt.Format(time.RFC3339), requirements.Reservation.EndAt().Format(time.RFC3339))
+	} else {
+		logger.Infof("Session %s requested from controller at %s", id, api.Address)
+	}
+	return id, nil
+}
+
+// Logs why the queued session is not placed and the smallest changes that would place it
+func logPlacementAnalysis(group task.Group, api restapi.Client, id string) {
+	analysis, err := api.GetSessionAnalysisWithContext(group.Ctx(), id)
+	if err != nil {
+		// Controllers predating the analysis do not serve it
+		logger.Debugf("unable to analyze the placement of session %s, %v", id, err)
+		return
+	}
+
+	if analysis.Schedulable {
+		return
+	}
+
+	logger.Infof("Session %s is not placed in pool %s, %s", id, analysis.Pool, analysis.Blocker)
+	for _, suggestion := range analysis.Suggestions {
+		logger.Infof("  To place it, %s", suggestion.Message)
+	}
+}
+
+// Returns the window of --reserve-at and --reserve-for, nil when the session is not reserved
+func sessionReservation() (*restapi.SessionReservation, error) {
+	if *reserveAt == "" {
+		if *reserveFor != 0 {
+			return nil, errors.New("--reserve-for requires --reserve-at")
+		}
+
+		return nil, nil
+	}
+
+	startAt, err := time.Parse(time.RFC3339, *reserveAt)
+	if err != nil {
+		return nil, fmt.Errorf("--reserve-at must be a time in RFC 3339, such as 2023-06-01T22:00:00Z, %v", err)
+	}
+
+	if *reserveFor < time.Second {
+		return nil, errors.New("--reserve-at requires --reserve-for of at least a second")
+	}
+
+	return &restapi.SessionReservation{
+		StartAt:         startAt,
+		DurationSeconds: int64(reserveFor.Seconds()),
+	}, nil
+}
+
+func requestClientCertificate(group task.Group, api restapi.Client, tlsConfig *tls.Config, sessionId string) error {
+	csr, key, err := crypto.GenerateCsr(sessionId)
+	if err != nil {
+		return err
+	}
+
+	issued, err := api.RequestClientCertificateWithContext(group.Ctx(), restapi.CertificateRequest{
+		SessionId: sessionId,
+		Csr:       string(csr),
+	})
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.X509KeyPair([]byte(issued.Certificate), key)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM([]byte(issued.CaCertificate)) {
+		tlsConfig.RootCAs = pool
+	}
+
+	return nil
 }
@@ -0,0 +1,31 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Juice cannot yet be loaded into applications on macOS
+var errUnsupportedHost = errors.New("running applications with Juice is not supported on macOS")
+
+func validateHost() error {
+	return errUnsupportedHost
+}
+
+// Juice loads no host libraries into applications checked ahead of time on this platform
+func hostLibraryChecks() []hostLibrary {
+	return []hostLibrary{}
+}
+
+func createCommand(args []string) *exec.Cmd {
+	return exec.Command(args[0], args[1:]...)
+}
+
+func runCommand(group task.Group, cmd *exec.Cmd, config Configuration) error {
+	return errUnsupportedHost
+}
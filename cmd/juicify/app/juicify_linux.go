@@ -7,38 +7,11 @@ import (
 	"fmt"
 	"os/exec"
 	"path/filepath"
-
-	"github.com/NVIDIA/go-nvml/pkg/dl"
+	"strings"
 
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
 
-func check(name string) error {
-	lib := dl.New(name, dl.RTLD_NOW)
-	err := lib.Open()
-	if err != nil {
-		return err
-	}
-
-	return lib.Close()
-}
-
-func validateHost() error {
-	names := []string{
-		"libstdc++.so.6",
-		"libvulkan.so.1",
-	}
-
-	for _, name := range names {
-		err := check(name)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func createCommand(args []string) *exec.Cmd {
 	return exec.Command(args[0], args[1:]...)
 }
@@ -48,7 +21,10 @@ func runCommand(group task.Group, cmd *exec.Cmd, config Configuration) error {
 
 	juiceLibraryPath := filepath.Join(*juicePath, "libjuicejuda.so")
 
-	cmd.Env = append(cmd.Env, fmt.Sprintf("LD_PRELOAD=%s", juiceLibraryPath))
+	// Libraries given by --preload load after Juice
+	preloads := append([]string{juiceLibraryPath}, preloadLibraries...)
+
+	cmd.Env = append(cmd.Env, fmt.Sprintf("LD_PRELOAD=%s", strings.Join(preloads, ":")))
 
 	return cmd.Run()
 }
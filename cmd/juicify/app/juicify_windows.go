@@ -10,6 +10,7 @@ import (
 	// See https://github.com/Juice-Labs/juice/issues/1765.
 	// "github.com/kolesnikovae/go-winjob"
 
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
 
@@ -17,11 +18,20 @@ func validateHost() error {
 	return nil
 }
 
+// Juice loads no host libraries into applications checked ahead of time on this platform
+func hostLibraryChecks() []hostLibrary {
+	return []hostLibrary{}
+}
+
 func createCommand(args []string) *exec.Cmd {
 	return exec.Command(filepath.Join(*juicePath, "launch.exe"), args...)
 }
 
 func runCommand(group task.Group, cmd *exec.Cmd, config Configuration) error {
+	if len(preloadLibraries) > 0 {
+		logger.Warning("--preload is ignored on Windows")
+	}
+
 	// Windows jobs intermittently generate "SetInformationJobOject: The
 	// parameter is incorrect" errors when trying to execute launch.exe to
 	// spawn and inject Juice into an application.  Also juicify doesn't exit
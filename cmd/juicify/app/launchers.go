@@ -0,0 +1,258 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/config"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+var (
+	profileName  = flag.String("profile", "", "Applies the options and application saved in the named per-game profile, options given on the command line take precedence")
+	saveProfile  = flag.String("save-profile", "", "Saves the options and application given on the command line as the named per-game profile and exits")
+	profilesFile = flag.String("profiles-file", "", "Path to the per-game profiles, defaults to juice/profiles.json in the user's configuration directory")
+
+	steamLaunchOptions = flag.Bool("steam-launch-options", false, "Prints the Steam launch options that run a game through juicify with the given options and exits")
+	createShortcut     = flag.String("create-shortcut", "", "Creates a shortcut at the given path that runs the application through juicify with the given options and exits")
+)
+
+// Options that only control the launcher integration and are never passed on to
+// the command lines it generates
+var integrationFlags = map[string]bool{
+	"save-profile":         true,
+	"steam-launch-options": true,
+	"create-shortcut":      true,
+	"completion":           true,
+	"complete":             true,
+	"test":                 true,
+	"test-connection":      true,
+	"version":              true,
+}
+
+// Options given on the command line rather than applied from a profile, generated
+// command lines refer to the profile instead of repeating its options
+var commandLineFlags = map[string]bool{}
+
+// Per-game juicify options and the application they launch
+type Profile struct {
+	Args    []string `json:"args"`
+	Command []string `json:"command,omitempty"`
+}
+
+func getProfilesPath() (string, error) {
+	if *profilesFile != "" {
+		return *profilesFile, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "juice", "profiles.json"), nil
+}
+
+func loadProfiles() (map[string]Profile, error) {
+	path, err := getProfilesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := map[string]Profile{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse profiles %s, %v", path, err)
+	}
+
+	return profiles, nil
+}
+
+func storeProfiles(profiles map[string]Profile) error {
+	path, err := getProfilesPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// Applies the profile given by --profile, returning the application to launch. The
+// application given on the command line replaces the one saved in the profile.
+func applyProfile() ([]string, error) {
+	// Options applied from the configuration are not saved with profiles
+	flag.Visit(func(f *flag.Flag) {
+		if !config.Applied(f.Name) {
+			commandLineFlags[f.Name] = true
+		}
+	})
+
+	if *profileName == "" {
+		// The configuration may name the profile applied by default
+		userConfig, _, err := loadUserConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if userConfig.Profile == "" {
+			return flag.Args(), nil
+		}
+
+		*profileName = userConfig.Profile
+	}
+
+	profile, err := findProfile(*profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the profile's options and then the command line again so the options
+	// given on the command line take precedence
+	err = flag.CommandLine.Parse(profile.Args)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s is invalid, %v", *profileName, err)
+	}
+
+	err = flag.CommandLine.Parse(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(flag.Args()) > 0 {
+		return flag.Args(), nil
+	}
+
+	return profile.Command, nil
+}
+
+// Returns the options given to juicify, excluding those in exclude and those controlling
+// the launcher integration. Options applied from a profile are only included with withProfile.
+func launcherArgs(withProfile bool, exclude ...string) []string {
+	args := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		if (!withProfile && !commandLineFlags[f.Name]) || integrationFlags[f.Name] {
+			return
+		}
+
+		for _, name := range exclude {
+			if f.Name == name {
+				return
+			}
+		}
+
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+
+	return args
+}
+
+func runSaveProfile(application []string) error {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+
+	userConfig, path, err := loadUserConfig()
+	if err != nil {
+		return err
+	}
+
+	if _, found := userConfig.Profiles[*saveProfile]; found {
+		return fmt.Errorf("profile %s is defined by %s, edit it there instead", *saveProfile, path)
+	}
+
+	profiles[*saveProfile] = Profile{
+		Args:    launcherArgs(true, "profile", "profiles-file", "juice-config"),
+		Command: application,
+	}
+
+	err = storeProfiles(profiles)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Saved profile %s", *saveProfile)
+	return nil
+}
+
+// Steam substitutes %command% with the game's own command line
+func runSteamLaunchOptions() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{executable}, launcherArgs(false)...)
+	args = append(args, "--", "%command%")
+
+	quoted := make([]string, len(args))
+	for index, arg := range args {
+		quoted[index] = quoteArgument(arg)
+	}
+
+	// %command% is substituted by Steam and must not be quoted
+	quoted[len(quoted)-1] = "%command%"
+
+	fmt.Println(strings.Join(quoted, " "))
+	return nil
+}
+
+func runCreateShortcut(application []string) error {
+	if len(application) == 0 {
+		return errors.New("--create-shortcut requires an application, either on the command line or from --profile")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := launcherArgs(false)
+
+	// The profile supplies the application when it is not given on the command line
+	if len(flag.Args()) > 0 {
+		args = append(args, "--")
+		args = append(args, flag.Args()...)
+	}
+
+	name := *profileName
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(application[0]), filepath.Ext(application[0]))
+	}
+
+	err = createShortcutFile(*createShortcut, name, filepath.Dir(application[0]), executable, args)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Created shortcut %s", *createShortcut)
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func quoteArgument(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return arg
+	}
+
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Exec keys of desktop entries are double quoted with ", `, $, and \ escaped
+func quoteDesktopArgument(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`<>~|&;*?#()") {
+		return strings.ReplaceAll(arg, "%", "%%")
+	}
+
+	replacer := strings.NewReplacer(`"`, `\"`, "`", "\\`", `$`, `\$`, `\`, `\\`, "%", "%%")
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// Creates a freedesktop.org desktop entry
+func createShortcutFile(path string, name string, workingDir string, executable string, args []string) error {
+	if filepath.Ext(path) != ".desktop" {
+		path = path + ".desktop"
+	}
+
+	quoted := []string{quoteDesktopArgument(executable)}
+	for _, arg := range args {
+		quoted = append(quoted, quoteDesktopArgument(arg))
+	}
+
+	entry := strings.Join([]string{
+		"[Desktop Entry]",
+		"Type=Application",
+		fmt.Sprintf("Name=%s", name),
+		fmt.Sprintf("Comment=%s with Juice", name),
+		fmt.Sprintf("Exec=%s", strings.Join(quoted, " ")),
+		fmt.Sprintf("Path=%s", workingDir),
+		"Terminal=false",
+		"",
+	}, "\n")
+
+	return os.WriteFile(path, []byte(entry), 0755)
+}
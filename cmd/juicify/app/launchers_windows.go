@@ -0,0 +1,54 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func quoteArgument(arg string) string {
+	return syscall.EscapeArg(arg)
+}
+
+// PowerShell single quoted strings only escape single quotes
+func quotePowerShell(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// Creates a .lnk shortcut through the WScript.Shell COM object
+func createShortcutFile(path string, name string, workingDir string, executable string, args []string) error {
+	if !strings.EqualFold(filepath.Ext(path), ".lnk") {
+		path = path + ".lnk"
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, len(args))
+	for index, arg := range args {
+		quoted[index] = quoteArgument(arg)
+	}
+
+	script := strings.Join([]string{
+		fmt.Sprintf("$shortcut = (New-Object -ComObject WScript.Shell).CreateShortcut(%s)", quotePowerShell(path)),
+		fmt.Sprintf("$shortcut.TargetPath = %s", quotePowerShell(executable)),
+		fmt.Sprintf("$shortcut.Arguments = %s", quotePowerShell(strings.Join(quoted, " "))),
+		fmt.Sprintf("$shortcut.WorkingDirectory = %s", quotePowerShell(workingDir)),
+		fmt.Sprintf("$shortcut.Description = %s", quotePowerShell(fmt.Sprintf("%s with Juice", name))),
+		"$shortcut.Save()",
+	}, "; ")
+
+	output, err := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to create shortcut %s, %v\n%s", path, err, string(output))
+	}
+
+	return nil
+}
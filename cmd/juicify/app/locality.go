@@ -0,0 +1,139 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	matchLabels    = flag.String("match-labels", "", "Comma separated list of key=value pairs the agent running the session must have, e.g. region=us-east")
+	region         = flag.String("region", "", "The region juicify runs in, the controller prefers agents with the same region label")
+	zone           = flag.String("zone", "", "The zone juicify runs in, the controller prefers agents with the same zone label")
+	localityProbes = flag.String("locality-probes", "", "Comma separated list of region=host:port pairs, juicify measures the round trip time to each and the controller prefers agents in the regions closest to it")
+)
+
+const (
+	localityProbeAttempts = 3
+	localityProbeTimeout  = 2 * time.Second
+)
+
+func parseKeyValues(name string, value string) (map[string]string, error) {
+	keyValues := map[string]string{}
+	if value == "" {
+		return keyValues, nil
+	}
+
+	var err error
+	for _, pair := range strings.Split(value, ",") {
+		keyValue := strings.Split(pair, "=")
+		if len(keyValue) != 2 {
+			err = errors.Join(err, fmt.Errorf("'%s' must be in the format key=value", pair))
+		} else {
+			keyValues[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --%s with %s", name, err)
+	}
+
+	return keyValues, nil
+}
+
+// Returns where juicify is for the controller to place its session close by, nil when
+// neither --region, --zone, nor --locality-probes are given
+func localityHint(ctx context.Context) (*restapi.LocalityHint, error) {
+	probes, err := parseKeyValues("locality-probes", *localityProbes)
+	if err != nil {
+		return nil, err
+	}
+
+	if *region == "" && *zone == "" && len(probes) == 0 {
+		return nil, nil
+	}
+
+	hint := &restapi.LocalityHint{
+		Region: *region,
+		Zone:   *zone,
+	}
+
+	if len(probes) > 0 {
+		hint.RegionRtts = measureRegionRtts(ctx, probes)
+	}
+
+	return hint, nil
+}
+
+// Measures the round trip time to each region as the quickest of a few TCP connections to its
+// address. Regions that cannot be reached are left out.
+func measureRegionRtts(ctx context.Context, probes map[string]string) map[string]float64 {
+	var mutex sync.Mutex
+	rtts := map[string]float64{}
+
+	var wg sync.WaitGroup
+	for region, address := range probes {
+		wg.Add(1)
+		go func(region, address string) {
+			defer wg.Done()
+
+			rtt, err := measureRtt(ctx, address)
+			if err != nil {
+				logger.Debugf("unable to measure the round trip time to region %s at %s, %v", region, address, err)
+				return
+			}
+
+			logger.Debugf("round trip time to region %s is %s", region, rtt)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			rtts[region] = float64(rtt.Microseconds()) / 1000
+		}(region, address)
+	}
+
+	wg.Wait()
+
+	return rtts
+}
+
+func measureRtt(ctx context.Context, address string) (time.Duration, error) {
+	dialer := net.Dialer{
+		Timeout: localityProbeTimeout,
+	}
+
+	var quickest time.Duration
+	var err error
+	for attempt := 0; attempt < localityProbeAttempts; attempt++ {
+		start := time.Now()
+
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			continue
+		}
+
+		rtt := time.Since(start)
+		conn.Close()
+
+		if quickest == 0 || rtt < quickest {
+			quickest = rtt
+		}
+	}
+
+	if quickest == 0 {
+		return 0, err
+	}
+
+	return quickest, nil
+}
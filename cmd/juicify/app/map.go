@@ -0,0 +1,373 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const mapUsage = "usage: juicify [options] map [--count <n> | --parameters <file>] [--concurrency <n>] [--retries <n>] [--status-file <file>] <application> <application args>"
+
+const (
+	mapTaskPending   = "pending"
+	mapTaskRunning   = "running"
+	mapTaskSucceeded = "succeeded"
+	mapTaskFailed    = "failed"
+	mapTaskCanceled  = "canceled"
+)
+
+// Placeholders replaced in the application and its arguments for each task
+const (
+	mapIndexPlaceholder     = "{index}"
+	mapParameterPlaceholder = "{param}"
+)
+
+type mapTask struct {
+	Index     int    `json:"index"`
+	Parameter string `json:"parameter,omitempty"`
+	State     string `json:"state"`
+	Attempts  int    `json:"attempts"`
+	SessionId string `json:"sessionId,omitempty"`
+	ExitCode  int    `json:"exitCode"`
+	Error     string `json:"error,omitempty"`
+}
+
+// The outcome of juicify map printed with --output-format
+type mapSummary struct {
+	Tasks     int `json:"tasks"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Canceled  int `json:"canceled"`
+	// The tasks in order of index, the same as those written to --status-file
+	Results []mapTask `json:"results"`
+}
+
+type mapRunner struct {
+	config      Configuration
+	application []string
+	retries     int
+	statusFile  string
+
+	mutex sync.Mutex
+	tasks []mapTask
+}
+
+// juicify map runs the application once per task, each with its own session
+func isMap(application []string) bool {
+	return len(application) > 0 && application[0] == "map"
+}
+
+// Reads one parameter per line, skipping empty lines and lines starting with #
+func readMapParameters(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %s, %v", path, err)
+	}
+
+	parameters := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			parameters = append(parameters, line)
+		}
+	}
+
+	return parameters, nil
+}
+
+func runMap(group task.Group, config Configuration, args []string) error {
+	flags := flag.NewFlagSet("map", flag.ContinueOnError)
+	count := flags.Int("count", 0, "The number of tasks to run, each task is given its index through "+mapIndexPlaceholder)
+	parametersFile := flags.String("parameters", "", "File of one parameter per line, a task is run for each parameter and given it through "+mapParameterPlaceholder)
+	concurrency := flags.Int("concurrency", 1, "The maximum number of tasks, and so sessions, running at once")
+	retries := flags.Int("retries", 0, "The number of times a failed task is run again, each time with a new session")
+	statusFile := flags.String("status-file", "", "File the status of every task is written to as JSON whenever a task changes")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New(mapUsage)
+	}
+
+	if *concurrency < 1 {
+		return errors.New("map: --concurrency must be at least 1")
+	}
+
+	var parameters []string
+	if *parametersFile != "" {
+		if *count != 0 {
+			return errors.New("map: --count and --parameters are mutually exclusive, one or the other but not both")
+		}
+
+		parameters, err = readMapParameters(*parametersFile)
+		if err != nil {
+			return err
+		}
+	} else if *count > 0 {
+		parameters = make([]string, *count)
+	} else {
+		return errors.New("map: either --count or --parameters is required")
+	}
+
+	// Every task requests its own session rather than using the one in juice.cfg
+	config.Id = ""
+
+	runner := &mapRunner{
+		config:      config,
+		application: flags.Args(),
+		retries:     *retries,
+		statusFile:  *statusFile,
+		tasks:       make([]mapTask, len(parameters)),
+	}
+
+	for index, parameter := range parameters {
+		runner.tasks[index] = mapTask{
+			Index:     index,
+			Parameter: parameter,
+			State:     mapTaskPending,
+		}
+	}
+
+	logger.Infof("map: running %d tasks, %d at a time", len(runner.tasks), *concurrency)
+
+	runner.writeStatus()
+
+	slots := make(chan struct{}, *concurrency)
+
+	var waitGroup sync.WaitGroup
+	for index := range runner.tasks {
+		select {
+		case slots <- struct{}{}:
+		case <-group.Ctx().Done():
+		}
+
+		if group.Ctx().Err() != nil {
+			break
+		}
+
+		waitGroup.Add(1)
+		go func(index int) {
+			defer waitGroup.Done()
+			defer func() { <-slots }()
+
+			runner.run(group, index)
+		}(index)
+	}
+
+	waitGroup.Wait()
+
+	return runner.summarize(group)
+}
+
+func (runner *mapRunner) update(index int, fn func(task *mapTask)) {
+	runner.mutex.Lock()
+	fn(&runner.tasks[index])
+	runner.mutex.Unlock()
+
+	runner.writeStatus()
+}
+
+func (runner *mapRunner) writeStatus() {
+	if runner.statusFile == "" {
+		return
+	}
+
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	data, err := json.MarshalIndent(runner.tasks, "", "  ")
+	if err == nil {
+		err = os.WriteFile(runner.statusFile, data, 0644)
+	}
+	if err != nil {
+		logger.Warningf("map: unable to write %s, %v", runner.statusFile, err)
+	}
+}
+
+// Returns the application and its arguments for the task with the placeholders replaced
+func (runner *mapRunner) taskApplication(index int, parameter string) []string {
+	replacer := strings.NewReplacer(
+		mapIndexPlaceholder, strconv.Itoa(index),
+		mapParameterPlaceholder, parameter,
+	)
+
+	application := make([]string, len(runner.application))
+	for i, arg := range runner.application {
+		application[i] = replacer.Replace(arg)
+	}
+
+	return application
+}
+
+// Runs the task until it succeeds, it has been retried --retries times, or juicify is canceled
+func (runner *mapRunner) run(group task.Group, index int) {
+	parameter := runner.tasks[index].Parameter
+
+	for attempt := 1; attempt <= runner.retries+1; attempt++ {
+		runner.update(index, func(task *mapTask) {
+			task.State = mapTaskRunning
+			task.Attempts = attempt
+			task.SessionId = ""
+			task.Error = ""
+		})
+
+		sessionId, err := runner.attempt(group, index, parameter)
+
+		exitCode := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			exitCode = -1
+		}
+
+		canceled := group.Ctx().Err() != nil
+
+		runner.update(index, func(task *mapTask) {
+			task.SessionId = sessionId
+			task.ExitCode = exitCode
+
+			switch {
+			case err == nil:
+				task.State = mapTaskSucceeded
+			case canceled:
+				task.State = mapTaskCanceled
+				task.Error = err.Error()
+			default:
+				task.State = mapTaskFailed
+				task.Error = err.Error()
+			}
+		})
+
+		if err == nil || canceled {
+			return
+		}
+
+		if attempt <= runner.retries {
+			logger.Warningf("map: task %d failed on attempt %d of %d, retrying, %v", index, attempt, runner.retries+1, err)
+		} else {
+			logger.Errorf("map: task %d failed after %d attempts, %v", index, attempt, err)
+		}
+	}
+}
+
+// Runs the task once with a new session, returning the id of the session
+func (runner *mapRunner) attempt(group task.Group, index int, parameter string) (string, error) {
+	local, err := openLocalSession(runner.application, runner.config)
+	if err != nil {
+		return "", err
+	}
+	defer local.Release()
+
+	config, releaseApi, _, err := connect(group, runner.config, true)
+
+	var frames *frameReporter
+	startedAt := time.Now()
+	if err == nil {
+		logger.Infof("map: task %d running with session %s", index, config.Id)
+
+		frames = startFrameReporter(releaseApi, &config)
+
+		cmd, err_ := applicationCommand(runner.taskApplication(index, parameter), config)
+		err = err_
+		if err == nil {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			// Stdout is left to the summary so scripts are able to parse it
+			if structuredOutput() {
+				cmd.Stdout = os.Stderr
+			}
+			cmd.Env = append(cmd.Env,
+				fmt.Sprintf("JUICIFY_MAP_INDEX=%d", index),
+				fmt.Sprintf("JUICIFY_MAP_PARAM=%s", parameter),
+			)
+
+			err = runCommand(group, cmd, config)
+			removeAssignment(config)
+		}
+	}
+
+	frames.Stop()
+
+	if releaseApi != nil {
+		releaseSession(*releaseApi, config.Id, startedAt, err, group.Ctx().Err() != nil)
+	}
+
+	return config.Id, err
+}
+
+// Logs the outcome of every task and the tasks by exit code, returning an error when any task did not succeed
+func (runner *mapRunner) summarize(group task.Group) error {
+	runner.mutex.Lock()
+
+	states := map[string]int{}
+	exitCodes := map[int]int{}
+	for index := range runner.tasks {
+		task := &runner.tasks[index]
+
+		// Never started because juicify was canceled
+		if task.State == mapTaskPending && group.Ctx().Err() != nil {
+			task.State = mapTaskCanceled
+		}
+
+		states[task.State]++
+		if task.State == mapTaskSucceeded || task.State == mapTaskFailed {
+			exitCodes[task.ExitCode]++
+		}
+	}
+
+	total := len(runner.tasks)
+	var err error
+	if structuredOutput() {
+		err = printResult(mapSummary{
+			Tasks:     total,
+			Succeeded: states[mapTaskSucceeded],
+			Failed:    states[mapTaskFailed],
+			Canceled:  states[mapTaskCanceled],
+			Results:   runner.tasks,
+		})
+	}
+	runner.mutex.Unlock()
+
+	runner.writeStatus()
+
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("map: %d tasks, %d succeeded, %d failed, %d canceled",
+		total, states[mapTaskSucceeded], states[mapTaskFailed], states[mapTaskCanceled])
+
+	codes := make([]int, 0, len(exitCodes))
+	for code := range exitCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		logger.Infof("map:   exit code %d: %d tasks", code, exitCodes[code])
+	}
+
+	if states[mapTaskSucceeded] != total {
+		return fmt.Errorf("map: %d of %d tasks did not succeed", total-states[mapTaskSucceeded], total)
+	}
+
+	return nil
+}
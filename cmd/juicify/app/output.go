@@ -0,0 +1,47 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+// Formats of --output-format
+const (
+	outputText = "text"
+	outputJson = "json"
+	outputYaml = "yaml"
+)
+
+// Named --output-format rather than --output as juicify report's --output is the archive it writes
+var outputFormat = flag.String("output-format", outputText, "Prints the results of --test-connection, map, and report to stdout as json or yaml rather than logging them as text, for scripts. The fields of the results only change in new major versions")
+
+func validateOutputFormat() error {
+	if *outputFormat != outputText && *outputFormat != outputJson && *outputFormat != outputYaml {
+		return fmt.Errorf("--output-format must be text, json, or yaml, not %s", *outputFormat)
+	}
+
+	return nil
+}
+
+// Returns whether results are printed as JSON or YAML rather than logged
+func structuredOutput() bool {
+	return *outputFormat != outputText
+}
+
+// Prints the result to stdout in --output-format
+func printResult(value any) error {
+	if *outputFormat == outputYaml {
+		return utilities.WriteYaml(os.Stdout, value)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -0,0 +1,220 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/jobs"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/utilities"
+)
+
+const pairedUsage = "usage: juicify [options] paired --job <script> [--job-args <args>] [--launcher slurm|exec] [--sbatch-args <args>] [--poll-interval <duration>] [--] <application> [<application args>]"
+
+// Bounds canceling the paired job once juicify itself has been canceled
+const pairedCancelTimeout = 30 * time.Second
+
+// juicify paired runs the application alongside a CPU job, requesting its session once the job
+// starts and stopping the one still running when the other ends
+func isPaired(application []string) bool {
+	return len(application) > 0 && application[0] == "paired"
+}
+
+func runPaired(group task.Group, config Configuration, args []string) error {
+	jobArgs := []string{}
+	sbatchArgs := []string{}
+
+	flags := flag.NewFlagSet("paired", flag.ContinueOnError)
+	jobCommand := flags.String("job", "", "The script or command of the CPU job, submitted with sbatch by the slurm launcher or run locally by the exec launcher")
+	flags.Var(utilities.CommaValue{Value: &jobArgs}, "job-args", "Comma separated arguments of the job")
+	launcherName := flags.String("launcher", "slurm", "How the job is run, one of slurm or exec")
+	flags.Var(utilities.CommaValue{Value: &sbatchArgs}, "sbatch-args", "Comma separated options passed to sbatch, such as --partition=cpu,--nodes=4")
+	pollInterval := flags.Duration("poll-interval", 5*time.Second, "How often the state of the job is checked")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New(pairedUsage)
+	}
+
+	if *jobCommand == "" {
+		return errors.New("paired: --job is required")
+	}
+
+	if *pollInterval <= 0 {
+		return errors.New("paired: --poll-interval must be positive")
+	}
+
+	var launcher jobs.Launcher
+	switch *launcherName {
+	case "slurm":
+		launcher = jobs.NewSlurmLauncher(sbatchArgs)
+	case "exec":
+		if len(sbatchArgs) > 0 {
+			return errors.New("paired: --sbatch-args requires --launcher slurm")
+		}
+
+		launcher = jobs.NewExecLauncher()
+	default:
+		return fmt.Errorf("paired: --launcher must be one of slurm or exec, not %s", *launcherName)
+	}
+
+	job, err := launcher.Submit(group.Ctx(), jobs.Spec{
+		Command: append([]string{*jobCommand}, jobArgs...),
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("paired: submitted job %s, waiting for it to start", job.Id())
+
+	state, err := jobs.WaitFor(group.Ctx(), job, *pollInterval, func(state string) bool {
+		return state != jobs.StatePending
+	})
+	if err != nil {
+		// Canceled while the job was queued
+		if group.Ctx().Err() != nil {
+			return cancelPairedJob(job)
+		}
+
+		return errors.Join(err, cancelPairedJob(job))
+	}
+
+	if jobs.Ended(state) {
+		return fmt.Errorf("paired: job %s ended, %s, before it was seen running", job.Id(), state)
+	}
+
+	logger.Infof("paired: job %s is running, requesting a session", job.Id())
+
+	// The session is requested for the job rather than using the one in juice.cfg
+	config.Id = ""
+
+	return runPairedApplication(group, config, job, *pollInterval, flags.Args())
+}
+
+// Runs the application with a new session until it exits or the job ends, stopping the other
+func runPairedApplication(group task.Group, config Configuration, job jobs.Job, pollInterval time.Duration, application []string) error {
+	local, err := openLocalSession(application, config)
+	if err != nil {
+		return errors.Join(err, cancelPairedJob(job))
+	}
+	defer local.Release()
+
+	config, releaseApi, _, err := connect(group, config, true)
+	if err != nil {
+		err = errors.Join(err, cancelPairedJob(job))
+
+		// Canceled while waiting for the session
+		if group.Ctx().Err() != nil {
+			return nil
+		}
+
+		return err
+	}
+
+	logger.Infof("paired: running with session %s alongside job %s", config.Id, job.Id())
+
+	frames := startFrameReporter(releaseApi, &config)
+
+	ctx, cancel := context.WithCancel(group.Ctx())
+	defer cancel()
+
+	cmd, err := applicationCommand(application, config)
+	startedAt := time.Now()
+	if err == nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("JUICIFY_PAIRED_JOB_ID=%s", job.Id()))
+
+		// The job ending stops the application
+		cmd = bindCommand(ctx, cmd)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// The state the job ended in, empty when the application exited first
+		var jobState string
+		watching := make(chan struct{})
+		go func() {
+			defer close(watching)
+
+			state, err := jobs.WaitFor(ctx, job, pollInterval, jobs.Ended)
+			if err == nil {
+				logger.Infof("paired: job %s ended, %s, stopping the application", job.Id(), state)
+
+				jobState = state
+				cancel()
+			} else if ctx.Err() == nil {
+				logger.Warningf("paired: unable to get the state of job %s, %v", job.Id(), err)
+			}
+		}()
+
+		err = runCommand(group, cmd, config)
+		removeAssignment(config)
+		cancel()
+		<-watching
+
+		switch jobState {
+		case "":
+			err = errors.Join(err, cancelPairedJob(job))
+		case jobs.StateCompleted:
+			// The application was stopped because the job is done
+			err = nil
+		default:
+			err = fmt.Errorf("paired: job %s ended, %s", job.Id(), jobState)
+		}
+	} else {
+		err = errors.Join(err, cancelPairedJob(job))
+	}
+
+	frames.Stop()
+
+	if releaseApi != nil {
+		releaseSession(*releaseApi, config.Id, startedAt, err, group.Ctx().Err() != nil)
+	}
+
+	return err
+}
+
+// Returns a copy of the command killed when ctx is done. On Windows this kills launch.exe
+// rather than the application it launched.
+func bindCommand(ctx context.Context, cmd *exec.Cmd) *exec.Cmd {
+	bound := exec.CommandContext(ctx, cmd.Path)
+	bound.Args = cmd.Args
+	bound.Env = cmd.Env
+	bound.Dir = cmd.Dir
+	bound.SysProcAttr = cmd.SysProcAttr
+	bound.ExtraFiles = cmd.ExtraFiles
+
+	return bound
+}
+
+// Cancels the job unless it has already ended
+func cancelPairedJob(job jobs.Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pairedCancelTimeout)
+	defer cancel()
+
+	state, err := job.State(ctx)
+	if err == nil && jobs.Ended(state) {
+		return nil
+	}
+
+	logger.Infof("paired: canceling job %s", job.Id())
+
+	err = job.Cancel(ctx)
+	if err != nil {
+		return fmt.Errorf("paired: unable to cancel job %s, %v", job.Id(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+	"github.com/Juice-Labs/Juice-Labs/pkg/transport"
+)
+
+var (
+	useQuic           = flag.Bool("quic", false, "Experimental. Connects the application to the agent over QUIC when the agent accepts it, so the session survives network changes such as from Wi-Fi to wired, falling back to TCP otherwise")
+	quicResumeTimeout = flag.Duration("quic-resume-timeout", 30*time.Second, "How long juicify tries to reconnect to the agent over QUIC after the network changes before the application's connections are closed")
+)
+
+// Relays the application's connections, accepted on a loopback port, to the agent over QUIC, as
+// the application connects over TCP
+type quicBridge struct {
+	listener net.Listener
+	dialer   *transport.Dialer
+
+	done chan struct{}
+}
+
+// Returns nil when --quic is not set or the agent does not accept QUIC, otherwise points config at
+// the bridge's loopback port and starts relaying
+func startQuicBridge(group task.Group, api restapi.Client, config *Configuration) *quicBridge {
+	if !*useQuic {
+		return nil
+	}
+
+	status, err := api.StatusWithContext(group.Ctx())
+	if err != nil {
+		logger.Warningf("unable to read the status of the agent, connecting over TCP, %v", err)
+		return nil
+	}
+
+	if !status.HasCapability(restapi.CapabilityQuic) || status.QuicPort == 0 {
+		logger.Info("the agent does not accept QUIC, connecting over TCP")
+		return nil
+	}
+
+	// The TLS configuration of the agent's API, holding the client certificate issued by the controller
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: *disableTls,
+	}
+	if httpTransport, ok := api.Client.Transport.(*http.Transport); ok && httpTransport.TLSClientConfig != nil {
+		tlsConfig = httpTransport.TLSClientConfig
+	}
+
+	address := net.JoinHostPort(config.Host, fmt.Sprint(status.QuicPort))
+	dialer, err := transport.Dial(group.Ctx(), address, tlsConfig, *quicResumeTimeout)
+	if err != nil {
+		logger.Warningf("unable to connect to the agent over QUIC at %s, connecting over TCP, %v", address, err)
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Warningf("unable to listen for the application's connections, connecting over TCP, %v", err)
+		dialer.Close()
+		return nil
+	}
+
+	bridge := &quicBridge{
+		listener: listener,
+		dialer:   dialer,
+		done:     make(chan struct{}),
+	}
+
+	go bridge.run(group)
+
+	config.Host = "127.0.0.1"
+	config.Port = listener.Addr().(*net.TCPAddr).Port
+
+	logger.Infof("Connected to %s over QUIC (experimental)", address)
+	return bridge
+}
+
+func (bridge *quicBridge) run(group task.Group) {
+	defer close(bridge.done)
+
+	for {
+		local, err := bridge.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		remote, err := bridge.dialer.DialContext(group.Ctx())
+		if err != nil {
+			logger.Warningf("unable to open a connection to the agent over QUIC, %v", err)
+			local.Close()
+			continue
+		}
+
+		go transport.Relay(local, remote)
+	}
+}
+
+func (bridge *quicBridge) Stop() {
+	if bridge == nil {
+		return
+	}
+
+	bridge.listener.Close()
+	<-bridge.done
+
+	bridge.dialer.Close()
+}
@@ -0,0 +1,51 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"time"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// Releases the session once the application exits rather than waiting for the agent
+// to notice, reporting how the application exited and how long it ran
+func releaseSession(api restapi.Client, id string, startedAt time.Time, runErr error, canceled bool) {
+	release := restapi.SessionRelease{
+		ExitStatus: restapi.ExitStatusSuccess,
+		StartedAt:  startedAt,
+		EndedAt:    time.Now(),
+	}
+
+	var exitErr *exec.ExitError
+	if canceled {
+		release.ExitStatus = restapi.ExitStatusCanceled
+	} else if errors.As(runErr, &exitErr) {
+		release.ExitStatus = restapi.ExitStatusFailure
+		release.ExitCode = exitErr.ExitCode()
+	} else if runErr != nil {
+		release.ExitStatus = restapi.ExitStatusFailure
+		release.ExitCode = -1
+	}
+
+	logger.Infof("Session %s ran for %s, exit status %s (%d)",
+		id, release.EndedAt.Sub(release.StartedAt).Round(time.Millisecond), release.ExitStatus, release.ExitCode)
+
+	// juicify may be exiting because it was canceled, release the session regardless
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := api.ReleaseSessionWithContext(ctx, id, release)
+	if errors.Is(err, pkgerrors.ErrNotFound) {
+		// Already cleaned up or released by another copy of juicify
+		logger.Debugf("session %s was not found to release, %v", id, err)
+	} else if err != nil {
+		logger.Warningf("unable to release session %s, %v", id, err)
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"archive/zip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+const reportUsage = "usage: juicify [options] report [--session <id>] [--output <file>] [--log-bytes <bytes>]"
+
+// Options whose values are replaced in reports, matched by name
+var sensitiveOptions = []string{"token", "secret", "password", "key"}
+
+// A library Juice loads into applications, see hostLibraryChecks
+type hostLibrary struct {
+	Name string `json:"name"`
+	// The file the library resolves to, empty when it cannot be found
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type reportFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type reportHost struct {
+	Version string `json:"version"`
+	Os      string `json:"os"`
+	Arch    string `json:"arch"`
+
+	// The outcome of checking the host can run applications with Juice, empty when it can
+	ValidationError string        `json:"validationError,omitempty"`
+	Libraries       []hostLibrary `json:"libraries"`
+
+	// The files of the Juice installation at --juice-path
+	JuicePath  string       `json:"juicePath"`
+	JuiceFiles []reportFile `json:"juiceFiles"`
+}
+
+type reportConfig struct {
+	Config Configuration `json:"config"`
+	// The options juicify was run with, sensitive values replaced
+	Options map[string]string `json:"options"`
+}
+
+// The outcome of juicify report printed with --output-format
+type reportResult struct {
+	Archive string     `json:"archive"`
+	Host    reportHost `json:"host"`
+}
+
+// juicify report packages what support needs to reproduce a problem into an archive to attach
+// to bug reports
+func isReport(application []string) bool {
+	return len(application) > 0 && application[0] == "report"
+}
+
+func runReport(group task.Group, config Configuration, args []string) error {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	sessionId := flags.String("session", config.Id, "The session to include the placement of, defaults to the session in juice.cfg")
+	output := flags.String("output", fmt.Sprintf("juicify-report-%s.zip", time.Now().Format("20060102-150405")), "The archive to write")
+	logBytes := flags.Int64("log-bytes", 1024*1024, "Bytes at the end of the client's log included in the report")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 0 {
+		return errors.New(reportUsage)
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(file)
+
+	host := reportHostInfo()
+
+	err = writeReport(group, archive, host, config, *sessionId, *logBytes)
+	err = errors.Join(err, archive.Close(), file.Close())
+	if err != nil {
+		return errors.Join(err, os.Remove(*output))
+	}
+
+	if structuredOutput() {
+		return printResult(reportResult{
+			Archive: *output,
+			Host:    host,
+		})
+	}
+
+	logger.Infof("Wrote the report to %s, attach it to the bug report", *output)
+	return nil
+}
+
+func writeReport(group task.Group, archive *zip.Writer, host reportHost, config Configuration, sessionId string, logBytes int64) error {
+	err := writeReportJson(archive, "host.json", host)
+	if err != nil {
+		return err
+	}
+
+	err = writeReportJson(archive, "config.json", reportConfig{
+		Config:  config,
+		Options: sanitizedOptions(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if config.LogFile != "" {
+		err = writeReportTail(archive, filepath.Join("logs", filepath.Base(config.LogFile)), config.LogFile, logBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sessionId == "" || *agentAddress != "" {
+		return nil
+	}
+
+	// The report is still useful without the session's placement, such as when the controller
+	// cannot be reached, so the failure is reported in its place
+	trace, err := getSessionTrace(group, config, sessionId)
+	if err != nil {
+		return writeReportText(archive, "session-error.txt", fmt.Sprintf("unable to fetch session %s from the controller, %v\n", sessionId, err))
+	}
+
+	return writeReportJson(archive, "session.json", trace)
+}
+
+func reportHostInfo() reportHost {
+	host := reportHost{
+		Version:    build.Version,
+		Os:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		Libraries:  hostLibraryChecks(),
+		JuicePath:  *juicePath,
+		JuiceFiles: []reportFile{},
+	}
+
+	err := validateHost()
+	if err != nil {
+		host.ValidationError = err.Error()
+	}
+
+	entries, err := os.ReadDir(*juicePath)
+	if err == nil {
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || entry.IsDir() {
+				continue
+			}
+
+			host.JuiceFiles = append(host.JuiceFiles, reportFile{
+				Name:     entry.Name(),
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+		}
+	}
+
+	return host
+}
+
+// Returns the options set on the command line, the values of sensitive options replaced
+func sanitizedOptions() map[string]string {
+	options := map[string]string{}
+	flag.Visit(func(option *flag.Flag) {
+		value := option.Value.String()
+		for _, sensitive := range sensitiveOptions {
+			if strings.Contains(strings.ToLower(option.Name), sensitive) {
+				value = "<redacted>"
+				break
+			}
+		}
+
+		options[option.Name] = value
+	})
+
+	return options
+}
+
+func getSessionTrace(group task.Group, config Configuration, sessionId string) (restapi.SessionTrace, error) {
+	api := restapi.Client{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: *disableTls,
+				},
+			},
+		},
+		Scheme:     "https",
+		Address:    fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Token:      *controllerToken,
+		OnBehalfOf: *onBehalfOf,
+	}
+
+	if *disableTls {
+		api.Scheme = "http"
+	}
+
+	err := api.NegotiateVersionWithContext(group.Ctx())
+	if err != nil {
+		return restapi.SessionTrace{}, err
+	}
+
+	return api.GetSessionTraceWithContext(group.Ctx(), sessionId)
+}
+
+func createReportEntry(archive *zip.Writer, name string) (io.Writer, error) {
+	return archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+func writeReportJson(archive *zip.Writer, name string, value any) error {
+	writer, err := createReportEntry(archive, name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func writeReportText(archive *zip.Writer, name string, text string) error {
+	writer, err := createReportEntry(archive, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(writer, text)
+	return err
+}
+
+// Writes up to the last limit bytes of the file, noting in the report when it cannot be read
+func writeReportTail(archive *zip.Writer, name string, path string, limit int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return writeReportText(archive, name+".error.txt", fmt.Sprintf("unable to read file %s, %v\n", path, err))
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > limit {
+		_, err = file.Seek(-limit, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer, err := createReportEntry(archive, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, file)
+	return err
+}
@@ -0,0 +1,331 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	streamNegotiation         = flag.Bool("stream-negotiation", true, "Measures the bandwidth and round trip time to the agent when the session starts and agrees with the agent on the compression and frame rate limit they allow")
+	streamRenegotiateInterval = flag.Duration("stream-renegotiate-interval", 30*time.Second, "Interval between measurements of the bandwidth and round trip time to the agent, the compression and frame rate limit are agreed again when they change, 0 only agrees on them when the session starts")
+	streamProbeSize           = flag.Int("stream-probe-size", 4*1024*1024, "Bytes read from the agent to measure the bandwidth to it")
+	streamCompressionOverride = flag.String("compression", "", "Compresses the traffic to the agent with none, fast, balanced, or small compression rather than the compression agreed with the agent")
+	streamFrameRateOverride   = flag.Int("frame-rate-limit", 0, "Limits the application to this many frames per second rather than the limit agreed with the agent, 0 leaves it to the agent")
+)
+
+const (
+	streamRttAttempts = 3
+
+	// Relative change in the bandwidth or round trip time to the agent that agrees on the stream again
+	streamRenegotiateChange = 0.25
+	// Changes in the round trip time smaller than this are jitter
+	streamRttJitterMs = 5
+)
+
+// The compression levels of the client, see Configuration.CompressionLevel
+var streamCompressionLevels = map[string]int{
+	restapi.StreamCompressionFast:     1,
+	restapi.StreamCompressionBalanced: 5,
+	restapi.StreamCompressionSmall:    9,
+}
+
+// The fields of Configuration written to Configuration.StreamFile
+type streamConfiguration struct {
+	DisableCompression bool `json:"disableCompression"`
+	CompressionLevel   int  `json:"compressionLevel"`
+	FrameRateLimit     int  `json:"frameRateLimit"`
+}
+
+func validateStreamOverrides() error {
+	_, found := streamCompressionLevels[*streamCompressionOverride]
+	if *streamCompressionOverride != "" && *streamCompressionOverride != restapi.StreamCompressionNone && !found {
+		return fmt.Errorf("--compression: %s is not none, fast, balanced, or small", *streamCompressionOverride)
+	}
+
+	if *streamFrameRateOverride < 0 {
+		return errors.New("--frame-rate-limit must not be negative")
+	}
+
+	if *streamProbeSize <= 0 {
+		return errors.New("--stream-probe-size must be positive")
+	}
+
+	return nil
+}
+
+// Returns the parameters the user overrides, with --compression and --frame-rate-limit or in juice.cfg
+func streamOverrides(config Configuration) restapi.StreamParameters {
+	overrides := restapi.StreamParameters{
+		Compression:    *streamCompressionOverride,
+		FrameRateLimit: *streamFrameRateOverride,
+	}
+
+	if overrides.Compression == "" && config.DisableCompression {
+		overrides.Compression = restapi.StreamCompressionNone
+	}
+
+	if overrides.FrameRateLimit == 0 {
+		overrides.FrameRateLimit = config.FrameRateLimit
+	}
+
+	return overrides
+}
+
+func applyStream(config *Configuration, stream restapi.StreamParameters) {
+	if stream.Compression != "" {
+		config.DisableCompression = stream.Compression == restapi.StreamCompressionNone
+		config.CompressionLevel = streamCompressionLevels[stream.Compression]
+	}
+
+	if stream.FrameRateLimit > 0 {
+		config.FrameRateLimit = stream.FrameRateLimit
+	}
+}
+
+// Measures the round trip time to the agent as the quickest of a few requests and the bandwidth
+// to it from reading --stream-probe-size bytes less a round trip
+func measureStream(ctx context.Context, api restapi.Client, id string) (restapi.NetworkEstimate, error) {
+	var rtt time.Duration
+	for attempt := 0; attempt < streamRttAttempts; attempt++ {
+		start := time.Now()
+
+		_, err := api.StatusWithContext(ctx)
+		if err != nil {
+			return restapi.NetworkEstimate{}, err
+		}
+
+		elapsed := time.Since(start)
+		if rtt == 0 || elapsed < rtt {
+			rtt = elapsed
+		}
+	}
+
+	start := time.Now()
+
+	size, err := api.ProbeSessionWithContext(ctx, id, *streamProbeSize)
+	if err != nil {
+		return restapi.NetworkEstimate{}, err
+	}
+
+	elapsed := time.Since(start)
+	if elapsed > 2*rtt {
+		elapsed -= rtt
+	}
+
+	return restapi.NetworkEstimate{
+		BandwidthMbps: float64(size) * 8 / elapsed.Seconds() / 1e6,
+		RttMs:         float64(rtt.Microseconds()) / 1000,
+	}, nil
+}
+
+// Returns whether the estimate differs enough from the one last negotiated to agree on the stream again
+func streamChanged(last restapi.NetworkEstimate, estimate restapi.NetworkEstimate) bool {
+	if math.Abs(estimate.BandwidthMbps-last.BandwidthMbps) > streamRenegotiateChange*last.BandwidthMbps {
+		return true
+	}
+
+	rttChange := math.Abs(estimate.RttMs - last.RttMs)
+	return rttChange > streamRttJitterMs && rttChange > streamRenegotiateChange*last.RttMs
+}
+
+// Agrees on how the client streams the session with the agent when the session starts and again
+// every --stream-renegotiate-interval the bandwidth or round trip time to the agent has changed,
+// writing the parameters agreed to Configuration.StreamFile for the client to reread
+type streamNegotiator struct {
+	api       restapi.Client
+	id        string
+	overrides restapi.StreamParameters
+	path      string
+
+	estimate restapi.NetworkEstimate
+	stream   restapi.StreamParameters
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Returns nil when --stream-negotiation is not set, the agent does not negotiate, or the first
+// negotiation fails, applying only the overrides to config. Otherwise applies the parameters
+// agreed to config, points it at the stream file, and starts renegotiating.
+func startStreamNegotiator(group task.Group, api restapi.Client, config *Configuration) *streamNegotiator {
+	overrides := streamOverrides(*config)
+	applyStream(config, overrides)
+
+	if !*streamNegotiation || config.Id == "" {
+		return nil
+	}
+
+	status, err := api.StatusWithContext(group.Ctx())
+	if err != nil {
+		logger.Warningf("unable to read the status of the agent, the stream is not negotiated, %v", err)
+		return nil
+	}
+
+	if !status.HasCapability(restapi.CapabilityStreamNegotiation) {
+		logger.Debug("the agent does not negotiate the stream")
+		return nil
+	}
+
+	negotiator := &streamNegotiator{
+		api:       api,
+		id:        config.Id,
+		overrides: overrides,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	err = negotiator.negotiate(group.Ctx())
+	if err != nil {
+		logger.Warningf("unable to negotiate the stream with the agent, %v", err)
+		return nil
+	}
+
+	applyStream(config, negotiator.stream)
+
+	file, err := os.CreateTemp("", "juicify-stream-*.json")
+	if err != nil {
+		logger.Warningf("unable to create the stream file, the stream is not renegotiated, %v", err)
+		return nil
+	}
+	file.Close()
+
+	negotiator.path = file.Name()
+	err = negotiator.write()
+	if err != nil {
+		logger.Warningf("unable to write the stream file, the stream is not renegotiated, %v", err)
+		os.Remove(negotiator.path)
+		return nil
+	}
+
+	config.StreamFile = negotiator.path
+
+	if *streamRenegotiateInterval > 0 {
+		go negotiator.run(group)
+	} else {
+		close(negotiator.done)
+	}
+
+	return negotiator
+}
+
+// Measures the bandwidth and round trip time to the agent and agrees on the stream with it
+func (negotiator *streamNegotiator) negotiate(ctx context.Context) error {
+	estimate, err := measureStream(ctx, negotiator.api, negotiator.id)
+	if err != nil {
+		return err
+	}
+
+	return negotiator.negotiateEstimate(ctx, estimate)
+}
+
+func (negotiator *streamNegotiator) negotiateEstimate(ctx context.Context, estimate restapi.NetworkEstimate) error {
+	stream, err := negotiator.api.NegotiateSessionStreamWithContext(ctx, negotiator.id, restapi.StreamNegotiation{
+		Estimate:  estimate,
+		Overrides: negotiator.overrides,
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Streaming with %s compression and a frame rate limit of %d, %.1f Mbps and %.1f ms round trips to the agent",
+		stream.Compression, stream.FrameRateLimit, estimate.BandwidthMbps, estimate.RttMs)
+
+	negotiator.estimate = estimate
+	negotiator.stream = stream
+	return nil
+}
+
+// Replaces the stream file so the client never reads it partially written
+func (negotiator *streamNegotiator) write() error {
+	config := Configuration{}
+	applyStream(&config, negotiator.stream)
+
+	data, err := json.Marshal(streamConfiguration{
+		DisableCompression: config.DisableCompression,
+		CompressionLevel:   config.CompressionLevel,
+		FrameRateLimit:     config.FrameRateLimit,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(negotiator.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(negotiator.path+".tmp", negotiator.path)
+}
+
+func (negotiator *streamNegotiator) run(group task.Group) {
+	defer close(negotiator.done)
+
+	ticker := time.NewTicker(*streamRenegotiateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-negotiator.stop:
+			return
+
+		case <-group.Ctx().Done():
+			return
+
+		case <-ticker.C:
+			negotiator.renegotiate(group.Ctx())
+		}
+	}
+}
+
+func (negotiator *streamNegotiator) renegotiate(ctx context.Context) {
+	estimate, err := measureStream(ctx, negotiator.api, negotiator.id)
+	if err != nil {
+		logger.Debugf("unable to measure the bandwidth to the agent, %v", err)
+		return
+	}
+
+	if !streamChanged(negotiator.estimate, estimate) {
+		return
+	}
+
+	last := negotiator.stream
+	err = negotiator.negotiateEstimate(ctx, estimate)
+	if err != nil {
+		logger.Warningf("unable to renegotiate the stream with the agent, %v", err)
+		return
+	}
+
+	if negotiator.stream == last {
+		return
+	}
+
+	err = negotiator.write()
+	if err != nil {
+		logger.Warningf("unable to write the stream file, %v", err)
+	}
+}
+
+// Stops renegotiating once the application exits. Safe to call on nil.
+func (negotiator *streamNegotiator) Stop() {
+	if negotiator == nil {
+		return
+	}
+
+	close(negotiator.stop)
+	<-negotiator.done
+
+	os.Remove(negotiator.path)
+}
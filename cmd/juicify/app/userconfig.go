@@ -0,0 +1,232 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var userConfigFile = flag.String("juice-config", "", "Path to the juicify configuration of named profiles selected with --profile, defaults to .juice/config.yaml in the user's home directory")
+
+// Options a profile of the configuration cannot set
+var unprofiledFlags = map[string]bool{
+	"profile":       true,
+	"save-profile":  true,
+	"profiles-file": true,
+	"juice-config":  true,
+	"config":        true,
+	"reserve-at":    true,
+}
+
+// The juicify configuration written by hand, in contrast to the profiles saved by --save-profile.
+//
+//	profile: render
+//	profiles:
+//	  render:
+//	    controller: controller.example.com:8080
+//	    tags:
+//	      region: us-east
+//	    vram: 8192
+//	    preload: [/usr/lib/x86_64-linux-gnu/libgamemodeauto.so.0]
+//	    options:
+//	      tenant: rendering
+//	    command: [./render, --headless]
+type userConfig struct {
+	// The profile applied when --profile is not given, none when empty
+	Profile  string                       `yaml:"profile"`
+	Profiles map[string]userConfigProfile `yaml:"profiles"`
+}
+
+type userConfigProfile struct {
+	// --host
+	Controller string `yaml:"controller"`
+	// --match-labels
+	Tags map[string]string `yaml:"tags"`
+	// --vram, in MiB
+	Vram uint64 `yaml:"vram"`
+	// --preload
+	Preload []string `yaml:"preload"`
+	// Any other juicify options by name, without the leading --
+	Options map[string]any `yaml:"options"`
+	// The application launched when none is given on the command line
+	Command []string `yaml:"command"`
+}
+
+func getUserConfigPath() (string, error) {
+	if *userConfigFile != "" {
+		return *userConfigFile, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".juice", "config.yaml"), nil
+}
+
+// Returns the configuration and its path, an empty configuration when the file does not exist
+func loadUserConfig() (userConfig, string, error) {
+	path, err := getUserConfigPath()
+	if err != nil {
+		return userConfig{}, "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return userConfig{}, path, nil
+		}
+
+		return userConfig{}, path, err
+	}
+
+	var config userConfig
+
+	// Misspelled keys would otherwise be silently ignored
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return userConfig{}, path, fmt.Errorf("unable to parse configuration %s, %v", path, err)
+	}
+
+	if config.Profile != "" {
+		if _, found := config.Profiles[config.Profile]; !found {
+			return userConfig{}, path, fmt.Errorf("configuration %s: profile %s not found", path, config.Profile)
+		}
+	}
+
+	return config, path, nil
+}
+
+// Returns the profile as the options and application of a saved profile
+func (profile userConfigProfile) profile() (Profile, error) {
+	options := map[string]string{}
+	for name, value := range profile.Options {
+		name = strings.TrimPrefix(name, "--")
+		if flag.Lookup(name) == nil {
+			return Profile{}, fmt.Errorf("unknown option %s", name)
+		}
+
+		if unprofiledFlags[name] || integrationFlags[name] {
+			return Profile{}, fmt.Errorf("option %s cannot be set by a profile", name)
+		}
+
+		// Lists are given to the options taking several values separated by commas
+		if values, isList := value.([]any); isList {
+			items := make([]string, 0, len(values))
+			for _, item := range values {
+				items = append(items, fmt.Sprint(item))
+			}
+			value = strings.Join(items, ",")
+		}
+
+		options[name] = fmt.Sprint(value)
+	}
+
+	set := func(name string, value string) error {
+		if _, found := options[name]; found {
+			return fmt.Errorf("option %s is set both by options and by the profile's own keys", name)
+		}
+
+		options[name] = value
+		return nil
+	}
+
+	var err error
+	if profile.Controller != "" {
+		err = errors.Join(err, set("host", profile.Controller))
+	}
+
+	if len(profile.Tags) > 0 {
+		tags := make([]string, 0, len(profile.Tags))
+		for key, value := range profile.Tags {
+			tags = append(tags, fmt.Sprint(key, "=", value))
+		}
+		sort.Strings(tags)
+
+		err = errors.Join(err, set("match-labels", strings.Join(tags, ",")))
+	}
+
+	if profile.Vram > 0 {
+		err = errors.Join(err, set("vram", fmt.Sprint(profile.Vram)))
+	}
+
+	if len(profile.Preload) > 0 {
+		err = errors.Join(err, set("preload", strings.Join(profile.Preload, ",")))
+	}
+
+	if err != nil {
+		return Profile{}, err
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, len(names))
+	for _, name := range names {
+		args = append(args, fmt.Sprintf("--%s=%s", name, options[name]))
+	}
+
+	return Profile{
+		Args:    args,
+		Command: profile.Command,
+	}, nil
+}
+
+// Returns the profile of the name from the configuration or the profiles saved by
+// --save-profile, a name may only be used by one of them
+func findProfile(name string) (Profile, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	config, path, err := loadUserConfig()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	saved, isSaved := profiles[name]
+	configured, isConfigured := config.Profiles[name]
+
+	if isSaved && isConfigured {
+		profilesPath, err := getProfilesPath()
+		if err != nil {
+			return Profile{}, err
+		}
+
+		return Profile{}, fmt.Errorf("profile %s is in both %s and %s, rename one of them", name, path, profilesPath)
+	}
+
+	if isConfigured {
+		profile, err := configured.profile()
+		if err != nil {
+			return Profile{}, fmt.Errorf("configuration %s: profile %s is invalid, %v", path, name, err)
+		}
+
+		return profile, nil
+	}
+
+	if isSaved {
+		return saved, nil
+	}
+
+	return Profile{}, fmt.Errorf("profile %s not found", name)
+}
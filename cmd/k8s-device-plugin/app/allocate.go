@@ -0,0 +1,166 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+var (
+	juicePath          = flag.String("juice-path", "/opt/juice", "Directory on the node of the Juice client libraries, mounted read-only into the containers allocated devices")
+	containerJuicePath = flag.String("container-juice-path", "/opt/juice", "Directory --juice-path is mounted on in containers")
+
+	tenant             = flag.String("tenant", "", "Tenant recorded on the sessions of pods")
+	sessionIdleTimeout = flag.Duration("session-idle-timeout", 5*time.Minute, "Closes the session of a container once it has not used its GPUs for this long. The kubelet does not tell device plugins when containers exit, so their sessions are only closed once idle")
+	assignmentTimeout  = flag.Duration("assignment-timeout", time.Minute, "Fails the allocation, and so the start of the container, when its session is not placed on an agent within this duration")
+)
+
+func validateAllocationFlags() error {
+	if *sessionIdleTimeout < time.Second {
+		return errors.New("--session-idle-timeout must be at least 1s, sessions of containers are only closed once idle")
+	}
+
+	return nil
+}
+
+// The subset of juicify's configuration that connects the client libraries to a session
+type clientConfiguration struct {
+	Id   string `json:"id"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// Requests a session for a container allocated gpus devices, returning the configuration
+// connecting to it once it is placed on an agent
+func (plugin *Plugin) requestSession(ctx context.Context, gpus int) (clientConfiguration, error) {
+	requirements := restapi.SessionRequirements{
+		Version:     build.Version,
+		Gpus:        make([]restapi.GpuRequirements, gpus),
+		MatchLabels: map[string]string{},
+		Tolerates:   map[string]string{},
+		Tenant:      *tenant,
+
+		IdleTimeoutSeconds: int(sessionIdleTimeout.Seconds()),
+	}
+
+	if *pool != "" {
+		requirements.MatchLabels[restapi.PoolLabel] = *pool
+	}
+
+	id, err := plugin.api.RequestSessionWithContext(ctx, requirements)
+	if err != nil {
+		return clientConfiguration{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *assignmentTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		session, err := plugin.api.GetSessionWithContext(ctx, id)
+		if err == nil && session.State != restapi.SessionQueued {
+			if session.State == restapi.SessionClosed || session.Address == "" {
+				return clientConfiguration{}, fmt.Errorf("session %s is %s", id, session.State)
+			}
+
+			return configurationOf(session)
+		}
+
+		select {
+		case <-ctx.Done():
+			err = errors.Join(fmt.Errorf("session %s was not placed on an agent within %s", id, *assignmentTimeout), err)
+
+			// The session would otherwise hold GPUs until it is idle
+			_, err_ := plugin.api.CancelSessionWithContext(context.Background(), id)
+			return clientConfiguration{}, errors.Join(err, err_)
+
+		case <-ticker.C:
+		}
+	}
+}
+
+func configurationOf(session restapi.Session) (clientConfiguration, error) {
+	host, portStr, err := net.SplitHostPort(session.Address)
+	if err != nil {
+		return clientConfiguration{}, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return clientConfiguration{}, err
+	}
+
+	return clientConfiguration{
+		Id:   session.Id,
+		Host: host,
+		Port: port,
+	}, nil
+}
+
+// Returns the environment juicify runs applications with, preloading the client libraries
+// mounted from --juice-path
+func containerEnvironment(config clientConfiguration) (map[string]string, error) {
+	configOverride, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	icdPath := path.Join(*containerJuicePath, "JuiceVlk.json")
+
+	return map[string]string{
+		"LD_PRELOAD":         path.Join(*containerJuicePath, "libjuicejuda.so"),
+		"VK_ICD_FILENAMES":   icdPath,
+		"VK_DRIVER_FILES":    icdPath,
+		"JUICE_CFG_OVERRIDE": string(configOverride),
+	}, nil
+}
+
+// Requests a session for each container, injecting the environment connecting its application
+// to the session
+func (plugin *Plugin) Allocate(ctx context.Context, request *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	response := &pluginapi.AllocateResponse{}
+	for _, container := range request.ContainerRequests {
+		config, err := plugin.requestSession(ctx, len(container.DevicesIDs))
+		if err != nil {
+			logger.Errorf("unable to allocate devices %v, %v", container.DevicesIDs, err)
+			return nil, err
+		}
+
+		environment, err := containerEnvironment(config)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Infof("devices %v allocated session %s on %s:%d", container.DevicesIDs, config.Id, config.Host, config.Port)
+
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs: environment,
+			Mounts: []*pluginapi.Mount{
+				{
+					ContainerPath: *containerJuicePath,
+					HostPath:      *juicePath,
+					ReadOnly:      true,
+				},
+			},
+		})
+	}
+
+	return response, nil
+}
@@ -0,0 +1,148 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+var (
+	pool             = flag.String("pool", "", "Pool of the agents whose GPUs are advertised and sessions are placed on, every agent when not set")
+	sessionsPerGpu   = flag.Int("sessions-per-gpu", 1, "Devices advertised for each GPU, matching the agents' --max-sessions-per-gpu to share GPUs between pods")
+	maxDevices       = flag.Int("max-devices", 8, "Most devices advertised to the kubelet of each node, the GPUs of the pool are shared by every node running the plugin")
+	capacityInterval = flag.Duration("capacity-interval", 30*time.Second, "Interval between reads of the GPUs of the controller's agents")
+)
+
+// Returns the devices backed by the GPUs of the pool's active agents, or nil when the controller
+// cannot be reached
+func (plugin *Plugin) readCapacity(group task.Group) ([]*pluginapi.Device, error) {
+	agents, err := plugin.api.GetAgentsWithContext(group.Ctx())
+	if err != nil {
+		return nil, err
+	}
+
+	gpus := 0
+	for _, agent := range agents {
+		if agent.State != restapi.AgentActive || agent.Draining {
+			continue
+		}
+
+		if *pool != "" && agent.Labels[restapi.PoolLabel] != *pool {
+			continue
+		}
+
+		gpus += len(agent.Gpus)
+	}
+
+	count := gpus * *sessionsPerGpu
+	if count > *maxDevices {
+		count = *maxDevices
+	}
+
+	devices := make([]*pluginapi.Device, 0, count)
+	for index := 0; index < count; index++ {
+		devices = append(devices, &pluginapi.Device{
+			ID:     fmt.Sprintf("juice-gpu-%d", index),
+			Health: pluginapi.Healthy,
+		})
+	}
+
+	return devices, nil
+}
+
+func sameDevices(a []*pluginapi.Device, b []*pluginapi.Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if a[index].ID != b[index].ID || a[index].Health != b[index].Health {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (plugin *Plugin) setDevices(devices []*pluginapi.Device) {
+	plugin.mutex.Lock()
+	defer plugin.mutex.Unlock()
+
+	if plugin.devices != nil && sameDevices(plugin.devices, devices) {
+		return
+	}
+
+	plugin.devices = devices
+	close(plugin.changed)
+	plugin.changed = make(chan struct{})
+}
+
+// Marks the advertised devices unhealthy, the kubelet then stops allocating them
+func (plugin *Plugin) setUnhealthy() {
+	plugin.mutex.Lock()
+	devices := make([]*pluginapi.Device, 0, len(plugin.devices))
+	for _, device := range plugin.devices {
+		devices = append(devices, &pluginapi.Device{
+			ID:     device.ID,
+			Health: pluginapi.Unhealthy,
+		})
+	}
+	plugin.mutex.Unlock()
+
+	plugin.setDevices(devices)
+}
+
+func (plugin *Plugin) runCapacity(group task.Group) error {
+	ticker := time.NewTicker(*capacityInterval)
+	defer ticker.Stop()
+
+	for {
+		devices, err := plugin.readCapacity(group)
+		if err != nil {
+			logger.Warningf("unable to read the GPUs of the controller's agents, marking the devices unhealthy, %v", err)
+			plugin.setUnhealthy()
+		} else {
+			plugin.setDevices(devices)
+		}
+
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends the devices to the kubelet whenever they change
+func (plugin *Plugin) ListAndWatch(_ *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
+	for {
+		plugin.mutex.Lock()
+		devices := plugin.devices
+		changed := plugin.changed
+		plugin.mutex.Unlock()
+
+		err := stream.Send(&pluginapi.ListAndWatchResponse{
+			Devices: devices,
+		})
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+
+		case <-changed:
+		}
+	}
+}
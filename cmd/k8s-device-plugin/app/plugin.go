@@ -0,0 +1,189 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/crypto"
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Extended resource pods request remote GPUs with, e.g. resources.limits: {juice.dev/gpu: 1}
+const ResourceName = "juice.dev/gpu"
+
+var (
+	controllerAddress = flag.String("controller", "", "The IP address or hostname and port of the controller the sessions of pods are requested from")
+	controllerToken   = flag.String("controller-token", "", "Bearer token presented to the controller, the listing of agents requires the roles allowed to use the admin endpoints when its authorization policy restricts them")
+	disableTls        = flag.Bool("disable-tls", false, "Connect to the controller over http rather than https")
+	caFile            = flag.String("ca-file", "", "Certificates of the authorities the controller's certificate is verified against, the system's when not set")
+
+	devicePluginPath = flag.String("device-plugin-path", pluginapi.DevicePluginPath, "Directory of the kubelet's device plugin sockets")
+	socketName       = flag.String("socket-name", "juice.sock", "Name of the plugin's socket in --device-plugin-path")
+)
+
+// Advertises the GPUs of the controller's agents to the kubelet as ResourceName, requesting a
+// session for each container they are allocated to
+type Plugin struct {
+	api restapi.Client
+
+	mutex   sync.Mutex
+	devices []*pluginapi.Device
+	// Closed and replaced when devices change, see ListAndWatch
+	changed chan struct{}
+}
+
+func NewPlugin() (*Plugin, error) {
+	if *controllerAddress == "" {
+		return nil, errors.New("--controller must be set")
+	}
+
+	err := validateAllocationFlags()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if *caFile != "" {
+		tlsConfig.RootCAs, err = crypto.AppendCertsFromFile(nil, *caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	api := restapi.Client{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		Scheme:  "https",
+		Address: *controllerAddress,
+		Token:   *controllerToken,
+	}
+
+	if *disableTls {
+		api.Scheme = "http"
+	}
+
+	return &Plugin{
+		api:     api,
+		changed: make(chan struct{}),
+	}, nil
+}
+
+func (plugin *Plugin) Run(group task.Group) error {
+	group.GoFn("Device Plugin Capacity", plugin.runCapacity)
+
+	socketPath := filepath.Join(*devicePluginPath, *socketName)
+	for {
+		err := plugin.serve(group, socketPath)
+		if err != nil || group.Ctx().Err() != nil {
+			return err
+		}
+
+		logger.Info("kubelet restarted, registering again")
+	}
+}
+
+// Serves the plugin on socketPath until the kubelet removes it when it restarts
+func (plugin *Plugin) serve(group task.Group, socketPath string) error {
+	err := os.Remove(socketPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(server, plugin)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	kubeletSocket := filepath.Join(*devicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+	err = register(group.Ctx(), kubeletSocket)
+	if err != nil {
+		if group.Ctx().Err() != nil {
+			return nil
+		}
+
+		return fmt.Errorf("unable to register with the kubelet at %s, %v", kubeletSocket, err)
+	}
+
+	logger.Infof("registered %s with the kubelet", ResourceName)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-group.Ctx().Done():
+			return nil
+
+		case err := <-served:
+			return err
+
+		case <-ticker.C:
+			_, err := os.Stat(socketPath)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+		}
+	}
+}
+
+func register(ctx context.Context, kubeletSocket string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	connection, err := grpc.DialContext(ctx, "unix://"+kubeletSocket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	_, err = pluginapi.NewRegistrationClient(connection).Register(ctx, &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     *socketName,
+		ResourceName: ResourceName,
+		Options:      &pluginapi.DevicePluginOptions{},
+	})
+	return err
+}
+
+func (plugin *Plugin) GetDevicePluginOptions(ctx context.Context, _ *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{}, nil
+}
+
+func (plugin *Plugin) GetPreferredAllocation(ctx context.Context, _ *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return &pluginapi.PreferredAllocationResponse{}, nil
+}
+
+func (plugin *Plugin) PreStartContainer(ctx context.Context, _ *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
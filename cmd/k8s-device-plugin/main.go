@@ -0,0 +1,22 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package main
+
+import (
+	"github.com/Juice-Labs/Juice-Labs/cmd/internal/build"
+	"github.com/Juice-Labs/Juice-Labs/cmd/k8s-device-plugin/app"
+	"github.com/Juice-Labs/Juice-Labs/pkg/appmain"
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+func main() {
+	appmain.Run("Juice Device Plugin", build.Version, func(group task.Group) error {
+		plugin, err := app.NewPlugin()
+		if err != nil {
+			return err
+		}
+
+		return plugin.Run(group)
+	})
+}
@@ -0,0 +1 @@
+docker build --pull --rm --build-arg BASE_CONTAINER=ubuntu:22.04 -f Dockerfile -t juice-labs/device-plugin:%1 "../.."
@@ -0,0 +1,2 @@
+#!/bin/bash
+docker build --pull --rm --build-arg BASE_CONTAINER=ubuntu:22.04 -f Dockerfile -t juice-labs/device-plugin:$1 "../.."
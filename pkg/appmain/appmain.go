@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/Juice-Labs/Juice-Labs/pkg/config"
 	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
 	"github.com/Juice-Labs/Juice-Labs/pkg/task"
 )
@@ -36,7 +37,13 @@ func Run(name string, version string, logic task.TaskFn) {
 		os.Exit(ExitSuccess)
 	}
 
-	err := logger.Configure()
+	logger.SetComponent(name)
+
+	err := config.Load(flag.CommandLine, config.EnvPrefix(name))
+	if err == nil {
+		err = logger.Configure()
+	}
+
 	if err == nil {
 		logger.Info(name, ", v", version)
 
@@ -1,6 +1,9 @@
+//go:build !windows
+
 /*
  *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
  */
+
 package appmain
 
 type jobObject struct{}
@@ -0,0 +1,180 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Layers the options of a binary from a configuration file and environment variables under its
+// command line, so deployments may configure them without building command lines
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const fileOption = "config"
+
+var (
+	file = flag.String(fileOption, "", "YAML (.yaml, .yml) or TOML (.toml) file of option values by option name, nested tables join their names with -. Options on the command line take precedence, followed by environment variables named by the binary and the option, such as JUICE_AGENT_LOG_LEVEL, then this file")
+)
+
+// The options whose values were applied from the environment or the configuration file
+var applied = map[string]bool{}
+
+// Returns the prefix of the environment variables of the binary named name, such as JUICE_AGENT
+// for Juice Agent
+func EnvPrefix(name string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(name), "_"))
+}
+
+// Returns the environment variable of the option, such as JUICE_AGENT_LOG_LEVEL for log-level
+func EnvName(prefix string, option string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// Applies the values of the options not set on the command line, from the environment variables
+// of prefix and then from the file given by --config or its environment variable. Must be called
+// after the flags are parsed.
+func Load(flags *flag.FlagSet, prefix string) error {
+	commandLine := map[string]bool{}
+	flags.Visit(func(option *flag.Flag) {
+		commandLine[option.Name] = true
+	})
+
+	path := *file
+	if !commandLine[fileOption] {
+		path = os.Getenv(EnvName(prefix, fileOption))
+	}
+
+	values := map[string]string{}
+	if path != "" {
+		var err error
+		values, err = readFile(path)
+		if err != nil {
+			return err
+		}
+
+		for name := range values {
+			if flags.Lookup(name) == nil || name == fileOption {
+				return fmt.Errorf("%s: unknown option %s", path, name)
+			}
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(option *flag.Flag) {
+		if commandLine[option.Name] || option.Name == fileOption {
+			return
+		}
+
+		// Empty variables are treated as not set, as shells and deployment tools often leave them
+		source := EnvName(prefix, option.Name)
+		value := os.Getenv(source)
+		present := value != ""
+		if !present {
+			source = path
+			value, present = values[option.Name]
+		}
+
+		if present {
+			err_ := flags.Set(option.Name, value)
+			if err_ != nil {
+				err = errors.Join(err, fmt.Errorf("%s: invalid value %q for option %s, %v", source, value, option.Name, err_))
+			} else {
+				applied[option.Name] = true
+			}
+		}
+	})
+
+	return err
+}
+
+// Returns whether the option's value was applied from the environment or the configuration file
+// rather than given on the command line
+func Applied(option string) bool {
+	return applied[option]
+}
+
+func readFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &document)
+
+	case ".toml":
+		err = toml.Unmarshal(content, &document)
+
+	default:
+		return nil, fmt.Errorf("%s: unknown format, expected a .yaml, .yml, or .toml file", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := map[string]string{}
+	err = flatten("", document, values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return values, nil
+}
+
+// Adds the values of the document by option name, lists are joined with commas as the options
+// taking several values expect
+func flatten(prefix string, document map[string]any, values map[string]string) error {
+	names := make([]string, 0, len(document))
+	for name := range document {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		option := name
+		if prefix != "" {
+			option = prefix + "-" + name
+		}
+
+		switch value := document[name].(type) {
+		case map[string]any:
+			err := flatten(option, value, values)
+			if err != nil {
+				return err
+			}
+
+		case []any:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				switch item.(type) {
+				case map[string]any, []any:
+					return fmt.Errorf("option %s must be a list of values", option)
+				}
+
+				items = append(items, fmt.Sprint(item))
+			}
+
+			values[option] = strings.Join(items, ",")
+
+		case nil:
+			values[option] = ""
+
+		default:
+			values[option] = fmt.Sprint(value)
+		}
+	}
+
+	return nil
+}
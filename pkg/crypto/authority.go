@@ -0,0 +1,232 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+type CertificateAuthority struct {
+	certificate    *x509.Certificate
+	certificatePem []byte
+	signer         crypto.Signer
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func GenerateCertificateAuthority() (*CertificateAuthority, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Juice Technologies, Inc."},
+			CommonName:   "Juice Controller CA",
+		},
+
+		NotBefore: now.Add(-time.Minute),
+		NotAfter:  now.AddDate(1, 0, 0),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{
+		certificate: certificate,
+		certificatePem: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: derBytes,
+		}),
+		signer: privateKey,
+	}, nil
+}
+
+func LoadCertificateAuthority(certFile, keyFile string) (*CertificateAuthority, error) {
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !certificate.IsCA {
+		return nil, fmt.Errorf("LoadCertificateAuthority: %s is not a certificate authority", certFile)
+	}
+
+	signer, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("LoadCertificateAuthority: %s does not contain a signing key", keyFile)
+	}
+
+	certificatePem, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{
+		certificate:    certificate,
+		certificatePem: certificatePem,
+		signer:         signer,
+	}, nil
+}
+
+func (authority *CertificateAuthority) CertificatePem() []byte {
+	return authority.certificatePem
+}
+
+func (authority *CertificateAuthority) Certificate() *x509.Certificate {
+	return authority.certificate
+}
+
+func (authority *CertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(authority.certificate)
+	return pool
+}
+
+// Signs the PEM encoded certificate signing request, returning a PEM encoded certificate.
+// If commonName is not empty, it replaces the common name requested in the CSR.
+func (authority *CertificateAuthority) SignCsr(csrPem []byte, commonName string, ttl time.Duration, extKeyUsage ...x509.ExtKeyUsage) ([]byte, time.Time, error) {
+	block, _ := pem.Decode(csrPem)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, time.Time{}, errors.New("CertificateAuthority.SignCsr: invalid certificate signing request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("CertificateAuthority.SignCsr: invalid signature with %s", err)
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	subject := pkix.Name{
+		Organization: authority.certificate.Subject.Organization,
+		CommonName:   csr.Subject.CommonName,
+	}
+
+	if commonName != "" {
+		subject.CommonName = commonName
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(authority.certificate.NotAfter) {
+		notAfter = authority.certificate.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+
+		NotBefore: now.Add(-time.Minute),
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, authority.certificate, csr.PublicKey, authority.signer)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: derBytes,
+	}), notAfter, nil
+}
+
+// Generates a new private key and certificate signing request, both PEM encoded.
+// hosts may contain both hostnames and IP addresses.
+func GenerateCsr(commonName string, hosts ...string) ([]byte, []byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	derBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkcs8Key, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csrPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: derBytes,
+	})
+
+	keyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: pkcs8Key,
+	})
+
+	return csrPem, keyPem, nil
+}
@@ -11,7 +11,9 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
+	"os"
 	"time"
 )
 
@@ -66,3 +68,22 @@ func GenerateCertificate() (tls.Certificate, error) {
 func LoadCertificate(certFile, keyFile string) (tls.Certificate, error) {
 	return tls.LoadX509KeyPair(certFile, keyFile)
 }
+
+// Adds the PEM encoded certificates in the file to the pool, such as the certificates of an
+// organization's certificate authorities. A nil pool is created.
+func AppendCertsFromFile(pool *x509.CertPool, file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("AppendCertsFromFile: %s contains no PEM encoded certificates", file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,163 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of values encrypted by a Keyring, followed by <key id>:<base64 nonce and ciphertext>
+const encryptedPrefix = "enc:"
+
+// Encrypts values using AES-256-GCM with the primary key and decrypts values
+// encrypted with any key in the ring, allowing keys to be rotated
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// Loads a keyring from a file of <key id>:<base64 encoded 32 byte key> lines. The
+// first key is the primary, the remaining keys are only used to decrypt. Blank
+// lines and lines starting with # are ignored.
+//
+// To rotate keys, add a new key as the first line and keep the old keys until all
+// values have been re-encrypted, see Rotate.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadKeyring: unable to read file %s, %v", path, err)
+	}
+
+	keyring := &Keyring{
+		keys: map[string]cipher.AEAD{},
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encodedKey, found := strings.Cut(line, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("LoadKeyring: line '%s' must be in the format <key id>:<base64 key>", line)
+		}
+
+		if _, exists := keyring.keys[id]; exists {
+			return nil, fmt.Errorf("LoadKeyring: key id %s is used more than once", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("LoadKeyring: key %s is not valid base64, %v", id, err)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("LoadKeyring: key %s must be 32 bytes, found %d", id, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring.keys[id] = aead
+		if keyring.primary == "" {
+			keyring.primary = id
+		}
+	}
+
+	if keyring.primary == "" {
+		return nil, fmt.Errorf("LoadKeyring: %s does not contain any keys", path)
+	}
+
+	return keyring, nil
+}
+
+func (keyring *Keyring) Encrypt(plaintext string) (string, error) {
+	aead := keyring.keys[keyring.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(keyring.primary))
+	return fmt.Sprint(encryptedPrefix, keyring.primary, ":", base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Decrypts a value produced by Encrypt, values that are not encrypted are returned
+// unchanged so fields written before encryption was enabled remain readable
+func (keyring *Keyring) Decrypt(value string) (string, error) {
+	rest, found := strings.CutPrefix(value, encryptedPrefix)
+	if !found {
+		return value, nil
+	}
+
+	id, encoded, found := strings.Cut(rest, ":")
+	if !found {
+		return "", errors.New("Keyring.Decrypt: malformed encrypted value")
+	}
+
+	aead, found := keyring.keys[id]
+	if !found {
+		return "", fmt.Errorf("Keyring.Decrypt: value is encrypted with unknown key %s", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Keyring.Decrypt: malformed encrypted value, %v", err)
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("Keyring.Decrypt: malformed encrypted value")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("Keyring.Decrypt: failed with %s", err)
+	}
+
+	return string(plaintext), nil
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Returns true when the value is not encrypted with the primary key and should be re-encrypted
+func (keyring *Keyring) NeedsRotation(value string) bool {
+	return !strings.HasPrefix(value, fmt.Sprint(encryptedPrefix, keyring.primary, ":"))
+}
+
+// Re-encrypts the value with the primary key if required
+func (keyring *Keyring) Rotate(value string) (string, bool, error) {
+	if !keyring.NeedsRotation(value) {
+		return value, false, nil
+	}
+
+	plaintext, err := keyring.Decrypt(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	rotated, err := keyring.Encrypt(plaintext)
+	return rotated, err == nil, err
+}
@@ -0,0 +1,53 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+
+// Kinds of errors shared by the controller, agent, and clients. Errors of a kind match it with
+// errors.Is however they are wrapped, including errors returned by restapi.Client for responses
+// with the kind's HTTP status.
+package errors
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrConflict      = errors.New("conflict")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrUnavailable   = errors.New("unavailable")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrForbidden     = errors.New("forbidden")
+	ErrTooLarge      = errors.New("too large")
+)
+
+// Error of a kind that keeps its own message
+type kindError struct {
+	kind  error
+	cause error
+}
+
+func (err *kindError) Error() string {
+	return err.cause.Error()
+}
+
+func (err *kindError) Unwrap() []error {
+	return []error{err.kind, err.cause}
+}
+
+// Returns an error with the message that matches kind
+func New(kind error, message string) error {
+	return &kindError{
+		kind:  kind,
+		cause: errors.New(message),
+	}
+}
+
+// Returns an error formatted like fmt.Errorf that matches kind, along with any errors wrapped with %w
+func Errorf(kind error, format string, args ...any) error {
+	return &kindError{
+		kind:  kind,
+		cause: fmt.Errorf(format, args...),
+	}
+}
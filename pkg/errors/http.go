@@ -0,0 +1,66 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var statuses = []struct {
+	kind   error
+	status int
+}{
+	{ErrNotFound, http.StatusNotFound},
+	{ErrConflict, http.StatusConflict},
+	{ErrQuotaExceeded, http.StatusTooManyRequests},
+	{ErrUnavailable, http.StatusServiceUnavailable},
+	{ErrUnauthorized, http.StatusUnauthorized},
+	{ErrForbidden, http.StatusForbidden},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge},
+}
+
+// Returns the HTTP status responding with err, http.StatusInternalServerError for errors of no kind
+func HttpStatus(err error) int {
+	return HttpStatusOr(err, http.StatusInternalServerError)
+}
+
+// Returns the HTTP status responding with err, fallback for errors of no kind
+func HttpStatusOr(err error, fallback int) int {
+	for _, status := range statuses {
+		if errors.Is(err, status.kind) {
+			return status.status
+		}
+	}
+
+	return fallback
+}
+
+// Returns the kind of error responded with status, nil when status has no kind
+func FromHttpStatus(status int) error {
+	for _, kind := range statuses {
+		if kind.status == status {
+			return kind.kind
+		}
+	}
+
+	return nil
+}
+
+// Returns the error received from a server that responded with status and message, which is
+// empty when the response has no body
+func FromResponse(status int, message string) error {
+	text := fmt.Sprintf("error received from server, code %d", status)
+	if message != "" {
+		text = fmt.Sprintf("%s\nmessage: %s", text, message)
+	}
+
+	kind := FromHttpStatus(status)
+	if kind == nil {
+		return errors.New(text)
+	}
+
+	return New(kind, text)
+}
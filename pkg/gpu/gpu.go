@@ -16,10 +16,19 @@ type Gpu struct {
 	restapi.Gpu
 
 	vramAvailable uint64
+	sessions      int
+
+	// VRAM found still in use after sessions closed, Find places no sessions on the GPU until it is released
+	vramLeaked uint64
+	// Why the GPU was found unhealthy, Find places no sessions on the GPU until it recovers
+	unhealthy string
 }
 
 type GpuSet struct {
 	gpus []*Gpu
+
+	// Maximum number of sessions placed on each GPU, 0 when unlimited
+	maxSessionsPerGpu int
 }
 
 type SelectedGpu struct {
@@ -95,12 +104,68 @@ func (gpuSet *SelectedGpuSet) GetGpus() []restapi.SessionGpu {
 		publicGpus[index] = restapi.SessionGpu{
 			Index:        gpu.gpu.Index,
 			VramRequired: gpu.vramRequired,
+			Name:         gpu.gpu.Name,
+			PciBus:       gpu.gpu.PciBus,
+			Vram:         gpu.gpu.Vram,
 		}
 	}
 
 	return publicGpus
 }
 
+// Returns the GPUs for which keep returns true, renumbered so each GPU's Index is its position
+// in the returned set
+func (gpuSet *GpuSet) Filter(keep func(gpu restapi.Gpu) bool) *GpuSet {
+	gpus := make([]*Gpu, 0)
+	for _, gpu := range gpuSet.gpus {
+		if keep(gpu.Gpu) {
+			filtered := *gpu
+			filtered.Index = len(gpus)
+			gpus = append(gpus, &filtered)
+		}
+	}
+
+	return &GpuSet{
+		gpus:              gpus,
+		maxSessionsPerGpu: gpuSet.maxSessionsPerGpu,
+	}
+}
+
+// Limits the number of sessions Find places on each GPU, 0 removes the limit. Encoder and
+// context limits can make another session fail on a GPU even when it has VRAM available.
+func (gpuSet *GpuSet) LimitSessionsPerGpu(max int) {
+	gpuSet.maxSessionsPerGpu = max
+}
+
+// Shares the GPU between at most maxSessions sessions, each allocated at most sessionVram, see
+// restapi.Gpu.MaxSessions
+func (gpuSet *GpuSet) Share(index int, maxSessions int, sessionVram uint64) {
+	gpuSet.gpus[index].MaxSessions = maxSessions
+	gpuSet.gpus[index].SessionVram = sessionVram
+}
+
+func (gpu *Gpu) full(maxSessions int) bool {
+	if gpu.MaxSessions > 0 && (maxSessions == 0 || gpu.MaxSessions < maxSessions) {
+		maxSessions = gpu.MaxSessions
+	}
+
+	return maxSessions > 0 && gpu.sessions >= maxSessions
+}
+
+// Returns the VRAM allocated to a session requiring vramRequired on the GPU and whether the GPU's
+// per-session cap allows it
+func (gpu *Gpu) allocation(vramRequired uint64) (uint64, bool) {
+	if gpu.SessionVram == 0 {
+		return vramRequired, true
+	}
+
+	if vramRequired == 0 {
+		return gpu.SessionVram, true
+	}
+
+	return vramRequired, vramRequired <= gpu.SessionVram
+}
+
 func (gpuSet *GpuSet) GetPciBusString() string {
 	pciBus := ""
 
@@ -134,11 +199,10 @@ func (gpuSet *GpuSet) Find(requirements []restapi.GpuRequirements) (*SelectedGpu
 		logger.Panic("GpuSet.Find: expected at least one GPU requirement")
 	}
 
-	// Currently, this algorithm will choose the first GPU that matches both VRAM and the PCIBus, if specified.
-	// This algorithm does not allow GPUs to be reused though there is no reason why the GPUs could not be reused,
-	// though not preferrable if other GPUs are available.
-
-	// TODO: Better matching algorithm. Reuse of the same GPU can be done but should be the last option
+	// Each requirement is placed on the matching GPU with the least VRAM available that still fits it (best fit).
+	// Packing sessions tightly keeps whole GPUs free for large requests rather than leaving slivers of VRAM
+	// too small to use on every GPU. This algorithm does not allow GPUs to be reused though there is no reason
+	// why the GPUs could not be reused, though not preferrable if other GPUs are available.
 
 	availableGpus := map[int]*Gpu{}
 	for index, gpu := range gpuSet.gpus {
@@ -147,8 +211,14 @@ func (gpuSet *GpuSet) Find(requirements []restapi.GpuRequirements) (*SelectedGpu
 
 	selectedGpus := make([]SelectedGpu, 0)
 	for _, requirement := range requirements {
+		bestIndex := -1
 		for index, potentialGpu := range availableGpus {
-			if requirement.VramRequired != 0 && potentialGpu.vramAvailable < requirement.VramRequired {
+			if potentialGpu.full(gpuSet.maxSessionsPerGpu) || potentialGpu.vramLeaked > 0 || potentialGpu.unhealthy != "" {
+				continue
+			}
+
+			vramAllocated, allowed := potentialGpu.allocation(requirement.VramRequired)
+			if !allowed || (vramAllocated != 0 && potentialGpu.vramAvailable < vramAllocated) {
 				continue
 			}
 
@@ -160,12 +230,20 @@ func (gpuSet *GpuSet) Find(requirements []restapi.GpuRequirements) (*SelectedGpu
 				}
 			}
 
+			if bestIndex == -1 || potentialGpu.vramAvailable < availableGpus[bestIndex].vramAvailable ||
+				(potentialGpu.vramAvailable == availableGpus[bestIndex].vramAvailable && index < bestIndex) {
+				bestIndex = index
+			}
+		}
+
+		if bestIndex != -1 {
+			vramAllocated, _ := availableGpus[bestIndex].allocation(requirement.VramRequired)
 			selectedGpus = append(selectedGpus, SelectedGpu{
-				gpu:          potentialGpu,
-				vramRequired: requirement.VramRequired,
+				gpu:          availableGpus[bestIndex],
+				vramRequired: vramAllocated,
 			})
 
-			delete(availableGpus, index)
+			delete(availableGpus, bestIndex)
 		}
 	}
 
@@ -175,6 +253,7 @@ func (gpuSet *GpuSet) Find(requirements []restapi.GpuRequirements) (*SelectedGpu
 
 	for _, gpu := range selectedGpus {
 		gpu.gpu.vramAvailable -= gpu.vramRequired
+		gpu.gpu.sessions++
 	}
 
 	return &SelectedGpuSet{
@@ -196,6 +275,7 @@ func (gpuSet *GpuSet) Select(chosenGpus []restapi.SessionGpu) (*SelectedGpuSet,
 			vramRequired: chosenGpu.VramRequired,
 		})
 		gpu.vramAvailable -= chosenGpu.VramRequired
+		gpu.sessions++
 	}
 
 	return &SelectedGpuSet{
@@ -204,6 +284,115 @@ func (gpuSet *GpuSet) Select(chosenGpus []restapi.SessionGpu) (*SelectedGpuSet,
 	}, nil
 }
 
+// Returns an error when the chosen GPUs could not take a session now, without selecting them
+func (gpuSet *GpuSet) CanSelect(chosenGpus []restapi.SessionGpu) error {
+	for _, chosenGpu := range chosenGpus {
+		if chosenGpu.Index < 0 || chosenGpu.Index >= len(gpuSet.gpus) {
+			return fmt.Errorf("GPU %d does not exist", chosenGpu.Index)
+		}
+
+		gpu := gpuSet.gpus[chosenGpu.Index]
+		if gpu.full(gpuSet.maxSessionsPerGpu) {
+			return fmt.Errorf("GPU %d already has %d sessions", chosenGpu.Index, gpu.sessions)
+		}
+
+		if gpu.vramLeaked > 0 {
+			return fmt.Errorf("GPU %d has %dMB of leaked VRAM", chosenGpu.Index, gpu.vramLeaked/(1024*1024))
+		}
+
+		if gpu.unhealthy != "" {
+			return fmt.Errorf("GPU %d is unhealthy, %s", chosenGpu.Index, gpu.unhealthy)
+		}
+
+		if gpu.SessionVram > 0 && chosenGpu.VramRequired > gpu.SessionVram {
+			return fmt.Errorf("GPU %d allocates at most %dMB of VRAM to each session, %dMB required", chosenGpu.Index, gpu.SessionVram/(1024*1024), chosenGpu.VramRequired/(1024*1024))
+		}
+
+		if gpu.vramAvailable < chosenGpu.VramRequired {
+			return fmt.Errorf("GPU %d has %dMB of VRAM available, %dMB required", chosenGpu.Index, gpu.vramAvailable/(1024*1024), chosenGpu.VramRequired/(1024*1024))
+		}
+	}
+
+	return nil
+}
+
+func (gpuSet *GpuSet) VramAvailable() []uint64 {
+	vramAvailable := make([]uint64, len(gpuSet.gpus))
+	for index, gpu := range gpuSet.gpus {
+		vramAvailable[index] = gpu.vramAvailable
+	}
+
+	return vramAvailable
+}
+
+// Sets the VRAM leaked on the GPU, 0 once it is released
+func (gpuSet *GpuSet) SetVramLeaked(index int, vram uint64) {
+	gpuSet.gpus[index].vramLeaked = vram
+}
+
+// Returns the VRAM leaked on each GPU
+func (gpuSet *GpuSet) VramLeaked() []uint64 {
+	vramLeaked := make([]uint64, len(gpuSet.gpus))
+	for index, gpu := range gpuSet.gpus {
+		vramLeaked[index] = gpu.vramLeaked
+	}
+
+	return vramLeaked
+}
+
+// Sets why the GPU is unhealthy, empty once it recovers
+func (gpuSet *GpuSet) SetUnhealthy(index int, reason string) {
+	gpuSet.gpus[index].unhealthy = reason
+}
+
+// Returns why each GPU is unhealthy, empty for the healthy GPUs
+func (gpuSet *GpuSet) Unhealthy() []string {
+	unhealthy := make([]string, len(gpuSet.gpus))
+	for index, gpu := range gpuSet.gpus {
+		unhealthy[index] = gpu.unhealthy
+	}
+
+	return unhealthy
+}
+
+// Returns the number of sessions on each GPU
+func (gpuSet *GpuSet) Sessions() []int {
+	sessions := make([]int, len(gpuSet.gpus))
+	for index, gpu := range gpuSet.gpus {
+		sessions[index] = gpu.sessions
+	}
+
+	return sessions
+}
+
+// Returns the fraction of available VRAM not usable by a single allocation, 0 when
+// all of the available VRAM is on one GPU and approaching 1 as it is spread into slivers
+func (gpuSet *GpuSet) Fragmentation() float64 {
+	var total, largest uint64
+	for _, gpu := range gpuSet.gpus {
+		total += gpu.vramAvailable
+		if gpu.vramAvailable > largest {
+			largest = gpu.vramAvailable
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	return 1 - float64(largest)/float64(total)
+}
+
+// Returns the VRAM left available on the selected GPUs
+func (gpuSet *SelectedGpuSet) VramRemaining() uint64 {
+	var remaining uint64
+	for _, gpu := range gpuSet.gpus {
+		remaining += gpu.gpu.vramAvailable
+	}
+
+	return remaining
+}
+
 func (gpuSet *SelectedGpuSet) Release() {
 	if gpuSet.released {
 		logger.Panic("SelectedGpuSet.Release: release called twice")
@@ -211,6 +400,7 @@ func (gpuSet *SelectedGpuSet) Release() {
 
 	for _, gpu := range gpuSet.gpus {
 		gpu.gpu.vramAvailable += gpu.vramRequired
+		gpu.gpu.sessions--
 	}
 
 	gpuSet.released = true
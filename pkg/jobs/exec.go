@@ -0,0 +1,99 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Runs jobs as local processes, for CPU work launched by a wrapper script or tested without a cluster
+type ExecLauncher struct{}
+
+func NewExecLauncher() *ExecLauncher {
+	return &ExecLauncher{}
+}
+
+type execJob struct {
+	cmd *exec.Cmd
+
+	mutex    sync.Mutex
+	state    string
+	canceled bool
+}
+
+func (launcher *ExecLauncher) Submit(ctx context.Context, spec Spec) (Job, error) {
+	if len(spec.Command) == 0 {
+		return nil, errors.New("exec: the job has no command")
+	}
+
+	// Not bound to ctx, the job runs until it exits or is canceled
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("exec: unable to start %s, %v", spec.Command[0], err)
+	}
+
+	job := &execJob{
+		cmd:   cmd,
+		state: StateRunning,
+	}
+
+	go job.wait()
+
+	return job, nil
+}
+
+func (job *execJob) wait() {
+	err := job.cmd.Wait()
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	switch {
+	case job.canceled:
+		job.state = StateCanceled
+	case err != nil:
+		job.state = StateFailed
+	default:
+		job.state = StateCompleted
+	}
+}
+
+func (job *execJob) Id() string {
+	return fmt.Sprint(job.cmd.Process.Pid)
+}
+
+func (job *execJob) State(ctx context.Context) (string, error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.state, nil
+}
+
+func (job *execJob) Cancel(ctx context.Context) error {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if Ended(job.state) {
+		return nil
+	}
+
+	job.canceled = true
+
+	err := job.cmd.Process.Kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+
+	return nil
+}
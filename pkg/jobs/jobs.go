@@ -0,0 +1,66 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+// States of a job, as reported by Job.State
+const (
+	StatePending   = "pending"
+	StateRunning   = "running"
+	StateCompleted = "completed"
+	StateFailed    = "failed"
+	StateCanceled  = "canceled"
+)
+
+// Returns whether the job in the state has ended and will not run again
+func Ended(state string) bool {
+	return state == StateCompleted || state == StateFailed || state == StateCanceled
+}
+
+// The command a job runs
+type Spec struct {
+	Command []string
+	// Added to the environment of the job
+	Env []string
+}
+
+// A job submitted to an external scheduler, such as a Slurm cluster, or run locally
+type Job interface {
+	Id() string
+	State(ctx context.Context) (string, error)
+	Cancel(ctx context.Context) error
+}
+
+// Submits jobs to run
+type Launcher interface {
+	Submit(ctx context.Context, spec Spec) (Job, error)
+}
+
+// Polls the state of the job at the interval until done returns true for it, returning the last
+// state, or until ctx is canceled
+func WaitFor(ctx context.Context, job Job, interval time.Duration, done func(state string) bool) (string, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		state, err := job.State(ctx)
+		if err != nil {
+			return state, err
+		}
+
+		if done(state) {
+			return state, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return state, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Submits jobs to a Slurm cluster with sbatch, tracking them with squeue and sacct
+type SlurmLauncher struct {
+	// Passed to sbatch ahead of the job's command, such as --partition or --nodes
+	Args []string
+}
+
+func NewSlurmLauncher(args []string) *SlurmLauncher {
+	return &SlurmLauncher{
+		Args: args,
+	}
+}
+
+type slurmJob struct {
+	id string
+}
+
+// Runs the Slurm command, returning its standard output
+func slurm(ctx context.Context, env []string, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s failed, %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (launcher *SlurmLauncher) Submit(ctx context.Context, spec Spec) (Job, error) {
+	if len(spec.Command) == 0 {
+		return nil, errors.New("slurm: the job has no command")
+	}
+
+	args := append([]string{"--parsable"}, launcher.Args...)
+	args = append(args, spec.Command...)
+
+	// sbatch exports its environment to the job by default
+	output, err := slurm(ctx, spec.Env, "sbatch", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// --parsable prints <id>[;<cluster>]
+	id, _, _ := strings.Cut(output, ";")
+	if id == "" {
+		return nil, fmt.Errorf("slurm: sbatch did not print the id of the job, %q", output)
+	}
+
+	return &slurmJob{
+		id: id,
+	}, nil
+}
+
+func (job *slurmJob) Id() string {
+	return job.id
+}
+
+func (job *slurmJob) State(ctx context.Context) (string, error) {
+	// squeue only lists jobs until shortly after they end, sacct remembers them when accounting is enabled
+	output, err := slurm(ctx, nil, "squeue", "--noheader", "--jobs", job.id, "--format", "%T")
+	if err != nil || output == "" {
+		output, err = slurm(ctx, nil, "sacct", "--noheader", "--parsable2", "--allocations", "--jobs", job.id, "--format", "State")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		// Neither knows of the job any more
+		return StateCompleted, nil
+	}
+
+	return slurmState(fields[0]), nil
+}
+
+func (job *slurmJob) Cancel(ctx context.Context) error {
+	_, err := slurm(ctx, nil, "scancel", job.id)
+	return err
+}
+
+// Maps the state of a Slurm job to a job state
+func slurmState(state string) string {
+	switch state {
+	case "PENDING", "CONFIGURING", "REQUEUED", "REQUEUE_FED", "REQUEUE_HOLD", "RESV_DEL_HOLD":
+		return StatePending
+	case "RUNNING", "COMPLETING", "SUSPENDED", "STOPPED", "SIGNALING", "STAGE_OUT", "RESIZING":
+		return StateRunning
+	case "COMPLETED":
+		return StateCompleted
+	}
+
+	// sacct reports CANCELLED by <uid>
+	if strings.HasPrefix(state, "CANCELLED") {
+		return StateCanceled
+	}
+
+	return StateFailed
+}
@@ -0,0 +1,203 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields commonly logged with messages
+const (
+	FieldSessionId = "session_id"
+	FieldAgentId   = "agent_id"
+)
+
+// Structured fields of a message, written as their own keys when --log-format is json. Text
+// messages leave them out, they already name what they concern.
+type Fields map[string]string
+
+var (
+	fieldsMutex sync.RWMutex
+	// The name of the process, see SetComponent
+	component string
+	// Logged with every message, see SetField
+	processFields = Fields{}
+
+	// Serializes the lines of the JSON log across levels
+	jsonMutex sync.Mutex
+)
+
+// Names the process in the component field, such as juice-agent for "Juice Agent"
+func SetComponent(name string) {
+	fieldsMutex.Lock()
+	defer fieldsMutex.Unlock()
+
+	component = strings.ToLower(strings.Join(strings.Fields(name), "-"))
+}
+
+// Logs the field with every message from now on, such as the agent's id once it is known. An
+// empty value removes the field.
+func SetField(key string, value string) {
+	fieldsMutex.Lock()
+	defer fieldsMutex.Unlock()
+
+	if value == "" {
+		delete(processFields, key)
+	} else {
+		processFields[key] = value
+	}
+}
+
+// Logs messages with fields, see Fields
+type Entry struct {
+	fields Fields
+}
+
+func WithFields(fields Fields) Entry {
+	return Entry{
+		fields: fields,
+	}
+}
+
+// Logs messages concerning the session
+func WithSession(id string) Entry {
+	return WithFields(Fields{FieldSessionId: id})
+}
+
+// Writes the message to the logger of the level, which discards it when the level is not logged
+func (entry Entry) output(logger *log.Logger, level string, message string) {
+	if !jsonFormat {
+		logger.Print(message)
+		return
+	}
+
+	out := logger.Writer()
+	if out == io.Discard {
+		return
+	}
+
+	message = strings.TrimSuffix(message, "\n")
+
+	fieldsMutex.RLock()
+	fields := make(Fields, len(processFields)+len(entry.fields))
+	for key, value := range processFields {
+		fields[key] = value
+	}
+	processComponent := component
+	fieldsMutex.RUnlock()
+
+	for key, value := range entry.fields {
+		fields[key] = value
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Written in a fixed order rather than through a map so lines read consistently
+	var line strings.Builder
+	line.WriteString("{")
+	writeJsonField(&line, "timestamp", time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(",")
+	writeJsonField(&line, "level", level)
+	if processComponent != "" {
+		line.WriteString(",")
+		writeJsonField(&line, "component", processComponent)
+	}
+	line.WriteString(",")
+	writeJsonField(&line, "message", message)
+	for _, key := range keys {
+		switch key {
+		case "timestamp", "level", "component", "message":
+			continue
+		}
+
+		line.WriteString(",")
+		writeJsonField(&line, key, fields[key])
+	}
+	line.WriteString("}\n")
+
+	jsonMutex.Lock()
+	defer jsonMutex.Unlock()
+
+	io.WriteString(out, line.String())
+}
+
+func writeJsonField(line *strings.Builder, key string, value string) {
+	encodedKey, _ := json.Marshal(key)
+	encodedValue, _ := json.Marshal(value)
+
+	line.Write(encodedKey)
+	line.WriteString(":")
+	line.Write(encodedValue)
+}
+
+func (entry Entry) Error(v ...any) {
+	if !*quiet {
+		entry.output(errorLogger, "error", fmt.Sprint(v...))
+	}
+}
+
+func (entry Entry) Errorf(format string, v ...any) {
+	if !*quiet {
+		entry.output(errorLogger, "error", fmt.Sprintf(format, v...))
+	}
+}
+
+func (entry Entry) Warning(v ...any) {
+	if !*quiet {
+		entry.output(warningLogger, "warning", fmt.Sprint(v...))
+	}
+}
+
+func (entry Entry) Warningf(format string, v ...any) {
+	if !*quiet {
+		entry.output(warningLogger, "warning", fmt.Sprintf(format, v...))
+	}
+}
+
+func (entry Entry) Info(v ...any) {
+	if !*quiet {
+		entry.output(infoLogger, "info", fmt.Sprint(v...))
+	}
+}
+
+func (entry Entry) Infof(format string, v ...any) {
+	if !*quiet {
+		entry.output(infoLogger, "info", fmt.Sprintf(format, v...))
+	}
+}
+
+func (entry Entry) Debug(v ...any) {
+	if !*quiet {
+		entry.output(debugLogger, "debug", fmt.Sprint(v...))
+	}
+}
+
+func (entry Entry) Debugf(format string, v ...any) {
+	if !*quiet {
+		entry.output(debugLogger, "debug", fmt.Sprintf(format, v...))
+	}
+}
+
+func (entry Entry) Trace(v ...any) {
+	if !*quiet {
+		entry.output(traceLogger, "trace", fmt.Sprint(v...))
+	}
+}
+
+func (entry Entry) Tracef(format string, v ...any) {
+	if !*quiet {
+		entry.output(traceLogger, "trace", fmt.Sprintf(format, v...))
+	}
+}
@@ -27,9 +27,13 @@ var (
 	quiet       = flag.Bool("quiet", false, "Disables all logging output")
 	logLevelArg = flag.String("log-level", "info", "Sets the maximum level of output [Fatal, Error, Warning, Info (Default), Debug, Trace]")
 	logFile     = flag.String("log-file", "", "")
+	logFormat   = flag.String("log-format", "text", "The format of the log, text or json. JSON writes an object per line with the timestamp, level, component, message, and the fields of the message such as session_id and agent_id")
 
 	logLevel = LevelInfo
 
+	// Whether --log-format is json, see Entry.output
+	jsonFormat = false
+
 	panicLogger   = log.New(os.Stderr, "Panic: ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
 	fatalLogger   = log.New(os.Stderr, "Fatal: ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
 	errorLogger   = log.New(os.Stderr, "Error: ", log.LstdFlags|log.LUTC|log.Lmsgprefix)
@@ -59,6 +63,15 @@ func LogLevelAsString() (string, error) {
 }
 
 func Configure() error {
+	switch *logFormat {
+	case "text":
+		jsonFormat = false
+	case "json":
+		jsonFormat = true
+	default:
+		return fmt.Errorf("unknown log-format %s, expected text or json", *logFormat)
+	}
+
 	switch strings.ToLower(strings.TrimSpace(*logLevelArg)) {
 	case "fatal":
 		logLevel = LevelFatal
@@ -128,77 +141,63 @@ func Configure() error {
 }
 
 func Fatal(v ...any) {
-	fatalLogger.Fatal(v...)
+	Entry{}.output(fatalLogger, "fatal", fmt.Sprint(v...))
+	os.Exit(1)
 }
 
 func Fatalf(format string, v ...any) {
-	fatalLogger.Fatalf(format, v...)
+	Entry{}.output(fatalLogger, "fatal", fmt.Sprintf(format, v...))
+	os.Exit(1)
 }
 
 func Panic(v ...any) {
-	panicLogger.Panic(v...)
+	message := fmt.Sprint(v...)
+	Entry{}.output(panicLogger, "panic", message)
+	panic(message)
 }
 
 func Panicf(format string, v ...any) {
-	panicLogger.Panicf(format, v...)
+	message := fmt.Sprintf(format, v...)
+	Entry{}.output(panicLogger, "panic", message)
+	panic(message)
 }
 
 func Error(v ...any) {
-	if !*quiet {
-		errorLogger.Print(v...)
-	}
+	Entry{}.Error(v...)
 }
 
 func Errorf(format string, v ...any) {
-	if !*quiet {
-		errorLogger.Printf(format, v...)
-	}
+	Entry{}.Errorf(format, v...)
 }
 
 func Warning(v ...any) {
-	if !*quiet {
-		warningLogger.Print(v...)
-	}
+	Entry{}.Warning(v...)
 }
 
 func Warningf(format string, v ...any) {
-	if !*quiet {
-		warningLogger.Printf(format, v...)
-	}
+	Entry{}.Warningf(format, v...)
 }
 
 func Info(v ...any) {
-	if !*quiet {
-		infoLogger.Print(v...)
-	}
+	Entry{}.Info(v...)
 }
 
 func Infof(format string, v ...any) {
-	if !*quiet {
-		infoLogger.Printf(format, v...)
-	}
+	Entry{}.Infof(format, v...)
 }
 
 func Debug(v ...any) {
-	if !*quiet {
-		debugLogger.Print(v...)
-	}
+	Entry{}.Debug(v...)
 }
 
 func Debugf(format string, v ...any) {
-	if !*quiet {
-		debugLogger.Printf(format, v...)
-	}
+	Entry{}.Debugf(format, v...)
 }
 
 func Trace(v ...any) {
-	if !*quiet {
-		traceLogger.Print(v...)
-	}
+	Entry{}.Trace(v...)
 }
 
 func Tracef(format string, v ...any) {
-	if !*quiet {
-		traceLogger.Printf(format, v...)
-	}
+	Entry{}.Tracef(format, v...)
 }
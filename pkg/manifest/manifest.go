@@ -0,0 +1,290 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A resource declared by a manifest, a YAML document with its kind, its name, and the fields of
+// its kind
+type Resource struct {
+	Kind string
+	Name string
+
+	// The value Kinds returned for the kind, the fields of the document decoded into it
+	Spec any
+}
+
+// Returns the value the fields of the resources of each kind are decoded into, a pointer to a
+// struct whose fields have yaml tags
+type Kinds map[string]func() any
+
+func (kinds Kinds) names() []string {
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Decodes the resources of the YAML documents read, rejecting unknown kinds or fields and
+// resources declared more than once. Empty documents are skipped.
+func Decode(reader io.Reader, kinds Kinds) ([]Resource, error) {
+	resources := []Resource{}
+	declared := map[string]struct{}{}
+
+	decoder := yaml.NewDecoder(reader)
+	for document := 1; ; document++ {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if err == io.EOF {
+			return resources, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		resource, err := decodeResource(&node, kinds)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", document, err)
+		} else if resource.Kind == "" {
+			continue
+		}
+
+		key := resource.Kind + "/" + resource.Name
+		if _, present := declared[key]; present {
+			return nil, fmt.Errorf("document %d: %s %s is declared more than once", document, resource.Kind, resource.Name)
+		}
+		declared[key] = struct{}{}
+
+		resources = append(resources, resource)
+	}
+}
+
+func decodeResource(document *yaml.Node, kinds Kinds) (Resource, error) {
+	if len(document.Content) == 0 {
+		return Resource{}, nil
+	}
+
+	node := document.Content[0]
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return Resource{}, nil
+	} else if node.Kind != yaml.MappingNode {
+		return Resource{}, errors.New("must be a mapping with a kind and a name")
+	}
+
+	if len(node.Content) == 0 {
+		return Resource{}, nil
+	}
+
+	var resource Resource
+	spec := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		switch key.Value {
+		case "kind":
+			resource.Kind = value.Value
+		case "name":
+			resource.Name = value.Value
+		default:
+			spec.Content = append(spec.Content, key, value)
+		}
+	}
+
+	newSpec, present := kinds[resource.Kind]
+	if !present {
+		return Resource{}, fmt.Errorf("unknown kind %q, must be one of %s", resource.Kind, strings.Join(kinds.names(), ", "))
+	}
+
+	if resource.Name == "" {
+		return Resource{}, fmt.Errorf("%s has no name", resource.Kind)
+	}
+
+	// Decoded again from YAML, yaml.Node.Decode does not reject unknown fields
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return Resource{}, err
+	}
+
+	resource.Spec = newSpec()
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(resource.Spec)
+	if err != nil && err != io.EOF {
+		return Resource{}, fmt.Errorf("%s %s: %w", resource.Kind, resource.Name, err)
+	}
+
+	return resource, nil
+}
+
+// The fields of a resource compared one by one, keyed by their path such as labels.gpu or
+// events[1]
+type Fields map[string]string
+
+// Returns the fields of the value as it is marshaled to YAML, leaving out those it omits
+func Flatten(value any) (Fields, error) {
+	var node yaml.Node
+	err := node.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := Fields{}
+	flatten(&node, "", fields)
+	return fields, nil
+}
+
+func flatten(node *yaml.Node, path string, fields Fields) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, content := range node.Content {
+			flatten(content, path, fields)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+
+			flatten(node.Content[i+1], key, fields)
+		}
+	case yaml.SequenceNode:
+		for i, content := range node.Content {
+			flatten(content, fmt.Sprintf("%s[%d]", path, i), fields)
+		}
+	case yaml.AliasNode:
+		flatten(node.Alias, path, fields)
+	default:
+		if node.Tag != "!!null" {
+			fields[path] = node.Value
+		}
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Describes the fields declared that are added or changed and the current fields removed, nil
+// when they are the same. Fields added are described as +path=value, changed as
+// ~path=value (was value), and removed as -path.
+func Diff(current Fields, declared Fields) []string {
+	var diff []string
+	for _, key := range sortedKeys(declared) {
+		value, present := current[key]
+		if !present {
+			diff = append(diff, fmt.Sprintf("+%s=%s", key, declared[key]))
+		} else if value != declared[key] {
+			diff = append(diff, fmt.Sprintf("~%s=%s (was %s)", key, declared[key], value))
+		}
+	}
+
+	for _, key := range sortedKeys(current) {
+		if _, present := declared[key]; !present {
+			diff = append(diff, fmt.Sprintf("-%s", key))
+		}
+	}
+
+	return diff
+}
+
+// Actions of a change
+const (
+	Create  = "create"
+	Update  = "update"
+	Replace = "replace"
+	Delete  = "delete"
+)
+
+var actionSymbols = map[string]string{
+	Create:  "+",
+	Update:  "~",
+	Replace: "-/+",
+	Delete:  "-",
+}
+
+// A change making the current state match the manifests
+type Change struct {
+	Action string   `json:"action"`
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	Diff   []string `json:"diff,omitempty"`
+}
+
+// Describes the change on one line, such as ~ pool batch: ~paused=true (was false)
+func (change Change) String() string {
+	line := fmt.Sprintf("%s %s %s", actionSymbols[change.Action], change.Kind, change.Name)
+	if len(change.Diff) > 0 {
+		line = fmt.Sprint(line, ": ", strings.Join(change.Diff, ", "))
+	}
+
+	return line
+}
+
+// Returns the changes making the current resources of the kind, by name, match those declared,
+// ordered by name: creating the resources only declared, updating those whose fields differ,
+// and, with prune, deleting those not declared. Resources that match are left out.
+func Plan(kind string, current map[string]Fields, declared map[string]Fields, prune bool) []Change {
+	changes := []Change{}
+	for _, name := range sortedNames(declared) {
+		fields, present := current[name]
+		if !present {
+			changes = append(changes, Change{
+				Action: Create,
+				Kind:   kind,
+				Name:   name,
+				Diff:   Diff(nil, declared[name]),
+			})
+		} else if diff := Diff(fields, declared[name]); len(diff) > 0 {
+			changes = append(changes, Change{
+				Action: Update,
+				Kind:   kind,
+				Name:   name,
+				Diff:   diff,
+			})
+		}
+	}
+
+	if prune {
+		for _, name := range sortedNames(current) {
+			if _, present := declared[name]; !present {
+				changes = append(changes, Change{
+					Action: Delete,
+					Kind:   kind,
+					Name:   name,
+				})
+			}
+		}
+	}
+
+	return changes
+}
+
+func sortedNames(resources map[string]Fields) []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
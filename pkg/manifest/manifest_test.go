@@ -0,0 +1,213 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package manifest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testPool struct {
+	Paused bool              `yaml:"paused"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Users  []string          `yaml:"users,omitempty"`
+}
+
+var testKinds = Kinds{
+	"pool": func() any { return &testPool{} },
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		expected []Resource
+		err      string
+	}{
+		{
+			name: "documents",
+			manifest: `kind: pool
+name: batch
+paused: true
+labels:
+  gpu: a100
+---
+---
+kind: pool
+name: interactive
+users: [alice, bob]
+`,
+			expected: []Resource{
+				{Kind: "pool", Name: "batch", Spec: &testPool{Paused: true, Labels: map[string]string{"gpu": "a100"}}},
+				{Kind: "pool", Name: "interactive", Spec: &testPool{Users: []string{"alice", "bob"}}},
+			},
+		},
+		{
+			name:     "unknown kind",
+			manifest: "kind: template\nname: render\n",
+			err:      `document 1: unknown kind "template", must be one of pool`,
+		},
+		{
+			name:     "unknown field",
+			manifest: "kind: pool\nname: batch\nenabled: true\n",
+			err:      "document 1: pool batch: yaml: unmarshal errors:\n  line 1: field enabled not found in type manifest.testPool",
+		},
+		{
+			name:     "no name",
+			manifest: "kind: pool\npaused: true\n",
+			err:      "document 1: pool has no name",
+		},
+		{
+			name:     "declared twice",
+			manifest: "kind: pool\nname: batch\n---\nkind: pool\nname: batch\npaused: true\n",
+			err:      "document 2: pool batch is declared more than once",
+		},
+		{
+			name:     "not a mapping",
+			manifest: "- kind: pool\n",
+			err:      "document 1: must be a mapping with a kind and a name",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resources, err := Decode(strings.NewReader(test.manifest), testKinds)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected the error %q, instead received %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(test.expected, resources) {
+				t.Errorf("expected %+v, instead received %+v", test.expected, resources)
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	fields, err := Flatten(testPool{
+		Paused: true,
+		Labels: map[string]string{"gpu": "a100", "zone": "west"},
+		Users:  []string{"alice", "bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Fields{
+		"paused":      "true",
+		"labels.gpu":  "a100",
+		"labels.zone": "west",
+		"users[0]":    "alice",
+		"users[1]":    "bob",
+	}
+	if !reflect.DeepEqual(expected, fields) {
+		t.Errorf("expected %v, instead received %v", expected, fields)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  Fields
+		declared Fields
+		expected []string
+	}{
+		{
+			name:     "create",
+			declared: Fields{"paused": "true", "labels.gpu": "a100"},
+			expected: []string{"+labels.gpu=a100", "+paused=true"},
+		},
+		{
+			name:     "update",
+			current:  Fields{"paused": "false", "labels.gpu": "a100"},
+			declared: Fields{"paused": "true", "labels.gpu": "a100"},
+			expected: []string{"~paused=true (was false)"},
+		},
+		{
+			name:     "delete",
+			current:  Fields{"paused": "true", "labels.gpu": "a100"},
+			declared: Fields{"paused": "true"},
+			expected: []string{"-labels.gpu"},
+		},
+		{
+			name:     "no-op",
+			current:  Fields{"paused": "true", "labels.gpu": "a100"},
+			declared: Fields{"labels.gpu": "a100", "paused": "true"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := Diff(test.current, test.declared)
+			if !reflect.DeepEqual(test.expected, diff) {
+				t.Errorf("expected %q, instead received %q", test.expected, diff)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	current := map[string]Fields{
+		"batch":       {"paused": "false"},
+		"interactive": {"paused": "false"},
+		"render":      {"paused": "true"},
+	}
+
+	declared := map[string]Fields{
+		"batch":       {"paused": "true"},
+		"interactive": {"paused": "false"},
+		"training":    {"paused": "false"},
+	}
+
+	tests := []struct {
+		name     string
+		prune    bool
+		expected []Change
+	}{
+		{
+			name: "create and update",
+			expected: []Change{
+				{Action: Update, Kind: "pool", Name: "batch", Diff: []string{"~paused=true (was false)"}},
+				{Action: Create, Kind: "pool", Name: "training", Diff: []string{"+paused=false"}},
+			},
+		},
+		{
+			name:  "prune",
+			prune: true,
+			expected: []Change{
+				{Action: Update, Kind: "pool", Name: "batch", Diff: []string{"~paused=true (was false)"}},
+				{Action: Create, Kind: "pool", Name: "training", Diff: []string{"+paused=false"}},
+				{Action: Delete, Kind: "pool", Name: "render"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := Plan("pool", current, declared, test.prune)
+			if !reflect.DeepEqual(test.expected, changes) {
+				t.Errorf("expected %+v, instead received %+v", test.expected, changes)
+			}
+		})
+	}
+
+	changes := Plan("pool", current, map[string]Fields{"batch": {"paused": "false"}}, false)
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, instead received %+v", changes)
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	change := Change{Action: Replace, Kind: "token", Name: "ci", Diff: []string{"~user=bob (was alice)", "+ttl=24h"}}
+	expected := "-/+ token ci: ~user=bob (was alice), +ttl=24h"
+	if change.String() != expected {
+		t.Errorf("expected %q, instead received %q", expected, change.String())
+	}
+}
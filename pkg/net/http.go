@@ -9,6 +9,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 )
 
 func Respond[T any](w http.ResponseWriter, code int, obj T) error {
@@ -31,6 +33,11 @@ func RespondWithString(w http.ResponseWriter, code int, msg string) error {
 	return err
 }
 
+// Responds with the message of err and the HTTP status of its kind
+func RespondWithError(w http.ResponseWriter, err error) error {
+	return RespondWithString(w, pkgerrors.HttpStatus(err), err.Error())
+}
+
 func RespondEmpty(w http.ResponseWriter, code int) {
 	w.WriteHeader(code)
 }
@@ -112,7 +119,7 @@ func PostNoResponse(client *http.Client, url string) error {
 	defer r.Body.Close()
 
 	if r.StatusCode != 200 {
-		return fmt.Errorf("error received from server, code %d", r.StatusCode)
+		return pkgerrors.FromResponse(r.StatusCode, "")
 	}
 
 	return nil
@@ -134,7 +141,7 @@ func PostWithBodyNoResponse[T any](client *http.Client, url string, obj T) error
 	defer r.Body.Close()
 
 	if r.StatusCode != 200 {
-		return fmt.Errorf("error received from server, code %d", r.StatusCode)
+		return pkgerrors.FromResponse(r.StatusCode, "")
 	}
 
 	return nil
@@ -185,11 +192,7 @@ func ReadBodyAsBytes(header http.Header, statusCode int, body io.ReadCloser, con
 	}
 
 	if statusCode != 200 {
-		if message != nil {
-			return nil, fmt.Errorf("error received from server, code %d\nmessage: %s", statusCode, string(message))
-		}
-
-		return nil, fmt.Errorf("error received from server, code %d", statusCode)
+		return nil, pkgerrors.FromResponse(statusCode, string(message))
 	}
 
 	return message, nil
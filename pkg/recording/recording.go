@@ -0,0 +1,268 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package recording
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/restapi"
+)
+
+// A recording starts with magic and the key it is encrypted with, wrapped by the controller,
+// followed by chunks of <uint32 length><nonce><ciphertext>. Each chunk decrypts to
+// <int64 unix nanoseconds><kind><data> and is authenticated with its index, so chunks cannot be
+// reordered or dropped without the recording failing to decrypt.
+var magic = []byte("JUICEREC\x01")
+
+const (
+	kindFromClient byte = iota
+	kindFromRenderer
+	kindEnd
+)
+
+// Largest chunk written, larger writes are split
+const maxChunkData = 64 * 1024
+
+// Bytes added to each chunk's data
+const chunkOverhead = 4 + 12 + 8 + 1 + 16
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("recording keys must be 32 bytes, found %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func additionalData(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, index)
+}
+
+// Encrypts the traffic of a session to a recording, not safe for concurrent use
+type Writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	index uint64
+	size  int64
+}
+
+func NewWriter(w io.Writer, key restapi.RecordingKey) (*Writer, error) {
+	aead, err := newAead(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key.WrappedKey) > 0xffff {
+		return nil, errors.New("wrapped recording key is too long")
+	}
+
+	header := append([]byte{}, magic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(key.WrappedKey)))
+	header = append(header, key.WrappedKey...)
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:    w,
+		aead: aead,
+		size: int64(len(header)),
+	}, nil
+}
+
+// Returns the bytes written so far
+func (writer *Writer) Size() int64 {
+	return writer.size
+}
+
+// Returns the bytes writing data adds to the recording
+func ChunkSize(data int) int64 {
+	chunks := (data + maxChunkData - 1) / maxChunkData
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	return int64(data + chunks*chunkOverhead)
+}
+
+// Records the data sent in the direction, see restapi.RecordingFrom*
+func (writer *Writer) Write(at time.Time, direction string, data []byte) error {
+	kind := kindFromClient
+	if direction == restapi.RecordingFromRenderer {
+		kind = kindFromRenderer
+	}
+
+	for len(data) > 0 {
+		length := len(data)
+		if length > maxChunkData {
+			length = maxChunkData
+		}
+
+		err := writer.writeChunk(at, kind, data[:length])
+		if err != nil {
+			return err
+		}
+
+		data = data[length:]
+	}
+
+	return nil
+}
+
+// Ends the recording for the reason, see restapi.RecordingEnd*. Nothing may be written after.
+func (writer *Writer) End(at time.Time, reason string) error {
+	return writer.writeChunk(at, kindEnd, []byte(reason))
+}
+
+func (writer *Writer) writeChunk(at time.Time, kind byte, data []byte) error {
+	plaintext := binary.BigEndian.AppendUint64(make([]byte, 0, 9+len(data)), uint64(at.UnixNano()))
+	plaintext = append(plaintext, kind)
+	plaintext = append(plaintext, data...)
+
+	nonce := make([]byte, writer.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	sealed := writer.aead.Seal(nonce, nonce, plaintext, additionalData(writer.index))
+
+	chunk := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+	chunk = append(chunk, sealed...)
+
+	_, err = writer.w.Write(chunk)
+	if err != nil {
+		return err
+	}
+
+	writer.index++
+	writer.size += int64(len(chunk))
+	return nil
+}
+
+// Decrypts a recording written by Writer
+type Reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	index uint64
+	ended bool
+}
+
+// Reads the recording's header, unwrap returns the key from the wrapped key stored with it
+func NewReader(r io.Reader, unwrap func(wrappedKey string) ([]byte, error)) (*Reader, error) {
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, len(magic)+2)
+	_, err := io.ReadFull(reader, header)
+	if err == nil && string(header[:len(magic)]) == string(magic) {
+		wrappedKey := make([]byte, binary.BigEndian.Uint16(header[len(magic):]))
+		_, err = io.ReadFull(reader, wrappedKey)
+		if err == nil {
+			return newReader(reader, string(wrappedKey), unwrap)
+		}
+	}
+
+	// Errors reading the recording are returned as they are, such as those of a request for it
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	return nil, errors.New("not a session recording")
+}
+
+func newReader(reader *bufio.Reader, wrappedKey string, unwrap func(wrappedKey string) ([]byte, error)) (*Reader, error) {
+	key, err := unwrap(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the key of the recording, %v", err)
+	}
+
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:    reader,
+		aead: aead,
+	}, nil
+}
+
+// Returns the next chunk of the recording, and io.EOF after its restapi.RecordingEnd chunk.
+// Recordings cut short, such as when the agent stopped while recording, end with a
+// restapi.RecordingEndTruncated chunk.
+func (reader *Reader) Next() (restapi.RecordingChunk, error) {
+	if reader.ended {
+		return restapi.RecordingChunk{}, io.EOF
+	}
+
+	var length [4]byte
+	_, err := io.ReadFull(reader.r, length[:])
+	if err == nil {
+		sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+		_, err = io.ReadFull(reader.r, sealed)
+		if err == nil {
+			return reader.open(sealed)
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		reader.ended = true
+		return restapi.RecordingChunk{
+			Direction: restapi.RecordingEnd,
+			Reason:    restapi.RecordingEndTruncated,
+		}, nil
+	}
+
+	return restapi.RecordingChunk{}, err
+}
+
+func (reader *Reader) open(sealed []byte) (restapi.RecordingChunk, error) {
+	nonceSize := reader.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return restapi.RecordingChunk{}, fmt.Errorf("chunk %d of the recording is malformed", reader.index)
+	}
+
+	plaintext, err := reader.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData(reader.index))
+	if err != nil || len(plaintext) < 9 {
+		return restapi.RecordingChunk{}, fmt.Errorf("chunk %d of the recording failed to decrypt, it was modified or is out of order", reader.index)
+	}
+	reader.index++
+
+	chunk := restapi.RecordingChunk{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(plaintext))).UTC(),
+	}
+
+	data := plaintext[9:]
+	switch plaintext[8] {
+	case kindFromClient:
+		chunk.Direction = restapi.RecordingFromClient
+		chunk.Data = data
+	case kindFromRenderer:
+		chunk.Direction = restapi.RecordingFromRenderer
+		chunk.Data = data
+	case kindEnd:
+		chunk.Direction = restapi.RecordingEnd
+		chunk.Reason = string(data)
+		reader.ended = true
+	default:
+		return restapi.RecordingChunk{}, fmt.Errorf("chunk %d of the recording is of unknown kind %d", reader.index-1, plaintext[8])
+	}
+
+	return chunk, nil
+}
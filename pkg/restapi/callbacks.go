@@ -0,0 +1,67 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	// Header of session callbacks holding sha256=<hex HMAC-SHA256 of the body>, keyed by the
+	// controller's --session-callback-secret-file
+	SessionCallbackSignatureHeader = "X-Juice-Signature"
+
+	sessionCallbackSignaturePrefix = "sha256="
+)
+
+// Posted as JSON to SessionRequirements.CallbackUrl once the session closes. Callbacks are sent at
+// least once, receivers use SessionId to ignore repeats.
+type SessionCallback struct {
+	SessionId  string    `json:"sessionId"`
+	ExitStatus string    `json:"exitStatus"`
+	ClosedAt   time.Time `json:"closedAt"`
+
+	Tenant string `json:"tenant,omitempty"`
+	User   string `json:"user,omitempty"`
+
+	Gpus        []SessionGpu `json:"gpus"`
+	CpuFallback bool         `json:"cpuFallback,omitempty"`
+
+	// Usage summaries, each nil when not reported
+	Release *SessionRelease `json:"release,omitempty"`
+	Network *NetworkMetrics `json:"network,omitempty"`
+	Frames  *FrameMetrics   `json:"frames,omitempty"`
+
+	LogExcerpt string `json:"logExcerpt,omitempty"`
+}
+
+// Returns the value of SessionCallbackSignatureHeader for the body
+func SignSessionCallback(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return sessionCallbackSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns whether the signature, the value of SessionCallbackSignatureHeader, matches the body
+func VerifySessionCallback(secret []byte, body []byte, signature string) bool {
+	encoded, found := strings.CutPrefix(signature, sessionCallbackSignaturePrefix)
+	if !found {
+		return false
+	}
+
+	expected, err := hex.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -5,24 +5,63 @@ package restapi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type Client struct {
 	Client  *http.Client
 	Scheme  string
 	Address string
+
+	// REST API version used for requests, defaults to v1. See NegotiateVersion
+	ApiVersion string
+
+	// Pre-shared token sent as a bearer token, required by agents configured with one
+	Token string
+
+	// User sessions are requested on behalf of, see OnBehalfOfHeader
+	OnBehalfOf string
 }
 
-func (api Client) do(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
-	url := url.URL{
-		Scheme: api.Scheme,
-		Host:   api.Address,
-		Path:   path,
+// Returns the URL of the path, served by the client's REST API version
+func (api Client) url(path string) url.URL {
+	if api.ApiVersion != "" && api.ApiVersion != ApiV1 {
+		if rest, found := strings.CutPrefix(path, "/v1/"); found {
+			path = fmt.Sprint("/", api.ApiVersion, "/", rest)
+		}
+	}
+
+	path, query, _ := strings.Cut(path, "?")
+
+	return url.URL{
+		Scheme:   api.Scheme,
+		Host:     api.Address,
+		Path:     path,
+		RawQuery: query,
 	}
+}
+
+func (api Client) addHeaders(header http.Header) {
+	if api.Token != "" {
+		header.Add("Authorization", fmt.Sprint("Bearer ", api.Token))
+	}
+
+	if api.OnBehalfOf != "" {
+		header.Add(OnBehalfOfHeader, api.OnBehalfOf)
+	}
+}
+
+func (api Client) do(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	url := api.url(path)
 
 	request, err := http.NewRequestWithContext(ctx, method, url.String(), body)
 	if err != nil {
@@ -33,6 +72,8 @@ func (api Client) do(ctx context.Context, method string, path string, contentTyp
 		request.Header.Add("Content-Type", contentType)
 	}
 
+	api.addHeaders(request.Header)
+
 	return api.Client.Do(request)
 }
 
@@ -44,14 +85,30 @@ func (api Client) post(ctx context.Context, path string) (*http.Response, error)
 	return api.do(ctx, "POST", path, "", nil)
 }
 
+func (api Client) put(ctx context.Context, path string) (*http.Response, error) {
+	return api.do(ctx, "PUT", path, "", nil)
+}
+
+func (api Client) delete(ctx context.Context, path string) (*http.Response, error) {
+	return api.do(ctx, "DELETE", path, "", nil)
+}
+
 func (api Client) postWithJson(ctx context.Context, path string, body io.Reader) (*http.Response, error) {
 	return api.do(ctx, "POST", path, "application/json", body)
 }
 
+func (api Client) putWithOctetStream(ctx context.Context, path string, body io.Reader) (*http.Response, error) {
+	return api.do(ctx, "PUT", path, "application/octet-stream", body)
+}
+
 func (api Client) putWithJson(ctx context.Context, path string, body io.Reader) (*http.Response, error) {
 	return api.do(ctx, "PUT", path, "application/json", body)
 }
 
+func (api Client) patchWithJson(ctx context.Context, path string, body io.Reader) (*http.Response, error) {
+	return api.do(ctx, "PATCH", path, "application/json", body)
+}
+
 func (api Client) Status() (Status, error) {
 	return api.StatusWithContext(context.Background())
 }
@@ -66,12 +123,40 @@ func (api Client) StatusWithContext(ctx context.Context) (Status, error) {
 	return parseJsonResponse[Status](response)
 }
 
+func (api *Client) NegotiateVersion() error {
+	return api.NegotiateVersionWithContext(context.Background())
+}
+
+// Selects the most preferred API version served by the server, /v1/status is
+// served by every version of the server
+func (api *Client) NegotiateVersionWithContext(ctx context.Context) error {
+	versioned := *api
+	versioned.ApiVersion = ApiV1
+
+	status, err := versioned.StatusWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	api.ApiVersion = ApiV1
+	for _, version := range SupportedApiVersions {
+		for _, served := range status.ApiVersions {
+			if version == served {
+				api.ApiVersion = version
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
 func (api Client) GetSession(id string) (Session, error) {
 	return api.GetSessionWithContext(context.Background(), id)
 }
 
 func (api Client) GetSessionWithContext(ctx context.Context, id string) (Session, error) {
-	response, err := api.get(ctx, fmt.Sprint("/v1/session", id))
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id))
 	if err != nil {
 		return Session{}, err
 	}
@@ -80,6 +165,58 @@ func (api Client) GetSessionWithContext(ctx context.Context, id string) (Session
 	return parseJsonResponse[Session](response)
 }
 
+func (api Client) GetSessionTrace(id string) (SessionTrace, error) {
+	return api.GetSessionTraceWithContext(context.Background(), id)
+}
+
+// Returns how the controller placed the session, see SessionTrace
+func (api Client) GetSessionTraceWithContext(ctx context.Context, id string) (SessionTrace, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id, "/trace"))
+	if err != nil {
+		return SessionTrace{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[SessionTrace](response)
+}
+
+func (api Client) AnalyzeSession(requirements SessionRequirements) (PlacementAnalysis, error) {
+	return api.AnalyzeSessionWithContext(context.Background(), requirements)
+}
+
+// Returns whether a session with the requirements would be placed and, if not, the smallest
+// changes that would place it, see PlacementAnalysis
+func (api Client) AnalyzeSessionWithContext(ctx context.Context, requirements SessionRequirements) (PlacementAnalysis, error) {
+	body, err := jsonReaderFromObject(requirements)
+	if err != nil {
+		return PlacementAnalysis{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/analyze/session", body)
+	if err != nil {
+		return PlacementAnalysis{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[PlacementAnalysis](response)
+}
+
+func (api Client) GetSessionAnalysis(id string) (PlacementAnalysis, error) {
+	return api.GetSessionAnalysisWithContext(context.Background(), id)
+}
+
+// Returns why the queued session is not placed and the smallest changes that would place it,
+// see PlacementAnalysis
+func (api Client) GetSessionAnalysisWithContext(ctx context.Context, id string) (PlacementAnalysis, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id, "/analysis"))
+	if err != nil {
+		return PlacementAnalysis{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[PlacementAnalysis](response)
+}
+
 func (api Client) UpdateSession(session Session) error {
 	return api.UpdateSessionWithContext(context.Background(), session)
 }
@@ -90,7 +227,7 @@ func (api Client) UpdateSessionWithContext(ctx context.Context, session Session)
 		return err
 	}
 
-	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/session", session.Id), body)
+	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/session/", session.Id), body)
 	if err != nil {
 		return err
 	}
@@ -118,12 +255,36 @@ func (api Client) RequestSessionWithContext(ctx context.Context, requirements Se
 	return parseStringResponse(response)
 }
 
-func (api Client) ReleaseSession(id string) error {
-	return api.ReleaseSessionWithContext(context.Background(), id)
+func (api Client) ReleaseSession(id string, release SessionRelease) error {
+	return api.ReleaseSessionWithContext(context.Background(), id, release)
 }
 
-func (api Client) ReleaseSessionWithContext(ctx context.Context, id string) error {
-	response, err := api.post(ctx, fmt.Sprint("/v1/release/session/", id))
+func (api Client) ReleaseSessionWithContext(ctx context.Context, id string, release SessionRelease) error {
+	body, err := jsonReaderFromObject(release)
+	if err != nil {
+		return err
+	}
+
+	response, err := api.postWithJson(ctx, fmt.Sprint("/v1/release/session/", id), body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
+func (api Client) UpdateSessionFrames(id string, frames FrameMetrics) error {
+	return api.UpdateSessionFramesWithContext(context.Background(), id, frames)
+}
+
+func (api Client) UpdateSessionFramesWithContext(ctx context.Context, id string, frames FrameMetrics) error {
+	body, err := jsonReaderFromObject(frames)
+	if err != nil {
+		return err
+	}
+
+	response, err := api.postWithJson(ctx, fmt.Sprint("/v1/session/", id, "/frames"), body)
 	if err != nil {
 		return err
 	}
@@ -132,12 +293,131 @@ func (api Client) ReleaseSessionWithContext(ctx context.Context, id string) erro
 	return validateResponse(response)
 }
 
+// Reads size bytes from the agent running the session, returning the bytes read. Clients time it
+// to measure their bandwidth to the agent.
+func (api Client) ProbeSession(id string, size int) (int64, error) {
+	return api.ProbeSessionWithContext(context.Background(), id, size)
+}
+
+func (api Client) ProbeSessionWithContext(ctx context.Context, id string, size int) (int64, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id, "/probe?size=", size))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return 0, validateResponse(response)
+	}
+
+	return io.Copy(io.Discard, response.Body)
+}
+
+func (api Client) NegotiateSessionStream(id string, negotiation StreamNegotiation) (StreamParameters, error) {
+	return api.NegotiateSessionStreamWithContext(context.Background(), id, negotiation)
+}
+
+// Agrees on how the client streams the session with the agent running it
+func (api Client) NegotiateSessionStreamWithContext(ctx context.Context, id string, negotiation StreamNegotiation) (StreamParameters, error) {
+	body, err := jsonReaderFromObject(negotiation)
+	if err != nil {
+		return StreamParameters{}, err
+	}
+
+	response, err := api.postWithJson(ctx, fmt.Sprint("/v1/session/", id, "/stream"), body)
+	if err != nil {
+		return StreamParameters{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[StreamParameters](response)
+}
+
+func (api Client) GetSessionFiles(id string) ([]SessionFile, error) {
+	return api.GetSessionFilesWithContext(context.Background(), id)
+}
+
+func (api Client) GetSessionFilesWithContext(ctx context.Context, id string) ([]SessionFile, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id, "/files"))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]SessionFile](response)
+}
+
+// Streams content to the file in the session's scratch directory, replacing any file with the name
+func (api Client) PutSessionFile(id string, name string, content io.Reader) (SessionFile, error) {
+	return api.PutSessionFileWithContext(context.Background(), id, name, content)
+}
+
+func (api Client) PutSessionFileWithContext(ctx context.Context, id string, name string, content io.Reader) (SessionFile, error) {
+	response, err := api.putWithOctetStream(ctx, fmt.Sprint("/v1/session/", id, "/files/", name), content)
+	if err != nil {
+		return SessionFile{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[SessionFile](response)
+}
+
+// Streams the file in the session's scratch directory to w, returning the number of bytes written
+func (api Client) GetSessionFile(id string, name string, w io.Writer) (int64, error) {
+	return api.GetSessionFileWithContext(context.Background(), id, name, w)
+}
+
+func (api Client) GetSessionFileWithContext(ctx context.Context, id string, name string, w io.Writer) (int64, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id, "/files/", name))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return 0, validateResponse(response)
+	}
+
+	return io.Copy(w, response.Body)
+}
+
 func (api Client) GetAgent(id string) (Agent, error) {
 	return api.GetAgentWithContext(context.Background(), id)
 }
 
 func (api Client) GetAgentWithContext(ctx context.Context, id string) (Agent, error) {
+	agent, _, err := api.GetAgentWithReconcileWithContext(ctx, id)
+	return agent, err
+}
+
+func (api Client) GetAgentWithReconcile(id string) (Agent, bool, error) {
+	return api.GetAgentWithReconcileWithContext(context.Background(), id)
+}
+
+// Returns the agent and whether the controller asks the agent to report the sessions it runs,
+// see ReconcileAgent
+func (api Client) GetAgentWithReconcileWithContext(ctx context.Context, id string) (Agent, bool, error) {
 	response, err := api.get(ctx, fmt.Sprint("/v1/agent/", id))
+	if err != nil {
+		return Agent{}, false, err
+	}
+	defer response.Body.Close()
+
+	agent, err := parseJsonResponse[Agent](response)
+	if err != nil {
+		return Agent{}, false, err
+	}
+
+	return agent, response.Header.Get(ReconcileRequestedHeader) != "", nil
+}
+
+func (api Client) DrainAgent(id string) (Agent, error) {
+	return api.DrainAgentWithContext(context.Background(), id)
+}
+
+// Stops the controller placing new sessions on the agent while the sessions it runs finish
+func (api Client) DrainAgentWithContext(ctx context.Context, id string) (Agent, error) {
+	response, err := api.put(ctx, fmt.Sprint("/v1/agent/", id, "/drain"))
 	if err != nil {
 		return Agent{}, err
 	}
@@ -146,40 +426,822 @@ func (api Client) GetAgentWithContext(ctx context.Context, id string) (Agent, er
 	return parseJsonResponse[Agent](response)
 }
 
-func (api Client) UpdateAgent(update AgentUpdate) error {
-	return api.UpdateAgentWithContext(context.Background(), update)
+func (api Client) ResumeAgent(id string) (Agent, error) {
+	return api.ResumeAgentWithContext(context.Background(), id)
 }
 
-func (api Client) UpdateAgentWithContext(ctx context.Context, update AgentUpdate) error {
-	body, err := jsonReaderFromObject(update)
+// Places new sessions on the draining agent again
+func (api Client) ResumeAgentWithContext(ctx context.Context, id string) (Agent, error) {
+	response, err := api.delete(ctx, fmt.Sprint("/v1/agent/", id, "/drain"))
 	if err != nil {
-		return err
+		return Agent{}, err
 	}
+	defer response.Body.Close()
 
-	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/agent/", update.Id), body)
+	return parseJsonResponse[Agent](response)
+}
+
+func (api Client) PatchAgentLabels(id string, patch AgentLabelsPatch) (Agent, error) {
+	return api.PatchAgentLabelsWithContext(context.Background(), id, patch)
+}
+
+// Changes the labels and taints of the live agent, the controller places sessions by them from
+// its next scheduling pass
+func (api Client) PatchAgentLabelsWithContext(ctx context.Context, id string, patch AgentLabelsPatch) (Agent, error) {
+	body, err := jsonReaderFromObject(patch)
 	if err != nil {
-		return err
+		return Agent{}, err
+	}
+
+	response, err := api.patchWithJson(ctx, fmt.Sprint("/v1/agent/", id, "/labels"), body)
+	if err != nil {
+		return Agent{}, err
 	}
 	defer response.Body.Close()
 
-	return validateResponse(response)
+	return parseJsonResponse[Agent](response)
 }
 
-func (api Client) RegisterAgent(agent Agent) (string, error) {
-	return api.RegisterAgentWithContext(context.Background(), agent)
+// Returns the agents registered with the controller
+func (api Client) GetAgents() ([]Agent, error) {
+	return api.GetAgentsWithContext(context.Background())
 }
 
-func (api Client) RegisterAgentWithContext(ctx context.Context, agent Agent) (string, error) {
-	body, err := jsonReaderFromObject(agent)
+func (api Client) GetAgentsWithContext(ctx context.Context) ([]Agent, error) {
+	response, err := api.get(ctx, "/v1/agents")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer response.Body.Close()
 
-	response, err := api.postWithJson(ctx, "/v1/register/agent", body)
+	return parseJsonResponse[[]Agent](response)
+}
+
+// Returns a page of the agents matching the query
+func (api Client) QueryAgents(query ListQuery) (ListPage[Agent], error) {
+	return api.QueryAgentsWithContext(context.Background(), query)
+}
+
+func (api Client) QueryAgentsWithContext(ctx context.Context, query ListQuery) (ListPage[Agent], error) {
+	return queryList[Agent](ctx, api, "/v1/agents", query)
+}
+
+// Returns the sessions placed on agents
+func (api Client) GetSessions() ([]PlacedSession, error) {
+	return api.GetSessionsWithContext(context.Background())
+}
+
+func (api Client) GetSessionsWithContext(ctx context.Context) ([]PlacedSession, error) {
+	response, err := api.get(ctx, "/v1/sessions")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer response.Body.Close()
 
-	return parseStringResponse(response)
+	return parseJsonResponse[[]PlacedSession](response)
+}
+
+// Returns a page of the sessions placed on agents matching the query
+func (api Client) QuerySessions(query ListQuery) (ListPage[PlacedSession], error) {
+	return api.QuerySessionsWithContext(context.Background(), query)
+}
+
+func (api Client) QuerySessionsWithContext(ctx context.Context, query ListQuery) (ListPage[PlacedSession], error) {
+	return queryList[PlacedSession](ctx, api, "/v1/sessions", query)
+}
+
+func queryList[T any](ctx context.Context, api Client, path string, query ListQuery) (ListPage[T], error) {
+	if encoded := query.Encode(); encoded != "" {
+		path = fmt.Sprint(path, "?", encoded)
+	}
+
+	response, err := api.get(ctx, path)
+	if err != nil {
+		return ListPage[T]{}, err
+	}
+	defer response.Body.Close()
+
+	items, err := parseJsonResponse[[]T](response)
+	if err != nil {
+		return ListPage[T]{}, err
+	}
+
+	// Controllers without pagination return every item
+	page := ListPage[T]{
+		Items:      items,
+		Total:      len(items),
+		NextCursor: response.Header.Get(NextCursorHeader),
+	}
+
+	if header := response.Header.Get(TotalCountHeader); header != "" {
+		page.Total, err = strconv.Atoi(header)
+		if err != nil {
+			return ListPage[T]{}, fmt.Errorf("invalid %s header, %v", TotalCountHeader, err)
+		}
+	}
+
+	return page, nil
+}
+
+// Returns the queued sessions in the order they are placed
+func (api Client) GetQueue() ([]QueuedSession, error) {
+	return api.GetQueueWithContext(context.Background())
+}
+
+func (api Client) GetQueueWithContext(ctx context.Context) ([]QueuedSession, error) {
+	response, err := api.get(ctx, "/v1/queue")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]QueuedSession](response)
+}
+
+func (api Client) CancelSession(id string) (Session, error) {
+	return api.CancelSessionWithContext(context.Background(), id)
+}
+
+// Closes the session when queued, otherwise has its agent cancel it even when persistent,
+// returning the session
+func (api Client) CancelSessionWithContext(ctx context.Context, id string) (Session, error) {
+	response, err := api.post(ctx, fmt.Sprint("/v1/cancel/session/", id))
+	if err != nil {
+		return Session{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[Session](response)
+}
+
+// Cancels a session requested by the client's user, such as one requested with the wrong
+// requirements, returning the session. See CancelSession for how it is canceled.
+func (api Client) DeleteSession(id string) (Session, error) {
+	return api.DeleteSessionWithContext(context.Background(), id)
+}
+
+func (api Client) DeleteSessionWithContext(ctx context.Context, id string) (Session, error) {
+	response, err := api.delete(ctx, fmt.Sprint("/v1/session/", id))
+	if err != nil {
+		return Session{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[Session](response)
+}
+
+// Returns the configuration resources of the kind ordered by name, see ConfigKinds
+func (api Client) GetConfigResources(kind string) ([]ConfigResource, error) {
+	return api.GetConfigResourcesWithContext(context.Background(), kind)
+}
+
+func (api Client) GetConfigResourcesWithContext(ctx context.Context, kind string) ([]ConfigResource, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/config/", kind))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]ConfigResource](response)
+}
+
+// Creates or replaces the configuration resource, returning it as stored
+func (api Client) PutConfigResource(resource ConfigResource) (ConfigResource, error) {
+	return api.PutConfigResourceWithContext(context.Background(), resource)
+}
+
+func (api Client) PutConfigResourceWithContext(ctx context.Context, resource ConfigResource) (ConfigResource, error) {
+	body, err := jsonReaderFromObject(resource)
+	if err != nil {
+		return ConfigResource{}, err
+	}
+
+	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/config/", resource.Kind, "/", url.PathEscape(resource.Name)), body)
+	if err != nil {
+		return ConfigResource{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[ConfigResource](response)
+}
+
+func (api Client) DeleteConfigResource(kind string, name string) error {
+	return api.DeleteConfigResourceWithContext(context.Background(), kind, name)
+}
+
+func (api Client) DeleteConfigResourceWithContext(ctx context.Context, kind string, name string) error {
+	response, err := api.delete(ctx, fmt.Sprint("/v1/config/", kind, "/", url.PathEscape(name)))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
+// Returns the credentials revoked
+func (api Client) GetRevocations() ([]Revocation, error) {
+	return api.GetRevocationsWithContext(context.Background())
+}
+
+func (api Client) GetRevocationsWithContext(ctx context.Context) ([]Revocation, error) {
+	response, err := api.get(ctx, "/v1/revocations")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]Revocation](response)
+}
+
+func (api Client) RevokeCredential(revocation Revocation) (RevocationResult, error) {
+	return api.RevokeCredentialWithContext(context.Background(), revocation)
+}
+
+// Rejects the requests presenting the credential and cancels its sessions
+func (api Client) RevokeCredentialWithContext(ctx context.Context, revocation Revocation) (RevocationResult, error) {
+	body, err := jsonReaderFromObject(revocation)
+	if err != nil {
+		return RevocationResult{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/revocations", body)
+	if err != nil {
+		return RevocationResult{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[RevocationResult](response)
+}
+
+func (api Client) RemoveRevocation(kind string, subject string) error {
+	return api.RemoveRevocationWithContext(context.Background(), kind, subject)
+}
+
+// Accepts the requests presenting the revoked credential again
+func (api Client) RemoveRevocationWithContext(ctx context.Context, kind string, subject string) error {
+	response, err := api.delete(ctx, fmt.Sprint("/v1/revocations/", kind, "/", url.PathEscape(subject)))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
+// Returns the tokens minted for clients, without the tokens themselves
+func (api Client) GetApiTokens() ([]ApiToken, error) {
+	return api.GetApiTokensWithContext(context.Background())
+}
+
+func (api Client) GetApiTokensWithContext(ctx context.Context) ([]ApiToken, error) {
+	response, err := api.get(ctx, "/v1/tokens")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]ApiToken](response)
+}
+
+func (api Client) MintApiToken(request ApiTokenRequest) (ApiToken, error) {
+	return api.MintApiTokenWithContext(context.Background(), request)
+}
+
+// Mints a token for clients, the token itself is only returned here
+func (api Client) MintApiTokenWithContext(ctx context.Context, request ApiTokenRequest) (ApiToken, error) {
+	body, err := jsonReaderFromObject(request)
+	if err != nil {
+		return ApiToken{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/tokens", body)
+	if err != nil {
+		return ApiToken{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[ApiToken](response)
+}
+
+func (api Client) DeleteApiToken(id string) error {
+	return api.DeleteApiTokenWithContext(context.Background(), id)
+}
+
+// Rejects the requests presenting the token from now on
+func (api Client) DeleteApiTokenWithContext(ctx context.Context, id string) error {
+	response, err := api.delete(ctx, fmt.Sprint("/v1/tokens/", id))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
+func (api Client) ReconcileAgent(id string, reconciliation AgentReconciliation) (AgentReconciliationResult, error) {
+	return api.ReconcileAgentWithContext(context.Background(), id, reconciliation)
+}
+
+func (api Client) ReconcileAgentWithContext(ctx context.Context, id string, reconciliation AgentReconciliation) (AgentReconciliationResult, error) {
+	body, err := jsonReaderFromObject(reconciliation)
+	if err != nil {
+		return AgentReconciliationResult{}, err
+	}
+
+	response, err := api.postWithJson(ctx, fmt.Sprint("/v1/reconcile/agent/", id), body)
+	if err != nil {
+		return AgentReconciliationResult{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[AgentReconciliationResult](response)
+}
+
+func (api Client) UpdateAgent(update AgentUpdate) error {
+	return api.UpdateAgentWithContext(context.Background(), update)
+}
+
+func (api Client) UpdateAgentWithContext(ctx context.Context, update AgentUpdate) error {
+	body, err := jsonReaderFromObject(update)
+	if err != nil {
+		return err
+	}
+
+	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/agent/", update.Id), body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return validateResponse(response)
+}
+
+func (api Client) RegisterAgent(agent Agent) (string, error) {
+	return api.RegisterAgentWithContext(context.Background(), agent)
+}
+
+func (api Client) RegisterAgentWithContext(ctx context.Context, agent Agent) (string, error) {
+	id, _, err := api.RegisterAgentWithScheduleWithContext(ctx, agent)
+	return id, err
+}
+
+func (api Client) RegisterAgentWithSchedule(agent Agent) (string, HeartbeatSchedule, error) {
+	return api.RegisterAgentWithScheduleWithContext(context.Background(), agent)
+}
+
+// Registers the agent, returning its id and the schedule of its updates. The schedule is
+// zero when the controller does not assign one.
+func (api Client) RegisterAgentWithScheduleWithContext(ctx context.Context, agent Agent) (string, HeartbeatSchedule, error) {
+	body, err := jsonReaderFromObject(agent)
+	if err != nil {
+		return "", HeartbeatSchedule{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/register/agent", body)
+	if err != nil {
+		return "", HeartbeatSchedule{}, err
+	}
+	defer response.Body.Close()
+
+	id, err := parseStringResponse(response)
+	if err != nil {
+		return "", HeartbeatSchedule{}, err
+	}
+
+	return id, parseHeartbeatSchedule(response.Header), nil
+}
+
+func (api Client) GetCaCertificate() (string, error) {
+	return api.GetCaCertificateWithContext(context.Background())
+}
+
+func (api Client) GetCaCertificateWithContext(ctx context.Context) (string, error) {
+	response, err := api.get(ctx, "/v1/certificate/ca")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	return parseStringResponse(response)
+}
+
+func (api Client) RequestAgentCertificate(request CertificateRequest) (Certificate, error) {
+	return api.RequestAgentCertificateWithContext(context.Background(), request)
+}
+
+func (api Client) RequestAgentCertificateWithContext(ctx context.Context, request CertificateRequest) (Certificate, error) {
+	body, err := jsonReaderFromObject(request)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/certificate/agent", body)
+	if err != nil {
+		return Certificate{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[Certificate](response)
+}
+
+func (api Client) RequestClientCertificate(request CertificateRequest) (Certificate, error) {
+	return api.RequestClientCertificateWithContext(context.Background(), request)
+}
+
+func (api Client) RequestClientCertificateWithContext(ctx context.Context, request CertificateRequest) (Certificate, error) {
+	body, err := jsonReaderFromObject(request)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/certificate/client", body)
+	if err != nil {
+		return Certificate{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[Certificate](response)
+}
+
+func (api Client) GetSlos() ([]SloStatus, error) {
+	return api.GetSlosWithContext(context.Background())
+}
+
+func (api Client) GetSlosWithContext(ctx context.Context) ([]SloStatus, error) {
+	response, err := api.get(ctx, "/v1/slos")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]SloStatus](response)
+}
+
+// Returns the usage of closed sessions aggregated by month and tenant
+func (api Client) GetUsageAggregates() ([]UsageAggregate, error) {
+	return api.GetUsageAggregatesWithContext(context.Background())
+}
+
+func (api Client) GetUsageAggregatesWithContext(ctx context.Context) ([]UsageAggregate, error) {
+	response, err := api.get(ctx, "/v1/usage")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]UsageAggregate](response)
+}
+
+func (api Client) GetPoolScheduling() ([]PoolScheduling, error) {
+	return api.GetPoolSchedulingWithContext(context.Background())
+}
+
+func (api Client) GetPoolSchedulingWithContext(ctx context.Context) ([]PoolScheduling, error) {
+	response, err := api.get(ctx, "/v1/scheduling/pools")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]PoolScheduling](response)
+}
+
+// Pauses or resumes scheduling the pool's queued sessions
+func (api Client) UpdatePoolScheduling(pool string, update PoolSchedulingUpdate) (PoolScheduling, error) {
+	return api.UpdatePoolSchedulingWithContext(context.Background(), pool, update)
+}
+
+func (api Client) UpdatePoolSchedulingWithContext(ctx context.Context, pool string, update PoolSchedulingUpdate) (PoolScheduling, error) {
+	body, err := jsonReaderFromObject(update)
+	if err != nil {
+		return PoolScheduling{}, err
+	}
+
+	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/scheduling/pool/", pool), body)
+	if err != nil {
+		return PoolScheduling{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[PoolScheduling](response)
+}
+
+func (api Client) GetFeatures() ([]Feature, error) {
+	return api.GetFeaturesWithContext(context.Background())
+}
+
+func (api Client) GetFeaturesWithContext(ctx context.Context) ([]Feature, error) {
+	response, err := api.get(ctx, "/v1/features")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]Feature](response)
+}
+
+func (api Client) UpdateFeature(name string, update FeatureUpdate) (Feature, error) {
+	return api.UpdateFeatureWithContext(context.Background(), name, update)
+}
+
+func (api Client) UpdateFeatureWithContext(ctx context.Context, name string, update FeatureUpdate) (Feature, error) {
+	body, err := jsonReaderFromObject(update)
+	if err != nil {
+		return Feature{}, err
+	}
+
+	response, err := api.putWithJson(ctx, fmt.Sprint("/v1/feature/", name), body)
+	if err != nil {
+		return Feature{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[Feature](response)
+}
+
+func (api Client) ImportAgents(agents []ExpectedAgent) (ImportStatus, error) {
+	return api.ImportAgentsWithContext(context.Background(), agents)
+}
+
+func (api Client) ImportAgentsWithContext(ctx context.Context, agents []ExpectedAgent) (ImportStatus, error) {
+	body, err := jsonReaderFromObject(agents)
+	if err != nil {
+		return ImportStatus{}, err
+	}
+
+	response, err := api.postWithJson(ctx, "/v1/import/agents", body)
+	if err != nil {
+		return ImportStatus{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[ImportStatus](response)
+}
+
+func (api Client) GetImport(id string) (ImportStatus, error) {
+	return api.GetImportWithContext(context.Background(), id)
+}
+
+func (api Client) GetImportWithContext(ctx context.Context, id string) (ImportStatus, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/import/agents/", id))
+	if err != nil {
+		return ImportStatus{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[ImportStatus](response)
+}
+
+func (api Client) GetFleetHealth() (FleetHealth, error) {
+	return api.GetFleetHealthWithContext(context.Background())
+}
+
+func (api Client) GetFleetHealthWithContext(ctx context.Context) (FleetHealth, error) {
+	response, err := api.get(ctx, "/v1/fleet/health")
+	if err != nil {
+		return FleetHealth{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[FleetHealth](response)
+}
+
+func (api Client) GetCapacity() ([]PoolCapacity, error) {
+	return api.GetCapacityWithContext(context.Background())
+}
+
+// Returns the capacity of each pool ordered by name
+func (api Client) GetCapacityWithContext(ctx context.Context) ([]PoolCapacity, error) {
+	response, err := api.get(ctx, "/v1/capacity")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]PoolCapacity](response)
+}
+
+func (api Client) GetLeader() (Lease, error) {
+	return api.GetLeaderWithContext(context.Background())
+}
+
+// Returns the scheduler lease of the controller replica running the scheduling loop, see
+// SchedulerLease
+func (api Client) GetLeaderWithContext(ctx context.Context) (Lease, error) {
+	response, err := api.get(ctx, "/v1/leader")
+	if err != nil {
+		return Lease{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[Lease](response)
+}
+
+// Returns up to limit events published after the sequence since, 0 for the oldest retained.
+// Consumers pass EventReplay.Next as since to continue after the events returned.
+func (api Client) GetEventsSince(since uint64, limit int) (EventReplay, error) {
+	return api.GetEventsSinceWithContext(context.Background(), since, limit)
+}
+
+func (api Client) GetEventsSinceWithContext(ctx context.Context, since uint64, limit int) (EventReplay, error) {
+	response, err := api.get(ctx, fmt.Sprintf("/v1/events?since=%d&limit=%d", since, limit))
+	if err != nil {
+		return EventReplay{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[EventReplay](response)
+}
+
+// Returns up to limit journal entries recorded after the sequence since, waiting up to wait for
+// the first when there are none yet. Consumers pass JournalReplay.Next as since to continue after
+// the entries returned.
+func (api Client) GetJournalSince(since uint64, limit int, wait time.Duration) (JournalReplay, error) {
+	return api.GetJournalSinceWithContext(context.Background(), since, limit, wait)
+}
+
+func (api Client) GetJournalSinceWithContext(ctx context.Context, since uint64, limit int, wait time.Duration) (JournalReplay, error) {
+	response, err := api.get(ctx, fmt.Sprintf("/v1/journal?since=%d&limit=%d&wait=%s", since, limit, wait))
+	if err != nil {
+		return JournalReplay{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[JournalReplay](response)
+}
+
+// Streams the state changes of sessions and agents chosen by the subscription to handler until
+// ctx is done, handler returns an error, or the controller closes the stream
+func (api Client) StreamEventsWithContext(ctx context.Context, subscription EventSubscription, handler func(Event) error) error {
+	url := api.url("/v1/events")
+	url.Scheme = "ws"
+	if api.Scheme == "https" {
+		url.Scheme = "wss"
+	}
+
+	dialer := websocket.Dialer{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if transport, ok := api.Client.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+
+	header := http.Header{}
+	api.addHeaders(header)
+
+	conn, response, err := dialer.DialContext(ctx, url.String(), header)
+	if err != nil {
+		if response != nil {
+			defer response.Body.Close()
+			return errors.Join(err, validateResponse(response))
+		}
+
+		return err
+	}
+	defer conn.Close()
+
+	// Unblocks reading once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = conn.WriteJSON(subscription)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var event Event
+		err = conn.ReadJSON(&event)
+		if err != nil {
+			if ctx.Err() != nil || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		err = handler(event)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Runs the command in the session's environment on its agent, streaming its combined output to
+// w. Returns the command's exit code, -1 when it was killed.
+func (api Client) ExecSession(id string, exec SessionExec, w io.Writer) (int, error) {
+	return api.ExecSessionWithContext(context.Background(), id, exec, w)
+}
+
+func (api Client) ExecSessionWithContext(ctx context.Context, id string, exec SessionExec, w io.Writer) (int, error) {
+	body, err := jsonReaderFromObject(exec)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := api.postWithJson(ctx, fmt.Sprint("/v1/session/", id, "/exec"), body)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return 0, validateResponse(response)
+	}
+
+	_, err = io.Copy(w, response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	// Trailers are only available once the body has been read
+	exitCode, err := strconv.Atoi(response.Trailer.Get(ExecExitCodeTrailer))
+	if err != nil {
+		return 0, fmt.Errorf("%s exited without reporting its exit code, its output may be incomplete", exec.Command)
+	}
+
+	return exitCode, nil
+}
+
+// Streams the recording of the session to w, returning the number of bytes written. Controllers
+// return the recording decrypted, one RecordingChunk per line of JSON, agents return it encrypted.
+func (api Client) GetSessionRecording(id string, w io.Writer) (int64, error) {
+	return api.GetSessionRecordingWithContext(context.Background(), id, w)
+}
+
+func (api Client) GetSessionRecordingWithContext(ctx context.Context, id string, w io.Writer) (int64, error) {
+	response, err := api.get(ctx, fmt.Sprint("/v1/session/", id, "/recording"))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return 0, validateResponse(response)
+	}
+
+	return io.Copy(w, response.Body)
+}
+
+// Returns a new key for the agent to encrypt the recording of the session assigned to it with
+func (api Client) RequestSessionRecordingKey(agentId string, sessionId string) (RecordingKey, error) {
+	return api.RequestSessionRecordingKeyWithContext(context.Background(), agentId, sessionId)
+}
+
+func (api Client) RequestSessionRecordingKeyWithContext(ctx context.Context, agentId string, sessionId string) (RecordingKey, error) {
+	response, err := api.post(ctx, fmt.Sprint("/v1/agent/", agentId, "/session/", sessionId, "/recording-key"))
+	if err != nil {
+		return RecordingKey{}, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[RecordingKey](response)
+}
+
+func (api Client) GetEventSchemas() ([]EventSchema, error) {
+	return api.GetEventSchemasWithContext(context.Background())
+}
+
+func (api Client) GetEventSchemasWithContext(ctx context.Context) ([]EventSchema, error) {
+	response, err := api.get(ctx, "/v1/events/schemas")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	return parseJsonResponse[[]EventSchema](response)
+}
+
+// Streams the named runtime profile of the server to w, such as profile for CPU, heap, or
+// goroutine, returning the number of bytes written. The CPU profile and trace are captured over
+// seconds, other profiles are the differences over seconds when it is not 0
+func (api Client) CaptureProfile(name string, seconds int, w io.Writer) (int64, error) {
+	return api.CaptureProfileWithContext(context.Background(), name, seconds, w)
+}
+
+func (api Client) CaptureProfileWithContext(ctx context.Context, name string, seconds int, w io.Writer) (int64, error) {
+	path := fmt.Sprint("/debug/pprof/", name)
+	if seconds > 0 {
+		path = fmt.Sprint(path, "?seconds=", seconds)
+	}
+
+	response, err := api.get(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return 0, validateResponse(response)
+	}
+
+	return io.Copy(w, response.Body)
 }
@@ -0,0 +1,191 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Kinds of the configuration resources the controller stores and applies, managed through
+// /v1/config/{kind} such as by juicectl apply
+const (
+	// Named by the tenant, see TenantQuota
+	ConfigQuota = "quota"
+	// See RoleBinding
+	ConfigRoleBinding = "roleBinding"
+	// See WebhookSubscription
+	ConfigWebhook = "webhook"
+	// Named by SessionRequirements.Template, see SessionTemplate
+	ConfigTemplate = "template"
+	// See MaintenanceWindow
+	ConfigMaintenanceWindow = "maintenanceWindow"
+)
+
+// Returns the value the spec of each kind of configuration resource is decoded into
+var ConfigKinds = map[string]func() any{
+	ConfigQuota:             func() any { return &TenantQuota{} },
+	ConfigRoleBinding:       func() any { return &RoleBinding{} },
+	ConfigWebhook:           func() any { return &WebhookSubscription{} },
+	ConfigTemplate:          func() any { return &SessionTemplate{} },
+	ConfigMaintenanceWindow: func() any { return &MaintenanceWindow{} },
+}
+
+// A configuration resource stored by the controller and shared by the controllers sharing its
+// storage, applied over the configuration of their files and flags
+type ConfigResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// The spec of the kind, see ConfigKinds
+	Spec json.RawMessage `json:"spec"`
+
+	// Set by the controller
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// The GPUs of the tenant named by the quota resource, replacing its quota in the controller's
+// --tenant-quota-file, see SessionRequirements.Tenant
+type TenantQuota struct {
+	// GPUs the tenant's sessions are entitled to, its sessions within them are never reclaimed
+	GuaranteedGpus int `json:"guaranteedGpus" yaml:"guaranteedGpus"`
+	// GPUs the tenant's sessions may use in total while capacity is idle, GuaranteedGpus when not set
+	BurstGpus int `json:"burstGpus,omitempty" yaml:"burstGpus,omitempty"`
+}
+
+// Grants roles to users, in addition to those granted by the tokens of the controller's
+// authorization policy. Users are named by the token they present or the common name of their
+// certificate. Only applies when the policy restricts the endpoints by role.
+type RoleBinding struct {
+	Users []string `json:"users" yaml:"users"`
+	Roles []string `json:"roles" yaml:"roles"`
+}
+
+// Posts webhooks to a URL, in addition to the controller's --webhook-urls
+type WebhookSubscription struct {
+	Url string `json:"url" yaml:"url"`
+	// The webhooks posted, from WebhookTypes, every type when empty
+	Events []string `json:"events,omitempty" yaml:"events,omitempty"`
+
+	// Signs the webhooks posted to the URL, see WebhookSignatureHeader. Never returned by the
+	// controller, which returns SecretSha256 instead.
+	Secret string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	// Identifies the secret without disclosing it, see SecretSha256Of
+	SecretSha256 string `json:"secretSha256,omitempty" yaml:"secretSha256,omitempty"`
+}
+
+// Requirements shared by the sessions requested with SessionRequirements.Template naming the
+// template resource. The requirements a request sets are kept, the labels and tolerations it
+// sets are added to the template's.
+type SessionTemplate struct {
+	Gpus []GpuRequirements `json:"gpus,omitempty" yaml:"gpus,omitempty"`
+
+	MatchLabels map[string]string `json:"matchLabels,omitempty" yaml:"matchLabels,omitempty"`
+	Tolerates   map[string]string `json:"tolerates,omitempty" yaml:"tolerates,omitempty"`
+
+	AllowCpuFallback    bool     `json:"allowCpuFallback,omitempty" yaml:"allowCpuFallback,omitempty"`
+	Tenant              string   `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+	Priority            int      `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Class               string   `json:"class,omitempty" yaml:"class,omitempty"`
+	IdleTimeoutSeconds  int      `json:"idleTimeoutSeconds,omitempty" yaml:"idleTimeoutSeconds,omitempty"`
+	Placement           string   `json:"placement,omitempty" yaml:"placement,omitempty"`
+	RequireCapabilities []string `json:"requireCapabilities,omitempty" yaml:"requireCapabilities,omitempty"`
+}
+
+// Sets the requirements the request leaves unset from the template
+func (template SessionTemplate) Apply(requirements *SessionRequirements) {
+	if len(requirements.Gpus) == 0 {
+		requirements.Gpus = append([]GpuRequirements{}, template.Gpus...)
+	}
+
+	requirements.MatchLabels = mergeKeyValues(template.MatchLabels, requirements.MatchLabels)
+	requirements.Tolerates = mergeKeyValues(template.Tolerates, requirements.Tolerates)
+
+	requirements.AllowCpuFallback = requirements.AllowCpuFallback || template.AllowCpuFallback
+
+	if requirements.Tenant == "" {
+		requirements.Tenant = template.Tenant
+	}
+	if requirements.Priority == 0 {
+		requirements.Priority = template.Priority
+	}
+	if requirements.Class == "" {
+		requirements.Class = template.Class
+	}
+	if requirements.IdleTimeoutSeconds == 0 {
+		requirements.IdleTimeoutSeconds = template.IdleTimeoutSeconds
+	}
+	if requirements.Placement == "" {
+		requirements.Placement = template.Placement
+	}
+	if len(requirements.RequireCapabilities) == 0 {
+		requirements.RequireCapabilities = append([]string{}, template.RequireCapabilities...)
+	}
+}
+
+// Returns the values of the template with those of the request replacing them, nil when neither
+// has any
+func mergeKeyValues(template map[string]string, request map[string]string) map[string]string {
+	if len(template) == 0 {
+		return request
+	}
+
+	merged := map[string]string{}
+	for key, value := range template {
+		merged[key] = value
+	}
+	for key, value := range request {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// A window during which the controller assigns no sessions to the agents it selects, those
+// already running are left to finish. Agents are selected by hostname or by their labels,
+// an agent matching either is selected.
+type MaintenanceWindow struct {
+	Hostnames   []string          `json:"hostnames,omitempty" yaml:"hostnames,omitempty"`
+	MatchLabels map[string]string `json:"matchLabels,omitempty" yaml:"matchLabels,omitempty"`
+
+	Start time.Time `json:"start" yaml:"start"`
+	End   time.Time `json:"end" yaml:"end"`
+}
+
+// Returns whether the window is open at the time
+func (window MaintenanceWindow) Open(now time.Time) bool {
+	return !now.Before(window.Start) && now.Before(window.End)
+}
+
+// Returns whether the window selects the agent
+func (window MaintenanceWindow) Selects(agent Agent) bool {
+	for _, hostname := range window.Hostnames {
+		if hostname == agent.Hostname {
+			return true
+		}
+	}
+
+	if len(window.MatchLabels) == 0 {
+		return false
+	}
+
+	for key, value := range window.MatchLabels {
+		if agent.Labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the hex SHA-256 of the secret, empty for an empty secret
+func SecretSha256Of(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,528 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Fields of Event identifying what an event is about
+const (
+	EventSubjectAgent   = "agentId"
+	EventSubjectSession = "sessionId"
+	EventSubjectPool    = "pool"
+)
+
+// Describes the events of a type. Version is incremented by changes that could break consumers,
+// such as removing, renaming, or changing the meaning of a field. Data keys may be added to a
+// version, consumers ignore keys they do not know.
+type EventType struct {
+	Type        string
+	Version     int
+	Description string
+
+	// Fields of Event set on every event of the type, see EventSubject*
+	Subjects []string
+
+	// Keys of Event.Data set on every event of the type and what they hold
+	Data map[string]string
+}
+
+var EventTypes = []EventType{
+	{
+		Type:        EventSloBudgetExceeded,
+		Version:     1,
+		Description: "A pool's error budget for a service level indicator is being spent faster than the objective allows",
+		Subjects:    []string{EventSubjectPool},
+		Data: map[string]string{
+			"indicator": "The service level indicator, see Slo*",
+			"burnRate":  "Rate the error budget is spent at, 1 spends it exactly over the objective's window",
+		},
+	},
+	{
+		Type:        EventSloBudgetRecovered,
+		Version:     1,
+		Description: "A pool's error budget is no longer exceeded",
+		Subjects:    []string{EventSubjectPool},
+		Data: map[string]string{
+			"indicator": "The service level indicator, see Slo*",
+			"burnRate":  "Rate the error budget is spent at, 1 spends it exactly over the objective's window",
+		},
+	},
+	{
+		Type:        EventSessionHookFailed,
+		Version:     1,
+		Description: "A hook the agent runs around a session failed",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"hook":   "Name of the hook",
+			"output": "End of the output of the hook",
+		},
+	},
+	{
+		Type:        EventSessionStaleKilled,
+		Version:     1,
+		Description: "The agent killed a session the controller no longer knew about",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"missingFor": "How long the controller did not know about the session",
+		},
+	},
+	{
+		Type:        EventSessionStaleAdopted,
+		Version:     1,
+		Description: "The agent kept a session the controller no longer knew about running",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"missingFor": "How long the controller did not know about the session",
+		},
+	},
+	{
+		Type:        EventAgentReregistered,
+		Version:     1,
+		Description: "An agent registered again with a controller that no longer knew about it",
+		Subjects:    []string{EventSubjectAgent},
+	},
+	{
+		Type:        EventAgentReconciled,
+		Version:     1,
+		Description: "The controller corrected its records of an agent to the sessions the agent reported running",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"adopted":   "Number of sessions running on the agent the controller did not place on it",
+			"corrected": "Number of sessions the controller recorded in another state",
+			"closed":    "Number of sessions the controller recorded as running that the agent no longer runs",
+		},
+	},
+	{
+		Type:        EventAgentReconnected,
+		Version:     1,
+		Description: "An agent reached its controller again after losing it, the sessions it ran kept running",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"attempts":        "Number of attempts to reach the controller",
+			"disconnectedFor": "How long the agent could not reach the controller",
+		},
+	},
+	{
+		Type:        EventAgentMissing,
+		Version:     1,
+		Description: "An agent stopped updating the controller",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"hostname": "Hostname of the agent",
+		},
+	},
+	{
+		Type:        EventQueueSaturated,
+		Version:     1,
+		Description: "The sessions waiting for capacity reached the controller's queue saturation threshold",
+		Data: map[string]string{
+			"queued": "Number of sessions waiting for capacity",
+		},
+	},
+	{
+		Type:        EventQueueRecovered,
+		Version:     1,
+		Description: "The sessions waiting for capacity fell below the controller's queue saturation threshold",
+		Data: map[string]string{
+			"queued": "Number of sessions waiting for capacity",
+		},
+	},
+	{
+		Type:        EventPoolCapacityExhausted,
+		Version:     1,
+		Description: "A pool has no VRAM available for its queued sessions",
+		Subjects:    []string{EventSubjectPool},
+		Data: map[string]string{
+			"queued": "Number of the pool's sessions waiting for capacity",
+		},
+	},
+	{
+		Type:        EventPoolCapacityRecovered,
+		Version:     1,
+		Description: "A pool has VRAM available again",
+		Subjects:    []string{EventSubjectPool},
+	},
+	{
+		Type:        EventCertificateExpiring,
+		Version:     1,
+		Description: "A certificate used by the controller expires soon",
+		Data: map[string]string{
+			"certificate": "Name of the certificate",
+			"notAfter":    "When the certificate expires, RFC 3339",
+		},
+	},
+	{
+		Type:        EventSessionExec,
+		Version:     1,
+		Description: "A user ran a diagnostic command in a session",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"command": "The command and its arguments",
+			"user":    "The user the controller's authorization policy identified, empty without one",
+		},
+	},
+	{
+		Type:        EventGpuVramLeaked,
+		Version:     1,
+		Description: "VRAM remained in use on a GPU after a session on it closed, the agent places no sessions on the GPU until it is released",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"gpu":        "Index of the GPU on the agent",
+			"pciBus":     "PCI bus of the GPU",
+			"vramLeaked": "Bytes of VRAM leaked",
+			"processes":  "The processes holding the VRAM as pid:name:bytes, separated by commas",
+			"reset":      "Outcome of resetting the GPU, empty when it was not reset",
+		},
+	},
+	{
+		Type:        EventGpuVramReleased,
+		Version:     1,
+		Description: "VRAM leaked on a GPU was released, the agent places sessions on the GPU again",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"gpu":    "Index of the GPU on the agent",
+			"pciBus": "PCI bus of the GPU",
+		},
+	},
+	{
+		Type:        EventSessionCallbackFailed,
+		Version:     1,
+		Description: "The controller gave up sending a closed session's callback",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"host":     "Host of the session's callback URL",
+			"attempts": "Number of attempts made",
+			"error":    "Error of the last attempt",
+		},
+	},
+	{
+		Type:        EventSessionStateChanged,
+		Version:     1,
+		Description: "A session was queued, assigned to an agent, became active, was canceled, or closed, agentId is set when the change was made by or for the agent running it",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"state":      "The session's new state, see Session*",
+			"exitStatus": "The session's exit status once closed, see ExitStatus*",
+		},
+	},
+	{
+		Type:        EventAgentStateChanged,
+		Version:     1,
+		Description: "An agent registered with the controller or closed",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"state": "The agent's new state, see Agent*",
+		},
+	},
+	{
+		Type:        EventAgentDraining,
+		Version:     1,
+		Description: "An operator stopped or resumed placing new sessions on an agent",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"hostname": "Hostname of the agent",
+			"draining": "true when no new sessions are placed on the agent, false when resumed",
+			"sessions": "Number of sessions the agent runs",
+		},
+	},
+	{
+		Type:        EventGpuUnhealthy,
+		Version:     1,
+		Description: "The agent's health checks found a GPU unhealthy, the agent places no sessions on the GPU until it recovers",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"gpu":    "Index of the GPU on the agent",
+			"pciBus": "PCI bus of the GPU",
+			"reason": "The problems found, separated by semicolons",
+		},
+	},
+	{
+		Type:        EventGpuRecovered,
+		Version:     1,
+		Description: "A GPU found unhealthy passed the agent's health checks again, the agent places sessions on the GPU again",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"gpu":    "Index of the GPU on the agent",
+			"pciBus": "PCI bus of the GPU",
+		},
+	},
+	{
+		Type:        EventAgentCordoned,
+		Version:     1,
+		Description: "The controller stopped placing sessions on an agent reporting unhealthy GPUs, the sessions it runs are left running",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"hostname": "Hostname of the agent",
+			"gpus":     "Indexes of the unhealthy GPUs, separated by commas",
+		},
+	},
+	{
+		Type:        EventAgentUncordoned,
+		Version:     1,
+		Description: "The GPUs of a cordoned agent recovered, or the agent left, and the controller places sessions on it again",
+		Subjects:    []string{EventSubjectAgent},
+	},
+	{
+		Type:        EventAgentDrained,
+		Version:     1,
+		Description: "The last session of a draining agent finished, the agent can be stopped without interrupting sessions",
+		Subjects:    []string{EventSubjectAgent},
+	},
+	{
+		Type:        EventSessionAssignmentDeclined,
+		Version:     1,
+		Description: "The agent chosen for a session did not confirm it could take the session, which was offered to the next candidate",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"reason": "Why the agent declined, or why it could not be asked",
+		},
+	},
+	{
+		Type:        EventSessionIdleReclaimed,
+		Version:     1,
+		Description: "An agent closed a session whose client was inactive for the session's idle timeout, returning its GPUs to the pool",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"idleSeconds":        "Seconds the client was inactive",
+			"idleTimeoutSeconds": "The session's idle timeout in seconds",
+		},
+	},
+	{
+		Type:        EventQuotaBorrowed,
+		Version:     1,
+		Description: "A session was placed beyond the GPUs guaranteed to its tenant by borrowing idle capacity, it is preemptible",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"tenant":         "The tenant of the session",
+			"gpus":           "GPUs the tenant's sessions use including the session",
+			"guaranteedGpus": "GPUs guaranteed to the tenant",
+			"burstGpus":      "GPUs the tenant's sessions may use by borrowing",
+		},
+	},
+	{
+		Type:        EventQuotaReclaimed,
+		Version:     1,
+		Description: "A preemptible session was canceled to return the GPUs it borrowed to a tenant within its guarantee",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"tenant":     "The tenant of the session canceled",
+			"forTenant":  "The tenant the GPUs were reclaimed for",
+			"forSession": "The queued session the GPUs were reclaimed for",
+		},
+	},
+	{
+		Type:        EventSessionPreempted,
+		Version:     1,
+		Description: "A session of a preemptible class was canceled to make room for a session of another class",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"class":      "The class of the session canceled",
+			"forClass":   "The class of the queued session the GPUs were freed for",
+			"forSession": "The queued session the GPUs were freed for",
+		},
+	},
+	{
+		Type:        EventSessionWaitExceeded,
+		Version:     1,
+		Description: "A queued session was not placed within the maximum wait of its class and was closed",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"class":   "The class of the session",
+			"waited":  "How long the session was queued",
+			"maxWait": "The maximum wait of the class",
+		},
+	},
+	{
+		Type:        EventAgentLabelsChanged,
+		Version:     1,
+		Description: "An operator changed the labels or taints of a live agent, the next scheduling pass places sessions by them",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"hostname": "Hostname of the agent",
+			"labels":   "The agent's labels after the change, as comma separated key=value pairs",
+			"taints":   "The agent's taints after the change, as comma separated key=value pairs",
+		},
+	},
+	{
+		Type:        EventCredentialRevoked,
+		Version:     1,
+		Description: "An operator revoked a token or the credentials of a user, its requests are rejected and its sessions canceled",
+		Data: map[string]string{
+			"kind":     "What was revoked, see Revocation*",
+			"subject":  "The name of the token or the user",
+			"reason":   "Why the credential was revoked, empty when not given",
+			"evicted":  "true when the sessions placed on agents were also canceled",
+			"canceled": "Number of sessions canceled",
+		},
+	},
+	{
+		Type:        EventCredentialRestored,
+		Version:     1,
+		Description: "An operator removed the revocation of a token or the credentials of a user",
+		Data: map[string]string{
+			"kind":    "What was revoked, see Revocation*",
+			"subject": "The name of the token or the user",
+		},
+	},
+	{
+		Type:        EventTokenMinted,
+		Version:     1,
+		Description: "An operator minted a token for clients, see ApiToken",
+		Data: map[string]string{
+			"id":        "The id of the token",
+			"name":      "The name of the token",
+			"user":      "The user recorded on the sessions requested with the token, empty when it names none",
+			"expiresAt": "When the token expires in RFC 3339, empty when it does not",
+		},
+	},
+	{
+		Type:        EventTokenDeleted,
+		Version:     1,
+		Description: "An operator deleted a token minted for clients, its requests are rejected",
+		Data: map[string]string{
+			"id":   "The id of the token",
+			"name": "The name of the token",
+		},
+	},
+	{
+		Type:        EventSessionRecordingEnded,
+		Version:     1,
+		Description: "The agent stopped recording a session, because it closed or its recording reached the agent's limits",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"reason": "Why the recording ended, see RecordingEnd*",
+			"size":   "Size of the encrypted recording in bytes",
+		},
+	},
+	{
+		Type:        EventSessionRecordingAccessed,
+		Version:     1,
+		Description: "A user retrieved the recording of a session",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"user":      "The user the controller's authorization policy identified, empty without one",
+			"tokenName": "The name of the token presented, empty when it is not named",
+		},
+	},
+	{
+		Type:        EventSessionReservationEnded,
+		Version:     1,
+		Description: "The window of a reserved session ended and the session was canceled, returning the VRAM held for it to its pool",
+		Subjects:    []string{EventSubjectSession},
+		Data: map[string]string{
+			"startAt": "When the window started in RFC 3339",
+			"endAt":   "When the window ended in RFC 3339",
+			"placed":  "false when the session was never placed on an agent during its window",
+		},
+	},
+	{
+		Type:        EventAgentSelfTestFailed,
+		Version:     1,
+		Description: "An agent registered with critical checks of its self-test failing, see the controller's --agent-self-test-action",
+		Subjects:    []string{EventSubjectAgent},
+		Data: map[string]string{
+			"hostname": "Hostname of the agent",
+			"failed":   "The critical checks that failed, comma separated, see SelfTest*",
+			"action":   "What the controller did, cordon, refuse, or none when it only records the failure",
+		},
+	},
+	{
+		Type:        EventSessionRequeued,
+		Version:     1,
+		Description: "A running session was canceled to make room for a session of higher priority and returns to the queue once its agent closes it, see the controller's --priority-preemption",
+		Subjects:    []string{EventSubjectAgent, EventSubjectSession},
+		Data: map[string]string{
+			"priority":    "The priority of the session preempted",
+			"forPriority": "The priority of the queued session the GPUs were freed for",
+			"forSession":  "The queued session the GPUs were freed for",
+		},
+	},
+	{
+		Type:        EventControllerLeaderElected,
+		Version:     1,
+		Description: "A controller replica acquired the scheduler lease and runs the scheduling loop, see the controller's --leader-election",
+		Data: map[string]string{
+			"holder":   "The replica that acquired the lease, see the controller's --leader-id",
+			"previous": "The replica that held the lease before, empty when it was free",
+		},
+	},
+	{
+		Type:        EventControllerLeadershipLost,
+		Version:     1,
+		Description: "A controller replica stopped running the scheduling loop, unable to renew the scheduler lease before it expired or finding another replica holding it",
+		Data: map[string]string{
+			"holder": "The replica that lost the lease",
+			"reason": "Why the lease was lost",
+		},
+	},
+}
+
+// Returns the description of the event type, false for types not in EventTypes
+func LookupEventType(eventType string) (EventType, bool) {
+	for _, known := range EventTypes {
+		if known.Type == eventType {
+			return known, true
+		}
+	}
+
+	return EventType{}, false
+}
+
+func (eventType EventType) Schema() EventSchema {
+	required := []string{"type", "version", "time"}
+	required = append(required, eventType.Subjects...)
+
+	properties := map[string]any{
+		"type":     map[string]any{"const": eventType.Type},
+		"version":  map[string]any{"const": eventType.Version},
+		"sequence": map[string]any{"type": "integer", "minimum": 1},
+		"time":     map[string]any{"type": "string", "format": "date-time"},
+		"message":  map[string]any{"type": "string"},
+	}
+
+	for _, subject := range eventType.Subjects {
+		switch subject {
+		case EventSubjectAgent, EventSubjectSession:
+			properties[subject] = map[string]any{"type": "string", "format": "uuid"}
+		default:
+			properties[subject] = map[string]any{"type": "string"}
+		}
+	}
+
+	if len(eventType.Data) > 0 {
+		keys := make([]string, 0, len(eventType.Data))
+		data := map[string]any{}
+		for key, description := range eventType.Data {
+			keys = append(keys, key)
+			data[key] = map[string]any{"type": "string", "description": description}
+		}
+		sort.Strings(keys)
+
+		properties["data"] = map[string]any{
+			"type":                 "object",
+			"properties":           data,
+			"required":             keys,
+			"additionalProperties": map[string]any{"type": "string"},
+		}
+		required = append(required, "data")
+	}
+
+	return EventSchema{
+		Type:        eventType.Type,
+		Version:     eventType.Version,
+		Description: eventType.Description,
+		Schema: map[string]any{
+			"$schema":     "https://json-schema.org/draft/2020-12/schema",
+			"$id":         fmt.Sprintf("urn:juice:event:%s:v%d", eventType.Type, eventType.Version),
+			"title":       eventType.Type,
+			"description": eventType.Description,
+			"type":        "object",
+			"properties":  properties,
+			"required":    required,
+		},
+	}
+}
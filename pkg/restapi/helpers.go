@@ -9,36 +9,53 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
 )
 
 func parseBody(body io.Reader, length int64) ([]byte, error) {
 	if length > 0 {
 		message := make([]byte, length)
-		n, err := body.Read(message)
-		if err != io.EOF {
-			return nil, err
-		} else if length != int64(n) {
+		n, err := io.ReadFull(body, message)
+		if err == io.ErrUnexpectedEOF {
 			return nil, fmt.Errorf("body length %d did not match expected content length %d", n, length)
+		} else if err != nil {
+			return nil, err
 		}
 
 		return message, nil
+	} else if length < 0 {
+		return io.ReadAll(body)
 	}
 
 	return nil, nil
 }
 
+func responseError(response *http.Response, body []byte) error {
+	if body != nil {
+		if response.Header.Get("Content-Type") == "application/json" {
+			var structured Error
+			if json.Unmarshal(body, &structured) == nil && structured.Code != "" {
+				return structured
+			}
+		}
+
+		return pkgerrors.FromResponse(response.StatusCode, string(body))
+	}
+
+	return pkgerrors.FromResponse(response.StatusCode, "")
+}
+
 func parseResponse(response *http.Response, contentType string) ([]byte, error) {
 	body, err := parseBody(response.Body, response.ContentLength)
 	if err != nil {
 		return nil, err
 	}
 
-	if response.StatusCode != 200 {
-		if body != nil {
-			return nil, fmt.Errorf("error received from server, code %d\nmessage: %s", response.StatusCode, string(body))
-		}
-
-		return nil, fmt.Errorf("error received from server, code %d", response.StatusCode)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, responseError(response, body)
 	}
 
 	if response.Header.Get("Content-Type") != contentType {
@@ -69,18 +86,31 @@ func parseStringResponse(response *http.Response) (string, error) {
 	return string(body), nil
 }
 
+func parseHeartbeatSchedule(header http.Header) HeartbeatSchedule {
+	interval, err := strconv.ParseInt(header.Get(HeartbeatIntervalHeader), 10, 64)
+	if err != nil || interval <= 0 {
+		return HeartbeatSchedule{}
+	}
+
+	offset, err := strconv.ParseInt(header.Get(HeartbeatOffsetHeader), 10, 64)
+	if err != nil || offset < 0 || offset >= interval {
+		offset = 0
+	}
+
+	return HeartbeatSchedule{
+		Interval: time.Duration(interval) * time.Millisecond,
+		Offset:   time.Duration(offset) * time.Millisecond,
+	}
+}
+
 func validateResponse(response *http.Response) error {
 	body, err := parseBody(response.Body, response.ContentLength)
 	if err != nil {
 		return err
 	}
 
-	if response.StatusCode != 200 {
-		if body != nil {
-			return fmt.Errorf("error received from server, code %d\nmessage: %s", response.StatusCode, string(body))
-		}
-
-		return fmt.Errorf("error received from server, code %d", response.StatusCode)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return responseError(response, body)
 	}
 
 	return nil
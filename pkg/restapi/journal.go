@@ -0,0 +1,70 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"time"
+)
+
+// What a storage mutation recorded in the controller's journal changed
+const (
+	JournalAgent         = "agent"
+	JournalSession       = "session"
+	JournalExpectedAgent = "expectedAgent"
+	JournalRevocation    = "revocation"
+	JournalApiToken      = "apiToken"
+	JournalUsage         = "usage"
+	JournalEvent         = "event"
+	// Identified by the kind and name of the resource, such as quota/render
+	JournalConfigResource = "configResource"
+)
+
+// States of a journal entry
+const (
+	// Recorded ahead of the mutation, which has not completed yet. An entry left pending by a
+	// controller that stopped may or may not have been applied.
+	JournalPending = "pending"
+	JournalApplied = "applied"
+	JournalFailed  = "failed"
+	// The mutation completed without changing anything, such as a sweep finding nothing to remove
+	JournalUnchanged = "unchanged"
+)
+
+// A storage mutation made through a controller, recorded in the storage ahead of the mutation
+// and updated once it completes, see /v1/journal
+type JournalEntry struct {
+	// Assigned by the storage in order of the mutations, shared by the controllers sharing the
+	// storage and kept across their restarts
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	// One of the Journal* states
+	State string `json:"state"`
+
+	// The storage operation, such as AssignSession
+	Operation string `json:"operation"`
+	// One of the Journal* kinds
+	Kind string `json:"kind"`
+	// The id of what was changed, empty for operations changing many at once
+	Id string `json:"id,omitempty"`
+
+	// The agents whose state, labels, taints, or sessions the mutation may have changed
+	AgentIds []string `json:"agentIds,omitempty"`
+	// The mutation may have changed any agent
+	AllAgents bool `json:"allAgents,omitempty"`
+
+	// The event persisted by an applied AppendEvent, webhooks are posted from it
+	Event *Event `json:"event,omitempty"`
+}
+
+// Journal entries recorded after a sequence
+type JournalReplay struct {
+	Entries []JournalEntry `json:"entries"`
+
+	// The sequence to replay from next, that of the last entry returned or since when none were
+	Next uint64 `json:"next"`
+
+	// Entries after since were removed from the journal before they were replayed, or since is
+	// past its last entry, the consumer must resynchronize from the current state
+	Missed bool `json:"missed,omitempty"`
+}
@@ -3,6 +3,16 @@
  */
 package restapi
 
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	pkgerrors "github.com/Juice-Labs/Juice-Labs/pkg/errors"
+)
+
 const (
 	SessionClosed    = "closed"
 	SessionQueued    = "queued"
@@ -16,8 +26,193 @@ const (
 	ExitStatusSuccess  = "success"
 	ExitStatusFailure  = "failure"
 	ExitStatusCanceled = "canceled"
+	// Closed by the agent once the session's client was inactive for its idle timeout, see
+	// SessionRequirements.IdleTimeoutSeconds
+	ExitStatusIdle = "idle"
+)
+
+const (
+	ApiV1 = "v1"
+	ApiV2 = "v2"
+)
+
+// Names the user a session is requested on behalf of, honored only for tokens the controller's
+// authorization policy allows to delegate
+const OnBehalfOfHeader = "Juice-On-Behalf-Of"
+
+// Returned with the agent's id at registration, the interval between the agent's updates and the
+// offset of its updates within the interval, both in milliseconds. See HeartbeatSchedule
+const (
+	HeartbeatIntervalHeader = "Juice-Heartbeat-Interval"
+	HeartbeatOffsetHeader   = "Juice-Heartbeat-Offset"
+)
+
+// Set on the agent returned to the agent itself when the controller asks the agent to report the
+// sessions it runs, such as after the controller restarted. See AgentReconciliation
+const ReconcileRequestedHeader = "Juice-Reconcile-Requested"
+
+// REST API versions understood by this client, in order of preference
+var SupportedApiVersions = []string{ApiV2, ApiV1}
+
+const (
+	ErrorBadRequest    = "badRequest"
+	ErrorUnauthorized  = "unauthorized"
+	ErrorForbidden     = "forbidden"
+	ErrorNotFound      = "notFound"
+	ErrorConflict      = "conflict"
+	ErrorQuotaExceeded = "quotaExceeded"
+	ErrorInternal      = "internal"
+	ErrorUnavailable   = "unavailable"
 )
 
+const (
+	EventSloBudgetExceeded  = "slo.budgetExceeded"
+	EventSloBudgetRecovered = "slo.budgetRecovered"
+
+	EventSessionHookFailed = "session.hookFailed"
+
+	EventSessionStaleKilled  = "session.staleKilled"
+	EventSessionStaleAdopted = "session.staleAdopted"
+	EventAgentReregistered   = "agent.reregistered"
+	EventAgentReconciled     = "agent.reconciled"
+	EventAgentReconnected    = "agent.reconnected"
+
+	EventAgentMissing          = "agent.missing"
+	EventQueueSaturated        = "queue.saturated"
+	EventQueueRecovered        = "queue.recovered"
+	EventPoolCapacityExhausted = "pool.capacityExhausted"
+	EventPoolCapacityRecovered = "pool.capacityRecovered"
+	EventCertificateExpiring   = "certificate.expiring"
+
+	EventSessionExec = "session.exec"
+
+	EventGpuVramLeaked   = "gpu.vramLeaked"
+	EventGpuVramReleased = "gpu.vramReleased"
+	EventGpuUnhealthy    = "gpu.unhealthy"
+	EventGpuRecovered    = "gpu.recovered"
+
+	EventAgentCordoned   = "agent.cordoned"
+	EventAgentUncordoned = "agent.uncordoned"
+
+	EventSessionCallbackFailed = "session.callbackFailed"
+
+	EventSessionStateChanged = "session.stateChanged"
+	EventAgentStateChanged   = "agent.stateChanged"
+
+	EventAgentDraining = "agent.draining"
+	EventAgentDrained  = "agent.drained"
+
+	EventSessionAssignmentDeclined = "session.assignmentDeclined"
+
+	EventSessionIdleReclaimed = "session.idleReclaimed"
+
+	EventQuotaBorrowed  = "quota.borrowed"
+	EventQuotaReclaimed = "quota.reclaimed"
+
+	EventSessionPreempted    = "session.preempted"
+	EventSessionWaitExceeded = "session.waitExceeded"
+
+	EventAgentLabelsChanged = "agent.labelsChanged"
+
+	EventCredentialRevoked  = "credential.revoked"
+	EventCredentialRestored = "credential.restored"
+
+	EventTokenMinted  = "token.minted"
+	EventTokenDeleted = "token.deleted"
+
+	EventSessionRecordingEnded    = "session.recordingEnded"
+	EventSessionRecordingAccessed = "session.recordingAccessed"
+
+	EventSessionReservationEnded = "session.reservationEnded"
+
+	EventAgentSelfTestFailed = "agent.selfTestFailed"
+
+	EventSessionRequeued = "session.requeued"
+
+	EventControllerLeaderElected  = "controller.leaderElected"
+	EventControllerLeadershipLost = "controller.leadershipLost"
+)
+
+const (
+	SloAssignmentLatency = "assignmentLatency"
+	SloSessionSuccess    = "sessionSuccess"
+)
+
+// Agents and sessions are grouped into pools by the value of this label,
+// sessions select a pool through their MatchLabels
+const PoolLabel = "pool"
+
+const DefaultPool = "default"
+
+// Agents are placed in the topology of a multi-site fleet by the values of these labels,
+// sessions prefer agents close to their LocalityHint and require a region or zone through
+// their MatchLabels
+const (
+	RegionLabel = "region"
+	ZoneLabel   = "zone"
+)
+
+// Controllers cordoning the agents failing critical checks of their SelfTest give them this taint
+// with the value "failed", see the controller's --agent-self-test-action. Sessions tolerating it
+// may still be placed on them, and removing it through /v1/agent/{id}/labels uncordons them.
+const SelfTestTaint = "selfTest"
+
+// The checks of the self-test agents run on startup, see SelfTest
+const (
+	// The renderer and the libraries it loads are installed
+	SelfTestLibraries = "libraries"
+	// The GPU backend reads the GPUs through their driver, such as NVML for NVIDIA GPUs
+	SelfTestGpuDriver = "gpuDriver"
+	// The renderer creates a Vulkan instance and enumerates the GPUs
+	SelfTestVulkan = "vulkan"
+	// The controller's port is reachable, only run by agents connecting to a controller
+	SelfTestController = "controller"
+	// The agent's clock agrees with the controller's, only run by agents connecting to a controller
+	SelfTestClockSkew = "clockSkew"
+)
+
+// Agents are labeled with the records of an external inventory by the controller's importer, see
+// InventoryRecord. Sessions may select agents by these labels through their MatchLabels.
+const (
+	InventoryRackLabel       = "inventory.rack"
+	InventoryDatacenterLabel = "inventory.datacenter"
+	InventoryOwnerLabel      = "inventory.owner"
+	InventoryWarrantyLabel   = "inventory.warranty"
+)
+
+// How the controller chooses among the agents a session fits on, see SessionRequirements.Placement
+const (
+	// The agent leaving the least VRAM free on the GPUs chosen, consolidating sessions so larger
+	// GPUs and whole agents stay free
+	PlacementBinPack = "binpack"
+	// The agent running the fewest sessions, leaving the most VRAM free, minimizing the sessions
+	// contending for its GPUs, CPU, and network
+	PlacementSpread = "spread"
+	// Any agent the session fits on, at random
+	PlacementRandom = "random"
+)
+
+// Returns whether strategy is one of the placement strategies
+func IsPlacementStrategy(strategy string) bool {
+	return strategy == PlacementBinPack || strategy == PlacementSpread || strategy == PlacementRandom
+}
+
+// Session classes, presets of the queue priority, preemptibility, and maximum wait in the queue
+// of the sessions, see the controller's --session-class-file
+const (
+	// Placed first and never preempted, closed when not placed within minutes
+	SessionClassInteractive = "interactive"
+	// Placed after interactive sessions, never preempted, and left queued until placed
+	SessionClassBatch = "batch"
+	// Placed last on capacity no other session needs, canceled when a session of another class needs it
+	SessionClassPreemptible = "preemptible"
+)
+
+// Returns whether class is one of the session classes
+func IsSessionClass(class string) bool {
+	return class == SessionClassInteractive || class == SessionClassBatch || class == SessionClassPreemptible
+}
+
 const (
 	AgentClosed   = "closed"
 	AgentActive   = "active"
@@ -26,8 +221,8 @@ const (
 )
 
 type GpuRequirements struct {
-	VramRequired uint64 `json:"vramRequired"`
-	PciBus       string `json:"pciBus"`
+	VramRequired uint64 `json:"vramRequired" yaml:"vramRequired"`
+	PciBus       string `json:"pciBus" yaml:"pciBus,omitempty"`
 }
 
 type SessionRequirements struct {
@@ -38,12 +233,108 @@ type SessionRequirements struct {
 
 	MatchLabels map[string]string `json:"matchLabels"`
 	Tolerates   map[string]string `json:"tolerates"`
+
+	// Allows the session to be placed on a CPU rendering fallback (llvmpipe)
+	// when no GPU capacity is available
+	AllowCpuFallback bool `json:"allowCpuFallback,omitempty"`
+
+	// Identifies who the session is used by, the agent groups its metrics by tenant
+	Tenant string `json:"tenant,omitempty"`
+
+	// Where the client is, the controller prefers agents close to it
+	Locality *LocalityHint `json:"locality,omitempty"`
+
+	// Queued sessions with higher priorities are placed first, those of equal priority in the
+	// order they were requested
+	Priority int `json:"priority,omitempty"`
+
+	// One of SessionClass*, chooses the priority, preemptibility, and maximum wait of the session
+	// as a whole. The controller sets Priority from the class, empty leaves them to Priority.
+	Class string `json:"class,omitempty"`
+
+	// Receives a SessionCallback once the session closes, see the controller's
+	// --session-callback-secret-file
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+
+	// The user the session is requested by, set by the controller from the requester's
+	// certificate or token rather than taken from the request
+	User string `json:"user,omitempty"`
+	// The service account that requested the session on behalf of User, see OnBehalfOfHeader
+	DelegatedBy string `json:"delegatedBy,omitempty"`
+	// The name of the authorization policy token the session was requested with, set by the
+	// controller so revoking the token can cancel its sessions, see Revocation
+	TokenName string `json:"tokenName,omitempty"`
+
+	// Closes the session once its client has neither used the GPU nor sent or received data for
+	// this many seconds, returning its GPUs to the pool. 0 leaves it to the agent's
+	// --default-idle-timeout.
+	IdleTimeoutSeconds int `json:"idleTimeoutSeconds,omitempty"`
+
+	// Overrides the controller's --placement-strategy for the session, one of PlacementBinPack,
+	// PlacementSpread, or PlacementRandom
+	Placement string `json:"placement,omitempty"`
+
+	// The session is only placed on agents supporting each of these features, see Capability*.
+	// Such as CapabilityGpuFairness for sessions sharing GPUs, which agents running without root
+	// may not enforce.
+	RequireCapabilities []string `json:"requireCapabilities,omitempty"`
+
+	// Port on the agent's loopback interface the session's workload serves Prometheus metrics
+	// on, passed to it as JUICE_SESSION_METRICS_PORT. The agent scrapes the port and exports the
+	// metrics labeled with the session, its tenant, and its GPUs. 0 exports none.
+	MetricsPort int `json:"metricsPort,omitempty"`
+
+	// Records the traffic between the client and the session's renderer on the agent, encrypted
+	// with a key only the controller can derive, for deployments that must retain records of
+	// their sessions. The session is only placed on agents with CapabilitySessionRecording.
+	Record bool `json:"record,omitempty"`
+
+	// Books the session in advance for a window, see SessionReservation. Requested without one,
+	// the session is placed as soon as capacity allows.
+	Reservation *SessionReservation `json:"reservation,omitempty"`
+
+	// Names the template resource the controller sets the requirements the request leaves unset
+	// from, see SessionTemplate
+	Template string `json:"template,omitempty"`
+}
+
+// The window a session is booked for. The controller holds the VRAM of the session's pool for
+// it ahead of the window, see the controller's --reservation-hold-lead, places it once the window
+// starts, and cancels it once the window ends whether or not it was placed. Reservations and
+// on-demand sessions conflicting with the VRAM held are rejected when requested.
+type SessionReservation struct {
+	StartAt         time.Time `json:"startAt"`
+	DurationSeconds int64     `json:"durationSeconds"`
+}
+
+// Returns when the window ends
+func (reservation SessionReservation) EndAt() time.Time {
+	return reservation.StartAt.Add(time.Duration(reservation.DurationSeconds) * time.Second)
+}
+
+// Returns whether the windows of the reservations overlap
+func (reservation SessionReservation) Overlaps(other SessionReservation) bool {
+	return reservation.StartAt.Before(other.EndAt()) && other.StartAt.Before(reservation.EndAt())
+}
+
+type LocalityHint struct {
+	// The RegionLabel and ZoneLabel values of the agents closest to the client
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+
+	// Round trip times from the client to each region in milliseconds, measured by the client
+	RegionRtts map[string]float64 `json:"regionRtts,omitempty"`
 }
 
 type SessionGpu struct {
 	Index int `json:"index"`
 
 	VramRequired uint64 `json:"vramRequired"`
+
+	// Describe the GPU to the application using the session, see Gpu
+	Name   string `json:"name,omitempty"`
+	PciBus string `json:"pciBus,omitempty"`
+	Vram   uint64 `json:"vram,omitempty"`
 }
 
 type Session struct {
@@ -55,6 +346,274 @@ type Session struct {
 	Persistent bool   `json:"persistent"`
 
 	Gpus []SessionGpu `json:"gpus"`
+
+	// Set when the session is rendered on the CPU rather than GPU hardware
+	CpuFallback bool `json:"cpuFallback,omitempty"`
+
+	// See SessionRequirements.Tenant
+	Tenant string `json:"tenant,omitempty"`
+
+	// See SessionRequirements.User and SessionRequirements.DelegatedBy
+	User        string `json:"user,omitempty"`
+	DelegatedBy string `json:"delegatedBy,omitempty"`
+
+	// See SessionRequirements.TokenName
+	TokenName string `json:"tokenName,omitempty"`
+
+	// See SessionRequirements.IdleTimeoutSeconds
+	IdleTimeoutSeconds int `json:"idleTimeoutSeconds,omitempty"`
+
+	// See SessionRequirements.Class
+	Class string `json:"class,omitempty"`
+
+	// See SessionRequirements.MetricsPort
+	MetricsPort int `json:"metricsPort,omitempty"`
+
+	// See SessionRequirements.Record
+	Record bool `json:"record,omitempty"`
+
+	// See SessionRequirements.Reservation
+	Reservation *SessionReservation `json:"reservation,omitempty"`
+
+	// See SessionRequirements.Priority
+	Priority int `json:"priority,omitempty"`
+
+	// Rolling summary of the connections to the client, reported by the agent
+	Network *NetworkMetrics `json:"network,omitempty"`
+
+	// Rolling summary of the frames presented to the client, reported by the client
+	Frames *FrameMetrics `json:"frames,omitempty"`
+
+	// Reported by the client when the application using the session exits
+	Release *SessionRelease `json:"release,omitempty"`
+
+	// The end of the renderer's log, reported by the agent once the session closes
+	LogExcerpt string `json:"logExcerpt,omitempty"`
+
+	// Set when the session was placed beyond the GPUs guaranteed to its tenant by borrowing idle
+	// capacity, such sessions are canceled first when a tenant within its guarantee needs the GPUs
+	Preemptible bool `json:"preemptible,omitempty"`
+
+	// Set while the session is canceled to make room for a session of higher priority, see the
+	// controller's --priority-preemption. The agent gives its renderer time to exit, and the
+	// session returns to the queue once its agent closes it rather than closing.
+	Preempted bool `json:"preempted,omitempty"`
+
+	// Set by the controller from the policy of the session's tenant, not stored
+	DataChannel *DataChannelPolicy `json:"dataChannel,omitempty"`
+
+	// Last agreed between the client and the agent, see CapabilityStreamNegotiation
+	Stream *StreamParameters `json:"stream,omitempty"`
+}
+
+// Usage summary sent by the client when it releases a session
+type SessionRelease struct {
+	// Exit status of the application as observed by the client, see ExitStatus*
+	ExitStatus string `json:"exitStatus"`
+	ExitCode   int    `json:"exitCode"`
+
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+}
+
+// Diagnostic command run in a session's environment on its agent, such as nvidia-smi or strace
+// of the renderer, see Client.ExecSession
+type SessionExec struct {
+	// Name of a command the agent allows, see the agent's --exec-commands
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+const (
+	// Replaced in SessionExec.Args by the process id of the session's renderer, e.g. strace -p {renderer-pid}
+	ExecRendererPidPlaceholder = "{renderer-pid}"
+
+	// HTTP trailer of the exit code of the command, sent after its output
+	ExecExitCodeTrailer = "Juice-Exit-Code"
+)
+
+// A chunk of the traffic of a recorded session, see SessionRequirements.Record. The controller
+// returns the recording decrypted as one chunk per line of JSON, ending with a RecordingEnd chunk.
+type RecordingChunk struct {
+	Time time.Time `json:"time"`
+	// RecordingFromClient, RecordingFromRenderer, or RecordingEnd
+	Direction string `json:"direction"`
+	Data      []byte `json:"data,omitempty"`
+
+	// Why the recording ended, set on the RecordingEnd chunk, see RecordingEnd*
+	Reason string `json:"reason,omitempty"`
+}
+
+const (
+	RecordingFromClient   = "client"
+	RecordingFromRenderer = "renderer"
+	RecordingEnd          = "end"
+)
+
+// Why a recording ended
+const (
+	RecordingEndClosed = "closed"
+	// The recording reached the agent's --recording-max-size, the session went on unrecorded
+	RecordingEndMaxSize = "maxSize"
+	// The recording reached the agent's --recording-max-duration, the session went on unrecorded
+	RecordingEndMaxDuration = "maxDuration"
+	// The recording ends without saying why, such as when the agent stopped while recording
+	RecordingEndTruncated = "truncated"
+)
+
+// The key a recorded session is encrypted with, generated by the controller for the agent
+// running the session
+type RecordingKey struct {
+	// AES-256 key the agent encrypts the recording with and then forgets
+	Key []byte `json:"key"`
+	// The key encrypted with the controller's --recording-key-file, stored with the recording
+	// so only the controller can decrypt it
+	WrappedKey string `json:"wrappedKey"`
+}
+
+// Asks an agent whether it can take a session on the GPUs the controller chose for it now, sent
+// before the session is assigned when the controller's --assignment-confirm-timeout is set
+type AssignmentConfirmation struct {
+	Gpus        []SessionGpu `json:"gpus"`
+	CpuFallback bool         `json:"cpuFallback,omitempty"`
+}
+
+type AssignmentConfirmed struct {
+	Accepted bool `json:"accepted"`
+	// Why the agent cannot take the session when not accepted
+	Reason string `json:"reason,omitempty"`
+}
+
+// File in a session's scratch directory, pushed by the client or left for it to pull
+type SessionFile struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// Directions files move through a session's data channel
+const (
+	// From the client to the session's scratch directory
+	DataChannelPush = "push"
+	// From the session's scratch directory to the client
+	DataChannelPull = "pull"
+)
+
+// Restricts the files clients move through a session's data channel, its scratch directory. Set by
+// the controller from the policy of the session's tenant and enforced by the agent, the zero value
+// leaves the agent's own limits.
+type DataChannelPolicy struct {
+	// Refuses every transfer and listing the files
+	Disabled bool `json:"disabled,omitempty"`
+	// Largest file in bytes pushed or pulled, 0 leaves the agent's --session-file-max-size
+	MaxTransferSize int64 `json:"maxTransferSize,omitempty"`
+	// The directions allowed, see DataChannel*, both when empty
+	Directions []string `json:"directions,omitempty"`
+	// File extensions allowed, such as .png, every extension when empty
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+	// File extensions refused, even when in AllowedExtensions
+	DeniedExtensions []string `json:"deniedExtensions,omitempty"`
+}
+
+// The compression of the traffic between the client and the agent, see StreamParameters
+const (
+	StreamCompressionNone     = "none"
+	StreamCompressionFast     = "fast"
+	StreamCompressionBalanced = "balanced"
+	StreamCompressionSmall    = "small"
+)
+
+// Bandwidth and round trip time from the client to the agent, measured by the client
+type NetworkEstimate struct {
+	BandwidthMbps float64 `json:"bandwidthMbps"`
+	RttMs         float64 `json:"rttMs"`
+}
+
+// How the client streams a session, agreed with the agent from the client's NetworkEstimate
+type StreamParameters struct {
+	// See StreamCompression*
+	Compression string `json:"compression"`
+	// Frames per second the application presents at most, 0 when unlimited
+	FrameRateLimit int `json:"frameRateLimit"`
+}
+
+// Sent by the client when the session starts and again when its estimate changes
+type StreamNegotiation struct {
+	Estimate NetworkEstimate `json:"estimate"`
+
+	// Overrides the agent keeps, an empty Compression and a FrameRateLimit of 0 leave them to the agent
+	Overrides StreamParameters `json:"overrides"`
+}
+
+type NetworkMetrics struct {
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+
+	// Bytes per second over the agent's network metrics window
+	SendRate    uint64 `json:"sendRate"`
+	ReceiveRate uint64 `json:"receiveRate"`
+
+	// Round trip time to the client in microseconds, the mean and maximum over the window
+	Rtt    uint32 `json:"rtt"`
+	RttMax uint32 `json:"rttMax"`
+
+	Retransmits uint32 `json:"retransmits"`
+
+	// Counted by agents with eBPF network accounting, which also includes the bytes of the
+	// connections the renderer opens itself
+	PacketsSent     uint64 `json:"packetsSent,omitempty"`
+	PacketsReceived uint64 `json:"packetsReceived,omitempty"`
+
+	// Packets per second over the agent's network metrics window
+	SendPacketRate    uint64 `json:"sendPacketRate,omitempty"`
+	ReceivePacketRate uint64 `json:"receivePacketRate,omitempty"`
+
+	// Transport of the session's latest client connection, see Transport*. Over QUIC, Retransmits
+	// counts the packets lost and Resumes the times connections moved to a new network path.
+	Transport string `json:"transport,omitempty"`
+	Resumes   uint32 `json:"resumes,omitempty"`
+}
+
+// When an agent updates the controller, assigned by the controller at registration so agents
+// update at evenly spread times rather than in bursts
+type HeartbeatSchedule struct {
+	Interval time.Duration
+	// Updates occur when the time since the Unix epoch modulo Interval is Offset
+	Offset time.Duration
+}
+
+// Frame pacing and input latency measured by the client over its metrics window
+type FrameMetrics struct {
+	Frames    uint64  `json:"frames"`
+	FrameRate float64 `json:"frameRate"`
+
+	// Intervals between presented frames in milliseconds
+	FrameIntervalP50 float64 `json:"frameIntervalP50"`
+	FrameIntervalP95 float64 `json:"frameIntervalP95"`
+	FrameIntervalP99 float64 `json:"frameIntervalP99"`
+
+	// Frames presented at least twice the median interval after the previous frame
+	Stutters uint64 `json:"stutters"`
+
+	// Time from input being sent to the first frame presented after it in milliseconds,
+	// zero when there was no input
+	InputLatencyP50 float64 `json:"inputLatencyP50"`
+	InputLatencyP95 float64 `json:"inputLatencyP95"`
+}
+
+// How a session shares its GPUs with the other sessions on them, measured by the agent's GPU
+// fairness enforcement
+type GpuFairness struct {
+	// Percent of the GPU's streaming multiprocessors the session used over the last interval, the
+	// highest of its GPUs
+	SmUtilization float64 `json:"smUtilization"`
+	// Percent of the GPU the session is entitled to among the sessions using it, the lowest of its GPUs
+	FairShare float64 `json:"fairShare"`
+
+	// Fraction of the time the agent suspends the session's renderer, 0 when not throttled
+	Throttle float64 `json:"throttle"`
+	// Total seconds the session's renderer has been suspended
+	ThrottledSeconds float64 `json:"throttledSeconds"`
 }
 
 type GpuMetrics struct {
@@ -67,6 +626,14 @@ type GpuMetrics struct {
 	PowerDraw       uint32 `json:"powerDraw"`
 	PowerLimit      uint32 `json:"powerLimit"`
 	FanSpeed        uint32 `json:"fanSpeed"`
+
+	// VRAM the agent found still in use after the sessions on the GPU closed, the agent places no
+	// sessions on the GPU until it is released
+	VramLeaked uint64 `json:"vramLeaked,omitempty"`
+
+	// Why the agent's health checks found the GPU unhealthy, empty while it is healthy. The agent
+	// places no sessions on the GPU and the controller none on the agent until it recovers
+	Unhealthy string `json:"unhealthy,omitempty"`
 }
 
 type Gpu struct {
@@ -82,6 +649,17 @@ type Gpu struct {
 	Vram        uint64 `json:"vram"`
 	PciBus      string `json:"pciBus"`
 
+	// VRAM not allocated to sessions, reported by the controller
+	VramAvailable uint64 `json:"vramAvailable,omitempty"`
+	// Sessions placed on the GPU, reported by the controller
+	Sessions int `json:"sessions,omitempty"`
+
+	// Sessions sharing the GPU at most and the VRAM allocated to each at most, advertised by agents
+	// splitting the GPU into fractions. Sessions without a VRAM requirement are allocated
+	// SessionVram. 0 leaves the GPU to MaxSessionsPerGpu and its VRAM available.
+	MaxSessions int    `json:"maxSessions,omitempty"`
+	SessionVram uint64 `json:"sessionVram,omitempty"`
+
 	Metrics GpuMetrics `json:"metrics"`
 }
 
@@ -98,16 +676,221 @@ type Agent struct {
 	Taints map[string]string `json:"taints"`
 
 	Sessions []Session `json:"sessions"`
+
+	// Number of concurrent CPU rendering fallback sessions the agent accepts
+	CpuFallbackCapacity int `json:"cpuFallbackCapacity,omitempty"`
+
+	// Maximum number of concurrent sessions placed on each GPU, 0 when unlimited
+	MaxSessionsPerGpu int `json:"maxSessionsPerGpu,omitempty"`
+
+	// Fraction of the available VRAM not usable by a single allocation, reported by the controller
+	VramFragmentation float64 `json:"vramFragmentation,omitempty"`
+
+	// Set by operators through /v1/agent/{id}/drain, no new sessions are placed on a draining
+	// agent while the sessions it runs finish
+	Draining bool `json:"draining,omitempty"`
+
+	// Optional features supported by the agent when it registered, see Capability*. Sessions
+	// requiring features through RequireCapabilities are only placed on agents supporting them
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Whether the agent runs without root, forgoing the features that need it, see the agent's
+	// --rootless
+	Rootless bool `json:"rootless,omitempty"`
+
+	// Token matching the agent to its pre-registered ExpectedAgent, only sent when registering
+	JoinToken string `json:"joinToken,omitempty"`
+
+	// Results of the self-test the agent ran on startup, nil for agents not running one
+	SelfTest *SelfTest `json:"selfTest,omitempty"`
+}
+
+// The checks an agent ran on startup, see SelfTest*
+type SelfTest struct {
+	RanAt  time.Time       `json:"ranAt"`
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+type SelfTestCheck struct {
+	// One of SelfTest*
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Why the check failed, or what it found when it passed
+	Message string `json:"message,omitempty"`
+}
+
+// Returns the names of the checks that failed
+func (selfTest SelfTest) Failed() []string {
+	failed := []string{}
+	for _, check := range selfTest.Checks {
+		if !check.Passed {
+			failed = append(failed, check.Name)
+		}
+	}
+
+	return failed
+}
+
+// Changes to the labels and taints of a live agent sent to /v1/agent/{id}/labels. Keys are
+// removed before the others are set. The agent's own labels and taints replace them when it
+// registers again, such as after it restarts.
+type AgentLabelsPatch struct {
+	// Labels added or replaced
+	Labels map[string]string `json:"labels,omitempty"`
+	// Keys of the labels removed
+	RemoveLabels []string `json:"removeLabels,omitempty"`
+
+	// Taints added or replaced
+	Taints map[string]string `json:"taints,omitempty"`
+	// Keys of the taints removed
+	RemoveTaints []string `json:"removeTaints,omitempty"`
+}
+
+// An agent pre-registered with the controller, agents registering with its hostname
+// adopt its id, labels, and taints
+type ExpectedAgent struct {
+	Id       string `json:"id"`
+	Hostname string `json:"hostname"`
+
+	// Shorthand for the PoolLabel label
+	Pool string `json:"pool,omitempty"`
+
+	// GPUs the agent is expected to report, only the names and VRAM are compared
+	Gpus []Gpu `json:"gpus,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+	Taints map[string]string `json:"taints,omitempty"`
+
+	// When set, the agent must present the token with --join-token to adopt the identity
+	Token string `json:"token,omitempty"`
+}
+
+const (
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+type ImportStatus struct {
+	Id       string `json:"id"`
+	State    string `json:"state"`
+	Total    int    `json:"total"`
+	Imported int    `json:"imported"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Compares the expected agents with the agents connected to the controller
+type FleetHealth struct {
+	Expected  int `json:"expected"`
+	Connected int `json:"connected"`
+
+	// Hostnames of expected agents that are not connected
+	Missing []string `json:"missing"`
+	// Hostnames of connected agents that were not expected
+	Unexpected []string `json:"unexpected"`
+	// Hostnames of connected agents not reporting their expected GPUs
+	Mismatched []string `json:"mismatched"`
 }
 
 type Status struct {
 	State    string `json:"state"`
 	Version  string `json:"version"`
 	Hostname string `json:"hostname"`
+
+	// REST API versions served, servers without this field only serve v1
+	ApiVersions []string `json:"apiVersions,omitempty"`
+
+	// Optional features supported by the server, see Capability*
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Whether each of the controller's feature flags is enabled, see Feature
+	Features map[string]bool `json:"features,omitempty"`
+
+	// The server's clock when it responded, agents compare it to their own clock
+	Time time.Time `json:"time,omitempty"`
+
+	// Backend the agent detects its GPUs with, see the agent's --gpu-backend
+	GpuBackend string `json:"gpuBackend,omitempty"`
+
+	// UDP port the agent accepts client connections over QUIC on, see CapabilityQuic
+	QuicPort int `json:"quicPort,omitempty"`
+}
+
+const (
+	// The agent accepts session requests directly rather than through a controller
+	CapabilityDirectSessions = "directSessions"
+	// The agent requires a pre-shared session token to request sessions
+	CapabilitySessionToken = "sessionToken"
+	// The agent accepts sessions using CPU rendering fallback
+	CapabilityCpuFallback = "cpuFallback"
+	// The agent accepts files pushed to its sessions' scratch directories, see SessionFile
+	CapabilitySessionFiles = "sessionFiles"
+	// The agent runs diagnostic commands in its sessions for the controller, see SessionExec
+	CapabilitySessionExec = "sessionExec"
+	// The agent's GPU backend reports the utilization of its GPUs
+	CapabilityGpuMetrics = "gpuMetrics"
+	// The agent's GPU backend reads the VRAM used on its GPUs, needed to detect leaked VRAM
+	CapabilityVramUsage = "vramUsage"
+	// The agent's GPU backend reads the health of its GPUs, such as uncorrected ECC errors and
+	// hardware slowdowns, see the agent's --gpu-health-interval
+	CapabilityGpuHealth = "gpuHealth"
+	// The agent's GPU backend resets GPUs holding leaked VRAM, see the agent's --vram-leak-reset
+	CapabilityGpuReset = "gpuReset"
+	// The agent confirms it can take sessions before the controller assigns them, see AssignmentConfirmation
+	CapabilityConfirmAssignments = "confirmAssignments"
+	// The agent's GPU backend reads the utilization of its GPUs by process, needed to enforce
+	// fairness between the sessions sharing a GPU
+	CapabilityProcessUtilization = "processUtilization"
+	// The agent throttles sessions using more than their share of a GPU, see the agent's
+	// --gpu-fairness-interval
+	CapabilityGpuFairness = "gpuFairness"
+	// The agent counts the network traffic of each session's renderer with eBPF, see the agent's
+	// --ebpf-network-accounting
+	CapabilityNetworkAccounting = "networkAccounting"
+	// The agent serves its runtime profiles to operators presenting its --profiling-token
+	CapabilityProfiling = "profiling"
+	// Experimental. The agent accepts client connections over QUIC on Status.QuicPort, which resume
+	// when the client's network changes
+	CapabilityQuic = "quic"
+	// The agent agrees on StreamParameters with clients from the bandwidth and round trip time they
+	// measure to it, see StreamNegotiation
+	CapabilityStreamNegotiation = "streamNegotiation"
+	// The agent records the sessions requiring it to its --recording-dir, see
+	// SessionRequirements.Record
+	CapabilitySessionRecording = "sessionRecording"
+)
+
+// The transports client connections reach agents over, see NetworkMetrics.Transport
+const (
+	TransportTcp  = "tcp"
+	TransportQuic = "quic"
+)
+
+func (status Status) HasCapability(capability string) bool {
+	return hasCapability(status.Capabilities, capability)
 }
 
+func (agent Agent) HasCapability(capability string) bool {
+	return hasCapability(agent.Capabilities, capability)
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, supported := range capabilities {
+		if supported == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// An update without a State only updates the network metrics of the session
 type SessionUpdate struct {
-	State string `json:"state"`
+	State      string          `json:"state"`
+	ExitStatus string          `json:"exitStatus,omitempty"`
+	Network    *NetworkMetrics `json:"network,omitempty"`
+	// Only sent with the update closing the session
+	LogExcerpt string `json:"logExcerpt,omitempty"`
 }
 
 type AgentUpdate struct {
@@ -115,4 +898,568 @@ type AgentUpdate struct {
 	State    string                   `json:"state"`
 	Sessions map[string]SessionUpdate `json:"sessions"`
 	Gpus     []GpuMetrics             `json:"gpus"`
+
+	// Events raised by the agent since its last update
+	Events []Event `json:"events,omitempty"`
+}
+
+// The sessions an agent runs, which the controller corrects its records of the agent to
+type AgentReconciliation struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// The corrections the controller made to its records of an agent, by session id
+type AgentReconciliationResult struct {
+	// Sessions the agent runs that the controller did not place on the agent
+	Adopted []string `json:"adopted,omitempty"`
+	// Sessions the controller recorded in another state than the agent reported
+	Corrected []string `json:"corrected,omitempty"`
+	// Sessions the controller recorded as running that the agent no longer runs
+	Closed []string `json:"closed,omitempty"`
+	// Sessions the agent runs that the controller placed on another agent, left to it
+	Conflicting []string `json:"conflicting,omitempty"`
+}
+
+type CertificateRequest struct {
+	// Bootstrap token, required when requesting an agent certificate
+	Token string `json:"token,omitempty"`
+	// Session the certificate is issued for, required when requesting a client certificate
+	SessionId string `json:"sessionId,omitempty"`
+	// PEM encoded certificate signing request
+	Csr string `json:"csr"`
+}
+
+type Certificate struct {
+	Certificate   string    `json:"certificate"`
+	CaCertificate string    `json:"caCertificate"`
+	NotAfter      time.Time `json:"notAfter"`
+}
+
+type Event struct {
+	Type string `json:"type"`
+	// Version of the type's schema, see EventTypes
+	Version int `json:"version,omitempty"`
+	// Assigned in order of publication by the controller's event log, see GetEventsSince
+	Sequence  uint64            `json:"sequence,omitempty"`
+	Time      time.Time         `json:"time"`
+	Message   string            `json:"message,omitempty"`
+	AgentId   string            `json:"agentId,omitempty"`
+	SessionId string            `json:"sessionId,omitempty"`
+	Pool      string            `json:"pool,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// Events published after a sequence
+type EventReplay struct {
+	Events []Event `json:"events"`
+
+	// The sequence to replay from next, that of the last event returned or since when none were
+	Next uint64 `json:"next"`
+
+	// Events after since were removed by the controller's retention before they were replayed,
+	// the consumer must resynchronize from the current state rather than from events
+	Missed bool `json:"missed,omitempty"`
+}
+
+// Sent by clients on the /v1/events WebSocket to choose the state changes streamed to them, see
+// EventSessionStateChanged and EventAgentStateChanged. Each message replaces the subscription.
+type EventSubscription struct {
+	// Stream the state changes of these sessions
+	SessionIds []string `json:"sessionIds,omitempty"`
+	// Stream the state changes of these agents and of the sessions assigned to them
+	AgentIds []string `json:"agentIds,omitempty"`
+
+	// Stream the state changes published after this sequence, 0 to first replay every state change
+	// the controller retains. Every state change is streamed when no ids are set.
+	Since uint64 `json:"since,omitempty"`
+}
+
+type EventSchema struct {
+	Type        string `json:"type"`
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+
+	// JSON Schema of the events of the type
+	Schema map[string]any `json:"schema"`
+}
+
+const (
+	// Off by default, may change or be removed without notice
+	FeatureAlpha = "alpha"
+	// On by default, may be turned off if it misbehaves
+	FeatureBeta = "beta"
+	// Part of the controller, can no longer be turned off
+	FeatureStable = "stable"
+	// Scheduled for removal, see Feature.RemovedAfter
+	FeatureDeprecated = "deprecated"
+)
+
+type Feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Stage       string `json:"stage"`
+	Default     bool   `json:"default"`
+	Enabled     bool   `json:"enabled"`
+
+	// Date (YYYY-MM-DD) after which a deprecated feature may be removed
+	RemovedAfter string `json:"removedAfter,omitempty"`
+}
+
+type FeatureUpdate struct {
+	Enabled bool `json:"enabled"`
+}
+
+type SloStatus struct {
+	Pool      string  `json:"pool"`
+	Indicator string  `json:"indicator"`
+	Objective float64 `json:"objective"`
+
+	// Number of observations and the observations violating the objective within the window
+	Total int `json:"total"`
+	Bad   int `json:"bad"`
+
+	// Rate the error budget is consumed relative to the objective, 1 consumes exactly the budget over the window
+	BurnRate        float64 `json:"burnRate"`
+	BudgetRemaining float64 `json:"budgetRemaining"`
+	Exceeded        bool    `json:"exceeded"`
+}
+
+// Usage of a tenant's sessions closed in a month. The controller adds sessions to the aggregates
+// once their history ages, so usage outlives the history it removes.
+type UsageAggregate struct {
+	// Such as 2023-09, in UTC
+	Month  string `json:"month"`
+	Tenant string `json:"tenant"`
+
+	Sessions int `json:"sessions"`
+	// From when the client started the application to when it ended, from when the session was
+	// requested to when it closed for sessions the client did not release
+	SessionSeconds float64 `json:"sessionSeconds"`
+	// The seconds of each session multiplied by the number of GPUs it rendered on
+	GpuSeconds float64 `json:"gpuSeconds"`
+
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+}
+
+// Scheduling state of a pool, each pool's queue is scheduled independently of the others
+type PoolScheduling struct {
+	Pool string `json:"pool"`
+
+	// Paused pools keep their queued sessions queued until resumed
+	Paused bool `json:"paused"`
+	// Whether a scheduling pass of the pool is in progress
+	Running bool `json:"running"`
+	// Sessions queued in the pool as of the last scheduling pass
+	Queued int `json:"queued"`
+
+	LastPassAt       time.Time `json:"lastPassAt,omitempty"`
+	LastPassSeconds  float64   `json:"lastPassSeconds"`
+	LastPassAssigned int       `json:"lastPassAssigned"`
+}
+
+type PoolSchedulingUpdate struct {
+	Paused bool `json:"paused"`
+}
+
+// Why queued sessions are not placed, see CapacityBlocker
+const (
+	// The pool's scheduling is paused
+	BlockerPoolPaused = "poolPaused"
+	// No agent has the labels matched, has taints the session tolerates, or supports the
+	// capabilities required
+	BlockerNoMatchingAgent = "noMatchingAgent"
+	// The agents matching are disabled, draining, or report unhealthy GPUs
+	BlockerAgentsUnavailable = "agentsUnavailable"
+	// No agent matching has as many GPUs as required
+	BlockerGpuCount = "gpuCount"
+	// No agent matching has GPUs with as much VRAM as required, even without sessions
+	BlockerGpuVram = "gpuVram"
+	// An agent matching has the VRAM required available but not on few enough GPUs
+	BlockerFragmentation = "fragmentation"
+	// An agent matching has the VRAM required available on GPUs with their maximum sessions
+	BlockerSessionLimit = "sessionLimit"
+	// No agent matching has the VRAM required available
+	BlockerVram = "insufficientVram"
+)
+
+// Queued sessions not placed for the same reason
+type CapacityBlocker struct {
+	// See Blocker*
+	Reason string `json:"reason"`
+
+	Sessions     int       `json:"sessions"`
+	VramRequired uint64    `json:"vramRequired"`
+	OldestQueued time.Time `json:"oldestQueued"`
+}
+
+// When the demand for VRAM in a pool, its committed VRAM and the VRAM its queued sessions
+// require, is expected to exceed its allocatable VRAM if it keeps the trend it had over the
+// samples taken by the controller
+type CapacityForecast struct {
+	Samples       int     `json:"samples"`
+	WindowSeconds float64 `json:"windowSeconds"`
+
+	// Change in the demand per hour over the window
+	DemandPerHour float64 `json:"demandPerHour"`
+	// Zero when the demand is not growing or there are too few samples to tell
+	ExhaustedAt time.Time `json:"exhaustedAt,omitempty"`
+	// Whether the demand already exceeds the allocatable VRAM
+	Exhausted bool `json:"exhausted"`
+}
+
+// Capacity of a pool, see GET /v1/capacity. Allocatable GPUs and VRAM are those of the agents
+// sessions are placed on, active agents neither draining nor reporting unhealthy GPUs.
+type PoolCapacity struct {
+	Pool   string `json:"pool"`
+	Paused bool   `json:"paused"`
+
+	Agents            int `json:"agents"`
+	AllocatableAgents int `json:"allocatableAgents"`
+
+	Gpus            int    `json:"gpus"`
+	AllocatableGpus int    `json:"allocatableGpus"`
+	Vram            uint64 `json:"vram"`
+	AllocatableVram uint64 `json:"allocatableVram"`
+
+	// VRAM reserved by and GPUs with the sessions placed on the allocatable agents
+	CommittedVram uint64 `json:"committedVram"`
+	CommittedGpus int    `json:"committedGpus"`
+
+	// Fraction of the allocatable VRAM available not usable by a single allocation, see
+	// Agent.VramFragmentation, and the most VRAM available on a single GPU
+	Fragmentation        float64 `json:"fragmentation"`
+	LargestVramAvailable uint64  `json:"largestVramAvailable"`
+
+	Queued             int    `json:"queued"`
+	QueuedVramRequired uint64 `json:"queuedVramRequired"`
+
+	// The most common reasons queued sessions are not placed, most sessions first
+	Blockers []CapacityBlocker `json:"blockers"`
+
+	Forecast CapacityForecast `json:"forecast"`
+}
+
+// The changes that let sessions not placed be placed, see PlacementSuggestion
+const (
+	// The pool's scheduling is paused, an operator resumes it
+	SuggestionResumePool = "resumePool"
+	// Requiring at most VramRequired bytes of VRAM on each GPU
+	SuggestionReduceVram = "reduceVram"
+	// Requiring Gpus GPUs
+	SuggestionReduceGpus = "reduceGpus"
+	// Allowing the session to fall back to CPU rendering
+	SuggestionAllowCpuFallback = "allowCpuFallback"
+	// Tolerating the taints of the agent in Tolerates
+	SuggestionTolerateTaints = "tolerateTaints"
+	// Not matching the labels in RemoveLabels
+	SuggestionDropLabels = "dropLabels"
+	// Not requiring the capabilities in RemoveCapabilities
+	SuggestionDropCapabilities = "dropCapabilities"
+	// Tolerating, not matching, and not requiring more than one of the above to match the agent
+	SuggestionMatchAgent = "matchAgent"
+	// Waiting for the sessions in Sessions to close on the agent
+	SuggestionWaitForSessions = "waitForSessions"
+	// Waiting for an agent that is disabled, draining, or reports unhealthy GPUs to return
+	SuggestionWaitForAgent = "waitForAgent"
+)
+
+// The smallest change of its kind that lets the session be placed on its own
+type PlacementSuggestion struct {
+	// One of Suggestion*
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+
+	// The agent the session would be placed on
+	AgentId  string `json:"agentId,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+
+	VramRequired       uint64            `json:"vramRequired,omitempty"`
+	Gpus               int               `json:"gpus,omitempty"`
+	Tolerates          map[string]string `json:"tolerates,omitempty"`
+	RemoveLabels       []string          `json:"removeLabels,omitempty"`
+	RemoveCapabilities []string          `json:"removeCapabilities,omitempty"`
+	Sessions           []string          `json:"sessions,omitempty"`
+
+	// When the sessions waited for are expected to have closed, from their reservations and
+	// whether they are already canceling. Zero when unknown.
+	ReadyAt time.Time `json:"readyAt,omitempty"`
+}
+
+// Whether sessions with the requirements would be placed by the next scheduling pass, after the
+// sessions queued ahead of them, and if not why and what would let them be placed, see
+// POST /v1/analyze/session and GET /v1/session/{id}/analysis
+type PlacementAnalysis struct {
+	Pool        string `json:"pool"`
+	Schedulable bool   `json:"schedulable"`
+	// See Blocker*, empty when schedulable
+	Blocker string `json:"blocker,omitempty"`
+
+	// Changes to the requirements first, ordered by kind
+	Suggestions []PlacementSuggestion `json:"suggestions"`
+}
+
+// A session placed on an agent
+type PlacedSession struct {
+	Session
+
+	AgentId  string `json:"agentId"`
+	Hostname string `json:"hostname"`
+}
+
+// Filters and pages the agents of GET /v1/agents and the sessions of GET /v1/sessions, empty
+// fields match everything. The number matching across every page is returned in the
+// TotalCountHeader header.
+type ListQuery struct {
+	// See Agent* and Session*
+	State string
+	// Agents with every label, or the sessions placed on them
+	Labels map[string]string
+	// Agents with a GPU of the name, such as NVIDIA GeForce RTX 4090, or the sessions using one
+	GpuName string
+
+	// Skips this many agents or sessions, ordered by id
+	Offset int
+	// Returns at most this many agents or sessions, every one when 0
+	Limit int
+
+	// Continues a listing from the page returned with the cursor in its NextCursorHeader header,
+	// the query must have the same filters. The first page of a listing with more pages records
+	// a snapshot of the agents or sessions matching, which the following pages are read from:
+	// every page lists them as they were when the first page was listed, none are skipped or
+	// listed twice as they change, and the total stays the same. Cursors expire 10 minutes after
+	// the first page was listed. Mutually exclusive with Offset.
+	Cursor string
+
+	// Set by the controller from Cursor rather than taken from the request, along with Offset.
+	// Reads the page from the snapshot recorded by the first page.
+	Snapshot string
+}
+
+// A page of the agents or sessions matching a ListQuery
+type ListPage[T any] struct {
+	Items []T
+	// The number matching across every page, see TotalCountHeader
+	Total int
+	// Lists the next page when set, see ListQuery.Cursor
+	NextCursor string
+}
+
+// Returns the query parameters of the query
+func (query ListQuery) Encode() string {
+	values := url.Values{}
+	if query.State != "" {
+		values.Set("state", query.State)
+	}
+
+	for key, value := range query.Labels {
+		values.Add("label", fmt.Sprint(key, "=", value))
+	}
+
+	if query.GpuName != "" {
+		values.Set("gpu", query.GpuName)
+	}
+
+	if query.Offset > 0 {
+		values.Set("offset", strconv.Itoa(query.Offset))
+	}
+
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	if query.Cursor != "" {
+		values.Set("cursor", query.Cursor)
+	}
+
+	return values.Encode()
+}
+
+// The number of agents or sessions matching a ListQuery across every page
+const TotalCountHeader = "Juice-Total-Count"
+
+// The cursor listing the page after the one returned with it, not set on the last page, see
+// ListQuery.Cursor
+const NextCursorHeader = "Juice-Next-Cursor"
+
+// How the controller placed a session, attached to bug reports by juicify report
+type SessionTrace struct {
+	Session Session `json:"session"`
+
+	// The agent the session was last placed on without its sessions, nil when never placed
+	Agent *Agent `json:"agent,omitempty"`
+
+	// The events published about the session in order, as far back as the controller's
+	// --event-retention
+	Events []Event `json:"events"`
+}
+
+// A session waiting to be placed on an agent
+type QueuedSession struct {
+	Id   string `json:"id"`
+	Pool string `json:"pool"`
+
+	Requirements SessionRequirements `json:"requirements"`
+	RequestedAt  time.Time           `json:"requestedAt"`
+}
+
+// The credentials revoked, see Revocation
+const (
+	// A token of the controller's authorization policy, by its name
+	RevocationToken = "token"
+	// Every credential of a user, by the user a token names or the common name of a certificate,
+	// including the requests of service accounts on behalf of the user
+	RevocationUser = "user"
+)
+
+// Rejects the requests presenting a credential until the revocation is removed, for offboarding
+// and incident response. The queued sessions requested with the credential are canceled when it
+// is revoked.
+type Revocation struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"subject"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Also cancels the sessions requested with the credential that are placed on agents
+	EvictSessions bool `json:"evictSessions,omitempty"`
+
+	// Set by the controller
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+// The lease of the controller replica running the scheduling loop among replicas sharing their
+// storage, see the controller's --leader-election and GET /v1/leader
+const SchedulerLease = "scheduler"
+
+// Held by one holder at a time until it expires unless the holder renews it
+type Lease struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder"`
+
+	// When the holder acquired the lease, kept as it renews it
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type RevocationResult struct {
+	Revocation Revocation `json:"revocation"`
+
+	// The sessions canceled, queued or, when evicted, placed on agents
+	CanceledSessions []string `json:"canceledSessions"`
+}
+
+// A bearer token minted by the controller for clients to request and look up sessions with, see
+// the controller's --require-client-tokens. Only a hash of the token is stored, the token itself
+// is returned once when it is minted.
+type ApiToken struct {
+	Id string `json:"id"`
+	// Identifies the token without disclosing it, recorded as the TokenName of the sessions
+	// requested with it so revoking the token cancels them, see RevocationToken
+	Name string `json:"name"`
+	// The user recorded on the sessions requested with the token
+	User string `json:"user,omitempty"`
+
+	// Set by the controller
+	CreatedAt time.Time `json:"createdAt"`
+	// The token is rejected from then on, zero when it does not expire
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+
+	// Only returned when the token is minted
+	Token string `json:"token,omitempty"`
+}
+
+type ApiTokenRequest struct {
+	Name string `json:"name"`
+	User string `json:"user,omitempty"`
+
+	// Seconds until the token expires, 0 when it does not
+	TtlSeconds int `json:"ttlSeconds,omitempty"`
+}
+
+// Returns whether the token has expired at the time
+func (token ApiToken) Expired(now time.Time) bool {
+	return !token.ExpiresAt.IsZero() && !now.Before(token.ExpiresAt)
+}
+
+// Structured error returned by /v2 routes
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err Error) Error() string {
+	return fmt.Sprintf("error received from server, code %d (%s)\nmessage: %s", err.Status, err.Code, err.Message)
+}
+
+// Matches the kind of error of the status with errors.Is
+func (err Error) Unwrap() error {
+	return pkgerrors.FromHttpStatus(err.Status)
+}
+
+func ErrorCodeFromStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorBadRequest
+	case http.StatusUnauthorized:
+		return ErrorUnauthorized
+	case http.StatusForbidden:
+		return ErrorForbidden
+	case http.StatusNotFound:
+		return ErrorNotFound
+	case http.StatusConflict:
+		return ErrorConflict
+	case http.StatusTooManyRequests:
+		return ErrorQuotaExceeded
+	case http.StatusServiceUnavailable:
+		return ErrorUnavailable
+	}
+
+	return ErrorInternal
+}
+
+// Session request received through an external message queue
+type QueueRequest struct {
+	// Chosen by the requester to correlate results with the request
+	RequestId    string              `json:"requestId"`
+	Requirements SessionRequirements `json:"requirements"`
+}
+
+// Published to the external message queue as the requested session changes state
+type QueueResult struct {
+	RequestId  string `json:"requestId"`
+	SessionId  string `json:"sessionId"`
+	State      string `json:"state"`
+	ExitStatus string `json:"exitStatus,omitempty"`
+	Address    string `json:"address,omitempty"`
+}
+
+// A host in an external inventory, such as a CMDB, whose fields label the agent running on it
+type InventoryRecord struct {
+	// Identifies the host, matching the agent with the hostname or the UUID of one of its GPUs,
+	// compared case-insensitively. GPU UUIDs identify hosts through renames and reinstalls.
+	Fingerprint string `json:"fingerprint"`
+
+	Rack       string `json:"rack,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Owner      string `json:"owner,omitempty"`
+	// The date the host's warranty expires, such as 2025-06-30
+	Warranty string `json:"warranty,omitempty"`
+}
+
+// Returns the labels of the record's fields that are set, by the inventory labels
+func (record InventoryRecord) Labels() map[string]string {
+	labels := map[string]string{}
+	for label, value := range map[string]string{
+		InventoryRackLabel:       record.Rack,
+		InventoryDatacenterLabel: record.Datacenter,
+		InventoryOwnerLabel:      record.Owner,
+		InventoryWarrantyLabel:   record.Warranty,
+	} {
+		if value != "" {
+			labels[label] = value
+		}
+	}
+
+	return labels
 }
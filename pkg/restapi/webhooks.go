@@ -0,0 +1,61 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package restapi
+
+import (
+	"time"
+)
+
+// Types of the webhooks the controller posts to its --webhook-urls
+const (
+	WebhookSessionQueued   = "session.queued"
+	WebhookSessionAssigned = "session.assigned"
+	// Closed with ExitStatusFailure
+	WebhookSessionFailed = "session.failed"
+	// Closed with any other exit status
+	WebhookSessionClosed   = "session.closed"
+	WebhookAgentRegistered = "agent.registered"
+	WebhookAgentMissing    = "agent.missing"
+)
+
+var WebhookTypes = []string{
+	WebhookSessionQueued,
+	WebhookSessionAssigned,
+	WebhookSessionFailed,
+	WebhookSessionClosed,
+	WebhookAgentRegistered,
+	WebhookAgentMissing,
+}
+
+// Header of webhooks holding sha256=<hex HMAC-SHA256 of the body>, keyed by the controller's
+// --webhook-secret-file, see VerifyWebhook
+const WebhookSignatureHeader = SessionCallbackSignatureHeader
+
+// Posted as JSON to the controller's --webhook-urls on the lifecycle changes of sessions and
+// agents. Webhooks are sent at least once, receivers use Id to ignore repeats.
+type Webhook struct {
+	Id   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	SessionId string `json:"sessionId,omitempty"`
+	AgentId   string `json:"agentId,omitempty"`
+
+	// The state and exit status of the session for session webhooks
+	State      string `json:"state,omitempty"`
+	ExitStatus string `json:"exitStatus,omitempty"`
+
+	// The event the webhook was sent for
+	Event Event `json:"event"`
+}
+
+// Returns the value of WebhookSignatureHeader for the body
+func SignWebhook(secret []byte, body []byte) string {
+	return SignSessionCallback(secret, body)
+}
+
+// Returns whether the signature, the value of WebhookSignatureHeader, matches the body
+func VerifyWebhook(secret []byte, body []byte, signature string) bool {
+	return VerifySessionCallback(secret, body, signature)
+}
@@ -0,0 +1,27 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package server
+
+import (
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/task"
+)
+
+// Prefix of the runtime profiling endpoints, see ProfilingEp
+const ProfilingPath = "/debug/pprof/"
+
+// Serves the runtime profiles of net/http/pprof under ProfilingPath. They disclose the process'
+// command line and memory, so callers must restrict them to operators.
+func ProfilingEp(group task.Group, router *mux.Router) error {
+	router.Methods("GET").Path(ProfilingPath + "cmdline").HandlerFunc(pprof.Cmdline)
+	router.Methods("GET").Path(ProfilingPath + "profile").HandlerFunc(pprof.Profile)
+	router.Methods("GET", "POST").Path(ProfilingPath + "symbol").HandlerFunc(pprof.Symbol)
+	router.Methods("GET").Path(ProfilingPath + "trace").HandlerFunc(pprof.Trace)
+	// Serves the index and the named profiles, such as heap and goroutine
+	router.Methods("GET").PathPrefix(ProfilingPath).HandlerFunc(pprof.Index)
+	return nil
+}
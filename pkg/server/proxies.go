@@ -0,0 +1,129 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	trustedProxies = flag.String("trusted-proxies", "", "Comma separated list of CIDRs or IP addresses of the load balancers and proxies in front of the server, the client address of their requests is taken from the X-Forwarded-For header")
+)
+
+const forwardedForHeader = "X-Forwarded-For"
+
+func parseTrustedProxies() ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	if *trustedProxies == "" {
+		return proxies, nil
+	}
+
+	var err error
+	for _, proxy := range strings.Split(*trustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				err = errors.Join(err, fmt.Errorf("'%s' is not an IP address or CIDR", proxy))
+				continue
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, parseErr := net.ParseCIDR(proxy)
+		if parseErr != nil {
+			err = errors.Join(err, fmt.Errorf("'%s' is not an IP address or CIDR", proxy))
+			continue
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --trusted-proxies with %s", err)
+	}
+
+	return proxies, nil
+}
+
+func isTrusted(proxies []*net.IPNet, ip net.IP) bool {
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the address of the client that sent the request through the proxies. Each proxy appends
+// the address it received the request from to X-Forwarded-For, so the header is walked from the
+// right, past the trusted proxies, to the first address a trusted proxy received the request from.
+// Addresses to the left of it were supplied by the client and are not trusted.
+func forwardedFor(proxies []*net.IPNet, header http.Header) net.IP {
+	var addresses []string
+	for _, value := range header.Values(forwardedForHeader) {
+		addresses = append(addresses, strings.Split(value, ",")...)
+	}
+
+	var client net.IP
+	for index := len(addresses) - 1; index >= 0; index-- {
+		ip := net.ParseIP(strings.TrimSpace(addresses[index]))
+		if ip == nil {
+			break
+		}
+
+		client = ip
+		if !isTrusted(proxies, ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// Replaces the RemoteAddr of requests received from trusted proxies with the address of the client.
+// The port the client connected from is not known, it is reported as 0.
+func clientAddressMiddleware(proxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err == nil {
+				peer := net.ParseIP(host)
+				if peer != nil && isTrusted(proxies, peer) {
+					client := forwardedFor(proxies, r.Header)
+					if client != nil {
+						r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Returns the IP address of the client that sent the request, taking --trusted-proxies into account
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return net.ParseIP(r.RemoteAddr)
+	}
+
+	return net.ParseIP(host)
+}
@@ -28,8 +28,14 @@ type Server struct {
 
 	tlsConfig *tls.Config
 
+	// Requests from these addresses are attributed to the client in their X-Forwarded-For header
+	trustedProxies []*net.IPNet
+
 	createEndpoints          map[string]CreateEndpointFn
 	immutableCreateEndpoints []CreateEndpointFn
+
+	// Served without TLS in addition to the address, for listeners securing their own connections
+	listeners []net.Listener
 }
 
 func NewServer(address string, tlsConfig *tls.Config) (*Server, error) {
@@ -47,10 +53,16 @@ func NewServer(address string, tlsConfig *tls.Config) (*Server, error) {
 		return nil, fmt.Errorf("NewServer: address does not contain a valid port")
 	}
 
+	trustedProxies, err := parseTrustedProxies()
+	if err != nil {
+		return nil, fmt.Errorf("NewServer: %s", err)
+	}
+
 	return &Server{
 		url:             url,
 		port:            port,
 		tlsConfig:       tlsConfig,
+		trustedProxies:  trustedProxies,
 		createEndpoints: map[string]CreateEndpointFn{},
 	}, nil
 }
@@ -63,6 +75,10 @@ func (server *Server) AddCreateEndpoint(fn CreateEndpointFn) {
 	server.immutableCreateEndpoints = append(server.immutableCreateEndpoints, fn)
 }
 
+func (server *Server) AddListener(listener net.Listener) {
+	server.listeners = append(server.listeners, listener)
+}
+
 func (server *Server) SetCreateEndpoint(name string, fn CreateEndpointFn) {
 	server.createEndpoints[name] = fn
 }
@@ -88,6 +104,9 @@ func (server *Server) Run(group task.Group) error {
 	}
 
 	loggerRouter := mux.NewRouter().StrictSlash(true)
+	if len(server.trustedProxies) > 0 {
+		loggerRouter.Use(clientAddressMiddleware(server.trustedProxies))
+	}
 	loggerRouter.Use(logger.Middleware)
 	loggerRouter.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		router.ServeHTTP(w, r)
@@ -110,6 +129,13 @@ func (server *Server) Run(group task.Group) error {
 		}
 	})
 
+	for _, listener := range server.listeners {
+		listener := listener
+		group.GoFn(fmt.Sprintf("HTTP Serve %s", listener.Addr()), func(group task.Group) error {
+			return httpServer.Serve(listener)
+		})
+	}
+
 	group.GoFn("HTTP Shutdown", func(group task.Group) error {
 		<-group.Ctx().Done()
 
@@ -0,0 +1,600 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Each frame starts with its kind and a value
+const (
+	// Opens a connection, the value is 0 followed by the connection's id. Listeners answer with a
+	// hello of their own.
+	frameHello byte = iota + 1
+	// Resumes a connection, the value is the bytes received so far followed by the connection's id.
+	// Listeners answer with a hello.
+	frameResume
+	// The value is the length of the data that follows
+	frameData
+	// The value is the bytes the reader consumed, which the writer no longer keeps
+	frameAck
+	// The writer closed the connection
+	frameFin
+)
+
+const (
+	frameHeaderSize = 9
+	idSize          = 16
+
+	// Data frames are split to at most this size
+	maxFrameSize = 64 * 1024
+
+	// Writers block once the peer has not acknowledged this much, bounding what is kept to resend
+	maxUnacked = 4 * 1024 * 1024
+
+	// Readers acknowledge each time they consume this much
+	ackInterval = 64 * 1024
+)
+
+var (
+	ErrResumeTimeout = errors.New("transport: the connection was not resumed in time")
+	ErrUnknownId     = errors.New("transport: the peer no longer knows the connection")
+	errProtocol      = errors.New("transport: protocol violation")
+)
+
+func writeFrame(stream quic.Stream, kind byte, value uint64, payload []byte) error {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint64(frame[1:], value)
+
+	_, err := stream.Write(append(frame, payload...))
+	return err
+}
+
+func readFrameHeader(stream quic.Stream) (byte, uint64, error) {
+	var header [frameHeaderSize]byte
+	_, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return header[0], binary.BigEndian.Uint64(header[1:]), nil
+}
+
+func writeHello(stream quic.Stream, kind byte, id [idSize]byte, received uint64) error {
+	return writeFrame(stream, kind, received, id[:])
+}
+
+// Returns the kind of the hello, the connection it names, and the bytes the peer received
+func readHello(stream quic.Stream) (byte, [idSize]byte, uint64, error) {
+	var id [idSize]byte
+
+	kind, received, err := readFrameHeader(stream)
+	if err != nil {
+		return 0, id, 0, err
+	}
+
+	if kind != frameHello && kind != frameResume {
+		return 0, id, 0, fmt.Errorf("%w, expected a hello frame, received %d", errProtocol, kind)
+	}
+
+	_, err = io.ReadFull(stream, id[:])
+	return kind, id, received, err
+}
+
+// A connection carried by a QUIC stream that survives the loss of its QUIC connection. The data
+// written is kept until the peer acknowledges it, so when the dialer reconnects, such as after a
+// laptop moves from Wi-Fi to a wired network, the connection resumes on a new stream and each side
+// resends what the other did not receive. Connections not resumed within their resume timeout fail.
+type Conn struct {
+	id            [idSize]byte
+	resumeTimeout time.Duration
+
+	// Called once the connection is done with
+	onFinish func(*Conn)
+
+	// Orders the frames written to the stream
+	writeMutex sync.Mutex
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	stream     quic.Stream
+	connection quic.Connection
+	stats      *connectionStats
+	// Closed when the reader of the stream returns
+	readerDone chan struct{}
+	detached   *time.Timer
+
+	// Written, not acknowledged by the peer, starting at offset acked
+	unacked []byte
+	acked   uint64
+	written uint64
+
+	readBuffer []byte
+	received   uint64
+	consumed   uint64
+	ackSent    uint64
+
+	localFin  bool
+	remoteFin bool
+	closed    bool
+	finished  bool
+	err       error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Of the QUIC connections the connection has since left
+	lostPackets uint64
+	resumes     int
+}
+
+func newConn(id [idSize]byte, resumeTimeout time.Duration, onFinish func(*Conn)) *Conn {
+	conn := &Conn{
+		id:            id,
+		resumeTimeout: resumeTimeout,
+		onFinish:      onFinish,
+	}
+	conn.cond = sync.NewCond(&conn.mutex)
+
+	return conn
+}
+
+// Stops using the current stream, returning once its reader has, so the bytes received are final
+func (conn *Conn) detach(stream quic.Stream) {
+	conn.mutex.Lock()
+	if stream == nil {
+		stream = conn.stream
+	}
+
+	if stream == nil || conn.stream != stream {
+		conn.mutex.Unlock()
+		return
+	}
+
+	readerDone := conn.readerDone
+
+	conn.stream = nil
+	if conn.stats != nil {
+		conn.lostPackets += conn.stats.lost()
+	}
+	conn.stats = nil
+
+	if !conn.finished && conn.detached == nil {
+		conn.detached = time.AfterFunc(conn.resumeTimeout, func() {
+			conn.fail(ErrResumeTimeout)
+		})
+	}
+	conn.cond.Broadcast()
+	conn.mutex.Unlock()
+
+	stream.CancelRead(0)
+	stream.CancelWrite(0)
+
+	<-readerDone
+}
+
+// Continues the connection on the stream, resending what the peer did not receive
+func (conn *Conn) attach(connection quic.Connection, stream quic.Stream, peerReceived uint64) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	conn.mutex.Lock()
+	if conn.finished {
+		conn.mutex.Unlock()
+		return net.ErrClosed
+	}
+
+	if peerReceived < conn.acked || peerReceived > conn.written {
+		conn.mutex.Unlock()
+		return fmt.Errorf("%w, the peer received %d bytes of the %d to %d kept", errProtocol, peerReceived, conn.acked, conn.written)
+	}
+
+	conn.unacked = conn.unacked[peerReceived-conn.acked:]
+	conn.acked = peerReceived
+	pending := append([]byte{}, conn.unacked...)
+	localFin := conn.localFin
+
+	if conn.detached != nil {
+		conn.detached.Stop()
+		conn.detached = nil
+	}
+
+	if conn.connection != nil {
+		conn.resumes++
+	}
+
+	conn.stream = stream
+	conn.connection = connection
+	conn.stats = statsOf(connection)
+	conn.readerDone = make(chan struct{})
+	go conn.read(stream, conn.readerDone)
+
+	conn.cond.Broadcast()
+	conn.mutex.Unlock()
+
+	var err error
+	for len(pending) > 0 && err == nil {
+		chunk := pending
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		pending = pending[len(chunk):]
+
+		err = writeFrame(stream, frameData, uint64(len(chunk)), chunk)
+	}
+
+	if err == nil && localFin {
+		err = writeFrame(stream, frameFin, 0, nil)
+	}
+
+	if err != nil {
+		go conn.detach(stream)
+	}
+
+	return nil
+}
+
+func (conn *Conn) read(stream quic.Stream, done chan struct{}) {
+	defer close(done)
+
+	for {
+		kind, value, err := readFrameHeader(stream)
+		if err == nil {
+			switch kind {
+			case frameData:
+				if value > maxFrameSize {
+					err = fmt.Errorf("%w, data frame of %d bytes", errProtocol, value)
+					break
+				}
+
+				data := make([]byte, value)
+				_, err = io.ReadFull(stream, data)
+				if err == nil {
+					conn.mutex.Lock()
+					conn.readBuffer = append(conn.readBuffer, data...)
+					conn.received += value
+					conn.cond.Broadcast()
+					conn.mutex.Unlock()
+				}
+
+			case frameAck:
+				conn.mutex.Lock()
+				if value > conn.acked && value <= conn.written {
+					conn.unacked = conn.unacked[value-conn.acked:]
+					conn.acked = value
+					conn.cond.Broadcast()
+				}
+				conn.mutex.Unlock()
+
+			case frameFin:
+				conn.mutex.Lock()
+				conn.remoteFin = true
+				conn.cond.Broadcast()
+				conn.mutex.Unlock()
+
+			default:
+				err = fmt.Errorf("%w, unknown frame %d", errProtocol, kind)
+			}
+		}
+
+		if err != nil {
+			conn.mutex.Lock()
+			done := conn.remoteFin || conn.finished
+			conn.mutex.Unlock()
+
+			// The stream ends once the peer closes the connection
+			if !done {
+				go conn.detach(stream)
+			}
+			return
+		}
+	}
+}
+
+// Fails the connection, its reads and writes return err
+func (conn *Conn) fail(err error) {
+	conn.mutex.Lock()
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.mutex.Unlock()
+
+	conn.finish()
+}
+
+func (conn *Conn) finish() {
+	conn.mutex.Lock()
+	if conn.finished {
+		conn.mutex.Unlock()
+		return
+	}
+
+	conn.finished = true
+	if conn.detached != nil {
+		conn.detached.Stop()
+		conn.detached = nil
+	}
+	stream := conn.stream
+	conn.cond.Broadcast()
+	conn.mutex.Unlock()
+
+	if stream != nil {
+		// The frames written are still delivered
+		stream.Close()
+		stream.CancelRead(0)
+	}
+
+	if conn.onFinish != nil {
+		conn.onFinish(conn)
+	}
+}
+
+// Waits on the condition until the deadline, returning os.ErrDeadlineExceeded once it passes
+func (conn *Conn) wait(deadline time.Time) error {
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.AfterFunc(remaining, func() {
+			conn.mutex.Lock()
+			conn.cond.Broadcast()
+			conn.mutex.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	conn.cond.Wait()
+	return nil
+}
+
+func (conn *Conn) Read(p []byte) (int, error) {
+	conn.mutex.Lock()
+
+	for len(conn.readBuffer) == 0 {
+		if conn.closed {
+			conn.mutex.Unlock()
+			return 0, net.ErrClosed
+		}
+
+		if conn.remoteFin {
+			conn.mutex.Unlock()
+			return 0, io.EOF
+		}
+
+		if conn.err != nil {
+			err := conn.err
+			conn.mutex.Unlock()
+			return 0, err
+		}
+
+		err := conn.wait(conn.readDeadline)
+		if err != nil {
+			conn.mutex.Unlock()
+			return 0, err
+		}
+	}
+
+	n := copy(p, conn.readBuffer)
+	conn.readBuffer = conn.readBuffer[n:]
+	conn.consumed += uint64(n)
+
+	ack := conn.consumed-conn.ackSent >= ackInterval
+	if ack {
+		conn.ackSent = conn.consumed
+	}
+	consumed := conn.consumed
+	conn.mutex.Unlock()
+
+	if ack {
+		conn.writeMutex.Lock()
+		conn.mutex.Lock()
+		stream := conn.stream
+		conn.mutex.Unlock()
+
+		// A detached connection acknowledges when it resumes
+		if stream != nil {
+			err := writeFrame(stream, frameAck, consumed, nil)
+			if err != nil {
+				go conn.detach(stream)
+			}
+		}
+		conn.writeMutex.Unlock()
+	}
+
+	return n, nil
+}
+
+func (conn *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+
+		conn.mutex.Lock()
+		for len(conn.unacked) >= maxUnacked && !conn.closed && !conn.localFin && conn.err == nil {
+			err := conn.wait(conn.writeDeadline)
+			if err != nil {
+				conn.mutex.Unlock()
+				return written, err
+			}
+		}
+		conn.mutex.Unlock()
+
+		conn.writeMutex.Lock()
+		conn.mutex.Lock()
+		if conn.closed || conn.localFin || conn.finished {
+			err := conn.err
+			if err == nil {
+				err = net.ErrClosed
+			}
+
+			conn.mutex.Unlock()
+			conn.writeMutex.Unlock()
+			return written, err
+		}
+
+		conn.unacked = append(conn.unacked, chunk...)
+		conn.written += uint64(len(chunk))
+		stream := conn.stream
+		conn.mutex.Unlock()
+
+		// Written once the connection resumes otherwise
+		if stream != nil {
+			err := writeFrame(stream, frameData, uint64(len(chunk)), chunk)
+			if err != nil {
+				go conn.detach(stream)
+			}
+		}
+		conn.writeMutex.Unlock()
+
+		written += len(chunk)
+	}
+
+	return written, nil
+}
+
+// Closes the writing side of the connection, the peer reads io.EOF once it has read everything
+// written before
+func (conn *Conn) CloseWrite() error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	conn.mutex.Lock()
+	if conn.localFin || conn.finished {
+		conn.mutex.Unlock()
+		return nil
+	}
+
+	conn.localFin = true
+	stream := conn.stream
+	conn.cond.Broadcast()
+	conn.mutex.Unlock()
+
+	if stream != nil {
+		err := writeFrame(stream, frameFin, 0, nil)
+		if err != nil {
+			go conn.detach(stream)
+		}
+	}
+
+	return nil
+}
+
+func (conn *Conn) Close() error {
+	err := conn.CloseWrite()
+
+	conn.mutex.Lock()
+	conn.closed = true
+	conn.cond.Broadcast()
+	conn.mutex.Unlock()
+
+	conn.finish()
+	return err
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.connection == nil {
+		return &net.UDPAddr{}
+	}
+
+	return conn.connection.LocalAddr()
+}
+
+// Returns the address of the peer on the QUIC connection the connection is or was last on
+func (conn *Conn) RemoteAddr() net.Addr {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.connection == nil {
+		return &net.UDPAddr{}
+	}
+
+	return conn.connection.RemoteAddr()
+}
+
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = t
+	conn.writeDeadline = t
+	conn.cond.Broadcast()
+	return nil
+}
+
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = t
+	conn.cond.Broadcast()
+	return nil
+}
+
+// Bounds the time writes wait for the peer to acknowledge, writes to the stream are not
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.writeDeadline = t
+	conn.cond.Broadcast()
+	return nil
+}
+
+// The statistics of a connection, see Conn.Stats
+type Stats struct {
+	// Sent and acknowledged by the peer
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// Smoothed round trip time of the QUIC connection the connection is on, 0 while detached
+	Rtt time.Duration
+
+	// Lost on every QUIC connection the connection was on, and resent by QUIC
+	LostPackets uint64
+
+	// Times the connection moved to a new QUIC connection
+	Resumes int
+
+	// Whether the connection is done with, it no longer resumes
+	Finished bool
+}
+
+func (conn *Conn) Stats() Stats {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	stats := Stats{
+		BytesSent:     conn.acked,
+		BytesReceived: conn.received,
+		LostPackets:   conn.lostPackets,
+		Resumes:       conn.resumes,
+		Finished:      conn.finished,
+	}
+
+	if conn.stats != nil {
+		stats.Rtt = conn.stats.rtt()
+		stats.LostPackets += conn.stats.lost()
+	}
+
+	return stats
+}
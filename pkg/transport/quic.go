@@ -0,0 +1,479 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+
+	"github.com/Juice-Labs/Juice-Labs/pkg/logger"
+)
+
+// Negotiated by TLS, so other QUIC protocols on the port are refused
+const Alpn = "juice"
+
+const (
+	// A QUIC connection silent for this long is lost, the keep alives are sent often enough that
+	// only a network change or outage silences it
+	maxIdleTimeout  = 5 * time.Second
+	keepAlivePeriod = time.Second
+
+	// Bounds the time a peer takes to open or resume a connection on a new stream
+	helloTimeout = 10 * time.Second
+
+	// Between attempts of the dialer to reconnect
+	minRedialDelay = 250 * time.Millisecond
+	maxRedialDelay = 2 * time.Second
+)
+
+// The statistics QUIC reports for one of its connections
+type connectionStats struct {
+	mutex       sync.Mutex
+	smoothedRtt time.Duration
+
+	lostPackets atomic.Uint64
+}
+
+func (stats *connectionStats) rtt() time.Duration {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	return stats.smoothedRtt
+}
+
+func (stats *connectionStats) lost() uint64 {
+	return stats.lostPackets.Load()
+}
+
+// The statistics of the open QUIC connections by tracing id
+var tracedConnections sync.Map
+
+func tracer(ctx context.Context, perspective logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+	tracingId, ok := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+
+	stats := &connectionStats{}
+	tracedConnections.Store(tracingId, stats)
+
+	return &logging.ConnectionTracer{
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			stats.mutex.Lock()
+			stats.smoothedRtt = rttStats.SmoothedRTT()
+			stats.mutex.Unlock()
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			stats.lostPackets.Add(1)
+		},
+		Close: func() {
+			tracedConnections.Delete(tracingId)
+		},
+	}
+}
+
+func statsOf(connection quic.Connection) *connectionStats {
+	tracingId, ok := connection.Context().Value(quic.ConnectionTracingKey).(uint64)
+	if ok {
+		if stats, found := tracedConnections.Load(tracingId); found {
+			return stats.(*connectionStats)
+		}
+	}
+
+	return &connectionStats{}
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  maxIdleTimeout,
+		KeepAlivePeriod: keepAlivePeriod,
+		Tracer:          tracer,
+	}
+}
+
+// Returns a copy of the TLS configuration negotiating the protocol
+func withAlpn(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{Alpn}
+	tlsConfig.MinVersion = tls.VersionTLS13
+
+	return tlsConfig
+}
+
+func newId() ([idSize]byte, error) {
+	var id [idSize]byte
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// Accepts connections over QUIC, as a net.Listener so HTTP servers serve them. The connections
+// resume on the new QUIC connections of their dialer, see Conn.
+type Listener struct {
+	listener      *quic.Listener
+	resumeTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	accepted chan *Conn
+
+	mutex sync.Mutex
+	conns map[[idSize]byte]*Conn
+}
+
+func Listen(address string, tlsConfig *tls.Config, resumeTimeout time.Duration) (*Listener, error) {
+	listener, err := quic.ListenAddr(address, withAlpn(tlsConfig), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	quicListener := &Listener{
+		listener:      listener,
+		resumeTimeout: resumeTimeout,
+		ctx:           ctx,
+		cancel:        cancel,
+		accepted:      make(chan *Conn),
+		conns:         map[[idSize]byte]*Conn{},
+	}
+
+	go quicListener.acceptConnections()
+
+	return quicListener, nil
+}
+
+func (listener *Listener) acceptConnections() {
+	for {
+		connection, err := listener.listener.Accept(listener.ctx)
+		if err != nil {
+			return
+		}
+
+		go listener.acceptStreams(connection)
+	}
+}
+
+func (listener *Listener) acceptStreams(connection quic.Connection) {
+	for {
+		stream, err := connection.AcceptStream(listener.ctx)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			err := listener.hello(connection, stream)
+			if err != nil {
+				logger.Debugf("transport: unable to open a connection from %s, %v", connection.RemoteAddr(), err)
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+			}
+		}()
+	}
+}
+
+// Opens the connection named by the hello of the stream, or resumes it
+func (listener *Listener) hello(connection quic.Connection, stream quic.Stream) error {
+	err := stream.SetReadDeadline(time.Now().Add(helloTimeout))
+	if err != nil {
+		return err
+	}
+
+	kind, id, peerReceived, err := readHello(stream)
+	if err != nil {
+		return err
+	}
+
+	err = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	listener.mutex.Lock()
+	conn, found := listener.conns[id]
+	if kind == frameResume && !found {
+		listener.mutex.Unlock()
+		return ErrUnknownId
+	} else if kind == frameHello {
+		if found || peerReceived != 0 {
+			listener.mutex.Unlock()
+			return fmt.Errorf("%w, the hello names a connection already open", errProtocol)
+		}
+
+		conn = newConn(id, listener.resumeTimeout, listener.forget)
+		listener.conns[id] = conn
+	}
+	listener.mutex.Unlock()
+
+	// The stream of the QUIC connection the dialer left may not have failed yet
+	conn.detach(nil)
+
+	conn.mutex.Lock()
+	received := conn.received
+	conn.mutex.Unlock()
+
+	err = writeHello(stream, frameHello, id, received)
+	if err == nil {
+		err = conn.attach(connection, stream, peerReceived)
+	}
+
+	if err != nil {
+		if !found {
+			conn.fail(err)
+		}
+		return err
+	}
+
+	if !found {
+		select {
+		case listener.accepted <- conn:
+		case <-listener.ctx.Done():
+			conn.Close()
+		}
+	}
+
+	return nil
+}
+
+func (listener *Listener) forget(conn *Conn) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	delete(listener.conns, conn.id)
+}
+
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.accepted:
+		return conn, nil
+
+	case <-listener.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops accepting connections, the connections accepted stay open until their QUIC connection is
+// lost
+func (listener *Listener) Close() error {
+	listener.cancel()
+	return listener.listener.Close()
+}
+
+func (listener *Listener) Addr() net.Addr {
+	return listener.listener.Addr()
+}
+
+// Dials connections over a QUIC connection to the listener at an address, reconnecting when the
+// QUIC connection is lost and resuming its connections on the new one
+type Dialer struct {
+	address       string
+	tlsConfig     *tls.Config
+	resumeTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex      sync.Mutex
+	connection quic.Connection
+	conns      map[[idSize]byte]*Conn
+}
+
+// Connects to the listener, failing when it does not accept QUIC connections
+func Dial(ctx context.Context, address string, tlsConfig *tls.Config, resumeTimeout time.Duration) (*Dialer, error) {
+	dialerCtx, cancel := context.WithCancel(context.Background())
+
+	dialer := &Dialer{
+		address:       address,
+		tlsConfig:     withAlpn(tlsConfig),
+		resumeTimeout: resumeTimeout,
+		ctx:           dialerCtx,
+		cancel:        cancel,
+		conns:         map[[idSize]byte]*Conn{},
+	}
+
+	connection, err := quic.DialAddr(ctx, address, dialer.tlsConfig, quicConfig())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	dialer.connection = connection
+	go dialer.reconnect(connection)
+
+	return dialer, nil
+}
+
+// Opens or resumes the connection on a new stream of the QUIC connection
+func (dialer *Dialer) open(ctx context.Context, connection quic.Connection, conn *Conn) error {
+	stream, err := connection.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn.mutex.Lock()
+	received := conn.received
+	kind := frameHello
+	if conn.connection != nil {
+		kind = frameResume
+	}
+	conn.mutex.Unlock()
+
+	err = stream.SetReadDeadline(time.Now().Add(helloTimeout))
+	if err == nil {
+		err = writeHello(stream, kind, conn.id, received)
+	}
+
+	var id [idSize]byte
+	var peerReceived uint64
+	if err == nil {
+		kind, id, peerReceived, err = readHello(stream)
+	}
+
+	if err == nil && (kind != frameHello || id != conn.id) {
+		err = fmt.Errorf("%w, the hello names another connection", errProtocol)
+	}
+
+	if err == nil {
+		err = stream.SetReadDeadline(time.Time{})
+	}
+
+	if err == nil {
+		err = conn.attach(connection, stream, peerReceived)
+	}
+
+	if err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+	}
+
+	return err
+}
+
+// Opens a connection to the listener
+func (dialer *Dialer) DialContext(ctx context.Context) (*Conn, error) {
+	id, err := newId()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newConn(id, dialer.resumeTimeout, dialer.forget)
+
+	dialer.mutex.Lock()
+	connection := dialer.connection
+	if connection == nil {
+		dialer.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	dialer.conns[id] = conn
+	dialer.mutex.Unlock()
+
+	err = dialer.open(ctx, connection, conn)
+	if err != nil {
+		conn.fail(err)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (dialer *Dialer) forget(conn *Conn) {
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+
+	delete(dialer.conns, conn.id)
+}
+
+// Waits for the QUIC connection to be lost, then reconnects and resumes its connections
+func (dialer *Dialer) reconnect(connection quic.Connection) {
+	select {
+	case <-dialer.ctx.Done():
+		return
+	case <-connection.Context().Done():
+	}
+
+	logger.Infof("transport: the QUIC connection to %s was lost, reconnecting", dialer.address)
+
+	ctx, cancel := context.WithTimeout(dialer.ctx, dialer.resumeTimeout)
+	defer cancel()
+
+	delay := minRedialDelay
+	for {
+		// A new socket, bound to the addresses of the network now used
+		next, err := quic.DialAddr(ctx, dialer.address, dialer.tlsConfig, quicConfig())
+		if err == nil {
+			connection = next
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Warningf("transport: unable to reconnect to %s, %v", dialer.address, err)
+			return
+		case <-time.After(delay):
+		}
+
+		delay = time.Duration(float64(delay) * 2)
+		if delay > maxRedialDelay {
+			delay = maxRedialDelay
+		}
+	}
+
+	dialer.mutex.Lock()
+	dialer.connection = connection
+	conns := make([]*Conn, 0, len(dialer.conns))
+	for _, conn := range dialer.conns {
+		conns = append(conns, conn)
+	}
+	dialer.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.detach(nil)
+
+		err := dialer.open(ctx, connection, conn)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warningf("transport: unable to resume a connection to %s, %v", dialer.address, err)
+				conn.fail(err)
+			}
+		}
+	}
+
+	logger.Infof("transport: reconnected to %s from %s, resumed %d connections", dialer.address, connection.LocalAddr(), len(conns))
+
+	go dialer.reconnect(connection)
+}
+
+// Closes the QUIC connection and its connections
+func (dialer *Dialer) Close() error {
+	dialer.cancel()
+
+	dialer.mutex.Lock()
+	connection := dialer.connection
+	dialer.connection = nil
+	conns := make([]*Conn, 0, len(dialer.conns))
+	for _, conn := range dialer.conns {
+		conns = append(conns, conn)
+	}
+	dialer.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	if connection != nil {
+		return connection.CloseWithError(0, "")
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package transport
+
+import (
+	"io"
+	"net"
+)
+
+// Closes the writing side of the connection when it has one, the whole connection otherwise
+func closeWrite(conn net.Conn) {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// Copies between the connections until both directions end, then closes them
+func Relay(a net.Conn, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		io.Copy(b, a)
+		closeWrite(b)
+	}()
+
+	io.Copy(a, b)
+	closeWrite(a)
+	<-done
+
+	a.Close()
+	b.Close()
+}
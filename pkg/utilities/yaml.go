@@ -0,0 +1,46 @@
+/*
+ *  Copyright (c) 2023 Juice Technologies, Inc. All Rights Reserved.
+ */
+package utilities
+
+import (
+	"encoding/json"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Writes the value as YAML with the keys and order of its JSON, so the YAML and JSON outputs of
+// the command line tools have the same fields
+func WriteYaml(writer io.Writer, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	// JSON is YAML, decoding it as nodes keeps the order of the fields
+	var node yaml.Node
+	err = yaml.Unmarshal(data, &node)
+	if err != nil {
+		return err
+	}
+	blockStyle(&node)
+
+	encoder := yaml.NewEncoder(writer)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&node)
+	if err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// Clears the flow style and quoting of the JSON the nodes were decoded from, the encoder quotes
+// the strings that need it
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}